@@ -9,12 +9,20 @@ package v1beta1
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/intel/pmem-csi/pkg/types"
 )
 
 // DeviceMode type decleration for allowed driver device managers
@@ -23,7 +31,7 @@ type DeviceMode string
 // Set sets the value
 func (mode *DeviceMode) Set(value string) error {
 	switch value {
-	case string(DeviceModeLVM), string(DeviceModeDirect), string(DeviceModeFake):
+	case string(DeviceModeLVM), string(DeviceModeDirect), string(DeviceModeAuto), string(DeviceModeFake), string(DeviceModeExternal):
 		*mode = DeviceMode(value)
 	case "ndctl":
 		// For backwards-compatibility.
@@ -38,17 +46,25 @@ func (mode *DeviceMode) String() string {
 	return string(*mode)
 }
 
-// +kubebuilder:validation:Enum=lvm,direct
+// +kubebuilder:validation:Enum=lvm,direct,auto
 const (
 	// DeviceModeLVM represents 'lvm' device manager
 	DeviceModeLVM DeviceMode = "lvm"
 	// DeviceModeDirect represents 'direct' device manager
 	DeviceModeDirect DeviceMode = "direct"
+	// DeviceModeAuto lets the node driver choose between 'direct'
+	// and 'lvm' on each node, based on the PMEM it finds or on the
+	// DeviceModeLabel of the node.
+	DeviceModeAuto DeviceMode = "auto"
 	// DeviceModeFake represents a device manager for testing:
 	// volume creation and deletion is just recorded in memory,
 	// without any actual backing store. Such fake volumes cannot
 	// be used for pods.
 	DeviceModeFake DeviceMode = "fake"
+	// DeviceModeExternal represents an out-of-tree device manager
+	// which the node driver calls via gRPC. It cannot be selected
+	// in a PmemCSIDeployment.
+	DeviceModeExternal DeviceMode = "external"
 )
 
 type LogFormat string
@@ -60,6 +76,67 @@ const (
 	LogFormatJSON LogFormat = "json"
 )
 
+// ResourceProfile selects predefined resource requirements for all
+// containers whose requirements are not set explicitly.
+type ResourceProfile string
+
+const (
+	// ResourceProfileSmall has minimal requests, for example for
+	// proof-of-concept clusters.
+	ResourceProfileSmall ResourceProfile = "small"
+	// ResourceProfileMedium has the builtin default requests.
+	ResourceProfileMedium ResourceProfile = "medium"
+	// ResourceProfileLarge has higher requests and also limits,
+	// for production clusters.
+	ResourceProfileLarge ResourceProfile = "large"
+)
+
+// UninstallPolicy determines what happens with the driver when
+// the PmemCSIDeployment gets deleted.
+type UninstallPolicy string
+
+const (
+	// UninstallPolicyDelete removes all objects of the driver.
+	// Volumes and their data remain on the nodes.
+	UninstallPolicyDelete UninstallPolicy = "Delete"
+	// UninstallPolicyRetain keeps the driver running. The operator
+	// removes its owner references from all objects of the driver.
+	UninstallPolicyRetain UninstallPolicy = "Retain"
+	// UninstallPolicyWipe stops the driver and then removes all
+	// volumes, volume groups and namespaces created by it on the
+	// nodes before removing the remaining objects.
+	UninstallPolicyWipe UninstallPolicy = "Wipe"
+)
+
+// RawNamespaceConversion determines on which nodes the node setup
+// DaemonSet converts raw namespaces.
+type RawNamespaceConversion string
+
+const (
+	// RawNamespaceConversionDisabled means that the node setup
+	// DaemonSet does not get deployed.
+	RawNamespaceConversionDisabled RawNamespaceConversion = "disabled"
+	// RawNamespaceConversionLabelledOnly runs the node setup on
+	// nodes with the <driver name>/convert-raw-namespaces=force label.
+	RawNamespaceConversionLabelledOnly RawNamespaceConversion = "labelled-only"
+	// RawNamespaceConversionAll runs the node setup on all nodes
+	// which are not selected by the node selector yet.
+	RawNamespaceConversionAll RawNamespaceConversion = "all"
+)
+
+// PMEMBusType selects PMEM by how it is attached to the node.
+// +kubebuilder:validation:Enum=nvdimm;cxl
+type PMEMBusType string
+
+const (
+	// PMEMBusTypeNVDIMM is PMEM on NVDIMMs.
+	PMEMBusTypeNVDIMM PMEMBusType = "nvdimm"
+	// PMEMBusTypeCXL is persistent memory on CXL Type-3 memory
+	// devices, which the kernel exposes as regions of a "CXL"
+	// nvdimm bus.
+	PMEMBusTypeCXL PMEMBusType = "cxl"
+)
+
 type MutatePods string
 
 const (
@@ -91,10 +168,19 @@ type DeploymentSpec struct {
 	Image string `json:"image,omitempty"`
 	// PullPolicy image pull policy one of Always, Never, IfNotPresent
 	PullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// ImagePullSecrets references secrets in the namespace of the driver
+	// (see Namespace) that are used for pulling the images of all pods
+	// created by the operator.
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 	// ProvisionerImage CSI provisioner sidecar image
 	ProvisionerImage string `json:"provisionerImage,omitempty"`
 	// NodeRegistrarImage CSI node driver registrar sidecar image
 	NodeRegistrarImage string `json:"nodeRegistrarImage,omitempty"`
+	// LivenessProbeImage CSI livenessprobe sidecar image. If set, the sidecar gets
+	// added to the node pods and the driver containers are probed through
+	// dedicated healthz endpoints instead of the Prometheus metrics endpoint.
+	// Empty (= unset) keeps the metrics-based probes.
+	LivenessProbeImage string `json:"livenessProbeImage,omitempty"`
 	// ProvisionerResources Compute resources required by provisioner sidecar container
 	ProvisionerResources *corev1.ResourceRequirements `json:"provisionerResources,omitempty"`
 	// NodeRegistrarResources Compute resources required by node registrar sidecar container
@@ -103,6 +189,11 @@ type DeploymentSpec struct {
 	NodeDriverResources *corev1.ResourceRequirements `json:"nodeDriverResources,omitempty"`
 	// ControllerDriverResources Compute resources required by central driver container
 	ControllerDriverResources *corev1.ResourceRequirements `json:"controllerDriverResources,omitempty"`
+	// ResourceProfile provides the resource requirements of those
+	// containers for which none are set explicitly. The default is
+	// "medium".
+	// +kubebuilder:validation:Enum=small;medium;large
+	ResourceProfile ResourceProfile `json:"resourceProfile,omitempty"`
 	// ControllerTLSSecret used to be the name of a secret which contains ca.crt, tls.crt and tls.key data
 	// for the scheduler extender and pod mutation webhook. It is now unused.
 	//
@@ -129,7 +220,7 @@ type DeploymentSpec struct {
 	// DEPRECATED
 	DeprecatedSchedulerNodePort int32 `json:"schedulerNodePort,omitempty"`
 	// DeviceMode to use to manage PMEM devices.
-	// +kubebuilder:validation:Enum=lvm;direct
+	// +kubebuilder:validation:Enum=lvm;direct;auto
 	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
 	// LogLevel number for the log verbosity
 	LogLevel uint16 `json:"logLevel,omitempty"`
@@ -139,20 +230,311 @@ type DeploymentSpec struct {
 	LogFormat LogFormat `json:"logFormat,omitempty"`
 	// NodeSelector node labels to use for selection of driver node
 	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// NodeSelectorExpressions are additional requirements for the
+	// labels of a driver node, like "storage In (pmem, optane)".
+	// A node must match the NodeSelector and all of these.
+	NodeSelectorExpressions []metav1.LabelSelectorRequirement `json:"nodeSelectorExpressions,omitempty"`
 	// PMEMPercentage represents the percentage of space to be used by the driver in each PMEM region
 	// on every node. Unset (= zero) selects the default of 100%.
 	// This is only valid for driver in LVM mode.
 	// +kubebuilder:validation:Minimum=0
 	// +kubebuilder:validation:Maximum=100
 	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+	// PMEMReserved is the amount of PMEM on each node which does
+	// not get reported as available for new volumes, either as
+	// percentage of the PMEM used by the driver ("10%") or as
+	// size ("16Gi"). Volumes still may use it, which protects
+	// space for ephemeral volumes. Unset (= empty) reserves
+	// nothing.
+	PMEMReserved string `json:"pmemReserved,omitempty"`
+	// SystemRAMPercentage is the percentage of each PMEM region on
+	// every node which gets onlined as system RAM with the kmem
+	// driver, for example for memory tiering. That part is not
+	// available for volumes. Unset (= zero) disables it. Only
+	// supported in LVM and direct mode.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	SystemRAMPercentage uint16 `json:"systemRAMPercentage,omitempty"`
+	// PMEMBusTypes limits the driver to PMEM of these types:
+	// "nvdimm" for NVDIMMs, "cxl" for CXL memory devices. Unset
+	// (= empty) uses all PMEM found on a node.
+	PMEMBusTypes []PMEMBusType `json:"pmemBusTypes,omitempty"`
+	// PMEMPools define named subsets of the regions on each node.
+	// A storage class selects one of them with the "pool"
+	// parameter. Unset (= empty) defines no pools.
+	PMEMPools []PMEMPoolSpec `json:"pmemPools,omitempty"`
+	// NodeModes run the node driver with a different device mode
+	// or PMEM percentage on some of the nodes. Each entry gets its
+	// own DaemonSet, the remaining nodes are handled by the default
+	// one. The node selectors of different entries must not
+	// select the same node.
+	NodeModes []NodeModeSpec `json:"nodeModes,omitempty"`
+	// RawNamespaceConversion determines on which nodes raw namespaces
+	// get converted for use by the driver. The default is
+	// "labelled-only".
+	// +kubebuilder:validation:Enum=disabled;labelled-only;all
+	RawNamespaceConversion RawNamespaceConversion `json:"rawNamespaceConversion,omitempty"`
+	// RawNamespaceConversionDryRun only checks which raw namespaces
+	// would get converted and reports that in the node status,
+	// without modifying the nodes.
+	RawNamespaceConversionDryRun bool `json:"rawNamespaceConversionDryRun,omitempty"`
+	// PMEMGoal lets the node setup provision NVDIMMs which have
+	// no PMEM regions yet with ipmctl. The new regions only
+	// appear after a reboot of the node. Needs raw namespace
+	// conversion.
+	PMEMGoal *PMEMGoalSpec `json:"pmemGoal,omitempty"`
+	// NodeDiscovery deploys a DaemonSet which checks all nodes that
+	// lack the labels of the node selector for PMEM and adds those
+	// labels to the nodes which have PMEM, so they do not need to
+	// be labelled manually.
+	NodeDiscovery bool `json:"nodeDiscovery,omitempty"`
 	// Labels contains additional labels for all objects created by the operator.
 	Labels map[string]string `json:"labels,omitempty"`
+	// Annotations contains additional annotations for all objects created
+	// by the operator and for the pods of the driver.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// RestartedAt, when changed, causes a rolling restart of the
+	// controller and node driver pods, for example after changing
+	// the PMEM configuration of the hosts.
+	// +nullable
+	RestartedAt *metav1.Time `json:"restartedAt,omitempty"`
+	// Namespace for the namespace-scoped objects of the driver, like
+	// the controller and node pods. The default is the namespace of
+	// the operator. Other namespaces must be enabled in the operator
+	// with its -namespaces parameter. Changing the namespace of an
+	// existing deployment is not supported.
+	Namespace string `json:"namespace,omitempty"`
 	// KubeletDir kubelet's root directory path
 	KubeletDir string `json:"kubeletDir,omitempty"`
 	// DaemonSets use the default RollingUpdate strategy with at most 1 node
 	// not having a running driver pod. That limit can be increased with
 	// this setting, either with a higher integer or a percentage.
 	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// MaxSurge allows the node DaemonSet to start the updated driver pod
+	// on a node before the old one is stopped, either for a number of
+	// nodes or a percentage. The default is 0. Old and new pod then
+	// briefly run at the same time, which is not possible in combination
+	// with NodeHostNetwork.
+	MaxSurge *intstr.IntOrString `json:"maxSurge,omitempty"`
+	// ControllerUpdateStrategy replaces the default RollingUpdate
+	// strategy (25% max unavailable, 25% max surge) of the controller
+	// Deployment.
+	ControllerUpdateStrategy *appsv1.DeploymentStrategy `json:"controllerUpdateStrategy,omitempty"`
+	// NodeHostNetwork runs the node driver pods in the host network namespace.
+	NodeHostNetwork bool `json:"nodeHostNetwork,omitempty"`
+	// ControllerHostNetwork runs the controller pods in the host network namespace.
+	ControllerHostNetwork bool `json:"controllerHostNetwork,omitempty"`
+	// OpenShiftSCC creates a SecurityContextConstraints object with
+	// just the privileges needed by the node driver and uses it
+	// instead of the builtin "privileged" SCC. Only supported
+	// on OpenShift.
+	OpenShiftSCC bool `json:"openShiftSCC,omitempty"`
+	// ControllerPriorityClassName is the priority class of the controller pods.
+	ControllerPriorityClassName string `json:"controllerPriorityClassName,omitempty"`
+	// NodePriorityClassName is the priority class of the node driver pods.
+	NodePriorityClassName string `json:"nodePriorityClassName,omitempty"`
+	// RuntimeClassName is the RuntimeClass of all pods created by the
+	// operator. The node driver needs a runtime like runc which
+	// supports privileged containers, so this must be set on clusters
+	// where the default RuntimeClass is a sandbox like Kata Containers
+	// or gVisor.
+	RuntimeClassName string `json:"runtimeClassName,omitempty"`
+	// SeccompProfile, if set, is used for all pods created by the operator.
+	// Privileged containers are not confined by it, which gets made explicit
+	// by setting their profile to "Unconfined".
+	SeccompProfile *corev1.SeccompProfile `json:"seccompProfile,omitempty"`
+	// AppArmorProfile, if set, gets applied to all containers created by the
+	// operator. Privileged containers get "unconfined" instead.
+	// +kubebuilder:validation:Pattern=`^(runtime/default|localhost/.+)$`
+	AppArmorProfile string `json:"appArmorProfile,omitempty"`
+	// Components selects which parts of the driver get deployed.
+	Components *ComponentsSpec `json:"components,omitempty"`
+	// Metrics contains settings for integrating with monitoring tools.
+	Metrics *MetricsSpec `json:"metrics,omitempty"`
+	// Ports overrides the default ports of the driver pods.
+	Ports *PortsSpec `json:"ports,omitempty"`
+	// Proxy settings get passed to all containers created by the operator
+	// as environment variables.
+	Proxy *ProxySpec `json:"proxy,omitempty"`
+	// StorageClasses get created for the driver by the operator. Objects
+	// for entries that get removed from the list are deleted.
+	StorageClasses []StorageClassSpec `json:"storageClasses,omitempty"`
+	// ValidatePVCs enables a validating admission policy which rejects
+	// PVCs for the StorageClasses above when the requested size is
+	// larger than the capacity of every node or smaller than the
+	// minimum volume size. Needs Kubernetes >= 1.30.
+	ValidatePVCs bool `json:"validatePVCs,omitempty"`
+	// VolumeLifecycleModes restricts the kinds of volumes that the
+	// driver supports, "Persistent" and/or "Ephemeral". Without
+	// "Persistent", the operator does not deploy the
+	// external-provisioner sidecar and its RBAC rules. The default
+	// is both.
+	VolumeLifecycleModes []storagev1.VolumeLifecycleMode `json:"volumeLifecycleModes,omitempty"`
+	// TokenRequests lists the audiences for which kubelet passes
+	// service account tokens of the pod to the driver in
+	// NodePublishVolume. The driver does not use them yet.
+	TokenRequests []storagev1.TokenRequest `json:"tokenRequests,omitempty"`
+	// UninstallPolicy determines what happens when the deployment
+	// gets deleted. The default is "Delete".
+	// +kubebuilder:validation:Enum=Delete;Retain;Wipe
+	UninstallPolicy UninstallPolicy `json:"uninstallPolicy,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// ComponentsSpec enables or disables optional parts of the driver.
+type ComponentsSpec struct {
+	// Controller enables the central controller with the
+	// rescheduler and the objects needed by it. Without it, only
+	// the node driver gets deployed and provisioning relies solely
+	// on storage capacity tracking. The default is true.
+	Controller *bool `json:"controller,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// MetricsSpec defines how the metrics endpoints of the driver are exposed.
+type MetricsSpec struct {
+	// ServiceMonitor enables the creation of Services for the controller
+	// and node metrics ports together with ServiceMonitor objects for
+	// them. This requires the CRDs from the Prometheus operator.
+	ServiceMonitor bool `json:"serviceMonitor,omitempty"`
+	// Secure serves the metrics ports via HTTPS through a
+	// kube-rbac-proxy sidecar. Clients must authenticate with a
+	// bearer token or, if ClientCASecret is set, a client
+	// certificate and need permission to get the "/metrics"
+	// non-resource URL. The driver itself then only listens on
+	// localhost.
+	Secure bool `json:"secure,omitempty"`
+	// RBACProxyImage replaces the default kube-rbac-proxy image.
+	RBACProxyImage string `json:"rbacProxyImage,omitempty"`
+	// TLSSecret is the name of a Secret with tls.crt and tls.key
+	// in the namespace of the driver. The proxy generates a
+	// self-signed certificate if not set.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+	// ClientCASecret is the name of a Secret with ca.crt. Client
+	// certificates signed by that CA are accepted in addition to
+	// bearer tokens.
+	ClientCASecret string `json:"clientCASecret,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// NodeModeSpec defines how the node driver runs on a subset of the
+// nodes.
+type NodeModeSpec struct {
+	// Name is appended to the name of the node DaemonSet.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Name string `json:"name"`
+	// NodeSelector selects the nodes in addition to the
+	// NodeSelector of the deployment.
+	// +kubebuilder:validation:Required
+	NodeSelector map[string]string `json:"nodeSelector"`
+	// DeviceMode on the selected nodes. Empty (= unset) selects
+	// the device mode of the deployment.
+	// +kubebuilder:validation:Enum=lvm;direct;auto
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// PMEMPercentage on the selected nodes. Unset (= zero) selects
+	// the percentage of the deployment.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	PMEMPercentage uint16 `json:"pmemPercentage,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PMEMPoolSpec defines a pool of regions for the -pmemPool
+// parameter of the node driver.
+type PMEMPoolSpec struct {
+	// Name is the value of the "pool" parameter which selects
+	// the pool.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z0-9]([-_.a-zA-Z0-9]*[a-zA-Z0-9])?$`
+	Name string `json:"name"`
+	// Regions are the names of the regions in the pool, as shown
+	// by "ndctl list --regions", for example "region0".
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Regions []string `json:"regions"`
+}
+
+// +k8s:deepcopy-gen=true
+// PMEMGoalSpec defines how NVDIMMs get configured for App Direct
+// mode.
+type PMEMGoalSpec struct {
+	// AppDirectPercentage is the percentage of the NVDIMM
+	// capacity that becomes persistent memory. The rest is used
+	// as volatile memory in Memory Mode.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	AppDirectPercentage uint16 `json:"appDirectPercentage"`
+	// Interleaved combines the NVDIMMs of each socket into one
+	// region. Otherwise each NVDIMM becomes a region of its own.
+	// The default is true.
+	Interleaved *bool `json:"interleaved,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// PortsSpec defines the ports used by the driver pods. Unset
+// fields select the default. All node ports must be different
+// because the pods may run in the host network.
+type PortsSpec struct {
+	// ControllerMetrics is the metrics port of the controller.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	ControllerMetrics int32 `json:"controllerMetrics,omitempty"`
+	// NodeMetrics is the metrics port of the node driver.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	NodeMetrics int32 `json:"nodeMetrics,omitempty"`
+	// ProvisionerMetrics is the metrics port of the external-provisioner.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	ProvisionerMetrics int32 `json:"provisionerMetrics,omitempty"`
+	// NodeHealthz is the port of the livenessprobe sidecar.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	NodeHealthz int32 `json:"nodeHealthz,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// ProxySpec defines the proxy environment variables of the driver
+// containers. Empty values are not set.
+type ProxySpec struct {
+	// HTTPProxy is used as HTTP_PROXY.
+	HTTPProxy string `json:"httpProxy,omitempty"`
+	// HTTPSProxy is used as HTTPS_PROXY.
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	// NoProxy is used as NO_PROXY.
+	NoProxy string `json:"noProxy,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// StorageClassSpec defines a StorageClass which uses the driver.
+type StorageClassSpec struct {
+	// Name of the StorageClass object.
+	// +kubebuilder:validation:Required
+	Name string `json:"name"`
+	// FSType is the filesystem for volumes. Empty (= unset) leaves the
+	// choice to the driver, which currently is ext4.
+	// +kubebuilder:validation:Enum=ext4;xfs
+	FSType string `json:"fsType,omitempty"`
+	// Usage determines how volumes are meant to be used. Empty (= unset)
+	// selects the driver default, AppDirect.
+	// +kubebuilder:validation:Enum=AppDirect;FileIO
+	Usage string `json:"usage,omitempty"`
+	// EraseAfter determines whether volume data gets erased when deleting
+	// a volume. Unset selects the driver default, which is to erase.
+	EraseAfter *bool `json:"eraseAfter,omitempty"`
+	// VerifyErase enables reading back samples of the erased data
+	// when deleting a volume. Unset selects the driver default,
+	// which is to not verify.
+	VerifyErase *bool `json:"verifyErase,omitempty"`
+	// VolumeBindingMode of the StorageClass. Empty (= unset) selects
+	// WaitForFirstConsumer, which works better than Immediate
+	// because PMEM is local to each node.
+	// +kubebuilder:validation:Enum=Immediate;WaitForFirstConsumer
+	VolumeBindingMode storagev1.VolumeBindingMode `json:"volumeBindingMode,omitempty"`
+	// Default marks the StorageClass as the default for the cluster.
+	Default bool `json:"default,omitempty"`
 }
 
 // DeploymentConditionType type for representing a deployment status condition
@@ -162,6 +544,14 @@ const (
 	// DriverDeployed means that the all the sub-resources required for the deployment CR
 	// got created
 	DriverDeployed DeploymentConditionType = "DriverDeployed"
+	// DeploymentConflict is true if the deployment cannot be deployed
+	// because it would interfere with some other, older deployment.
+	// It is only present after such a conflict was detected once.
+	DeploymentConflict DeploymentConditionType = "Conflict"
+	// Migrated is true if all migration steps for the current
+	// operator version were executed. It is only present after
+	// some migration step was necessary.
+	Migrated DeploymentConditionType = "Migrated"
 )
 
 // +k8s:deepcopy-gen=true
@@ -200,7 +590,8 @@ type DriverStatus struct {
 	DriverComponent string `json:"component"`
 	// Status represents the state of the component; one of `Ready` or `NotReady`.
 	// Component becomes `Ready` if all the instances(Pods) of the driver component
-	// are in running state. Otherwise, `NotReady`.
+	// are in running state. Otherwise, `NotReady`. A controller that is turned off
+	// in the components is `Disabled`.
 	Status string `json:"status"`
 	// Reason represents the human readable text that explains why the
 	// driver is in this state.
@@ -210,6 +601,56 @@ type DriverStatus struct {
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
 }
 
+// +k8s:deepcopy-gen=true
+// NodeStatus describes the node driver on one node.
+type NodeStatus struct {
+	// Node is the name of the node.
+	Node string `json:"node"`
+	// Phase of the node driver pod, empty if there is no pod.
+	Phase corev1.PodPhase `json:"phase,omitempty"`
+	// Ready is true if all containers of the node driver pod are ready.
+	Ready bool `json:"ready"`
+	// Registered is true if the driver is listed in the CSINode
+	// object of the node.
+	Registered bool `json:"registered"`
+	// DeviceMode is the device mode that the node driver uses,
+	// as reported through its topology. Useful with device mode
+	// 'auto'. Empty if not known.
+	DeviceMode DeviceMode `json:"deviceMode,omitempty"`
+	// Capacity is the PMEM capacity that was published for the node.
+	// Unset if not known.
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
+	// TotalCapacity is the published capacity plus the size of
+	// the persistent volumes which exist on the node, i.e. the
+	// capacity that a single volume could use on an empty node.
+	// Unset if not known.
+	TotalCapacity *resource.Quantity `json:"totalCapacity,omitempty"`
+	// MaximumVolumeSize is the size of the largest volume that
+	// can currently be created on the node. Unset if not known.
+	MaximumVolumeSize *resource.Quantity `json:"maximumVolumeSize,omitempty"`
+	// LastError explains why the pod is not working, if known.
+	LastError string `json:"lastError,omitempty"`
+	// RawNamespaceConversion is the result of the node setup,
+	// if it ran on the node.
+	RawNamespaceConversion string `json:"rawNamespaceConversion,omitempty"`
+	// PMEMGoal is the result of provisioning the NVDIMMs
+	// according to the PMEM goal, if the node setup did that.
+	PMEMGoal string `json:"pmemGoal,omitempty"`
+}
+
+// +k8s:deepcopy-gen=true
+// CapacityStatus describes the PMEM capacity in the whole cluster,
+// based on the storage capacity published for each node.
+type CapacityStatus struct {
+	// Available is the sum of the capacity published for all nodes.
+	Available resource.Quantity `json:"available"`
+	// MaximumVolumeSize is the size of the largest volume that
+	// can currently be created on any node.
+	MaximumVolumeSize resource.Quantity `json:"maximumVolumeSize"`
+	// Nodes is the number of nodes with known capacity.
+	Nodes int `json:"nodes"`
+}
+
 // +k8s:deepcopy-gen=true
 
 // DeploymentStatus defines the observed state of Deployment
@@ -223,6 +664,16 @@ type DeploymentStatus struct {
 	// Conditions
 	Conditions []DeploymentCondition `json:"conditions,omitempty"`
 	Components []DriverStatus        `json:"driverComponents,omitempty"`
+	// Nodes has one entry for each node where a node driver pod
+	// runs, where the driver is registered or where the node setup
+	// reported a result, sorted by node name.
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+	// Capacity sums up the PMEM capacity of all nodes.
+	Capacity *CapacityStatus `json:"capacity,omitempty"`
+	// OperatorVersion is the version of the operator which reconciled
+	// the deployment successfully the last time. It determines which
+	// migration steps are needed after an operator upgrade.
+	OperatorVersion string `json:"operatorVersion,omitempty"`
 	// LastUpdated time of the deployment status
 	// +nullable
 	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
@@ -237,6 +688,8 @@ type DeploymentStatus struct {
 // +kubebuilder:printcolumn:name="NodeSelector",type=string,JSONPath=`.spec.nodeSelector`
 // +kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.spec.image`
 // +kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Capacity",type=string,JSONPath=`.status.capacity.available`
+// +kubebuilder:printcolumn:name="MaxVolume",type=string,JSONPath=`.status.capacity.maximumVolumeSize`,priority=1
 // +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // +kubebuilder:storageversion
 type PmemCSIDeployment struct {
@@ -267,8 +720,54 @@ const (
 	EventReasonRunning = "Running"
 	// EventReasonFailed driver deployment failed, Event.Message holds detailed information
 	EventReasonFailed = "Failed"
+	// EventReasonPaused reconciliation is skipped because of PausedAnnotation
+	EventReasonPaused = "Paused"
+	// EventReasonDriftReverted a modified or deleted sub-object was restored
+	EventReasonDriftReverted = "DriftReverted"
+	// EventReasonAdopted an existing object was taken over because of AdoptAnnotation
+	EventReasonAdopted = "Adopted"
 )
 
+// PausedAnnotation, when set to "true" on a PmemCSIDeployment, stops
+// the operator from reconciling the deployment and from reverting
+// changes made to its sub-objects.
+const PausedAnnotation = "pmem-csi.intel.com/paused"
+
+// AdoptAnnotation, when set to "true" on a PmemCSIDeployment, allows
+// the operator to take over existing objects which have the name of
+// one of its sub-objects and no controller, for example because they
+// were created from the reference YAML files.
+const AdoptAnnotation = "pmem-csi.intel.com/adopt"
+
+// RestartedAtAnnotation is set in the pod templates of the controller
+// and node driver to the value of Spec.RestartedAt.
+const RestartedAtAnnotation = "pmem-csi.intel.com/restartedAt"
+
+// UninstallFinalizer is set on a PmemCSIDeployment by the operator
+// while the uninstall policy requires some action before the
+// deployment may be removed.
+const UninstallFinalizer = "pmem-csi.intel.com/uninstall"
+
+// RawNamespaceConversionAnnotation gets appended to the driver name
+// and "/" to form the node annotation where the node setup stores
+// its result.
+const RawNamespaceConversionAnnotation = "raw-namespace-conversion"
+
+// PMEMGoalAnnotation gets appended to the driver name and "/" to
+// form the node annotation where the node setup stores the result of
+// applying the PMEM goal.
+const PMEMGoalAnnotation = "pmem-goal"
+
+// DeviceModeLabel gets appended to the driver name and "/" to form
+// the node label with the device mode of the node driver. Kubelet
+// sets it from the driver topology. An admin may set it before the
+// driver starts to choose the mode for device mode 'auto'.
+const DeviceModeLabel = "device-mode"
+
+// NodeModeLabel identifies the node driver pods of a NodeModes entry.
+// The value is the name of the entry.
+const NodeModeLabel = "pmem-csi.intel.com/node-mode"
+
 const (
 	// DefaultLogLevel default logging level used for the driver
 	DefaultLogLevel = uint16(3)
@@ -290,6 +789,13 @@ const (
 	// DefaultRegistrarImage default node driver registrar image to use
 	DefaultRegistrarImage = "registry.k8s.io/sig-storage/csi-node-driver-registrar:v2.5.1"
 
+	// DefaultLivenessProbeImage livenessprobe image that is known to work with PMEM-CSI.
+	// It is not used unless explicitly configured via LivenessProbeImage.
+	DefaultLivenessProbeImage = "registry.k8s.io/sig-storage/livenessprobe:v2.7.0"
+
+	// DefaultRBACProxyImage kube-rbac-proxy image for serving metrics securely.
+	DefaultRBACProxyImage = "quay.io/brancz/kube-rbac-proxy:v0.14.2"
+
 	// Below resource requests and limits are derived(with minor adjustments) from
 	// recommendations reported by VirtualPodAutoscaler(LowerBound -> Requests and UpperBound -> Limits)
 
@@ -319,6 +825,18 @@ const (
 	DefaultPMEMPercentage = 100
 	// DefaultKubeletDir default kubelet's path
 	DefaultKubeletDir = "/var/lib/kubelet"
+	// DefaultControllerMetricsPort metrics port of the controller
+	DefaultControllerMetricsPort = 10010
+	// DefaultNodeMetricsPort metrics port of the node driver
+	DefaultNodeMetricsPort = 10010
+	// DefaultProvisionerMetricsPort metrics port of the external-provisioner
+	DefaultProvisionerMetricsPort = 10011
+	// DefaultNodeHealthzPort port of the livenessprobe sidecar
+	DefaultNodeHealthzPort = 9808
+	// DefaultControllerPriorityClassName priority class of the controller pods
+	DefaultControllerPriorityClassName = "system-cluster-critical"
+	// DefaultNodePriorityClassName priority class of the node driver pods
+	DefaultNodePriorityClassName = "system-node-critical"
 )
 
 var (
@@ -338,6 +856,15 @@ const (
 	DeploymentPhaseFailed DeploymentPhase = "Failed"
 )
 
+// Sizes below these get rounded up by the device managers.
+const (
+	// MinimumVolumeSizeLVM is the size of one LVM extent.
+	MinimumVolumeSizeLVM = "4Mi"
+	// MinimumVolumeSizeDirect is the default alignment of
+	// fsdax namespaces.
+	MinimumVolumeSizeDirect = "2Mi"
+)
+
 // A TLS secret must contain three data items.
 const (
 	// TLSSecretCA is the CA bundle.
@@ -349,7 +876,8 @@ const (
 )
 
 func (d *PmemCSIDeployment) SetCondition(t DeploymentConditionType, state corev1.ConditionStatus, reason string) {
-	for _, c := range d.Status.Conditions {
+	for i := range d.Status.Conditions {
+		c := &d.Status.Conditions[i]
 		if c.Type == t {
 			c.Status = state
 			c.Reason = reason
@@ -365,6 +893,16 @@ func (d *PmemCSIDeployment) SetCondition(t DeploymentConditionType, state corev1
 	})
 }
 
+// HasCondition returns true if a condition of the given type was set before.
+func (d *PmemCSIDeployment) HasCondition(t DeploymentConditionType) bool {
+	for _, c := range d.Status.Conditions {
+		if c.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *PmemCSIDeployment) SetDriverStatus(t DriverType, status, reason string) {
 	if d.Status.Components == nil {
 		d.Status.Components = make([]DriverStatus, 2)
@@ -385,11 +923,61 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 	switch d.Spec.DeviceMode {
 	case "":
 		d.Spec.DeviceMode = DefaultDeviceMode
-	case DeviceModeDirect, DeviceModeLVM:
+	case DeviceModeDirect, DeviceModeLVM, DeviceModeAuto:
 	default:
 		return fmt.Errorf("invalid device mode %q", d.Spec.DeviceMode)
 	}
 
+	// Running unconfined is what privileged containers do anyway,
+	// it is not a profile that can be chosen for all containers.
+	if d.Spec.SeccompProfile != nil {
+		switch d.Spec.SeccompProfile.Type {
+		case corev1.SeccompProfileTypeRuntimeDefault, corev1.SeccompProfileTypeLocalhost:
+		default:
+			return fmt.Errorf("invalid seccomp profile type %q", d.Spec.SeccompProfile.Type)
+		}
+	}
+
+	if d.Spec.MaxSurge != nil {
+		// Scaling against 100 nodes catches all non-zero percentages.
+		surge, err := intstr.GetScaledValueFromIntOrPercent(d.Spec.MaxSurge, 100, true)
+		if err != nil {
+			return fmt.Errorf("invalid maxSurge: %v", err)
+		}
+		if surge > 0 && d.Spec.NodeHostNetwork {
+			return errors.New("maxSurge cannot be used together with nodeHostNetwork")
+		}
+	}
+	if s := d.Spec.ControllerUpdateStrategy; s != nil {
+		switch s.Type {
+		case "", appsv1.RollingUpdateDeploymentStrategyType:
+		case appsv1.RecreateDeploymentStrategyType:
+			if s.RollingUpdate != nil {
+				return errors.New("controller update strategy Recreate does not support rollingUpdate parameters")
+			}
+		default:
+			return fmt.Errorf("invalid controller update strategy type %q", s.Type)
+		}
+	}
+
+	storageClasses := map[string]bool{}
+	numDefault := 0
+	for _, sc := range d.Spec.StorageClasses {
+		if sc.Name == "" {
+			return errors.New("storage class without name")
+		}
+		if storageClasses[sc.Name] {
+			return fmt.Errorf("storage class %q defined more than once", sc.Name)
+		}
+		storageClasses[sc.Name] = true
+		if sc.Default {
+			numDefault++
+		}
+	}
+	if numDefault > 1 {
+		return errors.New("more than one default storage class")
+	}
+
 	if d.Spec.Image == "" {
 		// If provided use operatorImage
 		if operatorImage != "" {
@@ -424,49 +1012,241 @@ func (d *PmemCSIDeployment) EnsureDefaults(operatorImage string) error {
 		d.Spec.PMEMPercentage = DefaultPMEMPercentage
 	}
 
-	if d.Spec.KubeletDir == "" {
-		d.Spec.KubeletDir = DefaultKubeletDir
+	if _, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchExpressions: d.Spec.NodeSelectorExpressions}); err != nil {
+		return fmt.Errorf("invalid node selector expressions: %v", err)
 	}
 
-	if d.Spec.ControllerDriverResources == nil {
-		d.Spec.ControllerDriverResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultControllerResourceRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultControllerResourceRequestMemory),
-			},
+	nodeModes := map[string]bool{}
+	for i := range d.Spec.NodeModes {
+		mode := &d.Spec.NodeModes[i]
+		switch mode.Name {
+		case "":
+			return errors.New("node mode without name")
+		case "setup", "wipe":
+			// Would conflict with the node setup or wipe DaemonSet.
+			return fmt.Errorf("node mode name %q is reserved", mode.Name)
+		}
+		if nodeModes[mode.Name] {
+			return fmt.Errorf("node mode %q defined more than once", mode.Name)
+		}
+		nodeModes[mode.Name] = true
+		switch mode.DeviceMode {
+		case "":
+			mode.DeviceMode = d.Spec.DeviceMode
+		case DeviceModeDirect, DeviceModeLVM, DeviceModeAuto:
+		default:
+			return fmt.Errorf("node mode %q: invalid device mode %q", mode.Name, mode.DeviceMode)
+		}
+		if mode.PMEMPercentage == 0 {
+			mode.PMEMPercentage = d.Spec.PMEMPercentage
+		}
+		if len(nodeModeRequirements(d.Spec.NodeSelector, mode.NodeSelector)) == 0 {
+			return fmt.Errorf("node mode %q selects all nodes of the deployment", mode.Name)
 		}
 	}
 
-	if d.Spec.ProvisionerResources == nil {
-		d.Spec.ProvisionerResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultProvisionerRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultProvisionerRequestMemory),
-			},
+	switch d.Spec.RawNamespaceConversion {
+	case "":
+		d.Spec.RawNamespaceConversion = RawNamespaceConversionLabelledOnly
+	case RawNamespaceConversionDisabled, RawNamespaceConversionLabelledOnly:
+	case RawNamespaceConversionAll:
+		if len(d.Spec.NodeSelector) == 0 && len(d.Spec.NodeSelectorExpressions) == 0 {
+			// Nothing left to convert, the driver runs everywhere.
+			return errors.New("raw namespace conversion for all nodes needs a node selector")
 		}
+	default:
+		return fmt.Errorf("invalid raw namespace conversion %q", d.Spec.RawNamespaceConversion)
+	}
+	if goal := d.Spec.PMEMGoal; goal != nil {
+		if goal.AppDirectPercentage == 0 || goal.AppDirectPercentage > 100 {
+			return fmt.Errorf("PMEM goal: App Direct percentage must be 1..100, got %d", goal.AppDirectPercentage)
+		}
+		if d.Spec.RawNamespaceConversion == RawNamespaceConversionDisabled {
+			return errors.New("PMEM goal needs raw namespace conversion")
+		}
+	}
+	if d.Spec.NodeDiscovery && len(d.Spec.NodeSelector) == 0 {
+		return errors.New("node discovery needs a node selector with labels")
 	}
 
-	if d.Spec.NodeDriverResources == nil {
-		d.Spec.NodeDriverResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultNodeResourceRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultNodeResourceRequestMemory),
-			},
+	if d.Spec.VolumeLifecycleModes == nil {
+		d.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{
+			storagev1.VolumeLifecyclePersistent,
+			storagev1.VolumeLifecycleEphemeral,
+		}
+	}
+	if len(d.Spec.VolumeLifecycleModes) == 0 {
+		return errors.New("at least one volume lifecycle mode is required")
+	}
+	lifecycleModes := map[storagev1.VolumeLifecycleMode]bool{}
+	for _, mode := range d.Spec.VolumeLifecycleModes {
+		switch mode {
+		case storagev1.VolumeLifecyclePersistent, storagev1.VolumeLifecycleEphemeral:
+		default:
+			return fmt.Errorf("invalid volume lifecycle mode %q", mode)
+		}
+		if lifecycleModes[mode] {
+			return fmt.Errorf("volume lifecycle mode %q listed more than once", mode)
+		}
+		lifecycleModes[mode] = true
+	}
+	if !d.WithProvisioner() && len(d.Spec.StorageClasses) > 0 {
+		return errors.New("storage classes need the Persistent volume lifecycle mode")
+	}
+	if err := validatePMEMReserved(d.Spec.PMEMReserved); err != nil {
+		return fmt.Errorf("invalid pmemReserved: %v", err)
+	}
+	busTypes := map[PMEMBusType]bool{}
+	for _, busType := range d.Spec.PMEMBusTypes {
+		switch busType {
+		case PMEMBusTypeNVDIMM, PMEMBusTypeCXL:
+		default:
+			return fmt.Errorf("invalid PMEM bus type %q", busType)
+		}
+		if busTypes[busType] {
+			return fmt.Errorf("PMEM bus type %q listed more than once", busType)
+		}
+		busTypes[busType] = true
+	}
+	if err := validatePMEMPools(d.Spec.PMEMPools); err != nil {
+		return fmt.Errorf("invalid pmemPools: %v", err)
+	}
+	audiences := map[string]bool{}
+	for _, tokenRequest := range d.Spec.TokenRequests {
+		if audiences[tokenRequest.Audience] {
+			return fmt.Errorf("token request audience %q listed more than once", tokenRequest.Audience)
+		}
+		audiences[tokenRequest.Audience] = true
+		if tokenRequest.ExpirationSeconds != nil && *tokenRequest.ExpirationSeconds < 600 {
+			return fmt.Errorf("token request for audience %q: expiration must be at least 600 seconds", tokenRequest.Audience)
 		}
 	}
 
-	if d.Spec.NodeRegistrarResources == nil {
-		d.Spec.NodeRegistrarResources = &corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse(DefaultNodeRegistrarRequestCPU),
-				corev1.ResourceMemory: resource.MustParse(DefaultNodeRegistrarRequestMemory),
-			},
+	switch d.Spec.UninstallPolicy {
+	case "":
+		d.Spec.UninstallPolicy = UninstallPolicyDelete
+	case UninstallPolicyDelete, UninstallPolicyRetain, UninstallPolicyWipe:
+	default:
+		return fmt.Errorf("invalid uninstall policy %q", d.Spec.UninstallPolicy)
+	}
+
+	if d.Spec.KubeletDir == "" {
+		d.Spec.KubeletDir = DefaultKubeletDir
+	}
+
+	if d.Spec.Ports == nil {
+		d.Spec.Ports = &PortsSpec{}
+	}
+	for _, p := range []struct {
+		port         *int32
+		defaultValue int32
+	}{
+		{&d.Spec.Ports.ControllerMetrics, DefaultControllerMetricsPort},
+		{&d.Spec.Ports.NodeMetrics, DefaultNodeMetricsPort},
+		{&d.Spec.Ports.ProvisionerMetrics, DefaultProvisionerMetricsPort},
+		{&d.Spec.Ports.NodeHealthz, DefaultNodeHealthzPort},
+	} {
+		if *p.port == 0 {
+			*p.port = p.defaultValue
+		}
+	}
+	if ports := d.Spec.Ports; ports.NodeMetrics == ports.ProvisionerMetrics ||
+		ports.NodeMetrics == ports.NodeHealthz ||
+		ports.ProvisionerMetrics == ports.NodeHealthz {
+		return fmt.Errorf("node ports must be different: %d (metrics), %d (provisioner metrics), %d (healthz)",
+			ports.NodeMetrics, ports.ProvisionerMetrics, ports.NodeHealthz)
+	}
+
+	if d.WithSecureMetrics() && d.Spec.Metrics.RBACProxyImage == "" {
+		d.Spec.Metrics.RBACProxyImage = DefaultRBACProxyImage
+	}
+
+	if d.Spec.ControllerPriorityClassName == "" {
+		d.Spec.ControllerPriorityClassName = DefaultControllerPriorityClassName
+	}
+
+	if d.Spec.NodePriorityClassName == "" {
+		d.Spec.NodePriorityClassName = DefaultNodePriorityClassName
+	}
+
+	if d.Spec.ResourceProfile == "" {
+		d.Spec.ResourceProfile = ResourceProfileMedium
+	}
+	profile, ok := resourceProfiles[d.Spec.ResourceProfile]
+	if !ok {
+		return fmt.Errorf("invalid resource profile %q", d.Spec.ResourceProfile)
+	}
+	for _, r := range []struct {
+		resources    **corev1.ResourceRequirements
+		defaultValue corev1.ResourceRequirements
+	}{
+		{&d.Spec.ControllerDriverResources, profile.controllerDriver},
+		{&d.Spec.ProvisionerResources, profile.provisioner},
+		{&d.Spec.NodeDriverResources, profile.nodeDriver},
+		{&d.Spec.NodeRegistrarResources, profile.nodeRegistrar},
+	} {
+		if *r.resources == nil {
+			*r.resources = r.defaultValue.DeepCopy()
 		}
 	}
 
 	return nil
 }
 
+// resourceProfile contains the resource requirements of the
+// containers that can be configured in a DeploymentSpec.
+type resourceProfile struct {
+	controllerDriver, provisioner, nodeDriver, nodeRegistrar corev1.ResourceRequirements
+}
+
+func resourceList(cpu, memory string) corev1.ResourceList {
+	return corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+}
+
+var resourceProfiles = map[ResourceProfile]resourceProfile{
+	ResourceProfileSmall: {
+		controllerDriver: corev1.ResourceRequirements{Requests: resourceList("5m", "64Mi")},
+		provisioner:      corev1.ResourceRequirements{Requests: resourceList("5m", "64Mi")},
+		nodeDriver:       corev1.ResourceRequirements{Requests: resourceList("20m", "128Mi")},
+		nodeRegistrar:    corev1.ResourceRequirements{Requests: resourceList("5m", "64Mi")},
+	},
+	ResourceProfileMedium: {
+		controllerDriver: corev1.ResourceRequirements{
+			Requests: resourceList(DefaultControllerResourceRequestCPU, DefaultControllerResourceRequestMemory),
+		},
+		provisioner: corev1.ResourceRequirements{
+			Requests: resourceList(DefaultProvisionerRequestCPU, DefaultProvisionerRequestMemory),
+		},
+		nodeDriver: corev1.ResourceRequirements{
+			Requests: resourceList(DefaultNodeResourceRequestCPU, DefaultNodeResourceRequestMemory),
+		},
+		nodeRegistrar: corev1.ResourceRequirements{
+			Requests: resourceList(DefaultNodeRegistrarRequestCPU, DefaultNodeRegistrarRequestMemory),
+		},
+	},
+	ResourceProfileLarge: {
+		controllerDriver: corev1.ResourceRequirements{
+			Requests: resourceList("50m", "256Mi"),
+			Limits:   resourceList("500m", "512Mi"),
+		},
+		provisioner: corev1.ResourceRequirements{
+			Requests: resourceList("50m", "256Mi"),
+			Limits:   resourceList("500m", "512Mi"),
+		},
+		nodeDriver: corev1.ResourceRequirements{
+			Requests: resourceList("200m", "512Mi"),
+			Limits:   resourceList("1", "1Gi"),
+		},
+		nodeRegistrar: corev1.ResourceRequirements{
+			Requests: resourceList("20m", "128Mi"),
+			Limits:   resourceList("100m", "256Mi"),
+		},
+	},
+}
+
 // GetHyphenedName returns the name of the deployment with dots replaced by hyphens.
 // Most objects created for the deployment will use hyphens in the name, sometimes
 // with an additional suffix like -controller, but others must use the original
@@ -487,6 +1267,196 @@ func (d *PmemCSIDeployment) MetricsServiceName() string {
 	return d.GetHyphenedName() + "-metrics"
 }
 
+// NodeMetricsServiceName returns the name of the node metrics
+// Service object used by the deployment
+func (d *PmemCSIDeployment) NodeMetricsServiceName() string {
+	return d.GetHyphenedName() + "-node-metrics"
+}
+
+// ControllerServiceMonitorName returns the name of the ServiceMonitor
+// object for the controller metrics Service
+func (d *PmemCSIDeployment) ControllerServiceMonitorName() string {
+	return d.GetHyphenedName() + "-controller"
+}
+
+// NodeServiceMonitorName returns the name of the ServiceMonitor
+// object for the node metrics Service
+func (d *PmemCSIDeployment) NodeServiceMonitorName() string {
+	return d.GetHyphenedName() + "-node"
+}
+
+// WithServiceMonitor returns true if the operator is asked to
+// create ServiceMonitor objects for the deployment.
+func (d *PmemCSIDeployment) WithServiceMonitor() bool {
+	return d.Spec.Metrics != nil && d.Spec.Metrics.ServiceMonitor
+}
+
+// WithProvisioner returns true if persistent volumes are supported,
+// which needs the external-provisioner.
+func (d *PmemCSIDeployment) WithProvisioner() bool {
+	if d.Spec.VolumeLifecycleModes == nil {
+		return true
+	}
+	for _, mode := range d.Spec.VolumeLifecycleModes {
+		if mode == storagev1.VolumeLifecyclePersistent {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPVCValidation returns true if the operator is asked to
+// validate PVCs and there are storage classes to check.
+func (d *PmemCSIDeployment) WithPVCValidation() bool {
+	return d.Spec.ValidatePVCs && len(d.Spec.StorageClasses) > 0
+}
+
+// MinimumVolumeSize returns the alignment of the device mode with the
+// smallest alignment among the nodes of the deployment.
+func (d *PmemCSIDeployment) MinimumVolumeSize() resource.Quantity {
+	modes := []DeviceMode{d.Spec.DeviceMode}
+	for _, mode := range d.Spec.NodeModes {
+		modes = append(modes, mode.DeviceMode)
+	}
+	for _, mode := range modes {
+		if mode == DeviceModeDirect {
+			return resource.MustParse(MinimumVolumeSizeDirect)
+		}
+	}
+	return resource.MustParse(MinimumVolumeSizeLVM)
+}
+
+// MaximumNodeCapacity returns the largest total capacity in the
+// node status, nil if none is known yet. The available capacity is
+// not used because it shrinks while volumes get created, which
+// would reject PVCs that fit once other volumes are deleted.
+func (d *PmemCSIDeployment) MaximumNodeCapacity() *resource.Quantity {
+	var capacity *resource.Quantity
+	for _, node := range d.Status.Nodes {
+		if node.TotalCapacity != nil && (capacity == nil || capacity.Cmp(*node.TotalCapacity) < 0) {
+			capacity = node.TotalCapacity
+		}
+	}
+	return capacity
+}
+
+// PVCValidationPolicySpec returns the ValidatingAdmissionPolicy which
+// checks the size of new PVCs for the storage classes of the
+// deployment. Sizes are only compared against the node capacity
+// once that is known.
+func (d *PmemCSIDeployment) PVCValidationPolicySpec() admissionregistrationv1.ValidatingAdmissionPolicySpec {
+	var classes []string
+	for _, sc := range d.Spec.StorageClasses {
+		classes = append(classes, fmt.Sprintf("'%s'", sc.Name))
+	}
+	// Fields which otherwise would get defaulted by the API server
+	// are set explicitly, to avoid needless updates.
+	failurePolicy := admissionregistrationv1.Fail
+	matchPolicy := admissionregistrationv1.Equivalent
+	scope := admissionregistrationv1.AllScopes
+	minSize := d.MinimumVolumeSize()
+	spec := admissionregistrationv1.ValidatingAdmissionPolicySpec{
+		FailurePolicy: &failurePolicy,
+		MatchConstraints: &admissionregistrationv1.MatchResources{
+			NamespaceSelector: &metav1.LabelSelector{},
+			ObjectSelector:    &metav1.LabelSelector{},
+			MatchPolicy:       &matchPolicy,
+			ResourceRules: []admissionregistrationv1.NamedRuleWithOperations{
+				{
+					RuleWithOperations: admissionregistrationv1.RuleWithOperations{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"persistentvolumeclaims"},
+							Scope:       &scope,
+						},
+					},
+				},
+			},
+		},
+		// The default storage class is set by a mutating admission
+		// plugin which runs before validation.
+		MatchConditions: []admissionregistrationv1.MatchCondition{
+			{
+				Name:       "storage-class",
+				Expression: fmt.Sprintf("has(object.spec.storageClassName) && object.spec.storageClassName in [%s]", strings.Join(classes, ", ")),
+			},
+			{
+				Name:       "storage-request",
+				Expression: "has(object.spec.resources.requests) && 'storage' in object.spec.resources.requests",
+			},
+		},
+		Variables: []admissionregistrationv1.Variable{
+			{
+				Name:       "size",
+				Expression: "quantity(object.spec.resources.requests.storage)",
+			},
+		},
+		Validations: []admissionregistrationv1.Validation{
+			{
+				Expression: fmt.Sprintf("!variables.size.isLessThan(quantity('%s'))", minSize.String()),
+				Message:    fmt.Sprintf("PMEM volumes must have a size of at least %s.", minSize.String()),
+			},
+		},
+	}
+	if maxSize := d.MaximumNodeCapacity(); maxSize != nil {
+		spec.Validations = append(spec.Validations, admissionregistrationv1.Validation{
+			Expression: fmt.Sprintf("!variables.size.isGreaterThan(quantity('%s'))", maxSize.String()),
+			Message:    fmt.Sprintf("PMEM volumes must not be larger than %s, the largest capacity of any node.", maxSize.String()),
+		})
+	}
+	return spec
+}
+
+// PVCValidationPolicyBindingSpec returns the binding which enables
+// the PVC validation policy.
+func (d *PmemCSIDeployment) PVCValidationPolicyBindingSpec() admissionregistrationv1.ValidatingAdmissionPolicyBindingSpec {
+	return admissionregistrationv1.ValidatingAdmissionPolicyBindingSpec{
+		PolicyName:        d.PVCValidationPolicyName(),
+		ValidationActions: []admissionregistrationv1.ValidationAction{admissionregistrationv1.Deny},
+	}
+}
+
+// WithSecureMetrics returns true if the metrics ports are
+// served via kube-rbac-proxy.
+func (d *PmemCSIDeployment) WithSecureMetrics() bool {
+	return d.Spec.Metrics != nil && d.Spec.Metrics.Secure
+}
+
+// WithController returns true if the central controller is
+// enabled.
+func (d *PmemCSIDeployment) WithController() bool {
+	return d.Spec.Components == nil ||
+		d.Spec.Components.Controller == nil ||
+		*d.Spec.Components.Controller
+}
+
+// WithNodeSetup returns true if the node setup DaemonSet for raw
+// namespace conversion is needed.
+func (d *PmemCSIDeployment) WithNodeSetup() bool {
+	return d.Spec.RawNamespaceConversion != RawNamespaceConversionDisabled
+}
+
+// WithNodeSetupRBAC returns true if the service account and RBAC
+// rules for modifying nodes are needed, either for the node setup or
+// the node discovery.
+func (d *PmemCSIDeployment) WithNodeSetupRBAC() bool {
+	return d.WithNodeSetup() || d.Spec.NodeDiscovery
+}
+
+// MetricsAuthClusterRoleName returns the name of the ClusterRole
+// which allows kube-rbac-proxy to check tokens and permissions
+func (d *PmemCSIDeployment) MetricsAuthClusterRoleName() string {
+	return d.GetHyphenedName() + "-metrics-auth"
+}
+
+// MetricsAuthClusterRoleBindingName returns the name of the
+// ClusterRoleBinding for MetricsAuthClusterRoleName
+func (d *PmemCSIDeployment) MetricsAuthClusterRoleBindingName() string {
+	return d.GetHyphenedName() + "-metrics-auth"
+}
+
 // SchedulerServiceName returns the name of the controller's
 // Service object for the webhooks.
 func (d *PmemCSIDeployment) WebhooksServiceName() string {
@@ -535,6 +1505,18 @@ func (d *PmemCSIDeployment) NodeOpenShiftRoleBindingName() string {
 	return d.GetHyphenedName() + "-node-openshift-cfg"
 }
 
+// NodeSCCName returns the name of the node driver's
+// SecurityContextConstraints object for OpenShift
+func (d *PmemCSIDeployment) NodeSCCName() string {
+	return d.GetHyphenedName() + "-node-scc"
+}
+
+// NodeSCCClusterRoleName returns the name of the ClusterRole
+// which allows using the node driver's SecurityContextConstraints
+func (d *PmemCSIDeployment) NodeSCCClusterRoleName() string {
+	return d.GetHyphenedName() + "-node-scc-user"
+}
+
 // ProvisionerRoleName returns the name of the provisioner's
 // RBAC Role object name used by the deployment
 func (d *PmemCSIDeployment) ProvisionerRoleName() string {
@@ -565,12 +1547,214 @@ func (d *PmemCSIDeployment) NodeDriverName() string {
 	return d.GetHyphenedName() + "-node"
 }
 
+// NodeModeDriverName returns the name of the node driver
+// DaemonSet for one of the node modes
+func (d *PmemCSIDeployment) NodeModeDriverName(mode string) string {
+	return d.NodeDriverName() + "-" + mode
+}
+
+// DriverNodeSelector returns the node selector in the format
+// expected by the -nodeSelector parameter of the driver.
+func (d *PmemCSIDeployment) DriverNodeSelector() types.NodeSelector {
+	return types.NodeSelector{
+		MatchLabels:      d.Spec.NodeSelector,
+		MatchExpressions: d.Spec.NodeSelectorExpressions,
+	}
+}
+
+// NodeSelectorAffinity returns the node affinity which enforces the
+// NodeSelectorExpressions, nil if there are none.
+func (d *PmemCSIDeployment) NodeSelectorAffinity() *corev1.Affinity {
+	return d.nodeAffinity([][]corev1.NodeSelectorRequirement{nil})
+}
+
+// NodeModesAffinity returns the node affinity which keeps the
+// default node driver DaemonSet away from the nodes of the node
+// modes and enforces the NodeSelectorExpressions, nil if neither
+// is needed.
+func (d *PmemCSIDeployment) NodeModesAffinity() *corev1.Affinity {
+	if len(d.Spec.NodeModes) == 0 {
+		return d.NodeSelectorAffinity()
+	}
+
+	// A node must not match any of the node selectors. Each
+	// node selector is excluded by one of its labels not
+	// matching, so the expressions for all combinations get
+	// ORed.
+	terms := [][]corev1.NodeSelectorRequirement{nil}
+	for _, mode := range d.Spec.NodeModes {
+		var newTerms [][]corev1.NodeSelectorRequirement
+		for _, term := range terms {
+			for _, req := range nodeModeRequirements(d.Spec.NodeSelector, mode.NodeSelector) {
+				newTerm := append([]corev1.NodeSelectorRequirement{}, term...)
+				if !containsRequirement(newTerm, req) {
+					newTerm = append(newTerm, req)
+				}
+				newTerms = append(newTerms, newTerm)
+			}
+		}
+		terms = newTerms
+	}
+	return d.nodeAffinity(terms)
+}
+
+// nodeAffinity ORs the terms after adding the NodeSelectorExpressions
+// to each of them. Empty terms are skipped.
+func (d *PmemCSIDeployment) nodeAffinity(terms [][]corev1.NodeSelectorRequirement) *corev1.Affinity {
+	nodeSelector := &corev1.NodeSelector{}
+	for _, term := range terms {
+		term = append(append([]corev1.NodeSelectorRequirement{}, term...), nodeSelectorRequirements(d.Spec.NodeSelectorExpressions, false)...)
+		if len(term) == 0 {
+			continue
+		}
+		nodeSelector.NodeSelectorTerms = append(nodeSelector.NodeSelectorTerms,
+			corev1.NodeSelectorTerm{MatchExpressions: term})
+	}
+	if len(nodeSelector.NodeSelectorTerms) == 0 {
+		return nil
+	}
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: nodeSelector,
+		},
+	}
+}
+
+// NodeSetupAffinity returns the node affinity for the node setup
+// DaemonSet with RawNamespaceConversionAll, nil otherwise. It selects
+// all nodes which lack one of the labels of the node selector or
+// which do not satisfy one of the node selector expressions.
+func (d *PmemCSIDeployment) NodeSetupAffinity() *corev1.Affinity {
+	if d.Spec.RawNamespaceConversion != RawNamespaceConversionAll {
+		return nil
+	}
+
+	nodeSelector := d.unlabelledNodes()
+	for _, req := range nodeSelectorRequirements(d.Spec.NodeSelectorExpressions, true) {
+		nodeSelector.NodeSelectorTerms = append(nodeSelector.NodeSelectorTerms,
+			corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{req},
+			})
+	}
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: nodeSelector,
+		},
+	}
+}
+
+// NodeDiscoveryAffinity returns the node affinity for the node
+// discovery DaemonSet. It selects all nodes which lack one of the
+// labels of the node selector and satisfy the
+// NodeSelectorExpressions. Discovery only adds labels, so on other
+// nodes the driver would not run anyway.
+func (d *PmemCSIDeployment) NodeDiscoveryAffinity() *corev1.Affinity {
+	var terms [][]corev1.NodeSelectorRequirement
+	for _, term := range d.unlabelledNodes().NodeSelectorTerms {
+		terms = append(terms, term.MatchExpressions)
+	}
+	return d.nodeAffinity(terms)
+}
+
+// unlabelledNodes returns a node selector with one NotIn term per
+// label of the node selector, sorted by key.
+func (d *PmemCSIDeployment) unlabelledNodes() *corev1.NodeSelector {
+	var keys []string
+	for key := range d.Spec.NodeSelector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	nodeSelector := &corev1.NodeSelector{}
+	for _, key := range keys {
+		nodeSelector.NodeSelectorTerms = append(nodeSelector.NodeSelectorTerms,
+			corev1.NodeSelectorTerm{
+				MatchExpressions: []corev1.NodeSelectorRequirement{
+					{
+						Key:      key,
+						Operator: corev1.NodeSelectorOpNotIn,
+						Values:   []string{d.Spec.NodeSelector[key]},
+					},
+				},
+			})
+	}
+	return nodeSelector
+}
+
+// nodeModeRequirements returns one NotIn requirement for each label
+// of the node mode selector, sorted by key. Labels which are also
+// required by the deployment cannot exclude a node and are skipped.
+func nodeModeRequirements(deploymentSelector, modeSelector map[string]string) []corev1.NodeSelectorRequirement {
+	var keys []string
+	for key, value := range modeSelector {
+		if deploymentValue, ok := deploymentSelector[key]; ok && deploymentValue == value {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var reqs []corev1.NodeSelectorRequirement
+	for _, key := range keys {
+		reqs = append(reqs, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpNotIn,
+			Values:   []string{modeSelector[key]},
+		})
+	}
+	return reqs
+}
+
+// nodeSelectorRequirements converts label selector requirements into
+// node selector requirements, optionally with the inverse operator.
+func nodeSelectorRequirements(exprs []metav1.LabelSelectorRequirement, negate bool) []corev1.NodeSelectorRequirement {
+	var reqs []corev1.NodeSelectorRequirement
+	for _, expr := range exprs {
+		op := corev1.NodeSelectorOperator(expr.Operator)
+		if negate {
+			op = negatedOperators[op]
+		}
+		reqs = append(reqs, corev1.NodeSelectorRequirement{
+			Key:      expr.Key,
+			Operator: op,
+			Values:   expr.Values,
+		})
+	}
+	return reqs
+}
+
+var negatedOperators = map[corev1.NodeSelectorOperator]corev1.NodeSelectorOperator{
+	corev1.NodeSelectorOpIn:           corev1.NodeSelectorOpNotIn,
+	corev1.NodeSelectorOpNotIn:        corev1.NodeSelectorOpIn,
+	corev1.NodeSelectorOpExists:       corev1.NodeSelectorOpDoesNotExist,
+	corev1.NodeSelectorOpDoesNotExist: corev1.NodeSelectorOpExists,
+}
+
+func containsRequirement(reqs []corev1.NodeSelectorRequirement, req corev1.NodeSelectorRequirement) bool {
+	for _, r := range reqs {
+		if r.Key == req.Key && r.Values[0] == req.Values[0] {
+			return true
+		}
+	}
+	return false
+}
+
 // ControllerDriverName returns the name of the controller
 // StatefulSet object name used by the deployment
 func (d *PmemCSIDeployment) ControllerDriverName() string {
 	return d.GetHyphenedName() + "-controller"
 }
 
+// PVCValidationPolicyName returns the name of the
+// ValidatingAdmissionPolicy for PVCs and of its binding.
+func (d *PmemCSIDeployment) PVCValidationPolicyName() string {
+	return d.GetHyphenedName() + "-pvcs"
+}
+
+// ControllerPodDisruptionBudgetName returns the name of the
+// PodDisruptionBudget for the controller pods
+func (d *PmemCSIDeployment) ControllerPodDisruptionBudgetName() string {
+	return d.GetHyphenedName() + "-controller"
+}
+
 // NodeSetupServiceAccountName returns the name of the service account
 // used by the StatefulSet with the webhooks.
 func (d *PmemCSIDeployment) NodeSetupServiceAccountName() string {
@@ -595,6 +1779,29 @@ func (d *PmemCSIDeployment) NodeSetupName() string {
 	return d.GetHyphenedName() + "-node-setup"
 }
 
+// NodeDiscoveryName returns the name of the node discovery
+// DaemonSet.
+func (d *PmemCSIDeployment) NodeDiscoveryName() string {
+	return d.GetHyphenedName() + "-node-discovery"
+}
+
+// NodeWipeName returns the name of the DaemonSet which wipes
+// the nodes for UninstallPolicyWipe.
+func (d *PmemCSIDeployment) NodeWipeName() string {
+	return d.GetHyphenedName() + "-node-wipe"
+}
+
+// NeedsUninstallFinalizer returns true if the uninstall policy
+// requires some action before the deployment may be removed.
+func (d *PmemCSIDeployment) NeedsUninstallFinalizer() bool {
+	switch d.Spec.UninstallPolicy {
+	case UninstallPolicyRetain, UninstallPolicyWipe:
+		return true
+	default:
+		return false
+	}
+}
+
 // GetOwnerReference returns self owner reference could be used by other object
 // to add this deployment to it's owner reference list.
 func (d *PmemCSIDeployment) GetOwnerReference() metav1.OwnerReference {
@@ -610,6 +1817,28 @@ func (d *PmemCSIDeployment) GetOwnerReference() metav1.OwnerReference {
 	}
 }
 
+// RestartAnnotations returns the pod template annotations which
+// trigger a rolling restart when Spec.RestartedAt changes.
+func (d *PmemCSIDeployment) RestartAnnotations() map[string]string {
+	if d.Spec.RestartedAt == nil {
+		return nil
+	}
+	return map[string]string{
+		RestartedAtAnnotation: d.Spec.RestartedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// IsPaused returns true if reconciliation of the deployment is paused.
+func (d *PmemCSIDeployment) IsPaused() bool {
+	return d.GetAnnotations()[PausedAnnotation] == "true"
+}
+
+// IsAdopting returns true if the deployment may take over existing
+// objects.
+func (d *PmemCSIDeployment) IsAdopting() bool {
+	return d.GetAnnotations()[AdoptAnnotation] == "true"
+}
+
 // GetControllerReplicas returns a non-zero replica number for the controller.
 func (d *PmemCSIDeployment) GetControllerReplicas() int {
 	if d.Spec.ControllerReplicas <= 0 {
@@ -617,3 +1846,49 @@ func (d *PmemCSIDeployment) GetControllerReplicas() int {
 	}
 	return d.Spec.ControllerReplicas
 }
+
+// validatePMEMReserved checks the format of DeploymentSpec.PMEMReserved.
+func validatePMEMReserved(value string) error {
+	if value == "" {
+		return nil
+	}
+	if percent := strings.TrimSuffix(value, "%"); percent != value {
+		p, err := strconv.ParseUint(percent, 10, 8)
+		if err != nil || p > 100 {
+			return fmt.Errorf("percentage must be 0..100, got %q", value)
+		}
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return err
+	}
+	if quantity.Sign() < 0 {
+		return fmt.Errorf("size must not be negative, got %q", value)
+	}
+	return nil
+}
+
+// validatePMEMPools checks what the -pmemPool parameter of the node
+// driver would reject.
+func validatePMEMPools(pools []PMEMPoolSpec) error {
+	names := map[string]bool{}
+	for _, pool := range pools {
+		if pool.Name == "" || strings.ContainsAny(pool.Name, "=,") {
+			return fmt.Errorf("invalid pool name %q", pool.Name)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("pool %q defined more than once", pool.Name)
+		}
+		names[pool.Name] = true
+		if len(pool.Regions) == 0 {
+			return fmt.Errorf("pool %q: no regions", pool.Name)
+		}
+		for _, region := range pool.Regions {
+			if !strings.HasPrefix(region, "region") || strings.Contains(region, ",") {
+				return fmt.Errorf("pool %q: invalid region name %q", pool.Name, region)
+			}
+		}
+	}
+	return nil
+}
@@ -9,13 +9,19 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/intel/pmem-csi/pkg/apis"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -45,6 +51,8 @@ var _ = Describe("Operator", func() {
 			Expect(d.Spec.PullPolicy).Should(BeEquivalentTo(api.DefaultImagePullPolicy), "default image pull policy mismatch")
 			Expect(d.Spec.ProvisionerImage).Should(BeEquivalentTo(api.DefaultProvisionerImage), "default provisioner image mismatch")
 			Expect(d.Spec.NodeRegistrarImage).Should(BeEquivalentTo(api.DefaultRegistrarImage), "default node driver registrar image mismatch")
+			Expect(d.Spec.ControllerPriorityClassName).Should(BeEquivalentTo(api.DefaultControllerPriorityClassName), "default controller priority class mismatch")
+			Expect(d.Spec.NodePriorityClassName).Should(BeEquivalentTo(api.DefaultNodePriorityClassName), "default node priority class mismatch")
 
 			Expect(d.Spec.ControllerDriverResources).ShouldNot(BeNil(), "default controller resources not set")
 
@@ -132,6 +140,539 @@ spec:
 			Expect(rs.Memory().Cmp(resource.MustParse("150Mi"))).Should(BeZero(), "provisioner 'memory' resource requests mismatch")
 		})
 
+		It("shall reject unsupported seccomp profile", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					SeccompProfile: &corev1.SeccompProfile{
+						Type: corev1.SeccompProfileTypeUnconfined,
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject duplicate storage classes", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					StorageClasses: []api.StorageClassSpec{
+						{Name: "pmem-csi-sc"},
+						{Name: "pmem-csi-sc", FSType: "xfs"},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject more than one default storage class", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					StorageClasses: []api.StorageClassSpec{
+						{Name: "pmem-csi-sc-ext4", Default: true},
+						{Name: "pmem-csi-sc-xfs", FSType: "xfs", Default: true},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject maxSurge with node host network", func() {
+			surge := intstr.FromString("10%")
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					MaxSurge:        &surge,
+					NodeHostNetwork: true,
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject rolling update parameters for Recreate", func() {
+			one := intstr.FromInt(1)
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					ControllerUpdateStrategy: &appsv1.DeploymentStrategy{
+						Type: appsv1.RecreateDeploymentStrategyType,
+						RollingUpdate: &appsv1.RollingUpdateDeployment{
+							MaxSurge: &one,
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject conflicting node ports", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					Ports: &api.PortsSpec{
+						ProvisionerMetrics: api.DefaultNodeMetricsPort,
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall accept pools", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					PMEMPools: []api.PMEMPoolSpec{
+						{Name: "socket0", Regions: []string{"region0", "region2"}},
+						{Name: "socket1", Regions: []string{"region1"}},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall reject invalid pools", func() {
+			for _, pools := range [][]api.PMEMPoolSpec{
+				{{Name: "", Regions: []string{"region0"}}},
+				{{Name: "a=b", Regions: []string{"region0"}}},
+				{{Name: "socket0"}},
+				{{Name: "socket0", Regions: []string{"namespace0.0"}}},
+				{{Name: "socket0", Regions: []string{"region0"}}, {Name: "socket0", Regions: []string{"region1"}}},
+			} {
+				d := api.PmemCSIDeployment{
+					Spec: api.DeploymentSpec{
+						PMEMPools: pools,
+					},
+				}
+				err := d.EnsureDefaults("")
+				Expect(err).Should(HaveOccurred(), "ensure defaults for %v", pools)
+			}
+		})
+
+		It("shall default node modes", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					DeviceMode:     api.DeviceModeDirect,
+					PMEMPercentage: 80,
+					NodeModes: []api.NodeModeSpec{
+						{
+							Name:         "lvm",
+							NodeSelector: map[string]string{"pool": "lvm"},
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.NodeModes[0].DeviceMode).Should(BeEquivalentTo(api.DeviceModeDirect), "node mode device mode")
+			Expect(d.Spec.NodeModes[0].PMEMPercentage).Should(BeEquivalentTo(80), "node mode percentage")
+		})
+
+		It("shall accept device mode auto", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					DeviceMode: api.DeviceModeAuto,
+					NodeModes: []api.NodeModeSpec{
+						{
+							Name:         "lvm",
+							NodeSelector: map[string]string{"pool": "lvm"},
+							DeviceMode:   api.DeviceModeLVM,
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.DeviceMode).Should(BeEquivalentTo(api.DeviceModeAuto), "driver mode")
+		})
+
+		It("shall reject node modes for all nodes", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeModes: []api.NodeModeSpec{
+						{
+							Name:         "all",
+							NodeSelector: api.DefaultNodeSelector,
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall exclude node modes from default node driver", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeModes: []api.NodeModeSpec{
+						{
+							Name:         "a",
+							NodeSelector: map[string]string{"pool": "a"},
+						},
+						{
+							Name:         "b",
+							NodeSelector: map[string]string{"pool": "b", "zone": "x"},
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			affinity := d.NodeModesAffinity()
+			Expect(affinity).ShouldNot(BeNil(), "affinity")
+			notIn := func(key, value string) corev1.NodeSelectorRequirement {
+				return corev1.NodeSelectorRequirement{Key: key, Operator: corev1.NodeSelectorOpNotIn, Values: []string{value}}
+			}
+			Expect(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{notIn("pool", "a"), notIn("pool", "b")}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{notIn("pool", "a"), notIn("zone", "x")}},
+			}), "node selector terms")
+		})
+
+		It("shall add finalizer only when uninstalling needs it", func() {
+			d := api.PmemCSIDeployment{}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.UninstallPolicy).Should(BeEquivalentTo(api.UninstallPolicyDelete), "default uninstall policy")
+			Expect(d.NeedsUninstallFinalizer()).Should(BeFalse(), "finalizer for Delete")
+			d.Spec.UninstallPolicy = api.UninstallPolicyWipe
+			Expect(d.NeedsUninstallFinalizer()).Should(BeTrue(), "finalizer for Wipe")
+		})
+
+		It("shall reject unknown uninstall policy", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					UninstallPolicy: "Keep",
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall expand resource profile", func() {
+			nodeDriverResources := &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU: resource.MustParse("1"),
+				},
+			}
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					ResourceProfile:     api.ResourceProfileLarge,
+					NodeDriverResources: nodeDriverResources.DeepCopy(),
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.NodeDriverResources).Should(Equal(nodeDriverResources), "explicit node driver resources")
+			Expect(d.Spec.ControllerDriverResources.Limits.Memory().String()).Should(Equal("512Mi"), "controller driver memory limit")
+			Expect(d.Spec.NodeRegistrarResources.Requests.Cpu().String()).Should(Equal("20m"), "node registrar CPU request")
+
+			d = api.PmemCSIDeployment{}
+			err = d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.ResourceProfile).Should(Equal(api.ResourceProfileMedium), "default resource profile")
+			Expect(d.Spec.NodeDriverResources.Requests.Cpu().String()).Should(Equal(api.DefaultNodeResourceRequestCPU), "default node driver CPU request")
+			Expect(d.Spec.NodeDriverResources.Limits).Should(BeEmpty(), "default node driver limits")
+		})
+
+		It("shall validate PVC sizes", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					ValidatePVCs: true,
+					NodeModes: []api.NodeModeSpec{
+						{
+							Name:         "direct",
+							NodeSelector: map[string]string{"pmem-pool": "direct"},
+							DeviceMode:   api.DeviceModeDirect,
+						},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.WithPVCValidation()).Should(BeFalse(), "validation without storage classes")
+			d.Spec.StorageClasses = []api.StorageClassSpec{{Name: "a"}, {Name: "b"}}
+			Expect(d.WithPVCValidation()).Should(BeTrue(), "validation with storage classes")
+
+			spec := d.PVCValidationPolicySpec()
+			Expect(spec.MatchConditions[0].Expression).Should(ContainSubstring("in ['a', 'b']"), "storage classes")
+			Expect(spec.Validations).Should(HaveLen(1), "validations without capacity")
+			Expect(spec.Validations[0].Expression).Should(ContainSubstring("quantity('2Mi')"), "minimum size of direct mode")
+
+			small, large, total := resource.MustParse("10Gi"), resource.MustParse("20Gi"), resource.MustParse("30Gi")
+			d.Status.Nodes = []api.NodeStatus{
+				{Node: "a", Capacity: &small, TotalCapacity: &total},
+				{Node: "b", Capacity: &large, TotalCapacity: &large},
+				{Node: "c"},
+			}
+			spec = d.PVCValidationPolicySpec()
+			Expect(spec.Validations).Should(HaveLen(2), "validations with capacity")
+			Expect(spec.Validations[1].Expression).Should(ContainSubstring("quantity('30Gi')"), "maximum size is total capacity")
+		})
+
+		It("shall reject unknown resource profile", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					ResourceProfile: "huge",
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall exclude selected nodes from node setup", func() {
+			d := api.PmemCSIDeployment{}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.RawNamespaceConversion).Should(Equal(api.RawNamespaceConversionLabelledOnly), "default raw namespace conversion")
+			Expect(d.WithNodeSetup()).Should(BeTrue(), "node setup for labelled-only")
+			Expect(d.NodeSetupAffinity()).Should(BeNil(), "affinity for labelled-only")
+
+			d.Spec.RawNamespaceConversion = api.RawNamespaceConversionAll
+			affinity := d.NodeSetupAffinity()
+			Expect(affinity).ShouldNot(BeNil(), "affinity for all")
+			Expect(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "storage", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"pmem"}}}},
+			}), "node selector terms")
+
+			d.Spec.RawNamespaceConversion = api.RawNamespaceConversionDisabled
+			Expect(d.WithNodeSetup()).Should(BeFalse(), "node setup for disabled")
+		})
+
+		It("shall combine node selector expressions with node affinity", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeSelectorExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "storage", Operator: metav1.LabelSelectorOpIn, Values: []string{"pmem", "optane"}},
+					},
+					RawNamespaceConversion: api.RawNamespaceConversionAll,
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			in := corev1.NodeSelectorRequirement{Key: "storage", Operator: corev1.NodeSelectorOpIn, Values: []string{"pmem", "optane"}}
+			affinity := d.NodeModesAffinity()
+			Expect(affinity).ShouldNot(BeNil(), "affinity")
+			Expect(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{in}},
+			}), "node selector terms")
+
+			affinity = d.NodeSetupAffinity()
+			Expect(affinity).ShouldNot(BeNil(), "node setup affinity")
+			Expect(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "storage", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"pmem"}}}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "storage", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"pmem", "optane"}}}},
+			}), "node setup terms")
+
+			nodeSelector := d.DriverNodeSelector()
+			Expect(nodeSelector.MatchesLabels(map[string]string{"storage": "pmem"})).Should(BeTrue(), "pmem node")
+			Expect(nodeSelector.MatchesLabels(map[string]string{"storage": "optane"})).Should(BeFalse(), "optane node without default label")
+		})
+
+		It("shall reject invalid node selector expressions", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeSelectorExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "storage", Operator: metav1.LabelSelectorOpIn},
+					},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+		})
+
+		It("shall support ephemeral-only deployments", func() {
+			d := api.PmemCSIDeployment{}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.Spec.VolumeLifecycleModes).Should(Equal([]storagev1.VolumeLifecycleMode{
+				storagev1.VolumeLifecyclePersistent,
+				storagev1.VolumeLifecycleEphemeral,
+			}), "default volume lifecycle modes")
+			Expect(d.WithProvisioner()).Should(BeTrue(), "provisioner by default")
+
+			d.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral}
+			err = d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults for ephemeral-only")
+			Expect(d.WithProvisioner()).Should(BeFalse(), "provisioner for ephemeral-only")
+
+			d.Spec.StorageClasses = []api.StorageClassSpec{{Name: "pmem-csi-sc"}}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "storage classes for ephemeral-only")
+		})
+
+		It("shall reject invalid volume lifecycle modes", func() {
+			for _, modes := range [][]storagev1.VolumeLifecycleMode{
+				{},
+				{"Temporary"},
+				{storagev1.VolumeLifecycleEphemeral, storagev1.VolumeLifecycleEphemeral},
+			} {
+				d := api.PmemCSIDeployment{
+					Spec: api.DeploymentSpec{
+						VolumeLifecycleModes: modes,
+					},
+				}
+				err := d.EnsureDefaults("")
+				Expect(err).Should(HaveOccurred(), "ensure defaults for %v", modes)
+			}
+		})
+
+		It("shall reject invalid token requests", func() {
+			expiration := int64(60)
+			for _, tokenRequests := range [][]storagev1.TokenRequest{
+				{{Audience: "a"}, {Audience: "a"}},
+				{{Audience: "a", ExpirationSeconds: &expiration}},
+			} {
+				d := api.PmemCSIDeployment{
+					Spec: api.DeploymentSpec{
+						TokenRequests: tokenRequests,
+					},
+				}
+				err := d.EnsureDefaults("")
+				Expect(err).Should(HaveOccurred(), "ensure defaults for %v", tokenRequests)
+			}
+		})
+
+		It("shall annotate pods for a restart", func() {
+			d := api.PmemCSIDeployment{}
+			Expect(d.RestartAnnotations()).Should(BeNil(), "annotations without restart")
+			restartedAt := metav1.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+			d.Spec.RestartedAt = &restartedAt
+			Expect(d.RestartAnnotations()).Should(Equal(map[string]string{
+				api.RestartedAtAnnotation: "2021-01-01T12:00:00Z",
+			}), "annotations with restart")
+		})
+
+		It("shall reject invalid raw namespace conversion", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					RawNamespaceConversion: "some",
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults")
+
+			d = api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeSelector:           map[string]string{},
+					RawNamespaceConversion: api.RawNamespaceConversionAll,
+				},
+			}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults with empty node selector")
+		})
+
+		It("shall reject invalid PMEM goals", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					PMEMGoal: &api.PMEMGoalSpec{AppDirectPercentage: 50},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+
+			d.Spec.PMEMGoal.AppDirectPercentage = 0
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "zero percentage")
+
+			d.Spec.PMEMGoal.AppDirectPercentage = 101
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "too large percentage")
+
+			d.Spec.PMEMGoal.AppDirectPercentage = 100
+			d.Spec.RawNamespaceConversion = api.RawNamespaceConversionDisabled
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "without node setup")
+		})
+
+		It("shall reject invalid PMEM bus types", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					PMEMBusTypes: []api.PMEMBusType{api.PMEMBusTypeCXL},
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+
+			d.Spec.PMEMBusTypes = []api.PMEMBusType{"pci"}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "unknown bus type")
+
+			d.Spec.PMEMBusTypes = []api.PMEMBusType{api.PMEMBusTypeNVDIMM, api.PMEMBusTypeNVDIMM}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "duplicate bus type")
+		})
+
+		It("shall reject invalid PMEM reservations", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					PMEMReserved: "10%",
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "percentage")
+
+			d.Spec.PMEMReserved = "16Gi"
+			err = d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "size")
+
+			d.Spec.PMEMReserved = "101%"
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "percentage too large")
+
+			d.Spec.PMEMReserved = "-1Gi"
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "negative size")
+
+			d.Spec.PMEMReserved = "lots"
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "invalid size")
+		})
+
+		It("shall discover PMEM on unlabelled nodes", func() {
+			d := api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeDiscovery:          true,
+					RawNamespaceConversion: api.RawNamespaceConversionDisabled,
+				},
+			}
+			err := d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults")
+			Expect(d.WithNodeSetup()).Should(BeFalse(), "node setup")
+			Expect(d.WithNodeSetupRBAC()).Should(BeTrue(), "node setup RBAC")
+			Expect(d.NodeDiscoveryAffinity().NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "storage", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"pmem"}}}},
+			}), "node selector terms")
+
+			// Nodes which do not satisfy the expressions are
+			// not checked because labelling them is not enough.
+			d = api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeDiscovery: true,
+					NodeSelector:  map[string]string{"storage": "pmem", "zone": "a"},
+					NodeSelectorExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "kind", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"virtual"}},
+					},
+				},
+			}
+			err = d.EnsureDefaults("")
+			Expect(err).ShouldNot(HaveOccurred(), "ensure defaults with expressions")
+			notVirtual := corev1.NodeSelectorRequirement{Key: "kind", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"virtual"}}
+			Expect(d.NodeDiscoveryAffinity().NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms).Should(Equal([]corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "storage", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"pmem"}}, notVirtual}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "zone", Operator: corev1.NodeSelectorOpNotIn, Values: []string{"a"}}, notVirtual}},
+			}), "node selector terms with expressions")
+
+			d = api.PmemCSIDeployment{
+				Spec: api.DeploymentSpec{
+					NodeDiscovery: true,
+					NodeSelector:  map[string]string{},
+				},
+			}
+			err = d.EnsureDefaults("")
+			Expect(err).Should(HaveOccurred(), "ensure defaults with empty node selector")
+		})
+
 		It("should have valid json schema", func() {
 
 			crdFile := os.Getenv("REPO_ROOT") + "/deploy/crd/pmem-csi.intel.com_pmemcsideployments.yaml"
@@ -167,6 +708,11 @@ spec:
 				"provisionerResources":      "object",
 				"nodeRegistrarResources":    "object",
 				"kubeletDir":                "string",
+				"seccompProfile":            "object",
+				"appArmorProfile":           "string",
+				"metrics":                   "object",
+				"annotations":               "object",
+				"storageClasses":            "array",
 			}
 
 			for key := range spec.Properties {
@@ -15,11 +15,12 @@ import (
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
-	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/intel/pmem-csi/pkg/version"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/scheme"
 )
 
@@ -81,7 +82,7 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 				[]byte(fmt.Sprintf("-logging-format=%s", deployment.Spec.LogFormat)))
 		}
 
-		nodeSelector := types.NodeSelector(deployment.Spec.NodeSelector)
+		nodeSelector := deployment.DriverNodeSelector()
 		*yaml = bytes.ReplaceAll(*yaml,
 			[]byte(`-nodeSelector={"storage":"pmem"}`),
 			[]byte("-nodeSelector="+nodeSelector.String()))
@@ -90,9 +91,44 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 	}
 
 	enabled := func(obj *unstructured.Unstructured) bool {
+		if !deployment.WithController() {
+			switch obj.GetName() {
+			case deployment.ControllerDriverName():
+				if obj.GetKind() == "Deployment" {
+					return false
+				}
+			case deployment.WebhooksServiceAccountName(),
+				deployment.WebhooksRoleName(),
+				deployment.WebhooksRoleBindingName(),
+				deployment.WebhooksClusterRoleName(),
+				deployment.WebhooksClusterRoleBindingName():
+				return false
+			}
+		}
+		if !deployment.WithNodeSetupRBAC() {
+			// The node setup DaemonSet is also the template for
+			// the node discovery and gets removed later if not needed.
+			switch obj.GetName() {
+			case deployment.NodeSetupName(),
+				deployment.NodeSetupServiceAccountName(),
+				deployment.NodeSetupClusterRoleName(),
+				deployment.NodeSetupClusterRoleBindingName():
+				return false
+			}
+		}
+		if !deployment.WithProvisioner() {
+			switch obj.GetName() {
+			case deployment.ProvisionerRoleName(),
+				deployment.ProvisionerRoleBindingName(),
+				deployment.ProvisionerClusterRoleName(),
+				deployment.ProvisionerClusterRoleBindingName():
+				return false
+			}
+		}
 		return true
 	}
 
+	ports := portsWithDefaults(deployment)
 	patchUnstructured := func(obj *unstructured.Unstructured) {
 		if deployment.Spec.Labels != nil {
 			labels := obj.GetLabels()
@@ -114,12 +150,57 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 				// TODO: avoid panic
 				panic(fmt.Errorf("set controller resources: %v", err))
 			}
+			patchLivenessProbe(obj, deployment, false)
+			patchRestartedAt(obj, deployment)
+			patchPort(obj, "pmem-driver", api.DefaultControllerMetricsPort, ports.ControllerMetrics)
+			patchHostNetwork(obj, deployment.Spec.ControllerHostNetwork)
+			patchSecurityProfiles(obj, deployment)
+			patchRuntimeClassName(obj, deployment.Spec.RuntimeClassName)
 			outerSpec := obj.Object["spec"].(map[string]interface{})
 			replicas := int64(deployment.Spec.ControllerReplicas)
 			if replicas == 0 {
 				replicas = 1
 			}
 			outerSpec["replicas"] = replicas
+			patchPriorityClassName(obj, deployment.Spec.ControllerPriorityClassName)
+			if deployment.Spec.ControllerUpdateStrategy != nil {
+				strategy, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment.Spec.ControllerUpdateStrategy)
+				if err != nil {
+					// TODO: avoid panic
+					panic(fmt.Errorf("set controller update strategy: %v", err))
+				}
+				outerSpec["strategy"] = strategy
+			}
+			if replicas > 1 {
+				patchLeaderElection(obj)
+			}
+		case "CSIDriver":
+			modes := []interface{}{}
+			for _, mode := range deployment.Spec.VolumeLifecycleModes {
+				modes = append(modes, string(mode))
+			}
+			obj.Object["spec"].(map[string]interface{})["volumeLifecycleModes"] = modes
+			if len(deployment.Spec.TokenRequests) > 0 {
+				tokenRequests := []interface{}{}
+				for _, tokenRequest := range deployment.Spec.TokenRequests {
+					value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&tokenRequest)
+					if err != nil {
+						// TODO: avoid panic
+						panic(fmt.Errorf("convert token request: %v", err))
+					}
+					tokenRequests = append(tokenRequests, value)
+				}
+				obj.Object["spec"].(map[string]interface{})["tokenRequests"] = tokenRequests
+			}
+		case "Role":
+			if obj.GetName() == deployment.WebhooksRoleName() && deployment.GetControllerReplicas() > 1 {
+				rules, _ := obj.Object["rules"].([]interface{})
+				obj.Object["rules"] = append(rules, map[string]interface{}{
+					"apiGroups": []interface{}{"coordination.k8s.io"},
+					"resources": []interface{}{"leases"},
+					"verbs":     []interface{}{"get", "create", "update"},
+				})
+			}
 		case "DaemonSet":
 			switch obj.GetName() {
 			case deployment.NodeSetupName():
@@ -127,20 +208,46 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					// TODO: avoid panic
 					panic(fmt.Errorf("set node resources: %v", err))
 				}
+				patchSecurityProfiles(obj, deployment)
+				patchRuntimeClassName(obj, deployment.Spec.RuntimeClassName)
+				if err := patchNodeSetup(obj, deployment); err != nil {
+					// TODO: avoid panic
+					panic(fmt.Errorf("set node setup parameters: %v", err))
+				}
+				patchPMEMBusTypes(obj, deployment)
 			case deployment.NodeDriverName():
 				resources := map[string]*corev1.ResourceRequirements{
 					"pmem-driver":          deployment.Spec.NodeDriverResources,
 					"external-provisioner": deployment.Spec.ProvisionerResources,
 					"driver-registrar":     deployment.Spec.NodeRegistrarResources,
 				}
+				if !deployment.WithProvisioner() {
+					removeContainer(obj, "external-provisioner")
+				}
+				// The sidecar must exist before patching the pod template.
+				patchLivenessProbe(obj, deployment, true)
 				if err := patchPodTemplate(obj, deployment, resources); err != nil {
 					// TODO: avoid panic
 					panic(fmt.Errorf("set node resources: %v", err))
 				}
+				patchRestartedAt(obj, deployment)
+				patchPMEMReserved(obj, deployment)
+				patchSystemRAMPercentage(obj, deployment)
+				patchPMEMPools(obj, deployment)
+				patchPMEMBusTypes(obj, deployment)
+				patchPort(obj, "pmem-driver", api.DefaultNodeMetricsPort, ports.NodeMetrics)
+				patchPort(obj, "external-provisioner", api.DefaultProvisionerMetricsPort, ports.ProvisionerMetrics)
+				patchHostNetwork(obj, deployment.Spec.NodeHostNetwork)
+				patchPriorityClassName(obj, deployment.Spec.NodePriorityClassName)
+				patchSecurityProfiles(obj, deployment)
+				patchRuntimeClassName(obj, deployment.Spec.RuntimeClassName)
 				outerSpec := obj.Object["spec"].(map[string]interface{})
 				updateStrategy := outerSpec["updateStrategy"].(map[string]interface{})
 				rollingUpdate := updateStrategy["rollingUpdate"].(map[string]interface{})
-				rollingUpdate["maxUnavailable"] = deployment.Spec.MaxUnavailable
+				rollingUpdate["maxUnavailable"] = intOrStringValue(deployment.Spec.MaxUnavailable)
+				if deployment.Spec.MaxSurge != nil {
+					rollingUpdate["maxSurge"] = intOrStringValue(deployment.Spec.MaxSurge)
+				}
 				template := outerSpec["template"].(map[string]interface{})
 				spec := template["spec"].(map[string]interface{})
 				if deployment.Spec.NodeSelector != nil {
@@ -150,6 +257,14 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 					}
 					spec["nodeSelector"] = selector
 				}
+				if affinity := deployment.NodeSelectorAffinity(); affinity != nil {
+					value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(affinity)
+					if err != nil {
+						// TODO: avoid panic
+						panic(fmt.Errorf("convert node affinity: %v", err))
+					}
+					spec["affinity"] = value
+				}
 			}
 		}
 	}
@@ -159,9 +274,436 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 		return nil, err
 	}
 
+	// Not part of the reference YAMLs because those
+	// only use a single controller replica.
+	if deployment.WithController() && deployment.GetControllerReplicas() > 1 {
+		objects = append(objects, controllerPodDisruptionBudget(namespace, deployment))
+	}
+	if deployment.WithServiceMonitor() {
+		for _, obj := range serviceMonitorObjects(namespace, deployment) {
+			if deployment.WithController() || obj.GetLabels()["app.kubernetes.io/component"] != "controller" {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	for _, sc := range deployment.Spec.StorageClasses {
+		objects = append(objects, storageClass(deployment, sc))
+	}
+	if deployment.WithPVCValidation() && kubernetes.Compare(1, 30) >= 0 {
+		validationObjects, err := pvcValidationObjects(deployment)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, validationObjects...)
+	}
+	if len(deployment.Spec.NodeModes) > 0 {
+		objects, err = nodeModeDaemonSets(objects, deployment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if deployment.Spec.NodeDiscovery {
+		objects, err = nodeDiscoveryDaemonSet(objects, deployment)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(deployment.Spec.Annotations) > 0 {
+		for i := range objects {
+			annotations := objects[i].GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			for key, value := range deployment.Spec.Annotations {
+				annotations[key] = value
+			}
+			objects[i].SetAnnotations(annotations)
+		}
+	}
+
 	return objects, nil
 }
 
+func storageClass(deployment api.PmemCSIDeployment, sc api.StorageClassSpec) unstructured.Unstructured {
+	parameters := map[string]interface{}{}
+	if sc.FSType != "" {
+		parameters["csi.storage.k8s.io/fstype"] = sc.FSType
+	}
+	if sc.Usage != "" {
+		parameters["usage"] = sc.Usage
+	}
+	if sc.EraseAfter != nil {
+		parameters["eraseafter"] = fmt.Sprintf("%v", *sc.EraseAfter)
+	}
+	if sc.VerifyErase != nil {
+		parameters["verifyErase"] = fmt.Sprintf("%v", *sc.VerifyErase)
+	}
+	bindingMode := string(sc.VolumeBindingMode)
+	if bindingMode == "" {
+		bindingMode = "WaitForFirstConsumer"
+	}
+	obj := unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"provisioner":       deployment.GetName(),
+			"volumeBindingMode": bindingMode,
+		},
+	}
+	if len(parameters) > 0 {
+		obj.Object["parameters"] = parameters
+	}
+	obj.SetAPIVersion("storage.k8s.io/v1")
+	obj.SetKind("StorageClass")
+	obj.SetName(sc.Name)
+	if sc.Default {
+		obj.SetAnnotations(map[string]string{"storageclass.kubernetes.io/is-default-class": "true"})
+	}
+	if deployment.Spec.Labels != nil {
+		labels := map[string]string{}
+		for key, value := range deployment.Spec.Labels {
+			labels[key] = value
+		}
+		obj.SetLabels(labels)
+	}
+	return obj
+}
+
+// intOrStringValue converts to a value that can be stored in an
+// unstructured object.
+func intOrStringValue(value *intstr.IntOrString) interface{} {
+	switch {
+	case value == nil:
+		return nil
+	case value.Type == intstr.String:
+		return value.StrVal
+	default:
+		return int64(value.IntVal)
+	}
+}
+
+// nodeModeDaemonSets adds one copy of the node driver DaemonSet per
+// node mode and keeps the original one away from their nodes.
+func nodeModeDaemonSets(objects []unstructured.Unstructured, deployment api.PmemCSIDeployment) ([]unstructured.Unstructured, error) {
+	var nodeDriver *unstructured.Unstructured
+	for i := range objects {
+		if objects[i].GetKind() == "DaemonSet" && objects[i].GetName() == deployment.NodeDriverName() {
+			nodeDriver = &objects[i]
+			break
+		}
+	}
+	if nodeDriver == nil {
+		return nil, fmt.Errorf("node driver DaemonSet %q not found", deployment.NodeDriverName())
+	}
+
+	var modeDaemonSets []unstructured.Unstructured
+	for _, mode := range deployment.Spec.NodeModes {
+		obj := nodeDriver.DeepCopy()
+		obj.SetName(deployment.NodeModeDriverName(mode.Name))
+		outerSpec := obj.Object["spec"].(map[string]interface{})
+		selector := outerSpec["selector"].(map[string]interface{})
+		selector["matchLabels"].(map[string]interface{})[api.NodeModeLabel] = mode.Name
+		template := outerSpec["template"].(map[string]interface{})
+		metadata := template["metadata"].(map[string]interface{})
+		metadata["labels"].(map[string]interface{})[api.NodeModeLabel] = mode.Name
+		spec := template["spec"].(map[string]interface{})
+		nodeSelector := map[string]interface{}{}
+		for key, value := range deployment.Spec.NodeSelector {
+			nodeSelector[key] = value
+		}
+		for key, value := range mode.NodeSelector {
+			nodeSelector[key] = value
+		}
+		spec["nodeSelector"] = nodeSelector
+		for _, container := range spec["containers"].([]interface{}) {
+			container := container.(map[string]interface{})
+			if container["name"].(string) != "pmem-driver" {
+				continue
+			}
+			cmd := container["command"].([]interface{})
+			for i := range cmd {
+				arg := cmd[i].(string)
+				switch {
+				case strings.HasPrefix(arg, "-deviceManager="):
+					cmd[i] = fmt.Sprintf("-deviceManager=%s", mode.DeviceMode)
+				case strings.HasPrefix(arg, "-pmemPercentage="):
+					cmd[i] = fmt.Sprintf("-pmemPercentage=%d", mode.PMEMPercentage)
+				}
+			}
+		}
+		modeDaemonSets = append(modeDaemonSets, *obj)
+	}
+
+	affinity, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment.NodeModesAffinity())
+	if err != nil {
+		return nil, fmt.Errorf("convert node affinity: %v", err)
+	}
+	outerSpec := nodeDriver.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	template["spec"].(map[string]interface{})["affinity"] = affinity
+
+	return append(objects, modeDaemonSets...), nil
+}
+
+// nodeDiscoveryDaemonSet adds a modified copy of the node setup
+// DaemonSet which labels nodes with PMEM. The original gets removed
+// if the node setup itself is disabled.
+func nodeDiscoveryDaemonSet(objects []unstructured.Unstructured, deployment api.PmemCSIDeployment) ([]unstructured.Unstructured, error) {
+	index := -1
+	for i := range objects {
+		if objects[i].GetKind() == "DaemonSet" && objects[i].GetName() == deployment.NodeSetupName() {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("node setup DaemonSet %q not found", deployment.NodeSetupName())
+	}
+
+	obj := objects[index].DeepCopy()
+	obj.SetName(deployment.NodeDiscoveryName())
+	labels := obj.GetLabels()
+	labels["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	labels["app.kubernetes.io/component"] = "node-discovery"
+	obj.SetLabels(labels)
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	selector := outerSpec["selector"].(map[string]interface{})
+	selector["matchLabels"].(map[string]interface{})["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	template := outerSpec["template"].(map[string]interface{})
+	metadata := template["metadata"].(map[string]interface{})
+	templateLabels := metadata["labels"].(map[string]interface{})
+	templateLabels["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	templateLabels["app.kubernetes.io/component"] = "node-discovery"
+	spec := template["spec"].(map[string]interface{})
+	delete(spec, "nodeSelector")
+	affinity, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment.NodeDiscoveryAffinity())
+	if err != nil {
+		return nil, fmt.Errorf("convert node affinity: %v", err)
+	}
+	spec["affinity"] = affinity
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		if container["name"].(string) != "pmem-driver" {
+			continue
+		}
+		var cmd []interface{}
+		for _, arg := range container["command"].([]interface{}) {
+			switch arg.(string) {
+			case "-mode=force-convert-raw-namespaces":
+				arg = "-mode=discover-pmem"
+			case "-dryRun":
+				continue
+			}
+			if strings.HasPrefix(arg.(string), "-pmemGoal=") {
+				continue
+			}
+			cmd = append(cmd, arg)
+		}
+		container["command"] = cmd
+	}
+
+	if !deployment.WithNodeSetup() {
+		objects = append(objects[:index], objects[index+1:]...)
+	}
+	return append(objects, *obj), nil
+}
+
+// patchNodeSetup applies the driver name and the raw namespace
+// conversion parameters to the node setup DaemonSet.
+func patchNodeSetup(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) error {
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	if affinity := deployment.NodeSetupAffinity(); affinity != nil {
+		value, err := runtime.DefaultUnstructuredConverter.ToUnstructured(affinity)
+		if err != nil {
+			return fmt.Errorf("convert node affinity: %v", err)
+		}
+		spec["affinity"] = value
+		delete(spec, "nodeSelector")
+	}
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		if container["name"].(string) != "pmem-driver" {
+			continue
+		}
+		// Not covered by patchPodTemplate without resources.
+		for _, entry := range container["env"].([]interface{}) {
+			entry := entry.(map[string]interface{})
+			if entry["name"].(string) == "PMEM_CSI_DRIVER_NAME" {
+				entry["value"] = deployment.GetName()
+			}
+		}
+		if deployment.Spec.RawNamespaceConversionDryRun {
+			container["command"] = append(container["command"].([]interface{}), "-dryRun")
+		}
+		if goal := deployment.Spec.PMEMGoal; goal != nil {
+			arg := fmt.Sprintf("-pmemGoal=%d", goal.AppDirectPercentage)
+			if goal.Interleaved != nil && !*goal.Interleaved {
+				arg += ",not-interleaved"
+			}
+			container["command"] = append(container["command"].([]interface{}), arg)
+		}
+	}
+	return nil
+}
+
+func serviceMonitorObjects(namespace string, deployment api.PmemCSIDeployment) []unstructured.Unstructured {
+	labels := func(component string) map[string]string {
+		labels := map[string]string{
+			"app.kubernetes.io/name":      "pmem-csi-" + component + "-metrics",
+			"app.kubernetes.io/part-of":   "pmem-csi",
+			"app.kubernetes.io/component": component,
+			"app.kubernetes.io/instance":  deployment.Name,
+		}
+		for key, value := range deployment.Spec.Labels {
+			labels[key] = value
+		}
+		return labels
+	}
+	port := func(name string, port int64) interface{} {
+		return map[string]interface{}{
+			"name":       name,
+			"port":       port,
+			"targetPort": port,
+		}
+	}
+	service := func(name, component string, spec map[string]interface{}) unstructured.Unstructured {
+		spec["selector"] = map[string]interface{}{
+			"app.kubernetes.io/name":     "pmem-csi-" + component,
+			"app.kubernetes.io/instance": deployment.Name,
+		}
+		obj := unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"spec": spec,
+			},
+		}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("Service")
+		obj.SetName(name)
+		obj.SetNamespace(namespace)
+		obj.SetLabels(labels(component))
+		return obj
+	}
+	serviceMonitor := func(name, component string, ports ...string) unstructured.Unstructured {
+		var endpoints []interface{}
+		for _, port := range ports {
+			endpoints = append(endpoints, map[string]interface{}{"port": port})
+		}
+		matchLabels := map[string]interface{}{
+			"app.kubernetes.io/name":      "pmem-csi-" + component + "-metrics",
+			"app.kubernetes.io/part-of":   "pmem-csi",
+			"app.kubernetes.io/component": component,
+			"app.kubernetes.io/instance":  deployment.Name,
+		}
+		obj := unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"spec": map[string]interface{}{
+					"endpoints": endpoints,
+					"namespaceSelector": map[string]interface{}{
+						"matchNames": []interface{}{namespace},
+					},
+					"selector": map[string]interface{}{
+						"matchLabels": matchLabels,
+					},
+				},
+			},
+		}
+		obj.SetAPIVersion("monitoring.coreos.com/v1")
+		obj.SetKind("ServiceMonitor")
+		obj.SetName(name)
+		obj.SetNamespace(namespace)
+		obj.SetLabels(labels(component))
+		return obj
+	}
+
+	metricsPorts := portsWithDefaults(deployment)
+	return []unstructured.Unstructured{
+		service(deployment.MetricsServiceName(), "controller", map[string]interface{}{
+			"type": "ClusterIP",
+			"ports": []interface{}{
+				port("metrics", int64(metricsPorts.ControllerMetrics)),
+				port("provisioner-metrics", int64(metricsPorts.ProvisionerMetrics)),
+			},
+		}),
+		service(deployment.NodeMetricsServiceName(), "node", map[string]interface{}{
+			"clusterIP": "None",
+			"ports": []interface{}{
+				port("metrics", int64(metricsPorts.NodeMetrics)),
+			},
+		}),
+		serviceMonitor(deployment.ControllerServiceMonitorName(), "controller", "metrics", "provisioner-metrics"),
+		serviceMonitor(deployment.NodeServiceMonitorName(), "node", "metrics"),
+	}
+}
+
+// pvcValidationObjects returns the ValidatingAdmissionPolicy for PVCs
+// and its binding.
+func pvcValidationObjects(deployment api.PmemCSIDeployment) ([]unstructured.Unstructured, error) {
+	policySpec := deployment.PVCValidationPolicySpec()
+	bindingSpec := deployment.PVCValidationPolicyBindingSpec()
+	var objects []unstructured.Unstructured
+	for _, item := range []struct {
+		kind string
+		spec interface{}
+	}{
+		{"ValidatingAdmissionPolicy", &policySpec},
+		{"ValidatingAdmissionPolicyBinding", &bindingSpec},
+	} {
+		spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(item.spec)
+		if err != nil {
+			return nil, fmt.Errorf("convert %s: %v", item.kind, err)
+		}
+		obj := unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"spec": spec,
+			},
+		}
+		obj.SetAPIVersion("admissionregistration.k8s.io/v1")
+		obj.SetKind(item.kind)
+		obj.SetName(deployment.PVCValidationPolicyName())
+		if deployment.Spec.Labels != nil {
+			labels := map[string]string{}
+			for key, value := range deployment.Spec.Labels {
+				labels[key] = value
+			}
+			obj.SetLabels(labels)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+func controllerPodDisruptionBudget(namespace string, deployment api.PmemCSIDeployment) unstructured.Unstructured {
+	labels := map[string]string{
+		"app.kubernetes.io/name":      "pmem-csi-controller",
+		"app.kubernetes.io/part-of":   "pmem-csi",
+		"app.kubernetes.io/component": "controller",
+		"app.kubernetes.io/instance":  deployment.Name,
+	}
+	for key, value := range deployment.Spec.Labels {
+		labels[key] = value
+	}
+	obj := unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"minAvailable": int64(1),
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{
+						"app.kubernetes.io/name":     "pmem-csi-controller",
+						"app.kubernetes.io/instance": deployment.Name,
+					},
+				},
+			},
+		},
+	}
+	obj.SetAPIVersion("policy/v1")
+	obj.SetKind("PodDisruptionBudget")
+	obj.SetName(deployment.ControllerPodDisruptionBudgetName())
+	obj.SetNamespace(namespace)
+	obj.SetLabels(labels)
+	return obj
+}
+
 func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, resources map[string]*corev1.ResourceRequirements) error {
 	outerSpec := obj.Object["spec"].(map[string]interface{})
 	template := outerSpec["template"].(map[string]interface{})
@@ -182,6 +724,27 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 		metadata["labels"] = labelsMap
 	}
 
+	if deployment.Spec.Annotations != nil {
+		annotationsMap, _ := metadata["annotations"].(map[string]interface{})
+		if annotationsMap == nil {
+			annotationsMap = map[string]interface{}{}
+		}
+		for key, value := range deployment.Spec.Annotations {
+			annotationsMap[key] = value
+		}
+		metadata["annotations"] = annotationsMap
+	}
+
+	if len(deployment.Spec.ImagePullSecrets) > 0 {
+		secrets := []interface{}{}
+		for _, secret := range deployment.Spec.ImagePullSecrets {
+			secrets = append(secrets, map[string]interface{}{"name": secret.Name})
+		}
+		spec["imagePullSecrets"] = secrets
+	}
+
+	patchProxyEnv(spec, deployment.Spec.Proxy)
+
 	if resources == nil {
 		return nil
 	}
@@ -245,6 +808,360 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 	return nil
 }
 
+// patchLivenessProbe replaces the metrics-based probes of the driver
+// container with healthz and readyz probes if the livenessprobe
+// sidecar is enabled. In the node pod, the sidecar container gets
+// added.
+func patchLivenessProbe(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, node bool) {
+	if deployment.Spec.LivenessProbeImage == "" {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	containers := spec["containers"].([]interface{})
+	healthzPort := portsWithDefaults(deployment).NodeHealthz
+	port := "metrics"
+	if node {
+		port = "healthz"
+	}
+	for _, container := range containers {
+		container := container.(map[string]interface{})
+		if container["name"].(string) != "pmem-driver" {
+			continue
+		}
+		for _, probe := range []string{"livenessProbe", "startupProbe"} {
+			httpGet := container[probe].(map[string]interface{})["httpGet"].(map[string]interface{})
+			httpGet["path"] = "/healthz"
+			httpGet["port"] = port
+		}
+		if !node {
+			// The node driver already has the readyz probes.
+			startup := container["startupProbe"].(map[string]interface{})
+			startup["httpGet"].(map[string]interface{})["path"] = "/readyz"
+			container["readinessProbe"] = map[string]interface{}{
+				"httpGet": map[string]interface{}{
+					"scheme": "HTTP",
+					"path":   "/readyz",
+					"port":   "metrics",
+				},
+				"failureThreshold": int64(3),
+				"periodSeconds":    int64(10),
+				"successThreshold": int64(1),
+				"timeoutSeconds":   int64(5),
+			}
+		}
+		if node {
+			container["ports"] = append(container["ports"].([]interface{}),
+				map[string]interface{}{
+					"name":          "healthz",
+					"containerPort": int64(healthzPort),
+					"protocol":      "TCP",
+				})
+		}
+	}
+	if node {
+		spec["containers"] = append(containers,
+			map[string]interface{}{
+				"name":            "liveness-probe",
+				"image":           deployment.Spec.LivenessProbeImage,
+				"imagePullPolicy": string(deployment.Spec.PullPolicy),
+				"args": []interface{}{
+					fmt.Sprintf("-v=%d", deployment.Spec.LogLevel),
+					"--csi-address=/csi/csi.sock",
+					fmt.Sprintf("--health-port=%d", healthzPort),
+				},
+				"securityContext": map[string]interface{}{
+					"readOnlyRootFilesystem": true,
+				},
+				"volumeMounts": []interface{}{
+					map[string]interface{}{
+						"name":      "socket-dir",
+						"mountPath": "/csi",
+					},
+				},
+				"terminationMessagePath":   "/dev/termination-log",
+				"terminationMessagePolicy": "File",
+			})
+	}
+}
+
+// patchRestartedAt adds the annotation for Spec.RestartedAt to the
+// pod template.
+func patchRestartedAt(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	restart := deployment.RestartAnnotations()
+	if restart == nil {
+		return
+	}
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	metadata := template["metadata"].(map[string]interface{})
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	if annotations == nil {
+		annotations = map[string]interface{}{}
+	}
+	for key, value := range restart {
+		annotations[key] = value
+	}
+	metadata["annotations"] = annotations
+}
+
+// patchPMEMReserved adds the -pmemReserved parameter to the
+// pmem-driver container if the deployment reserves PMEM.
+func patchPMEMReserved(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	if deployment.Spec.PMEMReserved == "" {
+		return
+	}
+	appendDriverArg(obj, "-pmemReserved="+deployment.Spec.PMEMReserved)
+}
+
+// patchSystemRAMPercentage adds the -pmemSystemRAMPercentage
+// parameter to the pmem-driver container if the deployment onlines
+// PMEM as system RAM.
+func patchSystemRAMPercentage(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	if deployment.Spec.SystemRAMPercentage == 0 {
+		return
+	}
+	appendDriverArg(obj, fmt.Sprintf("-pmemSystemRAMPercentage=%d", deployment.Spec.SystemRAMPercentage))
+}
+
+// patchPMEMPools adds one -pmemPool parameter per pool to the
+// pmem-driver container.
+func patchPMEMPools(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	for _, pool := range deployment.Spec.PMEMPools {
+		appendDriverArg(obj, "-pmemPool="+pool.Name+"="+strings.Join(pool.Regions, ","))
+	}
+}
+
+// patchPMEMBusTypes adds the -pmemBusTypes parameter to the
+// pmem-driver container if the deployment limits the PMEM types.
+func patchPMEMBusTypes(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	if len(deployment.Spec.PMEMBusTypes) == 0 {
+		return
+	}
+	var busTypes []string
+	for _, busType := range deployment.Spec.PMEMBusTypes {
+		busTypes = append(busTypes, string(busType))
+	}
+	appendDriverArg(obj, "-pmemBusTypes="+strings.Join(busTypes, ","))
+}
+
+// appendDriverArg adds a parameter to the command of the pmem-driver
+// container in the pod template.
+func appendDriverArg(obj *unstructured.Unstructured, arg string) {
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		if container["name"].(string) == "pmem-driver" {
+			container["command"] = append(container["command"].([]interface{}), arg)
+		}
+	}
+}
+
+// removeContainer drops the container with the given name from the
+// pod template.
+func removeContainer(obj *unstructured.Unstructured, containerName string) {
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	var containers []interface{}
+	for _, container := range spec["containers"].([]interface{}) {
+		if container.(map[string]interface{})["name"].(string) != containerName {
+			containers = append(containers, container)
+		}
+	}
+	spec["containers"] = containers
+}
+
+// patchLeaderElection enables leader election in the controller
+// when running more than one replica.
+func patchLeaderElection(obj *unstructured.Unstructured) {
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		if container["name"].(string) != "pmem-driver" {
+			continue
+		}
+		container["command"] = append(container["command"].([]interface{}), "-leader-election")
+	}
+}
+
+// portsWithDefaults returns the ports of the deployment with
+// defaults for unset fields.
+func portsWithDefaults(deployment api.PmemCSIDeployment) api.PortsSpec {
+	var ports api.PortsSpec
+	if deployment.Spec.Ports != nil {
+		ports = *deployment.Spec.Ports
+	}
+	for _, p := range []struct {
+		port         *int32
+		defaultValue int32
+	}{
+		{&ports.ControllerMetrics, api.DefaultControllerMetricsPort},
+		{&ports.NodeMetrics, api.DefaultNodeMetricsPort},
+		{&ports.ProvisionerMetrics, api.DefaultProvisionerMetricsPort},
+		{&ports.NodeHealthz, api.DefaultNodeHealthzPort},
+	} {
+		if *p.port == 0 {
+			*p.port = p.defaultValue
+		}
+	}
+	return ports
+}
+
+// patchPort replaces the default port in the container ports and
+// command line flags of a container.
+func patchPort(obj *unstructured.Unstructured, containerName string, defaultPort, port int32) {
+	if port == defaultPort {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	oldSuffix := fmt.Sprintf(":%d", defaultPort)
+	newSuffix := fmt.Sprintf(":%d", port)
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		if container["name"].(string) != containerName {
+			continue
+		}
+		ports, _ := container["ports"].([]interface{})
+		for _, p := range ports {
+			p := p.(map[string]interface{})
+			if p["containerPort"] == int64(defaultPort) {
+				p["containerPort"] = int64(port)
+			}
+		}
+		for _, key := range []string{"command", "args"} {
+			args, _ := container[key].([]interface{})
+			for i, arg := range args {
+				if arg, ok := arg.(string); ok && strings.HasSuffix(arg, oldSuffix) {
+					args[i] = strings.TrimSuffix(arg, oldSuffix) + newSuffix
+				}
+			}
+		}
+	}
+}
+
+func patchHostNetwork(obj *unstructured.Unstructured, hostNetwork bool) {
+	if !hostNetwork {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	spec["hostNetwork"] = true
+	spec["dnsPolicy"] = "ClusterFirstWithHostNet"
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		ports, ok := container["ports"].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, port := range ports {
+			port := port.(map[string]interface{})
+			port["hostPort"] = port["containerPort"]
+		}
+	}
+}
+
+func patchProxyEnv(spec map[string]interface{}, proxy *api.ProxySpec) {
+	if proxy == nil {
+		return
+	}
+
+	var env []interface{}
+	for _, e := range []struct{ name, value string }{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+		{"NO_PROXY", proxy.NoProxy},
+	} {
+		if e.value != "" {
+			env = append(env, map[string]interface{}{"name": e.name, "value": e.value})
+		}
+	}
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		existing, _ := container["env"].([]interface{})
+		container["env"] = append(existing, env...)
+	}
+}
+
+func patchPriorityClassName(obj *unstructured.Unstructured, priorityClassName string) {
+	if priorityClassName == "" {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	spec["priorityClassName"] = priorityClassName
+}
+
+func patchRuntimeClassName(obj *unstructured.Unstructured, runtimeClassName string) {
+	if runtimeClassName == "" {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	spec["runtimeClassName"] = runtimeClassName
+}
+
+func patchSecurityProfiles(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment) {
+	seccomp := deployment.Spec.SeccompProfile
+	appArmor := deployment.Spec.AppArmorProfile
+	if seccomp == nil && appArmor == "" {
+		return
+	}
+
+	outerSpec := obj.Object["spec"].(map[string]interface{})
+	template := outerSpec["template"].(map[string]interface{})
+	spec := template["spec"].(map[string]interface{})
+	metadata := template["metadata"].(map[string]interface{})
+	if seccomp != nil {
+		profile := map[string]interface{}{
+			"type": string(seccomp.Type),
+		}
+		if seccomp.LocalhostProfile != nil {
+			profile["localhostProfile"] = *seccomp.LocalhostProfile
+		}
+		spec["securityContext"] = map[string]interface{}{
+			"seccompProfile": profile,
+		}
+	}
+	for _, container := range spec["containers"].([]interface{}) {
+		container := container.(map[string]interface{})
+		securityContext, _ := container["securityContext"].(map[string]interface{})
+		privileged, _ := securityContext["privileged"].(bool)
+		if seccomp != nil && privileged {
+			securityContext["seccompProfile"] = map[string]interface{}{
+				"type": "Unconfined",
+			}
+		}
+		if appArmor != "" {
+			profile := appArmor
+			if privileged {
+				profile = "unconfined"
+			}
+			annotations, _ := metadata["annotations"].(map[string]interface{})
+			if annotations == nil {
+				annotations = map[string]interface{}{}
+				metadata["annotations"] = annotations
+			}
+			annotations["container.apparmor.security.beta.kubernetes.io/"+container["name"].(string)] = profile
+		}
+	}
+}
+
 func yamlPath(kubernetes version.Version, deviceMode api.DeviceMode) string {
 	return fmt.Sprintf("kubernetes-%s/pmem-csi-%s.yaml", kubernetes, deviceMode)
 }
@@ -11,7 +11,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -72,3 +74,85 @@ func TestLoadObjects(t *testing.T) {
 		})
 	}
 }
+
+func TestPMEMBusTypes(t *testing.T) {
+	yamls := deploy.ListAll()
+	require.NotEmpty(t, yamls, "should have builtin yaml deployments")
+	testCase := yamls[0]
+	deployment := api.PmemCSIDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pmem-csi.example.org",
+		},
+		Spec: api.DeploymentSpec{
+			PMEMBusTypes: []api.PMEMBusType{api.PMEMBusTypeNVDIMM, api.PMEMBusTypeCXL},
+		},
+	}
+	objects, err := deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment)
+	require.NoError(t, err, "load and customize yaml")
+
+	var command []string
+	for _, obj := range objects {
+		if obj.GetKind() == "DaemonSet" && obj.GetName() == deployment.NodeDriverName() {
+			command = driverCommand(t, obj)
+		}
+	}
+	require.NotEmpty(t, command, "command of node driver")
+	assert.Contains(t, command, "-pmemBusTypes=nvdimm,cxl", "node driver parameters")
+	assert.Equal(t, "-pmemBusTypes=nvdimm,cxl", command[len(command)-1], "parameter appended")
+
+	deployment.Spec.PMEMBusTypes = nil
+	objects, err = deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment)
+	require.NoError(t, err, "load and customize yaml without bus types")
+	for _, obj := range objects {
+		if obj.GetKind() == "DaemonSet" {
+			for _, arg := range driverCommand(t, obj) {
+				assert.NotContains(t, arg, "-pmemBusTypes", "%s parameters without bus types", obj.GetName())
+			}
+		}
+	}
+}
+
+func TestPMEMPools(t *testing.T) {
+	yamls := deploy.ListAll()
+	require.NotEmpty(t, yamls, "should have builtin yaml deployments")
+	testCase := yamls[0]
+	deployment := api.PmemCSIDeployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pmem-csi.example.org",
+		},
+		Spec: api.DeploymentSpec{
+			PMEMPools: []api.PMEMPoolSpec{
+				{Name: "socket0", Regions: []string{"region0", "region2"}},
+				{Name: "socket1", Regions: []string{"region1"}},
+			},
+		},
+	}
+	objects, err := deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, "default", deployment)
+	require.NoError(t, err, "load and customize yaml")
+
+	var command []string
+	for _, obj := range objects {
+		if obj.GetKind() == "DaemonSet" && obj.GetName() == deployment.NodeDriverName() {
+			command = driverCommand(t, obj)
+		}
+	}
+	require.NotEmpty(t, command, "command of node driver")
+	assert.Contains(t, command, "-pmemPool=socket0=region0,region2", "first pool")
+	assert.Contains(t, command, "-pmemPool=socket1=region1", "second pool")
+}
+
+// driverCommand returns the command of the pmem-driver container in
+// the pod template.
+func driverCommand(t *testing.T, obj unstructured.Unstructured) []string {
+	containers, _, err := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	require.NoError(t, err, "containers of %s", obj.GetName())
+	for _, container := range containers {
+		container := container.(map[string]interface{})
+		if container["name"] == "pmem-driver" {
+			command, _, err := unstructured.NestedStringSlice(container, "command")
+			require.NoError(t, err, "command of %s", obj.GetName())
+			return command
+		}
+	}
+	return nil
+}
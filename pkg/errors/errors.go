@@ -29,4 +29,19 @@ var (
 
 	// ErrNotEnoughSpace no space to create the device
 	NotEnoughSpace = errors.New("not enough space")
+
+	// UnknownPool the volume asks for a pool that is not defined
+	UnknownPool = errors.New("unknown pool")
+
+	// NotSupported the volume parameters are not supported by the device manager
+	NotSupported = errors.New("not supported")
+
+	// OutOfRange alignment makes the device larger than the size limit
+	OutOfRange = errors.New("size out of range")
+
+	// NotErased reading back a wiped device found data
+	NotErased = errors.New("data not erased")
+
+	// DeviceChanged device has the name of a volume, but not its identity
+	DeviceChanged = errors.New("device changed")
 )
@@ -10,26 +10,35 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"path/filepath"
 	"sync"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/tracing"
 )
 
 // RunCommand executes the command with logging through klog, with
 // output processed line-by-line with the command path as prefix. It
 // returns the combined output and, if there was a problem, includes
-// that output and the command in the error.
+// that output and the command in the error. IsCommandFailure
+// recognizes such errors.
 func RunCommand(ctx context.Context, cmd string, args ...string) (string, error) {
 	return Run(ctx, exec.Command(cmd, args...))
 }
 
 // Run does the same as RunCommand but takes a pre-populated
 // cmd. Stdout and stderr are ignored and replaced with the output
-// handling described for RunCommand.
-func Run(ctx context.Context, cmd *exec.Cmd) (string, error) {
+// handling described for RunCommand. Each command is traced as a
+// span of its own.
+func Run(ctx context.Context, cmd *exec.Cmd) (output string, finalErr error) {
+	ctx, span := tracing.Start(ctx, "exec "+filepath.Base(cmd.Path), attribute.StringSlice("args", cmd.Args))
+	defer func() { tracing.End(span, finalErr) }()
 	logger := klog.FromContext(ctx).WithValues("command", cmd.Path)
 	logger.V(4).Info("Starting command", "args", cmd.Args)
 
@@ -53,13 +62,22 @@ func Run(ctx context.Context, cmd *exec.Cmd) (string, error) {
 
 	switch {
 	case err != nil && both.Len() > 0:
-		err = fmt.Errorf("%q: command failed: %v\nCombined stderr/stdout output: %s", cmd, err, both.String())
+		err = fmt.Errorf("%q: command failed: %w\nCombined stderr/stdout output: %s", cmd, err, both.String())
 	case err != nil:
-		err = fmt.Errorf("%q: command failed with no output: %v", cmd, err)
+		err = fmt.Errorf("%q: command failed with no output: %w", cmd, err)
 	}
 	return stdout.String(), err
 }
 
+// IsCommandFailure returns true if the error or one of the errors
+// wrapped by it is the result of a command which could not be started
+// or failed.
+func IsCommandFailure(err error) bool {
+	var exitErr *exec.ExitError
+	var execErr *exec.Error
+	return errors.As(err, &exitErr) || errors.As(err, &execErr)
+}
+
 func dumpOutput(ctx context.Context, wg *sync.WaitGroup, in io.Reader, out []io.Writer) {
 	logger := klog.FromContext(ctx)
 	defer wg.Done()
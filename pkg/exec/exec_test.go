@@ -109,6 +109,7 @@ func TestRun(t *testing.T) {
 				errStr = err.Error()
 			}
 			assert.Equal(t, tc.expectedError, errStr, "error")
+			assert.Equal(t, err != nil, IsCommandFailure(err), "command failure")
 		})
 	}
 }
@@ -0,0 +1,212 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package exec
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// IOThrottle limits the impact of commands which write a lot of
+// data, like shred, dd and mkfs, on applications which use PMEM on
+// the same node.
+//
+// It can be used as a flag value, as a comma-separated list of
+// "ionice=<class>[:<level>]" and "writeBPS=<size>", for example
+// "ionice=idle,writeBPS=1Gi".
+type IOThrottle struct {
+	// IONiceClass is the I/O scheduling class that ionice
+	// runs the command with ("realtime", "best-effort" or
+	// "idle"). Empty disables ionice.
+	IONiceClass string
+	// IONiceLevel is the priority inside the realtime and
+	// best-effort class, from 0 (highest) to 7. Nil uses the
+	// default of ionice.
+	IONiceLevel *uint
+	// WriteBytesPerSecond limits writes to the device through
+	// the io.max file of the cgroup v2 that the driver runs in.
+	// Zero disables the limit.
+	WriteBytesPerSecond uint64
+}
+
+func (t *IOThrottle) Set(value string) error {
+	throttle := IOThrottle{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected <key>=<value>, got %q", item)
+		}
+		switch parts[0] {
+		case "ionice":
+			class := parts[1]
+			if i := strings.Index(class, ":"); i >= 0 {
+				level, err := strconv.ParseUint(class[i+1:], 10, 8)
+				if err != nil || level > 7 {
+					return fmt.Errorf("ionice level must be 0..7, got %q", class[i+1:])
+				}
+				l := uint(level)
+				throttle.IONiceLevel = &l
+				class = class[:i]
+			}
+			switch class {
+			case "realtime", "best-effort":
+			case "idle":
+				if throttle.IONiceLevel != nil {
+					return fmt.Errorf("ionice class %q has no level", class)
+				}
+			default:
+				return fmt.Errorf("unsupported ionice class %q", class)
+			}
+			throttle.IONiceClass = class
+		case "writeBPS":
+			quantity, err := resource.ParseQuantity(parts[1])
+			if err != nil {
+				return fmt.Errorf("writeBPS: %v", err)
+			}
+			if quantity.Sign() < 0 {
+				return fmt.Errorf("writeBPS must not be negative, got %q", parts[1])
+			}
+			throttle.WriteBytesPerSecond = uint64(quantity.Value())
+		default:
+			return fmt.Errorf("unsupported I/O throttling option %q", parts[0])
+		}
+	}
+	*t = throttle
+	return nil
+}
+
+func (t *IOThrottle) String() string {
+	var items []string
+	if t.IONiceClass != "" {
+		class := t.IONiceClass
+		if t.IONiceLevel != nil {
+			class += fmt.Sprintf(":%d", *t.IONiceLevel)
+		}
+		items = append(items, "ionice="+class)
+	}
+	if t.WriteBytesPerSecond > 0 {
+		items = append(items, fmt.Sprintf("writeBPS=%d", t.WriteBytesPerSecond))
+	}
+	return strings.Join(items, ",")
+}
+
+// selectedIOThrottle is set once during startup, therefore it does
+// not need locking. The empty value disables throttling.
+var selectedIOThrottle IOThrottle
+
+// SelectIOThrottle determines how RunThrottled limits commands. It
+// must be called before running commands.
+func SelectIOThrottle(throttle IOThrottle) {
+	selectedIOThrottle = throttle
+}
+
+// RunThrottled does the same as RunCommand for a command which
+// writes to the given block device, with the I/O throttling chosen
+// by SelectIOThrottle. When limiting the write bandwidth is not
+// possible, the error is logged and the command runs without the
+// limit.
+func RunThrottled(ctx context.Context, device string, cmd string, args ...string) (string, error) {
+	throttle := selectedIOThrottle
+	if throttle.WriteBytesPerSecond > 0 {
+		logger := klog.FromContext(ctx)
+		restore, err := limitDeviceWrites(device, throttle.WriteBytesPerSecond)
+		if err != nil {
+			logger.Error(err, "Not limiting write bandwidth", "device", device)
+		} else {
+			defer func() {
+				if err := restore(); err != nil {
+					logger.Error(err, "Removing write bandwidth limit failed", "device", device)
+				}
+			}()
+		}
+	}
+	cmd, args = throttle.wrap(cmd, args)
+	return RunCommand(ctx, cmd, args...)
+}
+
+// wrap prepends ionice to the command if configured.
+func (t IOThrottle) wrap(cmd string, args []string) (string, []string) {
+	if t.IONiceClass == "" {
+		return cmd, args
+	}
+	// -t: run the command even if the class cannot be set.
+	ioniceArgs := []string{"-t", "-c", t.IONiceClass}
+	if t.IONiceLevel != nil {
+		ioniceArgs = append(ioniceArgs, "-n", strconv.FormatUint(uint64(*t.IONiceLevel), 10))
+	}
+	ioniceArgs = append(ioniceArgs, cmd)
+	return "ionice", append(ioniceArgs, args...)
+}
+
+// cgroupRoot and procSelfCgroup can be changed for testing.
+var (
+	cgroupRoot     = "/sys/fs/cgroup"
+	procSelfCgroup = "/proc/self/cgroup"
+)
+
+// limitDeviceWrites sets a write limit for the device in the cgroup
+// of the current process. Because the limit is specific to the
+// device, it only affects commands which write to it. The returned
+// function removes the limit again.
+func limitDeviceWrites(device string, bytesPerSecond uint64) (func() error, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		return nil, fmt.Errorf("stat %s: %v", device, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return nil, fmt.Errorf("%s is not a block device", device)
+	}
+	return setIOMax(fmt.Sprintf("%d:%d", unix.Major(stat.Rdev), unix.Minor(stat.Rdev)), bytesPerSecond)
+}
+
+func setIOMax(dev string, bytesPerSecond uint64) (func() error, error) {
+	cgroup, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	ioMax := filepath.Join(cgroupRoot, cgroup, "io.max")
+	if err := os.WriteFile(ioMax, []byte(fmt.Sprintf("%s wbps=%d\n", dev, bytesPerSecond)), 0); err != nil {
+		return nil, fmt.Errorf("set write limit: %v", err)
+	}
+	return func() error {
+		return os.WriteFile(ioMax, []byte(dev+" wbps=max\n"), 0)
+	}, nil
+}
+
+// ownCgroup returns the path of the cgroup v2 of the current
+// process, relative to cgroupRoot.
+func ownCgroup() (string, error) {
+	file, err := os.Open(procSelfCgroup)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The unified hierarchy has ID 0 and no controllers.
+		if path := strings.TrimPrefix(scanner.Text(), "0::"); path != scanner.Text() {
+			return path, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("%s: not using cgroup v2", procSelfCgroup)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestIOThrottleSet(t *testing.T) {
+	level := uint(7)
+	testcases := map[string]struct {
+		value          string
+		expected       IOThrottle
+		expectedString string
+		expectedError  bool
+	}{
+		"empty": {},
+		"idle": {
+			value:    "ionice=idle",
+			expected: IOThrottle{IONiceClass: "idle"},
+		},
+		"best-effort": {
+			value:    "ionice=best-effort:7",
+			expected: IOThrottle{IONiceClass: "best-effort", IONiceLevel: &level},
+		},
+		"both": {
+			value:          "ionice=idle,writeBPS=1Ki",
+			expected:       IOThrottle{IONiceClass: "idle", WriteBytesPerSecond: 1024},
+			expectedString: "ionice=idle,writeBPS=1024",
+		},
+		"idle-level": {
+			value:         "ionice=idle:1",
+			expectedError: true,
+		},
+		"bad-level": {
+			value:         "ionice=realtime:8",
+			expectedError: true,
+		},
+		"bad-class": {
+			value:         "ionice=none",
+			expectedError: true,
+		},
+		"negative": {
+			value:         "writeBPS=-1",
+			expectedError: true,
+		},
+		"unknown": {
+			value:         "readBPS=1",
+			expectedError: true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var throttle IOThrottle
+			err := throttle.Set(tc.value)
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, throttle)
+			expectedString := tc.expectedString
+			if expectedString == "" {
+				expectedString = tc.value
+			}
+			assert.Equal(t, expectedString, throttle.String(), "string")
+		})
+	}
+}
+
+func TestIOThrottleWrap(t *testing.T) {
+	cmd, args := IOThrottle{}.wrap("dd", []string{"if=/dev/zero"})
+	assert.Equal(t, "dd", cmd, "no ionice")
+	assert.Equal(t, []string{"if=/dev/zero"}, args, "no ionice")
+
+	level := uint(4)
+	cmd, args = IOThrottle{IONiceClass: "best-effort", IONiceLevel: &level}.wrap("dd", []string{"if=/dev/zero"})
+	assert.Equal(t, "ionice", cmd, "ionice")
+	assert.Equal(t, []string{"-t", "-c", "best-effort", "-n", "4", "dd", "if=/dev/zero"}, args, "ionice")
+}
+
+func TestSetIOMax(t *testing.T) {
+	root := t.TempDir()
+	oldRoot, oldProc := cgroupRoot, procSelfCgroup
+	cgroupRoot, procSelfCgroup = root, filepath.Join(root, "cgroup")
+	defer func() {
+		cgroupRoot, procSelfCgroup = oldRoot, oldProc
+	}()
+
+	_, err := setIOMax("259:0", 1024)
+	assert.Error(t, err, "no cgroup file")
+
+	require.NoError(t, os.WriteFile(procSelfCgroup, []byte("1:name=systemd:/foo\n"), 0644))
+	_, err = setIOMax("259:0", 1024)
+	assert.Error(t, err, "cgroup v1")
+
+	require.NoError(t, os.WriteFile(procSelfCgroup, []byte("0::/kubepods/pod1\n"), 0644))
+	ioMax := filepath.Join(root, "kubepods", "pod1", "io.max")
+	require.NoError(t, os.MkdirAll(filepath.Dir(ioMax), 0755))
+	require.NoError(t, os.WriteFile(ioMax, nil, 0644))
+	restore, err := setIOMax("259:0", 1024)
+	require.NoError(t, err, "set io.max")
+	content, err := os.ReadFile(ioMax)
+	require.NoError(t, err)
+	assert.Equal(t, "259:0 wbps=1024\n", string(content), "limit")
+	require.NoError(t, restore(), "restore")
+	content, err = os.ReadFile(ioMax)
+	require.NoError(t, err)
+	assert.Equal(t, "259:0 wbps=max\n", string(content), "no limit")
+}
+
+func TestRunThrottled(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	defer SelectIOThrottle(IOThrottle{})
+	// /dev/null is not a block device, so only the error gets
+	// logged and the command still runs.
+	SelectIOThrottle(IOThrottle{WriteBytesPerSecond: 1024})
+	output, err := RunThrottled(ctx, "/dev/null", "echo", "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", output)
+}
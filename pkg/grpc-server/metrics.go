@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// grpcRequests counts all incoming gRPC calls.
+	grpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_grpc_requests_total",
+			Help: "Number of gRPC calls handled by PMEM-CSI, labeled by service, method and gRPC status code.",
+		},
+		[]string{"service", "method", "code"},
+	)
+
+	// grpcDuration measures how long incoming gRPC calls take.
+	// Volume operations may take minutes when wiping large
+	// volumes, therefore the buckets go up to ten minutes.
+	grpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_grpc_request_duration_seconds",
+			Help:    "Duration of gRPC calls handled by PMEM-CSI, labeled by service, method and gRPC status code.",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+		},
+		[]string{"service", "method", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(grpcRequests)
+	prometheus.MustRegister(grpcDuration)
+}
+
+// metricsInterceptor records count and duration of each call.
+func metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	service, method := splitMethodName(info.FullMethod)
+	code := status.Code(err).String()
+	grpcRequests.WithLabelValues(service, method, code).Inc()
+	grpcDuration.WithLabelValues(service, method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// splitMethodName turns "/csi.v1.Node/NodeStageVolume" into
+// "csi.v1.Node" and "NodeStageVolume".
+func splitMethodName(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsInterceptor(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "response", nil
+	}
+	failed := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.FailedPrecondition, "fake error")
+	}
+	count := func(code string) float64 {
+		return testutil.ToFloat64(grpcRequests.WithLabelValues("csi.v1.Node", "NodeStageVolume", code))
+	}
+	oks, failures := count("OK"), count("FailedPrecondition")
+
+	resp, err := metricsInterceptor(context.Background(), nil, info, ok)
+	assert.NoError(t, err, "successful call")
+	assert.Equal(t, "response", resp, "response")
+	_, err = metricsInterceptor(context.Background(), nil, info, failed)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "failed call")
+
+	assert.Equal(t, oks+1, count("OK"), "successful calls")
+	assert.Equal(t, failures+1, count("FailedPrecondition"), "failed calls")
+	assert.GreaterOrEqual(t, testutil.CollectAndCount(grpcDuration), 2, "durations")
+}
+
+func TestSplitMethodName(t *testing.T) {
+	service, method := splitMethodName("/csi.v1.Controller/CreateVolume")
+	assert.Equal(t, "csi.v1.Controller", service, "service")
+	assert.Equal(t, "CreateVolume", method, "method")
+	service, method = splitMethodName("Foo")
+	assert.Equal(t, "unknown", service, "service without slash")
+	assert.Equal(t, "Foo", method, "method without slash")
+}
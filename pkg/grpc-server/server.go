@@ -39,9 +39,11 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix
 	if endpoint == "" {
 		return fmt.Errorf("endpoint cannot be empty")
 	}
-	rpcServer, l, err := pmemgrpc.NewServer(endpoint, errorPrefix, tlsConfig, csiMetricsManager)
+	// The interceptor sees the final status code, including
+	// the error prefix added by NewServer.
+	rpcServer, l, err := pmemgrpc.NewServer(endpoint, errorPrefix, tlsConfig, csiMetricsManager, grpc.ChainUnaryInterceptor(metricsInterceptor))
 	if err != nil {
-		return nil
+		return err
 	}
 	for _, service := range services {
 		service.RegisterService(rpcServer)
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+)
+
+// RepeatedKey is added to a message which was suppressed before by
+// a logger returned by Deduplicate. The value is the number of
+// suppressed messages.
+const RepeatedKey = "repeated"
+
+// Deduplicate returns a logger which collapses identical messages,
+// meaning the same message with the same error, names and key/value
+// pairs. The first message is logged. Further identical messages
+// are only counted until the window has passed, then the message
+// gets logged again with the count of suppressed messages as
+// additional "repeated" value. This happens when the window expires
+// even if the message does not occur again, so the count is never
+// lost.
+//
+// This is meant for loops which retry an operation that keeps
+// failing. Loggers derived from the result share the state.
+func Deduplicate(logger klog.Logger, window time.Duration) klog.Logger {
+	return deduplicate(logger, window, clock.RealClock{})
+}
+
+func deduplicate(logger klog.Logger, window time.Duration, clk clock.WithDelayedExecution) klog.Logger {
+	sink := logger.GetSink()
+	if sink == nil {
+		return logger
+	}
+	// The sink gets called through three additional functions:
+	// dedupSink.Info or Error, dedupState.log and the closure
+	// passed to it.
+	if withCallDepth, ok := sink.(logr.CallDepthLogSink); ok {
+		sink = withCallDepth.WithCallDepth(3)
+	}
+	return logger.WithSink(&dedupSink{
+		sink: sink,
+		state: &dedupState{
+			window: window,
+			clock:  clk,
+			seen:   map[string]*dedupEntry{},
+		},
+	})
+}
+
+type dedupState struct {
+	mutex  sync.Mutex
+	window time.Duration
+	clock  clock.WithDelayedExecution
+	seen   map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	logged   time.Time
+	repeated int
+	// flush logs the summary of suppressed messages when the
+	// window expires. It is only set once a message was
+	// suppressed.
+	flush clock.Timer
+}
+
+// log calls emit if the message with the key must be logged, with
+// the number of messages that were suppressed since it was logged
+// last. Otherwise it counts the message and ensures that emit gets
+// called with that count when the window expires.
+func (s *dedupState) log(key string, emit func(repeated int)) {
+	s.mutex.Lock()
+	now := s.clock.Now()
+	entry := s.seen[key]
+	if entry != nil && now.Sub(entry.logged) < s.window {
+		entry.repeated++
+		if entry.flush == nil {
+			entry.flush = s.clock.AfterFunc(s.window-now.Sub(entry.logged), func() {
+				s.flush(key, entry, emit)
+			})
+		}
+		s.mutex.Unlock()
+		return
+	}
+	repeated := 0
+	if entry != nil {
+		// Logged again before the timer fired, which then
+		// has nothing left to do.
+		repeated = entry.repeated
+		if entry.flush != nil {
+			entry.flush.Stop()
+		}
+	}
+	s.seen[key] = &dedupEntry{logged: now}
+
+	// Forget about messages which have not been repeated,
+	// otherwise messages with changing values would
+	// accumulate. Repeated messages get removed by flush.
+	for key, entry := range s.seen {
+		if entry.repeated == 0 && now.Sub(entry.logged) >= s.window {
+			delete(s.seen, key)
+		}
+	}
+	s.mutex.Unlock()
+	emit(repeated)
+}
+
+// flush logs the summary for an entry unless the message was logged
+// again in the meantime.
+func (s *dedupState) flush(key string, entry *dedupEntry, emit func(repeated int)) {
+	s.mutex.Lock()
+	if s.seen[key] != entry {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.seen, key)
+	s.mutex.Unlock()
+	emit(entry.repeated)
+}
+
+type dedupSink struct {
+	sink  logr.LogSink
+	state *dedupState
+	// id is derived from the names and values added to the sink.
+	id string
+}
+
+var _ logr.LogSink = &dedupSink{}
+
+func (d *dedupSink) Init(info logr.RuntimeInfo) {
+	d.sink.Init(info)
+}
+
+func (d *dedupSink) Enabled(level int) bool {
+	return d.sink.Enabled(level)
+}
+
+func (d *dedupSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	key := fmt.Sprintf("%s %d %q %v", d.id, level, msg, keysAndValues)
+	d.state.log(key, func(repeated int) {
+		d.sink.Info(level, msg, withRepeated(keysAndValues, repeated)...)
+	})
+}
+
+func (d *dedupSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	key := fmt.Sprintf("%s error %q %v %v", d.id, msg, err, keysAndValues)
+	d.state.log(key, func(repeated int) {
+		d.sink.Error(err, msg, withRepeated(keysAndValues, repeated)...)
+	})
+}
+
+func (d *dedupSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &dedupSink{
+		sink:  d.sink.WithValues(keysAndValues...),
+		state: d.state,
+		id:    fmt.Sprintf("%s %v", d.id, keysAndValues),
+	}
+}
+
+func (d *dedupSink) WithName(name string) logr.LogSink {
+	return &dedupSink{
+		sink:  d.sink.WithName(name),
+		state: d.state,
+		id:    d.id + "/" + name,
+	}
+}
+
+func withRepeated(keysAndValues []interface{}, repeated int) []interface{} {
+	if repeated == 0 {
+		return keysAndValues
+	}
+	// Never modify the slice of the caller.
+	return append(keysAndValues[:len(keysAndValues):len(keysAndValues)], RepeatedKey, repeated)
+}
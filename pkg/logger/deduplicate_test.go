@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logger
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestDeduplicate(t *testing.T) {
+	logger := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.BufferLogs(true)))
+	buffer := logger.GetSink().(ktesting.Underlier).GetBuffer()
+	// newOutput returns what was logged since the previous call.
+	var offset int
+	newOutput := func() string {
+		output := buffer.String()
+		defer func() { offset = len(output) }()
+		return output[offset:]
+	}
+	clock := testingclock.NewFakeClock(time.Now())
+	dedup := deduplicate(logger, time.Minute, clock).WithName("loop")
+	err := errors.New("no such device")
+
+	for i := 0; i < 5; i++ {
+		dedup.Error(err, "Scanning failed", "device", "pmem0")
+	}
+	dedup.Error(err, "Scanning failed", "device", "pmem1")
+	dedup.WithValues("attempt", 1).Error(err, "Scanning failed", "device", "pmem0")
+	dedup.Info("Scanning failed", "device", "pmem0")
+	assert.Equal(t, `ERROR loop: Scanning failed err="no such device" device="pmem0"
+ERROR loop: Scanning failed err="no such device" device="pmem1"
+ERROR loop: Scanning failed err="no such device" attempt=1 device="pmem0"
+INFO loop: Scanning failed device="pmem0"
+`, newOutput(), "first messages")
+
+	clock.Step(30 * time.Second)
+	dedup.Error(err, "Scanning failed", "device", "pmem0")
+	assert.Empty(t, newOutput(), "within window")
+
+	// The summary gets logged when the window expires, the next
+	// message then starts a new window.
+	clock.Step(30 * time.Second)
+	assert.Equal(t, `ERROR loop: Scanning failed err="no such device" device="pmem0" repeated=5
+`, newOutput(), "window expired")
+	dedup.Error(err, "Scanning failed", "device", "pmem0")
+	dedup.Error(err, "Scanning failed", "device", "pmem0")
+	assert.Equal(t, `ERROR loop: Scanning failed err="no such device" device="pmem0"
+`, newOutput(), "after window")
+
+	clock.Step(time.Minute)
+	assert.Equal(t, `ERROR loop: Scanning failed err="no such device" device="pmem0" repeated=1
+`, newOutput(), "next window expired")
+	dedup.Error(err, "Scanning failed", "device", "pmem0")
+	dedup.Error(err, "Scanning failed", "device", "pmem1")
+	assert.Equal(t, `ERROR loop: Scanning failed err="no such device" device="pmem0"
+ERROR loop: Scanning failed err="no such device" device="pmem1"
+`, newOutput(), "next window")
+
+	// Nothing was suppressed, so there is no summary.
+	clock.Step(time.Minute)
+	assert.Empty(t, newOutput(), "no summary")
+}
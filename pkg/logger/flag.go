@@ -30,7 +30,12 @@ type Options struct {
 
 func (f *Options) Set(value string) error {
 	f.Format = value
+	return Apply(&f.LoggingConfiguration)
+}
 
+// Apply validates and activates the logging configuration. It can
+// only be called once.
+func Apply(c *logsapi.LoggingConfiguration) error {
 	// We want contextual logging to be enabled.
 	featureGate := featuregate.NewFeatureGate()
 	logsapi.AddFeatureGates(featureGate)
@@ -38,7 +43,7 @@ func (f *Options) Set(value string) error {
 		string(logsapi.ContextualLogging): true,
 	})
 
-	return logsapi.ValidateAndApply(&f.LoggingConfiguration, featureGate)
+	return logsapi.ValidateAndApply(c, featureGate)
 }
 
 func (f *Options) String() string {
@@ -0,0 +1,44 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"k8s.io/klog/v2"
+)
+
+// RequestIDKey is used for the request ID in log output and as gRPC
+// metadata key when passing it on to another process.
+const RequestIDKey = "request-id"
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random ID which is unique enough to tell
+// concurrent requests apart.
+func NewRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// WithRequestID stores the request ID in the context and adds it to
+// the logger in the context, so all log output for the request
+// includes it.
+func WithRequestID(ctx context.Context, id string) (context.Context, klog.Logger) {
+	logger := klog.FromContext(ctx).WithValues(RequestIDKey, id)
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	ctx = klog.NewContext(ctx, logger)
+	return ctx, logger
+}
+
+// RequestID returns the ID stored by WithRequestID, the empty string
+// if there is none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package logger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestRequestID(t *testing.T) {
+	logger := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.BufferLogs(true)))
+	ctx := klog.NewContext(context.Background(), logger)
+	assert.Empty(t, RequestID(ctx), "no request ID")
+
+	id := NewRequestID()
+	assert.Len(t, id, 16, "request ID length")
+	assert.NotEqual(t, id, NewRequestID(), "request IDs differ")
+
+	ctx, _ = WithRequestID(ctx, id)
+	assert.Equal(t, id, RequestID(ctx), "request ID")
+
+	// Loggers derived from the context inherit the ID.
+	ctx, _ = WithName(ctx, "child")
+	klog.FromContext(ctx).Info("hello")
+	buffer := logger.GetSink().(ktesting.Underlier).GetBuffer()
+	assert.Equal(t, `INFO child: hello request-id="`+id+`"`+"\n", buffer.String(), "log output")
+
+	assert.Equal(t, id, RequestID(context.WithValue(ctx, struct{}{}, 1)), "derived context")
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"fmt"
+)
+
+// Backend determines how the package accesses PMEM.
+type Backend string
+
+const (
+	// BackendLibndctl calls libndctl. It is only available when
+	// the package was built with cgo.
+	BackendLibndctl Backend = "libndctl"
+	// BackendSysfs reads the state from /sys/bus/nd and runs the
+	// ndctl command for modifications. It does not depend on
+	// cgo, and a crash of the ndctl command does not affect the
+	// caller.
+	BackendSysfs Backend = "sysfs"
+)
+
+func (b *Backend) Set(value string) error {
+	switch Backend(value) {
+	case "", BackendLibndctl, BackendSysfs:
+		*b = Backend(value)
+		return nil
+	default:
+		return fmt.Errorf("unsupported ndctl backend %q", value)
+	}
+}
+
+func (b *Backend) String() string {
+	return string(*b)
+}
+
+// selectedBackend is set once during startup, therefore it does not
+// need locking. The empty value picks libndctl if available and
+// sysfs otherwise.
+var selectedBackend Backend
+
+// SelectBackend determines which implementation NewContext
+// returns. It must be called before creating a context.
+func SelectBackend(backend Backend) {
+	selectedBackend = backend
+}
+
+// NewContext Initializes new context
+func NewContext() (Context, error) {
+	switch selectedBackend {
+	case BackendSysfs:
+		return newSysfsContext()
+	case BackendLibndctl:
+		return newLibndctlContext()
+	}
+	if libndctlAvailable {
+		return newLibndctlContext()
+	}
+	return newSysfsContext()
+}
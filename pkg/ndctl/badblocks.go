@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"sort"
+)
+
+// BadBlockSize is the unit of BadBlock offsets and lengths. The
+// kernel tracks media errors that were found by address range scrub
+// (ARS) or during access in 512 byte sectors.
+const BadBlockSize = 512
+
+// BadBlock is a range of PMEM with known media errors.
+type BadBlock struct {
+	// Offset is the first bad sector, relative to the start of
+	// the region or namespace.
+	Offset uint64 `json:"offset"`
+	// Length is the number of bad sectors.
+	Length uint64 `json:"length"`
+}
+
+// CountBadBlocks returns the total number of bad sectors. This is
+// the same as the "badblock_count" in "ndctl list --media-errors".
+func CountBadBlocks(badBlocks []BadBlock) uint64 {
+	var count uint64
+	for _, bb := range badBlocks {
+		count += bb.Length
+	}
+	return count
+}
+
+// countBadBlocksInRange returns the number of bad sectors which
+// overlap with the range of size bytes at the offset.
+func countBadBlocksInRange(badBlocks []BadBlock, offset, size uint64) uint64 {
+	first := offset / BadBlockSize
+	end := (offset + size + BadBlockSize - 1) / BadBlockSize
+	var count uint64
+	for _, bb := range badBlocks {
+		start, stop := bb.Offset, bb.Offset+bb.Length
+		if start < first {
+			start = first
+		}
+		if stop > end {
+			stop = end
+		}
+		if start < stop {
+			count += stop - start
+		}
+	}
+	return count
+}
+
+// plannedExtent returns the offset relative to the start of the
+// region where the kernel will put a new namespace of the given size.
+// Like the kernel, it picks the first free range that is large
+// enough. It returns false if that cannot be determined because the
+// address of the region or of one of its namespaces is unknown or
+// there is no such range.
+func plannedExtent(r Region, size uint64) (uint64, bool) {
+	base := r.Resource()
+	if base == 0 {
+		return 0, false
+	}
+	type extent struct {
+		start, end uint64
+	}
+	var used []extent
+	for _, ns := range r.AllNamespaces() {
+		resource := ns.Resource()
+		if resource < base {
+			return 0, false
+		}
+		used = append(used, extent{resource - base, resource - base + ns.RawSize()})
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].start < used[j].start
+	})
+	var offset uint64
+	for _, e := range used {
+		if e.start >= offset+size {
+			return offset, true
+		}
+		if e.end > offset {
+			offset = e.end
+		}
+	}
+	if offset+size <= r.Size() {
+		return offset, true
+	}
+	return 0, false
+}
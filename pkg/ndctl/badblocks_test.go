@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	gocontext "context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+func TestCountBadBlocksInRange(t *testing.T) {
+	badBlocks := []BadBlock{{Offset: 8, Length: 2}, {Offset: 1024, Length: 4}}
+	for name, tc := range map[string]struct {
+		badBlocks    []BadBlock
+		offset, size uint64
+		expected     uint64
+	}{
+		"before":        {badBlocks: badBlocks, offset: 0, size: 8 * BadBlockSize},
+		"between":       {badBlocks: badBlocks, offset: 10 * BadBlockSize, size: 1014 * BadBlockSize},
+		"after":         {badBlocks: badBlocks, offset: 1028 * BadBlockSize, size: mib},
+		"all":           {badBlocks: badBlocks, offset: 0, size: mib, expected: 6},
+		"partial":       {badBlocks: badBlocks, offset: 9 * BadBlockSize, size: 1016 * BadBlockSize, expected: 2},
+		"unaligned":     {badBlocks: badBlocks, offset: 9*BadBlockSize + 1, size: 1, expected: 1},
+		"inside":        {badBlocks: badBlocks, offset: 1025 * BadBlockSize, size: 2 * BadBlockSize, expected: 2},
+		"empty range":   {badBlocks: badBlocks, offset: 8 * BadBlockSize},
+		"no bad blocks": {offset: 0, size: mib},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, countBadBlocksInRange(tc.badBlocks, tc.offset, tc.size))
+		})
+	}
+}
+
+func TestAvoidBadBlocks(t *testing.T) {
+	gib := 1024 * mib
+	for name, tc := range map[string]struct {
+		badBlocks   string
+		avoid       bool
+		expectError bool
+	}{
+		// The fake region has bad blocks only inside the
+		// existing namespace at the start of the region.
+		"in use": {
+			badBlocks: "8 2\n1024 1\n",
+			avoid:     true,
+		},
+		"free space": {
+			badBlocks:   "8388608 1\n",
+			avoid:       true,
+			expectError: true,
+		},
+		"after new namespace": {
+			badBlocks: "12582912 1\n",
+			avoid:     true,
+		},
+		"not avoided": {
+			badBlocks: "8388608 1\n",
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fakeSysfs(t)
+			writeFile(t, filepath.Join(sysfsRoot, "devices", "platform", "ACPI0012:00", "ndbus0", "region0", "badblocks"), tc.badBlocks)
+			ndctx, err := newSysfsContext()
+			require.NoError(t, err, "new context")
+			defer ndctx.Free()
+			r := ndctx.GetBuses()[0].ActiveRegions()[0]
+
+			offset, ok := plannedExtent(r, 2*gib)
+			require.True(t, ok, "planned extent known")
+			assert.Equal(t, 4*gib, offset, "new namespace after the existing one")
+
+			_, size, _, err := prepareNamespace(gocontext.Background(), r, CreateNamespaceOpts{
+				Size:           2 * gib,
+				AvoidBadBlocks: tc.avoid,
+			})
+			if tc.expectError {
+				assert.ErrorIs(t, err, pmemerr.NotEnoughSpace, "bad blocks in planned extent")
+				return
+			}
+			require.NoError(t, err, "prepare namespace")
+			assert.Equal(t, 2*gib, size, "size")
+		})
+	}
+}
+
+func TestPlannedExtent(t *testing.T) {
+	fakeSysfs(t)
+	ndctx, err := newSysfsContext()
+	require.NoError(t, err, "new context")
+	defer ndctx.Free()
+	r := ndctx.GetBuses()[0].ActiveRegions()[0]
+
+	gib := 1024 * mib
+	offset, ok := plannedExtent(r, 12*gib)
+	assert.True(t, ok, "remaining space")
+	assert.Equal(t, 4*gib, offset, "offset of remaining space")
+	_, ok = plannedExtent(r, 13*gib)
+	assert.False(t, ok, "too large")
+
+	// Without the address of the region, the location is unknown.
+	writeFile(t, filepath.Join(sysfsRoot, "devices", "platform", "ACPI0012:00", "ndbus0", "region0", "resource"), "0")
+	_, ok = plannedExtent(r, gib)
+	assert.False(t, ok, "unknown region address")
+}
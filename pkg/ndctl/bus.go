@@ -6,22 +6,6 @@ package ndctl
 //#include <ndctl/ndctl.h>
 import "C"
 
-// Bus is a go wrapper for ndctl_bus.
-type Bus interface {
-	// Provider returns the bus provider.
-	Provider() string
-	// DeviceName returns the bus device name.
-	DeviceName() string
-	// Dimms returns the dimms provided by the bus.
-	Dimms() []Dimm
-	// ActiveRegions returns all active regions in the bus.
-	ActiveRegions() []Region
-	// AllRegions returns all regions in the bus including disabled regions.
-	AllRegions() []Region
-	// GetRegionByPhysicalAddress finds a region by physical address.
-	GetRegionByPhysicalAddress(address uint64) Region
-}
-
 type bus = C.struct_ndctl_bus
 
 var _ Bus = &bus{}
@@ -59,6 +43,7 @@ func (b *bus) GetRegionByPhysicalAddress(address uint64) Region {
 func (b *bus) String() string {
 	return marshal(map[string]interface{}{
 		"provider": b.Provider(),
+		"type":     GetBusType(b),
 		"dev":      b.DeviceName(),
 		"regions":  b.ActiveRegions(),
 		"dimms":    b.Dimms(),
@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BusType describes how PMEM is attached to the system.
+type BusType string
+
+const (
+	// BusTypeNVDIMM is PMEM on NVDIMMs, described by ACPI NFIT or,
+	// for emulated PMEM, by the e820 memory map.
+	BusTypeNVDIMM BusType = "nvdimm"
+	// BusTypeCXL is persistent memory on CXL Type-3 memory
+	// devices. The Linux cxl_pmem driver makes the persistent
+	// cxl_region devices available as regions of an nvdimm bus,
+	// so they get managed like NVDIMM regions.
+	BusTypeCXL BusType = "cxl"
+)
+
+// cxlProvider is the provider name of the nvdimm bus that the Linux
+// cxl_pmem driver registers.
+const cxlProvider = "CXL"
+
+// GetBusType determines the type of a bus based on its provider.
+func GetBusType(bus Bus) BusType {
+	if bus.Provider() == cxlProvider {
+		return BusTypeCXL
+	}
+	return BusTypeNVDIMM
+}
+
+// BusTypes is a list of bus types. The empty list selects all
+// types. It can be used as a flag value with a comma-separated list.
+type BusTypes []BusType
+
+func (b *BusTypes) Set(value string) error {
+	var types BusTypes
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		switch BusType(t) {
+		case "":
+			continue
+		case BusTypeNVDIMM, BusTypeCXL:
+			types = append(types, BusType(t))
+		default:
+			return fmt.Errorf("unsupported bus type %q", t)
+		}
+	}
+	*b = types
+	return nil
+}
+
+func (b *BusTypes) String() string {
+	var types []string
+	for _, t := range *b {
+		types = append(types, string(t))
+	}
+	return strings.Join(types, ",")
+}
+
+// Selects returns true if the list is empty or contains the type.
+func (b BusTypes) Selects(busType BusType) bool {
+	if len(b) == 0 {
+		return true
+	}
+	for _, t := range b {
+		if t == busType {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedBusTypes is set once during startup, therefore it does not
+// need locking.
+var selectedBusTypes BusTypes
+
+// SelectBusTypes limits the buses returned by Context.GetBuses to
+// those of the given types. It must be called before creating a
+// context.
+func SelectBusTypes(types BusTypes) {
+	selectedBusTypes = types
+}
+
+// IsBusSelected returns true if the bus is of one of the types
+// passed to SelectBusTypes.
+func IsBusSelected(bus Bus) bool {
+	return selectedBusTypes.Selects(GetBusType(bus))
+}
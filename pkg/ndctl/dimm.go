@@ -6,21 +6,9 @@ package ndctl
 //#include <ndctl/ndctl.h>
 import "C"
 
-// Dimm is a go wrapper for ndctl_dimm.
-type Dimm interface {
-	// Enabled returns if the dimm is enabled.
-	Enabled() bool
-	// Active returns if the the device is active.
-	Active() bool
-	// ID returns the dimm's unique identifier string.
-	ID() string
-	// PhysicalID returns the dimm's physical id number.
-	PhysicalID() int
-	// DeviceName returns the dimm's device name.
-	DeviceName() string
-	// Handle returns the dimm's handle.
-	Handle() int16
-}
+import (
+	"fmt"
+)
 
 type dimm = C.struct_ndctl_dimm
 
@@ -50,6 +38,50 @@ func (d *dimm) Handle() int16 {
 	return int16(C.ndctl_dimm_get_handle(d))
 }
 
+func (d *dimm) Health() (*DimmHealth, error) {
+	cmd := C.ndctl_dimm_cmd_new_smart(d)
+	if cmd == nil {
+		return nil, fmt.Errorf("%s: SMART command not supported", d.DeviceName())
+	}
+	defer C.ndctl_cmd_unref(cmd)
+	if rc := C.ndctl_cmd_submit(cmd); rc < 0 {
+		return nil, fmt.Errorf("%s: SMART command failed: %s", d.DeviceName(), cErrorString(rc))
+	}
+
+	health := &DimmHealth{}
+	flags := C.ndctl_cmd_smart_get_flags(cmd)
+	if flags&C.ND_SMART_HEALTH_VALID != 0 {
+		state := C.ndctl_cmd_smart_get_health(cmd)
+		switch {
+		case state&C.ND_SMART_FATAL_HEALTH != 0:
+			health.State = HealthFatal
+		case state&C.ND_SMART_CRITICAL_HEALTH != 0:
+			health.State = HealthCritical
+		case state&C.ND_SMART_NON_CRITICAL_HEALTH != 0:
+			health.State = HealthNonCritical
+		default:
+			health.State = HealthOK
+		}
+	}
+	if flags&C.ND_SMART_MTEMP_VALID != 0 {
+		t := float64(C.ndctl_decode_smart_temperature(C.ndctl_cmd_smart_get_media_temperature(cmd)))
+		health.MediaTemperature = &t
+	}
+	if flags&C.ND_SMART_CTEMP_VALID != 0 {
+		t := float64(C.ndctl_decode_smart_temperature(C.ndctl_cmd_smart_get_ctrl_temperature(cmd)))
+		health.ControllerTemperature = &t
+	}
+	if flags&C.ND_SMART_SPARES_VALID != 0 {
+		spares := uint(C.ndctl_cmd_smart_get_spares(cmd))
+		health.SparesPercentage = &spares
+	}
+	if flags&C.ND_SMART_SHUTDOWN_COUNT_VALID != 0 {
+		count := uint64(C.ndctl_cmd_smart_get_shutdown_count(cmd))
+		health.ShutdownCount = &count
+	}
+	return health, nil
+}
+
 // Strings formats all relevant attributes as JSON.
 func (d *dimm) String() string {
 	return marshal(map[string]interface{}{
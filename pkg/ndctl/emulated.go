@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// e820Provider is the provider name of the nvdimm bus for memory
+// that was reserved as PMEM with the memmap kernel parameter.
+const e820Provider = "e820"
+
+// emulatedVendors lists the DMI system vendors of virtual machines
+// which can only have emulated NVDIMMs.
+var emulatedVendors = []string{"QEMU"}
+
+// memmapAlign replaces the default region alignment for PMEM
+// reserved with memmap. The kernel only needs namespaces to be
+// aligned to 16MiB there. Emulated NVDIMMs in QEMU need the normal
+// fallback.
+const memmapAlign = 16 * mib
+
+// emulatedMachine checks the DMI system vendor only once because it
+// cannot change while the process runs. Tests replace it after
+// changing sysfsRoot.
+var emulatedMachine = sync.OnceValue(readEmulatedMachine)
+
+func readEmulatedMachine() bool {
+	vendor := readAttr(filepath.Join(sysfsRoot, "class", "dmi", "id"), "sys_vendor")
+	for _, v := range emulatedVendors {
+		if vendor == v {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEmulated returns true if the PMEM of the bus is emulated, for
+// example with memmap or by QEMU. Emulated PMEM is usually small and
+// has no media errors. Bad blocks then do not get checked because
+// address range scrubbing is not supported.
+func IsEmulated(bus Bus) bool {
+	if bus == nil {
+		return false
+	}
+	return isMemmap(bus) || emulatedMachine()
+}
+
+// isMemmap returns true for the bus of PMEM reserved with memmap.
+func isMemmap(bus Bus) bool {
+	return bus != nil && bus.Provider() == e820Provider
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBus implements just enough of Bus for IsEmulated.
+type fakeBus struct {
+	Bus
+	provider string
+}
+
+func (b fakeBus) Provider() string {
+	return b.provider
+}
+
+// fakeRegion implements just enough of Region for calculateAlignment.
+type fakeRegion struct {
+	Region
+	bus Bus
+}
+
+func (r fakeRegion) Bus() Bus {
+	return r.bus
+}
+
+func (r fakeRegion) InterleaveWays() uint64 {
+	return 1
+}
+
+func (r fakeRegion) GetAlign() uint64 {
+	return 0
+}
+
+// fakeVendor sets up a fake sysfs with the given DMI system vendor.
+// An empty vendor means that there is no DMI information.
+func fakeVendor(t *testing.T, vendor string) {
+	fakeSysfs(t)
+	if vendor != "" {
+		writeFile(t, filepath.Join(sysfsRoot, "class", "dmi", "id", "sys_vendor"), vendor)
+	}
+}
+
+func TestIsEmulated(t *testing.T) {
+	fakeVendor(t, "Intel Corporation")
+	assert.False(t, IsEmulated(nil), "no bus")
+	assert.True(t, IsEmulated(fakeBus{provider: "e820"}), "memmap")
+	assert.False(t, IsEmulated(fakeBus{provider: "ACPI.NFIT"}), "bare metal")
+
+	fakeVendor(t, "QEMU")
+	assert.True(t, IsEmulated(fakeBus{provider: "ACPI.NFIT"}), "QEMU")
+
+	// The vendor only gets read once.
+	require.NoError(t, os.Remove(filepath.Join(sysfsRoot, "class", "dmi", "id", "sys_vendor")), "remove vendor")
+	assert.True(t, IsEmulated(fakeBus{provider: "ACPI.NFIT"}), "cached")
+}
+
+func TestCalculateAlignmentEmulated(t *testing.T) {
+	for name, tc := range map[string]struct {
+		vendor   string
+		provider string
+		expected uint64
+	}{
+		"bare metal": {
+			vendor:   "Intel Corporation",
+			provider: "ACPI.NFIT",
+			expected: 96 * mib,
+		},
+		"no DMI": {
+			provider: "ACPI.NFIT",
+			expected: 96 * mib,
+		},
+		"QEMU": {
+			vendor:   "QEMU",
+			provider: "ACPI.NFIT",
+			expected: 96 * mib,
+		},
+		"memmap": {
+			vendor:   "Intel Corporation",
+			provider: "e820",
+			expected: 16 * mib,
+		},
+		"memmap in QEMU": {
+			vendor:   "QEMU",
+			provider: "e820",
+			expected: 16 * mib,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			fakeVendor(t, tc.vendor)
+			// The fsdax alignment is smaller than the
+			// region alignment and thus does not matter.
+			align, _ := calculateAlignment(fakeRegion{bus: fakeBus{provider: tc.provider}}, 2*mib)
+			assert.Equal(t, tc.expected, align, "alignment")
+		})
+	}
+}
@@ -17,6 +17,8 @@ type Dimm struct {
 	PhysicalID_ int
 	DeviceName_ string
 	Handle_     int16
+	Health_     *ndctl.DimmHealth
+	HealthErr_  error
 }
 
 var _ ndctl.Dimm = &Dimm{}
@@ -44,3 +46,7 @@ func (d *Dimm) DeviceName() string {
 func (d *Dimm) Handle() int16 {
 	return d.Handle_
 }
+
+func (d *Dimm) Health() (*ndctl.DimmHealth, error) {
+	return d.Health_, d.HealthErr_
+}
@@ -24,8 +24,11 @@ type Namespace struct {
 	Active_          bool
 	UUID_            uuid.UUID
 	Location_        ndctl.MapLocation
+	Resource_        uint64
+	Align_           uint64
 
-	Region_ ndctl.Region
+	Region_    ndctl.Region
+	BadBlocks_ []ndctl.BadBlock
 }
 
 var _ ndctl.Namespace = &Namespace{}
@@ -82,7 +85,16 @@ func (ns *Namespace) Region() ndctl.Region {
 	return ns.Region_
 }
 
+func (ns *Namespace) Resource() uint64 {
+	return ns.Resource_
+}
+
+func (ns *Namespace) Alignment() uint64 {
+	return ns.Align_
+}
+
 func (ns *Namespace) SetAltName(name string) error {
+	ns.Name_ = name
 	return nil
 }
 
@@ -122,3 +134,7 @@ func (ns *Namespace) SetRawMode(raw bool) error {
 func (ns *Namespace) SetPfnSeed(loc ndctl.MapLocation, align uint64) error {
 	return nil
 }
+
+func (ns *Namespace) BadBlocks() []ndctl.BadBlock {
+	return ns.BadBlocks_
+}
@@ -57,5 +57,11 @@ func (ctx *Context) Free() {
 }
 
 func (ctx *Context) GetBuses() []ndctl.Bus {
-	return ctx.Buses
+	var buses []ndctl.Bus
+	for _, bus := range ctx.Buses {
+		if ndctl.IsBusSelected(bus) {
+			buses = append(buses, bus)
+		}
+	}
+	return buses
 }
@@ -26,11 +26,14 @@ type Region struct {
 	Enabled_            bool
 	Readonly_           bool
 	InterleaveWays_     uint64
+	NumaNode_           int
 	RegionAlign_        uint64
+	Resource_           uint64
 
 	Mappings_   []ndctl.Mapping
 	Namespaces_ []ndctl.Namespace
 	Bus_        ndctl.Bus
+	BadBlocks_  []ndctl.BadBlock
 }
 
 var _ ndctl.Region = &Region{}
@@ -75,6 +78,10 @@ func (r *Region) InterleaveWays() uint64 {
 	return r.InterleaveWays_
 }
 
+func (r *Region) NumaNode() int {
+	return r.NumaNode_
+}
+
 func (r *Region) ActiveNamespaces() []ndctl.Namespace {
 	var namespaces []ndctl.Namespace
 	for _, namespace := range r.Namespaces_ {
@@ -111,6 +118,14 @@ func (r *Region) GetAlign() uint64 {
 	return r.RegionAlign_
 }
 
+func (r *Region) Resource() uint64 {
+	return r.Resource_
+}
+
+func (r *Region) BadBlocks() []ndctl.BadBlock {
+	return r.BadBlocks_
+}
+
 func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespaceOpts) (ndctl.Namespace, error) {
 	var err error
 	/* Set defaults */
@@ -156,6 +171,9 @@ func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespace
 			return nil, fmt.Errorf("create namespace with size %v: %w", opts.Size, pmemerr.NotEnoughSpace)
 		}
 		align := mib2
+		if opts.Align != 0 {
+			align = opts.Align
+		}
 		if opts.Size%align != 0 {
 			// Round up size to align with next block boundary.
 			opts.Size = (opts.Size/align + 1) * align
@@ -164,7 +182,7 @@ func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespace
 
 	/* setup_namespace */
 
-	ns := &Namespace{}
+	ns := &Namespace{Region_: r}
 
 	if ns.Type() != ndctl.IoNamespace {
 		uid, _ := uuid.NewUUID()
@@ -183,6 +201,12 @@ func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespace
 	if err == nil {
 		err = ns.SetEnforceMode(opts.Mode)
 	}
+	if opts.Mode == ndctl.FsdaxMode || opts.Mode == ndctl.DaxMode {
+		ns.Align_ = mib2
+		if opts.Align != 0 {
+			ns.Align_ = opts.Align
+		}
+	}
 
 	if err == nil {
 		err = ns.Enable()
@@ -196,7 +220,7 @@ func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespace
 	return ns, nil
 }
 
-func (r *Region) DestroyNamespace(ns ndctl.Namespace, force bool) error {
+func (r *Region) DestroyNamespace(ctx context.Context, ns ndctl.Namespace, force bool) error {
 	for i := range r.Namespaces_ {
 		if r.Namespaces_[i] == ns {
 			r.Namespaces_ = append(r.Namespaces_[:i], r.Namespaces_[i+1:]...)
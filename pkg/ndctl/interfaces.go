@@ -0,0 +1,233 @@
+package ndctl
+
+import (
+	gocontext "context"
+
+	"github.com/google/uuid"
+)
+
+// Bus is a go wrapper for ndctl_bus.
+type Bus interface {
+	// Provider returns the bus provider.
+	Provider() string
+	// DeviceName returns the bus device name.
+	DeviceName() string
+	// Dimms returns the dimms provided by the bus.
+	Dimms() []Dimm
+	// ActiveRegions returns all active regions in the bus.
+	ActiveRegions() []Region
+	// AllRegions returns all regions in the bus including disabled regions.
+	AllRegions() []Region
+	// GetRegionByPhysicalAddress finds a region by physical address.
+	GetRegionByPhysicalAddress(address uint64) Region
+}
+
+// Dimm is a go wrapper for ndctl_dimm.
+type Dimm interface {
+	// Enabled returns if the dimm is enabled.
+	Enabled() bool
+	// Active returns if the the device is active.
+	Active() bool
+	// ID returns the dimm's unique identifier string.
+	ID() string
+	// PhysicalID returns the dimm's physical id number.
+	PhysicalID() int
+	// DeviceName returns the dimm's device name.
+	DeviceName() string
+	// Handle returns the dimm's handle.
+	Handle() int16
+	// Health returns the SMART health information of the dimm.
+	Health() (*DimmHealth, error)
+}
+
+// HealthState summarizes the health of a dimm.
+type HealthState string
+
+const (
+	HealthOK          HealthState = "ok"
+	HealthNonCritical HealthState = "non-critical"
+	HealthCritical    HealthState = "critical"
+	HealthFatal       HealthState = "fatal"
+)
+
+// DimmHealth contains the SMART health information of a dimm. Values
+// which the dimm does not report are nil or empty.
+type DimmHealth struct {
+	// State is empty when unknown.
+	State HealthState
+	// MediaTemperature in degrees Celsius.
+	MediaTemperature *float64
+	// ControllerTemperature in degrees Celsius.
+	ControllerTemperature *float64
+	// SparesPercentage is the remaining spare capacity.
+	SparesPercentage *uint
+	// ShutdownCount is the number of unsafe (dirty) shutdowns.
+	ShutdownCount *uint64
+}
+
+// Mapping is a go wrapper for ndctl_mapping.
+type Mapping interface {
+	// Offset returns the offset within the region.
+	Offset() uint64
+	// Length returns the mapping's length.
+	Length() uint64
+	// Position returns the mapping's position.
+	Position() int
+	// Region gets the associated region.
+	Region() Region
+	// Dimm gets the associated dimm.
+	Dimm() Dimm
+}
+
+type RegionType string
+
+const (
+	PmemRegion    RegionType = "pmem" //C.ND_DEVICE_REGION_PMEM
+	BlockRegion   RegionType = "blk"  //C.ND_DEVICE_REGION_BLK
+	UnknownRegion RegionType = "unknown"
+)
+
+// Region go wrapper for ndctl_region
+type Region interface {
+	// ID returns region id.
+	ID() uint
+	// DeviceName returns region name.
+	DeviceName() string
+	// Size returns the total size of the region.
+	Size() uint64
+	// AvailableSize returns the size of remaining available space in the region.
+	AvailableSize() uint64
+	// MaxAvailableExtent returns max available extent size in the region.
+	MaxAvailableExtent() uint64
+	// Type identifies the kind of region.
+	Type() RegionType
+	// TypeName returns the name for the region type.
+	TypeName() string
+	// Enabled returns true if the region is enabled.
+	Enabled() bool
+	// Readonly returns true if the region is read/only.
+	Readonly() bool
+	// InterleaveWays returns the interleaving of the region.
+	InterleaveWays() uint64
+	// NumaNode returns the NUMA node that the region is attached
+	// to, -1 if unknown.
+	NumaNode() int
+	// ActiveNamespaces returns all active namespaces in the region.
+	ActiveNamespaces() []Namespace
+	// AllNamespaces returns all non-zero sized namespaces in the region
+	// as sometime a deleted namespace also lies around with size zero, we can ignore
+	// such namespace.
+	AllNamespaces() []Namespace
+	// Bus returns the bus associated with the region.
+	Bus() Bus
+	// Mappings returns all available mappings in the region.
+	Mappings() []Mapping
+	// SeedNamespace returns the initial namespace in the region.
+	SeedNamespace() Namespace
+	// CreateNamespace creates a new namespace in the region.
+	CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error)
+	// DestroyNamespace destroys the given namespace in the region.
+	DestroyNamespace(ctx gocontext.Context, ns Namespace, force bool) error
+	// FsdaxAlignment returns the default alignment for an fsdax namespace.
+	// It always returns a non-zero value.
+	FsdaxAlignment() uint64
+	// GetAlign returns region alignment. 0 if unknown.
+	GetAlign() uint64
+	// BadBlocks returns the known media errors in the region.
+	BadBlocks() []BadBlock
+	// Resource returns the physical start address of the
+	// region, 0 if unknown.
+	Resource() uint64
+}
+
+// NamespaceType type to represent namespace type
+type NamespaceType string
+
+// NamespaceMode represents mode of the namespace
+type NamespaceMode string
+
+type MapLocation string
+
+const (
+	//PmemNamespace pmem type namespace
+	PmemNamespace NamespaceType = "pmem"
+	//BlockNamespace block type namespace
+	BlockNamespace NamespaceType = "blk"
+	//IoNamespace io type namespace
+	IoNamespace NamespaceType = "io"
+	//UnknownType unknown namespace
+	UnknownType NamespaceType = "unknown"
+)
+
+const (
+	DaxMode     NamespaceMode = "dax"   //DevDax
+	FsdaxMode   NamespaceMode = "fsdax" //Memory
+	RawMode     NamespaceMode = "raw"
+	SectorMode  NamespaceMode = "sector"
+	UnknownMode NamespaceMode = "unknown"
+)
+
+const (
+	MemoryMap MapLocation = "mem" // RAM
+	DeviceMap MapLocation = "dev" // Block Device
+	NoneMap   MapLocation = "none"
+)
+
+// Namespace is a go wrapper for ndctl_namespace.
+type Namespace interface {
+	// ID returns the namespace id.
+	ID() uint
+	// Name returns the name of the namespace.
+	Name() string
+	// DeviceName returns the device name of the namespace.
+	DeviceName() string
+	// BlockDeviceName returns the block device name of the namespace.
+	BlockDeviceName() string
+	// Size returns the size of the device provided by the namespace.
+	Size() uint64
+	// RawSize returns the amount of PMEM used by the namespace
+	// in the underlying region, which is more than Size().
+	RawSize() uint64
+	// Mode returns the namespace mode.
+	Mode() NamespaceMode
+	// Type returns the namespace type.
+	Type() NamespaceType
+	// Enabled return true if the namespace is enabled.
+	Enabled() bool
+	// Active returns true if the namespace is active.
+	Active() bool
+	// UUID returns the uuid of the namespace.
+	UUID() uuid.UUID
+	// Location returns the namespace mapping location.
+	Location() MapLocation
+	// Region returns reference to the region that contains the namespace.
+	Region() Region
+	// Resource returns the physical start address of the
+	// namespace, 0 if unknown.
+	Resource() uint64
+	// Alignment returns the mapping alignment of an fsdax or
+	// devdax namespace, 0 for other modes or if unknown.
+	Alignment() uint64
+
+	// SetAltName changes the alternative name of the namespace.
+	SetAltName(name string) error
+	// SetSize changes the size of the namespace.
+	SetSize(size uint64) error
+	// SetUUID changes the uuid of the namespace.
+	SetUUID(uid uuid.UUID) error
+	// SetSectorSize changes the sector size of the namespace.
+	SetSectorSize(sectorSize uint64) error
+	// SetEnforceMode changes how the namespace mode.
+	SetEnforceMode(mode NamespaceMode) error
+	// Enable activates the namespace.
+	Enable() error
+	// Disable deactivates the namespace.
+	Disable() error
+	// RawMode enables or disables direct access to the block device.
+	SetRawMode(raw bool) error
+	// SetPfnSeed creates a PFN for the namespace.
+	SetPfnSeed(loc MapLocation, align uint64) error
+	// BadBlocks returns the known media errors in the data area
+	// of the namespace.
+	BadBlocks() []BadBlock
+}
@@ -0,0 +1,54 @@
+package ndctl
+
+//#cgo pkg-config: libndctl
+//#include <string.h>
+//#define ARRAY_SIZE(a) (sizeof(a) / sizeof((a)[0]))
+//#include <ndctl/libndctl.h>
+//#include <ndctl/ndctl.h>
+import "C"
+
+import (
+	"fmt"
+)
+
+type context = C.struct_ndctl_ctx
+
+var _ Context = &context{}
+
+// libndctlAvailable is true when the package was built with cgo.
+const libndctlAvailable = true
+
+func newLibndctlContext() (Context, error) {
+	var ndctx *context
+
+	if rc := C.ndctl_new(&ndctx); rc != 0 {
+		return nil, fmt.Errorf("Create context failed with error: %s", cErrorString(rc))
+	}
+
+	return ndctx, nil
+}
+
+func (ndctx *context) Free() {
+	if ndctx != nil {
+		C.ndctl_unref((*C.struct_ndctl_ctx)(ndctx))
+	}
+}
+
+func (ndctx *context) GetBuses() []Bus {
+	var buses []Bus
+
+	for ndbus := C.ndctl_bus_get_first(ndctx); ndbus != nil; ndbus = C.ndctl_bus_get_next(ndbus) {
+		if !IsBusSelected(ndbus) {
+			continue
+		}
+		buses = append(buses, ndbus)
+	}
+	return buses
+}
+
+func cErrorString(errno C.int) string {
+	if errno < 0 {
+		errno = -errno
+	}
+	return C.GoString(C.strerror(errno))
+}
@@ -0,0 +1,20 @@
+//go:build !cgo
+
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"errors"
+)
+
+// libndctlAvailable is true when the package was built with cgo.
+const libndctlAvailable = false
+
+func newLibndctlContext() (Context, error) {
+	return nil, errors.New("libndctl backend not available, binary was built without cgo")
+}
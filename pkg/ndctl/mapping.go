@@ -4,20 +4,6 @@ package ndctl
 //#include <ndctl/libndctl.h>
 import "C"
 
-// Mapping is a go wrapper for ndctl_mapping.
-type Mapping interface {
-	// Offset returns the offset within the region.
-	Offset() uint64
-	// Length returns the mapping's length.
-	Length() uint64
-	// Position returns the mapping's position.
-	Position() int
-	// Region gets the associated region.
-	Region() Region
-	// Dimm gets the associated dimm.
-	Dimm() Dimm
-}
-
 type mapping = C.struct_ndctl_mapping
 
 var _ Mapping = &mapping{}
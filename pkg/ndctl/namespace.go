@@ -16,39 +16,9 @@ import (
 	"unsafe"
 
 	"github.com/google/uuid"
+	"k8s.io/klog/v2"
 )
 
-const (
-	//PmemNamespace pmem type namespace
-	PmemNamespace NamespaceType = "pmem"
-	//BlockNamespace block type namespace
-	BlockNamespace NamespaceType = "blk"
-	//IoNamespace io type namespace
-	IoNamespace NamespaceType = "io"
-	//UnknownType unknown namespace
-	UnknownType NamespaceType = "unknown"
-)
-
-const (
-	DaxMode     NamespaceMode = "dax"   //DevDax
-	FsdaxMode   NamespaceMode = "fsdax" //Memory
-	RawMode     NamespaceMode = "raw"
-	SectorMode  NamespaceMode = "sector"
-	UnknownMode NamespaceMode = "unknown"
-)
-
-const (
-	MemoryMap MapLocation = "mem" // RAM
-	DeviceMap MapLocation = "dev" // Block Device
-	NoneMap   MapLocation = "none"
-)
-
-// NamespaceType type to represent namespace type
-type NamespaceType string
-
-// NamespaceMode represents mode of the namespace
-type NamespaceMode string
-
 func (mode NamespaceMode) toCMode() C.enum_ndctl_namespace_mode {
 	switch mode {
 	case DaxMode:
@@ -63,8 +33,6 @@ func (mode NamespaceMode) toCMode() C.enum_ndctl_namespace_mode {
 	return C.NDCTL_NS_MODE_UNKNOWN
 }
 
-type MapLocation string
-
 func (loc MapLocation) toCPfnLocation() C.enum_ndctl_pfn_loc {
 	if loc == MemoryMap {
 		return C.NDCTL_PFN_LOC_RAM
@@ -75,56 +43,6 @@ func (loc MapLocation) toCPfnLocation() C.enum_ndctl_pfn_loc {
 	return C.NDCTL_PFN_LOC_NONE
 }
 
-// Namespace is a go wrapper for ndctl_namespace.
-type Namespace interface {
-	// ID returns the namespace id.
-	ID() uint
-	// Name returns the name of the namespace.
-	Name() string
-	// DeviceName returns the device name of the namespace.
-	DeviceName() string
-	// BlockDeviceName returns the block device name of the namespace.
-	BlockDeviceName() string
-	// Size returns the size of the device provided by the namespace.
-	Size() uint64
-	// RawSize returns the amount of PMEM used by the namespace
-	// in the underlying region, which is more than Size().
-	RawSize() uint64
-	// Mode returns the namespace mode.
-	Mode() NamespaceMode
-	// Type returns the namespace type.
-	Type() NamespaceType
-	// Enabled return true if the namespace is enabled.
-	Enabled() bool
-	// Active returns true if the namespace is active.
-	Active() bool
-	// UUID returns the uuid of the namespace.
-	UUID() uuid.UUID
-	// Location returns the namespace mapping location.
-	Location() MapLocation
-	// Region returns reference to the region that contains the namespace.
-	Region() Region
-
-	// SetAltName changes the alternative name of the namespace.
-	SetAltName(name string) error
-	// SetSize changes the size of the namespace.
-	SetSize(size uint64) error
-	// SetUUID changes the uuid of the namespace.
-	SetUUID(uid uuid.UUID) error
-	// SetSectorSize changes the sector size of the namespace.
-	SetSectorSize(sectorSize uint64) error
-	// SetEnforceMode changes how the namespace mode.
-	SetEnforceMode(mode NamespaceMode) error
-	// Enable activates the namespace.
-	Enable() error
-	// Disable deactivates the namespace.
-	Disable() error
-	// RawMode enables or disables direct access to the block device.
-	SetRawMode(raw bool) error
-	// SetPfnSeed creates a PFN for the namespace.
-	SetPfnSeed(loc MapLocation, align uint64) error
-}
-
 type namespace = C.struct_ndctl_namespace
 
 var _ Namespace = &namespace{}
@@ -260,7 +178,9 @@ func (ns *namespace) UUID() uuid.UUID {
 	uidbytes := C.GoBytes(unsafe.Pointer(&cuid[0]), C.sizeof_uuid_t)
 	_uuid, err := uuid.FromBytes(uidbytes)
 	if err != nil {
-		fmt.Printf("WARN: wrong uuid: %s", err.Error())
+		// UUID has no context and no error return, the
+		// zero UUID is returned instead.
+		klog.Background().Error(err, "Invalid namespace UUID", "namespace", ns.DeviceName())
 		return uuid.UUID{}
 	}
 
@@ -295,6 +215,28 @@ func (ns *namespace) Region() Region {
 
 }
 
+func (ns *namespace) Resource() uint64 {
+	resource := C.ndctl_namespace_get_resource(ns)
+	if resource == C.ULLONG_MAX {
+		return 0
+	}
+	return uint64(resource)
+}
+
+func (ns *namespace) Alignment() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode:
+		if pfn := C.ndctl_namespace_get_pfn(ns); pfn != nil && C.ndctl_pfn_has_align(pfn) == 1 {
+			return uint64(C.ndctl_pfn_get_align(pfn))
+		}
+	case DaxMode:
+		if dax := C.ndctl_namespace_get_dax(ns); dax != nil {
+			return uint64(C.ndctl_dax_get_align(dax))
+		}
+	}
+	return 0
+}
+
 func (ns *namespace) SetAltName(name string) error {
 	if rc := C.ndctl_namespace_set_alt_name(ns, C.CString(name)); rc != 0 {
 		return fmt.Errorf("Failed to set namespace name: %s", cErrorString(rc))
@@ -377,6 +319,14 @@ func (ns *namespace) SetRawMode(raw bool) error {
 	return nil
 }
 
+func (ns *namespace) BadBlocks() []BadBlock {
+	var badBlocks []BadBlock
+	for bb := C.ndctl_namespace_get_first_badblock(ns); bb != nil; bb = C.ndctl_namespace_get_next_badblock(ns) {
+		badBlocks = append(badBlocks, BadBlock{Offset: uint64(bb.offset), Length: uint64(bb.len)})
+	}
+	return badBlocks
+}
+
 // String formats all relevant attributes as JSON.
 func (ns *namespace) String() string {
 	props := map[string]interface{}{
@@ -389,6 +339,10 @@ func (ns *namespace) String() string {
 		"name":    ns.Name(),
 	}
 
+	if count := CountBadBlocks(ns.BadBlocks()); count > 0 {
+		props["badblock_count"] = count
+	}
+
 	if mode := ns.Mode(); mode != DaxMode {
 		props["blockdev"] = ns.BlockDeviceName()
 	}
@@ -1,17 +1,14 @@
 package ndctl
 
-//#cgo pkg-config: libndctl
-//#include <string.h>
-//#define ARRAY_SIZE(a) (sizeof(a) / sizeof((a)[0]))
-//#include <ndctl/libndctl.h>
-//#include <ndctl/ndctl.h>
-import "C"
-
 import (
 	gocontext "context"
 	"fmt"
 
+	"k8s.io/klog/v2"
+
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/math"
 )
 
 const (
@@ -23,90 +20,297 @@ const (
 
 // CreateNamespaceOpts options to create a namespace
 type CreateNamespaceOpts struct {
-	Name       string
-	Size       uint64
+	Name string
+	Size uint64
+	// Limit is the maximum size after alignment. Creating the
+	// namespace fails with OutOfRange in regions where the
+	// alignment makes it larger. Zero disables the check.
+	Limit      uint64
 	SectorSize uint64
-	Type       NamespaceType
-	Mode       NamespaceMode
-	Location   MapLocation
+	// Align is the mapping alignment of fsdax and devdax
+	// namespaces. The size gets aligned to it, too. The
+	// default is 2MiB.
+	Align    uint64
+	Type     NamespaceType
+	Mode     NamespaceMode
+	Location MapLocation
+	// Regions limits CreateNamespace to the regions with these
+	// names. All regions are used if empty.
+	Regions []string
+	// AvoidBadBlocks fails with NotEnoughSpace without creating
+	// the namespace if the range of the region where the kernel
+	// would put it contains known media errors.
+	AvoidBadBlocks bool
 }
 
 // Context is a go wrapper for ndctl context
 type Context interface {
 	// Free destroys the context.
 	Free()
-	// GetBuses returns all available buses.
+	// GetBuses returns all available buses of the types
+	// selected with SelectBusTypes.
 	GetBuses() []Bus
 }
 
-type context = C.struct_ndctl_ctx
+// CreateNamespace creates a new namespace with given opts in some arbitrary
+// region. It returns an error if creation fails in all regions.
+func CreateNamespace(ctx gocontext.Context, ndctx Context, opts CreateNamespaceOpts) (Namespace, error) {
+	err := pmemerr.NotEnoughSpace
+	var ns Namespace
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if len(opts.Regions) > 0 && !containsRegion(opts.Regions, r.DeviceName()) {
+				continue
+			}
+			if ns, err = r.CreateNamespace(ctx, opts); err == nil {
+				return ns, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+func containsRegion(regions []string, name string) bool {
+	for _, region := range regions {
+		if region == name {
+			return true
+		}
+	}
+	return false
+}
 
-var _ Context = &context{}
+// prepareNamespace sets defaults in the options, checks that
+// the region can hold the namespace and determines the aligned size
+// of it. It is shared by the Region implementations.
+func prepareNamespace(ctx gocontext.Context, r Region, opts CreateNamespaceOpts) (CreateNamespaceOpts, uint64, klog.Logger, error) {
+	regionName := r.DeviceName()
+	logger := klog.FromContext(ctx).WithName("CreateNamespace").WithValues("region", regionName)
 
-// NewContext Initializes new context
-func NewContext() (Context, error) {
-	var ndctx *context
+	/* Set defaults */
+	if opts.Type == "" {
+		opts.Type = PmemNamespace
+	}
+	if opts.Mode == "" {
+		if opts.Type == PmemNamespace {
+			opts.Mode = FsdaxMode // == MemoryMode
+		} else {
+			opts.Mode = SectorMode
+		}
+	}
+	if opts.Location == "" {
+		opts.Location = DeviceMap
+	}
 
-	if rc := C.ndctl_new(&ndctx); rc != 0 {
-		return nil, fmt.Errorf("Create context failed with error: %s", cErrorString(rc))
+	if opts.SectorSize == 0 {
+		if opts.Type == BlockNamespace || opts.Mode == SectorMode {
+			// default sector size for blk-type or safe-mode
+			opts.SectorSize = kib4
+		}
+	}
+	fsdaxalign := r.FsdaxAlignment()
+	switch {
+	case opts.Mode != FsdaxMode && opts.Mode != DaxMode:
+		opts.Align = 0
+	case opts.Align == 0:
+		opts.Align = mib2
+	default:
+		fsdaxalign = opts.Align
 	}
 
-	return ndctx, nil
-}
+	/* Sanity checks */
 
-func (ndctx *context) Free() {
-	if ndctx != nil {
-		C.ndctl_unref((*C.struct_ndctl_ctx)(ndctx))
+	if !r.Enabled() {
+		return opts, 0, logger, fmt.Errorf("Region not enabled")
+	}
+	if r.Readonly() {
+		return opts, 0, logger, fmt.Errorf("Cannot create namspace in readonly region")
 	}
-}
 
-func (ndctx *context) GetBuses() []Bus {
-	var buses []Bus
+	if r.Type() == BlockRegion {
+		if opts.Mode == FsdaxMode || opts.Mode == DaxMode {
+			return opts, 0, logger, fmt.Errorf("Block regions does not support %s mode namespace", opts.Mode)
+		}
+	}
 
-	for ndbus := C.ndctl_bus_get_first(ndctx); ndbus != nil; ndbus = C.ndctl_bus_get_next(ndbus) {
-		buses = append(buses, ndbus)
+	align, alignInfo := calculateAlignment(r, fsdaxalign)
+	size := opts.Size
+	available := r.MaxAvailableExtent()
+	if available == ^uint64(0) {
+		// ULLONG_MAX: not supported by the kernel.
+		available = r.AvailableSize()
+	}
+	logger = logger.WithValues(
+		"region", r.DeviceName(),
+	).WithValues(alignInfo...).WithValues(
+		"available", pmemlog.CapacityRef(int64(available)),
+	)
+	if size == 0 || size%align != 0 {
+		// Align up to least-common-multiple alignment boundary.
+		size = (size/align + 1) * align
+		logger.V(3).Info("Namespace size must be rounded up to alignment boundaries",
+			"old-size", pmemlog.CapacityRef(int64(opts.Size)),
+			"new-size", pmemlog.CapacityRef(int64(size)),
+		)
+	} else {
+		logger.V(3).Info("Creating namespace with requested size",
+			"size", pmemlog.CapacityRef(int64(size)),
+		)
+	}
+	if opts.Limit > 0 && size > opts.Limit {
+		return opts, 0, logger, fmt.Errorf("create namespace with size %v: aligned to %v exceeds limit %v: %w", opts.Size, size, opts.Limit, pmemerr.OutOfRange)
+	}
+	if size > available {
+		return opts, 0, logger, fmt.Errorf("create namespace with size %v: %w", size, pmemerr.NotEnoughSpace)
 	}
-	return buses
+	if opts.AvoidBadBlocks && !IsEmulated(r.Bus()) {
+		if err := checkBadBlocks(r, size); err != nil {
+			return opts, 0, logger, fmt.Errorf("create namespace with size %v: %w", size, err)
+		}
+	}
+	return opts, size, logger, nil
 }
 
-// CreateNamespace creates a new namespace with given opts in some arbitrary
-// region. It returns an error if creation fails in all regions.
-func CreateNamespace(ctx gocontext.Context, ndctx Context, opts CreateNamespaceOpts) (Namespace, error) {
-	var err error
-	var ns Namespace
-	for _, bus := range ndctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			if ns, err = r.CreateNamespace(ctx, opts); err == nil {
-				return ns, nil
-			}
+// checkBadBlocks fails with NotEnoughSpace if a new namespace of the
+// given size would contain known media errors. The kernel chooses
+// where the namespace gets placed, so this relies on predicting that
+// with plannedExtent.
+func checkBadBlocks(r Region, size uint64) error {
+	badBlocks := r.BadBlocks()
+	if len(badBlocks) == 0 {
+		return nil
+	}
+	offset, ok := plannedExtent(r, size)
+	if !ok {
+		return fmt.Errorf("location in region with %d bad blocks unknown: %w", CountBadBlocks(badBlocks), pmemerr.NotEnoughSpace)
+	}
+	if count := countBadBlocksInRange(badBlocks, offset, size); count > 0 {
+		return fmt.Errorf("%d bad blocks at offset %d: %w", count, offset, pmemerr.NotEnoughSpace)
+	}
+	return nil
+}
+
+// finishNamespace checks a namespace created by CreateNamespace.
+func finishNamespace(ctx gocontext.Context, logger klog.Logger, r Region, ns Namespace, opts CreateNamespaceOpts) (Namespace, error) {
+	if opts.AvoidBadBlocks && !IsEmulated(r.Bus()) {
+		// Only happens if the kernel did not put the
+		// namespace where checkBadBlocks expected it.
+		if count := CountBadBlocks(ns.BadBlocks()); count > 0 {
+			logger.Info("Warning: new namespace has media errors",
+				"namespace", ns.DeviceName(),
+				"bad-blocks", count,
+			)
 		}
 	}
-	return nil, err
+
+	logger.V(3).Info("Namespace created",
+		"namespace", ns.DeviceName(),
+		"usable-size", pmemlog.CapacityRef(int64(ns.Size())),
+		"raw-size", pmemlog.CapacityRef(int64(ns.RawSize())),
+		"uuid", ns.UUID(),
+	)
+	return ns, nil
+}
+
+// CalculateAlignment considers region and namespace alignment.
+// It returns the final alignment value and key/value pairs for logging.
+func CalculateAlignment(r Region) (uint64, []interface{}) {
+	return calculateAlignment(r, r.FsdaxAlignment())
+}
+
+// CalculateAlignmentFor is like CalculateAlignment for namespaces
+// with the given mapping alignment instead of the default one.
+func CalculateAlignmentFor(r Region, fsdaxalign uint64) (uint64, []interface{}) {
+	return calculateAlignment(r, fsdaxalign)
+}
+
+func calculateAlignment(r Region, fsdaxalign uint64) (uint64, []interface{}) {
+	interleave := r.InterleaveWays()
+	namespacealign := fsdaxalign * interleave
+	rawRegionAlign := r.GetAlign()
+	regionalign := rawRegionAlign
+	emulated := IsEmulated(r.Bus())
+	switch {
+	case regionalign > 1:
+	case isMemmap(r.Bus()):
+		// Small memmap regions would not have room for
+		// many volumes with the generic fallback below.
+		regionalign = memmapAlign
+	default:
+		// This fallback turned out to be necessary when emulating PMEM in
+		// libvirt (OpenShift 4.8 beta): both PMEM-CSI and ndctl failed
+		// to create a namespace of size 100MiB, whereas 96MiB worked.
+		// It therefore also applies to emulated NVDIMMs in QEMU.
+		regionalign = 96 * 1024 * 1024
+	}
+	// Size has to be aligned both by namespace alignment times interleave_ways, and also by region alignment
+	align := math.LCM(namespacealign, regionalign)
+
+	return align, []interface{}{
+		"fsdaxalign", pmemlog.CapacityRef(int64(fsdaxalign)),
+		"interleave", interleave,
+		"namespace-align", pmemlog.CapacityRef(int64(namespacealign)),
+		"region-align", pmemlog.CapacityRef(int64(rawRegionAlign)),
+		"final-region-align", pmemlog.CapacityRef(int64(regionalign)),
+		"emulated", emulated,
+		"common-align", pmemlog.CapacityRef(int64(align)),
+	}
 }
 
 // DestroyNamespaceByName deletes the namespace with the given name.
-func DestroyNamespaceByName(ndctx Context, name string) error {
+func DestroyNamespaceByName(ctx gocontext.Context, ndctx Context, name string) error {
 	ns, err := GetNamespaceByName(ndctx, name)
 	if err != nil {
 		return err
 	}
 
 	r := ns.Region()
-	return r.DestroyNamespace(ns, true)
+	return r.DestroyNamespace(ctx, ns, true)
 }
 
 // GetNamespaceByName gets the namespace details for a given name.
 func GetNamespaceByName(ndctx Context, name string) (Namespace, error) {
+	var found Namespace
+	VisitNamespaces(ndctx, func(ns Namespace) bool {
+		if ns.Name() == name {
+			found = ns
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return nil, pmemerr.DeviceNotFound
+	}
+	return found, nil
+}
+
+// namespaceVisitor is implemented by regions which can enumerate
+// their namespaces one at a time. visitNamespaces uses the same
+// filtering as ActiveNamespaces and AllNamespaces and returns false
+// if visit stopped the enumeration.
+type namespaceVisitor interface {
+	visitNamespaces(onlyActive bool, visit func(ns Namespace) bool) bool
+}
+
+// VisitNamespaces calls visit for each namespace in all regions,
+// including idle namespaces, until it returns false. Unlike
+// GetAllNamespaces it does not collect all namespaces first, so
+// looking for a single namespace stops after finding it.
+func VisitNamespaces(ndctx Context, visit func(ns Namespace) bool) {
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.AllRegions() {
+			if v, ok := r.(namespaceVisitor); ok {
+				if !v.visitNamespaces(false, visit) {
+					return
+				}
+				continue
+			}
 			for _, ns := range r.AllNamespaces() {
-				if ns.Name() == name {
-					return ns, nil
+				if !visit(ns) {
+					return
 				}
 			}
 		}
 	}
-	return nil, pmemerr.DeviceNotFound
 }
 
 // GetActiveNamespaces returns a list of all active namespaces in all regions.
@@ -125,13 +329,10 @@ func GetActiveNamespaces(ndctx Context) []Namespace {
 // GetAllNamespaces returns a list of all namespaces in all regions including idle namespaces.
 func GetAllNamespaces(ndctx Context) []Namespace {
 	var list []Namespace
-	for _, bus := range ndctx.GetBuses() {
-		for _, r := range bus.AllRegions() {
-			nss := r.AllNamespaces()
-			list = append(list, nss...)
-		}
-	}
-
+	VisitNamespaces(ndctx, func(ns Namespace) bool {
+		list = append(list, ns)
+		return true
+	})
 	return list
 }
 
@@ -147,10 +348,3 @@ func IsSpaceAvailable(ndctx Context, size uint64) bool {
 
 	return false
 }
-
-func cErrorString(errno C.int) string {
-	if errno < 0 {
-		errno = -errno
-	}
-	return C.GoString(C.strerror(errno))
-}
@@ -11,66 +11,8 @@ import (
 	"fmt"
 
 	"github.com/google/uuid"
-	"k8s.io/klog/v2"
-
-	pmemerr "github.com/intel/pmem-csi/pkg/errors"
-	pmemlog "github.com/intel/pmem-csi/pkg/logger"
-	"github.com/intel/pmem-csi/pkg/math"
 )
 
-type RegionType string
-
-const (
-	PmemRegion    RegionType = "pmem" //C.ND_DEVICE_REGION_PMEM
-	BlockRegion   RegionType = "blk"  //C.ND_DEVICE_REGION_BLK
-	UnknownRegion RegionType = "unknown"
-)
-
-// Region go wrapper for ndctl_region
-type Region interface {
-	// ID returns region id.
-	ID() uint
-	// DeviceName returns region name.
-	DeviceName() string
-	// Size returns the total size of the region.
-	Size() uint64
-	// AvailableSize returns the size of remaining available space in the region.
-	AvailableSize() uint64
-	// MaxAvailableExtent returns max available extent size in the region.
-	MaxAvailableExtent() uint64
-	// Type identifies the kind of region.
-	Type() RegionType
-	// TypeName returns the name for the region type.
-	TypeName() string
-	// Enabled returns true if the region is enabled.
-	Enabled() bool
-	// Readonly returns true if the region is read/only.
-	Readonly() bool
-	// InterleaveWays returns the interleaving of the region.
-	InterleaveWays() uint64
-	// ActiveNamespaces returns all active namespaces in the region.
-	ActiveNamespaces() []Namespace
-	// AllNamespaces returns all non-zero sized namespaces in the region
-	// as sometime a deleted namespace also lies around with size zero, we can ignore
-	// such namespace.
-	AllNamespaces() []Namespace
-	// Bus returns the bus associated with the region.
-	Bus() Bus
-	// Mappings returns all available mappings in the region.
-	Mappings() []Mapping
-	// SeedNamespace returns the initial namespace in the region.
-	SeedNamespace() Namespace
-	// CreateNamespace creates a new namespace in the region.
-	CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error)
-	// DestroyNamespace destroys the given namespace in the region.
-	DestroyNamespace(ns Namespace, force bool) error
-	// FsdaxAlignment returns the default alignment for an fsdax namespace.
-	// It always returns a non-zero value.
-	FsdaxAlignment() uint64
-	// GetAlign returns region alignment. 0 if unknown.
-	GetAlign() uint64
-}
-
 type region = C.struct_ndctl_region
 
 var _ Region = &region{}
@@ -122,6 +64,10 @@ func (r *region) InterleaveWays() uint64 {
 	return uint64(C.ndctl_region_get_interleave_ways(r))
 }
 
+func (r *region) NumaNode() int {
+	return int(C.ndctl_region_get_numa_node(r))
+}
+
 func (r *region) ActiveNamespaces() []Namespace {
 	return r.namespaces(true)
 }
@@ -155,73 +101,26 @@ func (r *region) GetAlign() uint64 {
 	return uint64(align)
 }
 
-func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error) {
-	regionName := r.DeviceName()
-	logger := klog.FromContext(ctx).WithName("CreateNamespace").WithValues("region", regionName)
-
-	var err error
-	/* Set defaults */
-	if opts.Type == "" {
-		opts.Type = PmemNamespace
-	}
-	if opts.Mode == "" {
-		if opts.Type == PmemNamespace {
-			opts.Mode = FsdaxMode // == MemoryMode
-		} else {
-			opts.Mode = SectorMode
-		}
-	}
-	if opts.Location == "" {
-		opts.Location = DeviceMap
-	}
-
-	if opts.SectorSize == 0 {
-		if opts.Type == BlockNamespace || opts.Mode == SectorMode {
-			// default sector size for blk-type or safe-mode
-			opts.SectorSize = kib4
-		}
-	}
-
-	/* Sanity checks */
-
-	if !r.Enabled() {
-		return nil, fmt.Errorf("Region not enabled")
-	}
-	if r.Readonly() {
-		return nil, fmt.Errorf("Cannot create namspace in readonly region")
+func (r *region) Resource() uint64 {
+	resource := C.ndctl_region_get_resource(r)
+	if resource == C.ULLONG_MAX {
+		return 0
 	}
+	return uint64(resource)
+}
 
-	if r.Type() == BlockRegion {
-		if opts.Mode == FsdaxMode || opts.Mode == DaxMode {
-			return nil, fmt.Errorf("Block regions does not support %s mode namespace", opts.Mode)
-		}
+func (r *region) BadBlocks() []BadBlock {
+	var badBlocks []BadBlock
+	for bb := C.ndctl_region_get_first_badblock(r); bb != nil; bb = C.ndctl_region_get_next_badblock(r) {
+		badBlocks = append(badBlocks, BadBlock{Offset: uint64(bb.offset), Length: uint64(bb.len)})
 	}
+	return badBlocks
+}
 
-	align, alignInfo := CalculateAlignment(r)
-	size := opts.Size
-	available := r.MaxAvailableExtent()
-	if available == uint64(C.ULLONG_MAX) {
-		available = r.AvailableSize()
-	}
-	logger = logger.WithValues(
-		"region", r.DeviceName(),
-	).WithValues(alignInfo...).WithValues(
-		"available", pmemlog.CapacityRef(int64(available)),
-	)
-	if size == 0 || size%align != 0 {
-		// Align up to least-common-multiple alignment boundary.
-		size = (size/align + 1) * align
-		logger.V(3).Info("Namespace size must be rounded up to alignment boundaries",
-			"old-size", pmemlog.CapacityRef(int64(opts.Size)),
-			"new-size", pmemlog.CapacityRef(int64(size)),
-		)
-	} else {
-		logger.V(3).Info("Creating namespace with requested size",
-			"size", pmemlog.CapacityRef(int64(size)),
-		)
-	}
-	if size > available {
-		return nil, fmt.Errorf("create namespace with size %v: %w", size, pmemerr.NotEnoughSpace)
+func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error) {
+	opts, size, logger, err := prepareNamespace(ctx, r, opts)
+	if err != nil {
+		return nil, err
 	}
 
 	/* setup_namespace */
@@ -258,10 +157,10 @@ func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts
 		switch opts.Mode {
 		case FsdaxMode:
 			logger.V(5).Info("Setting pfn")
-			err = ndns.SetPfnSeed(opts.Location, mib2)
+			err = ndns.SetPfnSeed(opts.Location, opts.Align)
 		case DaxMode:
 			logger.V(5).Info("Setting dax")
-			err = ndns.setDaxSeed(opts.Location, mib2)
+			err = ndns.setDaxSeed(opts.Location, opts.Align)
 		case SectorMode:
 			logger.V(5).Info("Setting btt")
 			err = ndns.setBttSeed(opts.SectorSize)
@@ -279,13 +178,7 @@ func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts
 		return nil, err
 	}
 
-	logger.V(3).Info("Namespace created",
-		"namespace", ns.DeviceName(),
-		"usable-size", pmemlog.CapacityRef(int64(ns.Size())),
-		"raw-size", pmemlog.CapacityRef(int64(ns.RawSize())),
-		"uuid", ns.UUID(),
-	)
-	return ns, nil
+	return finishNamespace(ctx, logger, r, ns, opts)
 }
 
 func (r *region) FsdaxAlignment() uint64 {
@@ -305,7 +198,7 @@ func (r *region) FsdaxAlignment() uint64 {
 	return mib2
 }
 
-func (r *region) DestroyNamespace(ns Namespace, force bool) error {
+func (r *region) DestroyNamespace(ctx gocontext.Context, ns Namespace, force bool) error {
 	var rc C.int
 	devname := ns.DeviceName()
 	if ns == nil {
@@ -353,6 +246,8 @@ func (r *region) String() string {
 		"size":                 r.Size(),
 		"available_size":       r.AvailableSize(),
 		"max_available_extent": r.MaxAvailableExtent(),
+		"numa_node":            r.NumaNode(),
+		"badblock_count":       CountBadBlocks(r.BadBlocks()),
 		"namespaces":           r.ActiveNamespaces(),
 		"mappings":             r.Mappings(),
 	})
@@ -360,46 +255,28 @@ func (r *region) String() string {
 
 func (r *region) namespaces(onlyActive bool) []Namespace {
 	var namespaces []Namespace
+	r.visitNamespaces(onlyActive, func(ns Namespace) bool {
+		namespaces = append(namespaces, ns)
+		return true
+	})
+	return namespaces
+}
 
+func (r *region) visitNamespaces(onlyActive bool, visit func(ns Namespace) bool) bool {
 	for ndns := C.ndctl_namespace_get_first(r); ndns != nil; ndns = C.ndctl_namespace_get_next(ndns) {
 		ns := (Namespace)(ndns)
 		// If asked for only active namespaces return it regardless of it size
 		// if not, return only valid namespaces, i.e, non-zero sized.
 		if onlyActive {
-			if ns.Active() {
-				namespaces = append(namespaces, ns)
+			if !ns.Active() {
+				continue
 			}
-		} else if ns.Size() > 0 {
-			namespaces = append(namespaces, ns)
+		} else if ns.Size() == 0 {
+			continue
+		}
+		if !visit(ns) {
+			return false
 		}
 	}
-
-	return namespaces
-}
-
-// CalculateAlignment considers region and namespace alignment.
-// It returns the final alignment value and key/value pairs for logging.
-func CalculateAlignment(r Region) (uint64, []interface{}) {
-	interleave := r.InterleaveWays()
-	fsdaxalign := r.FsdaxAlignment()
-	namespacealign := fsdaxalign * interleave
-	rawRegionAlign := r.GetAlign()
-	regionalign := rawRegionAlign
-	if regionalign <= 1 {
-		// This fallback turned out to be necessary when emulating PMEM in
-		// libvirt (OpenShift 4.8 beta): both PMEM-CSI and ndctl failed
-		// to create a namespace of size 100MiB, whereas 96MiB worked.
-		regionalign = 96 * 1024 * 1024
-	}
-	// Size has to be aligned both by namespace alignment times interleave_ways, and also by region alignment
-	align := math.LCM(namespacealign, regionalign)
-
-	return align, []interface{}{
-		"fsdaxalign", pmemlog.CapacityRef(int64(fsdaxalign)),
-		"interleave", interleave,
-		"namespace-align", pmemlog.CapacityRef(int64(namespacealign)),
-		"region-align", pmemlog.CapacityRef(int64(rawRegionAlign)),
-		"final-region-align", pmemlog.CapacityRef(int64(regionalign)),
-		"common-align", pmemlog.CapacityRef(int64(align)),
-	}
+	return true
 }
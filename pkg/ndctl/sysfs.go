@@ -0,0 +1,866 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+// The sysfs backend reads all attributes directly from the kernel
+// each time that they are needed. Objects therefore only store the
+// device name. Namespaces get created, destroyed, enabled and
+// disabled with the ndctl command, everything else is done by
+// writing sysfs attributes.
+//
+// Kernel documentation:
+// https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-bus-nd
+
+// sysfsRoot is where sysfs is mounted. Tests replace it.
+var sysfsRoot = "/sys"
+
+// ndctlCommand is the command used for modifications.
+const ndctlCommand = "ndctl"
+
+// errSysfsNotSupported is returned for low-level operations which
+// only libndctl implements.
+var errSysfsNotSupported = errors.New("not supported by the sysfs ndctl backend")
+
+// Values of the "nstype" attribute, see ND_DEVICE_* in
+// include/uapi/linux/ndctl.h.
+const (
+	ndDeviceNamespaceIO   = 4
+	ndDeviceNamespacePmem = 5
+	ndDeviceNamespaceBlk  = 6
+)
+
+func ndDevice(name string) string {
+	return filepath.Join(sysfsRoot, "bus", "nd", "devices", name)
+}
+
+func readAttr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readUint returns the decimal or hexadecimal ("0x...") value of an
+// attribute, 0 if it does not exist.
+func readUint(dir, name string) uint64 {
+	value, _ := strconv.ParseUint(readAttr(dir, name), 0, 64)
+	return value
+}
+
+func hasAttr(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func writeAttr(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0); err != nil {
+		return fmt.Errorf("write %q: %v", value, err)
+	}
+	return nil
+}
+
+// isBound returns true if a driver is bound to the device.
+func isBound(dir string) bool {
+	return hasAttr(dir, "driver")
+}
+
+var numberRe = regexp.MustCompile(`[0-9]+`)
+
+// deviceNumbers extracts the numbers from a device name,
+// for example [0 1] from "namespace0.1".
+func deviceNumbers(name string) []uint {
+	var numbers []uint
+	for _, match := range numberRe.FindAllString(name, -1) {
+		n, _ := strconv.ParseUint(match, 10, 32)
+		numbers = append(numbers, uint(n))
+	}
+	return numbers
+}
+
+// listDevices returns the names of all nd devices with the prefix,
+// sorted by their numbers.
+func listDevices(prefix string) []string {
+	entries, err := os.ReadDir(ndDevice(""))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := deviceNumbers(names[i]), deviceNumbers(names[j])
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	return names
+}
+
+// busOf returns the name of the bus which contains the device.
+func busOf(name string) string {
+	path, err := filepath.EvalSymlinks(ndDevice(name))
+	if err != nil {
+		return ""
+	}
+	for ; path != "/" && path != "."; path = filepath.Dir(path) {
+		if strings.HasPrefix(filepath.Base(path), "ndbus") {
+			return filepath.Base(path)
+		}
+	}
+	return ""
+}
+
+type sysfsContext struct{}
+
+var _ Context = &sysfsContext{}
+
+func newSysfsContext() (Context, error) {
+	return &sysfsContext{}, nil
+}
+
+func (ctx *sysfsContext) Free() {
+}
+
+func (ctx *sysfsContext) GetBuses() []Bus {
+	var buses []Bus
+	for _, name := range listDevices("ndbus") {
+		b := &sysfsBus{name: name}
+		if !IsBusSelected(b) {
+			continue
+		}
+		buses = append(buses, b)
+	}
+	return buses
+}
+
+type sysfsBus struct {
+	name string
+}
+
+var _ Bus = &sysfsBus{}
+
+func (b *sysfsBus) Provider() string {
+	return readAttr(ndDevice(b.name), "provider")
+}
+
+func (b *sysfsBus) DeviceName() string {
+	return b.name
+}
+
+func (b *sysfsBus) Dimms() []Dimm {
+	var dimms []Dimm
+	for _, name := range listDevices("nmem") {
+		if busOf(name) == b.name {
+			dimms = append(dimms, &sysfsDimm{name: name})
+		}
+	}
+	return dimms
+}
+
+func (b *sysfsBus) ActiveRegions() []Region {
+	return b.regions(true)
+}
+
+func (b *sysfsBus) AllRegions() []Region {
+	return b.regions(false)
+}
+
+func (b *sysfsBus) GetRegionByPhysicalAddress(address uint64) Region {
+	for _, r := range b.AllRegions() {
+		start := r.Resource()
+		if address >= start && address < start+r.Size() {
+			return r
+		}
+	}
+	return nil
+}
+
+// Strings formats all relevant attributes as JSON.
+func (b *sysfsBus) String() string {
+	return marshal(map[string]interface{}{
+		"provider": b.Provider(),
+		"type":     GetBusType(b),
+		"dev":      b.DeviceName(),
+		"regions":  b.ActiveRegions(),
+		"dimms":    b.Dimms(),
+	})
+}
+
+func (b *sysfsBus) regions(onlyActive bool) []Region {
+	var regions []Region
+	for _, name := range listDevices("region") {
+		if busOf(name) != b.name {
+			continue
+		}
+		r := &sysfsRegion{name: name}
+		if !onlyActive || r.Enabled() {
+			regions = append(regions, r)
+		}
+	}
+	return regions
+}
+
+type sysfsDimm struct {
+	name string
+}
+
+var _ Dimm = &sysfsDimm{}
+
+func (d *sysfsDimm) Enabled() bool {
+	return isBound(ndDevice(d.name))
+}
+
+func (d *sysfsDimm) Active() bool {
+	return readAttr(ndDevice(d.name), "state") == "active"
+}
+
+func (d *sysfsDimm) ID() string {
+	return readAttr(ndDevice(d.name), "nfit/id")
+}
+
+func (d *sysfsDimm) PhysicalID() int {
+	return int(readUint(ndDevice(d.name), "nfit/phys_id"))
+}
+
+func (d *sysfsDimm) DeviceName() string {
+	return d.name
+}
+
+func (d *sysfsDimm) Handle() int16 {
+	return int16(readUint(ndDevice(d.name), "nfit/handle"))
+}
+
+// Health gets the SMART data with the ndctl command because there
+// are no sysfs attributes for it.
+func (d *sysfsDimm) Health() (*DimmHealth, error) {
+	output, err := pmemexec.RunCommand(gocontext.TODO(), ndctlCommand, "list", "--dimm="+d.name, "--health")
+	if err != nil {
+		return nil, err
+	}
+	return parseDimmHealth(output)
+}
+
+// parseDimmHealth parses "ndctl list --dimm=<dimm> --health" output.
+func parseDimmHealth(output string) (*DimmHealth, error) {
+	output = strings.TrimSpace(output)
+	if strings.HasPrefix(output, "{") {
+		output = "[" + output + "]"
+	}
+	var dimms []struct {
+		Health *struct {
+			State                 string   `json:"health_state"`
+			MediaTemperature      *float64 `json:"temperature_celsius"`
+			ControllerTemperature *float64 `json:"controller_temperature_celsius"`
+			SparesPercentage      *uint    `json:"spares_percentage"`
+			ShutdownCount         *uint64  `json:"shutdown_count"`
+		} `json:"health"`
+	}
+	if err := json.Unmarshal([]byte(output), &dimms); err != nil {
+		return nil, fmt.Errorf("parse %q: %v", output, err)
+	}
+	if len(dimms) != 1 || dimms[0].Health == nil {
+		return nil, fmt.Errorf("no health information in %q", output)
+	}
+	h := dimms[0].Health
+	return &DimmHealth{
+		State:                 HealthState(h.State),
+		MediaTemperature:      h.MediaTemperature,
+		ControllerTemperature: h.ControllerTemperature,
+		SparesPercentage:      h.SparesPercentage,
+		ShutdownCount:         h.ShutdownCount,
+	}, nil
+}
+
+// Strings formats all relevant attributes as JSON.
+func (d *sysfsDimm) String() string {
+	return marshal(map[string]interface{}{
+		"id":      d.ID(),
+		"dev":     d.DeviceName(),
+		"handle":  d.Handle(),
+		"phys_id": d.PhysicalID(),
+		"enabled": d.Enabled(),
+	})
+}
+
+type sysfsMapping struct {
+	region   string
+	dimm     string
+	offset   uint64
+	length   uint64
+	position int
+}
+
+var _ Mapping = &sysfsMapping{}
+
+func (m *sysfsMapping) Offset() uint64 {
+	return m.offset
+}
+
+func (m *sysfsMapping) Length() uint64 {
+	return m.length
+}
+
+func (m *sysfsMapping) Position() int {
+	return m.position
+}
+
+func (m *sysfsMapping) Region() Region {
+	return &sysfsRegion{name: m.region}
+}
+
+func (m *sysfsMapping) Dimm() Dimm {
+	return &sysfsDimm{name: m.dimm}
+}
+
+// Strings formats all relevant attributes as JSON.
+func (m *sysfsMapping) String() string {
+	return marshal(map[string]interface{}{
+		"dimm":     m.dimm,
+		"offset":   m.offset,
+		"length":   m.length,
+		"position": m.position,
+	})
+}
+
+type sysfsRegion struct {
+	name string
+}
+
+var _ Region = &sysfsRegion{}
+
+func (r *sysfsRegion) dir() string {
+	return ndDevice(r.name)
+}
+
+func (r *sysfsRegion) ID() uint {
+	if numbers := deviceNumbers(r.name); len(numbers) > 0 {
+		return numbers[0]
+	}
+	return 0
+}
+
+func (r *sysfsRegion) DeviceName() string {
+	return r.name
+}
+
+func (r *sysfsRegion) Size() uint64 {
+	return readUint(r.dir(), "size")
+}
+
+func (r *sysfsRegion) AvailableSize() uint64 {
+	return readUint(r.dir(), "available_size")
+}
+
+func (r *sysfsRegion) MaxAvailableExtent() uint64 {
+	if !hasAttr(r.dir(), "max_available_extent") {
+		// Same as in libndctl.
+		return ^uint64(0)
+	}
+	return readUint(r.dir(), "max_available_extent")
+}
+
+func (r *sysfsRegion) Type() RegionType {
+	switch readUint(r.dir(), "nstype") {
+	case ndDeviceNamespacePmem, ndDeviceNamespaceIO:
+		return PmemRegion
+	case ndDeviceNamespaceBlk:
+		return BlockRegion
+	}
+	return UnknownRegion
+}
+
+func (r *sysfsRegion) TypeName() string {
+	switch r.Type() {
+	case PmemRegion:
+		return "pmem"
+	case BlockRegion:
+		return "blk"
+	}
+	return "unknown"
+}
+
+func (r *sysfsRegion) Enabled() bool {
+	return isBound(r.dir())
+}
+
+func (r *sysfsRegion) Readonly() bool {
+	return readAttr(r.dir(), "read_only") == "1"
+}
+
+func (r *sysfsRegion) InterleaveWays() uint64 {
+	return readUint(r.dir(), "mappings")
+}
+
+func (r *sysfsRegion) NumaNode() int {
+	node, err := strconv.Atoi(readAttr(r.dir(), "numa_node"))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+func (r *sysfsRegion) ActiveNamespaces() []Namespace {
+	return r.namespaces(true)
+}
+
+func (r *sysfsRegion) AllNamespaces() []Namespace {
+	return r.namespaces(false)
+}
+
+func (r *sysfsRegion) Bus() Bus {
+	return &sysfsBus{name: busOf(r.name)}
+}
+
+func (r *sysfsRegion) Mappings() []Mapping {
+	var mappings []Mapping
+	for i := uint64(0); i < r.InterleaveWays(); i++ {
+		// <dimm>,<offset>,<length>,<position>
+		parts := strings.Split(readAttr(r.dir(), fmt.Sprintf("mapping%d", i)), ",")
+		if len(parts) < 3 {
+			continue
+		}
+		m := &sysfsMapping{region: r.name, dimm: parts[0], position: -1}
+		m.offset, _ = strconv.ParseUint(parts[1], 0, 64)
+		m.length, _ = strconv.ParseUint(parts[2], 0, 64)
+		if len(parts) > 3 {
+			m.position, _ = strconv.Atoi(parts[3])
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings
+}
+
+func (r *sysfsRegion) SeedNamespace() Namespace {
+	seed := readAttr(r.dir(), "namespace_seed")
+	if seed == "" {
+		return nil
+	}
+	return &sysfsNamespace{name: seed}
+}
+
+func (r *sysfsRegion) FsdaxAlignment() uint64 {
+	// See region.FsdaxAlignment.
+	if pfn := readAttr(r.dir(), "pfn_seed"); pfn != "" {
+		if align := readUint(ndDevice(pfn), "align"); align != 0 {
+			return align
+		}
+	}
+	return mib2
+}
+
+func (r *sysfsRegion) GetAlign() uint64 {
+	return readUint(r.dir(), "align")
+}
+
+func (r *sysfsRegion) Resource() uint64 {
+	return readUint(r.dir(), "resource")
+}
+
+func (r *sysfsRegion) BadBlocks() []BadBlock {
+	return parseBadBlocks(readAttr(r.dir(), "badblocks"))
+}
+
+func (r *sysfsRegion) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error) {
+	opts, size, logger, err := prepareNamespace(ctx, r, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"create-namespace",
+		"--region=" + r.name,
+		fmt.Sprintf("--size=%d", size),
+	}
+	switch opts.Mode {
+	case FsdaxMode:
+		args = append(args, "--mode=fsdax", "--map="+string(opts.Location), fmt.Sprintf("--align=%d", opts.Align))
+	case DaxMode:
+		args = append(args, "--mode=devdax", "--map="+string(opts.Location), fmt.Sprintf("--align=%d", opts.Align))
+	case SectorMode:
+		args = append(args, "--mode=sector", fmt.Sprintf("--sector-size=%d", opts.SectorSize))
+	default:
+		args = append(args, "--mode=raw")
+	}
+	if opts.Name != "" {
+		args = append(args, "--name="+opts.Name)
+	}
+	output, err := pmemexec.RunCommand(ctx, ndctlCommand, args...)
+	if err != nil {
+		return nil, err
+	}
+	var created struct {
+		Dev string `json:"dev"`
+	}
+	if err := json.Unmarshal([]byte(output), &created); err != nil || created.Dev == "" {
+		return nil, fmt.Errorf("unexpected output of %s create-namespace: %q", ndctlCommand, output)
+	}
+
+	return finishNamespace(ctx, logger, r, &sysfsNamespace{name: created.Dev}, opts)
+}
+
+func (r *sysfsRegion) DestroyNamespace(ctx gocontext.Context, ns Namespace, force bool) error {
+	if ns == nil {
+		return fmt.Errorf("null namespace")
+	}
+	devname := ns.DeviceName()
+	if r.Readonly() {
+		return fmt.Errorf("namespace %s is in readonly region", devname)
+	}
+	if ns.Active() && !force {
+		return fmt.Errorf("namespace is active, use force deletion")
+	}
+	if _, err := pmemexec.RunCommand(ctx, ndctlCommand, "destroy-namespace", "--force", "--region="+r.name, devname); err != nil {
+		return fmt.Errorf("failed to destroy namespace: %v", err)
+	}
+	return nil
+}
+
+// Strings formats all relevant attributes as JSON.
+func (r *sysfsRegion) String() string {
+	return marshal(map[string]interface{}{
+		"type":                 r.Type(),
+		"dev":                  r.DeviceName(),
+		"size":                 r.Size(),
+		"available_size":       r.AvailableSize(),
+		"max_available_extent": r.MaxAvailableExtent(),
+		"numa_node":            r.NumaNode(),
+		"badblock_count":       CountBadBlocks(r.BadBlocks()),
+		"namespaces":           r.ActiveNamespaces(),
+		"mappings":             r.Mappings(),
+	})
+}
+
+func (r *sysfsRegion) namespaces(onlyActive bool) []Namespace {
+	var namespaces []Namespace
+	r.visitNamespaces(onlyActive, func(ns Namespace) bool {
+		namespaces = append(namespaces, ns)
+		return true
+	})
+	return namespaces
+}
+
+func (r *sysfsRegion) visitNamespaces(onlyActive bool, visit func(ns Namespace) bool) bool {
+	for _, name := range listDevices(fmt.Sprintf("namespace%d.", r.ID())) {
+		ns := &sysfsNamespace{name: name}
+		// Same filtering as in region.namespaces.
+		if onlyActive {
+			if !ns.Active() {
+				continue
+			}
+		} else if ns.Size() == 0 {
+			continue
+		}
+		if !visit(ns) {
+			return false
+		}
+	}
+	return true
+}
+
+type sysfsNamespace struct {
+	name string
+}
+
+var _ Namespace = &sysfsNamespace{}
+
+func (ns *sysfsNamespace) dir() string {
+	return ndDevice(ns.name)
+}
+
+// holder returns the btt, pfn or dax device which claimed the
+// namespace, the empty string if none.
+func (ns *sysfsNamespace) holder() string {
+	return readAttr(ns.dir(), "holder")
+}
+
+func (ns *sysfsNamespace) ID() uint {
+	if numbers := deviceNumbers(ns.name); len(numbers) > 1 {
+		return numbers[1]
+	}
+	return 0
+}
+
+func (ns *sysfsNamespace) Name() string {
+	return readAttr(ns.dir(), "alt_name")
+}
+
+func (ns *sysfsNamespace) DeviceName() string {
+	return ns.name
+}
+
+func (ns *sysfsNamespace) BlockDeviceName() string {
+	if ns.Mode() == DaxMode {
+		/* Chardevice */
+		return ""
+	}
+	dir := ns.dir()
+	if holder := ns.holder(); holder != "" {
+		dir = ndDevice(holder)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "block"))
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return entries[0].Name()
+}
+
+func (ns *sysfsNamespace) Size() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode:
+		if holder := ns.holder(); holder != "" {
+			return readUint(ndDevice(holder), "size")
+		}
+		return readUint(ns.dir(), "size")
+	case DaxMode, SectorMode:
+		if holder := ns.holder(); holder != "" {
+			return readUint(ndDevice(holder), "size")
+		}
+		return 0
+	case RawMode:
+		return readUint(ns.dir(), "size")
+	}
+	return 0
+}
+
+func (ns *sysfsNamespace) RawSize() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode:
+		return readUint(ns.dir(), "size")
+	default:
+		return ns.Size()
+	}
+}
+
+func (ns *sysfsNamespace) Mode() NamespaceMode {
+	// Values from mode_show() in drivers/nvdimm/namespace_devs.c.
+	switch readAttr(ns.dir(), "mode") {
+	case "dax":
+		return DaxMode
+	case "memory":
+		return FsdaxMode
+	case "raw":
+		return RawMode
+	case "safe":
+		return SectorMode
+	}
+	return UnknownMode
+}
+
+func (ns *sysfsNamespace) Type() NamespaceType {
+	switch readUint(ns.dir(), "nstype") {
+	case ndDeviceNamespacePmem:
+		return PmemNamespace
+	case ndDeviceNamespaceBlk:
+		return BlockNamespace
+	case ndDeviceNamespaceIO:
+		return IoNamespace
+	}
+	return UnknownType
+}
+
+func (ns *sysfsNamespace) Enabled() bool {
+	return isBound(ns.dir())
+}
+
+func (ns *sysfsNamespace) Active() bool {
+	if ns.Enabled() {
+		return true
+	}
+	holder := ns.holder()
+	return holder != "" && isBound(ndDevice(holder))
+}
+
+func (ns *sysfsNamespace) UUID() uuid.UUID {
+	dir := ns.dir()
+	if holder := ns.holder(); holder != "" {
+		dir = ndDevice(holder)
+	} else if ns.Type() == IoNamespace {
+		return uuid.UUID{}
+	}
+	uid, err := uuid.Parse(readAttr(dir, "uuid"))
+	if err != nil {
+		return uuid.UUID{}
+	}
+	return uid
+}
+
+func (ns *sysfsNamespace) Location() MapLocation {
+	switch ns.Mode() {
+	case FsdaxMode, DaxMode:
+		holder := ns.holder()
+		if holder == "" {
+			if ns.Mode() == FsdaxMode {
+				return MemoryMap
+			}
+			return NoneMap
+		}
+		switch readAttr(ndDevice(holder), "mode") {
+		case "ram":
+			return MemoryMap
+		case "pmem":
+			return DeviceMap
+		}
+	}
+	return NoneMap
+}
+
+func (ns *sysfsNamespace) Region() Region {
+	if numbers := deviceNumbers(ns.name); len(numbers) > 0 {
+		return &sysfsRegion{name: fmt.Sprintf("region%d", numbers[0])}
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) Resource() uint64 {
+	return readUint(ns.dir(), "resource")
+}
+
+func (ns *sysfsNamespace) Alignment() uint64 {
+	switch ns.Mode() {
+	case FsdaxMode, DaxMode:
+		if holder := ns.holder(); holder != "" {
+			return readUint(ndDevice(holder), "align")
+		}
+	}
+	return 0
+}
+
+func (ns *sysfsNamespace) SetAltName(name string) error {
+	if err := writeAttr(ns.dir(), "alt_name", name); err != nil {
+		return fmt.Errorf("Failed to set namespace name: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetSize(size uint64) error {
+	if err := writeAttr(ns.dir(), "size", strconv.FormatUint(size, 10)); err != nil {
+		return fmt.Errorf("Failed to set namespace size: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetUUID(uid uuid.UUID) error {
+	if err := writeAttr(ns.dir(), "uuid", uid.String()); err != nil {
+		return fmt.Errorf("Failed to set namespace uid: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetSectorSize(sectorSize uint64) error {
+	if sectorSize == 0 {
+		sectorSize = 512
+	}
+	if err := writeAttr(ns.dir(), "sector_size", strconv.FormatUint(sectorSize, 10)); err != nil {
+		return fmt.Errorf("Failed to set namespace sector size: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetEnforceMode(mode NamespaceMode) error {
+	return errSysfsNotSupported
+}
+
+func (ns *sysfsNamespace) Enable() error {
+	if _, err := pmemexec.RunCommand(gocontext.TODO(), ndctlCommand, "enable-namespace", ns.name); err != nil {
+		return fmt.Errorf("failed to enable namespace: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) Disable() error {
+	if _, err := pmemexec.RunCommand(gocontext.TODO(), ndctlCommand, "disable-namespace", ns.name); err != nil {
+		return fmt.Errorf("failed to disable namespace: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetRawMode(raw bool) error {
+	value := "0"
+	if raw {
+		value = "1"
+	}
+	if err := writeAttr(ns.dir(), "force_raw", value); err != nil {
+		return fmt.Errorf("failed to set raw mode: %v", err)
+	}
+	return nil
+}
+
+func (ns *sysfsNamespace) SetPfnSeed(loc MapLocation, align uint64) error {
+	return errSysfsNotSupported
+}
+
+func (ns *sysfsNamespace) BadBlocks() []BadBlock {
+	dev := ns.BlockDeviceName()
+	if dev == "" {
+		return nil
+	}
+	return parseBadBlocks(readAttr(filepath.Join(sysfsRoot, "block", dev), "badblocks"))
+}
+
+// String formats all relevant attributes as JSON.
+func (ns *sysfsNamespace) String() string {
+	props := map[string]interface{}{
+		"id":      ns.ID(),
+		"dev":     ns.DeviceName(),
+		"mode":    ns.Mode(),
+		"size":    ns.Size(),
+		"enabled": ns.Enabled(),
+		"uuid":    ns.UUID(),
+		"name":    ns.Name(),
+	}
+
+	if count := CountBadBlocks(ns.BadBlocks()); count > 0 {
+		props["badblock_count"] = count
+	}
+
+	if mode := ns.Mode(); mode != DaxMode {
+		props["blockdev"] = ns.BlockDeviceName()
+	}
+
+	if location := ns.Location(); location != "none" {
+		props["map"] = location
+	}
+
+	return marshal(props)
+}
+
+// parseBadBlocks parses the content of a "badblocks" attribute, one
+// "<offset> <length>" pair per line.
+func parseBadBlocks(content string) []BadBlock {
+	var badBlocks []BadBlock
+	for _, line := range strings.Split(content, "\n") {
+		var bb BadBlock
+		if _, err := fmt.Sscan(line, &bb.Offset, &bb.Length); err == nil {
+			badBlocks = append(badBlocks, bb)
+		}
+	}
+	return badBlocks
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package ndctl
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+// fakeSysfs creates a sysfs tree with one bus, one dimm and one
+// region with an fsdax namespace and an unused seed namespace.
+func fakeSysfs(t *testing.T) {
+	root := t.TempDir()
+	oldRoot, oldEmulated := sysfsRoot, emulatedMachine
+	sysfsRoot = root
+	emulatedMachine = sync.OnceValue(readEmulatedMachine)
+	t.Cleanup(func() {
+		sysfsRoot, emulatedMachine = oldRoot, oldEmulated
+	})
+
+	platform := filepath.Join(root, "devices", "platform", "ACPI0012:00")
+	files := map[string]string{
+		"ndbus0/provider":                      "ACPI.NFIT",
+		"ndbus0/nmem0/state":                   "active",
+		"ndbus0/nmem0/nfit/id":                 "8089-a2-1837-00000bb3",
+		"ndbus0/nmem0/nfit/handle":             "0x1",
+		"ndbus0/nmem0/nfit/phys_id":            "0x1c",
+		"ndbus0/region0/size":                  "17179869184",
+		"ndbus0/region0/available_size":        "8589934592",
+		"ndbus0/region0/max_available_extent":  "4294967296",
+		"ndbus0/region0/nstype":                "5",
+		"ndbus0/region0/mappings":              "1",
+		"ndbus0/region0/mapping0":              "nmem0,0,17179869184,0",
+		"ndbus0/region0/read_only":             "0",
+		"ndbus0/region0/numa_node":             "1",
+		"ndbus0/region0/align":                 "16777216",
+		"ndbus0/region0/badblocks":             "8 2\n1024 1\n",
+		"ndbus0/region0/resource":              "0x240000000",
+		"ndbus0/region0/namespace_seed":        "namespace0.1",
+		"ndbus0/region0/pfn_seed":              "pfn0.0",
+		"ndbus0/region0/pfn0.0/align":          "2097152",
+		"ndbus0/region0/namespace0.0/alt_name": "pvc-1",
+		"ndbus0/region0/namespace0.0/size":     "4294967296",
+		"ndbus0/region0/namespace0.0/uuid":     "1a8e9a4e-3a59-4d95-8c9e-2b1a0d6f4e21",
+		"ndbus0/region0/namespace0.0/holder":   "pfn0.1",
+		"ndbus0/region0/namespace0.0/mode":     "memory",
+		"ndbus0/region0/namespace0.0/nstype":   "5",
+		"ndbus0/region0/namespace0.0/resource": "0x240000000",
+		"ndbus0/region0/pfn0.1/size":           "4227858432",
+		"ndbus0/region0/pfn0.1/mode":           "pmem",
+		"ndbus0/region0/pfn0.1/align":          "1073741824",
+		"ndbus0/region0/pfn0.1/uuid":           "6e4c5d2a-8f1b-4c3e-9a7d-5b2e1f0c3d4a",
+		"ndbus0/region0/namespace0.1/size":     "0",
+		"ndbus0/region0/namespace0.1/mode":     "raw",
+		"ndbus0/region0/namespace0.1/nstype":   "5",
+	}
+	for path, content := range files {
+		writeFile(t, filepath.Join(platform, path), content)
+	}
+	// Namespace0.0 is claimed by pfn0.1, so only the latter is bound.
+	for _, path := range []string{
+		"ndbus0/nmem0/driver",
+		"ndbus0/region0/driver",
+		"ndbus0/region0/pfn0.1/driver",
+		"ndbus0/region0/pfn0.1/block/pmem0",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(platform, path), 0755))
+	}
+	writeFile(t, filepath.Join(root, "block", "pmem0", "badblocks"), "16 4\n")
+
+	devices := filepath.Join(root, "bus", "nd", "devices")
+	require.NoError(t, os.MkdirAll(devices, 0755))
+	for name, path := range map[string]string{
+		"ndbus0":       "ndbus0",
+		"nmem0":        "ndbus0/nmem0",
+		"region0":      "ndbus0/region0",
+		"namespace0.0": "ndbus0/region0/namespace0.0",
+		"namespace0.1": "ndbus0/region0/namespace0.1",
+		"pfn0.0":       "ndbus0/region0/pfn0.0",
+		"pfn0.1":       "ndbus0/region0/pfn0.1",
+	} {
+		require.NoError(t, os.Symlink(filepath.Join(platform, path), filepath.Join(devices, name)))
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content+"\n"), 0644))
+}
+
+func TestSysfs(t *testing.T) {
+	fakeSysfs(t)
+	ndctx, err := newSysfsContext()
+	require.NoError(t, err, "new context")
+	defer ndctx.Free()
+
+	buses := ndctx.GetBuses()
+	require.Len(t, buses, 1, "buses")
+	bus := buses[0]
+	assert.Equal(t, "ndbus0", bus.DeviceName(), "bus name")
+	assert.Equal(t, "ACPI.NFIT", bus.Provider(), "provider")
+	assert.Equal(t, BusTypeNVDIMM, GetBusType(bus), "bus type")
+
+	dimms := bus.Dimms()
+	require.Len(t, dimms, 1, "dimms")
+	dimm := dimms[0]
+	assert.Equal(t, "nmem0", dimm.DeviceName(), "dimm name")
+	assert.True(t, dimm.Enabled(), "dimm enabled")
+	assert.True(t, dimm.Active(), "dimm active")
+	assert.Equal(t, "8089-a2-1837-00000bb3", dimm.ID(), "dimm ID")
+	assert.Equal(t, 0x1c, dimm.PhysicalID(), "dimm physical ID")
+	assert.Equal(t, int16(1), dimm.Handle(), "dimm handle")
+
+	regions := bus.ActiveRegions()
+	require.Len(t, regions, 1, "regions")
+	r := regions[0]
+	assert.Equal(t, uint(0), r.ID(), "region ID")
+	assert.Equal(t, "region0", r.DeviceName(), "region name")
+	assert.Equal(t, uint64(16*1024*1024*1024), r.Size(), "region size")
+	assert.Equal(t, uint64(8*1024*1024*1024), r.AvailableSize(), "available size")
+	assert.Equal(t, uint64(4*1024*1024*1024), r.MaxAvailableExtent(), "max available extent")
+	assert.Equal(t, PmemRegion, r.Type(), "region type")
+	assert.True(t, r.Enabled(), "region enabled")
+	assert.False(t, r.Readonly(), "region read-only")
+	assert.Equal(t, uint64(1), r.InterleaveWays(), "interleave ways")
+	assert.Equal(t, 1, r.NumaNode(), "NUMA node")
+	assert.Equal(t, uint64(16*1024*1024), r.GetAlign(), "region alignment")
+	assert.Equal(t, mib2, r.FsdaxAlignment(), "fsdax alignment")
+	assert.Equal(t, []BadBlock{{Offset: 8, Length: 2}, {Offset: 1024, Length: 1}}, r.BadBlocks(), "region bad blocks")
+	assert.Equal(t, "ndbus0", r.Bus().DeviceName(), "region bus")
+	assert.Equal(t, "namespace0.1", r.SeedNamespace().DeviceName(), "seed namespace")
+	assert.Equal(t, "region0", bus.GetRegionByPhysicalAddress(0x240001000).DeviceName(), "region by address")
+	assert.Nil(t, bus.GetRegionByPhysicalAddress(0x1000), "no region at address")
+
+	mappings := r.Mappings()
+	require.Len(t, mappings, 1, "mappings")
+	assert.Equal(t, "nmem0", mappings[0].Dimm().DeviceName(), "mapping dimm")
+	assert.Equal(t, uint64(0), mappings[0].Offset(), "mapping offset")
+	assert.Equal(t, uint64(16*1024*1024*1024), mappings[0].Length(), "mapping length")
+	assert.Equal(t, 0, mappings[0].Position(), "mapping position")
+
+	assert.Len(t, r.AllNamespaces(), 1, "namespaces with non-zero size")
+	namespaces := r.ActiveNamespaces()
+	require.Len(t, namespaces, 1, "active namespaces")
+	ns := namespaces[0]
+	assert.Equal(t, uint(0), ns.ID(), "namespace ID")
+	assert.Equal(t, "pvc-1", ns.Name(), "namespace name")
+	assert.Equal(t, "namespace0.0", ns.DeviceName(), "namespace device")
+	assert.Equal(t, "pmem0", ns.BlockDeviceName(), "block device")
+	assert.Equal(t, FsdaxMode, ns.Mode(), "namespace mode")
+	assert.Equal(t, PmemNamespace, ns.Type(), "namespace type")
+	assert.Equal(t, DeviceMap, ns.Location(), "namespace location")
+	assert.Equal(t, uint64(4227858432), ns.Size(), "namespace size")
+	assert.Equal(t, uint64(4*1024*1024*1024), ns.RawSize(), "namespace raw size")
+	assert.Equal(t, uint64(0x240000000), ns.Resource(), "namespace resource")
+	assert.Equal(t, uint64(1024*1024*1024), ns.Alignment(), "namespace alignment")
+	assert.Equal(t, uuid.MustParse("6e4c5d2a-8f1b-4c3e-9a7d-5b2e1f0c3d4a"), ns.UUID(), "namespace UUID")
+	assert.False(t, ns.Enabled(), "namespace itself is not bound")
+	assert.True(t, ns.Active(), "namespace active through pfn")
+	assert.Equal(t, "region0", ns.Region().DeviceName(), "namespace region")
+	assert.Equal(t, []BadBlock{{Offset: 16, Length: 4}}, ns.BadBlocks(), "namespace bad blocks")
+
+	found, err := GetNamespaceByName(ndctx, "pvc-1")
+	require.NoError(t, err, "get namespace by name")
+	assert.Equal(t, "namespace0.0", found.DeviceName(), "namespace by name")
+}
+
+func TestSysfsEmpty(t *testing.T) {
+	oldRoot := sysfsRoot
+	sysfsRoot = t.TempDir()
+	defer func() {
+		sysfsRoot = oldRoot
+	}()
+	ndctx, err := newSysfsContext()
+	require.NoError(t, err, "new context")
+	assert.Empty(t, ndctx.GetBuses(), "buses")
+}
+
+func TestBackend(t *testing.T) {
+	var backend Backend
+	assert.NoError(t, backend.Set("sysfs"), "sysfs")
+	assert.Equal(t, BackendSysfs, backend, "sysfs")
+	assert.NoError(t, backend.Set("libndctl"), "libndctl")
+	assert.Equal(t, "libndctl", backend.String(), "libndctl")
+	assert.Error(t, backend.Set("foo"), "unknown backend")
+}
+
+func TestDeviceNumbers(t *testing.T) {
+	assert.Equal(t, []uint{12, 3}, deviceNumbers("namespace12.3"))
+	assert.Equal(t, []uint{0}, deviceNumbers("region0"))
+	assert.Empty(t, deviceNumbers("ndctl"))
+}
+
+func TestParseDimmHealth(t *testing.T) {
+	health, err := parseDimmHealth(`{
+  "dev":"nmem0",
+  "id":"8089-a2-1837-00000bb3",
+  "handle":1,
+  "phys_id":28,
+  "health":{
+    "health_state":"non-critical",
+    "temperature_celsius":32.5,
+    "controller_temperature_celsius":40.0,
+    "spares_percentage":95,
+    "alarm_temperature":false,
+    "alarm_controller_temperature":false,
+    "alarm_spares":false,
+    "alarm_enabled_media_temperature":false,
+    "alarm_enabled_ctrl_temperature":false,
+    "alarm_enabled_spares":false,
+    "shutdown_state":"clean",
+    "shutdown_count":3
+  }
+}`)
+	require.NoError(t, err, "parse health")
+	mediaTemperature, controllerTemperature := 32.5, 40.0
+	spares, shutdowns := uint(95), uint64(3)
+	assert.Equal(t, &DimmHealth{
+		State:                 HealthNonCritical,
+		MediaTemperature:      &mediaTemperature,
+		ControllerTemperature: &controllerTemperature,
+		SparesPercentage:      &spares,
+		ShutdownCount:         &shutdowns,
+	}, health)
+
+	health, err = parseDimmHealth(`[{"dev":"nmem1","health":{"health_state":"ok"}}]`)
+	require.NoError(t, err, "parse partial health")
+	assert.Equal(t, &DimmHealth{State: HealthOK}, health)
+
+	_, err = parseDimmHealth(`{"dev":"nmem0"}`)
+	assert.Error(t, err, "without health")
+}
+
+// plainContext hides the namespace enumeration of the regions, like
+// a Context implementation outside of this package.
+type plainContext struct {
+	Context
+}
+
+func (ctx plainContext) GetBuses() []Bus {
+	var buses []Bus
+	for _, bus := range ctx.Context.GetBuses() {
+		buses = append(buses, plainBus{bus})
+	}
+	return buses
+}
+
+type plainBus struct {
+	Bus
+}
+
+func (b plainBus) AllRegions() []Region {
+	var regions []Region
+	for _, r := range b.Bus.AllRegions() {
+		regions = append(regions, plainRegion{r})
+	}
+	return regions
+}
+
+type plainRegion struct {
+	Region
+}
+
+func TestVisitNamespaces(t *testing.T) {
+	fakeSysfs(t)
+	ndctx, err := newSysfsContext()
+	require.NoError(t, err, "new context")
+	defer ndctx.Free()
+
+	for name, ndctx := range map[string]Context{
+		"sysfs": ndctx,
+		"plain": plainContext{ndctx},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var visited []string
+			VisitNamespaces(ndctx, func(ns Namespace) bool {
+				visited = append(visited, ns.DeviceName())
+				return true
+			})
+			assert.Equal(t, []string{"namespace0.0"}, visited, "namespaces with non-zero size")
+
+			calls := 0
+			VisitNamespaces(ndctx, func(ns Namespace) bool {
+				calls++
+				return false
+			})
+			assert.Equal(t, 1, calls, "stopped after first namespace")
+
+			_, err := GetNamespaceByName(ndctx, "pvc-2")
+			assert.ErrorIs(t, err, pmemerr.DeviceNotFound, "unknown namespace")
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcommon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// mutexProfileFraction and blockProfileRate enable the
+	// mutex and block profiles while the debug server runs.
+	// Both are sampled to keep the overhead low.
+	mutexProfileFraction = 10
+	blockProfileRate     = 100000 // one event per 100µs spent blocking
+)
+
+// DebugHandler serves the usual /debug/pprof endpoints plus
+// /debug/stacks, which returns the stacks of all goroutines as plain
+// text.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/stacks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(AllStacks())
+	})
+	return mux
+}
+
+// StartDebugServer serves DebugHandler on the listen address until
+// the context is done. While it runs, the mutex and block profiles
+// are enabled and SIGUSR1 logs the stacks of all goroutines, which
+// also works when the server cannot be reached. Returns the address
+// that can be used in Dial("tcp") to reach the server.
+func StartDebugServer(ctx context.Context, listen string) (string, error) {
+	logger := klog.FromContext(ctx).WithName("debug server").WithValues("listen", listen)
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return "", fmt.Errorf("listen on TCP address %q: %v", listen, err)
+	}
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+	runtime.SetBlockProfileRate(blockProfileRate)
+	server := http.Server{
+		Handler: DebugHandler(),
+	}
+	go func() {
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			logger.Error(err, "Failed")
+		}
+	}()
+
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+	go func() {
+		defer signal.Stop(sigusr1)
+		for {
+			select {
+			case <-ctx.Done():
+				server.Close()
+				runtime.SetMutexProfileFraction(0)
+				runtime.SetBlockProfileRate(0)
+				return
+			case <-sigusr1:
+				// Printed directly because the output is
+				// too large for a single log message.
+				fmt.Fprintf(os.Stderr, "=== goroutine stacks on SIGUSR1 ===\n%s=== end of goroutine stacks ===\n", AllStacks())
+			}
+		}
+	}()
+
+	logger.Info("Started", "addr", listener.Addr())
+	return listener.Addr().String(), nil
+}
+
+// AllStacks returns the stacks of all goroutines, growing the buffer
+// until it is large enough.
+func AllStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcommon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := StartDebugServer(ctx, "127.0.0.1:")
+	require.NoError(t, err, "start server")
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", addr, path))
+		require.NoError(t, err, "GET %s", path)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "read %s", path)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("/debug/stacks")
+	assert.Equal(t, http.StatusOK, code, "stacks status")
+	assert.Contains(t, body, "TestDebugServer", "stacks include the test goroutine")
+
+	code, body = get("/debug/pprof/")
+	assert.Equal(t, http.StatusOK, code, "pprof index status")
+	assert.Contains(t, body, "goroutine", "pprof index")
+
+	code, _ = get("/debug/pprof/mutex?debug=1")
+	assert.Equal(t, http.StatusOK, code, "mutex profile status")
+
+	code, _ = get("/metrics")
+	assert.Equal(t, http.StatusNotFound, code, "unknown path")
+}
@@ -7,19 +7,21 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcommon
 
 import (
-	"fmt"
 	"io/ioutil"
 	"os"
+
+	"k8s.io/klog/v2"
 )
 
 func ExitError(msg string, e error) {
-	str := msg + ": " + e.Error()
-	fmt.Println(str)
+	logger := klog.Background()
+	logger.Error(e, msg)
 	terminationMsgPath := os.Getenv("TERMINATION_LOG_PATH")
 	if terminationMsgPath != "" {
+		str := msg + ": " + e.Error()
 		err := ioutil.WriteFile(terminationMsgPath, []byte(str), os.FileMode(0644))
 		if err != nil {
-			fmt.Println("Can not create termination log file:" + terminationMsgPath)
+			logger.Error(err, "Cannot create termination log file", "path", terminationMsgPath)
 		}
 	}
 }
@@ -8,18 +8,25 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcommon
 
 import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 )
 
+// ServiceAccountTokensKey is the key in the volume context of
+// NodePublishVolume under which kubelet passes service account
+// tokens. It is the same as parameters.ServiceAccountTokens, which
+// is not imported to keep this package independent of the driver.
+const ServiceAccountTokensKey = "csi.storage.k8s.io/serviceAccount.tokens"
+
 // LogGRPCServer logs the server-side call information via klog.
 func LogGRPCServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	logger := klog.FromContext(ctx)
 	values := []interface{}{"full-method", info.FullMethod}
 	if logger.V(5).Enabled() {
-		values = append(values, "request", protosanitizer.StripSecrets(req))
+		values = append(values, "request", protosanitizer.StripSecrets(redactTokens(req)))
 	}
 	logger.V(3).Info("Processing gRPC call", values...)
 	resp, err := handler(ctx, req)
@@ -47,3 +54,25 @@ func LogGRPCClient(ctx context.Context, method string, req, reply interface{}, c
 	}
 	return err
 }
+
+// redactTokens removes service account tokens from the volume context
+// of NodePublishVolume. The CSI spec does not mark the volume context
+// as secret, so protosanitizer keeps them.
+func redactTokens(req interface{}) interface{} {
+	publish, ok := req.(*csi.NodePublishVolumeRequest)
+	if !ok {
+		return req
+	}
+	if _, ok := publish.GetVolumeContext()[ServiceAccountTokensKey]; !ok {
+		return req
+	}
+	redacted := *publish
+	redacted.VolumeContext = make(map[string]string, len(publish.VolumeContext))
+	for key, value := range publish.VolumeContext {
+		if key == ServiceAccountTokensKey {
+			value = "<redacted>"
+		}
+		redacted.VolumeContext[key] = value
+	}
+	return &redacted
+}
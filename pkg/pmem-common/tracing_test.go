@@ -0,0 +1,34 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcommon
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestRedactTokens(t *testing.T) {
+	assert.Equal(t, parameters.ServiceAccountTokens, ServiceAccountTokensKey, "volume context key")
+
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId: "pvc-1",
+		VolumeContext: map[string]string{
+			"size":                  "1Gi",
+			ServiceAccountTokensKey: `{"pmem-csi":{"token":"secret"}}`,
+		},
+	}
+	redacted := redactTokens(req).(*csi.NodePublishVolumeRequest)
+	assert.Equal(t, map[string]string{"size": "1Gi", ServiceAccountTokensKey: "<redacted>"}, redacted.VolumeContext, "redacted")
+	assert.Equal(t, `{"pmem-csi":{"token":"secret"}}`, req.VolumeContext[ServiceAccountTokensKey], "original unchanged")
+
+	other := &csi.NodeUnpublishVolumeRequest{VolumeId: "pvc-1"}
+	assert.Same(t, other, redactTokens(other), "other request")
+}
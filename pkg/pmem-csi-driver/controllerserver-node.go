@@ -14,29 +14,49 @@ import (
 	"math"
 	"strconv"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
-	"k8s.io/utils/keymutex"
 )
 
 type nodeVolume struct {
 	ID     string            `json:"id"`
 	Size   int64             `json:"size"`
 	Params map[string]string `json:"parameters"`
+	// UUID of the device, empty if unknown. It detects when a
+	// device with the same name gets recreated.
+	UUID string `json:"uuid,omitempty"`
+	// Created is the time when the volume was created as seconds
+	// since the Unix epoch, zero if unknown.
+	Created int64 `json:"created,omitempty"`
+}
+
+// checkDevice returns an error wrapping pmemerr.DeviceChanged if the
+// device is not the one that was created for the volume.
+func (vol *nodeVolume) checkDevice(device *pmdmanager.PmemDeviceInfo) error {
+	if vol != nil && vol.UUID != "" && device.UUID != "" && vol.UUID != device.UUID {
+		return fmt.Errorf("volume %s: expected device with UUID %s, %s has UUID %s: %w",
+			vol.ID, vol.UUID, device.Path, device.UUID, pmemerr.DeviceChanged)
+	}
+	return nil
 }
 
 type nodeControllerServer struct {
@@ -44,17 +64,43 @@ type nodeControllerServer struct {
 	nodeID      string
 	dm          pmdmanager.PmemDeviceManager
 	sm          pmemstate.StateManager
+	reserved    pmdmanager.Reservation
 	pmemVolumes map[string]*nodeVolume // map of reqID:nodeVolume
-	mutex       sync.Mutex             // lock for pmemVolumes
+	mutex       sync.RWMutex           // lock for pmemVolumes
+	// restored gets closed once pmemVolumes contains the volumes
+	// from the state.
+	restored chan struct{}
+	// recorder, if not nil, is used for events about the node.
+	recorder record.EventRecorder
 }
 
+const (
+	// EventReasonEraseVerified is used when reading back the
+	// data of a deleted volume found that it was erased.
+	EventReasonEraseVerified = "EraseVerified"
+	// EventReasonEraseVerificationFailed is used when the data
+	// of a volume was not erased. The volume then does not get
+	// deleted.
+	EventReasonEraseVerificationFailed = "EraseVerificationFailed"
+	// EventReasonHeaderCleared is used instead of
+	// EventReasonEraseVerified when only the start of a volume
+	// was cleared because eraseAfter was disabled.
+	EventReasonHeaderCleared = "HeaderCleared"
+)
+
 var _ csi.ControllerServer = &nodeControllerServer{}
 var _ grpcserver.Service = &nodeControllerServer{}
 
-var nodeVolumeMutex = keymutex.NewHashed(-1)
+var nodeVolumeMutex = newVolumeLock("controller-server")
 
-func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
-	ctx, logger := pmemlog.WithName(ctx, "NewNodeControllerServer")
+// NewNodeControllerServer creates the controller service of the node driver.
+// The reserved PMEM is not included in the capacity reported by GetCapacity.
+//
+// Volumes from the state get restored in the background. Calls which
+// need to know about volumes block until that is done, others can be
+// served immediately.
+func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager, reserved pmdmanager.Reservation) *nodeControllerServer {
+	ctx, _ = pmemlog.WithName(ctx, "NewNodeControllerServer")
 
 	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
@@ -67,76 +113,208 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 		nodeID:                  nodeID,
 		dm:                      dm,
 		sm:                      sm,
+		reserved:                reserved,
 		pmemVolumes:             map[string]*nodeVolume{},
+		restored:                make(chan struct{}),
 	}
+	go ncs.restore(ctx)
 
-	// Restore provisioned volumes from state.
-	if sm != nil {
-		// Get actual devices at DeviceManager
-		devices, err := dm.ListDevices(ctx)
-		if err != nil {
-			logger.Error(err, "Failed to get volumes")
-		}
-		cleanupList := []string{}
-		ids, err := sm.GetAll()
+	return ncs
+}
+
+// stateWorkers is the number of goroutines which read volume entries
+// from the state in parallel.
+const stateWorkers = 8
+
+// restore populates pmemVolumes with the volumes from the state which
+// still exist and adopts those which have no state. Listing devices
+// and reading the state run in parallel.
+func (cs *nodeControllerServer) restore(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	defer close(cs.restored)
+	if cs.sm == nil {
+		return
+	}
+	start := time.Now()
+
+	var devices []*pmdmanager.PmemDeviceInfo
+	var listErr error
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		devices, listErr = cs.dm.ListDevices(ctx)
+	}()
+	vols := cs.loadState(ctx)
+	<-listed
+	if listErr != nil {
+		logger.Error(listErr, "Failed to get volumes")
+	}
+
+	// Device managers for volumes in other modes get created once
+	// per mode.
+	otherDMs := map[api.DeviceMode]pmdmanager.PmemDeviceManager{}
+	volumes := map[string]*nodeVolume{}
+	cleanupList := []string{}
+	for _, vol := range vols {
+		id := vol.ID
+		v, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
 		if err != nil {
-			logger.Error(err, "Failed to load state")
+			logger.Error(err, "Failed to parse volume parameters for volume", "volume-id", id)
+			continue
 		}
 
-		for _, id := range ids {
-			// retrieve volume info
-			vol := &nodeVolume{}
-			if err := sm.Get(id, vol); err != nil {
-				logger.Error(err, "Failed to retrieve volume info from persistent state", "volume-id", id)
-				continue
-			}
-			v, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
-			if err != nil {
-				logger.Error(err, "Failed to parse volume parameters for volume", "volume-id", id)
-				continue
-			}
-
-			found := false
-			if v.GetDeviceMode() != dm.GetMode() {
-				dm, err := pmdmanager.New(ctx, v.GetDeviceMode(), 0)
+		found := false
+		if mode := v.GetDeviceMode(); mode != cs.dm.GetMode() {
+			dm := otherDMs[mode]
+			if dm == nil {
+				dm, err = pmdmanager.New(ctx, mode, 0, pmdmanager.Options{})
 				if err != nil {
-					logger.Error(err, "Failed to initialize device manager for state volume", "volume-id", id, "device-mode", v.GetDeviceMode())
+					logger.Error(err, "Failed to initialize device manager for state volume", "volume-id", id, "device-mode", mode)
 					continue
 				}
+				otherDMs[mode] = dm
+			}
 
-				if _, err := dm.GetDevice(ctx, id); err == nil {
+			if _, err := dm.GetDevice(ctx, id); err == nil {
+				found = true
+			} else if !errors.Is(err, pmemerr.DeviceNotFound) {
+				logger.Error(err, "Failed to fetch device for state volume", "volume-id", id, "device-mode", mode)
+				// Let's ignore this volume
+				continue
+			}
+		} else {
+			// See if the device data stored at StateManager is still valid
+			for _, devInfo := range devices {
+				if devInfo.VolumeId == id {
 					found = true
-				} else if !errors.Is(err, pmemerr.DeviceNotFound) {
-					logger.Error(err, "Failed to fetch device for state volume", "volume-id", id, "device-mode", v.GetDeviceMode())
-					// Let's ignore this volume
-					continue
-				}
-			} else {
-				// See if the device data stored at StateManager is still valid
-				for _, devInfo := range devices {
-					if devInfo.VolumeId == id {
-						found = true
-						break
+					if vol.UUID == "" && devInfo.UUID != "" {
+						// State from an older release.
+						vol.UUID = devInfo.UUID
+						if err := cs.sm.Create(id, vol); err != nil {
+							logger.Error(err, "Failed to store UUID in state", "volume-id", id)
+						}
 					}
+					break
 				}
 			}
+		}
 
-			if found {
-				ncs.pmemVolumes[id] = vol
-			} else {
-				// if not found in DeviceManager's list, add to cleanupList
-				cleanupList = append(cleanupList, id)
-			}
+		if found {
+			volumes[id] = vol
+		} else {
+			// if not found in DeviceManager's list, add to cleanupList
+			cleanupList = append(cleanupList, id)
+		}
+	}
+
+	for _, id := range cleanupList {
+		if err := cs.sm.Delete(id); err != nil {
+			logger.Error(err, "Failed to remove stale volume from state", "volume-id", id)
 		}
+	}
+
+	if listErr == nil {
+		cs.adoptVolumes(ctx, volumes, devices)
+	}
+
+	cs.mutex.Lock()
+	cs.pmemVolumes = volumes
+	cs.mutex.Unlock()
+	logger.V(2).Info("Restored volumes", "volumes", len(volumes), "duration", time.Since(start))
+}
 
-		for _, id := range cleanupList {
-			if err := sm.Delete(id); err != nil {
-				logger.Error(err, "Failed to remove stale volume from state", "volume-id", id)
+// loadState reads all volume entries from the state, using several
+// goroutines. Entries which cannot be read are skipped.
+func (cs *nodeControllerServer) loadState(ctx context.Context) []*nodeVolume {
+	logger := klog.FromContext(ctx)
+	ids, err := cs.sm.GetAll()
+	if err != nil {
+		logger.Error(err, "Failed to load state")
+	}
+
+	vols := make([]*nodeVolume, len(ids))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < stateWorkers && i < len(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				// retrieve volume info
+				vol := &nodeVolume{}
+				if err := cs.sm.Get(ids[i], vol); err != nil {
+					logger.Error(err, "Failed to retrieve volume info from persistent state", "volume-id", ids[i])
+					continue
+				}
+				vols[i] = vol
 			}
+		}()
+	}
+	for i := range ids {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	// Drop the entries which could not be read.
+	result := vols[:0]
+	for _, vol := range vols {
+		if vol != nil {
+			result = append(result, vol)
 		}
 	}
+	return result
+}
 
-	return ncs
+// waitRestored blocks until restore is done.
+func (cs *nodeControllerServer) waitRestored() {
+	<-cs.restored
+}
+
+// checkRestored returns an error while restore is still running.
+func (cs *nodeControllerServer) checkRestored(ctx context.Context) error {
+	select {
+	case <-cs.restored:
+		return nil
+	default:
+		return errors.New("restoring volumes from state")
+	}
+}
+
+// adoptVolumes handles devices which have no state, for example
+// because the state directory was lost. Devices with a volume ID
+// created by PMEM-CSI get added to the state again, with just the
+// device mode and size as parameters. The volume name gets restored
+// when CreateVolume is called again for it. All other devices are
+// left alone and never get deleted or reported as volumes.
+func (cs *nodeControllerServer) adoptVolumes(ctx context.Context, volumes map[string]*nodeVolume, devices []*pmdmanager.PmemDeviceInfo) {
+	logger := klog.FromContext(ctx)
+	mode := cs.dm.GetMode()
+	for _, device := range devices {
+		id := device.VolumeId
+		if _, ok := volumes[id]; ok {
+			continue
+		}
+		if !pmdmanager.IsVolumeID(id) {
+			logger.Info("Warning: ignoring device without volume state", "name", id, "device", device.Path)
+			continue
+		}
+		p := parameters.Volume{
+			DeviceMode: &mode,
+		}
+		vol := &nodeVolume{
+			ID:     id,
+			Size:   int64(device.Size),
+			Params: p.ToContext(),
+			UUID:   device.UUID,
+		}
+		if err := cs.sm.Create(id, vol); err != nil {
+			logger.Error(err, "Failed to store state for volume without state, ignoring it", "volume-id", id)
+			continue
+		}
+		logger.Info("Adopted volume without state", "volume-id", id, "device", device.Path, "size", pmemlog.CapacityRef(vol.Size))
+		volumes[id] = vol
+	}
 }
 
 func (cs *nodeControllerServer) RegisterService(rpcServer *grpc.Server) {
@@ -165,10 +343,8 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		return nil, status.Error(codes.InvalidArgument, "persistent volume: "+err.Error())
 	}
 
-	nodeVolumeMutex.LockKey(req.Name)
-	defer func() {
-		_ = nodeVolumeMutex.UnlockKey(req.Name)
-	}()
+	unlock := nodeVolumeMutex.lock(ctx, req.Name)
+	defer unlock()
 
 	volumeID, size, err := cs.createVolumeInternal(ctx,
 		p,
@@ -177,6 +353,8 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		req.GetCapacityRange(),
 	)
 	if err != nil {
+		cs.volumeEvent(pvcRef(req.GetParameters(), req.Name), EventReasonVolumeCreationFailed,
+			failureMessage("Creating", req.Name, cs.nodeID, err))
 		// This is already a status error.
 		return nil, err
 	}
@@ -188,8 +366,14 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	})
 
 	// Prepare the volume context. Including the name is useful for logging.
+	// The PVC is needed for events in NodeStageVolume.
 	p.Name = &req.Name
 	volumeContext := p.ToContext()
+	for _, key := range []string{parameters.PVCName, parameters.PVCNamespace} {
+		if value, ok := req.GetParameters()[key]; ok {
+			volumeContext[key] = value
+		}
+	}
 
 	resp = &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
@@ -221,6 +405,11 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	p.Name = &volumeName
 
 	asked := capacity.GetRequiredBytes()
+	limit := capacity.GetLimitBytes()
+	if limit > 0 && asked > limit {
+		statusErr = status.Errorf(codes.OutOfRange, "required size %d is larger than limit %d", asked, limit)
+		return
+	}
 	if vol := cs.getVolumeByName(volumeName); vol != nil {
 		// Check if the size of existing volume can cover the new request
 		logger.V(4).Info("Volume exists", "volume-id", vol.ID, "size", pmemlog.CapacityRef(vol.Size))
@@ -228,6 +417,10 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			statusErr = status.Error(codes.AlreadyExists, fmt.Sprintf("smaller volume with the same name %q already exists", volumeName))
 			return
 		}
+		if limit > 0 && vol.Size > limit {
+			statusErr = status.Error(codes.AlreadyExists, fmt.Sprintf("larger volume with the same name %q already exists", volumeName))
+			return
+		}
 		// Use existing volume, it's the one the caller asked
 		// for earlier (idempotent call):
 		volumeID = vol.ID
@@ -237,11 +430,19 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 
 	volumeID = generateVolumeID(volumeName)
 	logger = logger.WithValues("volume-id", volumeID)
-	logger.V(4).Info("Creating new volume", "minimum-size", pmemlog.CapacityRef(asked), "maximum-size", pmemlog.CapacityRef(capacity.GetLimitBytes()))
+	logger.V(4).Info("Creating new volume", "minimum-size", pmemlog.CapacityRef(asked), "maximum-size", pmemlog.CapacityRef(limit))
 	ctx = klog.NewContext(ctx, logger)
 
 	// Check do we have entry with newly generated VolumeID already
 	if vol := cs.getVolumeByID(volumeID); vol != nil {
+		if _, ok := vol.Params[parameters.Name]; !ok {
+			// An adopted volume. It must have been
+			// created for this name.
+			statusErr = cs.restoreVolumeName(ctx, vol, p, asked)
+			volumeID = vol.ID
+			actual = vol.Size
+			return
+		}
 		// if we have, that has to be VolumeID collision, because above we checked
 		// that we don't have entry with such Name. VolumeID collision is very-very
 		// unlikely so we should not get here in any near future, if otherwise state is good.
@@ -255,9 +456,10 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	p.DeviceMode = &mode
 
 	vol := &nodeVolume{
-		ID:     volumeID,
-		Size:   asked,
-		Params: p.ToContext(),
+		ID:      volumeID,
+		Size:    asked,
+		Params:  p.ToContext(),
+		Created: time.Now().Unix(),
 	}
 	if cs.sm != nil {
 		// Persist new volume state *before* actually creating the volume.
@@ -277,26 +479,52 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			}
 		}()
 	}
-	actualSize, err := cs.dm.CreateDevice(ctx, volumeID, uint64(asked), p.GetUsage())
+	actualSize, err := cs.dm.CreateDevice(ctx, volumeID, uint64(asked), uint64(limit), p)
 	if err != nil {
 		code := codes.Internal
-		if errors.Is(err, pmemerr.NotEnoughSpace) {
+		switch {
+		case errors.Is(err, pmemerr.NotEnoughSpace):
 			code = codes.ResourceExhausted
+		case errors.Is(err, pmemerr.OutOfRange):
+			code = codes.OutOfRange
+		case errors.Is(err, pmemerr.UnknownPool), errors.Is(err, pmemerr.NotSupported):
+			code = codes.InvalidArgument
 		}
 		statusErr = status.Errorf(code, "device creation failed: %v", err)
 		return
 	}
 	actual = int64(actualSize)
+	update := false
 	if vol.Size != actual {
 		// Update volume size and store that persistently.
 		vol.Size = actual
+		update = true
+	}
+	// The device manager may have fallen back to a smaller
+	// mapping alignment, record the one that was used. The UUID
+	// identifies the device in later calls.
+	if device, err := cs.dm.GetDevice(ctx, volumeID); err != nil {
+		logger.V(3).Info("Getting the new device failed", "err", err)
+	} else {
+		if device.Alignment != 0 {
+			alignment := device.Alignment
+			p.Alignment = &alignment
+			vol.Params = p.ToContext()
+			update = true
+		}
+		if device.UUID != "" {
+			vol.UUID = device.UUID
+			update = true
+		}
+	}
+	if update && cs.sm != nil {
 		if err := cs.sm.Create(volumeID, vol); err != nil {
 			// We are in a difficult place now. We have
 			// created the volume, but couldn't update the
 			// metadata about it. The best we can do now
 			// is probably to proceed, hoping that whatever
 			// meta data was written is still valid.
-			logger.Error(err, "Updating state with new volume size failed")
+			logger.Error(err, "Updating state with new volume size, alignment and UUID failed")
 		}
 	}
 
@@ -323,8 +551,8 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 	}
 
 	// Serialize by VolumeId
-	nodeVolumeMutex.LockKey(volumeID)
-	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
+	unlock := nodeVolumeMutex.lock(ctx, volumeID)
+	defer unlock()
 
 	logger.V(4).Info("Starting to delete volume")
 	vol := cs.getVolumeByID(volumeID)
@@ -342,13 +570,33 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 
 	dm := cs.dm
 	if dm.GetMode() != p.GetDeviceMode() {
-		dm, err = pmdmanager.New(ctx, p.GetDeviceMode(), 0)
+		dm, err = pmdmanager.New(ctx, p.GetDeviceMode(), 0, pmdmanager.Options{})
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
 		}
 	}
 
-	if err := dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter()); err != nil {
+	// Never delete a device which merely has the same name as the
+	// volume, for example because the original device was removed
+	// manually and something else was created in its place.
+	device, err := dm.GetDevice(ctx, volumeID)
+	switch {
+	case err == nil:
+		if err := vol.checkDevice(device); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "delete volume: %v", err)
+		}
+	case errors.Is(err, pmemerr.DeviceNotFound):
+		// Nothing to check, DeleteDevice treats this as success.
+	default:
+		return nil, status.Errorf(codes.Internal, "Failed to look up volume: %s", err.Error())
+	}
+
+	verify := p.GetVerifyErase()
+	err = dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter(), verify)
+	if verify && (err == nil || errors.Is(err, pmemerr.NotErased)) {
+		cs.eraseVerified(ctx, req.VolumeId, p.GetName(), p.GetEraseAfter(), err)
+	}
+	if err != nil {
 		if errors.Is(err, pmemerr.DeviceInUse) {
 			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 		}
@@ -368,6 +616,46 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// eraseVerified records the result of verifying the erasure of a
+// volume as event for the node. Only verifying a full erase gets
+// counted in the metrics data. Without it, only the start of the
+// volume was cleared and checked.
+func (cs *nodeControllerServer) eraseVerified(ctx context.Context, volumeID, name string, full bool, err error) {
+	logger := klog.FromContext(ctx)
+	var eventtype, reason, message string
+	switch {
+	case err != nil && full:
+		eventtype, reason = corev1.EventTypeWarning, EventReasonEraseVerificationFailed
+		message = fmt.Sprintf("Data of volume %s (%s) was not erased, keeping the volume: %v", volumeID, name, err)
+	case err != nil:
+		eventtype, reason = corev1.EventTypeWarning, EventReasonEraseVerificationFailed
+		message = fmt.Sprintf("Header of volume %s (%s) was not cleared, keeping the volume: %v", volumeID, name, err)
+	case full:
+		eventtype, reason = corev1.EventTypeNormal, EventReasonEraseVerified
+		message = fmt.Sprintf("Data of volume %s (%s) was erased.", volumeID, name)
+	default:
+		eventtype, reason = corev1.EventTypeNormal, EventReasonHeaderCleared
+		message = fmt.Sprintf("Header of volume %s (%s) was cleared.", volumeID, name)
+	}
+	if full {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		eraseVerifications.WithLabelValues(result).Inc()
+	}
+	logger.Info(message, "reason", reason)
+	if cs.recorder != nil {
+		// The same reference as used by the kubelet for node events.
+		node := &corev1.ObjectReference{
+			Kind: "Node",
+			Name: cs.nodeID,
+			UID:  types.UID(cs.nodeID),
+		}
+		cs.recorder.Event(node, eventtype, reason, message)
+	}
+}
+
 func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 
 	// Check arguments
@@ -403,14 +691,9 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 		return nil, err
 	}
 
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
-	// Copy from map into array for pagination.
-	vols := make([]*nodeVolume, 0, len(cs.pmemVolumes))
-	for _, vol := range cs.pmemVolumes {
-		vols = append(vols, vol)
-	}
+	// The response gets built from a copy, without blocking
+	// CreateVolume and DeleteVolume.
+	vols := cs.volumes()
 
 	// Code originally copied from https://github.com/kubernetes-csi/csi-test/blob/f14e3d32125274e0c3a3a5df380e1f89ff7c132b/mock/service/controller.go#L309-L365
 
@@ -478,10 +761,49 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 }
 
 func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	cap, err := cs.dm.GetCapacity(ctx)
+	// Only the number of stripes, the NUMA node and the bus affect
+	// capacity. Other parameters are ignored because they get
+	// checked by CreateVolume.
+	params := map[string]string{}
+	for _, key := range []string{parameters.Stripes, parameters.NumaNode, parameters.Bus} {
+		if value, ok := req.GetParameters()[key]; ok {
+			params[key] = value
+		}
+	}
+	p, err := parameters.Parse(parameters.CreateVolumeOrigin, params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	stripes := p.GetStripes()
+
+	var cap pmdmanager.Capacity
+	if stripes > 1 {
+		sc, ok := cs.dm.(pmdmanager.StripedCapacity)
+		if !ok {
+			// Striped volumes cannot be created at all.
+			return &csi.GetCapacityResponse{
+				MaximumVolumeSize: wrapperspb.Int64(0),
+			}, nil
+		}
+		cap, err = sc.GetStripedCapacity(ctx, stripes)
+	} else {
+		cap, err = cs.dm.GetCapacity(ctx)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
+	// The reservation is for the whole node. Only a share of it
+	// gets subtracted from the capacity of some regions.
+	nodeManaged := cap.Managed
+	if node := p.GetNumaNode(); node >= 0 {
+		// Striped capacity has no per-region details and
+		// remains unfiltered.
+		cap = cap.ForNumaNode(node)
+	}
+	if bus := p.GetBus(); bus != "" {
+		cap = cap.ForBus(bus)
+	}
+	cap = cs.reserved.ApplyShare(cap, nodeManaged)
 
 	return &csi.GetCapacityResponse{
 		AvailableCapacity: int64(cap.Available),
@@ -490,18 +812,72 @@ func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCap
 	}, nil
 }
 
+// numaNodes returns the NUMA nodes with PMEM that volumes can be
+// created on, in increasing order.
+func (cs *nodeControllerServer) numaNodes(ctx context.Context) []int {
+	cap, err := cs.dm.GetCapacity(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to get capacity, not reporting NUMA topology")
+		return nil
+	}
+	return cap.NumaNodes()
+}
+
+// volumes returns copies of all volumes. The caller may use them
+// without holding the mutex.
+func (cs *nodeControllerServer) volumes() []nodeVolume {
+	cs.waitRestored()
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	vols := make([]nodeVolume, 0, len(cs.pmemVolumes))
+	for _, vol := range cs.pmemVolumes {
+		vols = append(vols, *vol)
+	}
+	return vols
+}
+
 func (cs *nodeControllerServer) getVolumeByID(volumeID string) *nodeVolume {
-	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+	cs.waitRestored()
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
 	if pmemVol, ok := cs.pmemVolumes[volumeID]; ok {
 		return pmemVol
 	}
 	return nil
 }
 
-func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
+// restoreVolumeName completes the state of an adopted volume with
+// the parameters from CreateVolume.
+func (cs *nodeControllerServer) restoreVolumeName(ctx context.Context, vol *nodeVolume, p parameters.Volume, asked int64) error {
+	logger := klog.FromContext(ctx)
+	if vol.Size < asked {
+		return status.Error(codes.AlreadyExists, fmt.Sprintf("smaller volume with the same name %q already exists", p.GetName()))
+	}
+	mode := api.DeviceMode(vol.Params[parameters.DeviceMode])
+	p.DeviceMode = &mode
+	restored := &nodeVolume{
+		ID:      vol.ID,
+		Size:    vol.Size,
+		Params:  p.ToContext(),
+		UUID:    vol.UUID,
+		Created: vol.Created,
+	}
+	if cs.sm != nil {
+		if err := cs.sm.Create(vol.ID, restored); err != nil {
+			return status.Error(codes.Internal, "store state: "+err.Error())
+		}
+	}
 	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
+	cs.pmemVolumes[vol.ID] = restored
+	cs.mutex.Unlock()
+	logger.V(3).Info("Restored name of adopted volume")
+	return nil
+}
+
+func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
+	cs.waitRestored()
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
 	for _, pmemVol := range cs.pmemVolumes {
 		if pmemVol.Params[parameters.Name] == volumeName {
 			return pmemVol
@@ -535,6 +911,8 @@ func generateVolumeID(name string) string {
 	// This also lowers collision probability even more, as an attacker
 	// attempting to cause VolumeID collision, has to find another Name
 	// producing same sha-224 hash, while also having common first N chars.
+	// The device managers rely on this format to recognize devices created
+	// by PMEM-CSI, see pmdmanager.IsVolumeID.
 	use := 6
 	if len(name) < 6 {
 		use = len(name)
@@ -0,0 +1,493 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestAdoptVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+
+	req := &csi.CreateVolumeRequest{
+		Name: "pvc-adopt",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024,
+		},
+	}
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+	resp, err := cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+
+	// A device not created by PMEM-CSI.
+	_, err = dm.CreateDevice(ctx, "foreign", 1024*1024, 0, parameters.Volume{})
+	require.NoError(t, err, "create foreign device")
+
+	// Start again with empty state.
+	sm, err = pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create new state")
+	cs = NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+	cs.waitRestored()
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.Equal(t, []string{volumeID}, ids, "adopted volumes in state")
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	require.Len(t, list.Entries, 1, "listed volumes")
+	assert.Equal(t, volumeID, list.Entries[0].Volume.VolumeId, "listed volume")
+
+	// Creating the volume again restores the name and keeps
+	// the rest of the state.
+	cs.getVolumeByID(volumeID).Created = 1234
+	resp, err = cs.CreateVolume(ctx, req)
+	require.NoError(t, err, "create volume again")
+	assert.Equal(t, volumeID, resp.Volume.VolumeId, "volume ID")
+	var vol nodeVolume
+	require.NoError(t, sm.Get(volumeID, &vol), "get state")
+	assert.Equal(t, req.Name, vol.Params[parameters.Name], "restored name")
+	assert.Equal(t, string(api.DeviceModeFake), vol.Params[parameters.DeviceMode], "device mode")
+	assert.Equal(t, int64(1234), vol.Created, "creation time")
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete volume")
+	_, err = dm.GetDevice(ctx, "foreign")
+	assert.NoError(t, err, "foreign device still exists")
+}
+
+// blockedDM waits for the channel to be closed before listing devices.
+type blockedDM struct {
+	pmdmanager.PmemDeviceManager
+	unblock chan struct{}
+}
+
+func (dm blockedDM) ListDevices(ctx context.Context) ([]*pmdmanager.PmemDeviceInfo, error) {
+	<-dm.unblock
+	return dm.PmemDeviceManager.ListDevices(ctx)
+}
+
+func TestRestoreVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+	const numVolumes = 20
+	var volumeIDs []string
+	for i := 0; i < numVolumes; i++ {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: fmt.Sprintf("pvc-restore-%d", i),
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 1024 * 1024,
+			},
+		})
+		require.NoError(t, err, "create volume #%d", i)
+		volumeIDs = append(volumeIDs, resp.Volume.VolumeId)
+	}
+	// A stale entry.
+	require.NoError(t, sm.Create("pvc-stale", &nodeVolume{
+		ID:     "pvc-stale",
+		Params: map[string]string{parameters.DeviceMode: string(api.DeviceModeFake)},
+	}), "create stale entry")
+
+	blocked := blockedDM{PmemDeviceManager: dm, unblock: make(chan struct{})}
+	cs = NewNodeControllerServer(ctx, "node", blocked, sm, pmdmanager.Reservation{})
+	ids := NewIdentityServer("pmem-csi.intel.com", "test", nil)
+	ids.ready = cs.checkRestored
+
+	// Identity and capacity calls work while restoring.
+	probe, err := ids.Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err, "probe while restoring")
+	assert.False(t, probe.GetReady().GetValue(), "ready while restoring")
+	_, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity while restoring")
+
+	close(blocked.unblock)
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	var listed []string
+	for _, entry := range list.Entries {
+		listed = append(listed, entry.Volume.VolumeId)
+	}
+	assert.ElementsMatch(t, volumeIDs, listed, "restored volumes")
+	probe, err = ids.Probe(ctx, &csi.ProbeRequest{})
+	require.NoError(t, err, "probe after restoring")
+	assert.Nil(t, probe.Ready, "ready after restoring")
+	stateIDs, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.ElementsMatch(t, volumeIDs, stateIDs, "state without stale entry")
+}
+
+func TestListVolumesConcurrent(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil, pmdmanager.Reservation{})
+
+	createVolume := func(name string) (string, error) {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 1024 * 1024,
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		return resp.Volume.VolumeId, nil
+	}
+	const numVolumes = 5
+	for i := 0; i < numVolumes; i++ {
+		_, err := createVolume(fmt.Sprintf("pvc-list-%d", i))
+		require.NoError(t, err, "create volume #%d", i)
+	}
+
+	// Volumes come and go while listing.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 20; i++ {
+			volumeID, err := createVolume(fmt.Sprintf("pvc-churn-%d", i))
+			if err != nil {
+				done <- fmt.Errorf("create volume #%d: %v", i, err)
+				return
+			}
+			if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+				done <- fmt.Errorf("delete volume #%d: %v", i, err)
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2})
+		require.NoError(t, err, "list volumes #%d", i)
+		assert.Len(t, list.Entries, 2, "first page #%d", i)
+		assert.Equal(t, "2", list.NextToken, "next token #%d", i)
+	}
+	require.NoError(t, <-done, "create and delete volumes")
+
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	require.NoError(t, err, "list volumes")
+	assert.Len(t, list.Entries, numVolumes, "listed volumes")
+	assert.Empty(t, list.NextToken, "next token")
+}
+
+func TestGetCapacityNumaNode(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil, pmdmanager.Reservation{})
+
+	all, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity")
+	// The fake device manager has no per-region details, so
+	// the capacity is not filtered.
+	numa, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{parameters.NumaNode: "0"},
+	})
+	require.NoError(t, err, "get capacity for NUMA node")
+	assert.Equal(t, all.AvailableCapacity, numa.AvailableCapacity, "available capacity")
+	assert.Empty(t, cs.numaNodes(ctx), "NUMA nodes")
+
+	_, err = cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{parameters.NumaNode: "foo"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "invalid NUMA node")
+}
+
+// detailsDM reports two regions on different NUMA nodes.
+type detailsDM struct {
+	pmdmanager.PmemDeviceManager
+}
+
+func (dm detailsDM) GetCapacity(ctx context.Context) (pmdmanager.Capacity, error) {
+	gig := uint64(1024 * 1024 * 1024)
+	return pmdmanager.Capacity{
+		MaxVolumeSize:     8 * gig,
+		Available:         16 * gig,
+		PhysicalAvailable: 16 * gig,
+		Managed:           16 * gig,
+		Total:             16 * gig,
+		Details: []pmdmanager.CapacityDetail{
+			{Region: "region0", Bus: "ndbus0", NumaNode: 0, MaxVolumeSize: 8 * gig, Available: 8 * gig, Total: 8 * gig},
+			{Region: "region1", Bus: "ndbus0", NumaNode: 1, MaxVolumeSize: 8 * gig, Available: 8 * gig, Total: 8 * gig},
+		},
+	}, nil
+}
+
+func TestGetCapacityReserved(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	gig := int64(1024 * 1024 * 1024)
+	cs := NewNodeControllerServer(ctx, "node", detailsDM{dm}, nil, pmdmanager.Reservation{Bytes: uint64(4 * gig)})
+
+	all, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	require.NoError(t, err, "get capacity")
+	assert.Equal(t, 12*gig, all.AvailableCapacity, "available capacity of node")
+	// Each NUMA node has half of the PMEM and thus half of the
+	// reservation.
+	numa, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{parameters.NumaNode: "0"},
+	})
+	require.NoError(t, err, "get capacity for NUMA node")
+	assert.Equal(t, 6*gig, numa.AvailableCapacity, "available capacity of NUMA node")
+	assert.Equal(t, 6*gig, numa.MaximumVolumeSize.GetValue(), "maximum volume size of NUMA node")
+	bus, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{parameters.Bus: "ndbus0"},
+	})
+	require.NoError(t, err, "get capacity for bus")
+	assert.Equal(t, all.AvailableCapacity, bus.AvailableCapacity, "available capacity of bus")
+}
+
+// alignedDM pretends to align all sizes to 4MiB.
+type alignedDM struct {
+	pmdmanager.PmemDeviceManager
+}
+
+func (dm alignedDM) CreateDevice(ctx context.Context, name string, size, limit uint64, params parameters.Volume) (uint64, error) {
+	const align = 4 * 1024 * 1024
+	actual := (size + align - 1) / align * align
+	if limit > 0 && actual > limit {
+		return 0, pmemerr.OutOfRange
+	}
+	return dm.PmemDeviceManager.CreateDevice(ctx, name, actual, limit, params)
+}
+
+func TestCreateVolumeLimit(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	cs := NewNodeControllerServer(ctx, "node", alignedDM{dm}, sm, pmdmanager.Reservation{})
+
+	create := func(name string, required, limit int64) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: required,
+				LimitBytes:    limit,
+			},
+		})
+	}
+
+	_, err = create("pvc-invalid", 2*1024*1024, 1024*1024)
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "required larger than limit")
+
+	_, err = create("pvc-aligned", 1024*1024, 2*1024*1024)
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "aligned size larger than limit")
+	assert.Nil(t, cs.getVolumeByName("pvc-aligned"), "no volume after failure")
+
+	resp, err := create("pvc-ok", 1024*1024, 4*1024*1024)
+	require.NoError(t, err, "aligned size within limit")
+	assert.Equal(t, int64(4*1024*1024), resp.Volume.CapacityBytes, "capacity")
+
+	_, err = create("pvc-ok", 1024*1024, 2*1024*1024)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "existing volume larger than limit")
+}
+
+// notErasedDM fails to erase volumes.
+type notErasedDM struct {
+	pmdmanager.PmemDeviceManager
+}
+
+func (dm notErasedDM) DeleteDevice(ctx context.Context, name string, flush, verify bool) error {
+	if verify {
+		return fmt.Errorf("verify erasure: %w", pmemerr.NotErased)
+	}
+	return dm.PmemDeviceManager.DeleteDevice(ctx, name, flush, verify)
+}
+
+func TestDeleteVolumeVerifyErase(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	recorder := record.NewFakeRecorder(10)
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+	cs.recorder = recorder
+
+	create := func(name string, verify, erase bool) string {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 1024 * 1024,
+			},
+			Parameters: map[string]string{
+				parameters.VerifyErase: strconv.FormatBool(verify),
+				parameters.EraseAfter:  strconv.FormatBool(erase),
+			},
+		})
+		require.NoError(t, err, "create volume %s", name)
+		return resp.Volume.VolumeId
+	}
+	successes := testutil.ToFloat64(eraseVerifications.WithLabelValues("success"))
+	failures := testutil.ToFloat64(eraseVerifications.WithLabelValues("failure"))
+
+	volumeID := create("pvc-unverified", false, true)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete unverified volume")
+	assert.Empty(t, recorder.Events, "events for unverified volume")
+
+	volumeID = create("pvc-verified", true, true)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete verified volume")
+	assert.Contains(t, <-recorder.Events, "Normal "+EventReasonEraseVerified, "event for verified volume")
+	assert.Equal(t, successes+1, testutil.ToFloat64(eraseVerifications.WithLabelValues("success")), "successful verifications")
+
+	volumeID = create("pvc-header", true, false)
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	require.NoError(t, err, "delete volume without full erase")
+	assert.Contains(t, <-recorder.Events, "Normal "+EventReasonHeaderCleared, "event for volume without full erase")
+	assert.Equal(t, successes+1, testutil.ToFloat64(eraseVerifications.WithLabelValues("success")), "header not counted")
+
+	volumeID = create("pvc-not-erased", true, true)
+	cs.dm = notErasedDM{dm}
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.Internal, status.Code(err), "delete volume which was not erased: %v", err)
+	assert.Contains(t, <-recorder.Events, "Warning "+EventReasonEraseVerificationFailed, "event for volume which was not erased")
+	assert.Equal(t, failures+1, testutil.ToFloat64(eraseVerifications.WithLabelValues("failure")), "failed verifications")
+	_, err = dm.GetDevice(ctx, volumeID)
+	assert.NoError(t, err, "volume which was not erased still exists")
+}
+
+func TestRecreatedDevice(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-recreated",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024,
+		},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+	var vol nodeVolume
+	require.NoError(t, sm.Get(volumeID, &vol), "get state")
+	assert.NotEmpty(t, vol.UUID, "UUID in state")
+
+	_, device, err := ns.getVolumeDevice(ctx, volumeID)
+	require.NoError(t, err, "get original device")
+	assert.Equal(t, vol.UUID, device.UUID, "UUID of original device")
+
+	// Someone else creates a device with the same name.
+	require.NoError(t, dm.DeleteDevice(ctx, volumeID, false, false), "delete device")
+	_, err = dm.CreateDevice(ctx, volumeID, 1024*1024, 0, parameters.Volume{})
+	require.NoError(t, err, "recreate device")
+	_, _, err = ns.getVolumeDevice(ctx, volumeID)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "get recreated device: %v", err)
+}
+
+func TestDeleteRecreatedDevice(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-recreated",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024,
+		},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+
+	// Someone else creates a device with the same name.
+	require.NoError(t, dm.DeleteDevice(ctx, volumeID, false, false), "delete device")
+	_, err = dm.CreateDevice(ctx, volumeID, 1024*1024, 0, parameters.Volume{})
+	require.NoError(t, err, "recreate device")
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "delete recreated device: %v", err)
+	_, err = dm.GetDevice(ctx, volumeID)
+	assert.NoError(t, err, "recreated device still exists")
+	assert.NotNil(t, cs.getVolumeByID(volumeID), "volume still known")
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// defragment moves the namespaces of volumes in direct mode such that
+// the free space in each region becomes contiguous. The journal for
+// interrupted moves is kept in the state directory. Volumes keep
+// their ID and size, but moved namespaces have a new UUID.
+func defragment(ctx context.Context, statePath string) error {
+	if err := os.MkdirAll(statePath, 0750); err != nil {
+		return fmt.Errorf("create state directory: %v", err)
+	}
+	if err := pmdmanager.Defragment(ctx, filepath.Join(statePath, "defragment.journal"), pmdmanager.IsVolumeID); err != nil {
+		return err
+	}
+	return forgetUUIDs(statePath)
+}
+
+// forgetUUIDs removes the UUIDs of volumes in direct mode from the
+// state. The node driver records them again when it starts.
+func forgetUUIDs(statePath string) error {
+	sm, err := pmemstate.NewFileState(statePath)
+	if err != nil {
+		return err
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		return fmt.Errorf("load state: %v", err)
+	}
+	for _, id := range ids {
+		vol := &nodeVolume{}
+		if err := sm.Get(id, vol); err != nil {
+			return fmt.Errorf("volume %s: retrieve volume info: %v", id, err)
+		}
+		v, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			return fmt.Errorf("volume %s: parse volume parameters: %v", id, err)
+		}
+		if v.GetDeviceMode() != api.DeviceModeDirect || vol.UUID == "" {
+			continue
+		}
+		vol.UUID = ""
+		if err := sm.Create(id, vol); err != nil {
+			return fmt.Errorf("volume %s: update volume info: %v", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+const (
+	// EventReasonVolumeCreationFailed is used for the PVC when
+	// creating its volume on the node failed.
+	EventReasonVolumeCreationFailed = "VolumeCreationFailed"
+	// EventReasonVolumeStagingFailed is used for the PVC when
+	// formatting or mounting its volume on the node failed.
+	EventReasonVolumeStagingFailed = "VolumeStagingFailed"
+	// EventReasonVolumePublishingFailed is used for the pod when
+	// making a volume available to it failed.
+	EventReasonVolumePublishingFailed = "VolumePublishingFailed"
+)
+
+// pvcRef returns a reference to the PVC which is described by the
+// parameters that external-provisioner passes to CreateVolume with
+// --extra-create-metadata and which PMEM-CSI then copies into the
+// volume context, nil if they are missing. The UID is derived from
+// the volume name, which external-provisioner generates from it
+// ("pvc-<UID>"). Without the UID, "kubectl describe" would not show
+// the event.
+func pvcRef(params map[string]string, volumeName string) *corev1.ObjectReference {
+	name, namespace := params[parameters.PVCName], params[parameters.PVCNamespace]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Name:       name,
+		Namespace:  namespace,
+	}
+	if uid := strings.TrimPrefix(volumeName, "pvc-"); uid != volumeName {
+		if _, err := uuid.Parse(uid); err == nil {
+			ref.UID = types.UID(uid)
+		}
+	}
+	return ref
+}
+
+// podRef returns a reference to the pod which is described by the
+// pod info in the volume context of NodePublishVolume, nil if that
+// is missing.
+func podRef(volumeContext map[string]string) *corev1.ObjectReference {
+	name, namespace := volumeContext[parameters.PodName], volumeContext[parameters.PodNamespace]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       name,
+		Namespace:  namespace,
+		UID:        types.UID(volumeContext[parameters.PodUID]),
+	}
+}
+
+// maxEventErrorLength limits how much of an error message gets
+// copied into an event. The full error is in the driver log.
+const maxEventErrorLength = 512
+
+// failureMessage turns the error of a CSI call into a message for
+// users who cannot read the driver logs.
+func failureMessage(operation, volume, nodeID string, err error) string {
+	s := status.Convert(err)
+	var hint string
+	switch s.Code() {
+	case codes.ResourceExhausted:
+		hint = " There is not enough free PMEM on the node for the requested size."
+	case codes.OutOfRange:
+		hint = " The requested size cannot be satisfied within the size limit."
+	case codes.AlreadyExists:
+		hint = " The volume already exists with incompatible properties."
+	case codes.InvalidArgument:
+		hint = " Check the storage class parameters and volume attributes."
+	}
+	message := strings.TrimSuffix(s.Message(), ".")
+	if len(message) > maxEventErrorLength {
+		// For example, the output of a failed mkfs.
+		message = message[:maxEventErrorLength] + "..."
+	}
+	return fmt.Sprintf("%s volume %s on node %s failed: %s.%s", operation, volume, nodeID, message, hint)
+}
+
+// volumeName returns the name of a persistent volume as stored in
+// the volume context by CreateVolume, the volume ID otherwise.
+func volumeName(volumeContext map[string]string, volumeID string) string {
+	if name := volumeContext[parameters.Name]; name != "" {
+		return name
+	}
+	return volumeID
+}
+
+// volumeEvent records a warning event for the object if there is a
+// recorder and an object.
+func (cs *nodeControllerServer) volumeEvent(ref *corev1.ObjectReference, reason, message string) {
+	if cs.recorder != nil && ref != nil {
+		cs.recorder.Event(ref, corev1.EventTypeWarning, reason, message)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// objectRecorder remembers the objects of all events.
+type objectRecorder struct {
+	events []recordedEvent
+}
+
+type recordedEvent struct {
+	object                     *corev1.ObjectReference
+	eventtype, reason, message string
+}
+
+func (r *objectRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.events = append(r.events, recordedEvent{object.(*corev1.ObjectReference), eventtype, reason, message})
+}
+
+func (r *objectRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *objectRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+func TestPVCRef(t *testing.T) {
+	uid := "6b0a5a2c-54a1-4e0b-9d2c-6a6f5c1e1f6d"
+	params := map[string]string{
+		parameters.PVCName:      "my-pvc",
+		parameters.PVCNamespace: "default",
+	}
+	ref := pvcRef(params, "pvc-"+uid)
+	require.NotNil(t, ref, "PVC reference")
+	assert.Equal(t, corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "PersistentVolumeClaim",
+		Name:       "my-pvc",
+		Namespace:  "default",
+		UID:        types.UID(uid),
+	}, *ref)
+
+	ref = pvcRef(params, "pvc-not-a-uid")
+	require.NotNil(t, ref, "PVC reference without UID")
+	assert.Empty(t, ref.UID, "UID")
+
+	assert.Nil(t, pvcRef(map[string]string{parameters.PVCName: "my-pvc"}, "pvc-"+uid), "no namespace")
+	assert.Nil(t, pvcRef(nil, "pvc-"+uid), "no parameters")
+}
+
+func TestPodRef(t *testing.T) {
+	ref := podRef(map[string]string{
+		parameters.PodName:      "my-pod",
+		parameters.PodNamespace: "default",
+		parameters.PodUID:       "1234",
+	})
+	require.NotNil(t, ref, "pod reference")
+	assert.Equal(t, corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       "my-pod",
+		Namespace:  "default",
+		UID:        "1234",
+	}, *ref)
+	assert.Nil(t, podRef(map[string]string{parameters.Name: "pvc-1"}), "no pod info")
+}
+
+func TestFailureMessage(t *testing.T) {
+	assert.Equal(t,
+		"Creating volume pvc-1 on node worker1 failed: not enough space. There is not enough free PMEM on the node for the requested size.",
+		failureMessage("Creating", "pvc-1", "worker1", status.Error(codes.ResourceExhausted, "not enough space")))
+	assert.Equal(t,
+		"Staging volume pvc-1 on node worker1 failed: mount failed.",
+		failureMessage("Staging", "pvc-1", "worker1", status.Error(codes.Internal, "mount failed.")))
+	long := failureMessage("Staging", "pvc-1", "worker1", status.Error(codes.Internal, strings.Repeat("x", 2*maxEventErrorLength)))
+	assert.Less(t, len(long), maxEventErrorLength+100, "truncated message")
+}
+
+func TestCreateVolumeEvents(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	recorder := &objectRecorder{}
+	cs := NewNodeControllerServer(ctx, "worker1", dm, nil, pmdmanager.Reservation{})
+	cs.recorder = recorder
+
+	uid := "6b0a5a2c-54a1-4e0b-9d2c-6a6f5c1e1f6d"
+	create := func(size int64) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "pvc-" + uid,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: size,
+			},
+			Parameters: map[string]string{
+				parameters.PVCName:           "my-pvc",
+				parameters.PVCNamespace:      "default",
+				"csi.storage.k8s.io/pv/name": "pvc-" + uid,
+			},
+		})
+	}
+
+	_, err = create(1024 * 1024 * 1024 * 1024 * 1024)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "volume too large")
+	if assert.Len(t, recorder.events, 1, "events") {
+		event := recorder.events[0]
+		assert.Equal(t, "PersistentVolumeClaim", event.object.Kind, "kind")
+		assert.Equal(t, "my-pvc", event.object.Name, "name")
+		assert.Equal(t, types.UID(uid), event.object.UID, "UID")
+		assert.Equal(t, corev1.EventTypeWarning, event.eventtype, "type")
+		assert.Equal(t, EventReasonVolumeCreationFailed, event.reason, "reason")
+		assert.Contains(t, event.message, "not enough free PMEM", "message")
+	}
+
+	resp, err := create(1024 * 1024)
+	require.NoError(t, err, "create volume")
+	assert.Len(t, recorder.events, 1, "no event for success")
+	volumeContext := resp.Volume.VolumeContext
+	assert.Equal(t, "my-pvc", volumeContext[parameters.PVCName], "PVC name in volume context")
+	assert.Equal(t, "default", volumeContext[parameters.PVCNamespace], "PVC namespace in volume context")
+	assert.NotContains(t, volumeContext, "csi.storage.k8s.io/pv/name", "PV name in volume context")
+	_, err = parameters.Parse(parameters.PersistentVolumeOrigin, volumeContext)
+	assert.NoError(t, err, "parse volume context")
+}
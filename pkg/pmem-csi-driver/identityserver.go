@@ -11,20 +11,29 @@ import (
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type identityServer struct {
 	name       string
 	version    string
 	pluginCaps []*csi.PluginCapability
+	// healthz is optional and makes Probe fail when it fails.
+	healthz func(ctx context.Context) error
+	// ready is optional and makes Probe report that the driver
+	// is not ready yet while it fails.
+	ready func(ctx context.Context) error
 }
 
 var _ grpcserver.Service = &identityServer{}
 
-func NewIdentityServer(name, version string) *identityServer {
+func NewIdentityServer(name, version string, healthz func(ctx context.Context) error) *identityServer {
 	return &identityServer{
 		name:    name,
 		version: version,
+		healthz: healthz,
 		pluginCaps: []*csi.PluginCapability{
 			{
 				Type: &csi.PluginCapability_Service_{
@@ -56,6 +65,16 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 }
 
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if ids.healthz != nil {
+		if err := ids.healthz(ctx); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "health check: %v", err)
+		}
+	}
+	if ids.ready != nil {
+		if err := ids.ready(ctx); err != nil {
+			return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+		}
+	}
 	return &csi.ProbeResponse{}, nil
 }
 
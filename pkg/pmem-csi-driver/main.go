@@ -11,6 +11,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -41,14 +42,44 @@ func init() {
 	/* metrics options */
 	flag.StringVar(&config.metricsListen, "metricsListen", "", "listen address (like :8001) for prometheus metrics endpoint, disabled by default")
 	flag.StringVar(&config.metricsPath, "metricsPath", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
+	flag.StringVar(&config.metricsCertFile, "metricsCertFile", "", "certificate file for serving the metrics endpoint via HTTPS instead of HTTP, re-read when it changes, requires -metricsKeyFile")
+	flag.StringVar(&config.metricsKeyFile, "metricsKeyFile", "", "private key file for -metricsCertFile")
+	flag.StringVar(&config.metricsClientCAFile, "metricsClientCAFile", "", "CA certificate file for verifying client certificates, only clients with such a certificate may retrieve metrics (health checks remain unauthenticated), requires -metricsCertFile")
+
+	/* tracing options */
+	flag.BoolVar(&config.enableTracing, "enableTracing", false, "export OpenTelemetry traces for CSI calls, device operations and commands to the OTLP collector configured with the standard OTEL_* env variables, like OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	/* debug options */
+	flag.StringVar(&config.debugListen, "debugListen", "", "listen address (like 127.0.0.1:6060) for /debug/pprof and /debug/stacks, also enables the mutex and block profiles and logging of goroutine stacks on SIGUSR1, disabled by default")
 
 	/* Controller mode options */
-	flag.Var(&config.nodeSelector, "nodeSelector", "controller: reschedule PVCs with a selected node where PMEM-CSI is not meant to run because the node does not have these labels (represented as JSON map)")
+	flag.Var(&config.nodeSelector, "nodeSelector", "controller: reschedule PVCs with a selected node where PMEM-CSI is not meant to run because the node does not have these labels (represented as JSON map or as JSON label selector with matchLabels and matchExpressions)")
+	flag.BoolVar(&config.leaderElection, "leader-election", false, "controller: only reschedule PVCs while holding a lease, for running multiple instances as hot standbys")
+	flag.StringVar(&config.leaderElectionNamespace, "leader-election-namespace", "", "controller: namespace for the leader election lease, defaults to the namespace of the pod")
+
+	/* Raw namespace conversion options */
+	flag.Var(&config.PmemGoal, "pmemGoal", "force-convert-raw-namespaces: on nodes where NVDIMMs have no PMEM regions, create an ipmctl goal with this App Direct percentage, optionally followed by ',not-interleaved'; the node must be rebooted afterwards")
+	flag.BoolVar(&config.dryRun, "dryRun", false, "force-convert-raw-namespaces: only report in a node annotation which namespaces would be converted, without converting them or changing node labels")
 
 	/* Node mode options */
-	flag.Var(&config.DeviceManager, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm' or 'direct' (= 'ndctl')")
-	flag.StringVar(&config.StateBasePath, "statePath", "", "node: directory path where to persist the state of the driver, defaults to /var/lib/<drivername>")
+	flag.Var(deviceManagerFlag{&config}, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm', 'direct' (= 'ndctl'), 'auto' (chosen per node) or 'external://<socket path>' for an out-of-tree device manager")
+	flag.StringVar(&config.StateBasePath, "statePath", "", "node, wipe, defragment: directory path where to persist the state of the driver, defaults to /var/lib/<drivername>")
 	flag.UintVar(&config.PmemPercentage, "pmemPercentage", 100, "node: percentage of space to be used by the driver in each PMEM region")
+	flag.Var(&config.Pools, "pmemPool", "node: defines a pool of regions that volumes can select with the 'pool' parameter, as <name>=<region>,<region>,...; can be repeated")
+	flag.Var(&config.PmemReserved, "pmemReserved", "node: amount of PMEM which is not reported as available for new volumes, either as percentage of the managed PMEM (\"10%\") or as size (\"16Gi\")")
+	flag.UintVar(&config.SystemRAMPercentage, "pmemSystemRAMPercentage", 0, "node: percentage of each PMEM region that gets onlined as system RAM with the kmem driver instead of being used for volumes, disabled by default; only in LVM and direct mode")
+	flag.Var(&config.WarmPool, "pmemWarmPool", "node: in direct mode, keep <count> wiped namespaces of <size> ready for new volumes, as <size>=<count>; can be repeated")
+	flag.Var(&config.VolumeGroupLayout, "pmemVolumeGroupLayout", "node: 'region' for one LVM volume group per region, 'node' for one volume group with all regions which allows volumes that span or are striped across regions")
+	flag.BoolVar(&config.thinProvisioning, "pmemThinProvisioning", false, "node: use a thin pool in each volume group in LVM mode")
+	flag.UintVar(&config.thinPool.Overcommit, "pmemThinOvercommit", 100, "node: percentage of the thin pool size that may be allocated to volumes, more than 100 allows overcommitment")
+	flag.UintVar(&config.thinPool.Threshold, "pmemThinThreshold", 90, "node: data usage of a thin pool in percent at which no new volumes get created in it and warnings get logged")
+	flag.BoolVar(&config.lvmMetadataRecovery, "pmemLVMMetadataRecovery", false, "node: in LVM mode, back up the volume group metadata in the state directory and restore it during startup when it is corrupt; events about that are created for the node if the driver has permission")
+	flag.BoolVar(&config.allowShrink, "allowShrink", false, "node: in LVM mode, shrink unused volumes with ext4 when an admin sets the <drivername>/shrink-to annotation on their PV; the data beyond the new size is lost")
+	flag.DurationVar(&config.rescanInterval, "pmemRescanInterval", time.Minute, "node: how often to check for added regions or namespaces and set them up, zero disables it")
+	flag.DurationVar(&config.lockWatchdogThreshold, "lockWatchdogThreshold", 30*time.Minute, "node: log a warning and the goroutine stacks when a CSI call holds the lock for a volume longer than this, zero disables it")
+	flag.Var(&config.BusTypes, "pmemBusTypes", "node, wipe, defragment, force-convert-raw-namespaces, discover-pmem: comma-separated list of PMEM types to use, 'nvdimm' and/or 'cxl', all types by default")
+	flag.Var(&config.IOThrottle, "ioThrottle", "node, wipe, defragment: throttling of commands which wipe volumes or create file systems, as comma-separated list of 'ionice=<class>[:<level>]' and 'writeBPS=<size>' (cgroup v2 io.max limit for the device), disabled by default")
+	flag.Var(&config.NdctlBackend, "ndctlBackend", "node, wipe, defragment, force-convert-raw-namespaces, discover-pmem: how to access PMEM, 'libndctl' or 'sysfs' (reads sysfs and runs the ndctl command, works without cgo); default is libndctl if the binary was built with cgo")
 
 	// These options no longer have an effect. They don't get removed to
 	// keep old deployments working when upgrading only the image.
@@ -80,12 +111,12 @@ func Main() int {
 	config.Version = version
 	driver, err := GetCSIDriver(config)
 	if err != nil {
-		pmemcommon.ExitError("failed to initialize driver", err)
+		pmemcommon.ExitError("Failed to initialize driver", err)
 		return 1
 	}
 
 	if err = driver.Run(ctx); err != nil {
-		pmemcommon.ExitError("failed to run driver", err)
+		pmemcommon.ExitError("Failed to run driver", err)
 		return 1
 	}
 
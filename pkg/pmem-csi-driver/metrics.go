@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+var (
+	volumeInfoDesc = prometheus.NewDesc(
+		"pmem_csi_volume_info",
+		"Always 1 for each volume of the node, the labels describe the volume.",
+		[]string{"volume_id", "name", "device_mode", "usage"}, nil,
+	)
+	volumeSizeDesc = prometheus.NewDesc(
+		"pmem_csi_volume_size_bytes",
+		"Size of a volume of the node.",
+		[]string{"volume_id"}, nil,
+	)
+	volumeCreatedDesc = prometheus.NewDesc(
+		"pmem_csi_volume_created_timestamp_seconds",
+		"Time when a volume of the node was created, in seconds since the Unix epoch. Not available for volumes created by older releases.",
+		[]string{"volume_id"}, nil,
+	)
+)
+
+// volumeCollector turns the volumes of the node controller server
+// into metrics data.
+type volumeCollector struct {
+	cs *nodeControllerServer
+}
+
+// MustRegister adds the collector to the registry, using labels to
+// tag each sample with node and driver name like the
+// pmdmanager.CapacityCollector.
+func (vc volumeCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(vc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (vc volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeInfoDesc
+	ch <- volumeSizeDesc
+	ch <- volumeCreatedDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (vc volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, vol := range vc.cs.volumes() {
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			klog.Background().WithName("Prometheus Collect").Error(err, "Parse volume parameters", "volume-id", vol.ID)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			volumeInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			vol.ID, p.GetName(), string(p.GetDeviceMode()), string(p.GetUsage()),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			volumeSizeDesc,
+			prometheus.GaugeValue,
+			float64(vol.Size),
+			vol.ID,
+		)
+		if vol.Created != 0 {
+			ch <- prometheus.MustNewConstMetric(
+				volumeCreatedDesc,
+				prometheus.GaugeValue,
+				float64(vol.Created),
+				vol.ID,
+			)
+		}
+	}
+}
+
+var _ prometheus.Collector = volumeCollector{}
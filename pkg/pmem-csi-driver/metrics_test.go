@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestVolumeCollector(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil, pmdmanager.Reservation{})
+	registry := prometheus.NewPedanticRegistry()
+	volumeCollector{cs: cs}.MustRegister(registry, "node", "pmem-csi.intel.com")
+
+	count, err := testutil.GatherAndCount(registry)
+	require.NoError(t, err, "gather without volumes")
+	assert.Equal(t, 0, count, "metrics without volumes")
+
+	resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-metrics",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 1024 * 1024,
+		},
+		Parameters: map[string]string{parameters.UsageModel: string(parameters.UsageFileIO)},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := resp.Volume.VolumeId
+	vol := cs.getVolumeByID(volumeID)
+	assert.NotZero(t, vol.Created, "creation time")
+
+	expected := fmt.Sprintf(`# HELP pmem_csi_volume_info Always 1 for each volume of the node, the labels describe the volume.
+# TYPE pmem_csi_volume_info gauge
+pmem_csi_volume_info{device_mode="fake",driver_name="pmem-csi.intel.com",name="pvc-metrics",node="node",usage="FileIO",volume_id="%[1]s"} 1
+# HELP pmem_csi_volume_size_bytes Size of a volume of the node.
+# TYPE pmem_csi_volume_size_bytes gauge
+pmem_csi_volume_size_bytes{driver_name="pmem-csi.intel.com",node="node",volume_id="%[1]s"} %[2]d
+# HELP pmem_csi_volume_created_timestamp_seconds Time when a volume of the node was created, in seconds since the Unix epoch. Not available for volumes created by older releases.
+# TYPE pmem_csi_volume_created_timestamp_seconds gauge
+pmem_csi_volume_created_timestamp_seconds{driver_name="pmem-csi.intel.com",node="node",volume_id="%[1]s"} %[3]d
+`, volumeID, vol.Size, vol.Created)
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)), "metrics with volume")
+}
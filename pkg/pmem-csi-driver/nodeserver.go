@@ -13,14 +13,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
-	"k8s.io/utils/keymutex"
 	"k8s.io/utils/mount"
 
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
@@ -28,6 +29,7 @@ import (
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"github.com/intel/pmem-csi/pkg/imagefile"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
 	"github.com/intel/pmem-csi/pkg/volumepathhandler"
@@ -65,7 +67,7 @@ type nodeServer struct {
 
 var _ csi.NodeServer = &nodeServer{}
 var _ grpcserver.Service = &nodeServer{}
-var volumeMutex = keymutex.NewHashed(-1)
+var volumeMutex = newVolumeLock("node-server")
 
 func NewNodeServer(cs *nodeControllerServer, mountDirectory string) *nodeServer {
 	return &nodeServer{
@@ -77,6 +79,20 @@ func NewNodeServer(cs *nodeControllerServer, mountDirectory string) *nodeServer
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 		cs:             cs,
 		mounter:        mount.New(""),
@@ -89,12 +105,21 @@ func (ns *nodeServer) RegisterService(rpcServer *grpc.Server) {
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	segments := map[string]string{
+		DriverTopologyKey:           ns.cs.nodeID,
+		DriverDeviceModeTopologyKey: string(ns.cs.dm.GetMode()),
+	}
+	// Each NUMA node gets its own segment, for example
+	// pmem-csi.intel.com/numa-0=true. Kubelet only calls
+	// NodeGetInfo during driver registration, watchNumaTopology
+	// keeps the resulting node labels up-to-date.
+	for key, value := range ns.cs.numaSegments(ctx) {
+		segments[key] = value
+	}
 	return &csi.NodeGetInfoResponse{
 		NodeId: ns.cs.nodeID,
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				DriverTopologyKey: ns.cs.nodeID,
-			},
+			Segments: segments,
 		},
 	}, nil
 }
@@ -106,10 +131,97 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 }
 
 func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
+	ctx = klog.NewContext(ctx, logger)
+
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	dm, device, err := ns.getVolumeDevice(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := volumeUsage(volumePath, device)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %q: %v", volumePath, err)
+		}
+		return nil, status.Errorf(codes.Internal, "volume path %q: %v", volumePath, err)
+	}
+	resp := &csi.NodeGetVolumeStatsResponse{
+		Usage: usage,
+	}
+
+	if mediaErrors, ok := dm.(pmdmanager.MediaErrors); ok {
+		badBlocks, err := mediaErrors.VolumeBadBlocks(ctx, volumeID)
+		if err != nil {
+			// The condition is optional, so report just the usage.
+			logger.Error(err, "Checking for media errors failed")
+		} else {
+			resp.VolumeCondition = &csi.VolumeCondition{}
+			if badBlocks > 0 {
+				resp.VolumeCondition.Abnormal = true
+				resp.VolumeCondition.Message = fmt.Sprintf("%d blocks of %d bytes with media errors in the PMEM of the volume", badBlocks, ndctl.BadBlockSize)
+			}
+		}
+	}
+
+	return resp, nil
+}
+
+// volumeUsage returns statistics for the file system mounted at the
+// path or, for a raw block volume, just the size of the device.
+func volumeUsage(path string, device *pmdmanager.PmemDeviceInfo) ([]*csi.VolumeUsage, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return nil, err
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFBLK {
+		return []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: int64(device.Size),
+			},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(path, &statfs); err != nil {
+		return nil, err
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * int64(statfs.Bsize),
+			Available: int64(statfs.Bavail) * int64(statfs.Bsize),
+			Used:      int64(statfs.Blocks-statfs.Bfree) * int64(statfs.Bsize),
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	resp, err := ns.nodePublishVolume(ctx, req)
+	if err != nil {
+		ns.cs.volumeEvent(podRef(req.GetVolumeContext()), EventReasonVolumePublishingFailed,
+			failureMessage("Publishing", volumeName(req.GetVolumeContext(), req.GetVolumeId()), ns.cs.nodeID, err))
+	}
+	return resp, err
+}
+
+func (ns *nodeServer) nodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
 	ctx = klog.NewContext(ctx, logger)
@@ -126,10 +238,8 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	// Serialize by VolumeId
-	volumeMutex.LockKey(volumeID)
-	defer func() {
-		_ = volumeMutex.UnlockKey(volumeID)
-	}()
+	unlock := volumeMutex.lock(ctx, volumeID)
+	defer unlock()
 
 	var ephemeral bool
 	var device *pmdmanager.PmemDeviceInfo
@@ -148,9 +258,19 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		"read-only", readOnly,
 		"mount-flags", mountFlags,
 		"fs-type", fsType,
-		"volume-context", volumeContext,
+		"volume-context", parameters.VolumeContext(volumeContext).Redacted(),
 	)
 
+	// Not used yet, but already validated so that problems are
+	// reported early.
+	tokens, err := parameters.ParseServiceAccountTokens(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for audience, token := range tokens {
+		logger.V(5).Info("Received service account token", "audience", audience, "expiration", token.ExpirationTimestamp)
+	}
+
 	// Kubernetes v1.16+ would request ephemeral volumes via VolumeContext
 	val, ok := req.GetVolumeContext()[parameters.Ephemeral]
 	if ok {
@@ -168,7 +288,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %v", volumeID, err)
 		}
 		_, ok := req.GetVolumeContext()[volumeProvisionerIdentity]
-		ephemeral = device == nil && !ok && len(srcPath) == 0
+		ephemeral = device == nil && !ok && len(srcPath) == 0 && !pmdmanager.IsStaticVolumeID(volumeID)
 	}
 
 	var volumeParameters parameters.Volume
@@ -196,17 +316,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		volumeParameters = v
 
-		dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
-		if err != nil {
+		if _, device, err = ns.getVolumeDevice(ctx, volumeID); err != nil {
 			return nil, err
 		}
-
-		if device, err = dm.GetDevice(ctx, volumeID); err != nil {
-			if errors.Is(err, pmemerr.DeviceNotFound) {
-				return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
-			}
-			return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
-		}
 		mountFlags = append(mountFlags, "bind")
 	}
 
@@ -372,16 +484,19 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 
 	// Serialize by VolumeId
-	volumeMutex.LockKey(volumeID)
-	defer func() {
-		_ = volumeMutex.UnlockKey(volumeID)
-	}()
+	unlock := volumeMutex.lock(ctx, volumeID)
+	defer unlock()
 
 	var vol *nodeVolume
 	if vol = ns.cs.getVolumeByID(volumeID); vol == nil {
 		// For ephemeral volumes we use volumeID as volume name.
 		vol = ns.cs.getVolumeByName(volumeID)
 	}
+	if vol == nil && pmdmanager.IsStaticVolumeID(volumeID) {
+		// Static volumes are not in the driver state, only
+		// need to be unmounted.
+		vol = &nodeVolume{ID: volumeID, Params: map[string]string{}}
+	}
 
 	// The CSI spec 1.2 requires that the SP returns NOT_FOUND
 	// when the volume is not known.  This is problematic for
@@ -498,6 +613,16 @@ func (ns *nodeServer) nodeUnpublishKataContainerImage(ctx context.Context, req *
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	resp, err := ns.nodeStageVolume(ctx, req)
+	if err != nil {
+		name := volumeName(req.GetVolumeContext(), req.GetVolumeId())
+		ns.cs.volumeEvent(pvcRef(req.GetVolumeContext(), name), EventReasonVolumeStagingFailed,
+			failureMessage("Staging", name, ns.cs.nodeID, err))
+	}
+	return resp, err
+}
+
+func (ns *nodeServer) nodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	stagingtargetPath := req.GetStagingTargetPath()
 	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID, "staging-target-path", stagingtargetPath)
@@ -532,10 +657,8 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}
 
 	// Serialize by VolumeId
-	volumeMutex.LockKey(req.GetVolumeId())
-	defer func() {
-		_ = volumeMutex.UnlockKey(req.GetVolumeId())
-	}()
+	unlock := volumeMutex.lock(ctx, req.GetVolumeId())
+	defer unlock()
 
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 	logger.V(3).Info("Staging volume",
@@ -543,19 +666,11 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		"mount-options", mountOptions,
 	)
 
-	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+	_, device, err := ns.getVolumeDevice(ctx, volumeID)
 	if err != nil {
 		return nil, err
 	}
 
-	device, err := dm.GetDevice(ctx, volumeID)
-	if err != nil {
-		if errors.Is(err, pmemerr.DeviceNotFound) {
-			return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
-		}
-		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
-	}
-
 	// Check does devicepath already contain a filesystem?
 	existingFsType, err := determineFilesystemType(ctx, device.Path)
 	if err != nil {
@@ -608,24 +723,15 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 
 	// Serialize by VolumeId
-	volumeMutex.LockKey(volumeID)
-	defer func() {
-		_ = volumeMutex.UnlockKey(volumeID)
-	}()
+	unlock := volumeMutex.lock(ctx, volumeID)
+	defer unlock()
 
 	logger.V(3).Info("Unstage volume")
-	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
-	if err != nil {
-		return nil, err
-	}
 	// by spec, we have to return OK if asked volume is not mounted on asked path,
 	// so we look up the current device by volumeID and see is that device
 	// mounted on staging target path
-	if _, err := dm.GetDevice(ctx, volumeID); err != nil {
-		if errors.Is(err, pmemerr.DeviceNotFound) {
-			return nil, status.Errorf(codes.NotFound, "no device found with volume id '%s': %s", volumeID, err.Error())
-		}
-		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id '%s': %s", volumeID, err.Error())
+	if _, _, err := ns.getVolumeDevice(ctx, volumeID); err != nil {
+		return nil, err
 	}
 
 	// Find out device name for mounted path
@@ -723,7 +829,9 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 		return fmt.Errorf("Unsupported filesystem '%s'. Supported filesystems types: 'xfs', 'ext4'", fsType)
 	}
 
-	output, err := pmemexec.RunCommand(ctx, cmd, args...)
+	start := time.Now()
+	output, err := pmemexec.RunThrottled(ctx, device.Path, cmd, args...)
+	pmdmanager.ObserveOperation(pmdmanager.OperationMkfs, start, err)
 	if err != nil {
 		return fmt.Errorf("mkfs failed: output:[%s] err:[%v]", output, err)
 	}
@@ -766,7 +874,10 @@ func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string,
 		args = append(args, "-o", strings.Join(mountOptions, ","))
 	}
 	args = append(args, sourcePath, targetPath)
-	if _, err := pmemexec.RunCommand(ctx, "mount", args...); err != nil {
+	start := time.Now()
+	_, err = pmemexec.RunCommand(ctx, "mount", args...)
+	pmdmanager.ObserveOperation(pmdmanager.OperationMount, start, err)
+	if err != nil {
 		return fmt.Errorf("mount filesystem failed: %s", err.Error())
 	}
 
@@ -790,7 +901,7 @@ func (ns *nodeServer) getDeviceManagerForVolume(ctx context.Context, id string)
 
 	dm := ns.cs.dm
 	if v.GetDeviceMode() != dm.GetMode() {
-		dm, err = pmdmanager.New(ctx, v.GetDeviceMode(), 0)
+		dm, err = pmdmanager.New(ctx, v.GetDeviceMode(), 0, pmdmanager.Options{})
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize device manager for volume %q, volume mode %q: %v", id, v.GetDeviceMode(), err)
 		}
@@ -799,6 +910,41 @@ func (ns *nodeServer) getDeviceManagerForVolume(ctx context.Context, id string)
 	return dm, nil
 }
 
+// getVolumeDevice returns the device of a volume, including static
+// volumes which were created outside of PMEM-CSI, and the device
+// manager for it. There is no device manager for static volumes.
+// Errors are gRPC status errors.
+func (ns *nodeServer) getVolumeDevice(ctx context.Context, volumeID string) (pmdmanager.PmemDeviceManager, *pmdmanager.PmemDeviceInfo, error) {
+	var dm pmdmanager.PmemDeviceManager
+	var device *pmdmanager.PmemDeviceInfo
+	var err error
+	if pmdmanager.IsStaticVolumeID(volumeID) {
+		if _, _, err := pmdmanager.ParseStaticVolumeID(volumeID); err != nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "static volume: %v", err)
+		}
+		device, err = pmdmanager.GetStaticDevice(ctx, volumeID)
+	} else {
+		dm, err = ns.getDeviceManagerForVolume(ctx, volumeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		device, err = dm.GetDevice(ctx, volumeID)
+		if err == nil {
+			err = ns.cs.getVolumeByID(volumeID).checkDevice(device)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			return nil, nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
+		}
+		if errors.Is(err, pmemerr.DeviceChanged) {
+			return nil, nil, status.Errorf(codes.FailedPrecondition, "device of volume id %q was replaced: %v", volumeID, err)
+		}
+		return nil, nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
+	}
+	return dm, device, nil
+}
+
 // This is based on function used in LV-CSI driver
 func determineFilesystemType(ctx context.Context, devicePath string) (string, error) {
 	if devicePath == "" {
@@ -0,0 +1,103 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// mediaErrorsDM reports the same number of bad blocks or the same
+// error for all volumes.
+type mediaErrorsDM struct {
+	pmdmanager.PmemDeviceManager
+	badBlocks uint64
+	err       error
+}
+
+var _ pmdmanager.MediaErrors = mediaErrorsDM{}
+
+func (dm mediaErrorsDM) RegionBadBlocks(ctx context.Context) (map[string]uint64, error) {
+	return nil, dm.err
+}
+
+func (dm mediaErrorsDM) VolumeBadBlocks(ctx context.Context, volumeId string) (uint64, error) {
+	return dm.badBlocks, dm.err
+}
+
+func TestNodeGetVolumeStatsBadBlocks(t *testing.T) {
+	for name, tc := range map[string]struct {
+		badBlocks         uint64
+		err               error
+		noMediaErrors     bool
+		expectedCondition *csi.VolumeCondition
+	}{
+		"no media errors": {
+			expectedCondition: &csi.VolumeCondition{},
+		},
+		"media errors": {
+			badBlocks: 3,
+			expectedCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  "3 blocks of 512 bytes with media errors in the PMEM of the volume",
+			},
+		},
+		"check failed": {
+			err: errors.New("fake error"),
+		},
+		"not supported": {
+			noMediaErrors: true,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			fake, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+			require.NoError(t, err, "create device manager")
+			dm := fake
+			if !tc.noMediaErrors {
+				dm = mediaErrorsDM{PmemDeviceManager: fake, badBlocks: tc.badBlocks, err: tc.err}
+			}
+			sm, err := pmemstate.NewFileState(t.TempDir())
+			require.NoError(t, err, "create state")
+			cs := NewNodeControllerServer(ctx, "node", dm, sm, pmdmanager.Reservation{})
+			resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+				Name: "pvc-stats",
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+					},
+				},
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: 1024 * 1024,
+				},
+			})
+			require.NoError(t, err, "create volume")
+			ns := NewNodeServer(cs, t.TempDir())
+
+			stats, err := ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   resp.Volume.VolumeId,
+				VolumePath: t.TempDir(),
+			})
+			require.NoError(t, err, "get volume stats")
+			assert.NotEmpty(t, stats.Usage, "usage is reported regardless of media errors")
+			assert.Equal(t, tc.expectedCondition, stats.VolumeCondition, "volume condition")
+		})
+	}
+}
@@ -7,9 +7,11 @@ SPDX-License-Identifier: Apache-2.0
 package parameters
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -27,6 +29,12 @@ const (
 	PersistencyModel = "persistencyModel"
 	Size             = "size"
 	DeviceMode       = "deviceMode"
+	Pool             = "pool"
+	Stripes          = "stripes"
+	NumaNode         = "numaNode"
+	Bus              = "bus"
+	Alignment        = "alignment"
+	VerifyErase      = "verifyErase"
 
 	// Added in PMEM-CSI 1.1.0.
 	UsageModel           = "usage"
@@ -40,6 +48,23 @@ const (
 	// Additional, unknown parameters that are okay.
 	PodInfoPrefix = "csi.storage.k8s.io/"
 
+	// external-provisioner adds these keys to CreateVolumeRequest.Parameters
+	// when invoked with --extra-create-metadata. PMEM-CSI copies the PVC
+	// keys into the volume context.
+	PVCName      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
+	// Kubernetes adds these keys to NodePublishRequest.VolumeContext
+	// when the CSIDriver object has podInfoOnMount.
+	PodName      = "csi.storage.k8s.io/pod.name"
+	PodNamespace = "csi.storage.k8s.io/pod.namespace"
+	PodUID       = "csi.storage.k8s.io/pod.uid"
+
+	// Kubernetes v1.20+ adds this key to NodePublishRequest.VolumeContext
+	// when the CSIDriver object has token requests. The value is a JSON
+	// map from audience to token.
+	ServiceAccountTokens = "csi.storage.k8s.io/serviceAccount.tokens"
+
 	// Added by https://github.com/kubernetes-csi/external-provisioner/blob/feb67766f5e6af7db5c03ac0f0b16255f696c350/pkg/controller/controller.go#L584
 	ProvisionerID = "storage.kubernetes.io/csiProvisionerIdentity"
 
@@ -63,18 +88,31 @@ var valid = map[Origin][]string{
 	// Parameters from Kubernetes and users for a persistent volume.
 	CreateVolumeOrigin: []string{
 		EraseAfter,
+		VerifyErase,
 		KataContainers,
 		UsageModel,
 		PersistencyModel,
+		Pool,
+		Stripes,
+		NumaNode,
+		Bus,
+
+		// PVC and PV name from external-provisioner.
+		PodInfoPrefix,
 	},
 
 	// Parameters from Kubernetes and users.
 	EphemeralVolumeOrigin: []string{
 		EraseAfter,
+		VerifyErase,
 		KataContainers,
 		UsageModel,
 		PodInfoPrefix,
 		Size,
+		Pool,
+		Stripes,
+		NumaNode,
+		Bus,
 	},
 
 	// The volume context prepared by CreateVolume. We replicate
@@ -84,9 +122,14 @@ var valid = map[Origin][]string{
 	// Kubernetes adds pod info and provisioner ID.
 	PersistentVolumeOrigin: []string{
 		EraseAfter,
+		VerifyErase,
 		KataContainers,
 		PersistencyModel,
 		UsageModel,
+		Pool,
+		Stripes,
+		NumaNode,
+		Bus,
 
 		Name,
 		PodInfoPrefix,
@@ -97,12 +140,18 @@ var valid = map[Origin][]string{
 	// which is handled separately.
 	NodeVolumeOrigin: []string{
 		EraseAfter,
+		VerifyErase,
 		KataContainers,
 		UsageModel,
 		Name,
 		PersistencyModel,
 		Size,
 		DeviceMode,
+		Pool,
+		Stripes,
+		NumaNode,
+		Bus,
+		Alignment,
 	},
 }
 
@@ -112,12 +161,18 @@ var valid = map[Origin][]string{
 // the default.
 type Volume struct {
 	EraseAfter     *bool
+	VerifyErase    *bool
 	KataContainers *bool
 	Name           *string
 	Persistency    *Persistency
 	Size           *int64
 	DeviceMode     *api.DeviceMode
 	Usage          *Usage
+	Pool           *string
+	Stripes        *uint
+	NumaNode       *uint
+	Bus            *string
+	Alignment      *uint64
 }
 
 // VolumeContext represents the same settings as a string map.
@@ -193,6 +248,12 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
 			}
 			result.EraseAfter = &b
+		case VerifyErase:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.VerifyErase = &b
 		case Ephemeral:
 			b, err := strconv.ParseBool(value)
 			if err != nil {
@@ -208,6 +269,39 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as DeviceMode: %v", key, value, err)
 			}
 			result.DeviceMode = &mode
+		case Pool:
+			if value == "" {
+				return result, fmt.Errorf("parameter %q: empty pool name", key)
+			}
+			result.Pool = &value
+		case Stripes:
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as positive integer: %v", key, value, err)
+			}
+			if n == 0 {
+				return result, fmt.Errorf("parameter %q: must be at least 1", key)
+			}
+			stripes := uint(n)
+			result.Stripes = &stripes
+		case NumaNode:
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as non-negative integer: %v", key, value, err)
+			}
+			node := uint(n)
+			result.NumaNode = &node
+		case Bus:
+			if value == "" {
+				return result, fmt.Errorf("parameter %q: empty bus name", key)
+			}
+			result.Bus = &value
+		case Alignment:
+			n, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as positive integer: %v", key, value, err)
+			}
+			result.Alignment = &n
 		case ProvisionerID:
 		default:
 			if !strings.HasPrefix(key, PodInfoPrefix) {
@@ -244,6 +338,9 @@ func (v Volume) ToContext() VolumeContext {
 	if v.EraseAfter != nil {
 		result[EraseAfter] = fmt.Sprintf("%v", *v.EraseAfter)
 	}
+	if v.VerifyErase != nil {
+		result[VerifyErase] = fmt.Sprintf("%v", *v.VerifyErase)
+	}
 	if v.Name != nil {
 		result[Name] = *v.Name
 	}
@@ -262,6 +359,21 @@ func (v Volume) ToContext() VolumeContext {
 	if v.Usage != nil {
 		result[UsageModel] = string(*v.Usage)
 	}
+	if v.Pool != nil {
+		result[Pool] = *v.Pool
+	}
+	if v.Stripes != nil {
+		result[Stripes] = fmt.Sprintf("%d", *v.Stripes)
+	}
+	if v.NumaNode != nil {
+		result[NumaNode] = fmt.Sprintf("%d", *v.NumaNode)
+	}
+	if v.Bus != nil {
+		result[Bus] = *v.Bus
+	}
+	if v.Alignment != nil {
+		result[Alignment] = fmt.Sprintf("%d", *v.Alignment)
+	}
 
 	return result
 }
@@ -273,6 +385,15 @@ func (v Volume) GetEraseAfter() bool {
 	return true
 }
 
+// GetVerifyErase returns true if wiped data gets read back when
+// deleting the volume.
+func (v Volume) GetVerifyErase() bool {
+	if v.VerifyErase != nil {
+		return *v.VerifyErase
+	}
+	return false
+}
+
 func (v Volume) GetPersistency() Persistency {
 	if v.Persistency != nil {
 		return *v.Persistency
@@ -315,3 +436,91 @@ func (v Volume) GetUsage() Usage {
 	}
 	return UsageAppDirect
 }
+
+// GetPool returns the name of the pool, the empty string if the
+// volume may use any PMEM.
+func (v Volume) GetPool() string {
+	if v.Pool != nil {
+		return *v.Pool
+	}
+	return ""
+}
+
+// GetStripes returns across how many regions a volume gets striped,
+// 1 if it is not striped.
+func (v Volume) GetStripes() uint {
+	if v.Stripes != nil {
+		return *v.Stripes
+	}
+	return 1
+}
+
+// GetNumaNode returns the NUMA node whose PMEM has to be used for
+// the volume, -1 if any PMEM may be used.
+func (v Volume) GetNumaNode() int {
+	if v.NumaNode != nil {
+		return int(*v.NumaNode)
+	}
+	return -1
+}
+
+// GetBus returns the name of the NVDIMM bus whose PMEM has to be
+// used for the volume, the empty string if any PMEM may be used.
+func (v Volume) GetBus() string {
+	if v.Bus != nil {
+		return *v.Bus
+	}
+	return ""
+}
+
+// GetAlignment returns the mapping alignment that was used for the
+// namespace of the volume, 0 if unknown or not applicable.
+func (v Volume) GetAlignment() uint64 {
+	if v.Alignment != nil {
+		return *v.Alignment
+	}
+	return 0
+}
+
+// ServiceAccountToken is a token for the service account of the pod
+// which uses a volume, as provided by kubelet for one audience.
+type ServiceAccountToken struct {
+	Token               string    `json:"token"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+// ParseServiceAccountTokens extracts the service account tokens from
+// the volume context of NodePublishVolume. The result is empty when
+// the CSIDriver object has no token requests.
+func ParseServiceAccountTokens(volumeContext map[string]string) (map[string]ServiceAccountToken, error) {
+	value, ok := volumeContext[ServiceAccountTokens]
+	if !ok || value == "" {
+		return nil, nil
+	}
+	var tokens map[string]ServiceAccountToken
+	if err := json.Unmarshal([]byte(value), &tokens); err != nil {
+		return nil, fmt.Errorf("parameter %q: %v", ServiceAccountTokens, err)
+	}
+	for audience, token := range tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("parameter %q: empty token for audience %q", ServiceAccountTokens, audience)
+		}
+	}
+	return tokens, nil
+}
+
+// Redacted returns a copy of the volume context where secrets like
+// service account tokens are replaced, for use in log output.
+func (c VolumeContext) Redacted() VolumeContext {
+	if _, ok := c[ServiceAccountTokens]; !ok {
+		return c
+	}
+	result := VolumeContext{}
+	for key, value := range c {
+		if key == ServiceAccountTokens {
+			value = "<redacted>"
+		}
+		result[key] = value
+	}
+	return result
+}
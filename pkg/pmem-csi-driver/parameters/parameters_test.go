@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 
@@ -23,6 +24,11 @@ func TestParameters(t *testing.T) {
 	gigNum := int64(1 * 1024 * 1024 * 1024)
 	appDirect := UsageAppDirect
 	fileIO := UsageFileIO
+	fast := "fast"
+	two := uint(2)
+	one := uint(1)
+	bus := "ndbus1"
+	gigAlign := uint64(1024 * 1024 * 1024)
 
 	tests := []struct {
 		name       string
@@ -45,6 +51,19 @@ func TestParameters(t *testing.T) {
 			},
 		},
 
+		{
+			name:   "create-metadata",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfter:   "true",
+				PVCName:      "pvc",
+				PVCNamespace: "default",
+			},
+			parameters: Volume{
+				EraseAfter: &yes,
+			},
+		},
+
 		// Various parameters which are not allowed in this context.
 		{
 			name:   "invalid-parameter-create",
@@ -110,6 +129,126 @@ func TestParameters(t *testing.T) {
 			},
 		},
 
+		// Pools.
+		{
+			name:   "valid-pool",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Pool: "fast",
+			},
+			parameters: Volume{
+				Pool: &fast,
+			},
+		},
+		{
+			name:   "empty-pool",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Pool: "",
+			},
+			err: "parameter \"pool\": empty pool name",
+		},
+
+		// Stripes.
+		{
+			name:   "valid-stripes",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Stripes: "2",
+			},
+			parameters: Volume{
+				Stripes: &two,
+			},
+		},
+		{
+			name:   "zero-stripes",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Stripes: "0",
+			},
+			err: "parameter \"stripes\": must be at least 1",
+		},
+
+		// NUMA node.
+		{
+			name:   "valid-numa-node",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NumaNode: "1",
+			},
+			parameters: Volume{
+				NumaNode: &one,
+			},
+		},
+		{
+			name:   "negative-numa-node",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NumaNode: "-1",
+			},
+			err: "parameter \"numaNode\": failed to parse \"-1\" as non-negative integer: strconv.ParseUint: parsing \"-1\": invalid syntax",
+		},
+
+		// Bus.
+		{
+			name:   "valid-bus",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Bus: "ndbus1",
+			},
+			parameters: Volume{
+				Bus: &bus,
+			},
+		},
+		{
+			name:   "empty-bus",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Bus: "",
+			},
+			err: "parameter \"bus\": empty bus name",
+		},
+
+		// Alignment.
+		{
+			name:   "valid-alignment",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				Alignment: "1073741824",
+			},
+			parameters: Volume{
+				Alignment: &gigAlign,
+			},
+		},
+		{
+			name:   "alignment-from-user",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Alignment: "1073741824",
+			},
+			err: "parameter \"alignment\" invalid in this context",
+		},
+
+		// Erase verification.
+		{
+			name:   "valid-verify-erase",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				VerifyErase: "true",
+			},
+			parameters: Volume{
+				VerifyErase: &yes,
+			},
+		},
+		{
+			name:   "invalid-verify-erase",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				VerifyErase: "maybe",
+			},
+			err: "parameter \"verifyErase\": failed to parse \"maybe\" as boolean: strconv.ParseBool: parsing \"maybe\": invalid syntax",
+		},
+
 		// Parse errors for size.
 		{
 			name:   "invalid-size-suffix",
@@ -179,3 +318,30 @@ func TestParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestServiceAccountTokens(t *testing.T) {
+	tokens, err := ParseServiceAccountTokens(VolumeContext{})
+	assert.NoError(t, err, "no tokens")
+	assert.Empty(t, tokens, "no tokens")
+
+	volumeContext := VolumeContext{
+		Name:                 "pvc-1",
+		ServiceAccountTokens: `{"pmem-csi.example.com":{"token":"secret","expirationTimestamp":"2021-01-01T00:00:00Z"}}`,
+	}
+	tokens, err = ParseServiceAccountTokens(volumeContext)
+	if assert.NoError(t, err, "parse tokens") {
+		assert.Equal(t, map[string]ServiceAccountToken{
+			"pmem-csi.example.com": {
+				Token:               "secret",
+				ExpirationTimestamp: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		}, tokens)
+	}
+	assert.Equal(t, VolumeContext{Name: "pvc-1", ServiceAccountTokens: "<redacted>"}, volumeContext.Redacted(), "redacted")
+	assert.Contains(t, volumeContext[ServiceAccountTokens], "secret", "original unmodified")
+
+	_, err = ParseServiceAccountTokens(VolumeContext{ServiceAccountTokens: `{"pmem-csi.example.com":{}}`})
+	assert.Error(t, err, "empty token")
+	_, err = ParseServiceAccountTokens(VolumeContext{ServiceAccountTokens: "foo"})
+	assert.Error(t, err, "invalid JSON")
+}
@@ -10,6 +10,7 @@ package pmemcsidriver
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -17,17 +18,28 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"github.com/intel/pmem-csi/pkg/k8sutil"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+	"github.com/intel/pmem-csi/pkg/tracing"
 	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
 
@@ -45,7 +57,7 @@ type DriverMode string
 
 func (mode *DriverMode) Set(value string) error {
 	switch value {
-	case string(Node), string(Controller), string(ForceConvertRawNamespaces):
+	case string(Node), string(Controller), string(ForceConvertRawNamespaces), string(DiscoverPMEM), string(Wipe), string(Defragment):
 		*mode = DriverMode(value)
 	default:
 		// The flag package will add the value to the final output, no need to do it here.
@@ -58,6 +70,47 @@ func (mode *DriverMode) String() string {
 	return string(*mode)
 }
 
+// externalPrefix selects an external device manager in the
+// -deviceManager value, followed by the path of its Unix domain
+// socket.
+const externalPrefix = "external://"
+
+// deviceManagerFlag sets the device mode and, for an external device
+// manager, also its endpoint.
+type deviceManagerFlag struct {
+	cfg *Config
+}
+
+func (d deviceManagerFlag) Set(value string) error {
+	if strings.HasPrefix(value, externalPrefix) {
+		path := strings.TrimPrefix(value, externalPrefix)
+		if path == "" {
+			return errors.New("missing socket path for external device manager")
+		}
+		d.cfg.DeviceManager = api.DeviceModeExternal
+		d.cfg.ExternalDeviceManager = "unix://" + path
+		return nil
+	}
+	if err := d.cfg.DeviceManager.Set(value); err != nil {
+		return err
+	}
+	if d.cfg.DeviceManager == api.DeviceModeExternal {
+		return errors.New("external device manager needs a socket path, use " + externalPrefix + "<path>")
+	}
+	d.cfg.ExternalDeviceManager = ""
+	return nil
+}
+
+func (d deviceManagerFlag) String() string {
+	if d.cfg == nil {
+		return ""
+	}
+	if d.cfg.DeviceManager == api.DeviceModeExternal {
+		return externalPrefix + strings.TrimPrefix(d.cfg.ExternalDeviceManager, "unix://")
+	}
+	return string(d.cfg.DeviceManager)
+}
+
 // The mode strings are part of the metrics API (-> csi_controller,
 // csi_node as subsystem), do not change them!
 const (
@@ -67,11 +120,23 @@ const (
 	Controller DriverMode = "webhooks"
 	// Convert each raw namespace into fsdax.
 	ForceConvertRawNamespaces = "force-convert-raw-namespaces"
+	// Add the node selector labels to the node if it has PMEM.
+	DiscoverPMEM = "discover-pmem"
+	// Remove all volumes, volume groups and namespaces created by the driver.
+	Wipe = "wipe"
+	// Move volumes in direct mode such that free space becomes contiguous.
+	Defragment = "defragment"
 )
 
 var (
 	//PmemDriverTopologyKey key to use for topology constraint
 	DriverTopologyKey = ""
+	// DriverNumaTopologyPrefix is followed by the number of a NUMA
+	// node to form an additional topology key.
+	DriverNumaTopologyPrefix = ""
+	// DriverDeviceModeTopologyKey has the device mode of the node
+	// driver as value.
+	DriverDeviceModeTopologyKey = ""
 
 	// Mirrored after https://github.com/kubernetes/component-base/blob/dae26a37dccb958eac96bc9dedcecf0eb0690f0f/metrics/version.go#L21-L37
 	// just with less information.
@@ -83,11 +148,22 @@ var (
 		[]string{"version"},
 	)
 
+	// eraseVerifications counts how often the full erasure of a
+	// deleted volume was verified.
+	eraseVerifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_erase_verifications_total",
+			Help: "Number of fully erased volumes whose data was read back, labeled by result (success or failure).",
+		},
+		[]string{"result"},
+	)
+
 	simpleMetrics = prometheus.NewPedanticRegistry()
 )
 
 func init() {
 	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(eraseVerifications)
 	simpleMetrics.MustRegister(buildInfo)
 }
 
@@ -103,12 +179,48 @@ type Config struct {
 	Mode DriverMode
 	//DeviceManager device manager to use
 	DeviceManager api.DeviceMode
+	// ExternalDeviceManager is the endpoint of an external device manager
+	ExternalDeviceManager string
 	//Directory where to persist the node driver state
 	StateBasePath string
 	//Version driver release version
 	Version string
 	// PmemPercentage percentage of space to be used by the driver in each PMEM region
 	PmemPercentage uint
+	// PmemReserved is PMEM that the node does not report as available
+	PmemReserved pmdmanager.Reservation
+	// SystemRAMPercentage percentage of each PMEM region that gets onlined as system RAM
+	SystemRAMPercentage uint
+	// BusTypes limits the driver to PMEM of these types, empty for all types
+	BusTypes ndctl.BusTypes
+	// NdctlBackend determines how PMEM gets accessed, empty for the default
+	NdctlBackend ndctl.Backend
+	// PmemGoal provisions NVDIMMs without regions during raw namespace conversion
+	PmemGoal pmdmanager.Goal
+	// IOThrottle limits commands which wipe volumes or create file systems
+	IOThrottle pmemexec.IOThrottle
+	// Pools are named subsets of the regions that volumes can ask for
+	Pools pmdmanager.Pools
+	// VolumeGroupLayout determines the volume groups in LVM mode
+	VolumeGroupLayout pmdmanager.VolumeGroupLayout
+	// WarmPool defines the namespaces that are kept ready in direct mode
+	WarmPool pmdmanager.WarmPool
+
+	// thin provisioning in LVM mode
+	thinProvisioning bool
+	thinPool         pmdmanager.ThinPool
+
+	// back up LVM metadata and restore it when corrupt
+	lvmMetadataRecovery bool
+
+	// how often to check for new PMEM, zero disables it
+	rescanInterval time.Duration
+
+	// when to report a volume lock as stuck, zero disables it
+	lockWatchdogThreshold time.Duration
+
+	// shrink volumes when their PV has the shrink annotation
+	allowShrink bool
 
 	// KubeAPIQPS is the average rate of requests to the Kubernetes API server,
 	// enforced locally in client-go.
@@ -121,14 +233,43 @@ type Config struct {
 	// parameters for rescheduler and raw namespace conversion
 	nodeSelector types.NodeSelector
 
+	// only check what raw namespace conversion would do
+	dryRun bool
+
+	// parameters for rescheduler leader election
+	leaderElection          bool
+	leaderElectionNamespace string
+
 	// parameters for Prometheus metrics
 	metricsListen string
 	metricsPath   string
+	// Serve metrics via HTTPS with this certificate and key,
+	// optionally also requiring client certificates signed by
+	// the CA.
+	metricsCertFile     string
+	metricsKeyFile      string
+	metricsClientCAFile string
+
+	// export OpenTelemetry traces as configured by the OTEL_*
+	// env variables
+	enableTracing bool
+
+	// serve pprof and goroutine stacks for debugging
+	debugListen string
 }
 
 type csiDriver struct {
 	cfg       Config
 	gatherers prometheus.Gatherers
+	// readyChecks must all pass before readyzPath reports the
+	// driver as ready.
+	readyChecks []readinessCheck
+}
+
+// readinessCheck is one of the checks behind readyzPath.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
 }
 
 func GetCSIDriver(cfg Config) (*csiDriver, error) {
@@ -141,11 +282,13 @@ func GetCSIDriver(cfg Config) (*csiDriver, error) {
 	if cfg.Mode == Node && cfg.NodeID == "" {
 		return nil, errors.New("node ID configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.StateBasePath == "" {
+	if (cfg.Mode == Node || cfg.Mode == Wipe || cfg.Mode == Defragment) && cfg.StateBasePath == "" {
 		cfg.StateBasePath = "/var/lib/" + cfg.DriverName
 	}
 
 	DriverTopologyKey = cfg.DriverName + "/node"
+	DriverNumaTopologyPrefix = cfg.DriverName + "/numa-"
+	DriverDeviceModeTopologyKey = cfg.DriverName + "/" + api.DeviceModeLabel
 
 	// Should GetCSIDriver get called more than once per process,
 	// all of them will record their version.
@@ -175,6 +318,33 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 	defer cancel()
 	logger := klog.FromContext(ctx)
 
+	// Applies to all ndctl contexts, regardless of the mode.
+	ndctl.SelectBusTypes(csid.cfg.BusTypes)
+	ndctl.SelectBackend(csid.cfg.NdctlBackend)
+	pmemexec.SelectIOThrottle(csid.cfg.IOThrottle)
+
+	if csid.cfg.enableTracing {
+		shutdown, err := tracing.Setup(ctx, "pmem-csi-driver", csid.cfg.Version)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// The context is canceled at this point.
+			if err := shutdown(context.Background()); err != nil {
+				logger.Error(err, "Flushing traces failed")
+			}
+		}()
+		logger.V(2).Info("OpenTelemetry tracing enabled")
+	}
+
+	// Started early, so hangs during the initialization can also
+	// be analyzed.
+	if csid.cfg.debugListen != "" {
+		if _, err := pmemcommon.StartDebugServer(ctx, csid.cfg.debugListen); err != nil {
+			return err
+		}
+	}
+
 	switch csid.cfg.Mode {
 	case Controller:
 		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
@@ -190,7 +360,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		csiNodeLister := globalFactory.Storage().V1().CSINodes().Lister()
 
 		var pcp *pmemCSIProvisioner
-		if csid.cfg.nodeSelector != nil {
+		if csid.cfg.nodeSelector.IsSet() {
 			serverVersion, err := client.Discovery().ServerVersion()
 			if err != nil {
 				return fmt.Errorf("discover server version: %v", err)
@@ -199,7 +369,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 			// Create rescheduler. This has to be done before starting the factory
 			// because it will indirectly add a new index.
 			//
-			// We don't use leader election. The shared factories are running
+			// Leader election is optional. The shared factories are running
 			// anyway, so we don't avoid traffic when hot spares are idle. Quite
 			// the opposite, the leader election itself causes additional traffic.
 			//
@@ -207,7 +377,8 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 			// times. In the worst case, multiple instances will determine at exactly
 			// the same time that it's time to reschedule and try to unset the annotation.
 			// One of them will succeed, the others will get a conflict error and then
-			// notice that nothing is left to do on their retry.
+			// notice that nothing is left to do on their retry. Leader election
+			// merely avoids those conflicts and the log output caused by them.
 			pcp = newRescheduler(ctx,
 				csid.cfg.DriverName,
 				client, pvcInformer, scInformer, pvInformer, csiNodeLister,
@@ -226,10 +397,50 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		}
 
 		if pcp != nil {
-			pcp.startRescheduler(ctx, cancel)
+			if csid.cfg.leaderElection {
+				identity, err := os.Hostname()
+				if err != nil {
+					return fmt.Errorf("determine leader election identity: %v", err)
+				}
+				namespace := csid.cfg.leaderElectionNamespace
+				if namespace == "" {
+					namespace = k8sutil.GetNamespace(ctx)
+				}
+				if err := pcp.startReschedulerWithLeaderElection(ctx, cancel, client,
+					namespace, csid.cfg.DriverName+"-rescheduler", identity); err != nil {
+					return err
+				}
+			} else {
+				pcp.startRescheduler(ctx, cancel)
+			}
 		}
 	case Node:
-		dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
+		mode := csid.cfg.DeviceManager
+		if mode == api.DeviceModeAuto {
+			var err error
+			mode, err = csid.autoDeviceMode(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		opts := pmdmanager.Options{
+			Pools:    csid.cfg.Pools,
+			Layout:   csid.cfg.VolumeGroupLayout,
+			Endpoint: csid.cfg.ExternalDeviceManager,
+			WarmPool: csid.cfg.WarmPool,
+
+			SystemRAMPercentage: csid.cfg.SystemRAMPercentage,
+		}
+		if csid.cfg.thinProvisioning {
+			opts.ThinPool = &csid.cfg.thinPool
+		}
+		recorder := csid.nodeEventRecorder(ctx)
+		if csid.cfg.lvmMetadataRecovery && (csid.cfg.DeviceManager != api.DeviceModeAuto || mode == api.DeviceModeLVM) {
+			opts.MetadataBackupDir = filepath.Join(csid.cfg.StateBasePath, lvmBackupDir)
+			opts.NodeName = csid.cfg.NodeID
+			opts.EventRecorder = recorder
+		}
+		dm, err := pmdmanager.New(ctx, mode, csid.cfg.PmemPercentage, opts)
 		if err != nil {
 			return err
 		}
@@ -247,30 +458,68 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		csid.gatherers = append(csid.gatherers, cmm.GetRegistry())
 
 		// Create GRPC servers
-		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
-		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm)
+		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version, dm.Healthz)
+		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm, csid.cfg.PmemReserved)
+		cs.recorder = recorder
+		ids.ready = cs.checkRestored
 		ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount")
 
 		services := []grpcserver.Service{ids, ns, cs}
 		if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, services...); err != nil {
 			return err
 		}
+		csid.readyChecks = append(csid.readyChecks,
+			readinessCheck{"device-manager", dm.Healthz},
+			readinessCheck{"volumes", cs.checkRestored},
+			readinessCheck{"state-dir", func(ctx context.Context) error {
+				return checkWritable(csid.cfg.StateBasePath)
+			}},
+			readinessCheck{"csi-endpoint", func(ctx context.Context) error {
+				return pmemgrpc.CheckEndpoint(ctx, csid.cfg.Endpoint)
+			}},
+		)
 
 		// Also collect metrics data via the device manager.
 		pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		volumeCollector{cs: cs}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		pmdmanager.MustRegisterDeviceMetrics(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		if mode := dm.GetMode(); mode == api.DeviceModeLVM || mode == api.DeviceModeDirect {
+			pmdmanager.DimmHealthCollector{}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+		}
 
 		capacity, err := dm.GetCapacity(ctx)
 		if err != nil {
 			return fmt.Errorf("get initial capacity: %v", err)
 		}
 		logger.Info("PMEM-CSI ready.", "capacity", capacity)
+
+		// Capacity is always determined anew, but new PMEM
+		// might have to be set up first.
+		go pmdmanager.WatchRegions(ctx, dm, csid.cfg.rescanInterval)
+		go watchLocks(ctx, csid.cfg.lockWatchdogThreshold, volumeMutex, nodeVolumeMutex)
+		if mode := dm.GetMode(); mode == api.DeviceModeLVM || mode == api.DeviceModeDirect {
+			go pmdmanager.WatchHardware(ctx, recorder, csid.cfg.NodeID, hardwareCheckInterval)
+		}
+
+		if client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst); err != nil {
+			logger.Error(err, "Not updating NUMA topology labels, no connection to the apiserver")
+		} else {
+			go cs.watchNumaTopology(ctx, client)
+		}
+		if csid.cfg.allowShrink {
+			client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+			if err != nil {
+				return fmt.Errorf("connect to apiserver: %v", err)
+			}
+			go cs.watchShrinkRequests(ctx, client, csid.cfg.DriverName)
+		}
 	case ForceConvertRawNamespaces:
 		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
 		if err != nil {
 			return fmt.Errorf("connect to apiserver: %v", err)
 		}
 
-		if err := pmdmanager.ForceConvertRawNamespaces(ctx, client, csid.cfg.DriverName, csid.cfg.nodeSelector, csid.cfg.NodeID); err != nil {
+		if err := pmdmanager.ForceConvertRawNamespaces(ctx, client, csid.cfg.DriverName, csid.cfg.nodeSelector, csid.cfg.NodeID, csid.cfg.PmemGoal, csid.cfg.dryRun); err != nil {
 			return err
 		}
 
@@ -285,6 +534,35 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		// isn't supported for DaemonSets
 		// (https://github.com/kubernetes/kubernetes/issues/24725).
 		logger.Info("Raw namespace conversion is done, waiting for termination signal.")
+	case DiscoverPMEM:
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+
+		found, err := pmdmanager.LabelPMEMNode(ctx, client, csid.cfg.nodeSelector, csid.cfg.NodeID)
+		if err != nil {
+			return err
+		}
+
+		// Same as above. Without PMEM, the pod keeps running
+		// because the node does not get labelled.
+		logger.Info("PMEM discovery is done, waiting for termination signal.", "pmem", found)
+	case Wipe:
+		if err := wipe(ctx, csid.cfg.StateBasePath); err != nil {
+			return err
+		}
+
+		// Same as above. The metrics endpoint only gets started
+		// after wiping, which is used as readiness probe.
+		logger.Info("Wiping is done, waiting for termination signal.")
+	case Defragment:
+		if err := defragment(ctx, csid.cfg.StateBasePath); err != nil {
+			return err
+		}
+
+		// Same as above.
+		logger.Info("Defragmentation is done, waiting for termination signal.")
 	default:
 		return fmt.Errorf("Unsupported device mode '%v", csid.cfg.Mode)
 	}
@@ -295,7 +573,7 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		logger.Info("Prometheus endpoint started.", "endpoint", fmt.Sprintf("http://%s%s", addr, csid.cfg.metricsPath))
+		logger.Info("Prometheus endpoint started.", "endpoint", fmt.Sprintf("%s://%s%s", csid.metricsScheme(), addr, csid.cfg.metricsPath))
 	}
 
 	c := make(chan os.Signal, 1)
@@ -321,28 +599,197 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 	return nil
 }
 
-// startMetrics starts the HTTPS server for the Prometheus endpoint, if one is configured.
+// hardwareCheckInterval determines how often DIMM health and bad
+// blocks are checked for changes that need to be reported as events.
+const hardwareCheckInterval = time.Minute
+
+// lvmBackupDir is the sub-directory of the state directory with
+// LVM metadata backups.
+const lvmBackupDir = "lvm-backup"
+
+// nodeEventRecorder returns a recorder for events about the node, or
+// nil if there is no connection to the apiserver. Events are
+// optional, so errors are only logged.
+func (csid *csiDriver) nodeEventRecorder(ctx context.Context) record.EventRecorder {
+	logger := klog.FromContext(ctx)
+	client, err := k8sutil.NewClient(csid.cfg.KubeAPIQPS, csid.cfg.KubeAPIBurst)
+	if err != nil {
+		logger.Error(err, "Not creating events, no connection to the apiserver")
+		return nil
+	}
+	broadcaster := record.NewBroadcaster(record.WithContext(ctx))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: csid.cfg.DriverName, Host: csid.cfg.NodeID})
+}
+
+// autoDeviceMode determines the device mode for 'auto'. The device
+// mode label of the node takes precedence, so an admin can choose the
+// mode for individual nodes. Because kubelet sets the label from the
+// topology, a node also keeps the mode chosen when the driver started
+// there the first time.
+func (csid *csiDriver) autoDeviceMode(ctx context.Context) (api.DeviceMode, error) {
+	logger := klog.FromContext(ctx)
+	client, err := k8sutil.NewClient(csid.cfg.KubeAPIQPS, csid.cfg.KubeAPIBurst)
+	if err != nil {
+		logger.Error(err, "Not checking the node label, no connection to the apiserver")
+		return pmdmanager.AutoDeviceMode(ctx)
+	}
+	node, err := client.CoreV1().Nodes().Get(ctx, csid.cfg.NodeID, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("get node %s: %v", csid.cfg.NodeID, err)
+	}
+	label := DriverDeviceModeTopologyKey
+	switch value := api.DeviceMode(node.Labels[label]); value {
+	case "":
+		return pmdmanager.AutoDeviceMode(ctx)
+	case api.DeviceModeDirect, api.DeviceModeLVM:
+		logger.Info("Using device mode from node label", "label", label, "mode", value)
+		return value, nil
+	default:
+		return "", fmt.Errorf("node label %s: unsupported device mode %q", label, value)
+	}
+}
+
+// healthzPath and readyzPath are served by the metrics HTTP server
+// independently of the configured metrics path.
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// startMetrics starts the HTTP or HTTPS server for the Prometheus endpoint, if one is configured.
 // Error handling is the same as for startScheduler.
 func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string, error) {
+	config, err := csid.metricsTLSConfig()
+	if err != nil {
+		return "", err
+	}
 	mux := http.NewServeMux()
 	mux.Handle(csid.cfg.metricsPath,
-		promhttp.InstrumentMetricHandler(
+		csid.metricsAuth(promhttp.InstrumentMetricHandler(
 			prometheus.DefaultRegisterer,
 			promhttp.HandlerFor(csid.gatherers, promhttp.HandlerOpts{}),
-		),
+		)),
 	)
-	mux.Handle(csid.cfg.metricsPath+"/simple", promhttp.HandlerFor(simpleMetrics, promhttp.HandlerOpts{}))
-	return csid.startHTTPSServer(ctx, cancel, csid.cfg.metricsListen, mux)
+	mux.Handle(csid.cfg.metricsPath+"/simple", csid.metricsAuth(promhttp.HandlerFor(simpleMetrics, promhttp.HandlerOpts{})))
+	// Probes use these instead of the metrics handlers, which do
+	// more work than needed for such checks. healthz only shows
+	// that the process is up and serving. readyz also runs the
+	// readiness checks. The metrics server only gets started once
+	// the driver is initialized, so in modes without checks it is
+	// ready as soon as it responds.
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	mux.HandleFunc(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+		var failed strings.Builder
+		for _, c := range csid.readyChecks {
+			if err := c.check(r.Context()); err != nil {
+				klog.FromContext(ctx).Error(err, "Readiness check failed", "check", c.name)
+				fmt.Fprintf(&failed, "%s: %v\n", c.name, err)
+			}
+		}
+		if failed.Len() > 0 {
+			http.Error(w, strings.TrimSuffix(failed.String(), "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	return csid.startHTTPSServer(ctx, cancel, csid.cfg.metricsListen, mux, config)
+}
+
+// checkWritable creates and removes a file in the directory.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".readyz-")
+	if err != nil {
+		return err
+	}
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return os.Remove(name)
+}
+
+// metricsScheme returns "https" when metrics are served with TLS, "http" otherwise.
+func (csid *csiDriver) metricsScheme() string {
+	if csid.cfg.metricsCertFile != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// metricsTLSConfig returns nil when the metrics server is meant to
+// use plain HTTP. The certificate and key get loaded again for each
+// new connection, so replacing the files (for example, when
+// cert-manager or kubelet update a mounted Secret) takes effect
+// without restarting the driver. The client CA only gets loaded once.
+func (csid *csiDriver) metricsTLSConfig() (*tls.Config, error) {
+	certFile, keyFile, caFile := csid.cfg.metricsCertFile, csid.cfg.metricsKeyFile, csid.cfg.metricsClientCAFile
+	switch {
+	case certFile == "" && keyFile == "" && caFile == "":
+		return nil, nil
+	case certFile == "" || keyFile == "":
+		return nil, errors.New("metrics certificate and key must be set together")
+	}
+	// Fail early instead of on the first connection.
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return nil, fmt.Errorf("load metrics certificate: %v", err)
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load metrics certificate: %v", err)
+			}
+			return &cert, nil
+		},
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read metrics client CA: %v", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in metrics client CA file %q", caFile)
+		}
+		config.ClientCAs = certPool
+		// Clients without certificate must still be able to
+		// connect for health checks, metricsAuth rejects
+		// their metrics requests.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// metricsAuth wraps a metrics handler such that it only responds to
+// clients who presented a valid certificate, if client certificates
+// are required.
+func (csid *csiDriver) metricsAuth(handler http.Handler) http.Handler {
+	if csid.cfg.metricsClientCAFile == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 // startHTTPSServer contains the common logic for starting and
 // stopping an HTTPS server.  Returns an error or the address that can
 // be used in Dial("tcp") to reach the server (useful for testing when
 // "listen" does not include a port).
-func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), listen string, handler http.Handler) (string, error) {
+func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), listen string, handler http.Handler, config *tls.Config) (string, error) {
 	name := "HTTP server"
 	logger := klog.FromContext(ctx).WithName(name).WithValues("listen", listen)
-	var config *tls.Config
 	server := http.Server{
 		Addr: listen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -359,7 +806,14 @@ func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), list
 	go func() {
 		defer tcpListener.Close()
 
-		if err := server.Serve(listener); err != http.ErrServerClosed {
+		var err error
+		if config != nil {
+			// Certificates come from config.GetCertificate.
+			err = server.ServeTLS(listener, "", "")
+		} else {
+			err = server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
 			logger.Error(err, "Failed")
 		}
 		// Also stop main thread.
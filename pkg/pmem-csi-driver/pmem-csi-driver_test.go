@@ -9,10 +9,23 @@ package pmemcsidriver
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -21,6 +34,8 @@ import (
 func TestMetrics(t *testing.T) {
 	cases := map[string]struct {
 		path     string
+		fullPath string
+		checks   []readinessCheck
 		response http.Response
 	}{
 		"version": {
@@ -32,6 +47,37 @@ build_info{version="foo-bar-test"} 1
 `)),
 			},
 		},
+		"healthz": {
+			fullPath: "/healthz",
+			response: http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("ok")),
+			},
+		},
+		"healthz ignores checks": {
+			fullPath: "/healthz",
+			checks:   []readinessCheck{{"device-manager", failedCheck}},
+			response: http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("ok")),
+			},
+		},
+		"readyz": {
+			fullPath: "/readyz",
+			checks:   []readinessCheck{{"device-manager", okCheck}},
+			response: http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("ok")),
+			},
+		},
+		"readyz failed": {
+			fullPath: "/readyz",
+			checks:   []readinessCheck{{"device-manager", failedCheck}, {"state-dir", okCheck}, {"csi-endpoint", failedCheck}},
+			response: http.Response{
+				StatusCode: 503,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("device-manager: volume group pmem-csi not found\ncsi-endpoint: volume group pmem-csi not found\n")),
+			},
+		},
 		"not found": {
 			path: "/invalid",
 			response: http.Response{
@@ -52,6 +98,7 @@ build_info{version="foo-bar-test"} 1
 				metricsListen: "127.0.0.1:", // port allocated dynamically
 			})
 			require.NoError(t, err, "get PMEM-CSI driver")
+			pmemd.readyChecks = c.checks
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
@@ -64,12 +111,181 @@ build_info{version="foo-bar-test"} 1
 				Transport: tr,
 			}
 			url := fmt.Sprintf("http://%s%s%s", addr, path, c.path)
+			if c.fullPath != "" {
+				url = fmt.Sprintf("http://%s%s", addr, c.fullPath)
+			}
 			resp, err := client.Get(url)
 			checkResponse(t, &c.response, resp, err, n)
 		})
 	}
 }
 
+func okCheck(ctx context.Context) error {
+	return nil
+}
+
+func failedCheck(ctx context.Context) error {
+	return errors.New("volume group pmem-csi not found")
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkWritable(dir), "writable directory")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err, "read directory")
+	assert.Empty(t, entries, "temporary file removed")
+	assert.Error(t, checkWritable(filepath.Join(dir, "no-such-dir")), "missing directory")
+}
+
+func TestMetricsTLS(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := createCert(t, "ca", nil, nil)
+	serverCert, serverKey := createCert(t, "server", caCert, caKey)
+	clientCert, clientKey := createCert(t, "client", caCert, caKey)
+	otherCA, otherCAKey := createCert(t, "other-ca", nil, nil)
+	otherCert, otherKey := createCert(t, "other-client", otherCA, otherCAKey)
+	caFile := writeCert(t, dir, "ca", caCert, caKey)
+	writeCert(t, dir, "server", serverCert, serverKey)
+	certFile, keyFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem")
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	clientPair := keyPair(clientCert, clientKey)
+	otherPair := keyPair(otherCert, otherKey)
+
+	cases := map[string]struct {
+		clientCAFile string
+		clientCert   *tls.Certificate
+		fullPath     string
+		statusCode   int
+	}{
+		"no client auth": {
+			statusCode: 200,
+		},
+		"client cert": {
+			clientCAFile: caFile,
+			clientCert:   &clientPair,
+			statusCode:   200,
+		},
+		"missing client cert": {
+			clientCAFile: caFile,
+			statusCode:   401,
+		},
+		"healthz without client cert": {
+			clientCAFile: caFile,
+			fullPath:     "/healthz",
+			statusCode:   200,
+		},
+		// The client does not even send a certificate
+		// which is not signed by one of the CAs accepted
+		// by the server.
+		"untrusted client cert": {
+			clientCAFile: caFile,
+			clientCert:   &otherPair,
+			statusCode:   401,
+		},
+	}
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			path := "/metrics"
+			pmemd, err := GetCSIDriver(Config{
+				Mode:                Controller,
+				DriverName:          "pmem-csi",
+				NodeID:              "testnode",
+				Endpoint:            "unused",
+				Version:             "foo-bar-test",
+				metricsPath:         path,
+				metricsListen:       "127.0.0.1:", // port allocated dynamically
+				metricsCertFile:     certFile,
+				metricsKeyFile:      keyFile,
+				metricsClientCAFile: c.clientCAFile,
+			})
+			require.NoError(t, err, "get PMEM-CSI driver")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			addr, err := pmemd.startMetrics(ctx, cancel)
+			require.NoError(t, err, "start server")
+
+			config := &tls.Config{RootCAs: roots}
+			if c.clientCert != nil {
+				config.Certificates = []tls.Certificate{*c.clientCert}
+			}
+			tr := &http.Transport{TLSClientConfig: config}
+			defer tr.CloseIdleConnections()
+			client := &http.Client{
+				Transport: tr,
+			}
+			url := fmt.Sprintf("https://%s%s", addr, path)
+			if c.fullPath != "" {
+				url = fmt.Sprintf("https://%s%s", addr, c.fullPath)
+			}
+			resp, err := client.Get(url)
+			checkResponse(t, &http.Response{StatusCode: c.statusCode}, resp, err, n)
+		})
+	}
+}
+
+func TestMetricsTLSConfig(t *testing.T) {
+	for n, cfg := range map[string]Config{
+		"key without cert": {metricsKeyFile: "key.pem"},
+		"cert without key": {metricsCertFile: "cert.pem"},
+		"CA without cert":  {metricsClientCAFile: "ca.pem"},
+		"missing files":    {metricsCertFile: "/no/such/cert.pem", metricsKeyFile: "/no/such/key.pem"},
+	} {
+		t.Run(n, func(t *testing.T) {
+			csid := &csiDriver{cfg: cfg}
+			_, err := csid.metricsTLSConfig()
+			assert.Error(t, err)
+		})
+	}
+}
+
+// createCert creates a certificate for 127.0.0.1 which is signed by
+// the parent or, if the parent is nil, a self-signed CA.
+func createCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err, "create certificate")
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err, "parse certificate")
+	return cert, key
+}
+
+// writeCert stores certificate and key as <name>.pem and
+// <name>-key.pem and returns the name of the certificate file.
+func writeCert(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err, "marshal key")
+	certFile := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0600), "write certificate")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), "write key")
+	return certFile
+}
+
+func keyPair(cert *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
 func checkResponse(t *testing.T, expected, actual *http.Response, err error, what string) {
 	if assert.NoError(t, err, what) {
 		defer actual.Body.Close()
@@ -9,6 +9,7 @@ package pmemcsidriver
 import (
 	"context"
 	"fmt"
+	"time"
 
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/types"
@@ -16,15 +17,23 @@ import (
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 )
 
 const (
 	annSelectedNode = "volume.kubernetes.io/selected-node"
+
+	// Same defaults as in the Kubernetes CSI sidecars.
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 5 * time.Second
 )
 
 // newRescheduler creates an instance of
@@ -92,6 +101,55 @@ func (pcp *pmemCSIProvisioner) startRescheduler(ctx context.Context, cancel func
 	}()
 }
 
+// startReschedulerWithLeaderElection is like startRescheduler, except
+// that the rescheduler only runs while this instance holds the lease
+// with the given name. Losing the lease cancels the context, which
+// shuts down the process. It then gets restarted as a hot standby.
+func (pcp *pmemCSIProvisioner) startReschedulerWithLeaderElection(ctx context.Context, cancel func(),
+	client kubernetes.Interface, namespace, name, identity string) error {
+	l := klog.FromContext(ctx).WithName("rescheduler").WithValues("lease", klog.KRef(namespace, name), "identity", identity)
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Client: client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: identity,
+			},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				l.Info("became leader, starting")
+				pcp.provisionController.Run(ctx)
+			},
+			OnStoppedLeading: func() {
+				l.Info("no longer the leader")
+			},
+			OnNewLeader: func(leader string) {
+				l.V(3).Info("new leader", "leader", leader)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create leader elector: %v", err)
+	}
+
+	l.Info("waiting for leadership")
+	go func() {
+		defer cancel()
+		defer l.Info("stopped")
+		elector.Run(ctx)
+	}()
+	return nil
+}
+
 // ShouldProvision is called for each pending PVC before the lib
 // starts working on the PVC. We only deal with those which need to be
 // rescheduled.
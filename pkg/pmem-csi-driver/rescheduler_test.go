@@ -48,9 +48,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: true,
 			haveCSINode:   true,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
 			},
@@ -60,9 +60,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: true,
 			haveCSINode:   false,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
 			},
@@ -75,9 +75,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: false,
 			haveCSINode:   true,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
 			},
@@ -90,9 +90,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: false,
 			haveCSINode:   true,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
 			},
@@ -105,9 +105,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: true,
 			haveCSINode:   true,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{},
 
 			expectReschedulePreCheck:   false,
@@ -118,9 +118,9 @@ func TestRescheduler(t *testing.T) {
 			haveCSIDriver: false,
 			haveCSINode:   true,
 			selectedNode:  nodeName,
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				nodeLabelName: nodeLabelValue,
-			},
+			}},
 			nodeLabels: map[string]string{},
 
 			expectReschedulePreCheck:   true,
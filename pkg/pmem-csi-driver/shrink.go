@@ -0,0 +1,161 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// ShrinkAnnotation is the suffix of the PV annotation with which an
+// admin asks for shrinking a volume, for example
+// "pmem-csi.intel.com/shrink-to: 4Gi". The prefix is the driver name.
+const ShrinkAnnotation = "shrink-to"
+
+const (
+	// EventReasonVolumeShrunk is used for PVs after shrinking
+	// their volume.
+	EventReasonVolumeShrunk = "VolumeShrunk"
+	// EventReasonVolumeShrinkFailed is used for PVs whose volume
+	// could not be shrunk. The request is not retried until the
+	// annotation changes.
+	EventReasonVolumeShrinkFailed = "VolumeShrinkFailed"
+)
+
+// shrinkInterval determines how often PVs are checked for the shrink
+// annotation.
+const shrinkInterval = time.Minute
+
+// watchShrinkRequests periodically shrinks volumes of the node as
+// requested by the annotation of their PV until the context is done.
+func (cs *nodeControllerServer) watchShrinkRequests(ctx context.Context, client kubernetes.Interface, driverName string) {
+	failed := map[string]string{}
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		cs.processShrinkRequests(ctx, client, driverName, failed)
+	}, shrinkInterval)
+}
+
+// processShrinkRequests handles the annotation of all PVs of the
+// driver once. failed contains the annotation value for each volume
+// where shrinking failed before.
+func (cs *nodeControllerServer) processShrinkRequests(ctx context.Context, client kubernetes.Interface, driverName string, failed map[string]string) {
+	logger := klog.FromContext(ctx).WithName("processShrinkRequests")
+	annotation := driverName + "/" + ShrinkAnnotation
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		logger.Error(err, "List PVs")
+		return
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		value, ok := pv.Annotations[annotation]
+		if !ok ||
+			pv.Spec.CSI == nil ||
+			pv.Spec.CSI.Driver != driverName ||
+			cs.getVolumeByID(pv.Spec.CSI.VolumeHandle) == nil ||
+			failed[pv.Spec.CSI.VolumeHandle] == value {
+			continue
+		}
+		volumeID := pv.Spec.CSI.VolumeHandle
+		delete(failed, volumeID)
+		size, err := resource.ParseQuantity(value)
+		if err == nil {
+			var newSize int64
+			newSize, err = cs.shrinkVolume(klog.NewContext(ctx, logger.WithValues("volume-id", volumeID, "pv", pv.Name)), volumeID, size.Value())
+			if err == nil {
+				if newSize > 0 {
+					cs.pvEvent(pv, corev1.EventTypeNormal, EventReasonVolumeShrunk,
+						fmt.Sprintf("Volume %s was shrunk to %s, the capacity of the PV must be updated manually.", volumeID, resource.NewQuantity(newSize, resource.BinarySI)))
+				}
+				continue
+			}
+		}
+		logger.Error(err, "Shrinking volume failed", "volume-id", volumeID, "pv", pv.Name, "size", value)
+		failed[volumeID] = value
+		cs.pvEvent(pv, corev1.EventTypeWarning, EventReasonVolumeShrinkFailed,
+			fmt.Sprintf("Volume %s was not shrunk to %q: %v", volumeID, value, err))
+	}
+}
+
+// shrinkVolume reduces the size of a volume of the node. It returns
+// the new size, zero if the volume already is not larger than
+// requested.
+func (cs *nodeControllerServer) shrinkVolume(ctx context.Context, volumeID string, size int64) (int64, error) {
+	logger := klog.FromContext(ctx)
+
+	// Serialize by VolumeId, both against other controller
+	// operations and against staging and publishing on the node.
+	unlock := nodeVolumeMutex.lock(ctx, volumeID)
+	defer unlock()
+	unlockNode := volumeMutex.lock(ctx, volumeID)
+	defer unlockNode()
+
+	vol := cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return 0, fmt.Errorf("volume %s: %w", volumeID, pmemerr.DeviceNotFound)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid size %d: %w", size, pmemerr.OutOfRange)
+	}
+	if vol.Size <= size {
+		return 0, nil
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return 0, fmt.Errorf("previously stored volume parameters: %v", err)
+	}
+	if p.GetPersistency() != parameters.PersistencyNormal {
+		return 0, fmt.Errorf("%s volume: %w", p.GetPersistency(), pmemerr.NotSupported)
+	}
+	shrinker, ok := cs.dm.(pmdmanager.DeviceShrinker)
+	if !ok || cs.dm.GetMode() != p.GetDeviceMode() {
+		return 0, fmt.Errorf("device mode %s: %w", p.GetDeviceMode(), pmemerr.NotSupported)
+	}
+	device, err := cs.dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		return 0, err
+	}
+	if err := vol.checkDevice(device); err != nil {
+		return 0, err
+	}
+
+	actual, err := shrinker.ShrinkDevice(ctx, volumeID, uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	newSize := int64(actual)
+	logger.Info("Volume shrunk", "old-size", vol.Size, "new-size", newSize)
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	vol.Size = newSize
+	if cs.sm != nil {
+		if err := cs.sm.Create(volumeID, vol); err != nil {
+			return 0, fmt.Errorf("update volume info: %v", err)
+		}
+	}
+	return newSize, nil
+}
+
+// pvEvent records an event for the PV if there is a recorder.
+func (cs *nodeControllerServer) pvEvent(pv *corev1.PersistentVolume, eventtype, reason, message string) {
+	if cs.recorder != nil {
+		cs.recorder.Event(pv, eventtype, reason, message)
+	}
+}
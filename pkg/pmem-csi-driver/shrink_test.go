@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// shrinkingDM records the new size instead of shrinking devices.
+// Volumes in inUse cannot be shrunk.
+type shrinkingDM struct {
+	pmdmanager.PmemDeviceManager
+	inUse map[string]bool
+}
+
+func (dm shrinkingDM) ShrinkDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	if dm.inUse[volumeId] {
+		return 0, fmt.Errorf("shrink %s: %w", volumeId, pmemerr.DeviceInUse)
+	}
+	return size, nil
+}
+
+func TestShrinkVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	statePath := t.TempDir()
+	sm, err := pmemstate.NewFileState(statePath)
+	require.NoError(t, err, "create state")
+	shrinker := shrinkingDM{PmemDeviceManager: dm, inUse: map[string]bool{}}
+	recorder := record.NewFakeRecorder(10)
+	cs := NewNodeControllerServer(ctx, "node", shrinker, sm, pmdmanager.Reservation{})
+	cs.recorder = recorder
+	driverName := "pmem-csi.intel.com"
+	mib := int64(1024 * 1024)
+
+	create := func(name string) string {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+			},
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 8 * mib,
+			},
+		})
+		require.NoError(t, err, "create volume %s", name)
+		return resp.Volume.VolumeId
+	}
+	pv := func(name, volumeID, shrinkTo string) *corev1.PersistentVolume {
+		pv := &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{
+						Driver:       driverName,
+						VolumeHandle: volumeID,
+					},
+				},
+			},
+		}
+		if shrinkTo != "" {
+			pv.Annotations = map[string]string{driverName + "/" + ShrinkAnnotation: shrinkTo}
+		}
+		return pv
+	}
+
+	shrunk := create("pvc-shrunk")
+	unchanged := create("pvc-unchanged")
+	inUse := create("pvc-in-use")
+	shrinker.inUse[inUse] = true
+	client := fake.NewSimpleClientset(
+		pv("pv-shrunk", shrunk, "4Mi"),
+		pv("pv-unchanged", unchanged, ""),
+		pv("pv-in-use", inUse, "4Mi"),
+		pv("pv-other-node", "pvc-other-node", "4Mi"),
+	)
+
+	failed := map[string]string{}
+	cs.processShrinkRequests(ctx, client, driverName, failed)
+	assert.Equal(t, 4*mib, cs.getVolumeByID(shrunk).Size, "shrunk volume")
+	assert.Equal(t, 8*mib, cs.getVolumeByID(unchanged).Size, "volume without annotation")
+	assert.Equal(t, 8*mib, cs.getVolumeByID(inUse).Size, "volume in use")
+	assert.Equal(t, map[string]string{inUse: "4Mi"}, failed, "failed requests")
+	events := []string{<-recorder.Events, <-recorder.Events}
+	assert.Contains(t, events, "Normal "+EventReasonVolumeShrunk+" Volume "+shrunk+" was shrunk to 4Mi, the capacity of the PV must be updated manually.", "events")
+	assert.Len(t, recorder.Events, 0, "no other events")
+
+	vol := &nodeVolume{}
+	require.NoError(t, sm.Get(shrunk, vol), "get state")
+	assert.Equal(t, 4*mib, vol.Size, "size in state")
+
+	// Neither done nor failed requests get repeated.
+	cs.processShrinkRequests(ctx, client, driverName, failed)
+	assert.Len(t, recorder.Events, 0, "no events for repeated requests")
+
+	size, err := cs.shrinkVolume(ctx, unchanged, 16*mib)
+	require.NoError(t, err, "grow volume")
+	assert.Equal(t, int64(0), size, "volume not larger than requested")
+	_, err = cs.shrinkVolume(ctx, unchanged, 0)
+	assert.ErrorIs(t, err, pmemerr.OutOfRange, "zero size")
+	_, err = cs.shrinkVolume(ctx, "pvc-other-node", 4*mib)
+	assert.ErrorIs(t, err, pmemerr.DeviceNotFound, "unknown volume")
+
+	// Shrinking waits for node operations on the volume.
+	unlock := volumeMutex.lock(ctx, shrunk)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := cs.shrinkVolume(ctx, shrunk, 2*mib)
+		assert.NoError(t, err, "shrink volume again")
+	}()
+	select {
+	case <-done:
+		t.Fatal("shrinking did not wait for the node lock")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-done
+	assert.Equal(t, 2*mib, cs.getVolumeByID(shrunk).Size, "shrunk volume after unlocking")
+
+	cs.dm = dm
+	_, err = cs.shrinkVolume(ctx, unchanged, 4*mib)
+	assert.ErrorIs(t, err, pmemerr.NotSupported, "device manager without shrinking")
+}
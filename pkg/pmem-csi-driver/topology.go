@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// maxNumaTopologyNodes is the number of NUMA nodes for which a
+// topology segment gets reported. PMEM is not available on machines
+// with more sockets.
+const maxNumaTopologyNodes = 8
+
+// numaTopologyInterval determines how often the NUMA topology gets
+// compared against the node labels.
+const numaTopologyInterval = time.Minute
+
+// numaSegments returns one topology segment for each of the NUMA
+// nodes 0 to maxNumaTopologyNodes-1 with "true" for those with PMEM
+// and "false" for the others. The keys are the same on all nodes
+// because kubelet records them only once per driver registration in
+// the CSINode object and the external-provisioner expects all nodes
+// to have the same keys.
+func (cs *nodeControllerServer) numaSegments(ctx context.Context) map[string]string {
+	segments := map[string]string{}
+	for node := 0; node < maxNumaTopologyNodes; node++ {
+		segments[numaTopologyKey(node)] = "false"
+	}
+	for _, node := range cs.numaNodes(ctx) {
+		if node < maxNumaTopologyNodes {
+			segments[numaTopologyKey(node)] = "true"
+		}
+	}
+	return segments
+}
+
+func numaTopologyKey(node int) string {
+	return fmt.Sprintf("%s%d", DriverNumaTopologyPrefix, node)
+}
+
+// watchNumaTopology periodically updates the node labels for the NUMA
+// topology until the context is done. Kubelet only sets them when the
+// driver registers, so without this they would not reflect regions
+// that get added or removed later.
+func (cs *nodeControllerServer) watchNumaTopology(ctx context.Context, client kubernetes.Interface) {
+	ctx, logger := pmemlog.WithName(ctx, "watchNumaTopology")
+	// The same failure gets reported once per window instead of
+	// once per interval.
+	logger = pmemlog.Deduplicate(logger, 10*time.Minute)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := cs.updateNumaTopology(ctx, client); err != nil {
+			logger.Error(err, "Updating NUMA topology labels failed")
+		}
+	}, numaTopologyInterval)
+}
+
+// updateNumaTopology patches the node labels for the NUMA topology if
+// they differ from the current segments.
+func (cs *nodeControllerServer) updateNumaTopology(ctx context.Context, client kubernetes.Interface) error {
+	logger := klog.FromContext(ctx)
+	node, err := client.CoreV1().Nodes().Get(ctx, cs.nodeID, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node %s: %v", cs.nodeID, err)
+	}
+	labels := map[string]string{}
+	for key, value := range cs.numaSegments(ctx) {
+		if node.Labels[key] != value {
+			labels[key] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create patch: %v", err)
+	}
+	if _, err := client.CoreV1().Nodes().Patch(ctx, cs.nodeID, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("patch node %s: %v", cs.nodeID, err)
+	}
+	logger.V(2).Info("Updated NUMA topology labels", "node", cs.nodeID, "labels", labels)
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestNumaTopology(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldPrefix := DriverNumaTopologyPrefix
+	DriverNumaTopologyPrefix = "pmem-csi.intel.com/numa-"
+	defer func() { DriverNumaTopologyPrefix = oldPrefix }()
+
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	cs := NewNodeControllerServer(ctx, "node", detailsDM{dm}, nil, pmdmanager.Reservation{})
+
+	segments := cs.numaSegments(ctx)
+	assert.Len(t, segments, maxNumaTopologyNodes, "fixed number of segments")
+	assert.Equal(t, "true", segments["pmem-csi.intel.com/numa-0"], "NUMA node 0")
+	assert.Equal(t, "true", segments["pmem-csi.intel.com/numa-1"], "NUMA node 1")
+	assert.Equal(t, "false", segments["pmem-csi.intel.com/numa-2"], "NUMA node 2")
+
+	// Without details, no NUMA node has PMEM, but the keys remain
+	// the same.
+	empty := NewNodeControllerServer(ctx, "node", dm, nil, pmdmanager.Reservation{})
+	emptySegments := empty.numaSegments(ctx)
+	assert.Len(t, emptySegments, maxNumaTopologyNodes, "fixed number of segments without PMEM")
+	assert.Equal(t, "false", emptySegments["pmem-csi.intel.com/numa-0"], "NUMA node 0 without PMEM")
+
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node",
+			Labels: map[string]string{
+				"pmem-csi.intel.com/numa-0": "false",
+				"pmem-csi.intel.com/numa-1": "true",
+				"other":                     "label",
+			},
+		},
+	})
+	require.NoError(t, cs.updateNumaTopology(ctx, client), "update labels")
+	node, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	assert.Equal(t, "true", node.Labels["pmem-csi.intel.com/numa-0"], "label of new NUMA node")
+	assert.Equal(t, "true", node.Labels["pmem-csi.intel.com/numa-1"], "unchanged label")
+	assert.Equal(t, "false", node.Labels["pmem-csi.intel.com/numa-7"], "label of NUMA node without PMEM")
+	assert.Equal(t, "label", node.Labels["other"], "other label")
+
+	// Nothing to do when the labels are up-to-date.
+	client.ClearActions()
+	require.NoError(t, cs.updateNumaTopology(ctx, client), "update labels again")
+	for _, action := range client.Actions() {
+		assert.NotEqual(t, "patch", action.GetVerb(), "unexpected patch")
+	}
+
+	require.NoError(t, empty.updateNumaTopology(ctx, client), "remove PMEM")
+	node, err = client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	assert.Equal(t, "false", node.Labels["pmem-csi.intel.com/numa-0"], "label of NUMA node without PMEM")
+	assert.Equal(t, "false", node.Labels["pmem-csi.intel.com/numa-1"], "label of NUMA node without PMEM")
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/keymutex"
+
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+)
+
+var (
+	// Waiting and holding for a long time is what these
+	// histograms are meant to detect, so the buckets go up to
+	// ten minutes like those of pmem_csi_operation_duration_seconds.
+	volumeLockBuckets = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+	volumeLockWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_csi_volume_lock_wait_seconds",
+			Help:    "How long CSI calls on the node waited for the per-volume lock, labeled by lock (node-server or controller-server).",
+			Buckets: volumeLockBuckets,
+		},
+		[]string{"lock"},
+	)
+	volumeLockHold = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_csi_volume_lock_hold_seconds",
+			Help:    "How long CSI calls on the node held the per-volume lock, labeled by lock (node-server or controller-server).",
+			Buckets: volumeLockBuckets,
+		},
+		[]string{"lock"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(volumeLockWait)
+	prometheus.MustRegister(volumeLockHold)
+}
+
+// volumeLock serializes operations per volume like a
+// keymutex.KeyMutex and keeps track of who holds which key, for
+// metrics and for watchLocks.
+type volumeLock struct {
+	name string
+	keys keymutex.KeyMutex
+
+	mutex   sync.Mutex
+	holders map[*lockHolder]bool
+}
+
+// lockHolder describes one locked key.
+type lockHolder struct {
+	key    string
+	method string
+	since  time.Time
+	logger klog.Logger
+	// reported gets set by watchLocks.
+	reported bool
+}
+
+func newVolumeLock(name string) *volumeLock {
+	return &volumeLock{
+		name:    name,
+		keys:    keymutex.NewHashed(-1),
+		holders: map[*lockHolder]bool{},
+	}
+}
+
+// lock blocks until the key is locked and returns the function which
+// unlocks it again.
+func (l *volumeLock) lock(ctx context.Context, key string) func() {
+	start := time.Now()
+	l.keys.LockKey(key)
+	locked := time.Now()
+	volumeLockWait.WithLabelValues(l.name).Observe(locked.Sub(start).Seconds())
+
+	// Empty when not called by the gRPC server.
+	method, _ := grpc.Method(ctx)
+	holder := &lockHolder{
+		key:    key,
+		method: method,
+		since:  locked,
+		logger: klog.FromContext(ctx),
+	}
+	l.mutex.Lock()
+	l.holders[holder] = true
+	l.mutex.Unlock()
+
+	return func() {
+		l.mutex.Lock()
+		delete(l.holders, holder)
+		l.mutex.Unlock()
+		volumeLockHold.WithLabelValues(l.name).Observe(time.Since(locked).Seconds())
+		_ = l.keys.UnlockKey(key)
+	}
+}
+
+// stuck returns the holders which hold their key for longer than the
+// threshold and were not returned before.
+func (l *volumeLock) stuck(now time.Time, threshold time.Duration) []lockHolder {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var stuck []lockHolder
+	for holder := range l.holders {
+		if !holder.reported && now.Sub(holder.since) > threshold {
+			holder.reported = true
+			stuck = append(stuck, *holder)
+		}
+	}
+	return stuck
+}
+
+// stackOutput is where watchLocks writes goroutine stacks.
+var stackOutput io.Writer = os.Stderr
+
+// watchLocks checks the locks periodically until the context is done.
+// The first time that it finds a key locked for longer than the
+// threshold, it logs a warning and the stacks of all goroutines,
+// which then show where the operation is stuck, for example in a
+// mount or while erasing a volume. A zero threshold disables it.
+func watchLocks(ctx context.Context, threshold time.Duration, locks ...*volumeLock) {
+	if threshold <= 0 {
+		return
+	}
+	ticker := time.NewTicker(threshold / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			checkLocks(now, threshold, locks...)
+		}
+	}
+}
+
+// checkLocks reports stuck holders and returns true if there were any.
+func checkLocks(now time.Time, threshold time.Duration, locks ...*volumeLock) bool {
+	found := false
+	for _, l := range locks {
+		for _, holder := range l.stuck(now, threshold) {
+			holder.logger.Info("Warning: volume lock held too long",
+				"lock", l.name,
+				"volume", holder.key,
+				"method", holder.method,
+				"held", now.Sub(holder.since).Round(time.Second),
+			)
+			found = true
+		}
+	}
+	if found {
+		// Printed directly because the output is too large
+		// for a single log message.
+		fmt.Fprintf(stackOutput, "=== goroutine stacks for volume locks held too long ===\n%s=== end of goroutine stacks ===\n", pmemcommon.AllStacks())
+	}
+	return found
+}
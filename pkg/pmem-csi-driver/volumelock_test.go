@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestVolumeLock(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	l := newVolumeLock("test")
+	before := testutil.CollectAndCount(volumeLockWait)
+
+	unlock := l.lock(ctx, "vol-1")
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		unlock := l.lock(ctx, "vol-1")
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lock succeeded while the key was locked")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	assert.Equal(t, before+1, testutil.CollectAndCount(volumeLockWait), "new lock label")
+	assert.Empty(t, l.holders, "holders after unlocking")
+
+	// Stuck holders get reported once.
+	var output bytes.Buffer
+	oldOutput := stackOutput
+	stackOutput = &output
+	defer func() {
+		stackOutput = oldOutput
+	}()
+	unlock = l.lock(ctx, "vol-2")
+	defer unlock()
+	now := time.Now()
+	assert.False(t, checkLocks(now, time.Minute, l), "held shortly")
+	assert.Empty(t, output.String(), "no stacks")
+	assert.True(t, checkLocks(now.Add(2*time.Minute), time.Minute, l), "held too long")
+	assert.Contains(t, output.String(), "TestVolumeLock", "stacks include the test")
+	assert.False(t, checkLocks(now.Add(3*time.Minute), time.Minute, l), "already reported")
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// The device manager functions used by wipe. Tests replace them.
+var (
+	newDeviceManager        = pmdmanager.New
+	removeVolumeGroups      = pmdmanager.RemoveVolumeGroups
+	destroyDriverNamespaces = pmdmanager.DestroyDriverNamespaces
+)
+
+// wipe removes all volumes which are recorded in the driver state,
+// then the volume groups and namespaces created for LVM mode and the
+// warm and system RAM namespaces. Volumes in LVM mode are removed
+// together with their volume group. All data stored in volumes is
+// lost.
+func wipe(ctx context.Context, statePath string) error {
+	ctx, logger := pmemlog.WithName(ctx, "wipe")
+
+	sm, err := pmemstate.NewFileState(statePath)
+	if err != nil {
+		return err
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		return fmt.Errorf("load state: %v", err)
+	}
+
+	var direct pmdmanager.PmemDeviceManager
+	for _, id := range ids {
+		vol := &nodeVolume{}
+		if err := sm.Get(id, vol); err != nil {
+			return fmt.Errorf("volume %s: retrieve volume info: %v", id, err)
+		}
+		v, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			return fmt.Errorf("volume %s: parse volume parameters: %v", id, err)
+		}
+		if v.GetDeviceMode() != api.DeviceModeDirect {
+			continue
+		}
+		if direct == nil {
+			direct, err = newDeviceManager(ctx, api.DeviceModeDirect, 0, pmdmanager.Options{})
+			if err != nil {
+				return fmt.Errorf("initialize device manager for direct mode: %v", err)
+			}
+		}
+		logger.V(2).Info("Deleting volume", "volume-id", id)
+		if err := direct.DeleteDevice(ctx, id, true, false); err != nil {
+			return fmt.Errorf("volume %s: delete device: %v", id, err)
+		}
+	}
+
+	if err := removeVolumeGroups(ctx); err != nil {
+		return err
+	}
+	if err := destroyDriverNamespaces(ctx); err != nil {
+		return err
+	}
+	// Backups of the removed volume groups must not get restored.
+	if err := os.RemoveAll(filepath.Join(statePath, lvmBackupDir)); err != nil {
+		return fmt.Errorf("remove LVM metadata backups: %v", err)
+	}
+
+	for _, id := range ids {
+		if err := sm.Delete(id); err != nil {
+			return fmt.Errorf("volume %s: delete state: %v", id, err)
+		}
+	}
+	logger.V(2).Info("Removed all volumes", "num-volumes", len(ids))
+	return nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestWipe(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create device manager")
+	statePath := t.TempDir()
+	sm, err := pmemstate.NewFileState(statePath)
+	require.NoError(t, err, "create state")
+	backupDir := filepath.Join(statePath, lvmBackupDir)
+	require.NoError(t, os.Mkdir(backupDir, 0700), "create backup directory")
+
+	volumes := map[string]api.DeviceMode{
+		"pvc-direct": api.DeviceModeDirect,
+		"pvc-lvm":    api.DeviceModeLVM,
+	}
+	for id, mode := range volumes {
+		_, err := dm.CreateDevice(ctx, id, 1024*1024, 0, parameters.Volume{})
+		require.NoError(t, err, "create device %s", id)
+		vol := nodeVolume{
+			ID:     id,
+			Size:   1024 * 1024,
+			Params: map[string]string{parameters.DeviceMode: string(mode)},
+		}
+		require.NoError(t, sm.Create(id, vol), "store volume %s", id)
+	}
+
+	oldNew, oldRemove, oldDestroy := newDeviceManager, removeVolumeGroups, destroyDriverNamespaces
+	defer func() {
+		newDeviceManager, removeVolumeGroups, destroyDriverNamespaces = oldNew, oldRemove, oldDestroy
+	}()
+	newDeviceManager = func(ctx context.Context, mode api.DeviceMode, percentage uint, options pmdmanager.Options) (pmdmanager.PmemDeviceManager, error) {
+		assert.Equal(t, api.DeviceModeDirect, mode, "device mode")
+		return dm, nil
+	}
+	removed := 0
+	removeVolumeGroups = func(ctx context.Context) error {
+		removed++
+		return nil
+	}
+	destroyed := 0
+	destroyDriverNamespaces = func(ctx context.Context) error {
+		destroyed++
+		return nil
+	}
+
+	require.NoError(t, wipe(ctx, statePath), "wipe")
+	_, err = dm.GetDevice(ctx, "pvc-direct")
+	assert.True(t, errors.Is(err, pmemerr.DeviceNotFound), "direct mode volume deleted, got: %v", err)
+	_, err = dm.GetDevice(ctx, "pvc-lvm")
+	assert.NoError(t, err, "LVM volume is removed together with its volume group")
+	assert.Equal(t, 1, removed, "volume groups removed")
+	assert.Equal(t, 1, destroyed, "driver namespaces destroyed")
+	assert.NoDirExists(t, backupDir, "LVM metadata backups")
+	sm, err = pmemstate.NewFileState(statePath)
+	require.NoError(t, err, "reopen state")
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "get state")
+	assert.Empty(t, ids, "volumes in state")
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemoperator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	componentbaseconfig "k8s.io/component-base/config/v1alpha1"
+	"k8s.io/component-base/logs"
+	logsapi "k8s.io/component-base/logs/api/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ConfigurationAPIVersion is the apiVersion of the
+	// configuration file.
+	ConfigurationAPIVersion = "config.pmem-csi.intel.com/v1alpha1"
+	// ConfigurationKind is the kind of the configuration file.
+	ConfigurationKind = "OperatorConfiguration"
+)
+
+// Configuration is the content of the file passed via -config.
+// Command line flags which are set explicitly take precedence
+// over the corresponding fields.
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// DriverImage is the default image for driver deployments.
+	DriverImage string `json:"driverImage,omitempty"`
+	// LeaderElection configures leader election among multiple
+	// operator instances. The lock is in the namespace of the
+	// operator unless resourceNamespace is set.
+	LeaderElection componentbaseconfig.LeaderElectionConfiguration `json:"leaderElection"`
+	// MetricsAddr is the address the metrics endpoint binds to,
+	// "0" disables it.
+	MetricsAddr string `json:"metricsAddr,omitempty"`
+	// DebugAddr is the address for serving /debug/pprof and
+	// /debug/stacks, empty disables it.
+	DebugAddr string `json:"debugAddr,omitempty"`
+	// WatchNamespaces are the namespaces that may be used by
+	// deployments in addition to the namespace of the operator.
+	// "all" enables all namespaces.
+	WatchNamespaces []string `json:"watchNamespaces,omitempty"`
+	// Logging configures log output. Only the verbosity can be
+	// changed without restarting the operator.
+	Logging logsapi.LoggingConfiguration `json:"logging"`
+}
+
+// defaultConfiguration returns the configuration which is used when
+// there is no file or when the file does not set some field.
+func defaultConfiguration() *Configuration {
+	leaderElect := false
+	return &Configuration{
+		LeaderElection: componentbaseconfig.LeaderElectionConfiguration{
+			LeaderElect:   &leaderElect,
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+			ResourceLock:  resourcelock.LeasesResourceLock,
+			ResourceName:  "pmem-csi-operator-lock",
+		},
+		MetricsAddr: ":8080",
+		Logging:     *logsapi.NewLoggingConfiguration(),
+	}
+}
+
+// newConfiguration starts with the defaults, replaces them with the
+// content of the file if there is one, then applies the overrides and
+// validates the result. Validation must come last because flags may
+// fix or break values from the file.
+func newConfiguration(path string, defaults *Configuration, override func(c *Configuration)) (*Configuration, error) {
+	c := defaults.DeepCopy()
+	if path != "" {
+		var err error
+		c, err = loadConfiguration(path, defaults)
+		if err != nil {
+			return nil, err
+		}
+	}
+	override(c)
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return c, nil
+}
+
+// loadConfiguration reads the file and fills in all fields that are
+// not set there from defaults. Unknown fields are an error, as is
+// a missing or unknown apiVersion or kind. The result still needs
+// to be validated.
+func loadConfiguration(path string, defaults *Configuration) (*Configuration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read configuration: %v", err)
+	}
+	c := defaults.DeepCopy()
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("parse configuration %s: %v", path, err)
+	}
+	if c.APIVersion != ConfigurationAPIVersion || c.Kind != ConfigurationKind {
+		return nil, fmt.Errorf("configuration %s: expected apiVersion %q and kind %q, got %q and %q", path, ConfigurationAPIVersion, ConfigurationKind, c.APIVersion, c.Kind)
+	}
+	return c, nil
+}
+
+// validate checks the configuration after merging file and flags.
+func (c *Configuration) validate() error {
+	le := c.LeaderElection
+	switch {
+	case le.LeaseDuration.Duration <= 0, le.RenewDeadline.Duration <= 0, le.RetryPeriod.Duration <= 0:
+		return errors.New("leader election durations must be positive")
+	case le.RenewDeadline.Duration >= le.LeaseDuration.Duration:
+		return errors.New("leader election renewDeadline must be shorter than leaseDuration")
+	case le.ResourceName == "":
+		return errors.New("leader election resourceName must not be empty")
+	case le.ResourceLock != resourcelock.LeasesResourceLock:
+		// All other lock types were removed from client-go.
+		return fmt.Errorf("leader election resourceLock must be %q, got %q", resourcelock.LeasesResourceLock, le.ResourceLock)
+	}
+	return nil
+}
+
+// DeepCopy returns a copy which shares no data with the original.
+func (c *Configuration) DeepCopy() *Configuration {
+	out := *c
+	if c.LeaderElection.LeaderElect != nil {
+		leaderElect := *c.LeaderElection.LeaderElect
+		out.LeaderElection.LeaderElect = &leaderElect
+	}
+	out.WatchNamespaces = append([]string(nil), c.WatchNamespaces...)
+	c.Logging.DeepCopyInto(&out.Logging)
+	return &out
+}
+
+// reloadOnSIGHUP reads the file again each time the process receives
+// SIGHUP. The same overrides as during startup get applied to it.
+// A changed log verbosity becomes active immediately, all other
+// changes only after a restart.
+func reloadOnSIGHUP(ctx context.Context, path string, current, defaults *Configuration, override func(c *Configuration)) {
+	logger := klog.FromContext(ctx).WithName("config")
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+			}
+			reloadConfiguration(logger, path, current, defaults, override)
+		}
+	}()
+}
+
+// reloadConfiguration implements one reload for reloadOnSIGHUP. It
+// updates the log verbosity in current, everything else stays as it
+// was.
+func reloadConfiguration(logger klog.Logger, path string, current, defaults *Configuration, override func(c *Configuration)) {
+	c, err := newConfiguration(path, defaults, override)
+	if err != nil {
+		logger.Error(err, "Reloading the configuration failed, keeping the old one")
+		return
+	}
+	if c.Logging.Verbosity != current.Logging.Verbosity {
+		if _, err := logs.GlogSetter(fmt.Sprintf("%d", c.Logging.Verbosity)); err != nil {
+			logger.Error(err, "Changing the log verbosity failed")
+		} else {
+			logger.Info("Log verbosity changed.", "old", current.Logging.Verbosity, "new", c.Logging.Verbosity)
+			current.Logging.Verbosity = c.Logging.Verbosity
+		}
+	}
+	c.Logging.Verbosity = current.Logging.Verbosity
+	if !reflect.DeepEqual(c, current) {
+		logger.Info("The configuration was changed in a way which requires restarting the operator.")
+	}
+}
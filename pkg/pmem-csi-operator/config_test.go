@@ -0,0 +1,312 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemoperator
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/component-base/logs"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func noOverride(c *Configuration) {}
+
+// writeConfiguration creates a configuration file with the given
+// fields in addition to apiVersion and kind.
+func writeConfiguration(t *testing.T, path, fields string) {
+	content := "apiVersion: config.pmem-csi.intel.com/v1alpha1\nkind: OperatorConfiguration\n" + fields
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644), "write file")
+}
+
+// restoreVerbosity resets the klog verbosity after a test which
+// changes it.
+func restoreVerbosity(t *testing.T) {
+	old := flag.Lookup("v").Value.String()
+	t.Cleanup(func() {
+		_, err := logs.GlogSetter(old)
+		assert.NoError(t, err, "restore verbosity")
+	})
+}
+
+func TestLoadConfiguration(t *testing.T) {
+	testcases := map[string]struct {
+		content     string
+		expectError bool
+		check       func(t *testing.T, c *Configuration)
+	}{
+		"defaults": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: OperatorConfiguration
+`,
+			check: func(t *testing.T, c *Configuration) {
+				assert.Equal(t, ":8080", c.MetricsAddr, "metrics address")
+				assert.Empty(t, c.DebugAddr, "debug address")
+				assert.False(t, *c.LeaderElection.LeaderElect, "leader election")
+				assert.Equal(t, 15*time.Second, c.LeaderElection.LeaseDuration.Duration, "lease duration")
+				assert.Equal(t, "leases", c.LeaderElection.ResourceLock, "resource lock")
+				assert.Equal(t, "text", c.Logging.Format, "log format")
+			},
+		},
+		"values": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: OperatorConfiguration
+driverImage: example.com/pmem-csi-driver:v1.0.0
+metricsAddr: ":9090"
+debugAddr: "127.0.0.1:6060"
+watchNamespaces:
+- foo
+- all
+leaderElection:
+  leaderElect: true
+  leaseDuration: 30s
+logging:
+  format: json
+  verbosity: 5
+`,
+			check: func(t *testing.T, c *Configuration) {
+				assert.Equal(t, "example.com/pmem-csi-driver:v1.0.0", c.DriverImage, "driver image")
+				assert.Equal(t, ":9090", c.MetricsAddr, "metrics address")
+				assert.Equal(t, "127.0.0.1:6060", c.DebugAddr, "debug address")
+				assert.Equal(t, []string{"foo", "all"}, c.WatchNamespaces, "watch namespaces")
+				assert.True(t, *c.LeaderElection.LeaderElect, "leader election")
+				assert.Equal(t, 30*time.Second, c.LeaderElection.LeaseDuration.Duration, "lease duration")
+				assert.Equal(t, 10*time.Second, c.LeaderElection.RenewDeadline.Duration, "default renew deadline")
+				assert.Equal(t, "pmem-csi-operator-lock", c.LeaderElection.ResourceName, "default lock name")
+				assert.Equal(t, "json", c.Logging.Format, "log format")
+				assert.EqualValues(t, 5, c.Logging.Verbosity, "log verbosity")
+			},
+		},
+		"missing version": {
+			content:     `metricsAddr: ":9090"`,
+			expectError: true,
+		},
+		"wrong kind": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: PmemCSIDeployment
+`,
+			expectError: true,
+		},
+		"unknown field": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: OperatorConfiguration
+metricsAddress: ":9090"
+`,
+			expectError: true,
+		},
+		"bad leader election": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: OperatorConfiguration
+leaderElection:
+  leaseDuration: 5s
+`,
+			expectError: true,
+		},
+		"bad resource lock": {
+			content: `apiVersion: config.pmem-csi.intel.com/v1alpha1
+kind: OperatorConfiguration
+leaderElection:
+  resourceLock: configmaps
+`,
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0644), "write file")
+			defaults := defaultConfiguration()
+			c, err := newConfiguration(path, defaults, noOverride)
+			if tc.expectError {
+				require.Error(t, err, "load configuration")
+				return
+			}
+			require.NoError(t, err, "load configuration")
+			tc.check(t, c)
+			assert.Equal(t, defaultConfiguration(), defaults, "defaults must not be modified")
+		})
+	}
+}
+
+func TestNewConfiguration(t *testing.T) {
+	testcases := map[string]struct {
+		fields      string
+		noFile      bool
+		override    func(c *Configuration)
+		expectError bool
+		check       func(t *testing.T, c *Configuration)
+	}{
+		"no file": {
+			noFile: true,
+			check: func(t *testing.T, c *Configuration) {
+				assert.Equal(t, defaultConfiguration(), c, "defaults")
+			},
+		},
+		"flags take precedence": {
+			fields: "metricsAddr: \":9090\"\n",
+			override: func(c *Configuration) {
+				c.MetricsAddr = ":7070"
+			},
+			check: func(t *testing.T, c *Configuration) {
+				assert.Equal(t, ":7070", c.MetricsAddr, "metrics address")
+			},
+		},
+		"flags fix file": {
+			// Invalid on its own because the default renew
+			// deadline is 10s.
+			fields: "leaderElection:\n  leaseDuration: 5s\n",
+			override: func(c *Configuration) {
+				c.LeaderElection.RenewDeadline.Duration = 3 * time.Second
+			},
+			check: func(t *testing.T, c *Configuration) {
+				assert.Equal(t, 5*time.Second, c.LeaderElection.LeaseDuration.Duration, "lease duration")
+				assert.Equal(t, 3*time.Second, c.LeaderElection.RenewDeadline.Duration, "renew deadline")
+			},
+		},
+		"flags break file": {
+			fields: "leaderElection:\n  leaseDuration: 30s\n",
+			override: func(c *Configuration) {
+				c.LeaderElection.RenewDeadline.Duration = time.Minute
+			},
+			expectError: true,
+		},
+		"flags break defaults": {
+			noFile: true,
+			override: func(c *Configuration) {
+				c.LeaderElection.ResourceName = ""
+			},
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			path := ""
+			if !tc.noFile {
+				path = filepath.Join(t.TempDir(), "config.yaml")
+				writeConfiguration(t, path, tc.fields)
+			}
+			override := tc.override
+			if override == nil {
+				override = noOverride
+			}
+			c, err := newConfiguration(path, defaultConfiguration(), override)
+			if tc.expectError {
+				require.Error(t, err, "new configuration")
+				return
+			}
+			require.NoError(t, err, "new configuration")
+			tc.check(t, c)
+		})
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	testcases := map[string]struct {
+		fields          string
+		override        func(c *Configuration)
+		expectVerbosity uint32
+		expectRestart   bool
+		expectError     bool
+	}{
+		"unchanged": {},
+		"verbosity": {
+			fields:          "logging:\n  verbosity: 4\n",
+			expectVerbosity: 4,
+		},
+		"verbosity overridden": {
+			fields: "logging:\n  verbosity: 4\n",
+			override: func(c *Configuration) {
+				c.Logging.Verbosity = 0
+			},
+		},
+		"metrics address": {
+			fields:        "metricsAddr: \":9090\"\n",
+			expectRestart: true,
+		},
+		"metrics address overridden": {
+			fields: "metricsAddr: \":9090\"\n",
+			override: func(c *Configuration) {
+				c.MetricsAddr = ":8080"
+			},
+		},
+		"invalid": {
+			fields:      "logging:\n  verbosity: 4\nleaderElection:\n  leaseDuration: 5s\n",
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			restoreVerbosity(t)
+			logger := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.BufferLogs(true)))
+			buffer := logger.GetSink().(ktesting.Underlier).GetBuffer()
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			writeConfiguration(t, path, "")
+			override := tc.override
+			if override == nil {
+				override = noOverride
+			}
+			defaults := defaultConfiguration()
+			current, err := newConfiguration(path, defaults, override)
+			require.NoError(t, err, "initial configuration")
+			initial := current.DeepCopy()
+			writeConfiguration(t, path, tc.fields)
+
+			reloadConfiguration(logger, path, current, defaults, override)
+			assert.EqualValues(t, tc.expectVerbosity, current.Logging.Verbosity, "verbosity")
+			initial.Logging.Verbosity = current.Logging.Verbosity
+			assert.Equal(t, initial, current, "only the verbosity gets updated")
+			if tc.expectVerbosity > 0 {
+				assert.True(t, klog.V(klog.Level(tc.expectVerbosity)).Enabled(), "new verbosity active")
+			}
+			if tc.expectRestart {
+				assert.Contains(t, buffer.String(), "requires restarting", "restart message")
+			} else {
+				assert.NotContains(t, buffer.String(), "requires restarting", "restart message")
+			}
+			if tc.expectError {
+				assert.Contains(t, buffer.String(), "Reloading the configuration failed", "error message")
+			}
+		})
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	restoreVerbosity(t)
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfiguration(t, path, "")
+	defaults := defaultConfiguration()
+	current, err := newConfiguration(path, defaults, noOverride)
+	require.NoError(t, err, "initial configuration")
+	_, err = logs.GlogSetter("0")
+	require.NoError(t, err, "initial verbosity")
+
+	reloadOnSIGHUP(ctx, path, current, defaults, noOverride)
+	writeConfiguration(t, path, "logging:\n  verbosity: 6\n")
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP), "send SIGHUP")
+	// current gets updated concurrently, so only the global
+	// verbosity can be checked.
+	assert.Eventually(t, func() bool {
+		return klog.V(6).Enabled()
+	}, 10*time.Second, 10*time.Millisecond, "verbosity changed after SIGHUP")
+}
@@ -21,6 +21,11 @@ type ControllerOptions struct {
 	K8sVersion version.Version
 	// Namespace to use for namespace-scoped sub-resources created by the controller
 	Namespace string
+	// WatchNamespaces lists additional namespaces which may be used by
+	// deployments. metav1.NamespaceAll enables all namespaces.
+	WatchNamespaces []string
+	// OperatorVersion is the version of the running operator binary
+	OperatorVersion string
 	// DriverImage to use as default image for driver deployment
 	DriverImage string
 	// Config kubernetes config used
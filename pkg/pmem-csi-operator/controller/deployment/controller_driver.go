@@ -10,21 +10,25 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/metrics"
-	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/intel/pmem-csi/pkg/version"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	apiruntime "k8s.io/apimachinery/pkg/runtime"
@@ -35,9 +39,14 @@ import (
 )
 
 const (
-	controllerMetricsPort  = 10010
-	nodeMetricsPort        = 10010
-	provisionerMetricsPort = 10011
+	// With secure metrics, the metrics ports are served by
+	// kube-rbac-proxy and the actual metrics servers listen on
+	// localhost on the port plus this offset.
+	metricsUpstreamOffset = 100
+
+	appArmorAnnotationPrefix = "container.apparmor.security.beta.kubernetes.io/"
+
+	defaultStorageClassAnnotation = "storageclass.kubernetes.io/is-default-class"
 )
 
 func typeMeta(gv schema.GroupVersion, kind string) metav1.TypeMeta {
@@ -57,6 +66,7 @@ var currentObjects = []client.Object{
 	&rbacv1.ClusterRole{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "ClusterRole")},
 	&rbacv1.ClusterRoleBinding{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "ClusterRoleBinding")},
 	&storagev1.CSIDriver{TypeMeta: typeMeta(storagev1.SchemeGroupVersion, "CSIDriver")},
+	&storagev1.StorageClass{TypeMeta: typeMeta(storagev1.SchemeGroupVersion, "StorageClass")},
 	&appsv1.DaemonSet{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "DaemonSet")},
 	&rbacv1.Role{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "Role")},
 	&rbacv1.RoleBinding{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "RoleBinding")},
@@ -64,6 +74,7 @@ var currentObjects = []client.Object{
 	&corev1.Service{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "Service")},
 	&corev1.ServiceAccount{TypeMeta: typeMeta(corev1.SchemeGroupVersion, "ServiceAccount")},
 	&appsv1.Deployment{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "Deployment")},
+	&policyv1.PodDisruptionBudget{TypeMeta: typeMeta(policyv1.SchemeGroupVersion, "PodDisruptionBudget")},
 	&admissionregistrationv1.MutatingWebhookConfiguration{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "MutatingWebhookConfiguration")},
 }
 
@@ -75,6 +86,8 @@ func cloneObject(from client.Object) (client.Object, error) {
 		return t.DeepCopyObject().(*rbacv1.ClusterRoleBinding), nil
 	case *storagev1.CSIDriver:
 		return t.DeepCopyObject().(*storagev1.CSIDriver), nil
+	case *storagev1.StorageClass:
+		return t.DeepCopyObject().(*storagev1.StorageClass), nil
 	case *appsv1.DaemonSet:
 		return t.DeepCopyObject().(*appsv1.DaemonSet), nil
 	case *rbacv1.Role:
@@ -91,8 +104,16 @@ func cloneObject(from client.Object) (client.Object, error) {
 		return t.DeepCopyObject().(*appsv1.Deployment), nil
 	case *appsv1.StatefulSet:
 		return t.DeepCopyObject().(*appsv1.StatefulSet), nil
+	case *policyv1.PodDisruptionBudget:
+		return t.DeepCopyObject().(*policyv1.PodDisruptionBudget), nil
 	case *admissionregistrationv1.MutatingWebhookConfiguration:
 		return t.DeepCopyObject().(*admissionregistrationv1.MutatingWebhookConfiguration), nil
+	case *admissionregistrationv1.ValidatingAdmissionPolicy:
+		return t.DeepCopyObject().(*admissionregistrationv1.ValidatingAdmissionPolicy), nil
+	case *admissionregistrationv1.ValidatingAdmissionPolicyBinding:
+		return t.DeepCopyObject().(*admissionregistrationv1.ValidatingAdmissionPolicyBinding), nil
+	case *unstructured.Unstructured:
+		return t.DeepCopy(), nil
 	default:
 		return nil, fmt.Errorf("cannot clone client.Object of type %T", from)
 	}
@@ -100,7 +121,8 @@ func cloneObject(from client.Object) (client.Object, error) {
 
 func isNamespaced(kind string) bool {
 	switch kind {
-	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "MutatingWebhookConfiguration":
+	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "MutatingWebhookConfiguration", "StorageClass", "SecurityContextConstraints",
+		"ValidatingAdmissionPolicy", "ValidatingAdmissionPolicyBinding":
 		return false
 	default:
 		return true
@@ -113,6 +135,37 @@ func CurrentObjects() []client.Object {
 	return currentObjects
 }
 
+// serviceMonitorGVK identifies the ServiceMonitor type of the Prometheus
+// operator. There is no Go API for it in our dependencies, therefore such
+// objects are handled as unstructured.Unstructured.
+var serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+
+// sccGVK identifies the SecurityContextConstraints type of OpenShift,
+// also handled as unstructured.Unstructured.
+var sccGVK = schema.GroupVersionKind{Group: "security.openshift.io", Version: "v1", Kind: "SecurityContextConstraints"}
+
+func newUnstructured(gvk schema.GroupVersionKind) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	return obj
+}
+
+// A list of object types which are defined by CRDs that might not be
+// installed in the cluster or by APIs that are not available in all
+// supported Kubernetes releases. The operator only creates them when
+// explicitly asked to. They are not watched, because that would fail
+// without the CRD or API, and listing them for obsolete object removal
+// ignores unknown kinds.
+//
+// The RBAC rules in deploy/kustomize/operator/operator.yaml must
+// allow all of the operations (creation, patching, etc.).
+var optionalObjects = []client.Object{
+	newUnstructured(serviceMonitorGVK),
+	newUnstructured(sccGVK),
+	&admissionregistrationv1.ValidatingAdmissionPolicy{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "ValidatingAdmissionPolicy")},
+	&admissionregistrationv1.ValidatingAdmissionPolicyBinding{TypeMeta: typeMeta(admissionregistrationv1.SchemeGroupVersion, "ValidatingAdmissionPolicyBinding")},
+}
+
 // A list of objects that may have been created by a previous release
 // of the operator. This is relevant when updating from such an older
 // release to the current one, because the current one must remove
@@ -128,7 +181,7 @@ var obsoleteObjects = []client.Object{
 // A list of all object types potentially created by the operator,
 // in this or any previous release. In other words, this list may grow,
 // but never shrink.
-var allObjects = append(currentObjects[:], obsoleteObjects...)
+var allObjects = append(append(currentObjects[:], optionalObjects...), obsoleteObjects...)
 
 // Returns a slice with a new unstructured.UnstructuredList for each object
 // in allObjects.
@@ -162,6 +215,16 @@ func (d *pmemCSIDeployment) withStorageCapacity() bool {
 	return d.k8sVersion.Compare(1, 21) >= 0
 }
 
+// withPVCValidation checks for the v1 API of
+// ValidatingAdmissionPolicy, available since Kubernetes 1.30.
+func (d *pmemCSIDeployment) withPVCValidation() bool {
+	return d.WithPVCValidation() && d.k8sVersion.Compare(1, 30) >= 0
+}
+
+func (d *pmemCSIDeployment) withLivenessProbe() bool {
+	return d.Spec.LivenessProbeImage != ""
+}
+
 // Reconcile reconciles the driver deployment. When adding new
 // objects, extend also currentObjects above and the RBAC rules in
 // deploy/kustomize/operator/operator.yaml.
@@ -170,11 +233,11 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 	l.V(3).Info("start", "deployment", d.Name, "phase", d.Status.Phase)
 	var allObjects []apiruntime.Object
 	redeployAll := func() error {
-		for name, handler := range subObjectHandlers {
+		for name, handler := range d.getSubObjectHandlers() {
 			if handler.enabled != nil && !handler.enabled(d) {
 				continue
 			}
-			o, err := d.redeploy(ctx, r, handler)
+			o, _, err := d.redeploy(ctx, r, handler)
 			if err != nil {
 				return fmt.Errorf("failed to update %s: %v", name, err)
 			}
@@ -183,12 +246,23 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 		return nil
 	}
 
+	if err := d.migrate(ctx, r); err != nil {
+		return err
+	}
+
 	if err := redeployAll(); err != nil {
 		d.SetCondition(api.DriverDeployed, corev1.ConditionFalse, err.Error())
 		return err
 	}
 
 	d.SetCondition(api.DriverDeployed, corev1.ConditionTrue, "Driver deployed successfully.")
+	if !d.WithController() {
+		d.SetDriverStatus(api.ControllerDriver, "Disabled", "Controller is disabled in the components.")
+	}
+
+	if err := d.updateNodeStatus(ctx, r); err != nil {
+		return err
+	}
 
 	l.V(3).Info("deployed", "numObjects", len(allObjects))
 	// FIXME(avalluri): Limit the obsolete object deletion either only on version upgrades
@@ -197,6 +271,7 @@ func (d *pmemCSIDeployment) reconcile(ctx context.Context, r *ReconcileDeploymen
 		return fmt.Errorf("Delete obsolete objects failed with error: %v", err)
 	}
 
+	d.Status.OperatorVersion = r.operatorVersion
 	return nil
 }
 
@@ -219,12 +294,27 @@ func (d *pmemCSIDeployment) getSubObject(ctx context.Context, r *ReconcileDeploy
 	}
 	ownerRef := d.GetOwnerReference()
 	if !isOwnedBy(objMeta, &ownerRef) {
-		return fmt.Errorf("'%s' of type %T is not owned by '%s'", objMeta.GetName(), obj, ownerRef.Name)
+		if !d.IsAdopting() {
+			return fmt.Errorf("'%s' of type %T is not owned by '%s'", objMeta.GetName(), obj, ownerRef.Name)
+		}
+		if controller := metav1.GetControllerOf(objMeta); controller != nil {
+			return fmt.Errorf("'%s' of type %T is controlled by %s '%s' and cannot be adopted", objMeta.GetName(), obj, controller.Kind, controller.Name)
+		}
+		l.V(3).Info("will be adopted", "object", pmemlog.KObjWithType(objMeta))
 	}
 
 	return nil
 }
 
+// redeployResult describes what redeploy had to do.
+type redeployResult int
+
+const (
+	unchanged redeployResult = iota
+	patched
+	created
+)
+
 type redeployObject struct {
 	objType    reflect.Type
 	immutable  bool
@@ -243,20 +333,25 @@ type redeployObject struct {
 //  4. Call objectPatch.Apply() to submit the chanages to the APIServer.
 //  5. If the update in step 4 was success, then call the ro.postUpdate() callback
 //     to run any post update steps.
-func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment, ro redeployObject) (finalObj client.Object, finalErr error) {
+//
+// The result tells whether the object had to be created or patched.
+func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment, ro redeployObject) (finalObj client.Object, result redeployResult, finalErr error) {
 	l := klog.FromContext(ctx).WithName("redeploy")
 
 	// Get an instance with right type and meta data, prepare for logging.
 	o := ro.object(d)
 	if o == nil {
-		return nil, fmt.Errorf("nil object")
+		return nil, unchanged, fmt.Errorf("nil object")
 	}
 	l = l.WithValues("object", pmemlog.KObj(o))
 	ctx = klog.NewContext(ctx, l)
+	// For unknown reason client.Create() and client.Delete() clear
+	// the GVK on obj, so it gets restored manually after creating.
+	gvk := o.GetObjectKind().GroupVersionKind()
 
 	// Retrieve actual object from APIserver, it it exists.
 	if err := d.getSubObject(ctx, r, o); err != nil {
-		return nil, err
+		return nil, unchanged, err
 	}
 
 	// The underlying object should implement client.Object, but
@@ -265,7 +360,7 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	clone := o.DeepCopyObject()
 	clientObject, ok := clone.(client.Object)
 	if !ok {
-		return nil, fmt.Errorf("internal error: %T does not implement client.Object", clone)
+		return nil, unchanged, fmt.Errorf("internal error: %T does not implement client.Object", clone)
 	}
 
 	// Prepare for patching by remembering the base object.
@@ -273,7 +368,7 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 
 	// Now set all values that we care about...
 	if err := ro.modify(d, o); err != nil {
-		return nil, err
+		return nil, unchanged, err
 	}
 
 	// ... and also the labels.
@@ -286,6 +381,19 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	}
 	o.SetLabels(labels)
 
+	// Same for annotations.
+	if len(d.Spec.Annotations) > 0 {
+		o.SetAnnotations(joinMaps(o.GetAnnotations(), d.Spec.Annotations))
+	}
+
+	// Objects that getSubObject allowed to be adopted become owned
+	// by the deployment with the patch.
+	ownerRef := d.GetOwnerReference()
+	adopted := !isOwnedBy(o, &ownerRef)
+	if adopted {
+		o.SetOwnerReferences(append(o.GetOwnerReferences(), ownerRef))
+	}
+
 	// Now create or patch the object. If we have a resource
 	// version, then the object was retrieved from the apiserver
 	// and can be patched.
@@ -293,18 +401,19 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	if doPatch {
 		data, err := patch.Data(o)
 		if err != nil {
-			return nil, fmt.Errorf("generate patch: %v", err)
+			return nil, unchanged, fmt.Errorf("generate patch: %v", err)
 		}
 		// Check whether we really need to patch.
 		if string(data) != "{}" && len(data) >= 0 {
 			l.V(5).Info("patch", "diff", string(data))
-			if ro.immutable {
+			result = patched
+			if ro.immutable || selectorChanged(clientObject, o) {
 				// Delete and re-create below.
 				doPatch = false
 				o.SetResourceVersion("")
 				l.V(5).Info("immutable -> delete and re-create")
 				if err := r.client.Delete(ctx, o); err != nil {
-					return nil, fmt.Errorf("delete object: %v", err)
+					return nil, unchanged, fmt.Errorf("delete object: %v", err)
 				}
 			} else {
 				// Patch() will modify the object, which is an object that was
@@ -313,11 +422,11 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 				// so here we have to do a deep copy first.
 				copy, err := cloneObject(o)
 				if err != nil {
-					return nil, fmt.Errorf("internal error: %v", err)
+					return nil, unchanged, fmt.Errorf("internal error: %v", err)
 				}
 				l.V(3).Info("update", "patch", string(data))
 				if err := r.client.Patch(ctx, copy, patch); err != nil {
-					return nil, fmt.Errorf("patch object: %v", err)
+					return nil, unchanged, fmt.Errorf("patch object: %v", err)
 				}
 				if err := metrics.SetSubResourceUpdateMetric(o); err != nil {
 					l.V(3).Error(err, "failed to set sub-resource metrics", "object", o)
@@ -327,12 +436,12 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 	}
 
 	if !doPatch {
-		// For unknown reason client.Create() clearing off the
-		// GVK on obj, so restore it manually.
-		gvk := o.GetObjectKind().GroupVersionKind()
 		l.V(3).Info("create")
+		if result == unchanged {
+			result = created
+		}
 		if err := r.client.Create(ctx, o); err != nil {
-			return nil, fmt.Errorf("create object: %v", err)
+			return nil, unchanged, fmt.Errorf("create object: %v", err)
 		}
 		o.GetObjectKind().SetGroupVersionKind(gvk)
 		if err := metrics.SetSubResourceCreateMetric(o); err != nil {
@@ -340,13 +449,18 @@ func (d *pmemCSIDeployment) redeploy(ctx context.Context, r *ReconcileDeployment
 		}
 	}
 
+	if adopted {
+		r.evRecorder.Eventf(d.PmemCSIDeployment, corev1.EventTypeNormal, api.EventReasonAdopted,
+			"Adopted existing %s %q", o.GetObjectKind().GroupVersionKind().Kind, o.GetName())
+	}
+
 	// Final per-object changes, like emitting events or setting status.
 	if ro.postUpdate != nil {
 		if err := ro.postUpdate(d, o); err != nil {
-			return nil, err
+			return nil, unchanged, err
 		}
 	}
-	return o, nil
+	return o, result, nil
 }
 
 var subObjectHandlers = map[string]redeployObject{
@@ -359,7 +473,7 @@ var subObjectHandlers = map[string]redeployObject{
 			}
 		},
 		modify: func(d *pmemCSIDeployment, o client.Object) error {
-			d.getNodeDaemonSet(o.(*appsv1.DaemonSet))
+			d.getNodeDaemonSet(o.(*appsv1.DaemonSet), nil)
 			return nil
 		},
 		postUpdate: func(d *pmemCSIDeployment, o client.Object) error {
@@ -381,6 +495,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"controller driver": {
 		objType: reflect.TypeOf(&appsv1.Deployment{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &appsv1.Deployment{
 				TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
@@ -409,6 +526,124 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"controller pod disruption budget": {
+		objType: reflect.TypeOf(&policyv1.PodDisruptionBudget{}),
+		// A single replica cannot be evicted at all when
+		// minAvailable is one, which would block node drains.
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController() && d.GetControllerReplicas() > 1
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &policyv1.PodDisruptionBudget{
+				TypeMeta:   metav1.TypeMeta{Kind: "PodDisruptionBudget", APIVersion: "policy/v1"},
+				ObjectMeta: d.getObjectMeta(d.ControllerPodDisruptionBudgetName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getControllerPodDisruptionBudget(o.(*policyv1.PodDisruptionBudget))
+			return nil
+		},
+	},
+	"PVC validation policy": {
+		objType: reflect.TypeOf(&admissionregistrationv1.ValidatingAdmissionPolicy{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.withPVCValidation()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &admissionregistrationv1.ValidatingAdmissionPolicy{
+				TypeMeta:   metav1.TypeMeta{Kind: "ValidatingAdmissionPolicy", APIVersion: "admissionregistration.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.PVCValidationPolicyName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			o.(*admissionregistrationv1.ValidatingAdmissionPolicy).Spec = d.PVCValidationPolicySpec()
+			return nil
+		},
+	},
+	"PVC validation policy binding": {
+		objType: reflect.TypeOf(&admissionregistrationv1.ValidatingAdmissionPolicyBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.withPVCValidation()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &admissionregistrationv1.ValidatingAdmissionPolicyBinding{
+				TypeMeta:   metav1.TypeMeta{Kind: "ValidatingAdmissionPolicyBinding", APIVersion: "admissionregistration.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.PVCValidationPolicyName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			o.(*admissionregistrationv1.ValidatingAdmissionPolicyBinding).Spec = d.PVCValidationPolicyBindingSpec()
+			return nil
+		},
+	},
+	"controller metrics service": {
+		objType: reflect.TypeOf(&corev1.Service{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController() && d.WithServiceMonitor()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.Service{
+				TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.MetricsServiceName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getControllerMetricsService(o.(*corev1.Service))
+			return nil
+		},
+	},
+	"node metrics service": {
+		objType: reflect.TypeOf(&corev1.Service{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithServiceMonitor()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &corev1.Service{
+				TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+				ObjectMeta: d.getObjectMeta(d.NodeMetricsServiceName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getNodeMetricsService(o.(*corev1.Service))
+			return nil
+		},
+	},
+	"controller service monitor": {
+		objType: reflect.TypeOf(&unstructured.Unstructured{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController() && d.WithServiceMonitor()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			sm := newUnstructured(serviceMonitorGVK)
+			objMeta := d.getObjectMeta(d.ControllerServiceMonitorName(), false)
+			sm.SetName(objMeta.Name)
+			sm.SetNamespace(objMeta.Namespace)
+			sm.SetOwnerReferences(objMeta.OwnerReferences)
+			return sm
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getServiceMonitor(o.(*unstructured.Unstructured), "controller", "metrics", "provisioner-metrics")
+			return nil
+		},
+	},
+	"node service monitor": {
+		objType: reflect.TypeOf(&unstructured.Unstructured{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithServiceMonitor()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			sm := newUnstructured(serviceMonitorGVK)
+			objMeta := d.getObjectMeta(d.NodeServiceMonitorName(), false)
+			sm.SetName(objMeta.Name)
+			sm.SetNamespace(objMeta.Namespace)
+			sm.SetOwnerReferences(objMeta.OwnerReferences)
+			return sm
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getServiceMonitor(o.(*unstructured.Unstructured), "node", "metrics")
+			return nil
+		},
+	},
 	"CSIDriver": {
 		objType:   reflect.TypeOf(&storagev1.CSIDriver{}),
 		immutable: true, // not yet, will be added in https://github.com/kubernetes/kubernetes/pull/101789
@@ -425,6 +660,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks role": {
 		objType: reflect.TypeOf(&rbacv1.Role{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.Role{
 				TypeMeta:   metav1.TypeMeta{Kind: "Role", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -438,6 +676,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks role binding": {
 		objType: reflect.TypeOf(&rbacv1.RoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.RoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -451,6 +692,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks cluster role": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRole{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -464,6 +708,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks cluster role binding": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -477,6 +724,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"webhooks service account": {
 		objType: reflect.TypeOf(&corev1.ServiceAccount{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithController()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &corev1.ServiceAccount{
 				TypeMeta:   metav1.TypeMeta{Kind: "ServiceAccount", APIVersion: "v1"},
@@ -490,6 +740,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"provisioner role": {
 		objType: reflect.TypeOf(&rbacv1.Role{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithProvisioner()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.Role{
 				TypeMeta:   metav1.TypeMeta{Kind: "Role", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -503,6 +756,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"provisioner role binding": {
 		objType: reflect.TypeOf(&rbacv1.RoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithProvisioner()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.RoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -516,6 +772,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"provisioner cluster role": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithProvisioner()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRole{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -529,6 +788,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"provisioner cluster role binding": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithProvisioner()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -553,8 +815,44 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"node OpenShift SCC": {
+		objType: reflect.TypeOf(&unstructured.Unstructured{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.OpenShiftSCC
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			scc := newUnstructured(sccGVK)
+			objMeta := d.getObjectMeta(d.NodeSCCName(), true)
+			scc.SetName(objMeta.Name)
+			scc.SetOwnerReferences(objMeta.OwnerReferences)
+			return scc
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getNodeSCC(o.(*unstructured.Unstructured))
+			return nil
+		},
+	},
+	"node OpenShift SCC cluster role": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.OpenShiftSCC
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.NodeSCCClusterRoleName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getNodeSCCClusterRole(o.(*rbacv1.ClusterRole))
+			return nil
+		},
+	},
 	"node OpenShift role binding": {
 		objType: reflect.TypeOf(&rbacv1.RoleBinding{}),
+		// The role reference changes when enabling or disabling
+		// OpenShiftSCC and cannot be patched.
+		immutable: true,
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.RoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "RoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -567,8 +865,44 @@ var subObjectHandlers = map[string]redeployObject{
 		},
 	},
 
+	"metrics auth cluster role": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithSecureMetrics()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.MetricsAuthClusterRoleName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getMetricsAuthClusterRole(o.(*rbacv1.ClusterRole))
+			return nil
+		},
+	},
+	"metrics auth cluster role binding": {
+		objType: reflect.TypeOf(&rbacv1.ClusterRoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithSecureMetrics()
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.MetricsAuthClusterRoleBindingName(), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getMetricsAuthClusterRoleBinding(o.(*rbacv1.ClusterRoleBinding))
+			return nil
+		},
+	},
+
 	"node setup cluster role": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRole{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithNodeSetupRBAC()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRole{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRole", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -582,6 +916,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"node setup cluster role binding": {
 		objType: reflect.TypeOf(&rbacv1.ClusterRoleBinding{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithNodeSetupRBAC()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &rbacv1.ClusterRoleBinding{
 				TypeMeta:   metav1.TypeMeta{Kind: "ClusterRoleBinding", APIVersion: "rbac.authorization.k8s.io/v1"},
@@ -595,6 +932,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"node setup service account": {
 		objType: reflect.TypeOf(&corev1.ServiceAccount{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithNodeSetupRBAC()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &corev1.ServiceAccount{
 				TypeMeta:   metav1.TypeMeta{Kind: "ServiceAccount", APIVersion: "v1"},
@@ -608,6 +948,9 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 	"node setup driver": {
 		objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.WithNodeSetup()
+		},
 		object: func(d *pmemCSIDeployment) client.Object {
 			return &appsv1.DaemonSet{
 				TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
@@ -619,17 +962,84 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"node discovery driver": {
+		objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.Spec.NodeDiscovery
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &appsv1.DaemonSet{
+				TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+				ObjectMeta: d.getObjectMeta(d.NodeDiscoveryName(), false),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			d.getNodeDiscoveryDaemonSet(o.(*appsv1.DaemonSet))
+			return nil
+		},
+	},
+}
+
+// getSubObjectHandlers returns subObjectHandlers plus the handlers for
+// sub-objects which are defined by the deployment spec, like the
+// storage classes.
+func (d *pmemCSIDeployment) getSubObjectHandlers() map[string]redeployObject {
+	handlers := make(map[string]redeployObject, len(subObjectHandlers)+len(d.Spec.StorageClasses)+len(d.Spec.NodeModes))
+	for name, handler := range subObjectHandlers {
+		handlers[name] = handler
+	}
+	for i := range d.Spec.StorageClasses {
+		sc := &d.Spec.StorageClasses[i]
+		handlers["storage class "+sc.Name] = redeployObject{
+			objType: reflect.TypeOf(&storagev1.StorageClass{}),
+			// Parameters and binding mode cannot be updated.
+			immutable: true,
+			object: func(d *pmemCSIDeployment) client.Object {
+				return &storagev1.StorageClass{
+					TypeMeta:   metav1.TypeMeta{Kind: "StorageClass", APIVersion: "storage.k8s.io/v1"},
+					ObjectMeta: d.getObjectMeta(sc.Name, true),
+				}
+			},
+			modify: func(d *pmemCSIDeployment, o client.Object) error {
+				d.getStorageClass(o.(*storagev1.StorageClass), sc)
+				return nil
+			},
+		}
+	}
+	for i := range d.Spec.NodeModes {
+		mode := &d.Spec.NodeModes[i]
+		// The driver status only reflects the default DaemonSet.
+		handlers["node driver "+mode.Name] = redeployObject{
+			objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+			object: func(d *pmemCSIDeployment) client.Object {
+				return &appsv1.DaemonSet{
+					TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+					ObjectMeta: d.getObjectMeta(d.NodeModeDriverName(mode.Name), false),
+				}
+			},
+			modify: func(d *pmemCSIDeployment, o client.Object) error {
+				d.getNodeDaemonSet(o.(*appsv1.DaemonSet), mode)
+				return nil
+			},
+		}
+	}
+	return handlers
 }
 
 // HandleEvent handles the delete/update events received on sub-objects. It ensures that any undesirable change
-// is reverted.
+// is reverted and reports that with a DriftReverted event.
 func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Object, obj apiruntime.Object, r *ReconcileDeployment) error {
 	objType := reflect.TypeOf(obj)
 	l := klog.FromContext(ctx).WithName("deployment/event")
 	l.V(5).Info("start", "object", pmemlog.KObjWithType(metaData), "type", objType)
 
+	if d.IsPaused() {
+		l.V(3).Info("deployment paused, ignoring change", "object", pmemlog.KObjWithType(metaData))
+		return nil
+	}
+
 	objName := metaData.GetName()
-	for name, handler := range subObjectHandlers {
+	for name, handler := range d.getSubObjectHandlers() {
 		if handler.enabled != nil && !handler.enabled(d) {
 			continue
 		}
@@ -642,9 +1052,24 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 		}
 		l.V(3).Info("redeploying", "name", name, "object", pmemlog.KObjWithType(metaData))
 		org := d.DeepCopy()
-		if _, err := d.redeploy(ctx, r, handler); err != nil {
+		o, result, err := d.redeploy(ctx, r, handler)
+		if err != nil {
 			return fmt.Errorf("failed to redeploy %s: %v", name, err)
 		}
+		kind := o.GetObjectKind().GroupVersionKind().Kind
+		switch result {
+		case patched:
+			r.evRecorder.Eventf(d.PmemCSIDeployment, corev1.EventTypeWarning, api.EventReasonDriftReverted,
+				"Reverted changes of %s %q made by %s", kind, objName, lastManager(metaData))
+		case created:
+			r.evRecorder.Eventf(d.PmemCSIDeployment, corev1.EventTypeWarning, api.EventReasonDriftReverted,
+				"Re-created deleted %s %q", kind, objName)
+		}
+		if objType == reflect.TypeOf(&appsv1.DaemonSet{}) {
+			if err := d.updateNodeStatus(ctx, r); err != nil {
+				return err
+			}
+		}
 		if err := r.patchDeploymentStatus(d.PmemCSIDeployment, client.MergeFrom(org)); err != nil {
 			return fmt.Errorf("failed to update deployment CR status: %v", err)
 		}
@@ -653,6 +1078,271 @@ func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Obj
 	return nil
 }
 
+// lastManager returns the field manager which modified the object
+// most recently, as far as that is known.
+func lastManager(obj metav1.Object) string {
+	manager := "unknown"
+	var last *metav1.Time
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Subresource != "" || entry.Time == nil {
+			continue
+		}
+		if last == nil || last.Before(entry.Time) {
+			manager = entry.Manager
+			last = entry.Time
+		}
+	}
+	return manager
+}
+
+// updateNodeStatus replaces Status.Nodes with information from the node
+// driver pods, the CSINode objects, the node setup results and the
+// published storage capacity.
+func (d *pmemCSIDeployment) updateNodeStatus(ctx context.Context, r *ReconcileDeployment) error {
+	nodes := map[string]*api.NodeStatus{}
+	getNode := func(name string) *api.NodeStatus {
+		node := nodes[name]
+		if node == nil {
+			node = &api.NodeStatus{Node: name}
+			nodes[name] = node
+		}
+		return node
+	}
+
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/name":     "pmem-csi-node",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	); err != nil {
+		return fmt.Errorf("list node driver pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		node := getNode(pod.Spec.NodeName)
+		node.Phase = pod.Status.Phase
+		node.Ready = isPodReady(&pod)
+		node.LastError = podError(&pod)
+	}
+
+	csiNodes := &storagev1.CSINodeList{}
+	if err := r.client.List(ctx, csiNodes); err != nil {
+		return fmt.Errorf("list CSINodes: %v", err)
+	}
+	for _, csiNode := range csiNodes.Items {
+		for _, driver := range csiNode.Spec.Drivers {
+			if driver.Name == d.CSIDriverName() {
+				getNode(csiNode.Name).Registered = true
+			}
+		}
+	}
+
+	// Kubelet copies the device mode from the driver topology into
+	// a node label. The node setup records its results in node
+	// annotations.
+	nodeList := &corev1.NodeList{}
+	if err := r.client.List(ctx, nodeList); err != nil {
+		return fmt.Errorf("list nodes: %v", err)
+	}
+	modeLabel := d.CSIDriverName() + "/" + api.DeviceModeLabel
+	annotation := d.GetName() + "/" + api.RawNamespaceConversionAnnotation
+	goalAnnotation := d.GetName() + "/" + api.PMEMGoalAnnotation
+	for _, node := range nodeList.Items {
+		if d.WithNodeSetup() {
+			if result, ok := node.Annotations[annotation]; ok {
+				getNode(node.Name).RawNamespaceConversion = result
+			}
+			if result, ok := node.Annotations[goalAnnotation]; ok {
+				getNode(node.Name).PMEMGoal = result
+			}
+		}
+		// Only for nodes which are known already, a label set
+		// by an admin is not a reason to add a node.
+		if mode, ok := node.Labels[modeLabel]; ok && nodes[node.Name] != nil {
+			nodes[node.Name].DeviceMode = api.DeviceMode(mode)
+		}
+	}
+
+	// The v1 API for CSIStorageCapacity is available since Kubernetes 1.24.
+	if d.k8sVersion.Compare(1, 24) >= 0 {
+		capacities := &storagev1.CSIStorageCapacityList{}
+		if err := r.client.List(ctx, capacities, client.InNamespace(d.namespace)); err != nil && !meta.IsNoMatchError(err) {
+			return fmt.Errorf("list CSIStorageCapacity: %v", err)
+		}
+		topologyKey := d.CSIDriverName() + "/node"
+		for _, capacity := range capacities.Items {
+			if capacity.NodeTopology == nil || capacity.Capacity == nil {
+				continue
+			}
+			nodeName := capacity.NodeTopology.MatchLabels[topologyKey]
+			if nodeName == "" {
+				continue
+			}
+			// There is one object per storage class, all with the same
+			// capacity unless some of them are outdated.
+			node := getNode(nodeName)
+			if node.Capacity == nil || node.Capacity.Cmp(*capacity.Capacity) < 0 {
+				c := capacity.Capacity.DeepCopy()
+				node.Capacity = &c
+			}
+			if capacity.MaximumVolumeSize != nil &&
+				(node.MaximumVolumeSize == nil || node.MaximumVolumeSize.Cmp(*capacity.MaximumVolumeSize) < 0) {
+				size := capacity.MaximumVolumeSize.DeepCopy()
+				node.MaximumVolumeSize = &size
+			}
+		}
+		if err := d.updateTotalCapacity(ctx, r, nodes); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	d.Status.Nodes = nil
+	for _, name := range names {
+		d.Status.Nodes = append(d.Status.Nodes, *nodes[name])
+	}
+	d.Status.Capacity = summarizeCapacity(d.Status.Nodes)
+	return nil
+}
+
+// updateTotalCapacity adds the size of the persistent volumes on
+// each node to the published capacity. Static volumes are skipped
+// because they do not use space that the driver manages.
+func (d *pmemCSIDeployment) updateTotalCapacity(ctx context.Context, r *ReconcileDeployment, nodes map[string]*api.NodeStatus) error {
+	pvs := &corev1.PersistentVolumeList{}
+	if err := r.client.List(ctx, pvs); err != nil {
+		return fmt.Errorf("list persistent volumes: %v", err)
+	}
+	used := map[string]*resource.Quantity{}
+	topologyKey := d.CSIDriverName() + "/node"
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil ||
+			pv.Spec.CSI.Driver != d.CSIDriverName() ||
+			strings.HasPrefix(pv.Spec.CSI.VolumeHandle, "static:") {
+			continue
+		}
+		nodeName := pvNodeName(&pv, topologyKey)
+		size, ok := pv.Spec.Capacity[corev1.ResourceStorage]
+		if nodeName == "" || !ok {
+			continue
+		}
+		if used[nodeName] == nil {
+			used[nodeName] = resource.NewQuantity(0, resource.BinarySI)
+		}
+		used[nodeName].Add(size)
+	}
+	for name, node := range nodes {
+		if node.Capacity == nil {
+			continue
+		}
+		total := node.Capacity.DeepCopy()
+		if size := used[name]; size != nil {
+			total.Add(*size)
+		}
+		node.TotalCapacity = &total
+	}
+	return nil
+}
+
+// pvNodeName returns the node that a volume is pinned to through its
+// node affinity, empty if none.
+func pvNodeName(pv *corev1.PersistentVolume, topologyKey string) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == topologyKey &&
+				expr.Operator == corev1.NodeSelectorOpIn &&
+				len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// summarizeCapacity adds up the capacity of all nodes where it is
+// known. The result is nil if there are no such nodes.
+func summarizeCapacity(nodes []api.NodeStatus) *api.CapacityStatus {
+	var summary *api.CapacityStatus
+	for _, node := range nodes {
+		if node.Capacity == nil {
+			continue
+		}
+		if summary == nil {
+			summary = &api.CapacityStatus{
+				Available:         *resource.NewQuantity(0, resource.BinarySI),
+				MaximumVolumeSize: *resource.NewQuantity(0, resource.BinarySI),
+			}
+		}
+		summary.Nodes++
+		summary.Available.Add(*node.Capacity)
+		maxSize := node.Capacity
+		if node.MaximumVolumeSize != nil {
+			maxSize = node.MaximumVolumeSize
+		}
+		if summary.MaximumVolumeSize.Cmp(*maxSize) < 0 {
+			summary.MaximumVolumeSize = maxSize.DeepCopy()
+		}
+	}
+	return summary
+}
+
+// handleNodeEvent updates the node status after a change of a node
+// driver pod or a CSINode object.
+func (d *pmemCSIDeployment) handleNodeEvent(ctx context.Context, r *ReconcileDeployment) error {
+	if d.IsPaused() {
+		return nil
+	}
+	org := d.DeepCopy()
+	if err := d.updateNodeStatus(ctx, r); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(org.Status.Nodes, d.Status.Nodes) &&
+		reflect.DeepEqual(org.Status.Capacity, d.Status.Capacity) {
+		return nil
+	}
+	if err := r.patchDeploymentStatus(d.PmemCSIDeployment, client.MergeFrom(org)); err != nil {
+		return fmt.Errorf("failed to update deployment CR status: %v", err)
+	}
+	return nil
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podError returns a description of the first problem found in the
+// container status of the pod.
+func podError(pod *corev1.Pod) string {
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" {
+			return fmt.Sprintf("container %s: %s: %s", status.Name, waiting.Reason, waiting.Message)
+		}
+		if terminated := status.LastTerminationState.Terminated; terminated != nil && !status.Ready {
+			return fmt.Sprintf("container %s: %s: %s", status.Name, terminated.Reason, terminated.Message)
+		}
+	}
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodPending {
+		return pod.Status.Message
+	}
+	return ""
+}
+
 func objectIsObsolete(ctx context.Context, objList []apiruntime.Object, toFind unstructured.Unstructured) (bool, error) {
 	l := klog.FromContext(ctx)
 	l.V(5).Info("checking for obsolete object", "name", toFind.GetName(), "gkv", toFind.GetObjectKind().GroupVersionKind())
@@ -697,6 +1387,10 @@ func (d *pmemCSIDeployment) deleteObsoleteObjects(ctx context.Context, r *Reconc
 
 		l.V(5).Info("fetching objects", "gkv", list.GetObjectKind(), "options", opts.Namespace)
 		if err := r.client.List(ctx, list, opts); err != nil {
+			if meta.IsNoMatchError(err) {
+				// CRD not installed, so there cannot be any such objects.
+				continue
+			}
 			return err
 		}
 
@@ -735,10 +1429,46 @@ func (d *pmemCSIDeployment) getCSIDriver(csiDriver *storagev1.CSIDriver) {
 
 	// Volume lifecycle modes are supported only after k8s v1.16
 	if d.k8sVersion.Compare(1, 16) >= 0 {
-		csiDriver.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{
-			storagev1.VolumeLifecyclePersistent,
-			storagev1.VolumeLifecycleEphemeral,
+		csiDriver.Spec.VolumeLifecycleModes = append([]storagev1.VolumeLifecycleMode{}, d.Spec.VolumeLifecycleModes...)
+	}
+
+	// Token requests are supported only after k8s v1.20
+	if d.k8sVersion.Compare(1, 20) >= 0 {
+		csiDriver.Spec.TokenRequests = nil
+		for _, tokenRequest := range d.Spec.TokenRequests {
+			csiDriver.Spec.TokenRequests = append(csiDriver.Spec.TokenRequests, *tokenRequest.DeepCopy())
+		}
+	}
+}
+
+func (d *pmemCSIDeployment) getStorageClass(sc *storagev1.StorageClass, spec *api.StorageClassSpec) {
+	sc.Provisioner = d.GetName()
+	sc.Parameters = map[string]string{}
+	if spec.FSType != "" {
+		sc.Parameters["csi.storage.k8s.io/fstype"] = spec.FSType
+	}
+	if spec.Usage != "" {
+		sc.Parameters[parameters.UsageModel] = spec.Usage
+	}
+	if spec.EraseAfter != nil {
+		sc.Parameters[parameters.EraseAfter] = strconv.FormatBool(*spec.EraseAfter)
+	}
+	if spec.VerifyErase != nil {
+		sc.Parameters[parameters.VerifyErase] = strconv.FormatBool(*spec.VerifyErase)
+	}
+	bindingMode := spec.VolumeBindingMode
+	if bindingMode == "" {
+		bindingMode = storagev1.VolumeBindingWaitForFirstConsumer
+	}
+	sc.VolumeBindingMode = &bindingMode
+
+	if spec.Default {
+		if sc.Annotations == nil {
+			sc.Annotations = map[string]string{}
 		}
+		sc.Annotations[defaultStorageClassAnnotation] = "true"
+	} else {
+		delete(sc.Annotations, defaultStorageClassAnnotation)
 	}
 }
 
@@ -757,6 +1487,111 @@ func (d *pmemCSIDeployment) getService(service *corev1.Service, t corev1.Service
 	}
 }
 
+// metricsServiceLabels returns the labels of the metrics Service for
+// the given component ("controller" or "node"). They are also used
+// by the ServiceMonitor to select the Service.
+func (d *pmemCSIDeployment) metricsServiceLabels(component string) map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":      "pmem-csi-" + component + "-metrics",
+		"app.kubernetes.io/part-of":   "pmem-csi",
+		"app.kubernetes.io/component": component,
+		"app.kubernetes.io/instance":  d.Name,
+	}
+}
+
+func (d *pmemCSIDeployment) getControllerMetricsService(service *corev1.Service) {
+	service.Labels = joinMaps(service.Labels, d.metricsServiceLabels("controller"))
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	service.Spec.Ports = []corev1.ServicePort{
+		{
+			Name:       "metrics",
+			Port:       d.Spec.Ports.ControllerMetrics,
+			TargetPort: intstr.FromInt32(d.Spec.Ports.ControllerMetrics),
+		},
+		{
+			Name:       "provisioner-metrics",
+			Port:       d.Spec.Ports.ProvisionerMetrics,
+			TargetPort: intstr.FromInt32(d.Spec.Ports.ProvisionerMetrics),
+		},
+	}
+	service.Spec.Selector = map[string]string{
+		"app.kubernetes.io/name":     "pmem-csi-controller",
+		"app.kubernetes.io/instance": d.Name,
+	}
+}
+
+func (d *pmemCSIDeployment) getNodeMetricsService(service *corev1.Service) {
+	service.Labels = joinMaps(service.Labels, d.metricsServiceLabels("node"))
+	// Headless, Prometheus scrapes each node pod individually.
+	service.Spec.ClusterIP = corev1.ClusterIPNone
+	service.Spec.Ports = []corev1.ServicePort{
+		{
+			Name:       "metrics",
+			Port:       d.Spec.Ports.NodeMetrics,
+			TargetPort: intstr.FromInt32(d.Spec.Ports.NodeMetrics),
+		},
+	}
+	service.Spec.Selector = map[string]string{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.Name,
+	}
+}
+
+func (d *pmemCSIDeployment) getServiceMonitor(sm *unstructured.Unstructured, component string, ports ...string) {
+	labels := d.metricsServiceLabels(component)
+	sm.SetLabels(joinMaps(sm.GetLabels(), labels))
+
+	var endpoints []interface{}
+	for _, port := range ports {
+		endpoint := map[string]interface{}{
+			"port": port,
+		}
+		if d.WithSecureMetrics() {
+			endpoint["scheme"] = "https"
+			endpoint["bearerTokenFile"] = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+			endpoint["tlsConfig"] = d.serviceMonitorTLSConfig(component)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	matchLabels := map[string]interface{}{}
+	for key, value := range labels {
+		matchLabels[key] = value
+	}
+	sm.Object["spec"] = map[string]interface{}{
+		"endpoints": endpoints,
+		"namespaceSelector": map[string]interface{}{
+			"matchNames": []interface{}{d.namespace},
+		},
+		"selector": map[string]interface{}{
+			"matchLabels": matchLabels,
+		},
+	}
+}
+
+// serviceMonitorTLSConfig trusts the CA from the TLS secret, which
+// then must contain a ca.crt. Self-signed certificates generated by
+// kube-rbac-proxy cannot be verified.
+func (d *pmemCSIDeployment) serviceMonitorTLSConfig(component string) map[string]interface{} {
+	if d.Spec.Metrics.TLSSecret == "" {
+		return map[string]interface{}{
+			"insecureSkipVerify": true,
+		}
+	}
+	serviceName := d.MetricsServiceName()
+	if component == "node" {
+		serviceName = d.NodeMetricsServiceName()
+	}
+	return map[string]interface{}{
+		"ca": map[string]interface{}{
+			"secret": map[string]interface{}{
+				"name": d.Spec.Metrics.TLSSecret,
+				"key":  "ca.crt",
+			},
+		},
+		"serverName": serviceName + "." + d.namespace + ".svc",
+	}
+}
+
 func (d *pmemCSIDeployment) getWebhooksRole(role *rbacv1.Role) {
 	role.Rules = []rbacv1.PolicyRule{
 		{
@@ -767,6 +1602,16 @@ func (d *pmemCSIDeployment) getWebhooksRole(role *rbacv1.Role) {
 			},
 		},
 	}
+	if d.GetControllerReplicas() > 1 {
+		// For the leader election lease.
+		role.Rules = append(role.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs: []string{
+				"get", "create", "update",
+			},
+		})
+	}
 }
 
 func (d *pmemCSIDeployment) getWebhooksRoleBinding(rb *rbacv1.RoleBinding) {
@@ -881,6 +1726,55 @@ func (d *pmemCSIDeployment) getNodeOpenShiftRoleBinding(rb *rbacv1.RoleBinding)
 		Kind:     "ClusterRole",
 		Name:     "system:openshift:scc:privileged",
 	}
+	if d.Spec.OpenShiftSCC {
+		rb.RoleRef.Name = d.NodeSCCClusterRoleName()
+	}
+}
+
+func (d *pmemCSIDeployment) getNodeSCCClusterRole(cr *rbacv1.ClusterRole) {
+	cr.Rules = []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{"security.openshift.io"},
+			Resources:     []string{"securitycontextconstraints"},
+			ResourceNames: []string{d.NodeSCCName()},
+			Verbs:         []string{"use"},
+		},
+	}
+}
+
+// getNodeSCC allows what the node driver pods need: a privileged
+// container and host paths. Everything else is as restrictive as
+// possible. Users and groups are not listed, the SCC is granted via
+// RBAC.
+func (d *pmemCSIDeployment) getNodeSCC(scc *unstructured.Unstructured) {
+	runAsAny := func() map[string]interface{} {
+		return map[string]interface{}{"type": "RunAsAny"}
+	}
+	for key, value := range map[string]interface{}{
+		"allowHostDirVolumePlugin": true,
+		"allowHostIPC":             false,
+		"allowHostNetwork":         d.Spec.NodeHostNetwork,
+		"allowHostPID":             false,
+		"allowHostPorts":           d.Spec.NodeHostNetwork,
+		"allowPrivilegeEscalation": true,
+		"allowPrivilegedContainer": true,
+		"readOnlyRootFilesystem":   false,
+		"runAsUser":                runAsAny(),
+		"seLinuxContext":           runAsAny(),
+		"fsGroup":                  runAsAny(),
+		"supplementalGroups":       runAsAny(),
+		"seccompProfiles":          []interface{}{"*"},
+		"volumes": []interface{}{
+			"configMap",
+			"downwardAPI",
+			"emptyDir",
+			"hostPath",
+			"projected",
+			"secret",
+		},
+	} {
+		scc.Object[key] = value
+	}
 }
 
 func (d *pmemCSIDeployment) getControllerProvisionerRoleBinding(rb *rbacv1.RoleBinding) {
@@ -956,6 +1850,14 @@ func (d *pmemCSIDeployment) getControllerProvisionerClusterRole(cr *rbacv1.Clust
 				"get", "list", "watch",
 			},
 		},
+		{
+			// For the NUMA topology labels of the node driver.
+			APIGroups: []string{""},
+			Resources: []string{"nodes"},
+			Verbs: []string{
+				"patch",
+			},
+		},
 	}
 }
 
@@ -974,6 +1876,32 @@ func (d *pmemCSIDeployment) getControllerProvisionerClusterRoleBinding(crb *rbac
 	}
 }
 
+// controllerUpdateStrategy returns the strategy from the spec with
+// the same defaults as in the API server, otherwise the operator would
+// keep patching the Deployment.
+func (d *pmemCSIDeployment) controllerUpdateStrategy() appsv1.DeploymentStrategy {
+	strategy := appsv1.DeploymentStrategy{}
+	if d.Spec.ControllerUpdateStrategy != nil {
+		d.Spec.ControllerUpdateStrategy.DeepCopyInto(&strategy)
+	}
+	if strategy.Type == "" {
+		strategy.Type = appsv1.RollingUpdateDeploymentStrategyType
+	}
+	if strategy.Type == appsv1.RollingUpdateDeploymentStrategyType {
+		if strategy.RollingUpdate == nil {
+			strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{}
+		}
+		defaultValue := intstr.FromString("25%")
+		if strategy.RollingUpdate.MaxUnavailable == nil {
+			strategy.RollingUpdate.MaxUnavailable = &defaultValue
+		}
+		if strategy.RollingUpdate.MaxSurge == nil {
+			strategy.RollingUpdate.MaxSurge = &defaultValue
+		}
+	}
+	return strategy
+}
+
 func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 	replicas := int32(d.Spec.ControllerReplicas)
 	if replicas <= 0 {
@@ -1000,6 +1928,7 @@ func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 	ss.Labels["app.kubernetes.io/instance"] = d.Name
 
 	ss.Spec.Replicas = &replicas
+	ss.Spec.Strategy = d.controllerUpdateStrategy()
 	ss.Spec.Selector = &metav1.LabelSelector{
 		MatchLabels: map[string]string{
 			"app.kubernetes.io/name":     "pmem-csi-controller",
@@ -1015,20 +1944,52 @@ func (d *pmemCSIDeployment) getControllerDeployment(ss *appsv1.Deployment) {
 			"app.kubernetes.io/instance":  d.Name,
 			"pmem-csi.intel.com/webhook":  "ignore",
 		})
-	ss.Spec.Template.ObjectMeta.Annotations = map[string]string{
-		"pmem-csi.intel.com/scrape": "containers",
-	}
-	ss.Spec.Template.Spec.PriorityClassName = "system-cluster-critical"
+	ss.Spec.Template.ObjectMeta.Annotations = joinMaps(
+		joinMaps(d.Spec.Annotations, d.RestartAnnotations()),
+		map[string]string{
+			"pmem-csi.intel.com/scrape": "containers",
+		})
+	ss.Spec.Template.Spec.PriorityClassName = d.Spec.ControllerPriorityClassName
+	ss.Spec.Template.Spec.RuntimeClassName = d.runtimeClassName()
 	ss.Spec.Template.Spec.ServiceAccountName = d.GetHyphenedName() + "-webhooks"
+	ss.Spec.Template.Spec.ImagePullSecrets = d.Spec.ImagePullSecrets
 	ss.Spec.Template.Spec.Containers = []corev1.Container{
 		d.getControllerContainer(),
 	}
+	if d.WithSecureMetrics() {
+		ss.Spec.Template.Spec.Containers = append(ss.Spec.Template.Spec.Containers,
+			d.getMetricsProxyContainer("metrics-proxy", d.Spec.Ports.ControllerMetrics, "/metrics/simple", "/healthz", "/readyz"))
+	}
 	// Allow this pod to run on all nodes.
 	setTolerations(&ss.Spec.Template.Spec)
-	ss.Spec.Template.Spec.Volumes = []corev1.Volume{}
+	setHostNetwork(&ss.Spec.Template.Spec, d.Spec.ControllerHostNetwork)
+	d.setSecurityProfiles(&ss.Spec.Template)
+	d.setProxyEnv(&ss.Spec.Template.Spec)
+	ss.Spec.Template.Spec.Volumes = append([]corev1.Volume{}, d.getMetricsProxyVolumes()...)
+}
+
+func (d *pmemCSIDeployment) getControllerPodDisruptionBudget(pdb *policyv1.PodDisruptionBudget) {
+	if pdb.Labels == nil {
+		pdb.Labels = map[string]string{}
+	}
+	pdb.Labels["app.kubernetes.io/name"] = "pmem-csi-controller"
+	pdb.Labels["app.kubernetes.io/part-of"] = "pmem-csi"
+	pdb.Labels["app.kubernetes.io/component"] = "controller"
+	pdb.Labels["app.kubernetes.io/instance"] = d.Name
+
+	minAvailable := intstr.FromInt(1)
+	pdb.Spec.MinAvailable = &minAvailable
+	pdb.Spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app.kubernetes.io/name":     "pmem-csi-controller",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	}
 }
 
-func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
+// getNodeDaemonSet sets up the default node driver DaemonSet if mode
+// is nil, otherwise the one for that node mode.
+func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet, mode *api.NodeModeSpec) {
 	directoryOrCreate := corev1.HostPathDirectoryOrCreate
 
 	// To make sure that the default values set by the API server
@@ -1050,11 +2011,21 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 	ds.Labels["app.kubernetes.io/component"] = "node"
 	ds.Labels["app.kubernetes.io/instance"] = d.Name
 
+	selector := map[string]string{
+		"app.kubernetes.io/name":     "pmem-csi-node",
+		"app.kubernetes.io/instance": d.Name,
+	}
+	nodeSelector := d.Spec.NodeSelector
+	if mode != nil {
+		// Pods of the default DaemonSet do not have this label.
+		// Its selector cannot be changed, so it also matches
+		// the pods of the node modes. The DaemonSet controller
+		// ignores those because they have a different owner.
+		selector[api.NodeModeLabel] = mode.Name
+		nodeSelector = joinMaps(d.Spec.NodeSelector, mode.NodeSelector)
+	}
 	ds.Spec.Selector = &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			"app.kubernetes.io/name":     "pmem-csi-node",
-			"app.kubernetes.io/instance": d.Name,
-		},
+		MatchLabels: selector,
 	}
 	ds.Spec.UpdateStrategy.Type = appsv1.RollingUpdateDaemonSetStrategyType
 	if ds.Spec.UpdateStrategy.RollingUpdate == nil {
@@ -1068,28 +2039,62 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 		maxUnavailable = &one
 	}
 	ds.Spec.UpdateStrategy.RollingUpdate.MaxUnavailable = maxUnavailable
+	maxSurge := d.Spec.MaxSurge
+	if maxSurge == nil {
+		// Same as for maxUnavailable, the API server sets "0".
+		zero := intstr.FromInt(0)
+		maxSurge = &zero
+	}
+	ds.Spec.UpdateStrategy.RollingUpdate.MaxSurge = maxSurge
 	ds.Spec.Template.ObjectMeta.Labels = joinMaps(
 		d.Spec.Labels,
-		map[string]string{
-			"app.kubernetes.io/name":      "pmem-csi-node",
+		joinMaps(selector, map[string]string{
 			"app.kubernetes.io/part-of":   "pmem-csi",
 			"app.kubernetes.io/component": "node",
-			"app.kubernetes.io/instance":  d.Name,
 			"pmem-csi.intel.com/webhook":  "ignore",
+		}))
+	ds.Spec.Template.ObjectMeta.Annotations = joinMaps(
+		joinMaps(d.Spec.Annotations, d.RestartAnnotations()),
+		map[string]string{
+			"pmem-csi.intel.com/scrape": "containers",
 		})
-	ds.Spec.Template.ObjectMeta.Annotations = map[string]string{
-		"pmem-csi.intel.com/scrape": "containers",
-	}
-	ds.Spec.Template.Spec.PriorityClassName = "system-node-critical"
+	ds.Spec.Template.Spec.PriorityClassName = d.Spec.NodePriorityClassName
+	ds.Spec.Template.Spec.RuntimeClassName = d.runtimeClassName()
 	ds.Spec.Template.Spec.ServiceAccountName = d.ProvisionerServiceAccountName()
-	ds.Spec.Template.Spec.NodeSelector = d.Spec.NodeSelector
+	ds.Spec.Template.Spec.ImagePullSecrets = d.Spec.ImagePullSecrets
+	ds.Spec.Template.Spec.NodeSelector = nodeSelector
+	if mode == nil {
+		ds.Spec.Template.Spec.Affinity = d.NodeModesAffinity()
+		mode = &api.NodeModeSpec{
+			DeviceMode:     d.Spec.DeviceMode,
+			PMEMPercentage: d.Spec.PMEMPercentage,
+		}
+	} else {
+		ds.Spec.Template.Spec.Affinity = d.NodeSelectorAffinity()
+	}
 	ds.Spec.Template.Spec.Containers = []corev1.Container{
-		d.getNodeDriverContainer(),
+		d.getNodeDriverContainer(mode),
 		d.getNodeRegistrarContainer(),
-		d.getProvisionerContainer(),
+	}
+	if d.WithProvisioner() {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, d.getProvisionerContainer())
+	}
+	if d.withLivenessProbe() {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers, d.getLivenessProbeContainer())
+	}
+	if d.WithSecureMetrics() {
+		ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers,
+			d.getMetricsProxyContainer("metrics-proxy", d.Spec.Ports.NodeMetrics, "/metrics/simple", "/healthz", "/readyz"))
+		if d.WithProvisioner() {
+			ds.Spec.Template.Spec.Containers = append(ds.Spec.Template.Spec.Containers,
+				d.getMetricsProxyContainer("provisioner-metrics-proxy", d.Spec.Ports.ProvisionerMetrics))
+		}
 	}
 	// Allow this pod to run on all master nodes.
 	setTolerations(&ds.Spec.Template.Spec)
+	setHostNetwork(&ds.Spec.Template.Spec, d.Spec.NodeHostNetwork)
+	d.setSecurityProfiles(&ds.Spec.Template)
+	d.setProxyEnv(&ds.Spec.Template.Spec)
 	ds.Spec.Template.Spec.Volumes = []corev1.Volume{
 		{
 			Name: "socket-dir",
@@ -1155,10 +2160,11 @@ func (d *pmemCSIDeployment) getNodeDaemonSet(ds *appsv1.DaemonSet) {
 			},
 		},
 	}
+	ds.Spec.Template.Spec.Volumes = append(ds.Spec.Template.Spec.Volumes, d.getMetricsProxyVolumes()...)
 }
 
 func (d *pmemCSIDeployment) getControllerCommand() []string {
-	nodeSelector := types.NodeSelector(d.Spec.NodeSelector)
+	nodeSelector := d.DriverNodeSelector()
 	args := []string{
 		"/usr/local/bin/pmem-csi-driver",
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
@@ -1168,15 +2174,18 @@ func (d *pmemCSIDeployment) getControllerCommand() []string {
 		"-nodeSelector=" + nodeSelector.String(),
 	}
 
-	args = append(args, fmt.Sprintf("-metricsListen=:%d", controllerMetricsPort))
+	args = append(args, "-metricsListen="+d.metricsListen(d.Spec.Ports.ControllerMetrics))
+	if d.GetControllerReplicas() > 1 {
+		args = append(args, "-leader-election")
+	}
 
 	return args
 }
 
-func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
-	return []string{
+func (d *pmemCSIDeployment) getNodeDriverCommand(mode *api.NodeModeSpec) []string {
+	command := []string{
 		"/usr/local/bin/pmem-csi-driver",
-		fmt.Sprintf("-deviceManager=%s", d.Spec.DeviceMode),
+		fmt.Sprintf("-deviceManager=%s", mode.DeviceMode),
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
 		"-logging-format=" + string(d.Spec.LogFormat),
 		"-mode=node",
@@ -1184,9 +2193,33 @@ func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
 		"-nodeid=$(KUBE_NODE_NAME)",
 		"-statePath=/var/lib/$(PMEM_CSI_DRIVER_NAME)",
 		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
-		fmt.Sprintf("-pmemPercentage=%d", d.Spec.PMEMPercentage),
-		fmt.Sprintf("-metricsListen=:%d", nodeMetricsPort),
+		fmt.Sprintf("-pmemPercentage=%d", mode.PMEMPercentage),
+		"-metricsListen=" + d.metricsListen(d.Spec.Ports.NodeMetrics),
+	}
+	if d.Spec.PMEMReserved != "" {
+		command = append(command, "-pmemReserved="+d.Spec.PMEMReserved)
+	}
+	if d.Spec.SystemRAMPercentage != 0 {
+		command = append(command, fmt.Sprintf("-pmemSystemRAMPercentage=%d", d.Spec.SystemRAMPercentage))
+	}
+	for _, pool := range d.Spec.PMEMPools {
+		command = append(command, "-pmemPool="+pool.Name+"="+strings.Join(pool.Regions, ","))
+	}
+	return append(command, d.getPMEMBusTypesArgs()...)
+}
+
+// getPMEMBusTypesArgs returns the -pmemBusTypes parameter for all
+// modes of the driver which work with PMEM. It is empty when the
+// driver may use all PMEM.
+func (d *pmemCSIDeployment) getPMEMBusTypesArgs() []string {
+	if len(d.Spec.PMEMBusTypes) == 0 {
+		return nil
+	}
+	var busTypes []string
+	for _, busType := range d.Spec.PMEMBusTypes {
+		busTypes = append(busTypes, string(busType))
 	}
+	return []string{"-pmemBusTypes=" + strings.Join(busTypes, ",")}
 }
 
 func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
@@ -1216,7 +2249,7 @@ func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
 				},
 			},
 		},
-		Ports:                    d.getMetricsPorts(controllerMetricsPort),
+		Ports:                    d.getMetricsPorts(d.Spec.Ports.ControllerMetrics),
 		Resources:                *d.Spec.ControllerDriverResources,
 		TerminationMessagePath:   "/dev/termination-log",
 		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
@@ -1226,10 +2259,19 @@ func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
 		LivenessProbe: getMetricsProbe(6, 10, "/simple"),
 		StartupProbe:  getMetricsProbe(60, 1, "/simple"),
 	}
+	if d.withLivenessProbe() {
+		// The controller has no CSI socket that the livenessprobe
+		// sidecar could check, so the driver's own endpoints
+		// are used.
+		c.LivenessProbe = getHealthzProbe(6, 10, "metrics")
+		c.StartupProbe = getReadyzProbe(60, 1, "metrics")
+		c.ReadinessProbe = getReadyzProbe(3, 10, "metrics")
+	}
+	d.secureMetricsProbes(&c, d.Spec.Ports.ControllerMetrics)
 	return c
 }
 
-func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
+func (d *pmemCSIDeployment) getNodeDriverContainer(mode *api.NodeModeSpec) corev1.Container {
 	bidirectional := corev1.MountPropagationBidirectional
 	true := true
 	root := int64(0)
@@ -1237,7 +2279,7 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 		Name:            "pmem-driver",
 		Image:           d.Spec.Image,
 		ImagePullPolicy: d.Spec.PullPolicy,
-		Command:         d.getNodeDriverCommand(),
+		Command:         d.getNodeDriverCommand(mode),
 		Env: []corev1.EnvVar{
 			{
 				Name: "KUBE_NODE_NAME",
@@ -1290,7 +2332,7 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 				MountPropagation: &bidirectional,
 			},
 		},
-		Ports:     d.getMetricsPorts(nodeMetricsPort),
+		Ports:     d.getMetricsPorts(d.Spec.Ports.NodeMetrics),
 		Resources: *d.Spec.NodeDriverResources,
 		SecurityContext: &corev1.SecurityContext{
 			Privileged: &true,
@@ -1299,9 +2341,27 @@ func (d *pmemCSIDeployment) getNodeDriverContainer() corev1.Container {
 		},
 		TerminationMessagePath:   "/tmp/termination-log",
 		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
-		LivenessProbe:            getMetricsProbe(6, 10, "/simple"),
-		StartupProbe:             getMetricsProbe(300, 1, "/simple"),
+		// The driver's readyz endpoint also checks the
+		// device manager, the state directory and the CSI
+		// socket.
+		LivenessProbe:  getHealthzProbe(6, 10, "metrics"),
+		StartupProbe:   getReadyzProbe(300, 1, "metrics"),
+		ReadinessProbe: getReadyzProbe(3, 10, "metrics"),
+	}
+	if d.withLivenessProbe() {
+		// The port is served by the livenessprobe sidecar, which
+		// checks the driver via CSI Probe calls. It has to be
+		// listed here because named ports are looked up in the
+		// container that gets probed.
+		c.Ports = append(c.Ports, corev1.ContainerPort{
+			Name:          "healthz",
+			ContainerPort: d.Spec.Ports.NodeHealthz,
+			Protocol:      "TCP",
+		})
+		c.LivenessProbe = getHealthzProbe(6, 10, "healthz")
+		c.StartupProbe = getHealthzProbe(300, 1, "healthz")
 	}
+	d.secureMetricsProbes(&c, d.Spec.Ports.NodeMetrics)
 
 	return c
 }
@@ -1323,6 +2383,8 @@ func (d *pmemCSIDeployment) getProvisionerContainer() corev1.Container {
 			"--timeout=5m",
 			"--default-fstype=ext4",
 			"--worker-threads=5",
+			// PVC name and namespace for events created by the driver.
+			"--extra-create-metadata",
 		},
 		Env: []corev1.EnvVar{
 			{
@@ -1341,7 +2403,7 @@ func (d *pmemCSIDeployment) getProvisionerContainer() corev1.Container {
 				MountPath: "/csi",
 			},
 		},
-		Ports:     d.getMetricsPorts(provisionerMetricsPort),
+		Ports:     d.getMetricsPorts(d.Spec.Ports.ProvisionerMetrics),
 		Resources: *d.Spec.ProvisionerResources,
 		SecurityContext: &corev1.SecurityContext{
 			ReadOnlyRootFilesystem: &true,
@@ -1377,7 +2439,13 @@ func (d *pmemCSIDeployment) getProvisionerContainer() corev1.Container {
 	}
 
 	// Order must match the reference files (--enable-capacity before --metrics-address).
-	container.Args = append(container.Args, fmt.Sprintf("--metrics-address=:%d", provisionerMetricsPort))
+	container.Args = append(container.Args, "--metrics-address="+d.metricsListen(d.Spec.Ports.ProvisionerMetrics))
+	if d.WithSecureMetrics() {
+		// The provisioner has no separate health endpoint and
+		// kubelet cannot authenticate for /metrics.
+		container.LivenessProbe = nil
+		container.StartupProbe = nil
+	}
 
 	return container
 }
@@ -1473,16 +2541,26 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 			"app.kubernetes.io/instance":  d.Name,
 			"pmem-csi.intel.com/webhook":  "ignore",
 		})
+	spec.Template.ObjectMeta.Annotations = joinMaps(d.Spec.Annotations, nil)
 	podSpec := &ds.Spec.Template.Spec
 	podSpec.ServiceAccountName = d.NodeSetupServiceAccountName()
+	podSpec.ImagePullSecrets = d.Spec.ImagePullSecrets
+	podSpec.RuntimeClassName = d.runtimeClassName()
 	// Allow this pod to run on all nodes.
 	setTolerations(podSpec)
-	podSpec.NodeSelector = map[string]string{
-		d.Name + "/convert-raw-namespaces": "force",
+	if d.Spec.RawNamespaceConversion == api.RawNamespaceConversionAll {
+		podSpec.NodeSelector = nil
+	} else {
+		podSpec.NodeSelector = map[string]string{
+			d.Name + "/convert-raw-namespaces": "force",
+		}
 	}
+	podSpec.Affinity = d.NodeSetupAffinity()
 	podSpec.Containers = []corev1.Container{
 		d.getNodeSetupContainer(),
 	}
+	d.setSecurityProfiles(&ds.Spec.Template)
+	d.setProxyEnv(podSpec)
 	podSpec.Volumes = []corev1.Volume{
 		{
 			Name: "dev-dir",
@@ -1505,6 +2583,31 @@ func (d *pmemCSIDeployment) getNodeSetupDaemonSet(ds *appsv1.DaemonSet) {
 	}
 }
 
+// getNodeDiscoveryDaemonSet is the same as the node setup DaemonSet,
+// except for the name, the nodes it runs on and the command.
+func (d *pmemCSIDeployment) getNodeDiscoveryDaemonSet(ds *appsv1.DaemonSet) {
+	d.getNodeSetupDaemonSet(ds)
+
+	ds.Labels["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	ds.Labels["app.kubernetes.io/component"] = "node-discovery"
+	ds.Spec.Selector.MatchLabels["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	ds.Spec.Template.Labels["app.kubernetes.io/name"] = "pmem-csi-node-discovery"
+	ds.Spec.Template.Labels["app.kubernetes.io/component"] = "node-discovery"
+	podSpec := &ds.Spec.Template.Spec
+	podSpec.NodeSelector = nil
+	podSpec.Affinity = d.NodeDiscoveryAffinity()
+	nodeSelector := d.DriverNodeSelector()
+	podSpec.Containers[0].Command = append([]string{
+		"/usr/local/bin/pmem-csi-driver",
+		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+		"-logging-format=" + string(d.Spec.LogFormat),
+		"-mode=discover-pmem",
+		"-nodeSelector=" + nodeSelector.String(),
+		"-nodeid=$(KUBE_NODE_NAME)",
+		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
+	}, d.getPMEMBusTypesArgs()...)
+}
+
 func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 	true := true
 	root := int64(0)
@@ -1527,6 +2630,10 @@ func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 				Name:  "TERMINATION_LOG_PATH",
 				Value: "/tmp/termination-log",
 			},
+			{
+				Name:  "PMEM_CSI_DRIVER_NAME",
+				Value: d.GetName(),
+			},
 		},
 		VolumeMounts: []corev1.VolumeMount{
 			{
@@ -1555,18 +2662,59 @@ func (d *pmemCSIDeployment) getNodeSetupContainer() corev1.Container {
 }
 
 func (d *pmemCSIDeployment) getNodeSetupCommand() []string {
-	nodeSelector := types.NodeSelector(d.Spec.NodeSelector)
-	return []string{
+	nodeSelector := d.DriverNodeSelector()
+	command := []string{
 		"/usr/local/bin/pmem-csi-driver",
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
 		"-logging-format=" + string(d.Spec.LogFormat),
 		"-mode=force-convert-raw-namespaces",
 		"-nodeSelector=" + nodeSelector.String(),
 		"-nodeid=$(KUBE_NODE_NAME)",
+		"-drivername=$(PMEM_CSI_DRIVER_NAME)",
+	}
+	if d.Spec.RawNamespaceConversionDryRun {
+		command = append(command, "-dryRun")
+	}
+	if goal := d.Spec.PMEMGoal; goal != nil {
+		arg := fmt.Sprintf("-pmemGoal=%d", goal.AppDirectPercentage)
+		if goal.Interleaved != nil && !*goal.Interleaved {
+			arg += ",not-interleaved"
+		}
+		command = append(command, arg)
+	}
+	return append(command, d.getPMEMBusTypesArgs()...)
+}
+
+func (d *pmemCSIDeployment) getLivenessProbeContainer() corev1.Container {
+	true := true
+	return corev1.Container{
+		Name:            "liveness-probe",
+		Image:           d.Spec.LivenessProbeImage,
+		ImagePullPolicy: d.Spec.PullPolicy,
+		Args: []string{
+			fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+			"--csi-address=/csi/csi.sock",
+			fmt.Sprintf("--health-port=%d", d.Spec.Ports.NodeHealthz),
+		},
+		SecurityContext: &corev1.SecurityContext{
+			ReadOnlyRootFilesystem: &true,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "socket-dir",
+				MountPath: "/csi",
+			},
+		},
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
 	}
 }
 
 func (d *pmemCSIDeployment) getMetricsPorts(port int32) []corev1.ContainerPort {
+	if d.WithSecureMetrics() {
+		// Served by kube-rbac-proxy.
+		return nil
+	}
 	return []corev1.ContainerPort{
 		{
 			Name:          "metrics",
@@ -1576,6 +2724,146 @@ func (d *pmemCSIDeployment) getMetricsPorts(port int32) []corev1.ContainerPort {
 	}
 }
 
+// metricsListen returns the listen address of a metrics server.
+func (d *pmemCSIDeployment) metricsListen(port int32) string {
+	if d.WithSecureMetrics() {
+		return fmt.Sprintf("127.0.0.1:%d", port+metricsUpstreamOffset)
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+// secureMetricsProbes redirects probes of the metrics port to
+// kube-rbac-proxy. It passes them through without authentication
+// because of the ignored paths in getMetricsProxyContainer.
+func (d *pmemCSIDeployment) secureMetricsProbes(c *corev1.Container, port int32) {
+	if !d.WithSecureMetrics() {
+		return
+	}
+	for _, probe := range []*corev1.Probe{c.LivenessProbe, c.StartupProbe, c.ReadinessProbe} {
+		if probe != nil && probe.HTTPGet != nil && probe.HTTPGet.Port.String() == "metrics" {
+			probe.HTTPGet.Scheme = "HTTPS"
+			probe.HTTPGet.Port = intstr.FromInt(int(port))
+		}
+	}
+}
+
+// getMetricsProxyContainer returns a kube-rbac-proxy sidecar which
+// serves the given metrics port via HTTPS.
+func (d *pmemCSIDeployment) getMetricsProxyContainer(name string, port int32, ignorePaths ...string) corev1.Container {
+	true := true
+	metrics := d.Spec.Metrics
+	c := corev1.Container{
+		Name:            name,
+		Image:           metrics.RBACProxyImage,
+		ImagePullPolicy: d.Spec.PullPolicy,
+		Args: []string{
+			fmt.Sprintf("--v=%d", d.Spec.LogLevel),
+			fmt.Sprintf("--secure-listen-address=0.0.0.0:%d", port),
+			fmt.Sprintf("--upstream=http://127.0.0.1:%d/", port+metricsUpstreamOffset),
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "metrics",
+				ContainerPort: port,
+				Protocol:      "TCP",
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			ReadOnlyRootFilesystem: &true,
+		},
+		TerminationMessagePath:   corev1.TerminationMessagePathDefault,
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+	if len(ignorePaths) > 0 {
+		c.Args = append(c.Args, "--ignore-paths="+strings.Join(ignorePaths, ","))
+	}
+	if metrics.TLSSecret != "" {
+		c.Args = append(c.Args,
+			"--tls-cert-file=/etc/metrics-tls/tls.crt",
+			"--tls-private-key-file=/etc/metrics-tls/tls.key",
+		)
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      "metrics-tls",
+			MountPath: "/etc/metrics-tls",
+			ReadOnly:  true,
+		})
+	}
+	if metrics.ClientCASecret != "" {
+		c.Args = append(c.Args, "--client-ca-file=/etc/metrics-client-ca/ca.crt")
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      "metrics-client-ca",
+			MountPath: "/etc/metrics-client-ca",
+			ReadOnly:  true,
+		})
+	}
+	return c
+}
+
+// getMetricsProxyVolumes returns the volumes for the secrets used
+// by getMetricsProxyContainer.
+func (d *pmemCSIDeployment) getMetricsProxyVolumes() []corev1.Volume {
+	if !d.WithSecureMetrics() {
+		return nil
+	}
+	var volumes []corev1.Volume
+	for _, v := range []struct{ name, secret string }{
+		{"metrics-tls", d.Spec.Metrics.TLSSecret},
+		{"metrics-client-ca", d.Spec.Metrics.ClientCASecret},
+	} {
+		if v.secret != "" {
+			volumes = append(volumes, corev1.Volume{
+				Name: v.name,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: v.secret,
+					},
+				},
+			})
+		}
+	}
+	return volumes
+}
+
+func (d *pmemCSIDeployment) getMetricsAuthClusterRole(cr *rbacv1.ClusterRole) {
+	cr.Rules = []rbacv1.PolicyRule{
+		{
+			APIGroups: []string{"authentication.k8s.io"},
+			Resources: []string{"tokenreviews"},
+			Verbs:     []string{"create"},
+		},
+		{
+			APIGroups: []string{"authorization.k8s.io"},
+			Resources: []string{"subjectaccessreviews"},
+			Verbs:     []string{"create"},
+		},
+	}
+}
+
+func (d *pmemCSIDeployment) getMetricsAuthClusterRoleBinding(crb *rbacv1.ClusterRoleBinding) {
+	// The node driver runs with the provisioner service account.
+	crb.Subjects = []rbacv1.Subject{
+		{
+			Kind:      "ServiceAccount",
+			Name:      d.ProvisionerServiceAccountName(),
+			Namespace: d.namespace,
+		},
+	}
+	// Like the controller metrics service, the subject for the
+	// controller only exists together with the controller.
+	if d.WithController() {
+		crb.Subjects = append(crb.Subjects, rbacv1.Subject{
+			Kind:      "ServiceAccount",
+			Name:      d.WebhooksServiceAccountName(),
+			Namespace: d.namespace,
+		})
+	}
+	crb.RoleRef = rbacv1.RoleRef{
+		APIGroup: "rbac.authorization.k8s.io",
+		Kind:     "ClusterRole",
+		Name:     d.MetricsAuthClusterRoleName(),
+	}
+}
+
 func (d *pmemCSIDeployment) getObjectMeta(name string, isClusterResource bool) metav1.ObjectMeta {
 	meta := metav1.ObjectMeta{
 		Name: name,
@@ -1605,6 +2893,32 @@ func getMetricsProbe(failureThreshold int32, periodSeconds int32, pathSuffix str
 	}
 }
 
+func getHealthzProbe(failureThreshold int32, periodSeconds int32, port string) *corev1.Probe {
+	probe := getMetricsProbe(failureThreshold, periodSeconds, "")
+	probe.HTTPGet.Path = "/healthz"
+	probe.HTTPGet.Port = intstr.FromString(port)
+	return probe
+}
+
+func getReadyzProbe(failureThreshold int32, periodSeconds int32, port string) *corev1.Probe {
+	probe := getHealthzProbe(failureThreshold, periodSeconds, port)
+	probe.HTTPGet.Path = "/readyz"
+	return probe
+}
+
+// selectorChanged returns true if the label selector of a Deployment
+// or DaemonSet was modified. The selector cannot be updated, which
+// matters for adopted objects with a different selector.
+func selectorChanged(old, new client.Object) bool {
+	switch old := old.(type) {
+	case *appsv1.Deployment:
+		return !reflect.DeepEqual(old.Spec.Selector, new.(*appsv1.Deployment).Spec.Selector)
+	case *appsv1.DaemonSet:
+		return !reflect.DeepEqual(old.Spec.Selector, new.(*appsv1.DaemonSet).Spec.Selector)
+	}
+	return false
+}
+
 func joinMaps(left, right map[string]string) map[string]string {
 	result := map[string]string{}
 	for key, value := range left {
@@ -1621,6 +2935,98 @@ func setTolerations(podSpec *corev1.PodSpec) {
 	setToleration(podSpec, "NoExecute")
 }
 
+// setSecurityProfiles must be called after setting the containers
+// and the pod annotations. Privileged containers are not confined by
+// seccomp or AppArmor, so they explicitly get "unconfined" to make
+// that visible.
+func (d *pmemCSIDeployment) setSecurityProfiles(template *corev1.PodTemplateSpec) {
+	if d.Spec.SeccompProfile != nil {
+		if template.Spec.SecurityContext == nil {
+			template.Spec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		template.Spec.SecurityContext.SeccompProfile = d.Spec.SeccompProfile.DeepCopy()
+	} else if template.Spec.SecurityContext != nil {
+		template.Spec.SecurityContext.SeccompProfile = nil
+	}
+
+	for key := range template.Annotations {
+		if strings.HasPrefix(key, appArmorAnnotationPrefix) {
+			delete(template.Annotations, key)
+		}
+	}
+	for i := range template.Spec.Containers {
+		c := &template.Spec.Containers[i]
+		privileged := c.SecurityContext != nil &&
+			c.SecurityContext.Privileged != nil &&
+			*c.SecurityContext.Privileged
+		if d.Spec.SeccompProfile != nil && privileged {
+			c.SecurityContext.SeccompProfile = &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeUnconfined,
+			}
+		}
+		if d.Spec.AppArmorProfile != "" {
+			profile := d.Spec.AppArmorProfile
+			if privileged {
+				profile = "unconfined"
+			}
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			template.Annotations[appArmorAnnotationPrefix+c.Name] = profile
+		}
+	}
+}
+
+// runtimeClassName returns the RuntimeClass for all pods, nil if
+// the cluster default is to be used.
+func (d *pmemCSIDeployment) runtimeClassName() *string {
+	if d.Spec.RuntimeClassName == "" {
+		return nil
+	}
+	name := d.Spec.RuntimeClassName
+	return &name
+}
+
+// setProxyEnv must be called after setting the containers.
+func (d *pmemCSIDeployment) setProxyEnv(podSpec *corev1.PodSpec) {
+	if d.Spec.Proxy == nil {
+		return
+	}
+	var env []corev1.EnvVar
+	for _, e := range []struct{ name, value string }{
+		{"HTTP_PROXY", d.Spec.Proxy.HTTPProxy},
+		{"HTTPS_PROXY", d.Spec.Proxy.HTTPSProxy},
+		{"NO_PROXY", d.Spec.Proxy.NoProxy},
+	} {
+		if e.value != "" {
+			env = append(env, corev1.EnvVar{Name: e.name, Value: e.value})
+		}
+	}
+	for i := range podSpec.Containers {
+		podSpec.Containers[i].Env = append(podSpec.Containers[i].Env, env...)
+	}
+}
+
+// setHostNetwork must be called after setting the containers because
+// container ports are also host ports in the host network. The
+// apiserver would fill those in, which would cause redundant patching.
+func setHostNetwork(podSpec *corev1.PodSpec, hostNetwork bool) {
+	podSpec.HostNetwork = hostNetwork
+	if !hostNetwork {
+		podSpec.DNSPolicy = corev1.DNSClusterFirst
+		return
+	}
+	// Without this, the pod would use the DNS settings of the host
+	// and could not resolve cluster services anymore.
+	podSpec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+	for i := range podSpec.Containers {
+		ports := podSpec.Containers[i].Ports
+		for e := range ports {
+			ports[e].HostPort = ports[e].ContainerPort
+		}
+	}
+}
+
 func setToleration(podSpec *corev1.PodSpec, effect corev1.TaintEffect) {
 	newToleration := corev1.Toleration{
 		Effect:   effect,
@@ -10,7 +10,10 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"reflect"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,14 +25,17 @@ import (
 	"github.com/intel/pmem-csi/pkg/version"
 
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	v1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
-	"k8s.io/kubectl/pkg/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	crhandler "sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -73,7 +79,15 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 				// Deployment CR deleted, remove it's reference from cache.
 				// Objects owned by it are automatically garbage collected.
 				r.deleteDeployment(e.ObjectOld.GetName())
-				return false
+				// The uninstall policy still needs to be executed
+				// before the finalizer can be removed.
+				return controllerutil.ContainsFinalizer(e.ObjectNew, api.UninstallFinalizer)
+			}
+			if e.ObjectOld.IsPaused() != e.ObjectNew.IsPaused() {
+				// Only the metadata changed, but after
+				// resuming we need to catch up.
+				l.V(3).Info("pause state changed", "paused", e.ObjectNew.IsPaused())
+				return true
 			}
 			if e.ObjectOld.GetGeneration() == e.ObjectNew.GetGeneration() {
 				// No changes registered
@@ -123,7 +137,9 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 	// One exception is: If we fail to handle here, then we pass this
 	// event to reconcile loop, where it should recognize these requests
 	// and just requeue. Expecting that the failure is retried.
-	eventFunc := func(what string, obj client.Object) bool {
+	// obj is used to find the owning deployment, latest is the most
+	// recent revision of it.
+	eventFunc := func(what string, obj, latest client.Object) bool {
 		// TODO:
 		// - check that this output is okay
 		// - check why "go test" does not cover this code
@@ -138,8 +154,7 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 		}
 		r.reconcileMutex.Lock()
 		defer r.reconcileMutex.Unlock()
-		// TODO (?): single parameter
-		if err := d.handleEvent(ctx, obj, obj, r); err != nil {
+		if err := d.handleEvent(ctx, latest, obj, r); err != nil {
 			l.Error(err, "while handling the event, requeuing the event")
 			return true
 		}
@@ -147,14 +162,14 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 	}
 	sop := predicate.Funcs{
 		DeleteFunc: func(e event.DeleteEvent) bool {
-			return eventFunc("DELETED", e.Object)
+			return eventFunc("DELETED", e.Object, e.Object)
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			if e.ObjectNew.GetDeletionTimestamp() != nil {
 				// We can handle this in delete handler
 				return false
 			}
-			return eventFunc("UPDATED", e.ObjectOld)
+			return eventFunc("UPDATED", e.ObjectOld, e.ObjectNew)
 		},
 		CreateFunc: func(e event.CreateEvent) bool {
 			// Do not handle sub-object create events as the object was create by us.
@@ -174,9 +189,75 @@ func add(ctx context.Context, mgr manager.Manager, r *ReconcileDeployment) error
 		}
 	}
 
+	// Node driver pods, CSINode objects, the node setup results
+	// in node annotations and the published storage capacity are
+	// not owned by a deployment, but their changes are needed for
+	// the node status. Like sub-object
+	// changes, they are handled directly.
+	nodeEventFunc := func(what string, obj client.Object) bool {
+		for _, d := range r.getDeploymentsForNodeEvent(ctx, obj) {
+			l.V(5).Info(what, "object", logger.KObjWithType(obj), "deployment", d.Name)
+			r.reconcileMutex.Lock()
+			err := d.handleNodeEvent(ctx, r)
+			r.reconcileMutex.Unlock()
+			if err != nil {
+				l.Error(err, "updating the node status failed", "deployment", d.Name)
+			}
+		}
+		return false
+	}
+	np := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			if isNode(e.Object) && !hasNodeSetupResult(e.Object) {
+				return false
+			}
+			return nodeEventFunc("CREATED", e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if isNode(e.ObjectNew) && reflect.DeepEqual(e.ObjectOld.GetAnnotations(), e.ObjectNew.GetAnnotations()) {
+				// Nodes get updated frequently, but only
+				// the node setup result matters.
+				return false
+			}
+			return nodeEventFunc("UPDATED", e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			if isNode(e.Object) && !hasNodeSetupResult(e.Object) {
+				return false
+			}
+			return nodeEventFunc("DELETED", e.Object)
+		},
+	}
+	nodeResources := []client.Object{&corev1.Pod{}, &storagev1.CSINode{}, &corev1.Node{}}
+	// The v1 API for CSIStorageCapacity is available since Kubernetes 1.24.
+	if r.k8sVersion.Compare(1, 24) >= 0 {
+		nodeResources = append(nodeResources, &storagev1.CSIStorageCapacity{})
+	}
+	for _, resource := range nodeResources {
+		if err := c.Watch(source.Kind(mgr.GetCache(), resource, &crhandler.EnqueueRequestForObject{}, np)); err != nil {
+			return fmt.Errorf("create watch: %v", err)
+		}
+	}
+
 	return nil
 }
 
+func isNode(obj client.Object) bool {
+	_, ok := obj.(*corev1.Node)
+	return ok
+}
+
+// hasNodeSetupResult checks for the annotation of some deployment
+// with the result of the raw namespace conversion.
+func hasNodeSetupResult(obj client.Object) bool {
+	for key := range obj.GetAnnotations() {
+		if strings.HasSuffix(key, "/"+api.RawNamespaceConversionAnnotation) {
+			return true
+		}
+	}
+	return false
+}
+
 // blank assignment to verify that ReconcileDeployment implements reconcile.Reconciler
 var _ reconcile.Reconciler = &ReconcileDeployment{}
 
@@ -193,9 +274,13 @@ type ReconcileDeployment struct {
 	evBroadcaster record.EventBroadcaster
 	evRecorder    record.EventRecorder
 	namespace     string
-	k8sVersion    version.Version
+	// additional namespaces that deployments may use
+	watchNamespaces []string
+	k8sVersion      version.Version
 	// container image used for deploying the operator
 	containerImage string
+	// version of the operator, "unknown" if not set
+	operatorVersion string
 	// known deployments
 	deployments map[string]*api.PmemCSIDeployment
 	// deploymentsMutex protects concurrent access to deployments
@@ -205,8 +290,16 @@ type ReconcileDeployment struct {
 	// changes.
 	reconcileMutex sync.Mutex
 	reconcileHooks map[ReconcileHook]struct{}
+	// errorLogger is used for errors which cause Reconcile to be
+	// retried. A deployment which cannot be installed would
+	// otherwise log the same error every few minutes.
+	errorLogger klog.Logger
 }
 
+// repeatedErrorLogWindow is the window for logger.Deduplicate in
+// errorLogger.
+const repeatedErrorLogWindow = 30 * time.Minute
+
 // NewReconcileDeployment creates new deployment reconciler
 func NewReconcileDeployment(ctx context.Context, client client.Client, opts pmemcontroller.ControllerOptions) (reconcile.Reconciler, error) {
 	// "reconcile" will be part of all future log messages.
@@ -232,22 +325,28 @@ func NewReconcileDeployment(ctx context.Context, client client.Client, opts pmem
 		}
 		opts.DriverImage = image
 	}
-	l.Info("new instance", "defaultDriverImage", opts.DriverImage)
+	if opts.OperatorVersion == "" {
+		opts.OperatorVersion = "unknown"
+	}
+	l.Info("new instance", "defaultDriverImage", opts.DriverImage, "version", opts.OperatorVersion)
 
 	evBroadcaster := record.NewBroadcaster()
 	evBroadcaster.StartRecordingToSink(&v1.EventSinkImpl{Interface: opts.EventsClient})
 	evRecorder := evBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "pmem-csi-operator"})
 
 	return &ReconcileDeployment{
-		ctx:            ctx,
-		client:         client,
-		evBroadcaster:  evBroadcaster,
-		evRecorder:     evRecorder,
-		k8sVersion:     opts.K8sVersion,
-		namespace:      opts.Namespace,
-		containerImage: opts.DriverImage,
-		deployments:    map[string]*api.PmemCSIDeployment{},
-		reconcileHooks: map[ReconcileHook]struct{}{},
+		ctx:             ctx,
+		client:          client,
+		evBroadcaster:   evBroadcaster,
+		evRecorder:      evRecorder,
+		k8sVersion:      opts.K8sVersion,
+		namespace:       opts.Namespace,
+		watchNamespaces: opts.WatchNamespaces,
+		containerImage:  opts.DriverImage,
+		operatorVersion: opts.OperatorVersion,
+		deployments:     map[string]*api.PmemCSIDeployment{},
+		reconcileHooks:  map[ReconcileHook]struct{}{},
+		errorLogger:     logger.Deduplicate(l, repeatedErrorLogWindow),
 	}, nil
 }
 
@@ -265,13 +364,14 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 
 	requeueDelayOnError := 2 * time.Minute
 	l := klog.FromContext(r.ctx).WithValues("deployment", request.NamespacedName.Name)
+	el := r.errorLogger.WithValues("deployment", request.NamespacedName.Name)
 	ctx = klog.NewContext(ctx, l)
 
 	// Fetch the Deployment instance
 	deployment := &api.PmemCSIDeployment{}
 	err = r.client.Get(ctx, request.NamespacedName, deployment)
 	if err != nil {
-		l.Error(err, "failed to retrieve CR to reconcile", "deployment", request.Name)
+		el.Error(err, "failed to retrieve CR to reconcile", "deployment", request.Name)
 		// One reason for this could be a failed predicate event handler of
 		// sub-objects. So requeue the request so that the same predicate
 		// handle could be called on that object.
@@ -283,9 +383,22 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	// If the deployment has already been marked for deletion,
 	// then we don't need to do anything for it because the
 	// apiserver is in the process of garbage-collecting all
-	// sub-objects and then will remove it.
+	// sub-objects and then will remove it. The exception is
+	// an uninstall policy which must run first.
 	if deployment.DeletionTimestamp != nil {
-		return reconcile.Result{Requeue: false}, nil
+		if !controllerutil.ContainsFinalizer(deployment, api.UninstallFinalizer) {
+			return reconcile.Result{Requeue: false}, nil
+		}
+		done, err := r.uninstall(ctx, deployment)
+		if err != nil {
+			el.Error(err, "uninstall failed")
+			r.evRecorder.Event(deployment, corev1.EventTypeWarning, api.EventReasonFailed, err.Error())
+			return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
+		}
+		if !done {
+			return reconcile.Result{RequeueAfter: uninstallRequeueDelay}, nil
+		}
+		return reconcile.Result{}, nil
 	}
 
 	for f := range r.reconcileHooks {
@@ -294,11 +407,26 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 		}
 	}
 
+	if deployment.IsPaused() {
+		// Remember the deployment anyway, handleEvent
+		// must see that it is paused.
+		r.saveDeployment(deployment)
+		l.V(2).Info("reconcile paused", "deployment", deployment.GetName())
+		r.evRecorder.Event(deployment, corev1.EventTypeNormal, api.EventReasonPaused, "Reconciliation paused by annotation "+api.PausedAnnotation)
+		return reconcile.Result{}, nil
+	}
+
 	if deployment.Status.Phase == api.DeploymentPhaseNew {
 		/* New deployment */
 		r.evRecorder.Event(deployment, corev1.EventTypeNormal, api.EventReasonNew, "Processing new driver deployment")
 	}
 
+	// Must be done before making a copy for the status update.
+	if err := r.updateFinalizer(ctx, deployment); err != nil {
+		el.Error(err, "reconcile failed")
+		return reconcile.Result{Requeue: true, RequeueAfter: requeueDelayOnError}, err
+	}
+
 	// Cache the deployment
 	r.saveDeployment(deployment)
 
@@ -324,11 +452,14 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	}()
 
 	d, err := r.newDeployment(ctx, dep)
+	if err == nil {
+		err = r.checkConflicts(ctx, d)
+	}
 	if err == nil {
 		err = d.reconcile(ctx, r)
 	}
 	if err != nil {
-		l.Error(err, "reconcile failed")
+		el.Error(err, "reconcile failed")
 		dep.Status.Phase = api.DeploymentPhaseFailed
 		dep.Status.Reason = err.Error()
 		r.evRecorder.Event(dep, corev1.EventTypeWarning, api.EventReasonFailed, err.Error())
@@ -343,6 +474,166 @@ func (r *ReconcileDeployment) Reconcile(ctx context.Context, request reconcile.R
 	return reconcile.Result{}, nil
 }
 
+// checkConflicts compares the deployment against all older deployments
+// and returns an error if it cannot run alongside them. The result is
+// also recorded in the DeploymentConflict condition. The older
+// deployment wins, so a new deployment cannot break an existing one.
+func (r *ReconcileDeployment) checkConflicts(ctx context.Context, d *pmemCSIDeployment) error {
+	list := &api.PmemCSIDeploymentList{}
+	if err := r.client.List(ctx, list); err != nil {
+		return fmt.Errorf("list deployments: %v", err)
+	}
+
+	var conflicts []string
+	for i := range list.Items {
+		other := &list.Items[i]
+		if other.UID == d.UID ||
+			other.DeletionTimestamp != nil ||
+			!isOlder(other, d.PmemCSIDeployment) {
+			continue
+		}
+		// Apply the same defaults as for the deployment itself.
+		// An older deployment which cannot be reconciled has no
+		// objects and thus cannot conflict.
+		o, err := r.newDeployment(ctx, other.DeepCopy())
+		if err != nil {
+			continue
+		}
+		if reason := conflictReason(d, o); reason != "" {
+			conflicts = append(conflicts, fmt.Sprintf("%q (%s)", other.Name, reason))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		err := fmt.Errorf("conflicts with deployment %s", strings.Join(conflicts, ", "))
+		d.SetCondition(api.DeploymentConflict, corev1.ConditionTrue, err.Error())
+		return err
+	}
+	if d.HasCondition(api.DeploymentConflict) {
+		d.SetCondition(api.DeploymentConflict, corev1.ConditionFalse, "No conflicts with other deployments.")
+	}
+	return nil
+}
+
+// isOlder orders deployments by creation time, with the name as
+// tie breaker.
+func isOlder(a, b *api.PmemCSIDeployment) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// conflictReason returns a non-empty explanation if the two
+// deployments cannot run at the same time.
+func conflictReason(a, b *pmemCSIDeployment) string {
+	// Sub-objects must not be shared. Cluster-scoped objects
+	// (ClusterRoles, StorageClasses, ...) conflict regardless of
+	// the namespace, namespaced objects only in the same
+	// namespace.
+	bObjects := b.subObjectKeys()
+	var shared []string
+	for key := range a.subObjectKeys() {
+		if bObjects[key] {
+			shared = append(shared, key)
+		}
+	}
+	if len(shared) > 0 {
+		sort.Strings(shared)
+		return "same " + strings.Join(shared, ", ")
+	}
+	// Two node drivers on the same node would manage the same
+	// PMEM and, with host networking, also use the same ports.
+	if nodeSelectorsOverlap(a.PmemCSIDeployment, b.PmemCSIDeployment) {
+		return "node driver pods on the same nodes"
+	}
+	return ""
+}
+
+// subObjectKeys returns kind, namespace and name of all sub-objects
+// that the deployment creates.
+func (d *pmemCSIDeployment) subObjectKeys() map[string]bool {
+	keys := map[string]bool{}
+	for _, handler := range d.getSubObjectHandlers() {
+		if handler.enabled != nil && !handler.enabled(d) {
+			continue
+		}
+		o := handler.object(d)
+		kind := o.GetObjectKind().GroupVersionKind().Kind
+		if kind == "" {
+			kind = handler.objType.Elem().Name()
+		}
+		keys[fmt.Sprintf("%s %s", kind, klog.KObj(o))] = true
+	}
+	return keys
+}
+
+// nodeSelectorsOverlap returns true if some node could be selected
+// by both deployments. The node selectors of node modes only
+// narrow down the selection further and are ignored.
+func nodeSelectorsOverlap(a, b *api.PmemCSIDeployment) bool {
+	var reqs []metav1.LabelSelectorRequirement
+	for _, d := range []*api.PmemCSIDeployment{a, b} {
+		for key, value := range d.Spec.NodeSelector {
+			reqs = append(reqs, metav1.LabelSelectorRequirement{
+				Key:      key,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   []string{value},
+			})
+		}
+		reqs = append(reqs, d.Spec.NodeSelectorExpressions...)
+	}
+
+	// Requirements for different labels are independent, so
+	// a node can match all of them if that is possible for
+	// each label.
+	byKey := map[string][]metav1.LabelSelectorRequirement{}
+	for _, req := range reqs {
+		byKey[req.Key] = append(byKey[req.Key], req)
+	}
+	for _, reqs := range byKey {
+		if !satisfiable(reqs) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiable returns true if some value (or the absence of the
+// label) matches all requirements for one label.
+func satisfiable(reqs []metav1.LabelSelectorRequirement) bool {
+	var allowed sets.Set[string]
+	excluded := sets.New[string]()
+	mustExist, mustNotExist := false, false
+	for _, req := range reqs {
+		switch req.Operator {
+		case metav1.LabelSelectorOpIn:
+			mustExist = true
+			values := sets.New(req.Values...)
+			if allowed == nil {
+				allowed = values
+			} else {
+				allowed = allowed.Intersection(values)
+			}
+		case metav1.LabelSelectorOpNotIn:
+			excluded.Insert(req.Values...)
+		case metav1.LabelSelectorOpExists:
+			mustExist = true
+		case metav1.LabelSelectorOpDoesNotExist:
+			mustNotExist = true
+		}
+	}
+	switch {
+	case mustExist && mustNotExist:
+		return false
+	case allowed != nil:
+		return allowed.Difference(excluded).Len() > 0
+	default:
+		// Some value not mentioned anywhere or no label at all.
+		return true
+	}
+}
+
 func (r *ReconcileDeployment) Namespace() string {
 	return r.namespace
 }
@@ -425,6 +716,51 @@ func (r *ReconcileDeployment) getDeploymentFor(ctx context.Context, obj metav1.O
 	return nil, fmt.Errorf("Not found")
 }
 
+// getDeploymentsForNodeEvent returns the deployments which are
+// affected by a change of a pod or CSINode object.
+func (r *ReconcileDeployment) getDeploymentsForNodeEvent(ctx context.Context, obj client.Object) []*pmemCSIDeployment {
+	r.deploymentsMutex.Lock()
+	defer r.deploymentsMutex.Unlock()
+	var deployments []*api.PmemCSIDeployment
+	switch obj.(type) {
+	case *corev1.Pod:
+		labels := obj.GetLabels()
+		if labels["app.kubernetes.io/name"] != "pmem-csi-node" {
+			return nil
+		}
+		if d, ok := r.deployments[labels["app.kubernetes.io/instance"]]; ok {
+			deployments = append(deployments, d)
+		}
+	case *storagev1.CSIStorageCapacity:
+		topology := obj.(*storagev1.CSIStorageCapacity).NodeTopology
+		if topology == nil {
+			return nil
+		}
+		for _, d := range r.deployments {
+			if _, ok := topology.MatchLabels[d.CSIDriverName()+"/node"]; ok {
+				deployments = append(deployments, d)
+			}
+		}
+	default:
+		// Checking whether the CSINode object lists the driver is
+		// not enough because the driver might just have been removed.
+		for _, d := range r.deployments {
+			deployments = append(deployments, d)
+		}
+	}
+
+	var result []*pmemCSIDeployment
+	for _, d := range deployments {
+		// Don't modify the existing deployment, clone it first.
+		d, err := r.newDeployment(ctx, d.DeepCopy())
+		if err != nil {
+			continue
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
 // newDeployment prepares for object creation and will modify the PmemCSIDeployment.
 // Callers who don't want that need to clone it first.
 func (r *ReconcileDeployment) newDeployment(ctx context.Context, deployment *api.PmemCSIDeployment) (*pmemCSIDeployment, error) {
@@ -432,15 +768,36 @@ func (r *ReconcileDeployment) newDeployment(ctx context.Context, deployment *api
 		return nil, err
 	}
 
+	namespace := r.namespace
+	if deployment.Spec.Namespace != "" {
+		namespace = deployment.Spec.Namespace
+	}
+	if !r.isWatched(namespace) {
+		return nil, fmt.Errorf("namespace %q is not enabled in the operator", namespace)
+	}
+
 	d := &pmemCSIDeployment{
 		PmemCSIDeployment: deployment,
-		namespace:         r.namespace,
+		namespace:         namespace,
 		k8sVersion:        r.k8sVersion,
 	}
 
 	return d, nil
 }
 
+// isWatched returns true if the operator may create objects in the namespace.
+func (r *ReconcileDeployment) isWatched(namespace string) bool {
+	if namespace == r.namespace {
+		return true
+	}
+	for _, ns := range r.watchNamespaces {
+		if ns == metav1.NamespaceAll || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
 // containerImage returns container image name used by operator Pod
 func containerImage(ctx context.Context, cs *kubernetes.Clientset, namespace string) (string, error) {
 	const podNameEnv = "POD_NAME"
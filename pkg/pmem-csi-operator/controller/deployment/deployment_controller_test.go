@@ -26,11 +26,16 @@ import (
 	"github.com/intel/pmem-csi/pkg/version"
 	"github.com/intel/pmem-csi/test/e2e/operator/validate"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
@@ -181,6 +186,7 @@ type testContext struct {
 	evWatcher        watch.Interface
 	resourceVersions map[string]string
 	k8sVersion       version.Version
+	watchNamespaces  []string
 
 	eventsMutex sync.Mutex
 	events      []corev1.Event
@@ -210,10 +216,11 @@ func newTestContext(t *testing.T, k8sVersion version.Version, initObjs ...runtim
 
 func (tc *testContext) ResetReconciler() {
 	rc, err := deployment.NewReconcileDeployment(tc.ctx, tc.c, pmemcontroller.ControllerOptions{
-		Namespace:    testNamespace,
-		K8sVersion:   tc.k8sVersion,
-		DriverImage:  testDriverImage,
-		EventsClient: tc.cs.CoreV1().Events(metav1.NamespaceDefault),
+		Namespace:       testNamespace,
+		WatchNamespaces: tc.watchNamespaces,
+		K8sVersion:      tc.k8sVersion,
+		DriverImage:     testDriverImage,
+		EventsClient:    tc.cs.CoreV1().Events(metav1.NamespaceDefault),
 	})
 	require.NoError(tc.t, err, "create new reconciler")
 	tc.rc = rc
@@ -245,6 +252,15 @@ func createSecret(name, namespace string, data map[string][]byte) *corev1.Secret
 	}
 }
 
+// subjectNames returns the names of all subjects of the binding.
+func subjectNames(crb *rbacv1.ClusterRoleBinding) []string {
+	var names []string
+	for _, subject := range crb.Subjects {
+		names = append(names, subject.Name)
+	}
+	return names
+}
+
 func TestDeploymentController(t *testing.T) {
 	err := apis.AddToScheme(scheme.Scheme)
 	require.NoError(t, err, "add api schema")
@@ -383,11 +399,14 @@ func TestDeploymentController(t *testing.T) {
 				name: "test-deployment2",
 			}
 
+			// The node drivers must run on different nodes.
 			dep1 := getDeployment(d1)
+			dep1.Spec.NodeSelector = map[string]string{"storage": "pmem", "pmem-csi": "lvm"}
 			err := tc.c.Create(tc.ctx, dep1)
 			require.NoError(t, err, "failed to create deployment1")
 
 			dep2 := getDeployment(d2)
+			dep2.Spec.NodeSelector = map[string]string{"storage": "pmem", "pmem-csi": "direct"}
 			err = tc.c.Create(tc.ctx, dep2)
 			require.NoError(t, err, "failed to create deployment2")
 
@@ -403,6 +422,112 @@ func TestDeploymentController(t *testing.T) {
 			validateConditions(tc, d2.name, conditions)
 		})
 
+		t.Run("conflicting deployments", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			// Both map to the same object names.
+			d1 := &pmemDeployment{
+				name: "test-deployment",
+			}
+			d2 := &pmemDeployment{
+				name: "test.deployment",
+			}
+
+			dep1 := getDeployment(d1)
+			dep1.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			err := tc.c.Create(tc.ctx, dep1)
+			require.NoError(t, err, "failed to create deployment1")
+
+			dep2 := getDeployment(d2)
+			dep2.CreationTimestamp = metav1.Now()
+			err = tc.c.Create(tc.ctx, dep2)
+			require.NoError(t, err, "failed to create deployment2")
+
+			// The newer deployment must not disturb the older one.
+			tc.testReconcilePhase(d2.name, true, true, api.DeploymentPhaseFailed)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DeploymentConflict: corev1.ConditionTrue,
+			})
+			tc.testReconcilePhase(d1.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep1, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+		})
+
+		t.Run("conflicting storage class", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d1 := &pmemDeployment{
+				name: "test-deployment-1",
+			}
+			d2 := &pmemDeployment{
+				name: "test-deployment-2",
+			}
+
+			dep1 := getDeployment(d1)
+			dep1.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			dep1.Spec.NodeSelector = map[string]string{"pmem-csi": "lvm"}
+			dep1.Spec.StorageClasses = []api.StorageClassSpec{{Name: "pmem-csi-sc"}}
+			err := tc.c.Create(tc.ctx, dep1)
+			require.NoError(t, err, "failed to create deployment1")
+
+			// Different nodes, but the same cluster-scoped StorageClass.
+			dep2 := getDeployment(d2)
+			dep2.CreationTimestamp = metav1.Now()
+			dep2.Spec.NodeSelector = map[string]string{"pmem-csi": "direct"}
+			dep2.Spec.StorageClasses = []api.StorageClassSpec{{Name: "pmem-csi-sc"}}
+			err = tc.c.Create(tc.ctx, dep2)
+			require.NoError(t, err, "failed to create deployment2")
+
+			tc.testReconcilePhase(d2.name, true, true, api.DeploymentPhaseFailed)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DeploymentConflict: corev1.ConditionTrue,
+			})
+			dep := &api.PmemCSIDeployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d2.name}, dep)
+			require.NoError(t, err, "get deployment2")
+			require.Contains(t, dep.Status.Reason, "same StorageClass pmem-csi-sc", "reason")
+			tc.testReconcilePhase(d1.name, false, false, api.DeploymentPhaseRunning)
+		})
+
+		t.Run("conflicting nodes", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d1 := &pmemDeployment{
+				name: "test-deployment-1",
+			}
+			d2 := &pmemDeployment{
+				name: "test-deployment-2",
+			}
+
+			dep1 := getDeployment(d1)
+			dep1.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+			err := tc.c.Create(tc.ctx, dep1)
+			require.NoError(t, err, "failed to create deployment1")
+
+			dep2 := getDeployment(d2)
+			dep2.CreationTimestamp = metav1.Now()
+			err = tc.c.Create(tc.ctx, dep2)
+			require.NoError(t, err, "failed to create deployment2")
+
+			// The newer deployment must not disturb the older one...
+			tc.testReconcilePhase(d2.name, true, true, api.DeploymentPhaseFailed)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DeploymentConflict: corev1.ConditionTrue,
+			})
+			tc.testReconcilePhase(d1.name, false, false, api.DeploymentPhaseRunning)
+
+			// ... and can be deployed once the older one is gone.
+			err = tc.c.Delete(tc.ctx, dep1)
+			require.NoError(t, err, "failed to delete deployment1")
+			tc.testReconcilePhase(d2.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d2.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DeploymentConflict: corev1.ConditionFalse,
+				api.DriverDeployed:     corev1.ConditionTrue,
+			})
+		})
+
 		t.Run("modified deployment under reconcile", func(t *testing.T) {
 			tc := setup(t)
 			defer teardown(tc)
@@ -441,6 +566,707 @@ func TestDeploymentController(t *testing.T) {
 			validateConditions(tc, d.name, conditions)
 		})
 
+		t.Run("other namespace", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.Namespace = "other-namespace"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+
+			// Not enabled in the operator.
+			tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+
+			tc.watchNamespaces = []string{"other-namespace"}
+			tc.ResetReconciler()
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			controller := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: "other-namespace", Name: dep.ControllerDriverName()}, controller)
+			require.NoError(t, err, "controller in other namespace")
+		})
+
+		t.Run("OpenShift SCC", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.OpenShiftSCC = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			scc := &unstructured.Unstructured{}
+			scc.SetGroupVersionKind(schema.GroupVersionKind{Group: "security.openshift.io", Version: "v1", Kind: "SecurityContextConstraints"})
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.NodeSCCName()}, scc)
+			require.NoError(t, err, "get SCC")
+			require.Equal(t, true, scc.Object["allowPrivilegedContainer"], "privileged containers allowed")
+			require.Equal(t, false, scc.Object["allowHostNetwork"], "host network allowed")
+			cr := &rbacv1.ClusterRole{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.NodeSCCClusterRoleName()}, cr)
+			require.NoError(t, err, "get SCC cluster role")
+			rb := &rbacv1.RoleBinding{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeOpenShiftRoleBindingName()}, rb)
+			require.NoError(t, err, "get role binding")
+			require.Equal(t, dep.NodeSCCClusterRoleName(), rb.RoleRef.Name, "role binding with SCC")
+
+			// Disabling it again removes the SCC.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.OpenShiftSCC = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.NodeSCCName()}, scc)
+			require.True(t, errors.IsNotFound(err), "SCC removed, got error %v", err)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeOpenShiftRoleBindingName()}, rb)
+			require.NoError(t, err, "get role binding")
+			require.Equal(t, "system:openshift:scc:privileged", rb.RoleRef.Name, "role binding without SCC")
+		})
+
+		t.Run("secure metrics", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.Metrics = &api.MetricsSpec{
+				ServiceMonitor: true,
+				Secure:         true,
+				TLSSecret:      "metrics-tls",
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			var names []string
+			for _, c := range ds.Spec.Template.Spec.Containers {
+				names = append(names, c.Name)
+				switch c.Name {
+				case "pmem-driver":
+					require.Contains(t, c.Command, "-metricsListen=127.0.0.1:10110", "driver command")
+					require.Empty(t, c.Ports, "driver ports")
+					require.Equal(t, corev1.URISchemeHTTPS, c.LivenessProbe.HTTPGet.Scheme, "driver liveness probe")
+				case "external-provisioner":
+					require.Contains(t, c.Args, "--metrics-address=127.0.0.1:10111", "provisioner args")
+					require.Nil(t, c.LivenessProbe, "provisioner liveness probe")
+				case "metrics-proxy":
+					require.Contains(t, c.Args, "--tls-cert-file=/etc/metrics-tls/tls.crt", "proxy args")
+				}
+			}
+			require.Contains(t, names, "metrics-proxy", "node containers")
+			require.Contains(t, names, "provisioner-metrics-proxy", "node containers")
+			crb := &rbacv1.ClusterRoleBinding{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.MetricsAuthClusterRoleBindingName()}, crb)
+			require.NoError(t, err, "get metrics auth cluster role binding")
+			require.ElementsMatch(t, []string{dep.ProvisionerServiceAccountName(), dep.WebhooksServiceAccountName()}, subjectNames(crb), "metrics auth subjects")
+			sm := &unstructured.Unstructured{}
+			sm.SetGroupVersionKind(schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"})
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeServiceMonitorName()}, sm)
+			require.NoError(t, err, "get node service monitor")
+			endpoints, _, _ := unstructured.NestedSlice(sm.Object, "spec", "endpoints")
+			require.Len(t, endpoints, 1, "service monitor endpoints")
+			require.Equal(t, "https", endpoints[0].(map[string]interface{})["scheme"], "service monitor scheme")
+
+			// Back to plain HTTP.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Metrics.Secure = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Len(t, ds.Spec.Template.Spec.Containers, 3, "node containers")
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.MetricsAuthClusterRoleBindingName()}, crb)
+			require.True(t, errors.IsNotFound(err), "cluster role binding removed, got error %v", err)
+		})
+
+		t.Run("node status", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "node-driver-1",
+					Namespace: testNamespace,
+					Labels: map[string]string{
+						"app.kubernetes.io/name":     "pmem-csi-node",
+						"app.kubernetes.io/instance": d.name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					NodeName: "node-1",
+				},
+				Status: corev1.PodStatus{
+					Phase: corev1.PodRunning,
+					ContainerStatuses: []corev1.ContainerStatus{{
+						Name: "pmem-driver",
+						State: corev1.ContainerState{
+							Waiting: &corev1.ContainerStateWaiting{
+								Reason:  "CrashLoopBackOff",
+								Message: "back-off restarting failed container",
+							},
+						},
+					}},
+				},
+			}
+			err = tc.c.Create(tc.ctx, pod)
+			require.NoError(t, err, "failed to create pod")
+			for _, nodeName := range []string{"node-1", "node-2"} {
+				csiNode := &storagev1.CSINode{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: nodeName,
+					},
+					Spec: storagev1.CSINodeSpec{
+						Drivers: []storagev1.CSINodeDriver{{
+							Name:   d.name,
+							NodeID: nodeName,
+						}},
+					},
+				}
+				err = tc.c.Create(tc.ctx, csiNode)
+				require.NoError(t, err, "failed to create CSINode")
+			}
+			capacity := resource.MustParse("100Gi")
+			csiStorageCapacity := &storagev1.CSIStorageCapacity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "capacity-1",
+					Namespace: testNamespace,
+				},
+				NodeTopology: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						d.name + "/node": "node-2",
+					},
+				},
+				StorageClassName: "pmem-csi-sc",
+				Capacity:         &capacity,
+			}
+			err = tc.c.Create(tc.ctx, csiStorageCapacity)
+			require.NoError(t, err, "failed to create CSIStorageCapacity")
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node-3",
+					Annotations: map[string]string{
+						d.name + "/" + api.RawNamespaceConversionAnnotation: "dry run: 1 namespace(s) would be converted",
+						d.name + "/" + api.PMEMGoalAnnotation:               "not needed: found region0",
+					},
+				},
+			}
+			err = tc.c.Create(tc.ctx, node)
+			require.NoError(t, err, "failed to create Node")
+			node = &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "node-2",
+					Labels: map[string]string{
+						d.name + "/" + api.DeviceModeLabel: "direct",
+					},
+				},
+			}
+			err = tc.c.Create(tc.ctx, node)
+			require.NoError(t, err, "failed to create Node")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			expected := []api.NodeStatus{
+				{
+					Node:       "node-1",
+					Phase:      corev1.PodRunning,
+					Registered: true,
+					LastError:  "container pmem-driver: CrashLoopBackOff: back-off restarting failed container",
+				},
+				{
+					Node:       "node-2",
+					Registered: true,
+					DeviceMode: api.DeviceModeDirect,
+				},
+				{
+					Node:                   "node-3",
+					RawNamespaceConversion: "dry run: 1 namespace(s) would be converted",
+					PMEMGoal:               "not needed: found region0",
+				},
+			}
+			if tc.k8sVersion.Compare(1, 24) >= 0 {
+				expected[1].Capacity = &capacity
+				expected[1].TotalCapacity = &capacity
+			}
+			dep = &api.PmemCSIDeployment{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, expected, dep.Status.Nodes, "node status")
+		})
+
+		t.Run("raw namespace conversion", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.RawNamespaceConversion = api.RawNamespaceConversionAll
+			dep.Spec.RawNamespaceConversionDryRun = true
+			interleaved := false
+			dep.Spec.PMEMGoal = &api.PMEMGoalSpec{AppDirectPercentage: 50, Interleaved: &interleaved}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeSetupName()}, ds)
+			require.NoError(t, err, "get node setup")
+			podSpec := ds.Spec.Template.Spec
+			require.Empty(t, podSpec.NodeSelector, "node setup node selector")
+			require.Equal(t, []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      "storage",
+					Operator: corev1.NodeSelectorOpNotIn,
+					Values:   []string{"pmem"},
+				}},
+			}}, podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, "node setup affinity")
+			require.Contains(t, podSpec.Containers[0].Command, "-dryRun", "node setup command")
+			require.Contains(t, podSpec.Containers[0].Command, "-pmemGoal=50,not-interleaved", "node setup command")
+
+			// Disabling it removes the node setup.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.RawNamespaceConversion = api.RawNamespaceConversionDisabled
+			dep.Spec.PMEMGoal = nil
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeSetupName()}, ds)
+			require.True(t, errors.IsNotFound(err), "node setup removed, got error %v", err)
+			crb := &rbacv1.ClusterRoleBinding{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.NodeSetupClusterRoleBindingName()}, crb)
+			require.True(t, errors.IsNotFound(err), "node setup cluster role binding removed, got error %v", err)
+		})
+
+		t.Run("node driver only", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			controller := false
+			dep.Spec.Components = &api.ComponentsSpec{Controller: &controller}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.ControllerDriverName()}, &appsv1.Deployment{})
+			require.True(t, errors.IsNotFound(err), "no controller, got error %v", err)
+
+			// Secure metrics only for the node driver.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.Metrics = &api.MetricsSpec{
+				ServiceMonitor: true,
+				Secure:         true,
+				TLSSecret:      "metrics-tls",
+			}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.MetricsServiceName()}, &corev1.Service{})
+			require.True(t, errors.IsNotFound(err), "no controller metrics service, got error %v", err)
+			crb := &rbacv1.ClusterRoleBinding{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Name: dep.MetricsAuthClusterRoleBindingName()}, crb)
+			require.NoError(t, err, "get metrics auth cluster role binding")
+			require.Equal(t, []string{dep.ProvisionerServiceAccountName()}, subjectNames(crb), "metrics auth subjects")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "Disabled", dep.Status.Components[api.ControllerDriver].Status, "controller status")
+		})
+
+		t.Run("ephemeral only", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			csiDriver := &storagev1.CSIDriver{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.GetName()}, csiDriver)
+			require.NoError(t, err, "get CSIDriver")
+			require.Equal(t, []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecycleEphemeral}, csiDriver.Spec.VolumeLifecycleModes, "volume lifecycle modes")
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node driver")
+			for _, container := range ds.Spec.Template.Spec.Containers {
+				require.NotEqual(t, "external-provisioner", container.Name, "provisioner container")
+			}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ProvisionerClusterRoleName()}, &rbacv1.ClusterRole{})
+			require.True(t, errors.IsNotFound(err), "no provisioner cluster role, got error %v", err)
+		})
+
+		t.Run("token requests", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			tokenRequests := []storagev1.TokenRequest{{Audience: "pmem-csi.example.com"}}
+			dep.Spec.TokenRequests = tokenRequests
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			csiDriver := &storagev1.CSIDriver{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.GetName()}, csiDriver)
+			require.NoError(t, err, "get CSIDriver")
+			require.Equal(t, tokenRequests, csiDriver.Spec.TokenRequests, "token requests")
+		})
+
+		t.Run("restart", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node driver")
+			require.NotContains(t, ds.Spec.Template.Annotations, api.RestartedAtAnnotation, "initial annotations")
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			restartedAt := metav1.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+			dep.Spec.RestartedAt = &restartedAt
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Equal(t, "2021-01-01T12:00:00Z", ds.Spec.Template.Annotations[api.RestartedAtAnnotation], "node driver restart annotation")
+			controller := &appsv1.Deployment{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.ControllerDriverName(), Namespace: testNamespace}, controller)
+			require.NoError(t, err, "get controller")
+			require.Equal(t, "2021-01-01T12:00:00Z", controller.Spec.Template.Annotations[api.RestartedAtAnnotation], "controller restart annotation")
+		})
+
+		t.Run("node discovery", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.RawNamespaceConversion = api.RawNamespaceConversionDisabled
+			dep.Spec.NodeDiscovery = true
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDiscoveryName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node discovery")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-mode=discover-pmem", "node discovery command")
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeSetupName(), Namespace: testNamespace}, &appsv1.DaemonSet{})
+			require.True(t, errors.IsNotFound(err), "no node setup, got error %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeSetupClusterRoleName()}, &rbacv1.ClusterRole{})
+			require.NoError(t, err, "get node setup cluster role")
+		})
+
+		t.Run("PMEM bus types", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.PMEMBusTypes = []api.PMEMBusType{api.PMEMBusTypeNVDIMM, api.PMEMBusTypeCXL}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			for _, name := range []string{dep.NodeDriverName(), dep.NodeSetupName()} {
+				ds := &appsv1.DaemonSet{}
+				err = tc.c.Get(tc.ctx, client.ObjectKey{Name: name, Namespace: testNamespace}, ds)
+				require.NoError(t, err, "get %s", name)
+				require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-pmemBusTypes=nvdimm,cxl", "%s command", name)
+			}
+		})
+
+		t.Run("PMEM reservation", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.PMEMReserved = "16Gi"
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonRunning}, false)
+
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Contains(t, ds.Spec.Template.Spec.Containers[0].Command, "-pmemReserved=16Gi", "command")
+		})
+
+		t.Run("capacity status", func(t *testing.T) {
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			capacity := func(node, size, maxSize string) *storagev1.CSIStorageCapacity {
+				c := resource.MustParse(size)
+				m := resource.MustParse(maxSize)
+				return &storagev1.CSIStorageCapacity{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "capacity-" + node,
+						Namespace: testNamespace,
+					},
+					NodeTopology: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							d.name + "/node": node,
+						},
+					},
+					StorageClassName:  "pmem-csi-sc",
+					Capacity:          &c,
+					MaximumVolumeSize: &m,
+				}
+			}
+
+			pv := func(name, node, size, handle string) *corev1.PersistentVolume {
+				return &corev1.PersistentVolume{
+					ObjectMeta: metav1.ObjectMeta{
+						Name: name,
+					},
+					Spec: corev1.PersistentVolumeSpec{
+						Capacity: corev1.ResourceList{
+							corev1.ResourceStorage: resource.MustParse(size),
+						},
+						PersistentVolumeSource: corev1.PersistentVolumeSource{
+							CSI: &corev1.CSIPersistentVolumeSource{
+								Driver:       d.name,
+								VolumeHandle: handle,
+							},
+						},
+						NodeAffinity: &corev1.VolumeNodeAffinity{
+							Required: &corev1.NodeSelector{
+								NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+									MatchExpressions: []corev1.NodeSelectorRequirement{{
+										Key:      d.name + "/node",
+										Operator: corev1.NodeSelectorOpIn,
+										Values:   []string{node},
+									}},
+								}},
+							},
+						},
+					},
+				}
+			}
+
+			tc := setup(t, capacity("node-1", "10Gi", "8Gi"), capacity("node-2", "20Gi", "6Gi"),
+				pv("pv-1", "node-1", "4Gi", "pvc-1"),
+				pv("pv-2", "node-1", "2Gi", "pvc-2"),
+				pv("pv-static", "node-1", "1Gi", "static:lvm:vg0/data"))
+			defer teardown(tc)
+			if tc.k8sVersion.Compare(1, 24) < 0 {
+				t.Skip("CSIStorageCapacity v1 API not available")
+			}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.NotNil(t, dep.Status.Capacity, "capacity status")
+			require.Equal(t, 2, dep.Status.Capacity.Nodes, "nodes with capacity")
+			require.Equal(t, "30Gi", dep.Status.Capacity.Available.String(), "available capacity")
+			require.Equal(t, "8Gi", dep.Status.Capacity.MaximumVolumeSize.String(), "maximum volume size")
+			require.Len(t, dep.Status.Nodes, 2, "node status")
+			require.Equal(t, "6Gi", dep.Status.Nodes[1].MaximumVolumeSize.String(), "maximum volume size of node-2")
+			require.Equal(t, "16Gi", dep.Status.Nodes[0].TotalCapacity.String(), "total capacity of node-1")
+			require.Equal(t, "20Gi", dep.Status.Nodes[1].TotalCapacity.String(), "total capacity of node-2")
+		})
+
+		t.Run("PVC validation", func(t *testing.T) {
+			d := &pmemDeployment{
+				name: "test-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Spec.StorageClasses = []api.StorageClassSpec{{Name: "pmem-csi-sc"}}
+			dep.Spec.ValidatePVCs = true
+			capacity := resource.MustParse("100Gi")
+			csiStorageCapacity := &storagev1.CSIStorageCapacity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "capacity-1",
+					Namespace: testNamespace,
+				},
+				NodeTopology: &metav1.LabelSelector{
+					MatchLabels: map[string]string{
+						d.name + "/node": "node-1",
+					},
+				},
+				StorageClassName: "pmem-csi-sc",
+				Capacity:         &capacity,
+			}
+
+			// Not supported by the Kubernetes versions with reference YAMLs.
+			tc := setup(t, csiStorageCapacity)
+			defer teardown(tc)
+			err := tc.c.Create(tc.ctx, dep.DeepCopy())
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			policy := &admissionregistrationv1.ValidatingAdmissionPolicy{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, policy)
+			require.True(t, errors.IsNotFound(err), "no policy, got error %v", err)
+
+			tc = newTestContext(t, version.NewVersion(1, 30), csiStorageCapacity)
+			defer teardown(tc)
+			err = tc.c.Create(tc.ctx, dep.DeepCopy())
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, policy)
+			require.NoError(t, err, "get policy")
+			require.Len(t, policy.Spec.Validations, 1, "validations without node capacity")
+			require.Equal(t, "!variables.size.isLessThan(quantity('4Mi'))", policy.Spec.Validations[0].Expression, "minimum size")
+			binding := &admissionregistrationv1.ValidatingAdmissionPolicyBinding{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, binding)
+			require.NoError(t, err, "get binding")
+			require.Equal(t, dep.PVCValidationPolicyName(), binding.Spec.PolicyName, "policy name")
+
+			// The capacity is known after the first reconcile.
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, policy)
+			require.NoError(t, err, "get policy")
+			require.Len(t, policy.Spec.Validations, 2, "validations with node capacity")
+			require.Equal(t, "!variables.size.isGreaterThan(quantity('100Gi'))", policy.Spec.Validations[1].Expression, "maximum size")
+
+			// Disabling it removes the policy.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Spec.ValidatePVCs = false
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, policy)
+			require.True(t, errors.IsNotFound(err), "policy removed, got error %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.PVCValidationPolicyName()}, binding)
+			require.True(t, errors.IsNotFound(err), "binding removed, got error %v", err)
+		})
+
+		t.Run("paused deployment", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+
+			d := &pmemDeployment{
+				name: "paused-deployment",
+			}
+			dep := getDeployment(d)
+			dep.Annotations = map[string]string{api.PausedAnnotation: "true"}
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseNew)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: dep.NodeDriverName(), Namespace: testNamespace}, ds)
+			require.True(t, errors.IsNotFound(err), "node driver must not be created while paused, got: %v", err)
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			delete(dep.Annotations, api.PausedAnnotation)
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "resume deployment")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonPaused, api.EventReasonNew, api.EventReasonRunning}, false)
+		})
+
+		t.Run("adopt objects", func(t *testing.T) {
+			d := &pmemDeployment{
+				name: "adopting-deployment",
+			}
+			dep := getDeployment(d)
+			// Created from a reference YAML file, with a selector
+			// that is different from the one used by the operator.
+			ds := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      dep.NodeDriverName(),
+					Namespace: testNamespace,
+				},
+				Spec: appsv1.DaemonSetSpec{
+					Selector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app.kubernetes.io/name":        "pmem-csi-node",
+							"pmem-csi.intel.com/deployment": "lvm-production",
+						},
+					},
+				},
+			}
+			tc := setup(t, ds)
+			defer teardown(tc)
+
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			dep.Annotations = map[string]string{api.AdoptAnnotation: "true"}
+			err = tc.c.Update(tc.ctx, dep)
+			require.NoError(t, err, "enable adoption")
+
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateDriver(tc, dep, []string{api.EventReasonNew, api.EventReasonFailed, api.EventReasonAdopted, api.EventReasonRunning}, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKeyFromObject(ds), ds)
+			require.NoError(t, err, "get node driver")
+			require.Equal(t, []metav1.OwnerReference{dep.GetOwnerReference()}, ds.OwnerReferences, "owner of adopted node driver")
+			require.NotContains(t, ds.Spec.Selector.MatchLabels, "pmem-csi.intel.com/deployment", "selector of adopted node driver")
+
+			// Objects controlled by someone else are never adopted.
+			ds.OwnerReferences[0].UID = "someone-else"
+			ds.OwnerReferences[0].Name = "someone-else"
+			err = tc.c.Update(tc.ctx, ds)
+			require.NoError(t, err, "change owner of node driver")
+			tc.testReconcilePhase(d.name, true, true, api.DeploymentPhaseFailed)
+		})
+
 		t.Run("updating", func(t *testing.T) {
 			t.Parallel()
 			for _, testcase := range testcases.UpdateTests() {
@@ -576,6 +1402,147 @@ func TestDeploymentController(t *testing.T) {
 			require.NoErrorf(t, err, "get '%s' config map after reconcile", cm2.Name)
 		})
 
+		t.Run("migrate controller StatefulSet", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-migration",
+			}
+
+			dep := getDeployment(d)
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+			})
+
+			// Pretend that the deployment was created by an older
+			// operator which used a StatefulSet for the controller.
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "unknown", dep.Status.OperatorVersion, "operator version")
+			dep.Status.OperatorVersion = "v0.9.0"
+			err = tc.c.Status().Update(tc.ctx, dep)
+			require.NoError(t, err, "update deployment status")
+			ss := &appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      dep.ControllerDriverName(),
+					Namespace: testNamespace,
+					OwnerReferences: []metav1.OwnerReference{
+						dep.GetOwnerReference(),
+					},
+				},
+			}
+			err = tc.c.Create(tc.ctx, ss)
+			require.NoError(t, err, "create controller StatefulSet")
+
+			tc.ResetReconciler()
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			validateConditions(tc, d.name, map[api.DeploymentConditionType]corev1.ConditionStatus{
+				api.DriverDeployed: corev1.ConditionTrue,
+				api.Migrated:       corev1.ConditionTrue,
+			})
+			err = tc.c.Get(tc.ctx, client.ObjectKeyFromObject(ss), ss)
+			require.True(t, errors.IsNotFound(err), "StatefulSet should have been removed, got: %v", err)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, "unknown", dep.Status.OperatorVersion, "operator version after migration")
+		})
+
+		t.Run("uninstall with wipe", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-wipe",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.UninstallPolicy = api.UninstallPolicyWipe
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+			require.Equal(t, []string{api.UninstallFinalizer}, dep.Finalizers, "finalizers")
+
+			// A volume of the driver prevents wiping.
+			pv := &corev1.PersistentVolume{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+				Spec: corev1.PersistentVolumeSpec{
+					PersistentVolumeSource: corev1.PersistentVolumeSource{
+						CSI: &corev1.CSIPersistentVolumeSource{
+							Driver:       dep.CSIDriverName(),
+							VolumeHandle: "pvc-1",
+						},
+					},
+				},
+			}
+			err = tc.c.Create(tc.ctx, pv)
+			require.NoError(t, err, "create persistent volume")
+			err = tc.c.Delete(tc.ctx, dep)
+			require.NoError(t, err, "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "node driver kept while volumes exist")
+			wipe := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeWipeName()}, wipe)
+			require.True(t, errors.IsNotFound(err), "no node wipe while volumes exist, got error %v", err)
+
+			err = tc.c.Delete(tc.ctx, pv)
+			require.NoError(t, err, "delete persistent volume")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.True(t, errors.IsNotFound(err), "node driver removed, got error %v", err)
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeWipeName()}, wipe)
+			require.NoError(t, err, "get node wipe")
+			require.Contains(t, wipe.Spec.Template.Spec.Containers[0].Command, "-mode=wipe", "node wipe command")
+
+			// Not done while the pod is not ready.
+			wipe.Status.DesiredNumberScheduled = 1
+			err = tc.c.Status().Update(tc.ctx, wipe)
+			require.NoError(t, err, "update node wipe status")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "deployment still exists")
+
+			err = tc.c.Get(tc.ctx, client.ObjectKeyFromObject(wipe), wipe)
+			require.NoError(t, err, "get node wipe")
+			wipe.Status.NumberReady = 1
+			err = tc.c.Status().Update(tc.ctx, wipe)
+			require.NoError(t, err, "update node wipe status")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error %v", err)
+		})
+
+		t.Run("uninstall with retain", func(t *testing.T) {
+			tc := setup(t)
+			defer teardown(tc)
+			d := &pmemDeployment{
+				name: "test-driver-retain",
+			}
+
+			dep := getDeployment(d)
+			dep.Spec.UninstallPolicy = api.UninstallPolicyRetain
+			err := tc.c.Create(tc.ctx, dep)
+			require.NoError(t, err, "failed to create deployment")
+			tc.testReconcilePhase(d.name, false, false, api.DeploymentPhaseRunning)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.NoError(t, err, "get deployment")
+
+			err = tc.c.Delete(tc.ctx, dep)
+			require.NoError(t, err, "delete deployment")
+			tc.testReconcile(d.name, false, false)
+			err = tc.c.Get(tc.ctx, client.ObjectKey{Name: d.name}, dep)
+			require.True(t, errors.IsNotFound(err), "deployment removed, got error %v", err)
+			ds := &appsv1.DaemonSet{}
+			err = tc.c.Get(tc.ctx, types.NamespacedName{Namespace: testNamespace, Name: dep.NodeDriverName()}, ds)
+			require.NoError(t, err, "get node driver")
+			require.Empty(t, ds.OwnerReferences, "node driver owner references")
+		})
+
 		t.Run("recover from unexpected shutdown", func(t *testing.T) {
 			tc := setup(t)
 			defer teardown(tc)
@@ -636,7 +1603,7 @@ type testClient struct {
 }
 
 func newTestClient(initObjs ...runtime.Object) client.Client {
-	return &testClient{Client: fake.NewClientBuilder().WithRuntimeObjects(initObjs...).Build()}
+	return &testClient{Client: fake.NewClientBuilder().WithRuntimeObjects(initObjs...).WithStatusSubresource(&api.PmemCSIDeployment{}).Build()}
 }
 
 func (t *testClient) InjectPanicOn(gvk *schema.GroupVersionKind) {
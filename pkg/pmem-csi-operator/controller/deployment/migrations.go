@@ -0,0 +1,111 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/version"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// migration is one step that must be executed once when a deployment
+// gets reconciled by an operator version >= the migration version for
+// the first time. Migrations must be idempotent because the version
+// which reconciled a deployment is not known for deployments created
+// by an operator without support for migrations. migrate returns true
+// if it had to change something.
+type migration struct {
+	version version.Version
+	name    string
+	migrate func(ctx context.Context, d *pmemCSIDeployment, r *ReconcileDeployment) (bool, error)
+}
+
+// migrations is sorted by version. Steps with the same version are
+// executed in the order in which they are listed.
+var migrations = []migration{
+	{
+		version: version.NewVersion(1, 0),
+		name:    "controller StatefulSet to Deployment",
+		migrate: func(ctx context.Context, d *pmemCSIDeployment, r *ReconcileDeployment) (bool, error) {
+			// The StatefulSet would also be removed as obsolete object,
+			// but only after the new Deployment is running. Removing
+			// it first avoids having two active controllers.
+			ss := &appsv1.StatefulSet{}
+			ss.Name = d.ControllerDriverName()
+			ss.Namespace = d.namespace
+			if err := d.getSubObject(ctx, r, ss); err != nil {
+				return false, err
+			}
+			if ss.ResourceVersion == "" {
+				return false, nil
+			}
+			if err := r.client.Delete(ctx, ss, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
+				return false, client.IgnoreNotFound(err)
+			}
+			return true, nil
+		},
+	},
+}
+
+// parseOperatorVersion extracts major and minor version from the
+// output of "git describe" (v1.2.3-4-gabcdef). The result is false for
+// development builds and deployments which were not reconciled yet.
+func parseOperatorVersion(operatorVersion string) (version.Version, bool) {
+	v, err := version.Parse(strings.TrimPrefix(operatorVersion, "v"))
+	return v, err == nil
+}
+
+// migrate runs all migration steps which were not executed yet for the
+// deployment. The Migrated condition is only set when some step
+// had to change something.
+func (d *pmemCSIDeployment) migrate(ctx context.Context, r *ReconcileDeployment) error {
+	if d.Status.Phase == api.DeploymentPhaseNew {
+		// Nothing to migrate yet.
+		return nil
+	}
+
+	l := klog.FromContext(ctx).WithName("migrate")
+	last, lastKnown := parseOperatorVersion(d.Status.OperatorVersion)
+	current, currentKnown := parseOperatorVersion(r.operatorVersion)
+
+	var done []string
+	for _, m := range migrations {
+		if lastKnown && last.CompareVersion(m.version) >= 0 {
+			// Done before.
+			continue
+		}
+		if currentKnown && current.CompareVersion(m.version) < 0 {
+			// Not needed yet, can only happen after a downgrade.
+			continue
+		}
+		l.V(3).Info("running", "migration", m.name, "deployment", pmemlog.KObj(d))
+		changed, err := m.migrate(ctx, d, r)
+		if err != nil {
+			err = fmt.Errorf("migration %q: %v", m.name, err)
+			d.SetCondition(api.Migrated, corev1.ConditionFalse, err.Error())
+			return err
+		}
+		if changed {
+			l.V(2).Info("migrated", "migration", m.name, "deployment", pmemlog.KObj(d))
+			done = append(done, m.name)
+		}
+	}
+	if len(done) > 0 {
+		d.SetCondition(api.Migrated, corev1.ConditionTrue, fmt.Sprintf("Completed migrations: %s.", strings.Join(done, ", ")))
+	}
+	return nil
+}
@@ -10,12 +10,16 @@ package testcases
 
 import (
 	"fmt"
+	"time"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // UpdateTest defines a starting deployment and a function which will
@@ -40,6 +44,14 @@ func UpdateTests() []UpdateTest {
 		"nodeRegistrarImage": func(d *api.PmemCSIDeployment) {
 			d.Spec.NodeRegistrarImage = "still-no-such-registrar-image"
 		},
+		"imagePullSecrets": func(d *api.PmemCSIDeployment) {
+			d.Spec.ImagePullSecrets = []corev1.LocalObjectReference{
+				{Name: "no-such-pull-secret"},
+			}
+		},
+		"livenessProbeImage": func(d *api.PmemCSIDeployment) {
+			d.Spec.LivenessProbeImage = "no-such-livenessprobe-image"
+		},
 		"controllerDriverResources": func(d *api.PmemCSIDeployment) {
 			d.Spec.ControllerDriverResources = &corev1.ResourceRequirements{
 				Limits: corev1.ResourceList{
@@ -48,9 +60,42 @@ func UpdateTests() []UpdateTest {
 				},
 			}
 		},
+		"resourceProfile": func(d *api.PmemCSIDeployment) {
+			d.Spec.ResourceProfile = api.ResourceProfileLarge
+		},
 		"controllerReplicas": func(d *api.PmemCSIDeployment) {
 			d.Spec.ControllerReplicas = 5
 		},
+		"annotations": func(d *api.PmemCSIDeployment) {
+			d.Spec.Annotations = map[string]string{
+				"sidecar.istio.io/inject": "false",
+			}
+		},
+		"restartedAt": func(d *api.PmemCSIDeployment) {
+			restartedAt := metav1.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+			d.Spec.RestartedAt = &restartedAt
+		},
+		"serviceMonitor": func(d *api.PmemCSIDeployment) {
+			d.Spec.Metrics = &api.MetricsSpec{ServiceMonitor: true}
+		},
+		"storageClasses": func(d *api.PmemCSIDeployment) {
+			eraseAfter := false
+			verifyErase := true
+			d.Spec.StorageClasses = []api.StorageClassSpec{
+				{
+					Name:    d.Name + "-default",
+					Default: true,
+				},
+				{
+					Name:              d.Name + "-xfs-fileio",
+					FSType:            "xfs",
+					Usage:             "FileIO",
+					EraseAfter:        &eraseAfter,
+					VerifyErase:       &verifyErase,
+					VolumeBindingMode: storagev1.VolumeBindingImmediate,
+				},
+			}
+		},
 		"nodeDriverResources": func(d *api.PmemCSIDeployment) {
 			d.Spec.NodeDriverResources = &corev1.ResourceRequirements{
 				Limits: corev1.ResourceList{
@@ -90,9 +135,24 @@ func UpdateTests() []UpdateTest {
 				"still-no-such-label": "still-no-such-value",
 			}
 		},
+		"nodeSelectorExpressions": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeSelectorExpressions = []metav1.LabelSelectorRequirement{
+				{
+					Key:      "still-no-such-storage",
+					Operator: metav1.LabelSelectorOpIn,
+					Values:   []string{"pmem", "optane"},
+				},
+			}
+		},
 		"pmemPercentage": func(d *api.PmemCSIDeployment) {
 			d.Spec.PMEMPercentage++
 		},
+		"pmemReserved": func(d *api.PmemCSIDeployment) {
+			d.Spec.PMEMReserved = "10%"
+		},
+		"systemRAMPercentage": func(d *api.PmemCSIDeployment) {
+			d.Spec.SystemRAMPercentage = 10
+		},
 		"labels": func(d *api.PmemCSIDeployment) {
 			if d.Spec.Labels == nil {
 				d.Spec.Labels = map[string]string{}
@@ -102,6 +162,102 @@ func UpdateTests() []UpdateTest {
 		"kubeletDir": func(d *api.PmemCSIDeployment) {
 			d.Spec.KubeletDir = "/foo/bar"
 		},
+		"nodeHostNetwork": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeHostNetwork = true
+		},
+		"maxSurge": func(d *api.PmemCSIDeployment) {
+			surge := intstr.FromInt(2)
+			d.Spec.MaxSurge = &surge
+		},
+		"controllerUpdateStrategy": func(d *api.PmemCSIDeployment) {
+			d.Spec.ControllerUpdateStrategy = &appsv1.DeploymentStrategy{
+				Type: appsv1.RecreateDeploymentStrategyType,
+			}
+		},
+		"controllerPriorityClassName": func(d *api.PmemCSIDeployment) {
+			d.Spec.ControllerPriorityClassName = "system-node-critical"
+		},
+		"nodePriorityClassName": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodePriorityClassName = "system-cluster-critical"
+		},
+		"ports": func(d *api.PmemCSIDeployment) {
+			d.Spec.Ports = &api.PortsSpec{
+				ControllerMetrics:  10020,
+				NodeMetrics:        10020,
+				ProvisionerMetrics: 10021,
+			}
+		},
+		"proxy": func(d *api.PmemCSIDeployment) {
+			d.Spec.Proxy = &api.ProxySpec{
+				HTTPSProxy: "http://proxy.example.com:3128",
+				NoProxy:    ".cluster.local",
+			}
+		},
+		"nodeModes": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeModes = []api.NodeModeSpec{
+				{
+					Name:         "direct",
+					NodeSelector: map[string]string{"pmem-pool": "direct"},
+					DeviceMode:   api.DeviceModeDirect,
+				},
+				{
+					Name: "half",
+					NodeSelector: map[string]string{
+						"pmem-pool": "shared",
+						"zone":      "a",
+					},
+					PMEMPercentage: 50,
+				},
+			}
+		},
+		"rawNamespaceConversion": func(d *api.PmemCSIDeployment) {
+			d.Spec.RawNamespaceConversion = api.RawNamespaceConversionAll
+			d.Spec.RawNamespaceConversionDryRun = true
+			d.Spec.PMEMGoal = &api.PMEMGoalSpec{AppDirectPercentage: 100}
+		},
+		"nodeDiscovery": func(d *api.PmemCSIDeployment) {
+			d.Spec.NodeDiscovery = true
+		},
+		"pmemBusTypes": func(d *api.PmemCSIDeployment) {
+			d.Spec.PMEMBusTypes = []api.PMEMBusType{api.PMEMBusTypeCXL}
+		},
+		"pmemPools": func(d *api.PmemCSIDeployment) {
+			d.Spec.PMEMPools = []api.PMEMPoolSpec{
+				{Name: "socket0", Regions: []string{"region0", "region2"}},
+				{Name: "socket1", Regions: []string{"region1"}},
+			}
+		},
+		"components": func(d *api.PmemCSIDeployment) {
+			controller := false
+			d.Spec.Components = &api.ComponentsSpec{Controller: &controller}
+		},
+		"runtimeClassName": func(d *api.PmemCSIDeployment) {
+			d.Spec.RuntimeClassName = "runc"
+		},
+		"validatePVCs": func(d *api.PmemCSIDeployment) {
+			d.Spec.ValidatePVCs = true
+		},
+		"volumeLifecycleModes": func(d *api.PmemCSIDeployment) {
+			d.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{
+				storagev1.VolumeLifecycleEphemeral,
+			}
+		},
+		"tokenRequests": func(d *api.PmemCSIDeployment) {
+			d.Spec.TokenRequests = []storagev1.TokenRequest{
+				{Audience: "pmem-csi.example.com"},
+			}
+		},
+		"controllerHostNetwork": func(d *api.PmemCSIDeployment) {
+			d.Spec.ControllerHostNetwork = true
+		},
+		"seccompProfile": func(d *api.PmemCSIDeployment) {
+			d.Spec.SeccompProfile = &corev1.SeccompProfile{
+				Type: corev1.SeccompProfileTypeRuntimeDefault,
+			}
+		},
+		"appArmorProfile": func(d *api.PmemCSIDeployment) {
+			d.Spec.AppArmorProfile = "runtime/default"
+		},
 	}
 
 	full := api.PmemCSIDeployment{
@@ -176,7 +332,12 @@ func UpdateTests() []UpdateTest {
 	}
 
 	updateAll := func(d *api.PmemCSIDeployment) {
-		for _, mutator := range singleMutators {
+		for name, mutator := range singleMutators {
+			// maxSurge cannot be combined with nodeHostNetwork,
+			// ephemeral-only volumes not with storageClasses.
+			if name == "maxSurge" || name == "volumeLifecycleModes" {
+				continue
+			}
 			mutator(d)
 		}
 	}
@@ -0,0 +1,368 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// updateFinalizer ensures that the deployment has api.UninstallFinalizer
+// if and only if its uninstall policy needs it.
+func (r *ReconcileDeployment) updateFinalizer(ctx context.Context, deployment *api.PmemCSIDeployment) error {
+	needed := deployment.NeedsUninstallFinalizer()
+	if controllerutil.ContainsFinalizer(deployment, api.UninstallFinalizer) == needed {
+		return nil
+	}
+	patch := client.MergeFrom(deployment.DeepCopy())
+	if needed {
+		controllerutil.AddFinalizer(deployment, api.UninstallFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(deployment, api.UninstallFinalizer)
+	}
+	if err := r.client.Patch(ctx, deployment, patch); err != nil {
+		return fmt.Errorf("update finalizer: %v", err)
+	}
+	return nil
+}
+
+// uninstallRequeueDelay determines how often a deleted deployment
+// gets checked while waiting for the uninstall policy to complete.
+const uninstallRequeueDelay = 10 * time.Second
+
+// uninstall executes the uninstall policy of a deleted deployment and
+// removes the finalizer once that is done. The result is false while
+// the policy is still in progress.
+func (r *ReconcileDeployment) uninstall(ctx context.Context, deployment *api.PmemCSIDeployment) (bool, error) {
+	d, err := r.newDeployment(ctx, deployment.DeepCopy())
+	if err != nil {
+		return false, err
+	}
+	done, err := d.uninstall(ctx, r)
+	if err != nil || !done {
+		return false, err
+	}
+	patch := client.MergeFrom(deployment.DeepCopy())
+	controllerutil.RemoveFinalizer(deployment, api.UninstallFinalizer)
+	if err := r.client.Patch(ctx, deployment, patch); err != nil {
+		return false, fmt.Errorf("remove finalizer: %v", err)
+	}
+	return true, nil
+}
+
+// uninstall executes the uninstall policy of a deleted deployment.
+// The result is true once it is done and the finalizer may be removed.
+func (d *pmemCSIDeployment) uninstall(ctx context.Context, r *ReconcileDeployment) (bool, error) {
+	switch d.Spec.UninstallPolicy {
+	case api.UninstallPolicyRetain:
+		return true, d.orphanObjects(ctx, r)
+	case api.UninstallPolicyWipe:
+		return d.wipe(ctx, r)
+	default:
+		// The policy was changed after adding the finalizer,
+		// nothing to do anymore.
+		return true, nil
+	}
+}
+
+// orphanObjects removes the owner reference to the deployment from
+// all sub-objects, which then remain after the deployment is gone.
+func (d *pmemCSIDeployment) orphanObjects(ctx context.Context, r *ReconcileDeployment) error {
+	l := klog.FromContext(ctx).WithName("orphanObjects")
+	for _, list := range AllObjectLists() {
+		opts := &client.ListOptions{}
+		if isNamespaced(strings.TrimSuffix(list.GroupVersionKind().Kind, "List")) {
+			opts.Namespace = d.namespace
+		}
+		if err := r.client.List(ctx, list, opts); err != nil {
+			if meta.IsNoMatchError(err) {
+				continue
+			}
+			return err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			if !d.isOwnerOf(*obj) {
+				continue
+			}
+			patch := client.MergeFrom(obj.DeepCopy())
+			var owners []metav1.OwnerReference
+			for _, owner := range obj.GetOwnerReferences() {
+				if owner.UID != d.GetUID() {
+					owners = append(owners, owner)
+				}
+			}
+			obj.SetOwnerReferences(owners)
+			l.V(3).Info("orphaning", "object", pmemlog.KObjWithType(obj))
+			if err := r.client.Patch(ctx, obj, patch); err != nil {
+				return fmt.Errorf("remove owner reference from %s %q: %v", obj.GetKind(), obj.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// wipe stops the node driver, then runs the node wipe DaemonSet
+// until it is ready on all nodes. Nothing happens while volumes of
+// the driver still exist, because wiping the nodes would destroy
+// their data.
+func (d *pmemCSIDeployment) wipe(ctx context.Context, r *ReconcileDeployment) (bool, error) {
+	l := klog.FromContext(ctx).WithName("wipe")
+
+	inUse, err := d.volumesInUse(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	if inUse != "" {
+		l.V(2).Info("waiting for volumes to be deleted", "reason", inUse)
+		return false, nil
+	}
+
+	nodeDriverNames := []string{d.NodeDriverName()}
+	for _, mode := range d.Spec.NodeModes {
+		nodeDriverNames = append(nodeDriverNames, d.NodeModeDriverName(mode.Name))
+	}
+	for _, name := range nodeDriverNames {
+		ds := &appsv1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: d.namespace},
+		}
+		if err := r.client.Delete(ctx, ds); client.IgnoreNotFound(err) != nil {
+			return false, fmt.Errorf("delete node driver: %v", err)
+		}
+	}
+
+	// The volumes must not be in use anymore.
+	pods := &corev1.PodList{}
+	if err := r.client.List(ctx, pods,
+		client.InNamespace(d.namespace),
+		client.MatchingLabels{
+			"app.kubernetes.io/name":     "pmem-csi-node",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	); err != nil {
+		return false, fmt.Errorf("list node driver pods: %v", err)
+	}
+	if len(pods.Items) > 0 {
+		l.V(3).Info("waiting for node driver pods to stop", "numPods", len(pods.Items))
+		return false, nil
+	}
+
+	o, result, err := d.redeploy(ctx, r, nodeWipeHandler)
+	if err != nil {
+		return false, fmt.Errorf("deploy node wipe: %v", err)
+	}
+	ds := o.(*appsv1.DaemonSet)
+	if result == created ||
+		ds.Status.ObservedGeneration != ds.Generation ||
+		ds.Status.NumberReady < ds.Status.DesiredNumberScheduled {
+		l.V(3).Info("waiting for node wipe",
+			"ready", ds.Status.NumberReady,
+			"desired", ds.Status.DesiredNumberScheduled)
+		return false, nil
+	}
+	l.V(2).Info("nodes wiped", "numNodes", ds.Status.NumberReady)
+	return true, nil
+}
+
+// volumesInUse returns a non-empty explanation while PersistentVolumes
+// or VolumeAttachments of the driver exist.
+func (d *pmemCSIDeployment) volumesInUse(ctx context.Context, r *ReconcileDeployment) (string, error) {
+	driverName := d.CSIDriverName()
+	pvs := &corev1.PersistentVolumeList{}
+	if err := r.client.List(ctx, pvs); err != nil {
+		return "", fmt.Errorf("list persistent volumes: %v", err)
+	}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName {
+			return fmt.Sprintf("PersistentVolume %s still exists", pv.Name), nil
+		}
+	}
+	vas := &storagev1.VolumeAttachmentList{}
+	if err := r.client.List(ctx, vas); err != nil {
+		return "", fmt.Errorf("list volume attachments: %v", err)
+	}
+	for _, va := range vas.Items {
+		if va.Spec.Attacher == driverName {
+			return fmt.Sprintf("VolumeAttachment %s still exists", va.Name), nil
+		}
+	}
+	return "", nil
+}
+
+// nodeWipeHandler is not part of subObjectHandlers because the
+// DaemonSet is only needed while uninstalling.
+var nodeWipeHandler = redeployObject{
+	objType: reflect.TypeOf(&appsv1.DaemonSet{}),
+	object: func(d *pmemCSIDeployment) client.Object {
+		return &appsv1.DaemonSet{
+			TypeMeta:   metav1.TypeMeta{Kind: "DaemonSet", APIVersion: "apps/v1"},
+			ObjectMeta: d.getObjectMeta(d.NodeWipeName(), false),
+		}
+	},
+	modify: func(d *pmemCSIDeployment, o client.Object) error {
+		d.getNodeWipeDaemonSet(o.(*appsv1.DaemonSet))
+		return nil
+	},
+}
+
+func (d *pmemCSIDeployment) getNodeWipeDaemonSet(ds *appsv1.DaemonSet) {
+	directoryOrCreate := corev1.HostPathDirectoryOrCreate
+
+	if ds.Labels == nil {
+		ds.Labels = map[string]string{}
+	}
+	ds.Labels["app.kubernetes.io/name"] = "pmem-csi-node-wipe"
+	ds.Labels["app.kubernetes.io/part-of"] = "pmem-csi"
+	ds.Labels["app.kubernetes.io/component"] = "node-wipe"
+	ds.Labels["app.kubernetes.io/instance"] = d.Name
+
+	spec := &ds.Spec
+	spec.Selector = &metav1.LabelSelector{
+		MatchLabels: map[string]string{
+			"app.kubernetes.io/name":     "pmem-csi-node-wipe",
+			"app.kubernetes.io/instance": d.Name,
+		},
+	}
+	spec.Template.ObjectMeta.Labels = joinMaps(
+		d.Spec.Labels,
+		map[string]string{
+			"app.kubernetes.io/name":      "pmem-csi-node-wipe",
+			"app.kubernetes.io/part-of":   "pmem-csi",
+			"app.kubernetes.io/component": "node-wipe",
+			"app.kubernetes.io/instance":  d.Name,
+			"pmem-csi.intel.com/webhook":  "ignore",
+		})
+	spec.Template.ObjectMeta.Annotations = joinMaps(d.Spec.Annotations, nil)
+	podSpec := &ds.Spec.Template.Spec
+	// Same privileges as the node driver, which matters on OpenShift.
+	podSpec.ServiceAccountName = d.ProvisionerServiceAccountName()
+	podSpec.ImagePullSecrets = d.Spec.ImagePullSecrets
+	podSpec.PriorityClassName = d.Spec.NodePriorityClassName
+	podSpec.RuntimeClassName = d.runtimeClassName()
+	// All nodes which may have run the driver, including those
+	// of the node modes.
+	podSpec.NodeSelector = d.Spec.NodeSelector
+	podSpec.Affinity = d.NodeSelectorAffinity()
+	setTolerations(podSpec)
+	podSpec.Containers = []corev1.Container{
+		d.getNodeWipeContainer(),
+	}
+	d.setSecurityProfiles(&ds.Spec.Template)
+	d.setProxyEnv(podSpec)
+	podSpec.Volumes = []corev1.Volume{
+		{
+			Name: "pmem-state-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/var/lib/" + d.GetName(),
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+		{
+			Name: "dev-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/dev",
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+		{
+			Name: "sys-dir",
+			VolumeSource: corev1.VolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: "/sys",
+					Type: &directoryOrCreate,
+				},
+			},
+		},
+	}
+}
+
+func (d *pmemCSIDeployment) getNodeWipeContainer() corev1.Container {
+	true := true
+	root := int64(0)
+	bidirectional := corev1.MountPropagationBidirectional
+	c := corev1.Container{
+		Name:            "pmem-driver",
+		Image:           d.Spec.Image,
+		ImagePullPolicy: d.Spec.PullPolicy,
+		Command: append([]string{
+			"/usr/local/bin/pmem-csi-driver",
+			fmt.Sprintf("-v=%d", d.Spec.LogLevel),
+			"-logging-format=" + string(d.Spec.LogFormat),
+			"-mode=wipe",
+			"-drivername=$(PMEM_CSI_DRIVER_NAME)",
+			fmt.Sprintf("-metricsListen=:%d", d.Spec.Ports.NodeMetrics),
+		}, d.getPMEMBusTypesArgs()...),
+		Env: []corev1.EnvVar{
+			{
+				Name:  "PMEM_CSI_DRIVER_NAME",
+				Value: d.GetName(),
+			},
+			{
+				Name:  "TERMINATION_LOG_PATH",
+				Value: "/tmp/termination-log",
+			},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:             "pmem-state-dir",
+				MountPath:        "/var/lib/" + d.GetName(),
+				MountPropagation: &bidirectional,
+			},
+			{
+				Name:      "dev-dir",
+				MountPath: "/dev",
+			},
+			{
+				Name:      "sys-dir",
+				MountPath: "/sys",
+			},
+			{
+				Name:      "sys-dir",
+				MountPath: "/host-sys",
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: &true,
+			RunAsUser:  &root,
+		},
+		// The metrics endpoint only gets started after wiping
+		// the node.
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path:   "/metrics/simple",
+					Port:   intstr.FromInt32(d.Spec.Ports.NodeMetrics),
+					Scheme: corev1.URISchemeHTTP,
+				},
+			},
+			PeriodSeconds: 10,
+		},
+		TerminationMessagePath:   "/tmp/termination-log",
+		TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+	}
+	return c
+}
@@ -9,8 +9,11 @@ package pmemoperator
 import (
 	"context"
 	"flag"
-	"fmt"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/intel/pmem-csi/pkg/apis"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -20,6 +23,8 @@ import (
 	"github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller"
 
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	logsapi "k8s.io/component-base/logs/api/v1"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
@@ -31,18 +36,27 @@ import (
 	_ "github.com/intel/pmem-csi/pkg/pmem-csi-operator/controller/deployment"
 )
 
-func printVersion() {
-	//klog.Info(fmt.Sprintf("Operator Version: %s", version.Version))
-	klog.Info(fmt.Sprintf("Go Version: %s", runtime.Version()))
-	klog.Info(fmt.Sprintf("Go OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH))
+func printVersion(logger klog.Logger) {
+	logger.Info("PMEM-CSI operator started.", "version", version, "go-version", runtime.Version(), "os", runtime.GOOS, "arch", runtime.GOARCH)
 }
 
 var (
+	configFile = flag.String("config", "", "Configuration file with apiVersion "+ConfigurationAPIVersion+" and kind "+ConfigurationKind+". "+
+		"Flags which are set explicitly take precedence over the file. The file gets read again on SIGHUP, but only a changed log verbosity takes effect without a restart.")
 	driverImage    = flag.String("image", "", "docker container image used for deploying the operator.")
 	leaderElection = flag.Bool("leader-election", false, "Enable leader election for controller manager. "+
 		"Enabling this will ensure there is only one active controller manager.")
-	metricsAddr = flag.String("metrics-addr", ":8080", "The address the metric endpoint binds to. Use \"0\" to disable metrics.")
-	logFormat   = logger.NewFlag()
+	leaseDuration = flag.Duration("leader-election-lease-duration", 15*time.Second, "How long non-leaders wait after the last renewal of the lease before they try to take over. "+
+		"This is how long failover takes when the leader gets killed without releasing the lease.")
+	renewDeadline = flag.Duration("leader-election-renew-deadline", 10*time.Second, "How long the leader tries to renew the lease before it gives up, must be shorter than the lease duration.")
+	retryPeriod   = flag.Duration("leader-election-retry-period", 2*time.Second, "How long to wait between attempts to acquire or renew the lease.")
+	resourceLock  = flag.String("leader-election-resource-lock", resourcelock.LeasesResourceLock, "The type of object used for locking. Only \"leases\" is supported.")
+	metricsAddr   = flag.String("metrics-addr", ":8080", "The address the metric endpoint binds to. Use \"0\" to disable metrics.")
+	debugAddr     = flag.String("debug-addr", "", "The address (like 127.0.0.1:6060) for /debug/pprof and /debug/stacks. Also enables the mutex and block profiles and logging of goroutine stacks on SIGUSR1. Disabled by default.")
+	namespaces    = flag.String("namespaces", os.Getenv("WATCH_NAMESPACES"), "Comma-separated list of namespaces that may be used by deployments in addition to the namespace of the operator. \"all\" enables all namespaces. "+
+		"The operator needs the permissions from its Role in each of these namespaces. Defaults to the WATCH_NAMESPACES env variable.")
+	logFormat = flag.String("logging-format", "text", "determines log output format, 'text' and 'json' are supported")
+	version   = "unknown" // Set version during build time
 )
 
 func init() {
@@ -52,82 +66,134 @@ func init() {
 func Main() int {
 	flag.Parse()
 
-	printVersion()
+	defaults := defaultConfiguration()
+	if ns := os.Getenv("WATCH_NAMESPACES"); ns != "" {
+		defaults.WatchNamespaces = strings.Split(ns, ",")
+	}
+	operatorConfig, err := newConfiguration(*configFile, defaults, overrideFromFlags)
+	if err != nil {
+		pmemcommon.ExitError("Failed to load configuration", err)
+		return 1
+	}
+	if err := logger.Apply(&operatorConfig.Logging); err != nil {
+		pmemcommon.ExitError("Failed to configure logging", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	logger := klog.FromContext(ctx)
+	printVersion(logger)
 
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
-		pmemcommon.ExitError("Failed to get configuration: ", err)
+		pmemcommon.ExitError("Failed to get configuration", err)
 		return 1
 	}
 
-	ctx := context.Background()
+	stopCtx := signals.SetupSignalHandler()
+	if *configFile != "" {
+		reloadOnSIGHUP(stopCtx, *configFile, operatorConfig, defaults, overrideFromFlags)
+	}
+
+	if operatorConfig.DebugAddr != "" {
+		if _, err := pmemcommon.StartDebugServer(stopCtx, operatorConfig.DebugAddr); err != nil {
+			pmemcommon.ExitError("Failed to start debug server", err)
+			return 1
+		}
+	}
 
 	// Retrieve namespace to watch for new deployments and to create sub-resources
 	namespace := k8sutil.GetNamespace(ctx)
 
+	// Additional namespaces for sub-resources
+	watchNamespaces := parseNamespaces(strings.Join(operatorConfig.WatchNamespaces, ","))
+	defaultNamespaces := map[string]cache.Config{
+		namespace: cache.Config{},
+	}
+	for _, ns := range watchNamespaces {
+		if ns == cache.AllNamespaces {
+			defaultNamespaces = map[string]cache.Config{
+				cache.AllNamespaces: cache.Config{},
+			}
+			break
+		}
+		defaultNamespaces[ns] = cache.Config{}
+	}
+
+	le := operatorConfig.LeaderElection
+	leaderElectionNamespace := le.ResourceNamespace
+	if leaderElectionNamespace == "" {
+		leaderElectionNamespace = namespace
+	}
+
 	// Create a new Cmd to provide shared dependencies and start components
 	mgr, err := manager.New(cfg, manager.Options{
 		Cache: cache.Options{
-			DefaultNamespaces: map[string]cache.Config{
-				namespace: cache.Config{},
-			},
+			DefaultNamespaces: defaultNamespaces,
 		},
-		LeaderElection:          *leaderElection,
-		LeaderElectionNamespace: namespace,
-		LeaderElectionID:        "pmem-csi-operator-lock",
+		LeaderElection:             le.LeaderElect != nil && *le.LeaderElect,
+		LeaderElectionNamespace:    leaderElectionNamespace,
+		LeaderElectionID:           le.ResourceName,
+		LeaderElectionResourceLock: le.ResourceLock,
+		LeaseDuration:              &le.LeaseDuration.Duration,
+		RenewDeadline:              &le.RenewDeadline.Duration,
+		RetryPeriod:                &le.RetryPeriod.Duration,
+		// Hand over to another instance immediately when shutting
+		// down normally instead of letting the lease expire.
+		LeaderElectionReleaseOnCancel: true,
 		Metrics: metricsserver.Options{
-			BindAddress: *metricsAddr,
+			BindAddress: operatorConfig.MetricsAddr,
 		},
 	})
 	if err != nil {
-		pmemcommon.ExitError("Failed to create controller manager: ", err)
+		pmemcommon.ExitError("Failed to create controller manager", err)
 		return 1
 	}
 
 	ver, err := k8sutil.GetKubernetesVersion(mgr.GetConfig())
 	if err != nil {
-		pmemcommon.ExitError("Failed retrieve kubernetes version: ", err)
+		pmemcommon.ExitError("Failed to retrieve Kubernetes version", err)
 		return 1
 	}
-	klog.Info("Kubernetes Version: ", ver)
-
-	klog.Info("Registering Components.")
+	logger.Info("Registering components.", "kubernetes-version", ver)
 
 	// Setup Scheme for all resources
 	if err := apis.AddToScheme(mgr.GetScheme()); err != nil {
-		pmemcommon.ExitError("Failed to add API schema: ", err)
+		pmemcommon.ExitError("Failed to add API schema", err)
 		return 1
 	}
 
 	cs, err := kubernetes.NewForConfig(mgr.GetConfig())
 	if err != nil {
-		pmemcommon.ExitError("failed to get in-cluster client: %v", err)
+		pmemcommon.ExitError("Failed to get in-cluster client", err)
 		return 1
 	}
 	// Setup all Controllers
 	if err := controller.AddToManager(ctx, mgr, controller.ControllerOptions{
-		Config:       mgr.GetConfig(),
-		Namespace:    namespace,
-		K8sVersion:   *ver,
-		DriverImage:  *driverImage,
-		EventsClient: cs.CoreV1().Events(""),
+		Config:          mgr.GetConfig(),
+		Namespace:       namespace,
+		WatchNamespaces: watchNamespaces,
+		OperatorVersion: version,
+		K8sVersion:      *ver,
+		DriverImage:     operatorConfig.DriverImage,
+		EventsClient:    cs.CoreV1().Events(""),
 	}); err != nil {
-		pmemcommon.ExitError("Failed to add controller to manager: ", err)
+		pmemcommon.ExitError("Failed to add controller to manager", err)
 		return 1
 	}
 
-	klog.Info("Starting the Cmd.")
+	logger.Info("Starting the manager.")
 
 	// Start the Cmd
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
-		pmemcommon.ExitError("Manager exited non-zero: ", err)
+	if err := mgr.Start(stopCtx); err != nil {
+		pmemcommon.ExitError("Manager exited non-zero", err)
 		return 1
 	}
 
 	list := &api.PmemCSIDeploymentList{}
 	if err := mgr.GetClient().List(ctx, list); err != nil {
-		pmemcommon.ExitError("failed to get deployment list: %v", err)
+		pmemcommon.ExitError("Failed to get deployment list", err)
 		return 1
 	}
 
@@ -139,9 +205,60 @@ func Main() int {
 	}
 
 	if len(activeList) != 0 {
-		klog.Infof("There are active PMEM-CSI deployments (%v), hence not deleting the CRD.", activeList)
+		logger.Info("There are active PMEM-CSI deployments, hence not deleting the CRD.", "deployments", activeList)
 		return 0
 	}
 
 	return 0
 }
+
+// overrideFromFlags replaces values in the configuration with those
+// of the command line flags that were set explicitly.
+func overrideFromFlags(c *Configuration) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "image":
+			c.DriverImage = *driverImage
+		case "leader-election":
+			leaderElect := *leaderElection
+			c.LeaderElection.LeaderElect = &leaderElect
+		case "leader-election-lease-duration":
+			c.LeaderElection.LeaseDuration.Duration = *leaseDuration
+		case "leader-election-renew-deadline":
+			c.LeaderElection.RenewDeadline.Duration = *renewDeadline
+		case "leader-election-retry-period":
+			c.LeaderElection.RetryPeriod.Duration = *retryPeriod
+		case "leader-election-resource-lock":
+			c.LeaderElection.ResourceLock = *resourceLock
+		case "metrics-addr":
+			c.MetricsAddr = *metricsAddr
+		case "debug-addr":
+			c.DebugAddr = *debugAddr
+		case "namespaces":
+			c.WatchNamespaces = strings.Split(*namespaces, ",")
+		case "logging-format":
+			c.Logging.Format = *logFormat
+		case "v":
+			if v, err := strconv.ParseUint(f.Value.String(), 10, 32); err == nil {
+				c.Logging.Verbosity = logsapi.VerbosityLevel(v)
+			}
+		}
+	})
+}
+
+// parseNamespaces splits the -namespaces value. "all" gets
+// mapped to cache.AllNamespaces.
+func parseNamespaces(value string) []string {
+	var namespaces []string
+	for _, ns := range strings.Split(value, ",") {
+		ns = strings.TrimSpace(ns)
+		switch ns {
+		case "":
+			continue
+		case "all":
+			ns = cache.AllNamespaces
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+const (
+	// EventReasonDIMMUnhealthy is used when the SMART health of
+	// a DIMM is not ok anymore or gets worse.
+	EventReasonDIMMUnhealthy = "DIMMUnhealthy"
+	// EventReasonMediaErrors is used when the number of bad
+	// blocks in a region increases, for example after an address
+	// range scrub (ARS) found new media errors.
+	EventReasonMediaErrors = "MediaErrors"
+)
+
+// hardwareAlarm is a warning about a hardware problem.
+type hardwareAlarm struct {
+	reason, message string
+}
+
+// hardwareState is what WatchHardware found during the previous
+// check.
+type hardwareState struct {
+	// health maps DIMM device name to its health state.
+	health map[string]ndctl.HealthState
+	// badBlocks maps region device name to its bad block count.
+	badBlocks map[string]uint64
+}
+
+// WatchHardware periodically checks the health of all DIMMs and the
+// bad blocks of all regions and creates a Warning event for the node
+// about changes for the worse, including problems that already exist
+// during the first check. It returns immediately when there is no
+// recorder or the interval is zero and otherwise runs until the
+// context is canceled.
+func WatchHardware(ctx context.Context, recorder record.EventRecorder, nodeName string, interval time.Duration) {
+	if recorder == nil || interval <= 0 {
+		return
+	}
+	ctx, logger := pmemlog.WithName(ctx, "WatchHardware")
+	logger = pmemlog.Deduplicate(logger, repeatedLogWindow)
+	// The same reference as used by the kubelet for node events.
+	node := &corev1.ObjectReference{
+		Kind: "Node",
+		Name: nodeName,
+		UID:  types.UID(nodeName),
+	}
+	state := &hardwareState{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		alarms, err := state.check(ctx)
+		if err != nil {
+			logger.Error(err, "Checking PMEM hardware failed")
+		}
+		for _, alarm := range alarms {
+			logger.Info(alarm.message, "reason", alarm.reason)
+			recorder.Event(node, corev1.EventTypeWarning, alarm.reason, alarm.message)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *hardwareState) check(ctx context.Context) ([]hardwareAlarm, error) {
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+	return s.update(ctx, ndctx), nil
+}
+
+// update compares the current hardware state against the previous
+// one and remembers it for the next update.
+func (s *hardwareState) update(ctx context.Context, ndctx ndctl.Context) []hardwareAlarm {
+	logger := klog.FromContext(ctx)
+	var alarms []hardwareAlarm
+	health := map[string]ndctl.HealthState{}
+	badBlocks := map[string]uint64{}
+	for _, bus := range ndctx.GetBuses() {
+		for _, dimm := range bus.Dimms() {
+			h, err := dimm.Health()
+			if err != nil || h.State == "" {
+				logger.V(5).Info("No DIMM health", "dimm", dimm.DeviceName(), "err", err)
+				continue
+			}
+			name := dimm.DeviceName()
+			health[name] = h.State
+			if healthStateValues[h.State] > healthStateValues[s.health[name]] {
+				alarms = append(alarms, hardwareAlarm{
+					reason:  EventReasonDIMMUnhealthy,
+					message: fmt.Sprintf("DIMM %s (%s) on bus %s has health state %q.", name, dimm.ID(), bus.DeviceName(), h.State),
+				})
+			}
+		}
+		for _, r := range bus.ActiveRegions() {
+			name := r.DeviceName()
+			count := ndctl.CountBadBlocks(r.BadBlocks())
+			badBlocks[name] = count
+			if previous := s.badBlocks[name]; count > previous {
+				alarms = append(alarms, hardwareAlarm{
+					reason:  EventReasonMediaErrors,
+					message: fmt.Sprintf("Region %s on bus %s has %d new bad blocks, %d in total.", name, bus.DeviceName(), count-previous, count),
+				})
+			}
+		}
+	}
+	s.health = health
+	s.badBlocks = badBlocks
+	return alarms
+}
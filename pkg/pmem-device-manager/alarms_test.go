@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestHardwareState(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dimm := &ndctlfake.Dimm{
+		DeviceName_: "nmem0",
+		ID_:         "8089-a2-1837-00000bb3",
+		Health_:     &ndctl.DimmHealth{State: ndctl.HealthOK},
+	}
+	region := &ndctlfake.Region{
+		DeviceName_: "region0",
+		Enabled_:    true,
+		Type_:       ndctl.PmemRegion,
+	}
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus0",
+				Dimms_:      []ndctl.Dimm{dimm},
+				Regions_:    []ndctl.Region{region},
+			},
+		},
+	})
+	state := &hardwareState{}
+
+	assert.Empty(t, state.update(ctx, ndctx), "healthy hardware")
+
+	dimm.Health_ = &ndctl.DimmHealth{State: ndctl.HealthNonCritical}
+	region.BadBlocks_ = []ndctl.BadBlock{{Offset: 8, Length: 2}}
+	assert.Equal(t, []hardwareAlarm{
+		{reason: EventReasonDIMMUnhealthy, message: `DIMM nmem0 (8089-a2-1837-00000bb3) on bus ndbus0 has health state "non-critical".`},
+		{reason: EventReasonMediaErrors, message: "Region region0 on bus ndbus0 has 2 new bad blocks, 2 in total."},
+	}, state.update(ctx, ndctx), "new problems")
+	assert.Empty(t, state.update(ctx, ndctx), "unchanged problems")
+
+	dimm.Health_ = &ndctl.DimmHealth{State: ndctl.HealthFatal}
+	region.BadBlocks_ = append(region.BadBlocks_, ndctl.BadBlock{Offset: 1024, Length: 1})
+	assert.Len(t, state.update(ctx, ndctx), 2, "worse problems")
+
+	dimm.Health_ = &ndctl.DimmHealth{State: ndctl.HealthOK}
+	region.BadBlocks_ = nil
+	assert.Empty(t, state.update(ctx, ndctx), "recovered")
+
+	assert.Empty(t, (&hardwareState{}).update(ctx, ndctlfake.NewContext(&ndctlfake.Context{})), "no hardware")
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// AutoDeviceMode chooses between direct and LVM mode for device mode
+// 'auto' based on the PMEM of the node.
+func AutoDeviceMode(ctx context.Context) (api.DeviceMode, error) {
+	ctx, logger := pmemlog.WithName(ctx, "AutoDeviceMode")
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return "", err
+	}
+	defer ndctx.Free()
+
+	mode, reason := chooseDeviceMode(ndctx)
+	logger.Info("Chose device mode", "mode", mode, "reason", reason)
+	return mode, nil
+}
+
+// chooseDeviceMode returns the device mode and why it was chosen.
+// Existing volumes determine the mode because they must remain
+// usable. Otherwise direct mode is used if each region has all of
+// its free space in one extent, because then namespaces can be
+// created without running into fragmentation. LVM mode is the
+// fallback.
+func chooseDeviceMode(ndctx ndctl.Context) (api.DeviceMode, string) {
+	var regions []ndctl.Region
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.AllRegions() {
+			for _, ns := range r.AllNamespaces() {
+				switch {
+				case ns.Name() == pmemCSINamespaceName:
+					return api.DeviceModeLVM, "namespace for LVM exists in " + r.DeviceName()
+				case IsVolumeID(ns.Name()):
+					return api.DeviceModeDirect, "volume namespace exists in " + r.DeviceName()
+				}
+			}
+			if r.Enabled() {
+				regions = append(regions, r)
+			}
+		}
+	}
+	if len(regions) == 0 {
+		return api.DeviceModeLVM, "no active regions"
+	}
+	for _, r := range regions {
+		if r.Type() != ndctl.PmemRegion {
+			return api.DeviceModeLVM, r.DeviceName() + " is not a pmem region"
+		}
+		if r.MaxAvailableExtent() < r.AvailableSize() {
+			return api.DeviceModeLVM, "free space in " + r.DeviceName() + " is fragmented"
+		}
+	}
+	return api.DeviceModeDirect, "free space in all regions is contiguous"
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestChooseDeviceMode(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	region := func(available, extent uint64, namespaces ...string) *ndctlfake.Region {
+		r := &ndctlfake.Region{
+			DeviceName_:         "region0",
+			Size_:               16 * gig,
+			AvailableSize_:      available,
+			MaxAvailableExtent_: extent,
+			Enabled_:            true,
+			Type_:               ndctl.PmemRegion,
+		}
+		for _, name := range namespaces {
+			r.Namespaces_ = append(r.Namespaces_, &ndctlfake.Namespace{Name_: name, Size_: 4 * gig, Enabled_: true})
+		}
+		return r
+	}
+	volumeID := "pvc-12-0123456789abcdef0123456789abcdef0123456789abcdef01234567"
+
+	testcases := map[string]struct {
+		regions  []ndctl.Region
+		expected api.DeviceMode
+	}{
+		"no-regions": {
+			expected: api.DeviceModeLVM,
+		},
+		"contiguous": {
+			regions:  []ndctl.Region{region(16*gig, 16*gig)},
+			expected: api.DeviceModeDirect,
+		},
+		"fragmented": {
+			regions:  []ndctl.Region{region(8*gig, 4*gig, "foo")},
+			expected: api.DeviceModeLVM,
+		},
+		"lvm-namespace": {
+			regions:  []ndctl.Region{region(8*gig, 8*gig, pmemCSINamespaceName)},
+			expected: api.DeviceModeLVM,
+		},
+		"direct-volume": {
+			regions:  []ndctl.Region{region(8*gig, 4*gig, volumeID)},
+			expected: api.DeviceModeDirect,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+				Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: tc.regions}},
+			})
+			mode, reason := chooseDeviceMode(ndctx)
+			assert.Equal(t, tc.expected, mode, "device mode, reason: %s", reason)
+		})
+	}
+}
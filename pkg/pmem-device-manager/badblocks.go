@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// MediaErrors is implemented by device managers which know about
+// media errors (bad blocks) in the PMEM that they use. All counts
+// are in units of ndctl.BadBlockSize.
+type MediaErrors interface {
+	// RegionBadBlocks returns the number of bad blocks in each
+	// region, indexed by region name.
+	RegionBadBlocks(ctx context.Context) (map[string]uint64, error)
+	// VolumeBadBlocks returns the number of bad blocks in the
+	// namespaces which hold the volume.
+	// Possible errors: ErrDeviceNotFound
+	VolumeBadBlocks(ctx context.Context, volumeId string) (uint64, error)
+}
+
+// regionBadBlocks implements MediaErrors.RegionBadBlocks for all
+// device managers which use ndctl.
+func regionBadBlocks(ctx context.Context) (map[string]uint64, error) {
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+
+	badBlocks := map[string]uint64{}
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			badBlocks[r.DeviceName()] = ndctl.CountBadBlocks(r.BadBlocks())
+		}
+	}
+	return badBlocks, nil
+}
+
+// namespaceBadBlocks counts the bad blocks of the active namespaces
+// with the given block devices (for example, "/dev/pmem0").
+func namespaceBadBlocks(devices []string) (uint64, error) {
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return 0, err
+	}
+	defer ndctx.Free()
+
+	var count uint64
+	for _, ns := range ndctl.GetActiveNamespaces(ndctx) {
+		for _, device := range devices {
+			if ns.BlockDeviceName() != "" && device == "/dev/"+ns.BlockDeviceName() {
+				count += ndctl.CountBadBlocks(ns.BadBlocks())
+				break
+			}
+		}
+	}
+	return count, nil
+}
+
+// lvDevices returns the physical volumes which hold the data of a
+// logical volume. For a thin volume, those are the ones of the
+// thin pool.
+func lvDevices(ctx context.Context, path string) ([]string, error) {
+	thin, err := isThinVolume(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	lv := path
+	if thin {
+		// The data of the pool is in a hidden logical volume.
+		lv = filepath.Base(filepath.Dir(path)) + "/" + thinPoolName + "_tdata"
+	}
+	output, err := pmemexec.RunCommand(ctx, "lvs", "--noheadings", "-o", "devices", lv)
+	if err != nil {
+		return nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	return parseLVDevices(output), nil
+}
+
+// lvs option "devices", for example "/dev/pmem0(0),/dev/pmem1(0)",
+// with one line per segment.
+func parseLVDevices(output string) []string {
+	var devices []string
+	seen := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		for _, device := range strings.Split(line, ",") {
+			device = strings.TrimSpace(device)
+			if i := strings.Index(device, "("); i >= 0 {
+				device = device[:i]
+			}
+			if device == "" || seen[device] {
+				continue
+			}
+			seen[device] = true
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLVDevices(t *testing.T) {
+	for name, tc := range map[string]struct {
+		output   string
+		expected []string
+	}{
+		"empty": {},
+		"linear": {
+			output:   "  /dev/pmem0(0)\n",
+			expected: []string{"/dev/pmem0"},
+		},
+		"striped": {
+			output:   "  /dev/pmem0(0),/dev/pmem1(0)\n",
+			expected: []string{"/dev/pmem0", "/dev/pmem1"},
+		},
+		"segments": {
+			output:   "  /dev/pmem1(128)\n  /dev/pmem0(0)\n  /dev/pmem1(0)\n",
+			expected: []string{"/dev/pmem1", "/dev/pmem0"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseLVDevices(tc.output))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"sort"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// busRegions returns those of the regions which are on the bus.
+func busRegions(ndctx ndctl.Context, regions []string, bus string) []string {
+	return filterRegions(ndctx, regions, func(r ndctl.Region) bool {
+		return r.Bus().DeviceName() == bus
+	})
+}
+
+// busVolumeGroups returns those of the volume groups whose region is
+// on the bus.
+func (lvm *pmemLvm) busVolumeGroups(volumeGroups []string, bus string) []string {
+	return lvm.filterVolumeGroups(volumeGroups, func(r regionInfo) bool {
+		return r.bus == bus
+	})
+}
+
+// Buses returns the buses of the regions in the capacity details,
+// sorted and without duplicates.
+func (c Capacity) Buses() []string {
+	var buses []string
+	for _, detail := range c.Details {
+		if detail.Bus != "" && !containsString(buses, detail.Bus) {
+			buses = append(buses, detail.Bus)
+		}
+	}
+	sort.Strings(buses)
+	return buses
+}
+
+// ForBus returns the capacity of those regions in the capacity
+// details which are on the bus. The capacity is returned unmodified
+// when there are no details.
+func (c Capacity) ForBus(bus string) Capacity {
+	return c.filter(func(detail CapacityDetail) bool {
+		return detail.Bus == bus
+	})
+}
+
+// lessDeviceName orders device names like "ndbus2" and "ndbus10"
+// by their number if they have the same prefix.
+func lessDeviceName(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
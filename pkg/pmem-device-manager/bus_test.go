@@ -0,0 +1,108 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestBusRegions(t *testing.T) {
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus0",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region0", Enabled_: true},
+					&ndctlfake.Region{DeviceName_: "region1", Enabled_: false},
+				},
+			},
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus1",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region2", Enabled_: true},
+					&ndctlfake.Region{DeviceName_: "region3", Enabled_: true},
+				},
+			},
+		},
+	})
+	all := []string{"region0", "region1", "region2", "region3"}
+	assert.Equal(t, []string{"region0"}, busRegions(ndctx, all, "ndbus0"), "bus 0")
+	assert.Equal(t, []string{"region2", "region3"}, busRegions(ndctx, all, "ndbus1"), "bus 1")
+	assert.Equal(t, []string{"region3"}, busRegions(ndctx, []string{"region0", "region3"}, "ndbus1"), "bus 1 in pool")
+	assert.Empty(t, busRegions(ndctx, all, "ndbus2"), "bus 2")
+}
+
+func TestBusVolumeGroups(t *testing.T) {
+	lvm := &pmemLvm{
+		regions: map[string]regionInfo{
+			"bus0region0fsdax": {name: "region0", bus: "ndbus0"},
+			"bus1region1fsdax": {name: "region1", bus: "ndbus1"},
+		},
+	}
+	volumeGroups := []string{"bus0region0fsdax", "bus1region1fsdax", nodeVGName}
+	assert.Equal(t, []string{"bus0region0fsdax"}, lvm.busVolumeGroups(volumeGroups, "ndbus0"), "bus 0")
+	assert.Equal(t, []string{"bus1region1fsdax"}, lvm.busVolumeGroups(volumeGroups, "ndbus1"), "bus 1")
+	assert.Empty(t, lvm.busVolumeGroups(volumeGroups, "ndbus2"), "bus 2")
+}
+
+func TestCapacityBuses(t *testing.T) {
+	capacity := Capacity{
+		MaxVolumeSize:     300,
+		Available:         600,
+		PhysicalAvailable: 600,
+		Managed:           1500,
+		Total:             2000,
+		Details: []CapacityDetail{
+			{Region: "region0", Bus: "ndbus1", MaxVolumeSize: 100, Available: 100, Total: 500},
+			{Region: "region1", Bus: "ndbus0", MaxVolumeSize: 300, Available: 300, Total: 500},
+			{Region: "region2", Bus: "ndbus1", MaxVolumeSize: 200, Available: 200, Total: 500},
+			{VolumeGroup: "node"},
+		},
+	}
+	assert.Equal(t, []string{"ndbus0", "ndbus1"}, capacity.Buses(), "buses")
+	assert.Empty(t, Capacity{}.Buses(), "no details")
+
+	bus1 := capacity.ForBus("ndbus1")
+	assert.Equal(t, uint64(200), bus1.MaxVolumeSize, "max volume size")
+	assert.Equal(t, uint64(300), bus1.Available, "available")
+	assert.Equal(t, uint64(300), bus1.PhysicalAvailable, "physically available")
+	assert.Equal(t, uint64(1000), bus1.Managed, "managed")
+	assert.Equal(t, uint64(1000), bus1.Total, "total")
+	assert.Len(t, bus1.Details, 2, "details")
+	assert.Equal(t, Capacity{}, capacity.ForBus("ndbus2"), "bus 2")
+
+	noDetails := Capacity{MaxVolumeSize: 1, Available: 2}
+	assert.Equal(t, noDetails, noDetails.ForBus("ndbus0"), "no details")
+}
+
+func TestActiveRegionsOrder(t *testing.T) {
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus10",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region3", Enabled_: true},
+				},
+			},
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus2",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region11", Enabled_: true},
+					&ndctlfake.Region{DeviceName_: "region2", Enabled_: true},
+					&ndctlfake.Region{DeviceName_: "region4", Enabled_: false},
+				},
+			},
+		},
+	})
+	assert.Equal(t, []string{"region2", "region11", "region3"}, activeRegions(ndctx, nil), "all regions")
+	assert.Equal(t, []string{"region11", "region3"}, activeRegions(ndctx, []string{"region3", "region11"}), "pool")
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"sync"
+	"time"
+)
+
+// capacityCacheTTL is how long a GetCapacity result gets reused.
+// Changes made by the device manager itself invalidate it earlier,
+// the TTL covers changes made by others, like LVM thin pools
+// filling up or new PMEM showing up.
+var capacityCacheTTL = 5 * time.Second
+
+// capacityCache remembers the result of GetCapacity because the
+// external-provisioner and the scheduler extender call it often and
+// determining it means enumerating all regions or running LVM
+// commands. The key is the number of stripes, zero if the device
+// manager does not support striping.
+type capacityCache struct {
+	mutex   sync.Mutex
+	entries map[uint]capacityCacheEntry
+	// generation gets incremented by invalidate. Results which
+	// were computed while it changed are not stored because they
+	// might be stale.
+	generation uint64
+	// now can be replaced in tests.
+	now func() time.Time
+}
+
+type capacityCacheEntry struct {
+	capacity Capacity
+	expires  time.Time
+}
+
+// get returns the cached capacity or calls compute. Errors are not
+// cached.
+func (c *capacityCache) get(key uint, compute func() (Capacity, error)) (Capacity, error) {
+	c.mutex.Lock()
+	now := c.timeNow()
+	if entry, ok := c.entries[key]; ok && now.Before(entry.expires) {
+		c.mutex.Unlock()
+		return entry.capacity.copy(), nil
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	capacity, err := compute()
+	if err != nil {
+		return capacity, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generation == generation {
+		if c.entries == nil {
+			c.entries = map[uint]capacityCacheEntry{}
+		}
+		c.entries[key] = capacityCacheEntry{
+			capacity: capacity.copy(),
+			expires:  now.Add(capacityCacheTTL),
+		}
+	}
+	return capacity, nil
+}
+
+// invalidate must be called after each change of the PMEM usage.
+func (c *capacityCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	c.entries = nil
+}
+
+func (c *capacityCache) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// copy ensures that callers cannot modify the cached details.
+func (c Capacity) copy() Capacity {
+	c.Details = append([]CapacityDetail(nil), c.Details...)
+	return c
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacityCache(t *testing.T) {
+	now := time.Now()
+	cache := capacityCache{now: func() time.Time { return now }}
+	calls := 0
+	available := uint64(100)
+	compute := func() (Capacity, error) {
+		calls++
+		return Capacity{
+			Available: available,
+			Details:   []CapacityDetail{{Region: "region0", Available: available}},
+		}, nil
+	}
+	get := func(key uint) Capacity {
+		capacity, err := cache.get(key, compute)
+		require.NoError(t, err, "get capacity")
+		return capacity
+	}
+
+	assert.Equal(t, uint64(100), get(1).Available, "first call")
+	available = 50
+	capacity := get(1)
+	assert.Equal(t, uint64(100), capacity.Available, "cached")
+	assert.Equal(t, 1, calls, "calls with cached result")
+	capacity.Details[0].Available = 0
+	assert.Equal(t, uint64(100), get(1).Details[0].Available, "cached details cannot be modified")
+
+	assert.Equal(t, uint64(50), get(2).Available, "different stripes")
+	assert.Equal(t, 2, calls, "calls for different stripes")
+
+	cache.invalidate()
+	assert.Equal(t, uint64(50), get(1).Available, "after invalidation")
+	assert.Equal(t, 3, calls, "calls after invalidation")
+
+	available = 25
+	now = now.Add(capacityCacheTTL)
+	assert.Equal(t, uint64(25), get(1).Available, "after TTL")
+	assert.Equal(t, 4, calls, "calls after TTL")
+
+	// A result computed while the cache gets invalidated might
+	// be stale and must not be stored.
+	cache.invalidate()
+	_, err := cache.get(1, func() (Capacity, error) {
+		cache.invalidate()
+		return Capacity{Available: 1}, nil
+	})
+	require.NoError(t, err, "get capacity with concurrent invalidation")
+	assert.Equal(t, uint64(25), get(1).Available, "concurrent invalidation")
+
+	// Errors are not cached.
+	cache.invalidate()
+	_, err = cache.get(1, func() (Capacity, error) {
+		return Capacity{}, errors.New("fake error")
+	})
+	assert.Error(t, err, "get capacity with error")
+	assert.Equal(t, uint64(25), get(1).Available, "after error")
+}
@@ -8,6 +8,7 @@ package pmdmanager
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"github.com/intel/pmem-csi/pkg/exec"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/ndctl"
@@ -31,14 +33,22 @@ const (
 // ForceConvertRawNamespaces iterates over all raw namespaces,
 // force-converts them to fsdax + LVM volume group, then modifies the
 // node labels such that the normal driver runs instead of this
-// special one-time operation.
-func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface, driverName string, nodeSelector types.NodeSelector, nodeName string) (finalErr error) {
+// special one-time operation. The result is recorded in a node
+// annotation. In dry-run mode, only that annotation gets set, with
+// a list of the namespaces that would get converted.
+//
+// With a goal, NVDIMMs without regions get provisioned first. The
+// conversion then only happens after the node was rebooted.
+func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface, driverName string, nodeSelector types.NodeSelector, nodeName string, goal Goal, dryRun bool) (finalErr error) {
 	ctx, _ = pmemlog.WithName(ctx, "ForceConvertRawNamespaces")
 	defer func() {
 		if finalErr == nil {
 			return
 		}
 
+		// Best effort, the error itself gets returned anyway.
+		_ = annotate(ctx, client, driverName, nodeName, "failed: "+finalErr.Error())
+
 		// Gather some information and append it.
 		finalErr = fmt.Errorf("%w\n%s\n%s",
 			finalErr,
@@ -52,27 +62,53 @@ func ForceConvertRawNamespaces(ctx context.Context, client kubernetes.Interface,
 		return fmt.Errorf("ndctl: %v", err)
 	}
 
-	if _, err := convert(ctx, ndctx); err != nil {
+	if goal.AppDirectPercentage > 0 {
+		ready, err := applyGoal(ctx, client, driverName, nodeName, ndctx, goal, dryRun)
+		if err != nil {
+			return fmt.Errorf("apply PMEM goal: %v", err)
+		}
+		if !ready {
+			return annotate(ctx, client, driverName, nodeName, "waiting for reboot after PMEM goal")
+		}
+	}
+
+	converted, err := convert(ctx, ndctx, dryRun)
+	if err != nil {
 		return err
 	}
+	numConverted := len(converted)
+
+	if dryRun {
+		result := fmt.Sprintf("dry run: %d namespace(s) would be converted", numConverted)
+		if numConverted > 0 {
+			result += ": " + strings.Join(converted, ", ")
+		}
+		return annotate(ctx, client, driverName, nodeName, result)
+	}
 
 	if err := havePMEM(ctx, ndctx); err != nil {
 		return err
 	}
 
+	if err := annotate(ctx, client, driverName, nodeName, fmt.Sprintf("converted %d namespace(s)", numConverted)); err != nil {
+		return err
+	}
+
 	if err := relabel(ctx, client, driverName, nodeSelector, nodeName); err != nil {
 		return fmt.Errorf("relabel node %s: %v:", nodeName, err)
 	}
 	return nil
 }
 
-func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalErr error) {
+// convert returns the namespaces which were converted, or would be
+// converted in dry-run mode, as "<namespace> (<region>)".
+func convert(ctx context.Context, ndctx ndctl.Context, dryRun bool) (converted []string, finalErr error) {
 	ctx, logger := pmemlog.WithName(ctx, "convert")
 	defer func() {
 		if finalErr != nil {
-			logger.Error(finalErr, "failed", "converted", numConverted)
+			logger.Error(finalErr, "failed", "converted", len(converted))
 		} else {
-			logger.V(3).Info("successful", "converted", numConverted)
+			logger.V(3).Info("successful", "converted", len(converted))
 		}
 	}()
 
@@ -94,6 +130,16 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 					continue
 				}
 
+				if dryRun {
+					switch {
+					case namespace.Mode() == ndctl.RawMode,
+						namespace.Mode() == ndctl.FsdaxMode && namespace.Name() != pmemCSINamespaceName:
+						logger.V(2).Info("would convert namespace", "namespace", namespace, "vg", vgName)
+						converted = append(converted, convertedName(region, namespace))
+					}
+					continue
+				}
+
 				switch namespace.Mode() {
 				case ndctl.RawMode:
 					logger.V(2).Info("converting raw namespace", "namespace", namespace)
@@ -131,7 +177,7 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 						return
 					}
 					logger.V(2).Info("converted to fsdax namespace", "namespace", namespace, "vg", vgName)
-					numConverted++
+					converted = append(converted, convertedName(region, namespace))
 				default:
 					logger.V(3).Info("ignoring namespace because of mode", "mode", namespace.Mode())
 				}
@@ -142,6 +188,10 @@ func convert(ctx context.Context, ndctx ndctl.Context) (numConverted int, finalE
 	return
 }
 
+func convertedName(region ndctl.Region, namespace ndctl.Namespace) string {
+	return fmt.Sprintf("%s (%s)", namespace.DeviceName(), region.DeviceName())
+}
+
 func havePMEM(ctx context.Context, ndctx ndctl.Context) error {
 	ctx, logger := pmemlog.WithName(ctx, "havePMEM")
 
@@ -186,8 +236,9 @@ func relabel(ctx context.Context, client kubernetes.Interface, driverName string
 
 	// Remove "force" label.
 	labels = append(labels, fmt.Sprintf(`"%s/%s": null`, driverName, ConvertRawNamespacesLabel))
-	// Add labels for node driver.
-	for key, value := range nodeSelector {
+	// Add labels for node driver. Expressions cannot be satisfied
+	// automatically, the node must already match those.
+	for key, value := range nodeSelector.MatchLabels {
 		labels = append(labels, fmt.Sprintf("%q: %q", key, value))
 	}
 
@@ -200,3 +251,29 @@ func relabel(ctx context.Context, client kubernetes.Interface, driverName string
 	logger.V(3).Info("Change node labels", "node", nodeName, "patch", patch)
 	return nil
 }
+
+func annotate(ctx context.Context, client kubernetes.Interface, driverName string, nodeName string, result string) error {
+	return annotateNode(ctx, client, driverName, nodeName, api.RawNamespaceConversionAnnotation, result)
+}
+
+// annotateNode stores the result in the "<driver name>/<annotation>"
+// annotation of the node.
+func annotateNode(ctx context.Context, client kubernetes.Interface, driverName string, nodeName string, annotation string, result string) error {
+	ctx, logger := pmemlog.WithName(ctx, "annotate")
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				driverName + "/" + annotation: result,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create patch: %v", err)
+	}
+	logger.V(5).Info("Node", "patch", string(patch))
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}, ""); err != nil {
+		return fmt.Errorf("failed to patch node: %v", err)
+	}
+	logger.V(3).Info("Recorded result", "node", nodeName, "result", result)
+	return nil
+}
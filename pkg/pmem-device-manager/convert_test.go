@@ -116,10 +116,12 @@ case "$*" in
 esac
 `
 	testcases := map[string]struct {
-		hardware    ndctl.Context
-		scripts     map[string]string
-		expectError bool
-		expectNum   int
+		hardware        ndctl.Context
+		scripts         map[string]string
+		dryRun          bool
+		expectError     bool
+		expectNum       int
+		expectConverted []string
 	}{
 		"nop": {
 			hardware: ndctlfake.NewContext(&ndctlfake.Context{}),
@@ -176,6 +178,13 @@ esac
 			},
 			expectNum: 1,
 		},
+		"dry-run": {
+			// All commands fail if called.
+			hardware:        makeRawNamespace(),
+			dryRun:          true,
+			expectNum:       1,
+			expectConverted: []string{"namespace0.0 (region0)"},
+		},
 		"only-vgcreate": {
 			hardware: func() ndctl.Context {
 				hardware := makeRawNamespace()
@@ -300,13 +309,16 @@ esac
 
 			_, ctx := ktesting.NewTestContext(t)
 
-			numConverted, err := convert(ctx, tc.hardware)
+			converted, err := convert(ctx, tc.hardware, tc.dryRun)
 			if tc.expectError {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
 			}
-			assert.Equal(t, tc.expectNum, numConverted)
+			assert.Equal(t, tc.expectNum, len(converted))
+			if tc.expectConverted != nil {
+				assert.Equal(t, tc.expectConverted, converted)
+			}
 		})
 	}
 }
@@ -355,9 +367,9 @@ func TestRelabel(t *testing.T) {
 				"foo":                             "bar",
 			})},
 			driverName: "pmem-csi",
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				"storage": "pmem",
-			},
+			}},
 			nodeName: "worker",
 			expectNode: makeNode("worker", map[string]string{
 				"storage": "pmem",
@@ -370,9 +382,9 @@ func TestRelabel(t *testing.T) {
 				"foo":     "bar",
 			})},
 			driverName: "pmem-csi",
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				"storage": "pmem",
-			},
+			}},
 			nodeName: "worker",
 			expectNode: makeNode("worker", map[string]string{
 				"storage": "pmem",
@@ -381,9 +393,9 @@ func TestRelabel(t *testing.T) {
 		},
 		"no-node": {
 			driverName: "pmem-csi",
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				"storage": "pmem",
-			},
+			}},
 			nodeName:    "worker",
 			expectError: true,
 		},
@@ -392,11 +404,11 @@ func TestRelabel(t *testing.T) {
 				"pmem-csi/convert-raw-namespaces": "force",
 			})},
 			driverName: "pmem-csi",
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				"x":         "y",
 				"a":         "b",
 				"yyyy/zzzz": "1",
-			},
+			}},
 			nodeName: "worker",
 			expectNode: makeNode("worker", map[string]string{
 				"x":         "y",
@@ -411,9 +423,9 @@ func TestRelabel(t *testing.T) {
 				"foo":                              "bar",
 			})},
 			driverName: "pmem-csi1",
-			nodeSelector: types.NodeSelector{
+			nodeSelector: types.NodeSelector{MatchLabels: map[string]string{
 				"storage": "pmem",
-			},
+			}},
 			nodeName: "worker",
 			expectNode: makeNode("worker", map[string]string{
 				"pmem-csi2/convert-raw-namespaces": "force",
@@ -440,6 +452,17 @@ func TestRelabel(t *testing.T) {
 	}
 }
 
+func TestAnnotate(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client := fake.NewSimpleClientset(makeNode("worker", map[string]string{"foo": "bar"}))
+	err := annotate(ctx, client, "pmem-csi", "worker", "converted 1 namespace(s)")
+	require.NoError(t, err)
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	require.Equal(t, map[string]string{"pmem-csi/raw-namespace-conversion": "converted 1 namespace(s)"}, node.Annotations)
+	require.Equal(t, map[string]string{"foo": "bar"}, node.Labels)
+}
+
 func makeNode(nodeName string, labels map[string]string) *v1.Node {
 	return &v1.Node{
 		ObjectMeta: metav1.ObjectMeta{
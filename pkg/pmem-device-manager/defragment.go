@@ -0,0 +1,319 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// defragmentName is the name of a namespace while it gets filled
+// with the data of a volume.
+const defragmentName = "pmem-csi-defrag"
+
+// journalCopied is added to the journal after copying the data.
+const journalCopied = "copied"
+
+// maxDefragmentMoves limits how often namespaces get moved per
+// region. The kernel decides where a new namespace gets placed, so
+// there is no guarantee that moving namespaces makes progress.
+const maxDefragmentMoves = 100
+
+// wipeMovedNamespace overwrites the data of a namespace after it was
+// copied. Tests replace it because fake namespaces have no block
+// device.
+var wipeMovedNamespace = func(ctx context.Context, dev *PmemDeviceInfo) error {
+	return clearDevice(ctx, dev, true, false)
+}
+
+// Defragment moves the namespaces of volumes in direct mode so that
+// the free space in each region becomes contiguous and larger
+// volumes can be created. A namespace gets moved by creating a new
+// one, copying the data, and then destroying the old one. Namespaces
+// which are in use are skipped, so this should only be done while
+// the node is drained.
+//
+// isVolume identifies the namespaces which may be moved by their
+// name. The journal file records which volume is being moved and
+// whether its data was copied. An interrupted move gets completed or
+// rolled back when calling Defragment again with the same journal.
+func Defragment(ctx context.Context, journal string, isVolume func(name string) bool) error {
+	ctx, logger := pmemlog.WithName(ctx, "Defragment")
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	if err := recoverDefragment(ctx, journal); err != nil {
+		return fmt.Errorf("recover interrupted defragmentation: %v", err)
+	}
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return err
+	}
+	var regions []string
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			regions = append(regions, r.DeviceName())
+		}
+	}
+	ndctx.Free()
+
+	for _, region := range regions {
+		skip := map[string]bool{}
+		moves := 0
+		for ; moves < maxDefragmentMoves; moves++ {
+			done, err := defragmentStep(ctx, region, journal, isVolume, skip)
+			if err != nil {
+				return fmt.Errorf("region %s: %v", region, err)
+			}
+			if done {
+				break
+			}
+		}
+		logger.V(2).Info("Region done", "region", region, "moves", moves)
+	}
+	return nil
+}
+
+// defragmentStep moves at most one namespace in the region. It
+// returns true if the region is not fragmented or no namespace can
+// be moved.
+func defragmentStep(ctx context.Context, regionName, journal string, isVolume func(name string) bool, skip map[string]bool) (bool, error) {
+	logger := klog.FromContext(ctx).WithValues("region", regionName)
+
+	// Namespaces get created and destroyed, so always start with
+	// a new context.
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return false, err
+	}
+	defer ndctx.Free()
+	r := findRegion(ndctx, regionName)
+	if r == nil {
+		return false, fmt.Errorf("region not found")
+	}
+	if r.MaxAvailableExtent() >= r.AvailableSize() {
+		logger.V(3).Info("Free space is contiguous", "available", pmemlog.CapacityRef(int64(r.AvailableSize())))
+		return true, nil
+	}
+
+	var candidates []ndctl.Namespace
+	for _, ns := range r.ActiveNamespaces() {
+		if isVolume(ns.Name()) && !skip[ns.Name()] {
+			candidates = append(candidates, ns)
+		}
+	}
+	// Namespaces at the end of the region are most likely to
+	// move into a hole further down.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Resource() > candidates[j].Resource()
+	})
+	for _, ns := range candidates {
+		id := ns.Name()
+		if ns.RawSize() > r.MaxAvailableExtent() {
+			continue
+		}
+		if deviceInUse("/dev/" + ns.BlockDeviceName()) {
+			logger.Info("Skipping volume which is in use", "volume-id", id)
+			skip[id] = true
+			continue
+		}
+		oldResource := ns.Resource()
+		newResource, err := moveNamespace(ctx, r, ns, journal)
+		if errors.Is(err, pmemerr.NotEnoughSpace) {
+			skip[id] = true
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("move volume %s: %v", id, err)
+		}
+		logger.V(3).Info("Moved volume", "volume-id", id, "old-resource", oldResource, "new-resource", newResource)
+		if newResource >= oldResource {
+			// Moving it again is unlikely to help.
+			skip[id] = true
+		}
+		return false, nil
+	}
+	logger.V(3).Info("No volume can be moved",
+		"available", pmemlog.CapacityRef(int64(r.AvailableSize())),
+		"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())))
+	return true, nil
+}
+
+// moveNamespace copies the namespace into a new one with the same
+// size and mode, then replaces the original. It returns the
+// resource of the new namespace.
+func moveNamespace(ctx context.Context, r ndctl.Region, ns ndctl.Namespace, journal string) (uint64, error) {
+	id := ns.Name()
+	if err := os.WriteFile(journal, []byte(id), 0600); err != nil {
+		return 0, fmt.Errorf("write journal: %v", err)
+	}
+	tmp, err := r.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
+		Name:           defragmentName,
+		Size:           ns.RawSize(),
+		Mode:           ns.Mode(),
+		Location:       ns.Location(),
+		AvoidBadBlocks: true,
+	})
+	if err != nil {
+		_ = os.Remove(journal)
+		return 0, err
+	}
+	if _, err := pmemexec.RunThrottled(ctx, "/dev/"+tmp.BlockDeviceName(), "dd", "if=/dev/"+ns.BlockDeviceName(), "of=/dev/"+tmp.BlockDeviceName(), "bs=4M", "conv=fsync"); err != nil {
+		if err2 := r.DestroyNamespace(ctx, tmp, true); err2 == nil {
+			_ = os.Remove(journal)
+		}
+		return 0, fmt.Errorf("copy data: %v", err)
+	}
+
+	// From now on, an interruption gets handled by
+	// recoverDefragment by completing the move.
+	if err := os.WriteFile(journal, []byte(id+"\n"+journalCopied), 0600); err != nil {
+		return 0, fmt.Errorf("write journal: %v", err)
+	}
+	if err := replaceNamespace(ctx, ns, tmp); err != nil {
+		return 0, err
+	}
+	resource := tmp.Resource()
+	if err := os.Remove(journal); err != nil {
+		return 0, fmt.Errorf("remove journal: %v", err)
+	}
+	return resource, nil
+}
+
+// replaceNamespace destroys the original namespace after wiping its
+// data, which must not show up in new volumes, and gives its name to
+// the copy.
+func replaceNamespace(ctx context.Context, ns, replacement ndctl.Namespace) error {
+	id := ns.Name()
+	old := &PmemDeviceInfo{VolumeId: id, Path: "/dev/" + ns.BlockDeviceName(), Size: ns.Size()}
+	if err := wipeMovedNamespace(ctx, old); err != nil {
+		return err
+	}
+	if err := ns.Region().DestroyNamespace(ctx, ns, true); err != nil {
+		return fmt.Errorf("destroy old namespace: %v", err)
+	}
+	return renameNamespace(replacement, id)
+}
+
+// recoverDefragment handles a move that was interrupted. If the data
+// was copied completely, the move gets completed. Otherwise the copy
+// gets destroyed.
+func recoverDefragment(ctx context.Context, journal string) error {
+	logger := klog.FromContext(ctx)
+	data, err := os.ReadFile(journal)
+	noJournal := os.IsNotExist(err)
+	if err != nil && !noJournal {
+		return err
+	}
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+	tmp, err := ndctl.GetNamespaceByName(ndctx, defragmentName)
+	if noJournal {
+		// The journal gets written before creating the copy and
+		// removed after renaming it, so a copy without a journal
+		// is left over from a failed attempt to destroy it, or
+		// the journal got lost. In both cases the original still
+		// exists and the copy only occupies space.
+		if err == nil {
+			logger.Info("Removing copy of a volume without journal")
+			if err := tmp.Region().DestroyNamespace(ctx, tmp, true); err != nil {
+				return fmt.Errorf("destroy leftover copy: %v", err)
+			}
+		}
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	id := lines[0]
+	copied := len(lines) > 1 && lines[1] == journalCopied
+
+	switch {
+	case errors.Is(err, pmemerr.DeviceNotFound):
+		// Either nothing was created yet or the copy already
+		// got renamed, in which case it might not have been
+		// enabled again.
+		if ns, err := ndctl.GetNamespaceByName(ndctx, id); err == nil && !ns.Enabled() {
+			logger.Info("Enabling moved volume", "volume-id", id)
+			if err := ns.Enable(); err != nil {
+				return err
+			}
+		}
+	case err != nil:
+		return err
+	case !copied:
+		logger.Info("Removing incomplete copy of volume", "volume-id", id)
+		if err := tmp.Region().DestroyNamespace(ctx, tmp, true); err != nil {
+			return fmt.Errorf("destroy copy of volume %s: %v", id, err)
+		}
+	default:
+		logger.Info("Completing move of volume", "volume-id", id)
+		ns, err := ndctl.GetNamespaceByName(ndctx, id)
+		switch {
+		case err == nil:
+			if err := replaceNamespace(ctx, ns, tmp); err != nil {
+				return err
+			}
+		case errors.Is(err, pmemerr.DeviceNotFound):
+			if err := renameNamespace(tmp, id); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+	return os.Remove(journal)
+}
+
+// renameNamespace changes the name of an active namespace. This is
+// only possible while the namespace is disabled.
+func renameNamespace(ns ndctl.Namespace, name string) error {
+	if err := ns.Disable(); err != nil {
+		return err
+	}
+	if err := ns.SetAltName(name); err != nil {
+		return err
+	}
+	return ns.Enable()
+}
+
+func findRegion(ndctx ndctl.Context, name string) ndctl.Region {
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.DeviceName() == name {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// deviceInUse returns true if the block device cannot be opened
+// exclusively, for example because it is mounted. Tests replace it.
+var deviceInUse = func(path string) bool {
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return true
+	}
+	unix.Close(fd)
+	return false
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+// fakeDefragment replaces the ndctl context, the device checks and
+// dd for Defragment. It returns a function which returns the paths
+// of the wiped devices.
+func fakeDefragment(t *testing.T, region *ndctlfake.Region) func() []string {
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: []ndctl.Region{region}}},
+	})
+	var wiped []string
+	oldContext, oldWipe, oldInUse := newNdctlContext, wipeMovedNamespace, deviceInUse
+	t.Cleanup(func() {
+		newNdctlContext, wipeMovedNamespace, deviceInUse = oldContext, oldWipe, oldInUse
+	})
+	newNdctlContext = func() (ndctl.Context, error) {
+		return ndctx, nil
+	}
+	wipeMovedNamespace = func(ctx context.Context, dev *PmemDeviceInfo) error {
+		wiped = append(wiped, dev.Path)
+		return nil
+	}
+	deviceInUse = func(path string) bool {
+		return false
+	}
+
+	bin := t.TempDir()
+	path := os.Getenv("PATH")
+	t.Cleanup(func() { os.Setenv("PATH", path) })
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "dd"), []byte("#!/bin/sh\n"), 0700))
+	os.Setenv("PATH", bin+":"+path)
+
+	return func() []string { return wiped }
+}
+
+func TestDefragmentMove(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	id := volumeID("pvc-1")
+	volume := &ndctlfake.Namespace{
+		Name_:            id,
+		DeviceName_:      "namespace0.1",
+		BlockDeviceName_: "pmem0.1",
+		Size_:            gig,
+		Mode_:            ndctl.FsdaxMode,
+		Location_:        ndctl.DeviceMap,
+		Resource_:        3 * gig,
+		Enabled_:         true,
+	}
+	other := &ndctlfake.Namespace{
+		Name_:            "other",
+		DeviceName_:      "namespace0.0",
+		BlockDeviceName_: "pmem0",
+		Size_:            gig,
+		Resource_:        2 * gig,
+		Enabled_:         true,
+	}
+	region := &ndctlfake.Region{
+		DeviceName_:         "region0",
+		Size_:               8 * gig,
+		AvailableSize_:      6 * gig,
+		MaxAvailableExtent_: 4 * gig,
+		Enabled_:            true,
+		Type_:               ndctl.PmemRegion,
+		Namespaces_:         []ndctl.Namespace{other, volume},
+	}
+	wiped := fakeDefragment(t, region)
+	journal := filepath.Join(t.TempDir(), "journal")
+
+	require.NoError(t, Defragment(ctx, journal, IsVolumeID), "defragment")
+	assert.Equal(t, []string{"/dev/pmem0.1"}, wiped()[:1], "original wiped after copying")
+	assert.NoFileExists(t, journal, "journal")
+	namespaces := region.ActiveNamespaces()
+	require.Len(t, namespaces, 2, "namespaces")
+	assert.Same(t, other, namespaces[0], "other namespace unchanged")
+	moved := namespaces[1]
+	assert.Equal(t, id, moved.Name(), "name of copy")
+	assert.NotSame(t, volume, moved, "volume replaced by copy")
+	assert.Equal(t, volume.RawSize(), moved.RawSize(), "size of copy")
+	assert.Equal(t, ndctl.FsdaxMode, moved.Mode(), "mode of copy")
+	assert.NotEqual(t, volume.UUID(), moved.UUID(), "UUID of copy")
+}
+
+func TestRecoverDefragment(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	id := volumeID("pvc-1")
+	testcases := map[string]struct {
+		journal        string
+		withOriginal   bool
+		expectWiped    bool
+		expectCopy     bool
+		expectOriginal bool
+	}{
+		"copied": {
+			journal:      id + "\n" + journalCopied,
+			withOriginal: true,
+			expectWiped:  true,
+			expectCopy:   true,
+		},
+		"copied and original destroyed": {
+			journal:    id + "\n" + journalCopied,
+			expectCopy: true,
+		},
+		"not copied": {
+			journal:        id,
+			withOriginal:   true,
+			expectOriginal: true,
+		},
+		"no journal": {
+			withOriginal:   true,
+			expectOriginal: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			original := &ndctlfake.Namespace{
+				Name_:            id,
+				DeviceName_:      "namespace0.0",
+				BlockDeviceName_: "pmem0",
+				Size_:            gig,
+				Enabled_:         true,
+			}
+			tmp := &ndctlfake.Namespace{
+				Name_:            defragmentName,
+				DeviceName_:      "namespace0.1",
+				BlockDeviceName_: "pmem0.1",
+				Size_:            gig,
+				Enabled_:         true,
+			}
+			// Not fragmented, only the recovery does something.
+			region := &ndctlfake.Region{
+				DeviceName_:         "region0",
+				Size_:               4 * gig,
+				AvailableSize_:      2 * gig,
+				MaxAvailableExtent_: 2 * gig,
+				Enabled_:            true,
+				Type_:               ndctl.PmemRegion,
+				Namespaces_:         []ndctl.Namespace{tmp},
+			}
+			if tc.withOriginal {
+				region.Namespaces_ = append(region.Namespaces_, original)
+			}
+			wiped := fakeDefragment(t, region)
+			journal := filepath.Join(t.TempDir(), "journal")
+			if tc.journal != "" {
+				require.NoError(t, os.WriteFile(journal, []byte(tc.journal), 0600), "write journal")
+			}
+
+			require.NoError(t, Defragment(ctx, journal, IsVolumeID), "defragment")
+			assert.NoFileExists(t, journal, "journal")
+			if tc.expectWiped {
+				assert.Equal(t, []string{"/dev/pmem0"}, wiped(), "original wiped")
+			} else {
+				assert.Empty(t, wiped(), "nothing wiped")
+			}
+			var expected []ndctl.Namespace
+			if tc.expectCopy {
+				expected = append(expected, tmp)
+			}
+			if tc.expectOriginal {
+				expected = append(expected, original)
+			}
+			assert.Equal(t, expected, region.ActiveNamespaces(), "namespaces")
+			if tc.expectCopy {
+				assert.Equal(t, id, tmp.Name(), "copy renamed")
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/types"
+)
+
+// LabelPMEMNode checks whether the node has PMEM and if it has, adds
+// the labels of the node selector to the node such that the node
+// driver gets deployed there. Expressions in the node selector are
+// ignored because the node discovery only runs on nodes which
+// already satisfy those.
+func LabelPMEMNode(ctx context.Context, client kubernetes.Interface, nodeSelector types.NodeSelector, nodeName string) (bool, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LabelPMEMNode")
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return false, fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	numRegions := 0
+	for _, bus := range ndctx.GetBuses() {
+		for _, region := range bus.ActiveRegions() {
+			if region.Readonly() {
+				logger.V(3).Info("Skipping read-only region", "region", region)
+				continue
+			}
+			logger.V(3).Info("Found PMEM", "region", region)
+			numRegions++
+		}
+	}
+	if numRegions == 0 {
+		logger.V(2).Info("No PMEM found", "node", nodeName)
+		return false, nil
+	}
+
+	labels := map[string]string{}
+	for key, value := range nodeSelector.MatchLabels {
+		labels[key] = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("create patch: %v", err)
+	}
+	logger.V(5).Info("Node", "patch", string(patch))
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}, ""); err != nil {
+		return false, fmt.Errorf("failed to patch node: %v", err)
+	}
+	logger.V(2).Info("Labelled node with PMEM", "node", nodeName, "regions", numRegions, "labels", labels)
+	return true, nil
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+	"github.com/intel/pmem-csi/pkg/types"
+)
+
+func TestLabelPMEMNode(t *testing.T) {
+	nodeSelector := types.NodeSelector{
+		MatchLabels: map[string]string{"storage": "pmem"},
+		// Ignored, checked by the node affinity of the node discovery.
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "zone", Operator: metav1.LabelSelectorOpExists},
+		},
+	}
+
+	for name, tc := range map[string]struct {
+		regions     []ndctl.Region
+		expectLabel bool
+	}{
+		"pmem": {
+			regions: []ndctl.Region{
+				&ndctlfake.Region{DeviceName_: "region0", Enabled_: true, Type_: ndctl.PmemRegion},
+			},
+			expectLabel: true,
+		},
+		"read-only": {
+			regions: []ndctl.Region{
+				&ndctlfake.Region{DeviceName_: "region0", Enabled_: true, Type_: ndctl.PmemRegion, Readonly_: true},
+			},
+		},
+		"disabled": {
+			regions: []ndctl.Region{
+				&ndctlfake.Region{DeviceName_: "region0", Type_: ndctl.PmemRegion},
+			},
+		},
+		"no regions": {},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+				Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: tc.regions}},
+			})
+			oldContext := newNdctlContext
+			t.Cleanup(func() { newNdctlContext = oldContext })
+			newNdctlContext = func() (ndctl.Context, error) {
+				return ndctx, nil
+			}
+			client := fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "node",
+					Labels: map[string]string{"other": "label"},
+				},
+			})
+
+			labelled, err := LabelPMEMNode(ctx, client, nodeSelector, "node")
+			require.NoError(t, err, "label node")
+			assert.Equal(t, tc.expectLabel, labelled, "labelled")
+			node, err := client.CoreV1().Nodes().Get(ctx, "node", metav1.GetOptions{})
+			require.NoError(t, err, "get node")
+			expected := map[string]string{"other": "label"}
+			if tc.expectLabel {
+				expected["storage"] = "pmem"
+			} else {
+				for _, action := range client.Actions() {
+					assert.NotEqual(t, "patch", action.GetVerb(), "unexpected patch")
+				}
+			}
+			assert.Equal(t, expected, node.Labels, "node labels")
+		})
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// Goal defines how NVDIMMs without PMEM regions get provisioned with
+// ipmctl. The zero value disables provisioning.
+//
+// It can be used as a flag value, as "<percentage>" or
+// "<percentage>,not-interleaved", for example "50".
+type Goal struct {
+	// AppDirectPercentage is the part of the NVDIMM capacity
+	// which becomes persistent memory, the rest is used in
+	// Memory Mode.
+	AppDirectPercentage uint
+	// NotInterleaved creates one region per NVDIMM instead of
+	// one per socket.
+	NotInterleaved bool
+}
+
+func (g *Goal) Set(value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) > 2 || len(parts) == 2 && parts[1] != "not-interleaved" {
+		return fmt.Errorf("expected <percentage>[,not-interleaved], got %q", value)
+	}
+	p, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || p < 1 || p > 100 {
+		return fmt.Errorf("App Direct percentage must be 1..100, got %q", parts[0])
+	}
+	*g = Goal{AppDirectPercentage: uint(p), NotInterleaved: len(parts) == 2}
+	return nil
+}
+
+func (g *Goal) String() string {
+	if g.AppDirectPercentage == 0 {
+		return ""
+	}
+	value := strconv.FormatUint(uint64(g.AppDirectPercentage), 10)
+	if g.NotInterleaved {
+		value += ",not-interleaved"
+	}
+	return value
+}
+
+// ipmctlArgs returns the parameters for "ipmctl create -goal".
+func (g Goal) ipmctlArgs() []string {
+	memoryType := "AppDirect"
+	if g.NotInterleaved {
+		memoryType = "AppDirectNotInterleaved"
+	}
+	return []string{
+		fmt.Sprintf("MemoryMode=%d", 100-g.AppDirectPercentage),
+		"PersistentMemoryType=" + memoryType,
+	}
+}
+
+// applyGoal creates the goal with ipmctl if the node has no PMEM
+// regions on NVDIMMs yet. Nodes which already have regions are left
+// alone because a new goal would destroy their data. The result
+// gets recorded in a node annotation.
+//
+// A goal only takes effect after the next reboot, which the node
+// setup does not trigger. It returns false while the goal is
+// pending, in which case the node must not be set up further.
+func applyGoal(ctx context.Context, client kubernetes.Interface, driverName, nodeName string, ndctx ndctl.Context, goal Goal, dryRun bool) (ready bool, finalErr error) {
+	ctx, logger := pmemlog.WithName(ctx, "applyGoal")
+	result := ""
+	defer func() {
+		if finalErr != nil {
+			result = "failed: " + finalErr.Error()
+		}
+		if err := annotateNode(ctx, client, driverName, nodeName, api.PMEMGoalAnnotation, result); err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+
+	if regions := nvdimmRegions(ndctx); len(regions) > 0 {
+		logger.V(3).Info("NVDIMMs already provisioned", "regions", regions)
+		result = "not needed: found " + strings.Join(regions, ", ")
+		return true, nil
+	}
+
+	// After a reboot, the goal is gone and the regions exist.
+	// Without regions, a goal that still exists is pending.
+	output, err := exec.RunCommand(ctx, "ipmctl", "show", "-goal")
+	if err != nil {
+		return false, fmt.Errorf("check for pending goal: %v", err)
+	}
+	if !strings.Contains(strings.ToLower(output), "no goal") {
+		logger.Info("PMEM goal is pending, node must be rebooted")
+		result = "pending, reboot required"
+		return false, nil
+	}
+
+	args := goal.ipmctlArgs()
+	if dryRun {
+		result = "dry run: would create goal " + strings.Join(args, " ")
+		return false, nil
+	}
+	if _, err := exec.RunCommand(ctx, "ipmctl", append([]string{"create", "-f", "-goal"}, args...)...); err != nil {
+		return false, fmt.Errorf("create goal: %v", err)
+	}
+	logger.Info("Created PMEM goal, node must be rebooted", "goal", args)
+	result = "created goal " + strings.Join(args, " ") + ", reboot required"
+	return false, nil
+}
+
+// nvdimmRegions returns the names of all PMEM regions on NVDIMM buses.
+func nvdimmRegions(ndctx ndctl.Context) []string {
+	var regions []string
+	for _, bus := range ndctx.GetBuses() {
+		if ndctl.GetBusType(bus) != ndctl.BusTypeNVDIMM {
+			continue
+		}
+		for _, region := range bus.AllRegions() {
+			if region.Type() == ndctl.PmemRegion {
+				regions = append(regions, region.DeviceName())
+			}
+		}
+	}
+	return regions
+}
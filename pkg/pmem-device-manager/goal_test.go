@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestGoalSet(t *testing.T) {
+	var goal Goal
+	require.NoError(t, goal.Set("50"), "percentage")
+	assert.Equal(t, Goal{AppDirectPercentage: 50}, goal, "percentage")
+	assert.Equal(t, "50", goal.String(), "percentage")
+	assert.Equal(t, []string{"MemoryMode=50", "PersistentMemoryType=AppDirect"}, goal.ipmctlArgs(), "percentage")
+
+	require.NoError(t, goal.Set("100,not-interleaved"), "not interleaved")
+	assert.Equal(t, Goal{AppDirectPercentage: 100, NotInterleaved: true}, goal, "not interleaved")
+	assert.Equal(t, "100,not-interleaved", goal.String(), "not interleaved")
+	assert.Equal(t, []string{"MemoryMode=0", "PersistentMemoryType=AppDirectNotInterleaved"}, goal.ipmctlArgs(), "not interleaved")
+
+	for _, value := range []string{"", "0", "101", "50,interleaved", "50,not-interleaved,foo"} {
+		assert.Error(t, goal.Set(value), value)
+	}
+}
+
+func TestApplyGoal(t *testing.T) {
+	noGoal := `#!/bin/sh
+case "$*" in
+    "show -goal")
+        echo "There are no goal configs defined in the system."
+        ;;
+    "create -f -goal MemoryMode=50 PersistentMemoryType=AppDirect")
+        echo "Created following region configuration goal"
+        ;;
+    *)
+        echo >&2 "unexpected invocation: $*"
+        exit 1
+        ;;
+esac
+`
+	pendingGoal := `#!/bin/sh
+case "$*" in
+    "show -goal")
+        echo " SocketID | DimmID | MemorySize | AppDirect1Size"
+        echo " 0x0000   | 0x0001 | 64.000 GiB | 60.000 GiB"
+        ;;
+    *)
+        echo >&2 "unexpected invocation: $*"
+        exit 1
+        ;;
+esac
+`
+	failure := `#!/bin/sh
+echo "$@: fake error"
+exit 1
+`
+	withRegion := &ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus0",
+				Provider_:   "ACPI.NFIT",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region0", Type_: ndctl.PmemRegion, Enabled_: true},
+				},
+			},
+		},
+	}
+	withoutRegion := &ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus0",
+				Provider_:   "ACPI.NFIT",
+			},
+		},
+	}
+
+	testcases := map[string]struct {
+		ipmctl         string
+		ctx            *ndctlfake.Context
+		dryRun         bool
+		expectReady    bool
+		expectError    bool
+		expectedResult string
+	}{
+		"provisioned": {
+			ctx:            withRegion,
+			expectReady:    true,
+			expectedResult: "not needed: found region0",
+		},
+		"create": {
+			ipmctl:         noGoal,
+			ctx:            withoutRegion,
+			expectedResult: "created goal MemoryMode=50 PersistentMemoryType=AppDirect, reboot required",
+		},
+		"dry-run": {
+			ipmctl:         noGoal,
+			ctx:            withoutRegion,
+			dryRun:         true,
+			expectedResult: "dry run: would create goal MemoryMode=50 PersistentMemoryType=AppDirect",
+		},
+		"pending": {
+			ipmctl:         pendingGoal,
+			ctx:            withoutRegion,
+			expectedResult: "pending, reboot required",
+		},
+		"failure": {
+			ipmctl:      failure,
+			ctx:         withoutRegion,
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			path := os.Getenv("PATH")
+			defer os.Setenv("PATH", path)
+			tmp := t.TempDir()
+			if tc.ipmctl != "" {
+				require.NoError(t, os.WriteFile(filepath.Join(tmp, "ipmctl"), []byte(tc.ipmctl), 0700))
+			}
+			os.Setenv("PATH", tmp+":"+path)
+
+			client := fake.NewSimpleClientset(makeNode("worker", nil))
+			ready, err := applyGoal(ctx, client, "pmem-csi", "worker", ndctlfake.NewContext(tc.ctx), Goal{AppDirectPercentage: 50}, tc.dryRun)
+			node, getErr := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+			require.NoError(t, getErr, "get node")
+			result := node.Annotations["pmem-csi/pmem-goal"]
+			if tc.expectError {
+				assert.Error(t, err, "apply goal")
+				assert.Contains(t, result, "failed: ", "annotation")
+				return
+			}
+			require.NoError(t, err, "apply goal")
+			assert.Equal(t, tc.expectReady, ready, "ready")
+			assert.Equal(t, tc.expectedResult, result, "annotation")
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// sysfsPath must be writable for creating and deleting namespaces.
+// It can be changed for testing.
+var sysfsPath = "/sys"
+
+// checkNdctl verifies that namespaces can be managed. It does not
+// take ndctlMutex because only reading is involved.
+func checkNdctl() error {
+	if err := unix.Access(sysfsPath, unix.W_OK); err != nil {
+		return fmt.Errorf("%s not writable: %v", sysfsPath, err)
+	}
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+	ndctx.Free()
+	return nil
+}
+
+func (pmem *pmemNdctl) Healthz(ctx context.Context) error {
+	return checkNdctl()
+}
+
+// Healthz checks that all volume groups are still accessible.
+func (lvm *pmemLvm) Healthz(ctx context.Context) error {
+	if err := checkNdctl(); err != nil {
+		return err
+	}
+	lvm.vgMutex.RLock()
+	volumeGroups := lvm.volumeGroups
+	lvm.vgMutex.RUnlock()
+	return checkVolumeGroups(ctx, volumeGroups)
+}
+
+// checkVolumeGroups runs vgs for the volume groups. vgs only reads
+// LVM metadata, so running it in parallel to other LVM commands is
+// okay.
+func checkVolumeGroups(ctx context.Context, volumeGroups []string) error {
+	if len(volumeGroups) == 0 {
+		return nil
+	}
+	args := append([]string{"--noheadings", "-o", "vg_name"}, volumeGroups...)
+	output, err := pmemexec.RunCommand(ctx, "vgs", args...)
+	if err != nil {
+		return fmt.Errorf("volume groups %s: %v", strings.Join(volumeGroups, ", "), err)
+	}
+	found := strings.Fields(output)
+	for _, vgName := range volumeGroups {
+		if !containsString(found, vgName) {
+			return fmt.Errorf("volume group %s not found", vgName)
+		}
+	}
+	return nil
+}
+
+// Healthz checks that the external device manager still responds.
+func (pmem *pmemExternal) Healthz(ctx context.Context) error {
+	_, err := pmem.GetCapacity(ctx)
+	return err
+}
+
+func (dm *fakeDM) Healthz(ctx context.Context) error {
+	return nil
+}
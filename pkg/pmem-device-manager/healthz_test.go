@@ -0,0 +1,48 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestCheckNdctl(t *testing.T) {
+	oldPath := sysfsPath
+	defer func() {
+		sysfsPath = oldPath
+	}()
+	sysfsPath = filepath.Join(t.TempDir(), "no-such-dir")
+	assert.Error(t, checkNdctl(), "missing sysfs")
+}
+
+func TestCheckVolumeGroups(t *testing.T) {
+	vgs := `#!/bin/sh
+for vg in "$@"; do
+    case "$vg" in
+        -*|vg_name) ;;
+        missing) echo >&2 "Volume group \"$vg\" not found"; exit 5;;
+        *) echo "  $vg";;
+    esac
+done
+`
+	_, ctx := ktesting.NewTestContext(t)
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	tmp := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, "vgs"), []byte(vgs), 0700))
+	os.Setenv("PATH", tmp+":"+path)
+
+	assert.NoError(t, checkVolumeGroups(ctx, nil), "no volume groups")
+	assert.NoError(t, checkVolumeGroups(ctx, []string{"bus0region0fsdax", "bus0region1fsdax"}), "all found")
+	assert.Error(t, checkVolumeGroups(ctx, []string{"bus0region0fsdax", "missing"}), "one missing")
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// Rescanner is implemented by device managers which need to set up
+// PMEM that appears while the driver is running, for example after
+// hotplugging or applying a new goal.
+type Rescanner interface {
+	// Rescan checks all regions again. It returns true if the
+	// set of PMEM used for volumes changed.
+	Rescan(ctx context.Context) (bool, error)
+}
+
+// ndDevicesDir is where the kernel lists all regions and namespaces.
+var ndDevicesDir = "/sys/bus/nd/devices"
+
+// repeatedLogWindow is the window for pmemlog.Deduplicate in loops
+// which check the hardware periodically.
+const repeatedLogWindow = 10 * time.Minute
+
+// WatchRegions polls sysfs for added or removed regions and
+// namespaces and calls Rescan when there are changes. Sysfs does not
+// support inotify, therefore polling is used. It returns immediately
+// if the device manager does not need rescanning or the interval is
+// zero and otherwise runs until the context is canceled.
+func WatchRegions(ctx context.Context, dm PmemDeviceManager, interval time.Duration) {
+	rescanner, ok := dm.(Rescanner)
+	if !ok || interval <= 0 {
+		return
+	}
+	ctx, logger := pmemlog.WithName(ctx, "WatchRegions")
+	// The same failure gets reported once per window instead of
+	// once per interval. Only the loop itself uses this logger.
+	logger = pmemlog.Deduplicate(logger, repeatedLogWindow)
+
+	last, err := ndDevices()
+	if err != nil {
+		logger.Error(err, "Cannot watch for new PMEM")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := ndDevices()
+		if err != nil {
+			logger.Error(err, "Checking for new PMEM failed")
+			continue
+		}
+		if current == last {
+			continue
+		}
+		logger.V(3).Info("PMEM devices changed", "old", last, "new", current)
+		changed, err := rescanner.Rescan(ctx)
+		if err != nil {
+			// Try again next time.
+			logger.Error(err, "Setting up new PMEM failed")
+			continue
+		}
+		logger.V(2).Info("Rescanned PMEM", "changed", changed)
+		// Rescanning may have created namespaces, so check
+		// again instead of using the previous result.
+		last, err = ndDevices()
+		if err != nil {
+			logger.Error(err, "Checking for new PMEM failed")
+			last = current
+		}
+	}
+}
+
+// ndDevices returns the names of all regions and namespaces, sorted
+// by os.ReadDir and joined into a single string.
+func ndDevices() (string, error) {
+	entries, err := os.ReadDir(ndDevicesDir)
+	if err != nil {
+		return "", fmt.Errorf("list nd devices: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "region") || strings.HasPrefix(name, "namespace") {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ","), nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type fakeRescanner struct {
+	PmemDeviceManager
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (r *fakeRescanner) Rescan(ctx context.Context) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls++
+	return true, nil
+}
+
+func (r *fakeRescanner) numCalls() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.calls
+}
+
+func TestWatchRegions(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dir := t.TempDir()
+	oldDir := ndDevicesDir
+	ndDevicesDir = dir
+	defer func() {
+		ndDevicesDir = oldDir
+	}()
+	add := func(name string) {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755), "create %s", name)
+	}
+	add("region0")
+	add("namespace0.0")
+	add("ndbus0")
+
+	dm := &fakeRescanner{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		WatchRegions(ctx, dm, 10*time.Millisecond)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, dm.numCalls(), "rescans without changes")
+
+	add("ndbus1")
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 0, dm.numCalls(), "rescans after adding a bus")
+
+	add("region1")
+	require.Eventually(t, func() bool { return dm.numCalls() == 1 }, time.Second, 10*time.Millisecond, "rescan after adding a region")
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, dm.numCalls(), "rescans after handling the new region")
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,217 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// kmemNamespaceName is the name of the devdax namespace in each
+// region which PMEM-CSI onlines as system RAM with the kmem driver.
+// The memory then becomes available to all applications on the node
+// through a CPU-less NUMA node, for example for memory tiering.
+const kmemNamespaceName = "pmem-csi-kmem"
+
+// systemRAMMode is the daxctl mode for memory that is onlined as
+// system RAM.
+const systemRAMMode = "system-ram"
+
+// setupSystemRAM creates a devdax namespace with the given
+// percentage of each PMEM region unless the region already has one,
+// then onlines all of those namespaces as system RAM. Regions without
+// enough contiguous free space are skipped with a warning. The size
+// of existing namespaces does not get changed because memory that is
+// in use cannot be removed again.
+func setupSystemRAM(ctx context.Context, percentage uint) error {
+	ctx, logger := pmemlog.WithName(ctx, "setupSystemRAM")
+	if percentage > 100 {
+		return fmt.Errorf("invalid system RAM percentage %d", percentage)
+	}
+
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Type() != ndctl.PmemRegion {
+				continue
+			}
+			ns := kmemNamespace(r)
+			if ns == nil {
+				size := r.Size() * uint64(percentage) / 100
+				if size == 0 {
+					continue
+				}
+				if size > r.MaxAvailableExtent() {
+					logger.Info("Warning: not enough free space for system RAM",
+						"region", r.DeviceName(),
+						"size", pmemlog.CapacityRef(int64(size)),
+						"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())),
+					)
+					continue
+				}
+				ns, err = r.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
+					Name: kmemNamespaceName,
+					Mode: ndctl.DaxMode,
+					Size: size,
+				})
+				if err != nil {
+					return fmt.Errorf("region %s: create namespace for system RAM: %v", r.DeviceName(), err)
+				}
+				logger.Info("Created namespace for system RAM", "region", r.DeviceName(), "namespace", ns.DeviceName(), "size", pmemlog.CapacityRef(int64(ns.Size())))
+			}
+			if err := onlineSystemRAM(ctx, ns.DeviceName()); err != nil {
+				return fmt.Errorf("region %s: online %s as system RAM: %v", r.DeviceName(), ns.DeviceName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// kmemNamespace returns the namespace for system RAM in the region,
+// nil if there is none.
+func kmemNamespace(r ndctl.Region) ndctl.Namespace {
+	for _, ns := range r.ActiveNamespaces() {
+		if ns.Name() == kmemNamespaceName && ns.Mode() == ndctl.DaxMode {
+			return ns
+		}
+	}
+	return nil
+}
+
+// systemRAMSize returns how much PMEM of the region is used as system
+// RAM by PMEM-CSI.
+func systemRAMSize(r ndctl.Region) uint64 {
+	if ns := kmemNamespace(r); ns != nil {
+		return ns.RawSize()
+	}
+	return 0
+}
+
+// onlineSystemRAM switches the device DAX instance of the namespace
+// to system RAM. This must be repeated after each reboot, the kernel
+// does not remember it.
+func onlineSystemRAM(ctx context.Context, namespace string) error {
+	ctx, logger := pmemlog.WithName(ctx, "onlineSystemRAM")
+	output, err := pmemexec.RunCommand(ctx, "ndctl", "list", "--namespace="+namespace)
+	if err != nil {
+		return err
+	}
+	chardev, err := parseChardev(output)
+	if err != nil {
+		return err
+	}
+	output, err = pmemexec.RunCommand(ctx, "daxctl", "list", "--dev="+chardev)
+	if err != nil {
+		return err
+	}
+	mode, err := parseDaxMode(output)
+	if err != nil {
+		return err
+	}
+	if mode == systemRAMMode {
+		logger.V(3).Info("Already onlined as system RAM", "device", chardev)
+		return nil
+	}
+	if _, err := pmemexec.RunCommand(ctx, "daxctl", "reconfigure-device", "--mode="+systemRAMMode, chardev); err != nil {
+		return err
+	}
+	logger.Info("Onlined as system RAM", "device", chardev)
+	return nil
+}
+
+// offlineSystemRAM switches the device DAX instance of the namespace
+// back to devdax mode. The memory gets offlined first, which fails
+// while the kernel cannot migrate the data stored in it.
+func offlineSystemRAM(ctx context.Context, namespace string) error {
+	ctx, logger := pmemlog.WithName(ctx, "offlineSystemRAM")
+	output, err := pmemexec.RunCommand(ctx, "ndctl", "list", "--namespace="+namespace)
+	if err != nil {
+		return err
+	}
+	chardev, err := parseChardev(output)
+	if err != nil {
+		return err
+	}
+	output, err = pmemexec.RunCommand(ctx, "daxctl", "list", "--dev="+chardev)
+	if err != nil {
+		return err
+	}
+	mode, err := parseDaxMode(output)
+	if err != nil {
+		return err
+	}
+	if mode != systemRAMMode {
+		logger.V(3).Info("Not onlined as system RAM", "device", chardev)
+		return nil
+	}
+	if _, err := pmemexec.RunCommand(ctx, "daxctl", "reconfigure-device", "--mode=devdax", "--force", chardev); err != nil {
+		return err
+	}
+	logger.Info("Offlined system RAM", "device", chardev)
+	return nil
+}
+
+// daxDevice contains the fields of "ndctl list" and "daxctl list"
+// output that are needed here.
+type daxDevice struct {
+	Chardev string `json:"chardev"`
+	Mode    string `json:"mode"`
+}
+
+// parseDaxDevice parses ndctl or daxctl list output for a single
+// device. The tools print an object instead of an array when there is
+// only one.
+func parseDaxDevice(output string) (daxDevice, error) {
+	output = strings.TrimSpace(output)
+	var devices []daxDevice
+	if strings.HasPrefix(output, "{") {
+		output = "[" + output + "]"
+	}
+	if err := json.Unmarshal([]byte(output), &devices); err != nil {
+		return daxDevice{}, fmt.Errorf("parse %q: %v", output, err)
+	}
+	if len(devices) != 1 {
+		return daxDevice{}, fmt.Errorf("expected one device, got %q", output)
+	}
+	return devices[0], nil
+}
+
+// parseChardev returns the device DAX instance of a devdax namespace.
+func parseChardev(output string) (string, error) {
+	dev, err := parseDaxDevice(output)
+	if err != nil {
+		return "", err
+	}
+	if dev.Chardev == "" {
+		return "", fmt.Errorf("no chardev in %q", output)
+	}
+	return dev.Chardev, nil
+}
+
+// parseDaxMode returns the mode of a device DAX instance, either
+// "devdax" or "system-ram".
+func parseDaxMode(output string) (string, error) {
+	dev, err := parseDaxDevice(output)
+	if err != nil {
+		return "", err
+	}
+	return dev.Mode, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestParseDaxDevice(t *testing.T) {
+	chardev, err := parseChardev(`{
+  "dev":"namespace0.1",
+  "mode":"devdax",
+  "map":"dev",
+  "size":4225761280,
+  "uuid":"2ed5f4a5-9b8a-4b57-8a3b-1b0d6c1b2d0e",
+  "chardev":"dax0.1",
+  "align":2097152,
+  "name":"pmem-csi-kmem"
+}`)
+	require.NoError(t, err, "ndctl list")
+	assert.Equal(t, "dax0.1", chardev, "chardev")
+
+	mode, err := parseDaxMode(`[
+  {
+    "chardev":"dax0.1",
+    "size":4225761280,
+    "target_node":2,
+    "align":2097152,
+    "mode":"system-ram",
+    "online_memblocks":31,
+    "total_memblocks":31,
+    "movable":true
+  }
+]`)
+	require.NoError(t, err, "daxctl list")
+	assert.Equal(t, systemRAMMode, mode, "mode")
+
+	_, err = parseChardev(`{"dev":"namespace0.0","mode":"fsdax","blockdev":"pmem0"}`)
+	assert.Error(t, err, "fsdax namespace")
+
+	_, err = parseDaxMode(`[]`)
+	assert.Error(t, err, "no device")
+}
+
+func TestSystemRAMSize(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	r := &ndctlfake.Region{
+		DeviceName_: "region0",
+		Size_:       16 * gig,
+		Enabled_:    true,
+		Type_:       ndctl.PmemRegion,
+		Namespaces_: []ndctl.Namespace{
+			&ndctlfake.Namespace{Name_: pmemCSINamespaceName, Size_: 8 * gig, Mode_: ndctl.FsdaxMode, Enabled_: true},
+		},
+	}
+	assert.Equal(t, uint64(0), systemRAMSize(r), "without kmem namespace")
+
+	r.Namespaces_ = append(r.Namespaces_, &ndctlfake.Namespace{Name_: kmemNamespaceName, Size_: 4 * gig, Overhead_: 64 * 1024 * 1024, Mode_: ndctl.DaxMode, Enabled_: true})
+	assert.Equal(t, 4*gig+64*1024*1024, systemRAMSize(r), "with kmem namespace")
+}
@@ -8,12 +8,25 @@ package pmdmanager
 
 import (
 	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/ndctl"
 )
 
+// detailLabels identify the region or volume group of a
+// CapacityDetail.
+var detailLabels = []string{"region", "volume_group"}
+
 var (
 	pmemMaxDesc = prometheus.NewDesc(
 		"pmem_amount_max_volume_size",
@@ -25,6 +38,11 @@ var (
 		"Remaining amount of PMEM on the host that can be used for new volumes.",
 		nil, nil,
 	)
+	pmemPhysicalAvailableDesc = prometheus.NewDesc(
+		"pmem_amount_physically_available",
+		"Remaining amount of PMEM on the host that is not used yet, smaller than pmem_amount_available when thin volumes are overcommitted.",
+		nil, nil,
+	)
 	pmemManagedDesc = prometheus.NewDesc(
 		"pmem_amount_managed",
 		"Amount of PMEM on the host that is managed by PMEM-CSI.",
@@ -35,8 +53,75 @@ var (
 		"Total amount of PMEM on the host.",
 		nil, nil,
 	)
+	pmemSystemRAMDesc = prometheus.NewDesc(
+		"pmem_amount_system_ram",
+		"Amount of PMEM on the host that PMEM-CSI onlined as system RAM.",
+		nil, nil,
+	)
+	pmemDetailMaxDesc = prometheus.NewDesc(
+		"pmem_amount_max_volume_size_by_device",
+		"The size of the largest PMEM volume that can be created in a region or volume group.",
+		detailLabels, nil,
+	)
+	pmemDetailAvailableDesc = prometheus.NewDesc(
+		"pmem_amount_available_by_device",
+		"Remaining amount of PMEM in a region or volume group that can be used for new volumes.",
+		detailLabels, nil,
+	)
+	pmemDetailTotalDesc = prometheus.NewDesc(
+		"pmem_amount_total_by_device",
+		"Total amount of PMEM in a region or volume group.",
+		detailLabels, nil,
+	)
+	pmemRegionInfoDesc = prometheus.NewDesc(
+		"pmem_region_info",
+		"Always 1, the labels describe the NUMA node and interleave set of a region.",
+		[]string{"region", "numa_node", "interleave_ways"}, nil,
+	)
+	pmemBadBlocksDesc = prometheus.NewDesc(
+		"pmem_badblocks",
+		"Number of 512 byte blocks with known media errors in a PMEM region.",
+		[]string{"region"}, nil,
+	)
+	dimmHealthStateDesc = prometheus.NewDesc(
+		"pmem_dimm_health_state",
+		"SMART health of a DIMM: 0 = ok, 1 = non-critical, 2 = critical, 3 = fatal.",
+		dimmLabels, nil,
+	)
+	dimmMediaTemperatureDesc = prometheus.NewDesc(
+		"pmem_dimm_media_temperature_celsius",
+		"Media temperature of a DIMM.",
+		dimmLabels, nil,
+	)
+	dimmControllerTemperatureDesc = prometheus.NewDesc(
+		"pmem_dimm_controller_temperature_celsius",
+		"Controller temperature of a DIMM.",
+		dimmLabels, nil,
+	)
+	dimmSparesDesc = prometheus.NewDesc(
+		"pmem_dimm_spares_percentage",
+		"Remaining spare capacity of a DIMM in percent.",
+		dimmLabels, nil,
+	)
+	dimmShutdownCountDesc = prometheus.NewDesc(
+		"pmem_dimm_shutdown_count",
+		"Number of unsafe (dirty) shutdowns of a DIMM.",
+		dimmLabels, nil,
+	)
 )
 
+// dimmLabels identify a DIMM by bus, device name and unique ID.
+var dimmLabels = []string{"bus", "dimm", "id"}
+
+// healthStateValues maps the health state to the value of
+// pmem_dimm_health_state.
+var healthStateValues = map[ndctl.HealthState]float64{
+	ndctl.HealthOK:          0,
+	ndctl.HealthNonCritical: 1,
+	ndctl.HealthCritical:    2,
+	ndctl.HealthFatal:       3,
+}
+
 // NodeLabel is a label used for Prometheus which identifies the
 // node that the controller talks to.
 const NodeLabel = "node"
@@ -65,7 +150,7 @@ func (cc CapacityCollector) Describe(ch chan<- *prometheus.Desc) {
 func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 	ctx := context.TODO() // would be nicer to get it from caller
 	logger := klog.FromContext(ctx).WithName("Prometheus Collect")
-	klog.NewContext(ctx, logger)
+	ctx = klog.NewContext(ctx, logger)
 
 	capacity, err := cc.GetCapacity(ctx)
 	if err != nil {
@@ -81,6 +166,11 @@ func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(capacity.Available),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		pmemPhysicalAvailableDesc,
+		prometheus.GaugeValue,
+		float64(capacity.PhysicalAvailable),
+	)
 	ch <- prometheus.MustNewConstMetric(
 		pmemManagedDesc,
 		prometheus.GaugeValue,
@@ -91,6 +181,308 @@ func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(capacity.Total),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		pmemSystemRAMDesc,
+		prometheus.GaugeValue,
+		float64(capacity.SystemRAM),
+	)
+	for _, detail := range capacity.Details {
+		for _, metric := range []struct {
+			desc  *prometheus.Desc
+			value uint64
+		}{
+			{pmemDetailMaxDesc, detail.MaxVolumeSize},
+			{pmemDetailAvailableDesc, detail.Available},
+			{pmemDetailTotalDesc, detail.Total},
+		} {
+			ch <- prometheus.MustNewConstMetric(
+				metric.desc,
+				prometheus.GaugeValue,
+				float64(metric.value),
+				detail.Region, detail.VolumeGroup,
+			)
+		}
+		if detail.Region != "" {
+			ch <- prometheus.MustNewConstMetric(
+				pmemRegionInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				detail.Region, strconv.Itoa(detail.NumaNode), strconv.FormatUint(detail.InterleaveWays, 10),
+			)
+		}
+	}
+
+	if mediaErrors, ok := cc.PmemDeviceCapacity.(MediaErrors); ok {
+		badBlocks, err := mediaErrors.RegionBadBlocks(ctx)
+		if err != nil {
+			// The other metrics are still useful, so
+			// only the bad block counts are missing.
+			logger.Error(err, "Failed to count bad blocks")
+			return
+		}
+		for region, count := range badBlocks {
+			ch <- prometheus.MustNewConstMetric(
+				pmemBadBlocksDesc,
+				prometheus.GaugeValue,
+				float64(count),
+				region,
+			)
+		}
+	}
 }
 
 var _ prometheus.Collector = CapacityCollector{}
+
+// DimmHealthCollector reads the SMART health information of all
+// DIMMs each time that metrics data gets gathered. It works
+// independently of the device mode.
+type DimmHealthCollector struct{}
+
+// MustRegister adds the collector to the registry, using labels to tag each sample with node and driver name.
+func (dc DimmHealthCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(dc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (dc DimmHealthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- dimmHealthStateDesc
+	ch <- dimmMediaTemperatureDesc
+	ch <- dimmControllerTemperatureDesc
+	ch <- dimmSparesDesc
+	ch <- dimmShutdownCountDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (dc DimmHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	logger := klog.Background().WithName("Prometheus Collect")
+
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		logger.Error(err, "Failed to initialize ndctl context")
+		return
+	}
+	defer ndctx.Free()
+	collectDimmHealth(ndctx, ch, logger)
+}
+
+func collectDimmHealth(ndctx ndctl.Context, ch chan<- prometheus.Metric, logger klog.Logger) {
+	for _, bus := range ndctx.GetBuses() {
+		for _, dimm := range bus.Dimms() {
+			labels := []string{bus.DeviceName(), dimm.DeviceName(), dimm.ID()}
+			health, err := dimm.Health()
+			if err != nil {
+				// Emulated PMEM has no SMART data.
+				logger.V(5).Info("No DIMM health", "dimm", dimm.DeviceName(), "err", err)
+				continue
+			}
+			if value, ok := healthStateValues[health.State]; ok {
+				ch <- prometheus.MustNewConstMetric(dimmHealthStateDesc, prometheus.GaugeValue, value, labels...)
+			}
+			if health.MediaTemperature != nil {
+				ch <- prometheus.MustNewConstMetric(dimmMediaTemperatureDesc, prometheus.GaugeValue, *health.MediaTemperature, labels...)
+			}
+			if health.ControllerTemperature != nil {
+				ch <- prometheus.MustNewConstMetric(dimmControllerTemperatureDesc, prometheus.GaugeValue, *health.ControllerTemperature, labels...)
+			}
+			if health.SparesPercentage != nil {
+				ch <- prometheus.MustNewConstMetric(dimmSparesDesc, prometheus.GaugeValue, float64(*health.SparesPercentage), labels...)
+			}
+			if health.ShutdownCount != nil {
+				ch <- prometheus.MustNewConstMetric(dimmShutdownCountDesc, prometheus.GaugeValue, float64(*health.ShutdownCount), labels...)
+			}
+		}
+	}
+}
+
+var _ prometheus.Collector = DimmHealthCollector{}
+
+// capacityLabels identify the region (or volume group, if it spans
+// several regions) and the device mode of the capacity gauges.
+var capacityLabels = []string{"region", "device_mode"}
+
+var (
+	capacityTotal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_csi_capacity_total",
+			Help: "Total amount of PMEM in a region that is managed by PMEM-CSI, as seen by the last capacity query.",
+		},
+		capacityLabels,
+	)
+	capacityAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_csi_capacity_available",
+			Help: "Remaining amount of PMEM in a region that can be used for new volumes, as seen by the last capacity query.",
+		},
+		capacityLabels,
+	)
+	capacityMaxVolumeSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_csi_capacity_max_volume_size",
+			Help: "The size of the largest PMEM volume that can be created in a region, as seen by the last capacity query.",
+		},
+		capacityLabels,
+	)
+
+	// capacityGaugeMutex protects capacityGaugeLabels, the
+	// labels that were set by the last capacity query.
+	capacityGaugeMutex  sync.Mutex
+	capacityGaugeLabels = map[[2]string]bool{}
+)
+
+// MustRegisterDeviceMetrics adds the capacity gauges, which get
+// updated by each GetCapacity call of the LVM and direct device
+// managers, the error counters of their device operations and the
+// operation durations to the registry, using labels to tag each
+// sample with node and driver name. In contrast to the
+// CapacityCollector, these metrics don't cause additional capacity
+// queries when metrics data gets gathered.
+func MustRegisterDeviceMetrics(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(capacityTotal, capacityAvailable, capacityMaxVolumeSize, deviceErrors, operationDuration)
+}
+
+// recordCapacity updates the capacity gauges and removes those of
+// regions which are no longer present.
+func recordCapacity(mode api.DeviceMode, capacity Capacity) {
+	capacityGaugeMutex.Lock()
+	defer capacityGaugeMutex.Unlock()
+
+	current := map[[2]string]bool{}
+	for _, detail := range capacity.Details {
+		region := detail.Region
+		if region == "" {
+			region = detail.VolumeGroup
+		}
+		labels := [2]string{region, string(mode)}
+		current[labels] = true
+		capacityTotal.WithLabelValues(labels[:]...).Set(float64(detail.Total))
+		capacityAvailable.WithLabelValues(labels[:]...).Set(float64(detail.Available))
+		capacityMaxVolumeSize.WithLabelValues(labels[:]...).Set(float64(detail.MaxVolumeSize))
+	}
+	for labels := range capacityGaugeLabels {
+		if !current[labels] {
+			capacityTotal.DeleteLabelValues(labels[:]...)
+			capacityAvailable.DeleteLabelValues(labels[:]...)
+			capacityMaxVolumeSize.DeleteLabelValues(labels[:]...)
+		}
+	}
+	capacityGaugeLabels = current
+}
+
+// Device operations as used for the "operation" label of
+// pmem_csi_device_operation_errors_total. Failures while flushing
+// (= wiping) a device during DeleteDevice are counted as
+// FlushDevice.
+const (
+	opCreateDevice = "CreateDevice"
+	opDeleteDevice = "DeleteDevice"
+	opFlushDevice  = "FlushDevice"
+)
+
+// Error classes as used for the "class" label.
+const (
+	errorClassNotEnoughSpace = "not-enough-space"
+	errorClassDeviceBusy     = "device-busy"
+	errorClassExecFailure    = "exec-failure"
+	errorClassNdctl          = "ndctl-error"
+	errorClassOther          = "other"
+)
+
+// deviceErrors counts failed device operations.
+var deviceErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pmem_csi_device_operation_errors_total",
+		Help: "Number of failed device operations, labeled by operation and error class.",
+	},
+	[]string{"operation", "class"},
+)
+
+// countDeviceError increments the error counter if there is an error.
+func countDeviceError(operation string, err error) {
+	if err == nil {
+		return
+	}
+	deviceErrors.WithLabelValues(operation, classifyDeviceError(err)).Inc()
+}
+
+// classifyDeviceError determines the error class. Running out of
+// space and busy devices take precedence over how the problem was
+// detected.
+func classifyDeviceError(err error) string {
+	var ndErr ndctlError
+	switch {
+	case errors.Is(err, pmemerr.NotEnoughSpace):
+		return errorClassNotEnoughSpace
+	case errors.Is(err, pmemerr.DeviceInUse):
+		return errorClassDeviceBusy
+	case errors.As(err, &ndErr):
+		return errorClassNdctl
+	case pmemexec.IsCommandFailure(err):
+		return errorClassExecFailure
+	default:
+		return errorClassOther
+	}
+}
+
+// ndctlError marks an error as coming from the ndctl package without
+// changing its message.
+type ndctlError struct {
+	err error
+}
+
+func (e ndctlError) Error() string {
+	return e.err.Error()
+}
+
+func (e ndctlError) Unwrap() error {
+	return e.err
+}
+
+// wrapNdctlError returns nil for nil and an ndctlError otherwise.
+func wrapNdctlError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return ndctlError{err: err}
+}
+
+// Operations as used for the "operation" label of
+// pmem_csi_operation_duration_seconds.
+const (
+	OperationMkfs            = "mkfs"
+	OperationMount           = "mount"
+	OperationWipe            = "wipe"
+	OperationCreateNamespace = "create-namespace"
+)
+
+// operationDuration measures individual steps of volume operations
+// on the node. Wiping large volumes takes minutes, therefore the
+// buckets go up to ten minutes like those of the gRPC calls.
+var operationDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "pmem_csi_operation_duration_seconds",
+		Help:    "Duration of mkfs, mount, wipe and namespace creation on the node, labeled by operation and result (ok or error).",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600},
+	},
+	[]string{"operation", "result"},
+)
+
+// ObserveOperation records how long an operation which started at
+// the given time took.
+func ObserveOperation(operation string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	operationDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestCapacityDetails(t *testing.T) {
+	cc := CapacityCollector{
+		PmemDeviceCapacity: Capacity{
+			MaxVolumeSize: 3,
+			Available:     5,
+			Total:         10,
+			Details: []CapacityDetail{
+				{Region: "region0", VolumeGroup: "ndbus0region0fsdax", MaxVolumeSize: 3, Available: 3, Total: 6, NumaNode: 0, InterleaveWays: 2},
+				{Region: "region1", MaxVolumeSize: 1, Available: 2, Total: 4, NumaNode: 1, InterleaveWays: 1},
+				{VolumeGroup: "pmem-csi", MaxVolumeSize: 0, Available: 0, Total: 0, NumaNode: -1},
+			},
+		},
+	}
+	expected := `
+# HELP pmem_amount_available_by_device Remaining amount of PMEM in a region or volume group that can be used for new volumes.
+# TYPE pmem_amount_available_by_device gauge
+pmem_amount_available_by_device{region="region0",volume_group="ndbus0region0fsdax"} 3
+pmem_amount_available_by_device{region="region1",volume_group=""} 2
+pmem_amount_available_by_device{region="",volume_group="pmem-csi"} 0
+# HELP pmem_amount_max_volume_size_by_device The size of the largest PMEM volume that can be created in a region or volume group.
+# TYPE pmem_amount_max_volume_size_by_device gauge
+pmem_amount_max_volume_size_by_device{region="region0",volume_group="ndbus0region0fsdax"} 3
+pmem_amount_max_volume_size_by_device{region="region1",volume_group=""} 1
+pmem_amount_max_volume_size_by_device{region="",volume_group="pmem-csi"} 0
+# HELP pmem_amount_total_by_device Total amount of PMEM in a region or volume group.
+# TYPE pmem_amount_total_by_device gauge
+pmem_amount_total_by_device{region="region0",volume_group="ndbus0region0fsdax"} 6
+pmem_amount_total_by_device{region="region1",volume_group=""} 4
+pmem_amount_total_by_device{region="",volume_group="pmem-csi"} 0
+# HELP pmem_region_info Always 1, the labels describe the NUMA node and interleave set of a region.
+# TYPE pmem_region_info gauge
+pmem_region_info{interleave_ways="2",numa_node="0",region="region0"} 1
+pmem_region_info{interleave_ways="1",numa_node="1",region="region1"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(cc, strings.NewReader(expected),
+		"pmem_amount_available_by_device",
+		"pmem_amount_max_volume_size_by_device",
+		"pmem_amount_total_by_device",
+		"pmem_region_info",
+	))
+}
+
+// fakeDimmCollector collects DIMM health from a fake ndctl context.
+type fakeDimmCollector struct {
+	ndctx ndctl.Context
+}
+
+func (fc fakeDimmCollector) Describe(ch chan<- *prometheus.Desc) {
+	DimmHealthCollector{}.Describe(ch)
+}
+
+func (fc fakeDimmCollector) Collect(ch chan<- prometheus.Metric) {
+	collectDimmHealth(fc.ndctx, ch, klog.Background())
+}
+
+func TestDimmHealth(t *testing.T) {
+	mediaTemperature, controllerTemperature := 32.5, 40.0
+	spares, shutdowns := uint(95), uint64(3)
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "ndbus0",
+				Dimms_: []ndctl.Dimm{
+					&ndctlfake.Dimm{
+						DeviceName_: "nmem0",
+						ID_:         "8089-a2-1837-00000bb3",
+						Health_: &ndctl.DimmHealth{
+							State:                 ndctl.HealthCritical,
+							MediaTemperature:      &mediaTemperature,
+							ControllerTemperature: &controllerTemperature,
+							SparesPercentage:      &spares,
+							ShutdownCount:         &shutdowns,
+						},
+					},
+					&ndctlfake.Dimm{
+						DeviceName_: "nmem1",
+						ID_:         "8089-a2-1837-00000bb4",
+						Health_:     &ndctl.DimmHealth{State: ndctl.HealthOK},
+					},
+					&ndctlfake.Dimm{
+						DeviceName_: "nmem2",
+						HealthErr_:  errors.New("SMART command not supported"),
+					},
+				},
+			},
+		},
+	})
+	expected := `
+# HELP pmem_dimm_controller_temperature_celsius Controller temperature of a DIMM.
+# TYPE pmem_dimm_controller_temperature_celsius gauge
+pmem_dimm_controller_temperature_celsius{bus="ndbus0",dimm="nmem0",id="8089-a2-1837-00000bb3"} 40
+# HELP pmem_dimm_health_state SMART health of a DIMM: 0 = ok, 1 = non-critical, 2 = critical, 3 = fatal.
+# TYPE pmem_dimm_health_state gauge
+pmem_dimm_health_state{bus="ndbus0",dimm="nmem0",id="8089-a2-1837-00000bb3"} 2
+pmem_dimm_health_state{bus="ndbus0",dimm="nmem1",id="8089-a2-1837-00000bb4"} 0
+# HELP pmem_dimm_media_temperature_celsius Media temperature of a DIMM.
+# TYPE pmem_dimm_media_temperature_celsius gauge
+pmem_dimm_media_temperature_celsius{bus="ndbus0",dimm="nmem0",id="8089-a2-1837-00000bb3"} 32.5
+# HELP pmem_dimm_shutdown_count Number of unsafe (dirty) shutdowns of a DIMM.
+# TYPE pmem_dimm_shutdown_count gauge
+pmem_dimm_shutdown_count{bus="ndbus0",dimm="nmem0",id="8089-a2-1837-00000bb3"} 3
+# HELP pmem_dimm_spares_percentage Remaining spare capacity of a DIMM in percent.
+# TYPE pmem_dimm_spares_percentage gauge
+pmem_dimm_spares_percentage{bus="ndbus0",dimm="nmem0",id="8089-a2-1837-00000bb3"} 95
+`
+	assert.NoError(t, testutil.CollectAndCompare(fakeDimmCollector{ndctx}, strings.NewReader(expected)))
+}
+
+func TestCapacityGauges(t *testing.T) {
+	capacityMetrics := []string{"pmem_csi_capacity_available", "pmem_csi_capacity_max_volume_size", "pmem_csi_capacity_total"}
+	registry := prometheus.NewPedanticRegistry()
+	MustRegisterDeviceMetrics(registry, "node", "pmem-csi.intel.com")
+	defer recordCapacity(api.DeviceModeDirect, Capacity{})
+
+	recordCapacity(api.DeviceModeLVM, Capacity{
+		Details: []CapacityDetail{
+			{Region: "region0", VolumeGroup: "ndbus0region0fsdax", MaxVolumeSize: 3, Available: 4, Total: 6},
+			{VolumeGroup: "pmem-csi", MaxVolumeSize: 1, Available: 2, Total: 5},
+		},
+	})
+	expected := `
+# HELP pmem_csi_capacity_available Remaining amount of PMEM in a region that can be used for new volumes, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_available gauge
+pmem_csi_capacity_available{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="pmem-csi"} 2
+pmem_csi_capacity_available{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 4
+# HELP pmem_csi_capacity_max_volume_size The size of the largest PMEM volume that can be created in a region, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_max_volume_size gauge
+pmem_csi_capacity_max_volume_size{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="pmem-csi"} 1
+pmem_csi_capacity_max_volume_size{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 3
+# HELP pmem_csi_capacity_total Total amount of PMEM in a region that is managed by PMEM-CSI, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_total gauge
+pmem_csi_capacity_total{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="pmem-csi"} 5
+pmem_csi_capacity_total{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 6
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), capacityMetrics...), "first query")
+
+	// The volume group is gone, the region gets updated.
+	recordCapacity(api.DeviceModeLVM, Capacity{
+		Details: []CapacityDetail{
+			{Region: "region0", VolumeGroup: "ndbus0region0fsdax", MaxVolumeSize: 1, Available: 1, Total: 6},
+		},
+	})
+	expected = `
+# HELP pmem_csi_capacity_available Remaining amount of PMEM in a region that can be used for new volumes, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_available gauge
+pmem_csi_capacity_available{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 1
+# HELP pmem_csi_capacity_max_volume_size The size of the largest PMEM volume that can be created in a region, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_max_volume_size gauge
+pmem_csi_capacity_max_volume_size{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 1
+# HELP pmem_csi_capacity_total Total amount of PMEM in a region that is managed by PMEM-CSI, as seen by the last capacity query.
+# TYPE pmem_csi_capacity_total gauge
+pmem_csi_capacity_total{device_mode="lvm",driver_name="pmem-csi.intel.com",node="node",region="region0"} 6
+`
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected), capacityMetrics...), "second query")
+}
+
+func TestDeviceErrors(t *testing.T) {
+	_, cmdErr := pmemexec.RunCommand(context.Background(), "false")
+	testcases := map[string]struct {
+		err           error
+		expectedClass string
+	}{
+		"no space": {
+			err:           fmt.Errorf("no region on bus ndbus0: %w", pmemerr.NotEnoughSpace),
+			expectedClass: errorClassNotEnoughSpace,
+		},
+		"no space from ndctl": {
+			err:           wrapNdctlError(pmemerr.NotEnoughSpace),
+			expectedClass: errorClassNotEnoughSpace,
+		},
+		"busy": {
+			err:           fmt.Errorf("clear device: %w", pmemerr.DeviceInUse),
+			expectedClass: errorClassDeviceBusy,
+		},
+		"command": {
+			err:           fmt.Errorf("device shred failure: %w", cmdErr),
+			expectedClass: errorClassExecFailure,
+		},
+		"ndctl": {
+			err:           wrapNdctlError(errors.New("failed to enable namespace")),
+			expectedClass: errorClassNdctl,
+		},
+		"other": {
+			err:           pmemerr.DeviceExists,
+			expectedClass: errorClassOther,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedClass, classifyDeviceError(tc.err), "class")
+			counter := deviceErrors.WithLabelValues(opFlushDevice, tc.expectedClass)
+			before := testutil.ToFloat64(counter)
+			countDeviceError(opFlushDevice, tc.err)
+			assert.Equal(t, before+1, testutil.ToFloat64(counter), "counter")
+		})
+	}
+
+	before := testutil.CollectAndCount(deviceErrors)
+	countDeviceError(opCreateDevice, nil)
+	assert.Equal(t, before, testutil.CollectAndCount(deviceErrors), "no error, no new counter")
+	assert.Equal(t, "failed to enable namespace", wrapNdctlError(errors.New("failed to enable namespace")).Error(), "message")
+	assert.NoError(t, wrapNdctlError(nil), "nil")
+}
+
+func TestObserveOperation(t *testing.T) {
+	histogram := func(result string) *dto.Histogram {
+		var m dto.Metric
+		require.NoError(t, operationDuration.WithLabelValues(OperationMkfs, result).(prometheus.Histogram).Write(&m), "write metric")
+		return m.GetHistogram()
+	}
+	oks, failures := histogram("ok").GetSampleCount(), histogram("error").GetSampleCount()
+	sum := histogram("ok").GetSampleSum()
+
+	ObserveOperation(OperationMkfs, time.Now().Add(-time.Second), nil)
+	ObserveOperation(OperationMkfs, time.Now(), errors.New("fake error"))
+
+	assert.Equal(t, oks+1, histogram("ok").GetSampleCount(), "successful mkfs")
+	assert.Equal(t, failures+1, histogram("error").GetSampleCount(), "failed mkfs")
+	assert.GreaterOrEqual(t, histogram("ok").GetSampleSum()-sum, 1.0, "duration of successful mkfs")
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"sort"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// numaNodeRegions returns those of the regions which are attached to
+// the NUMA node.
+func numaNodeRegions(ndctx ndctl.Context, regions []string, node int) []string {
+	return filterRegions(ndctx, regions, func(r ndctl.Region) bool {
+		return r.NumaNode() == node
+	})
+}
+
+// numaNodeVolumeGroups returns those of the volume groups whose
+// region is attached to the NUMA node.
+func (lvm *pmemLvm) numaNodeVolumeGroups(volumeGroups []string, node int) []string {
+	return lvm.filterVolumeGroups(volumeGroups, func(r regionInfo) bool {
+		return r.numaNode == node
+	})
+}
+
+// NumaNodes returns the NUMA nodes that the regions in the capacity
+// details are attached to, sorted and without duplicates. Unknown
+// NUMA nodes are skipped.
+func (c Capacity) NumaNodes() []int {
+	var nodes []int
+	for _, detail := range c.Details {
+		if detail.NumaNode >= 0 && !containsInt(nodes, detail.NumaNode) {
+			nodes = append(nodes, detail.NumaNode)
+		}
+	}
+	sort.Ints(nodes)
+	return nodes
+}
+
+// ForNumaNode returns the capacity of those regions in the capacity
+// details which are attached to the NUMA node. The capacity is
+// returned unmodified when there are no details.
+func (c Capacity) ForNumaNode(node int) Capacity {
+	return c.filter(func(detail CapacityDetail) bool {
+		return detail.NumaNode == node
+	})
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
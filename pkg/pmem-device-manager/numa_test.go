@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestNumaNodeRegions(t *testing.T) {
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "bus0",
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region0", Enabled_: true, NumaNode_: 0},
+					&ndctlfake.Region{DeviceName_: "region1", Enabled_: true, NumaNode_: 1},
+					&ndctlfake.Region{DeviceName_: "region2", Enabled_: true, NumaNode_: 1},
+					&ndctlfake.Region{DeviceName_: "region3", Enabled_: false, NumaNode_: 1},
+				},
+			},
+		},
+	})
+	all := []string{"region0", "region1", "region2", "region3"}
+	assert.Equal(t, []string{"region0"}, numaNodeRegions(ndctx, all, 0), "node 0")
+	assert.Equal(t, []string{"region1", "region2"}, numaNodeRegions(ndctx, all, 1), "node 1")
+	assert.Equal(t, []string{"region2"}, numaNodeRegions(ndctx, []string{"region0", "region2"}, 1), "node 1 in pool")
+	assert.Empty(t, numaNodeRegions(ndctx, all, 2), "node 2")
+}
+
+func TestNumaNodeVolumeGroups(t *testing.T) {
+	lvm := &pmemLvm{
+		regions: map[string]regionInfo{
+			"bus0region0fsdax": {name: "region0", numaNode: 0},
+			"bus0region1fsdax": {name: "region1", numaNode: 1},
+		},
+	}
+	volumeGroups := []string{"bus0region0fsdax", "bus0region1fsdax", nodeVGName}
+	assert.Equal(t, []string{"bus0region0fsdax"}, lvm.numaNodeVolumeGroups(volumeGroups, 0), "node 0")
+	assert.Equal(t, []string{"bus0region1fsdax"}, lvm.numaNodeVolumeGroups(volumeGroups, 1), "node 1")
+	assert.Empty(t, lvm.numaNodeVolumeGroups(volumeGroups, 2), "node 2")
+}
+
+func TestCapacityNumaNodes(t *testing.T) {
+	capacity := Capacity{
+		MaxVolumeSize:     300,
+		Available:         600,
+		PhysicalAvailable: 600,
+		Managed:           1500,
+		Total:             2000,
+		Details: []CapacityDetail{
+			{Region: "region0", MaxVolumeSize: 100, Available: 100, Total: 500, NumaNode: 1},
+			{Region: "region1", MaxVolumeSize: 300, Available: 300, Total: 500, NumaNode: 0},
+			{Region: "region2", MaxVolumeSize: 200, Available: 200, Total: 500, NumaNode: 1},
+			{VolumeGroup: "node", NumaNode: -1},
+		},
+	}
+	assert.Equal(t, []int{0, 1}, capacity.NumaNodes(), "NUMA nodes")
+	assert.Empty(t, Capacity{}.NumaNodes(), "no details")
+
+	node1 := capacity.ForNumaNode(1)
+	assert.Equal(t, uint64(200), node1.MaxVolumeSize, "max volume size")
+	assert.Equal(t, uint64(300), node1.Available, "available")
+	assert.Equal(t, uint64(300), node1.PhysicalAvailable, "physically available")
+	assert.Equal(t, uint64(1000), node1.Managed, "managed")
+	assert.Equal(t, uint64(1000), node1.Total, "total")
+	assert.Len(t, node1.Details, 2, "details")
+	assert.Equal(t, Capacity{}, capacity.ForNumaNode(2), "node 2")
+
+	noDetails := Capacity{MaxVolumeSize: 1, Available: 2}
+	assert.Equal(t, noDetails, noDetails.ForNumaNode(0), "no details")
+}
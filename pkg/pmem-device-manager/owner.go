@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// PMEM might be shared with other software, so the device managers
+// only list and delete devices that were created by PMEM-CSI.
+//
+// Namespace names are limited to 63 characters, which is exactly
+// the length of a volume ID, so there is no room for a prefix. In
+// direct mode, a namespace belongs to PMEM-CSI when its name is a
+// volume ID or starts with warmPrefix. In LVM mode, logical volumes
+// get the lvTag.
+
+// volumeIDRegexp matches the volume IDs created by the PMEM-CSI
+// controller: up to six characters from the volume name, a hyphen,
+// and a SHA-224 hash in hex.
+var volumeIDRegexp = regexp.MustCompile(`^.{0,6}-[0-9a-f]{56}$`)
+
+// IsVolumeID returns true if the name has the format of the volume
+// IDs created by PMEM-CSI.
+func IsVolumeID(name string) bool {
+	return volumeIDRegexp.MatchString(name)
+}
+
+// lvTag is added to all logical volumes created by PMEM-CSI.
+const lvTag = "pmem-csi"
+
+// tagLogicalVolumes adds the lvTag to logical volumes which were
+// created by an older PMEM-CSI release. Those are recognized by
+// their volume ID. Logical volumes with a different name are left
+// alone.
+func tagLogicalVolumes(ctx context.Context, volumeGroups ...string) error {
+	ctx, logger := pmemlog.WithName(ctx, "tagLogicalVolumes")
+	if len(volumeGroups) == 0 {
+		return nil
+	}
+	args := append([]string{"--noheadings", "-o", "vg_name,lv_name,lv_tags"}, volumeGroups...)
+	output, err := pmemexec.RunCommand(ctx, "lvs", args...)
+	if err != nil {
+		return err
+	}
+	for _, lv := range untaggedVolumes(output) {
+		logger.V(2).Info("Tagging logical volume", "lv", lv)
+		if _, err := pmemexec.RunCommand(ctx, "lvchange", "--addtag", lvTag, lv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// untaggedVolumes parses lvs output with vg_name,lv_name,lv_tags and
+// returns <vg>/<lv> for all logical volumes with a volume ID as name
+// and without the lvTag.
+func untaggedVolumes(output string) []string {
+	var lvs []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !IsVolumeID(fields[1]) {
+			continue
+		}
+		if len(fields) == 3 && hasLVTag(fields[2]) {
+			continue
+		}
+		lvs = append(lvs, fields[0]+"/"+fields[1])
+	}
+	return lvs
+}
+
+// hasLVTag checks the comma-separated lv_tags field of lvs.
+func hasLVTag(tags string) bool {
+	return containsString(strings.Split(tags, ","), lvTag)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsVolumeID(t *testing.T) {
+	assert.True(t, IsVolumeID(volumeID("pvc-1234")), "volume ID")
+	assert.True(t, IsVolumeID(volumeID("")), "volume ID for empty name")
+	assert.False(t, IsVolumeID("pmem-csi"), "namespace of LVM mode")
+	assert.False(t, IsVolumeID(warmName(1024)), "warm namespace")
+	assert.False(t, IsVolumeID(defragmentName), "defragmentation namespace")
+	assert.False(t, IsVolumeID(volumeID("pvc-1234")+"0"), "too long")
+}
+
+func TestParseLVSOutput(t *testing.T) {
+	id := volumeID("pvc-1")
+	devices, err := parseLVSOutput(`  ` + id + ` /dev/vg/` + id + ` 4194304 rlBgvE-0bXq-2Dq8-rAiu-Wqk2-dSsh-CfFP0o pmem-csi
+  foreign /dev/vg/foreign 8388608 8aXkpl-Ymz1-Ysw9-GfPj-ZTxZ-d0Ze-Q6fV2j
+  other /dev/vg/other 8388608 oZ3Ffe-vgCy-6IDS-lj1e-bd7T-qx4K-vEeoGw backup,daily
+  ` + thinPoolName + ` /dev/vg/` + thinPoolName + ` 16777216 Y9hs5C-n7T0-R8Wx-bqtD-9dUf-HRqR-6zqKoW
+  multi /dev/vg/multi 4194304 h3eLTc-nQ0W-mXUa-Fj3c-T3n8-uS8F-m1H9dP x,pmem-csi
+`)
+	require.NoError(t, err, "parse")
+	assert.Equal(t, map[string]*PmemDeviceInfo{
+		id: {
+			VolumeId: id,
+			Path:     "/dev/vg/" + id,
+			Size:     4194304,
+			UUID:     "rlBgvE-0bXq-2Dq8-rAiu-Wqk2-dSsh-CfFP0o",
+		},
+		"multi": {
+			VolumeId: "multi",
+			Path:     "/dev/vg/multi",
+			Size:     4194304,
+			UUID:     "h3eLTc-nQ0W-mXUa-Fj3c-T3n8-uS8F-m1H9dP",
+		},
+	}, devices, "devices")
+}
+
+func TestUntaggedVolumes(t *testing.T) {
+	tagged := volumeID("pvc-1")
+	untagged := volumeID("pvc-2")
+	lvs := untaggedVolumes(`  vg0 ` + tagged + ` pmem-csi
+  vg0 ` + untagged + `
+  vg1 foreign
+  vg1 ` + thinPoolName + `
+`)
+	assert.Equal(t, []string{"vg0/" + untagged}, lvs, "untagged volumes")
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
+)
+
+// The external device manager protocol is a gRPC service with
+// unary methods. Messages are encoded as JSON with the
+// "application/grpc+json" content type, so out-of-tree
+// implementations do not need generated code. Errors are returned as
+// gRPC status codes, see externalStatus.
+const (
+	externalServiceName = "pmemcsi.v1.DeviceManager"
+	externalCodecName   = "json"
+)
+
+// ExternalCapacityRequest is the request for GetCapacity. Stripes is
+// zero or one for volumes that are not striped.
+type ExternalCapacityRequest struct {
+	Stripes uint `json:"stripes,omitempty"`
+}
+
+// ExternalCapacity is the response for GetCapacity.
+type ExternalCapacity struct {
+	MaxVolumeSize     uint64 `json:"maxVolumeSize"`
+	Available         uint64 `json:"available"`
+	PhysicalAvailable uint64 `json:"physicallyAvailable"`
+	Managed           uint64 `json:"managed"`
+	Total             uint64 `json:"total"`
+	// Details are optional.
+	Details []CapacityDetail `json:"details,omitempty"`
+}
+
+// ExternalCreateDeviceRequest is the request for CreateDevice. The
+// parameters are the ones that get stored for the volume on the
+// node, see parameters.NodeVolumeOrigin.
+type ExternalCreateDeviceRequest struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	// Limit is the maximum size after alignment, zero if
+	// there is no limit.
+	Limit      uint64            `json:"limit,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// ExternalCreateDeviceResponse is the response for CreateDevice.
+type ExternalCreateDeviceResponse struct {
+	Size uint64 `json:"size"`
+}
+
+// ExternalDeviceRequest is the request for GetDevice and DeleteDevice.
+type ExternalDeviceRequest struct {
+	Name   string `json:"name"`
+	Flush  bool   `json:"flush,omitempty"`
+	Verify bool   `json:"verify,omitempty"`
+}
+
+// ExternalDevice describes one volume. The path must be usable by the
+// node driver.
+type ExternalDevice struct {
+	VolumeID string `json:"volumeID"`
+	Path     string `json:"path"`
+	Size     uint64 `json:"size"`
+	// UUID is optional. If set, it must change when a device
+	// with the same name gets recreated.
+	UUID string `json:"uuid,omitempty"`
+}
+
+// ExternalListDevicesRequest is the request for ListDevices.
+type ExternalListDevicesRequest struct{}
+
+// ExternalListDevicesResponse is the response for ListDevices.
+type ExternalListDevicesResponse struct {
+	Devices []ExternalDevice `json:"devices,omitempty"`
+}
+
+// ExternalEmpty is the response for DeleteDevice.
+type ExternalEmpty struct{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return externalCodecName
+}
+
+// ExternalServerCodec must be passed to grpc.NewServer for a server
+// with RegisterExternalServer. The codec is not registered globally
+// because that would affect all gRPC servers and clients of the
+// process.
+func ExternalServerCodec() grpc.ServerOption {
+	return grpc.ForceServerCodec(jsonCodec{})
+}
+
+// externalErrors maps the well-known errors to gRPC status codes and
+// back.
+var externalErrors = []struct {
+	err  error
+	code codes.Code
+}{
+	{pmemerr.DeviceExists, codes.AlreadyExists},
+	{pmemerr.DeviceNotFound, codes.NotFound},
+	{pmemerr.DeviceInUse, codes.FailedPrecondition},
+	{pmemerr.NotEnoughSpace, codes.ResourceExhausted},
+	{pmemerr.UnknownPool, codes.InvalidArgument},
+	{pmemerr.NotSupported, codes.Unimplemented},
+	{pmemerr.OutOfRange, codes.OutOfRange},
+	{pmemerr.NotErased, codes.DataLoss},
+}
+
+func externalStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	for _, e := range externalErrors {
+		if errors.Is(err, e.err) {
+			return status.Error(e.code, err.Error())
+		}
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func externalError(err error) error {
+	if err == nil {
+		return nil
+	}
+	s := status.Convert(err)
+	for _, e := range externalErrors {
+		if s.Code() == e.code {
+			return fmt.Errorf("%w: external device manager: %s", e.err, s.Message())
+		}
+	}
+	return fmt.Errorf("external device manager: %v", err)
+}
+
+type pmemExternal struct {
+	conn *grpc.ClientConn
+}
+
+var _ PmemDeviceManager = &pmemExternal{}
+var _ StripedCapacity = &pmemExternal{}
+
+// newPmemDeviceManagerExternal connects to an external device
+// manager at the given endpoint (for example,
+// unix:///run/pmem-dm.sock).
+func newPmemDeviceManagerExternal(ctx context.Context, endpoint string) (PmemDeviceManager, error) {
+	ctx, logger := pmemlog.WithName(ctx, "newPmemDeviceManagerExternal")
+	if endpoint == "" {
+		return nil, errors.New("external device manager: no endpoint")
+	}
+	conn, err := pmemgrpc.Connect(endpoint, nil, grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("external device manager: connect to %s: %v", endpoint, err)
+	}
+	pmem := &pmemExternal{conn: conn}
+
+	// Check that the external device manager works before
+	// accepting volume requests.
+	capacity, err := pmem.GetCapacity(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Info("Enabled", "endpoint", endpoint, "capacity", capacity)
+	return pmem, nil
+}
+
+func (pmem *pmemExternal) invoke(ctx context.Context, method string, req, resp interface{}) error {
+	return externalError(pmem.conn.Invoke(ctx, "/"+externalServiceName+"/"+method, req, resp))
+}
+
+func (pmem *pmemExternal) GetMode() api.DeviceMode {
+	return api.DeviceModeExternal
+}
+
+func (pmem *pmemExternal) GetCapacity(ctx context.Context) (Capacity, error) {
+	return pmem.GetStripedCapacity(ctx, 1)
+}
+
+func (pmem *pmemExternal) GetStripedCapacity(ctx context.Context, stripes uint) (Capacity, error) {
+	var resp ExternalCapacity
+	if err := pmem.invoke(ctx, "GetCapacity", &ExternalCapacityRequest{Stripes: stripes}, &resp); err != nil {
+		return Capacity{}, err
+	}
+	return Capacity{
+		MaxVolumeSize:     resp.MaxVolumeSize,
+		Available:         resp.Available,
+		PhysicalAvailable: resp.PhysicalAvailable,
+		Managed:           resp.Managed,
+		Total:             resp.Total,
+		Details:           resp.Details,
+	}, nil
+}
+
+func (pmem *pmemExternal) CreateDevice(ctx context.Context, volumeId string, size, limit uint64, params parameters.Volume) (uint64, error) {
+	req := &ExternalCreateDeviceRequest{
+		Name:       volumeId,
+		Size:       size,
+		Limit:      limit,
+		Parameters: params.ToContext(),
+	}
+	var resp ExternalCreateDeviceResponse
+	if err := pmem.invoke(ctx, "CreateDevice", req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Size, nil
+}
+
+func (pmem *pmemExternal) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
+	var resp ExternalDevice
+	if err := pmem.invoke(ctx, "GetDevice", &ExternalDeviceRequest{Name: volumeId}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.info(), nil
+}
+
+func (pmem *pmemExternal) DeleteDevice(ctx context.Context, volumeId string, flush, verify bool) error {
+	return pmem.invoke(ctx, "DeleteDevice", &ExternalDeviceRequest{Name: volumeId, Flush: flush, Verify: verify}, &ExternalEmpty{})
+}
+
+func (pmem *pmemExternal) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
+	var resp ExternalListDevicesResponse
+	if err := pmem.invoke(ctx, "ListDevices", &ExternalListDevicesRequest{}, &resp); err != nil {
+		return nil, err
+	}
+	devices := make([]*PmemDeviceInfo, 0, len(resp.Devices))
+	for _, dev := range resp.Devices {
+		devices = append(devices, dev.info())
+	}
+	return devices, nil
+}
+
+func (dev ExternalDevice) info() *PmemDeviceInfo {
+	return &PmemDeviceInfo{
+		VolumeId: dev.VolumeID,
+		Path:     dev.Path,
+		Size:     dev.Size,
+		UUID:     dev.UUID,
+	}
+}
+
+func externalDevice(info *PmemDeviceInfo) ExternalDevice {
+	return ExternalDevice{
+		VolumeID: info.VolumeId,
+		Path:     info.Path,
+		Size:     info.Size,
+		UUID:     info.UUID,
+	}
+}
+
+// RegisterExternalServer makes the device manager available as an
+// external device manager through the gRPC server. The server must
+// have been created with ExternalServerCodec.
+func RegisterExternalServer(s *grpc.Server, dm PmemDeviceManager) {
+	s.RegisterService(&externalServiceDesc, dm)
+}
+
+// ServeExternal runs a gRPC server for the device manager at the
+// endpoint until the context is canceled. This is meant for
+// out-of-tree device managers which are used by the node driver with
+// -deviceManager=external://<path>.
+func ServeExternal(ctx context.Context, endpoint string, dm PmemDeviceManager) error {
+	s, listener, err := pmemgrpc.NewServer(endpoint, "", nil, nil, ExternalServerCodec())
+	if err != nil {
+		return err
+	}
+	RegisterExternalServer(s, dm)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	return s.Serve(listener)
+}
+
+func externalMethod[Req any](name string, call func(ctx context.Context, dm PmemDeviceManager, req *Req) (interface{}, error)) grpc.MethodDesc {
+	fullMethod := "/" + externalServiceName + "/" + name
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				resp, err := call(ctx, srv.(PmemDeviceManager), req.(*Req))
+				return resp, externalStatus(err)
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+		},
+	}
+}
+
+var externalServiceDesc = grpc.ServiceDesc{
+	ServiceName: externalServiceName,
+	HandlerType: (*PmemDeviceManager)(nil),
+	Methods: []grpc.MethodDesc{
+		externalMethod("GetCapacity", func(ctx context.Context, dm PmemDeviceManager, req *ExternalCapacityRequest) (interface{}, error) {
+			var capacity Capacity
+			var err error
+			if req.Stripes > 1 {
+				sc, ok := dm.(StripedCapacity)
+				if !ok {
+					return nil, fmt.Errorf("%w: striped volumes", pmemerr.NotSupported)
+				}
+				capacity, err = sc.GetStripedCapacity(ctx, req.Stripes)
+			} else {
+				capacity, err = dm.GetCapacity(ctx)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &ExternalCapacity{
+				MaxVolumeSize:     capacity.MaxVolumeSize,
+				Available:         capacity.Available,
+				PhysicalAvailable: capacity.PhysicalAvailable,
+				Managed:           capacity.Managed,
+				Total:             capacity.Total,
+				Details:           capacity.Details,
+			}, nil
+		}),
+		externalMethod("CreateDevice", func(ctx context.Context, dm PmemDeviceManager, req *ExternalCreateDeviceRequest) (interface{}, error) {
+			params, err := parameters.Parse(parameters.NodeVolumeOrigin, req.Parameters)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			size, err := dm.CreateDevice(ctx, req.Name, req.Size, req.Limit, params)
+			if err != nil {
+				return nil, err
+			}
+			return &ExternalCreateDeviceResponse{Size: size}, nil
+		}),
+		externalMethod("GetDevice", func(ctx context.Context, dm PmemDeviceManager, req *ExternalDeviceRequest) (interface{}, error) {
+			info, err := dm.GetDevice(ctx, req.Name)
+			if err != nil {
+				return nil, err
+			}
+			dev := externalDevice(info)
+			return &dev, nil
+		}),
+		externalMethod("DeleteDevice", func(ctx context.Context, dm PmemDeviceManager, req *ExternalDeviceRequest) (interface{}, error) {
+			if err := dm.DeleteDevice(ctx, req.Name, req.Flush, req.Verify); err != nil {
+				return nil, err
+			}
+			return &ExternalEmpty{}, nil
+		}),
+		externalMethod("ListDevices", func(ctx context.Context, dm PmemDeviceManager, req *ExternalListDevicesRequest) (interface{}, error) {
+			infos, err := dm.ListDevices(ctx)
+			if err != nil {
+				return nil, err
+			}
+			resp := &ExternalListDevicesResponse{}
+			for _, info := range infos {
+				resp.Devices = append(resp.Devices, externalDevice(info))
+			}
+			return resp, nil
+		}),
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pmd-external.go",
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestExternal(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fake, err := newFake(50)
+	require.NoError(t, err, "create fake device manager")
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "dm.sock")
+	done := make(chan error)
+	go func() {
+		done <- ServeExternal(ctx, endpoint, fake)
+	}()
+	defer func() {
+		cancel()
+		require.NoError(t, <-done, "serve")
+	}()
+
+	dm, err := New(ctx, api.DeviceModeExternal, 0, Options{Endpoint: endpoint})
+	require.NoError(t, err, "connect")
+	assert.Equal(t, api.DeviceModeExternal, dm.GetMode(), "mode")
+	// Other gRPC servers and clients in the same process must
+	// not be affected by the JSON codec.
+	assert.Nil(t, encoding.GetCodec(externalCodecName), "JSON codec not registered")
+
+	capacity, err := dm.GetCapacity(ctx)
+	require.NoError(t, err, "initial capacity")
+	expected, _ := fake.GetCapacity(ctx)
+	assert.Equal(t, expected, capacity, "initial capacity")
+
+	_, err = dm.(StripedCapacity).GetStripedCapacity(ctx, 2)
+	assert.True(t, errors.Is(err, pmemerr.NotSupported), "striped capacity: %v", err)
+
+	usage := parameters.UsageAppDirect
+	params := parameters.Volume{Usage: &usage}
+	size, err := dm.CreateDevice(ctx, "vol1", 1024*1024, 0, params)
+	require.NoError(t, err, "create")
+	assert.Equal(t, uint64(1024*1024), size, "created size")
+
+	_, err = dm.CreateDevice(ctx, "vol1", 1024*1024, 0, params)
+	assert.True(t, errors.Is(err, pmemerr.DeviceExists), "create again: %v", err)
+	_, err = dm.CreateDevice(ctx, "vol2", capacity.Total, 0, params)
+	assert.True(t, errors.Is(err, pmemerr.NotEnoughSpace), "create too large: %v", err)
+
+	device, err := dm.GetDevice(ctx, "vol1")
+	require.NoError(t, err, "get")
+	assert.NotEmpty(t, device.UUID, "UUID")
+	assert.Equal(t, &PmemDeviceInfo{VolumeId: "vol1", Path: FakeDevicePathPrefix + "vol1", Size: size, UUID: device.UUID}, device, "device")
+	_, err = dm.GetDevice(ctx, "vol2")
+	assert.True(t, errors.Is(err, pmemerr.DeviceNotFound), "get missing: %v", err)
+
+	devices, err := dm.ListDevices(ctx)
+	require.NoError(t, err, "list")
+	assert.Equal(t, []*PmemDeviceInfo{device}, devices, "devices")
+
+	require.NoError(t, dm.DeleteDevice(ctx, "vol1", false, false), "delete")
+	devices, err = dm.ListDevices(ctx)
+	require.NoError(t, err, "list after delete")
+	assert.Empty(t, devices, "devices after delete")
+}
+
+func TestExternalNoEndpoint(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	_, err := New(ctx, api.DeviceModeExternal, 0, Options{})
+	assert.Error(t, err, "no endpoint")
+	_, err = New(ctx, api.DeviceModeExternal, 0, Options{Endpoint: "unix://" + filepath.Join(t.TempDir(), "none.sock")})
+	assert.Error(t, err, "no server")
+}
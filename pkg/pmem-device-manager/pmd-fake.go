@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/google/uuid"
+
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 
@@ -60,14 +62,17 @@ func (dm *fakeDM) getCapacity() Capacity {
 		remaining -= dev.Size
 	}
 	return Capacity{
-		Available:     remaining,
-		MaxVolumeSize: remaining,
-		Managed:       dm.capacity,
-		Total:         totalCapacity,
+		Available:         remaining,
+		PhysicalAvailable: remaining,
+		MaxVolumeSize:     remaining,
+		Managed:           dm.capacity,
+		Total:             totalCapacity,
 	}
 }
 
-func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+// CreateDevice ignores pool, stripes and NUMA node because the fake device manager has no regions.
+// The limit is always met because the size does not get aligned.
+func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size, limit uint64, params parameters.Volume) (uint64, error) {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 
@@ -84,11 +89,12 @@ func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64
 		VolumeId: volumeId,
 		Size:     size,
 		Path:     FakeDevicePathPrefix + volumeId,
+		UUID:     uuid.New().String(),
 	}
 	return size, nil
 }
 
-func (dm *fakeDM) DeleteDevice(ctx context.Context, volumeId string, flush bool) error {
+func (dm *fakeDM) DeleteDevice(ctx context.Context, volumeId string, flush, verify bool) error {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 
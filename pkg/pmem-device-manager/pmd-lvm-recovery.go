@@ -0,0 +1,217 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+const (
+	// EventReasonLVMMetadataRestored is used when corrupt
+	// metadata of a volume group was replaced with a backup.
+	EventReasonLVMMetadataRestored = "LVMMetadataRestored"
+	// EventReasonLVMMetadataRecoveryFailed is used when restoring
+	// the metadata failed. The driver then does not start.
+	EventReasonLVMMetadataRecoveryFailed = "LVMMetadataRecoveryFailed"
+	// EventReasonLVMMetadataRecoverySkipped is used when the
+	// metadata of a volume group is corrupt, but restoring the
+	// backup is not safe.
+	EventReasonLVMMetadataRecoverySkipped = "LVMMetadataRecoverySkipped"
+)
+
+// The LVM configuration in the driver image disables the automatic
+// backups of LVM because they would be lost when the container
+// restarts. The driver therefore writes its own backups with
+// vgcfgbackup into a directory on the host.
+const backupSuffix = ".vg"
+
+// metadataRecovery contains the settings for backing up and
+// restoring LVM metadata.
+type metadataRecovery struct {
+	// dir is empty when backups are disabled.
+	dir      string
+	recorder record.EventRecorder
+	node     *corev1.ObjectReference
+}
+
+func newMetadataRecovery(opts Options) metadataRecovery {
+	return metadataRecovery{
+		dir:      opts.MetadataBackupDir,
+		recorder: opts.EventRecorder,
+		// The same reference as used by the kubelet for node events.
+		node: &corev1.ObjectReference{
+			Kind: "Node",
+			Name: opts.NodeName,
+			UID:  types.UID(opts.NodeName),
+		},
+	}
+}
+
+func (r metadataRecovery) backupFile(vgName string) string {
+	return filepath.Join(r.dir, vgName+backupSuffix)
+}
+
+func (r metadataRecovery) event(ctx context.Context, eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	klog.FromContext(ctx).Info(message, "reason", reason)
+	if r.recorder != nil && r.node.Name != "" {
+		r.recorder.Event(r.node, eventtype, reason, message)
+	}
+}
+
+// backup writes the current metadata of the volume groups. Failures
+// are only logged because they do not affect volumes.
+func (r metadataRecovery) backup(ctx context.Context, volumeGroups ...string) {
+	if r.dir == "" {
+		return
+	}
+	logger := klog.FromContext(ctx)
+	if err := os.MkdirAll(r.dir, 0750); err != nil {
+		logger.Error(err, "Backing up LVM metadata failed")
+		return
+	}
+	for _, vgName := range volumeGroups {
+		if _, err := pmemexec.RunCommand(ctx, "vgcfgbackup", "-f", r.backupFile(vgName), vgName); err != nil {
+			logger.Error(err, "Backing up LVM metadata failed", "vg", vgName)
+		}
+	}
+}
+
+// repair checks all volume groups which have a backup and restores
+// the backup when the metadata on the physical volumes cannot be
+// read. Volume groups without a backup are never touched.
+//
+// Restoring is skipped when it might destroy data: when a physical
+// volume from the backup is now used by a different volume group.
+// When none of the physical volumes exist anymore, the backup is
+// outdated and gets removed.
+func (r metadataRecovery) repair(ctx context.Context) error {
+	if r.dir == "" {
+		return nil
+	}
+	ctx, logger := pmemlog.WithName(ctx, "LVM-Recovery")
+	entries, err := os.ReadDir(r.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read LVM metadata backups: %v", err)
+	}
+	scanned := false
+	for _, entry := range entries {
+		vgName := strings.TrimSuffix(entry.Name(), backupSuffix)
+		if vgName == entry.Name() {
+			continue
+		}
+		_, checkErr := pmemexec.RunCommand(ctx, "vgck", vgName)
+		if checkErr != nil && !scanned {
+			// The device cache might just be outdated.
+			if _, err := pmemexec.RunCommand(ctx, "pvscan", "--cache"); err != nil {
+				logger.Error(err, "Updating the LVM device cache failed")
+			}
+			scanned = true
+			_, checkErr = pmemexec.RunCommand(ctx, "vgck", vgName)
+		}
+		if checkErr == nil {
+			continue
+		}
+
+		file := r.backupFile(vgName)
+		devices, err := backupDevices(file)
+		if err != nil {
+			return fmt.Errorf("volume group %s: %v", vgName, err)
+		}
+		var existing []string
+		for _, device := range devices {
+			if _, err := os.Stat(device); err == nil {
+				existing = append(existing, device)
+			}
+		}
+		if len(existing) == 0 {
+			logger.Info("Removing outdated LVM metadata backup, its physical volumes are gone", "vg", vgName, "devices", devices)
+			if err := os.Remove(file); err != nil {
+				return fmt.Errorf("volume group %s: remove outdated backup: %v", vgName, err)
+			}
+			continue
+		}
+		if other := otherVolumeGroup(ctx, vgName, existing); other != "" {
+			r.event(ctx, corev1.EventTypeWarning, EventReasonLVMMetadataRecoverySkipped,
+				"Metadata of volume group %s is corrupt (%v), not restoring it because its physical volumes are used by volume group %s", vgName, checkErr, other)
+			continue
+		}
+
+		if err := restoreMetadata(ctx, vgName, file); err != nil {
+			r.event(ctx, corev1.EventTypeWarning, EventReasonLVMMetadataRecoveryFailed,
+				"Metadata of volume group %s is corrupt (%v), restoring it from backup failed: %v", vgName, checkErr, err)
+			return fmt.Errorf("volume group %s: restore metadata: %v", vgName, err)
+		}
+		r.event(ctx, corev1.EventTypeWarning, EventReasonLVMMetadataRestored,
+			"Metadata of volume group %s was corrupt (%v) and got restored from backup", vgName, checkErr)
+	}
+	return nil
+}
+
+func restoreMetadata(ctx context.Context, vgName, file string) error {
+	// --force is required for volume groups with thin pools.
+	if _, err := pmemexec.RunCommand(ctx, "vgcfgrestore", "--force", "-f", file, vgName); err != nil {
+		return err
+	}
+	if _, err := pmemexec.RunCommand(ctx, "vgchange", "-ay", vgName); err != nil {
+		return err
+	}
+	_, err := pmemexec.RunCommand(ctx, "vgck", vgName)
+	return err
+}
+
+// otherVolumeGroup returns the name of a different volume group that
+// one of the devices belongs to, if there is one.
+func otherVolumeGroup(ctx context.Context, vgName string, devices []string) string {
+	for _, device := range devices {
+		output, err := pmemexec.RunCommand(ctx, "pvs", "--noheadings", "-o", "vg_name", device)
+		if err != nil {
+			continue
+		}
+		if other := strings.TrimSpace(output); other != "" && other != vgName {
+			return other
+		}
+	}
+	return ""
+}
+
+var backupDeviceRe = regexp.MustCompile(`^\s*device\s*=\s*"([^"]+)"`)
+
+// backupDevices returns the physical volumes listed in a backup file
+// written by vgcfgbackup.
+func backupDevices(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var devices []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if match := backupDeviceRe.FindStringSubmatch(scanner.Text()); match != nil {
+			devices = append(devices, match[1])
+		}
+	}
+	return devices, scanner.Err()
+}
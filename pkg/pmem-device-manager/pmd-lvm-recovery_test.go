@@ -0,0 +1,172 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestMetadataRepair(t *testing.T) {
+	// The fake LVM commands keep their state in files:
+	// "corrupt" makes vgck fail until vgcfgrestore ran,
+	// "other" is the volume group reported by pvs,
+	// "restore-fails" makes vgcfgrestore fail.
+	commands := map[string]string{
+		"vgck": `#!/bin/sh
+if [ -e "$STATE/corrupt" ] && ! [ -e "$STATE/restored" ]; then
+    echo >&2 "Volume group \"$1\" not found"
+    exit 5
+fi
+`,
+		"pvscan": `#!/bin/sh
+`,
+		"pvs": `#!/bin/sh
+cat "$STATE/other" 2>/dev/null
+`,
+		"vgcfgrestore": `#!/bin/sh
+if [ -e "$STATE/restore-fails" ]; then
+    echo >&2 "Couldn't find device"
+    exit 1
+fi
+echo "$*" >"$STATE/restored"
+`,
+		"vgchange": `#!/bin/sh
+`,
+	}
+
+	testcases := map[string]struct {
+		corrupt, restoreFails, devicesGone bool
+		other                              string
+		expectError                        bool
+		expectRestored                     bool
+		expectBackup                       bool
+		expectedEvent                      string
+	}{
+		"healthy": {
+			expectBackup: true,
+		},
+		"corrupt": {
+			corrupt:        true,
+			expectRestored: true,
+			expectBackup:   true,
+			expectedEvent:  "Warning " + EventReasonLVMMetadataRestored,
+		},
+		"restore failed": {
+			corrupt:       true,
+			restoreFails:  true,
+			expectError:   true,
+			expectBackup:  true,
+			expectedEvent: "Warning " + EventReasonLVMMetadataRecoveryFailed,
+		},
+		"devices gone": {
+			corrupt:     true,
+			devicesGone: true,
+		},
+		"used by other volume group": {
+			corrupt:       true,
+			other:         "foo",
+			expectBackup:  true,
+			expectedEvent: "Warning " + EventReasonLVMMetadataRecoverySkipped,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			path := os.Getenv("PATH")
+			defer os.Setenv("PATH", path)
+			bin := t.TempDir()
+			for name, script := range commands {
+				require.NoError(t, os.WriteFile(filepath.Join(bin, name), []byte(script), 0700))
+			}
+			os.Setenv("PATH", bin+":"+path)
+			state := t.TempDir()
+			t.Setenv("STATE", state)
+			touch := func(name, content string) {
+				require.NoError(t, os.WriteFile(filepath.Join(state, name), []byte(content), 0600))
+			}
+			if tc.corrupt {
+				touch("corrupt", "")
+			}
+			if tc.restoreFails {
+				touch("restore-fails", "")
+			}
+			if tc.other != "" {
+				touch("other", "  "+tc.other+"\n")
+			}
+
+			device := filepath.Join(state, "pmem0")
+			if !tc.devicesGone {
+				touch("pmem0", "")
+			}
+			dir := t.TempDir()
+			backup := filepath.Join(dir, "bus0region0fsdax.vg")
+			require.NoError(t, os.WriteFile(backup, []byte(fmt.Sprintf(`bus0region0fsdax {
+	physical_volumes {
+		pv0 {
+			id = "abc"
+			device = "%s"	# Hint only
+		}
+	}
+}
+`, device)), 0600))
+
+			recorder := record.NewFakeRecorder(10)
+			r := newMetadataRecovery(Options{
+				MetadataBackupDir: dir,
+				EventRecorder:     recorder,
+				NodeName:          "worker",
+			})
+			err := r.repair(ctx)
+			if tc.expectError {
+				assert.Error(t, err, "repair")
+			} else {
+				assert.NoError(t, err, "repair")
+			}
+			_, err = os.Stat(filepath.Join(state, "restored"))
+			assert.Equal(t, tc.expectRestored, err == nil, "restored")
+			_, err = os.Stat(backup)
+			assert.Equal(t, tc.expectBackup, err == nil, "backup kept")
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if tc.expectedEvent == "" {
+				assert.Empty(t, events, "events")
+			} else if assert.Len(t, events, 1, "events") {
+				assert.Contains(t, events[0], tc.expectedEvent, "event")
+			}
+		})
+	}
+}
+
+func TestBackupDevices(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "vg.vg")
+	require.NoError(t, os.WriteFile(file, []byte(`pmem-csi {
+	physical_volumes {
+		pv0 {
+			device = "/dev/pmem0"	# Hint only
+		}
+		pv1 {
+			device = "/dev/pmem1"	# Hint only
+		}
+	}
+}
+`), 0600))
+	devices, err := backupDevices(file)
+	require.NoError(t, err, "parse backup")
+	assert.Equal(t, []string{"/dev/pmem0", "/dev/pmem1"}, devices, "devices")
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/tracing"
+)
+
+var _ DeviceShrinker = &pmemLvm{}
+
+// ShrinkDevice first shrinks the ext4 filesystem with resize2fs, then
+// the logical volume with lvreduce. A failure in resize2fs, for
+// example because the data does not fit into the new size, leaves the
+// volume unchanged. A failure in lvreduce leaves a filesystem that is
+// smaller than the volume, which is still usable.
+func (lvm *pmemLvm) ShrinkDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-ShrinkDevice")
+	ctx, span := tracing.Start(ctx, "LVM-ShrinkDevice", attribute.String("volume-id", volumeId))
+	defer span.End()
+	defer lvm.capacity.invalidate()
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return 0, err
+	}
+	size = alignShrinkSize(size)
+	if size == 0 || size >= device.Size {
+		return 0, fmt.Errorf("new size %d must be smaller than current size %d: %w", size, device.Size, pmemerr.OutOfRange)
+	}
+	if deviceInUse(device.Path) {
+		return 0, fmt.Errorf("shrink %q: %w", device.Path, pmemerr.DeviceInUse)
+	}
+	output, err := pmemexec.RunCommand(ctx, "blkid", "-o", "value", "-s", "TYPE", device.Path)
+	if err != nil {
+		// blkid also fails when it finds no filesystem.
+		return 0, fmt.Errorf("shrink %q: no filesystem found: %w", device.Path, pmemerr.NotSupported)
+	}
+	if fsType := strings.TrimSpace(output); fsType != "ext4" {
+		return 0, fmt.Errorf("shrink %q: filesystem %q: %w", device.Path, fsType, pmemerr.NotSupported)
+	}
+
+	// resize2fs insists on a recent check of an unmounted
+	// filesystem. -p aborts instead of asking when it finds
+	// problems that need manual repair.
+	if _, err := pmemexec.RunCommand(ctx, "e2fsck", "-f", "-p", device.Path); err != nil {
+		return 0, fmt.Errorf("check filesystem: %v", err)
+	}
+	if _, err := pmemexec.RunCommand(ctx, "resize2fs", device.Path, fmt.Sprintf("%dK", size/1024)); err != nil {
+		return 0, fmt.Errorf("shrink filesystem: %v", err)
+	}
+	logger.V(3).Info("Shrunk filesystem", "device", device.Path, "size", pmemlog.CapacityRef(int64(size)))
+	if _, err := pmemexec.RunCommand(ctx, "lvreduce", "-f", "-L", fmt.Sprintf("%dB", size), device.Path); err != nil {
+		return 0, err
+	}
+	lvm.recovery.backup(ctx, lvVolumeGroup(device.Path))
+
+	// LVM may have rounded up, for example for striped volumes.
+	newDevice, err := getUncachedDevice(ctx, volumeId, lvVolumeGroup(device.Path))
+	if err != nil {
+		return 0, err
+	}
+	lvm.devices[volumeId] = newDevice
+	logger.Info("Shrunk logical volume", "device", device.Path,
+		"old-size", pmemlog.CapacityRef(int64(device.Size)),
+		"new-size", pmemlog.CapacityRef(int64(newDevice.Size)),
+	)
+	return newDevice.Size, nil
+}
+
+// alignShrinkSize rounds up to the LVM extent size.
+func alignShrinkSize(size uint64) uint64 {
+	return (size + lvmAlign - 1) / lvmAlign * lvmAlign
+}
+
+// lvVolumeGroup returns the volume group of a /dev/<vg>/<lv> path.
+func lvVolumeGroup(path string) string {
+	return filepath.Base(filepath.Dir(path))
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+func TestAlignShrinkSize(t *testing.T) {
+	mib := uint64(1024 * 1024)
+	assert.Equal(t, uint64(0), alignShrinkSize(0), "zero")
+	assert.Equal(t, 4*mib, alignShrinkSize(1), "round up")
+	assert.Equal(t, 8*mib, alignShrinkSize(8*mib), "aligned")
+	assert.Equal(t, "ndbus0region0fsdax", lvVolumeGroup("/dev/ndbus0region0fsdax/pvc-aa-bb"), "volume group")
+}
+
+func TestShrinkDeviceSize(t *testing.T) {
+	mib := uint64(1024 * 1024)
+	lvm := &pmemLvm{
+		devices: map[string]*PmemDeviceInfo{
+			"pvc-aa-bb": {VolumeId: "pvc-aa-bb", Path: "/dev/ndbus0region0fsdax/pvc-aa-bb", Size: 8 * mib},
+		},
+	}
+	ctx := context.Background()
+
+	_, err := lvm.ShrinkDevice(ctx, "pvc-cc-dd", 4*mib)
+	assert.True(t, errors.Is(err, pmemerr.DeviceNotFound), "unknown volume: %v", err)
+	_, err = lvm.ShrinkDevice(ctx, "pvc-aa-bb", 8*mib)
+	assert.True(t, errors.Is(err, pmemerr.OutOfRange), "same size: %v", err)
+	_, err = lvm.ShrinkDevice(ctx, "pvc-aa-bb", 7*mib)
+	assert.True(t, errors.Is(err, pmemerr.OutOfRange), "same size after alignment: %v", err)
+	_, err = lvm.ShrinkDevice(ctx, "pvc-aa-bb", 0)
+	assert.True(t, errors.Is(err, pmemerr.OutOfRange), "zero size: %v", err)
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+// VolumeGroupLayout determines how namespaces are grouped into
+// volume groups in LVM mode.
+type VolumeGroupLayout string
+
+const (
+	// VolumeGroupPerRegion puts the namespaces of each region
+	// into a separate volume group. Each volume is then confined
+	// to one region.
+	VolumeGroupPerRegion VolumeGroupLayout = "region"
+	// VolumeGroupPerNode puts the namespaces of all regions into
+	// one volume group. Volumes may then span regions and can
+	// be striped across them.
+	VolumeGroupPerNode VolumeGroupLayout = "node"
+)
+
+func (l *VolumeGroupLayout) Set(value string) error {
+	switch VolumeGroupLayout(value) {
+	case VolumeGroupPerRegion, VolumeGroupPerNode:
+		*l = VolumeGroupLayout(value)
+	default:
+		return fmt.Errorf("unsupported volume group layout %q", value)
+	}
+	return nil
+}
+
+func (l *VolumeGroupLayout) String() string {
+	return string(*l)
+}
+
+// stripeSize is passed to lvcreate for striped volumes. It matches
+// the size of huge pages, which keeps them usable with DAX.
+const stripeSize = "2m"
+
+var pvsArgs = []string{"--noheadings", "--nosuffix", "--units", "B", "-o", "vg_name,pv_name,pv_free"}
+
+// physicalVolume describes one physical volume of a volume group.
+type physicalVolume struct {
+	name string
+	// region is the name of the region with the namespace,
+	// the name of the physical volume if not known.
+	region string
+	free   uint64
+}
+
+// getPVFree returns the physical volumes of the given volume groups,
+// indexed by volume group name.
+func getPVFree(ctx context.Context, volumeGroups []string) (map[string][]physicalVolume, error) {
+	output, err := pmemexec.RunCommand(ctx, "pvs", pvsArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("pvs failure: %v", err)
+	}
+	pvs, err := parsePVSOutput(output, volumeGroups)
+	if err != nil {
+		return nil, err
+	}
+	regions, err := pvRegions()
+	if err != nil {
+		return nil, err
+	}
+	for _, vgPVs := range pvs {
+		for i := range vgPVs {
+			if region, ok := regions[vgPVs[i].name]; ok {
+				vgPVs[i].region = region
+			}
+		}
+	}
+	return pvs, nil
+}
+
+// pvRegions maps the device paths of all namespaces to the name of
+// their region.
+func pvRegions() (map[string]string, error) {
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return nil, fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	regions := map[string]string{}
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			for _, ns := range r.ActiveNamespaces() {
+				regions["/dev/"+ns.BlockDeviceName()] = r.DeviceName()
+			}
+		}
+	}
+	return regions, nil
+}
+
+// pvs options "vg_name,pv_name,pv_free"
+func parsePVSOutput(output string, volumeGroups []string) (map[string][]physicalVolume, error) {
+	wanted := map[string]bool{}
+	for _, vgName := range volumeGroups {
+		wanted[vgName] = true
+	}
+	pvs := map[string][]physicalVolume{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// Physical volumes which are not in a volume group
+		// have only two fields.
+		if len(fields) != 3 || !wanted[fields[0]] {
+			continue
+		}
+		free, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pvs output %q: %v", line, err)
+		}
+		pvs[fields[0]] = append(pvs[fields[0]], physicalVolume{name: fields[1], region: fields[1], free: free})
+	}
+	return pvs, nil
+}
+
+// regionSpace summarizes the free space of the physical volumes in
+// one region.
+type regionSpace struct {
+	// largest is the physical volume with most free extents.
+	largest physicalVolume
+	// total is the number of free extents in all physical volumes.
+	total uint64
+}
+
+// regionSpaces groups physical volumes by region, sorted by the
+// free space in the largest physical volume of each region.
+func regionSpaces(pvs []physicalVolume) []regionSpace {
+	byRegion := map[string]*regionSpace{}
+	var spaces []*regionSpace
+	for _, pv := range pvs {
+		space := byRegion[pv.region]
+		if space == nil {
+			space = &regionSpace{largest: pv}
+			byRegion[pv.region] = space
+			spaces = append(spaces, space)
+		} else if pv.free/lvmAlign > space.largest.free/lvmAlign {
+			space.largest = pv
+		}
+		space.total += pv.free / lvmAlign
+	}
+	result := make([]regionSpace, 0, len(spaces))
+	for _, space := range spaces {
+		result = append(result, *space)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].largest.free/lvmAlign > result[j].largest.free/lvmAlign
+	})
+	return result
+}
+
+// stripePVs returns the physical volumes for a volume of the given
+// size with the given number of stripes, one in each region, or nil
+// if there are not enough regions with space for one stripe.
+// lvcreate stripes across the physical volumes that it gets
+// as arguments.
+func stripePVs(pvs []physicalVolume, stripes uint, size uint64) []string {
+	n := uint64(stripes)
+	spaces := regionSpaces(pvs)
+	if n == 0 || uint64(len(spaces)) < n {
+		return nil
+	}
+	var names []string
+	for _, space := range spaces[:n] {
+		if space.largest.free/lvmAlign*lvmAlign < size/n {
+			return nil
+		}
+		names = append(names, space.largest.name)
+	}
+	return names
+}
+
+// stripedCapacity calculates how much space is available for
+// volumes with the given number of stripes when the volume group
+// has the given physical volumes. Each stripe must be on a different
+// region and inside a single physical volume.
+//
+// The largest volume uses the regions whose physical volumes have
+// most free space. All volumes together can use k in each region at
+// most, with the largest k for which the regions have space for k on
+// each of the stripes.
+func stripedCapacity(pvs []physicalVolume, stripes uint) (available, maxVolumeSize uint64) {
+	n := uint64(stripes)
+	spaces := regionSpaces(pvs)
+	if n == 0 || uint64(len(spaces)) < n {
+		return 0, 0
+	}
+	var total uint64
+	for _, space := range spaces {
+		total += space.total
+	}
+	maxVolumeSize = n * (spaces[n-1].largest.free / lvmAlign) * lvmAlign
+
+	fits := func(k uint64) bool {
+		var sum uint64
+		for _, space := range spaces {
+			if space.total < k {
+				sum += space.total
+			} else {
+				sum += k
+			}
+		}
+		return sum >= n*k
+	}
+	low, high := uint64(0), total/n
+	for low < high {
+		k := (low + high + 1) / 2
+		if fits(k) {
+			low = k
+		} else {
+			high = k - 1
+		}
+	}
+	available = n * low * lvmAlign
+	return available, maxVolumeSize
+}
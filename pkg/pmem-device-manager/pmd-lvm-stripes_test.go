@@ -0,0 +1,198 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+// inRegions returns physical volumes with the given free space,
+// each in its own region.
+func inRegions(free ...uint64) []physicalVolume {
+	var pvs []physicalVolume
+	for i, f := range free {
+		name := fmt.Sprintf("/dev/pmem%d", i)
+		pvs = append(pvs, physicalVolume{name: name, region: fmt.Sprintf("region%d", i), free: f})
+	}
+	return pvs
+}
+
+func TestStripedCapacity(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	testcases := map[string]struct {
+		pvs           []physicalVolume
+		stripes       uint
+		available     uint64
+		maxVolumeSize uint64
+	}{
+		"too few PVs": {
+			pvs:     inRegions(10 * gig),
+			stripes: 2,
+		},
+		"equal": {
+			pvs:           inRegions(10*gig, 10*gig),
+			stripes:       2,
+			available:     20 * gig,
+			maxVolumeSize: 20 * gig,
+		},
+		"unequal": {
+			pvs:           inRegions(2*gig, 10*gig),
+			stripes:       2,
+			available:     4 * gig,
+			maxVolumeSize: 4 * gig,
+		},
+		"more PVs than stripes": {
+			pvs:           inRegions(4*gig, 4*gig, 4*gig),
+			stripes:       2,
+			available:     12 * gig,
+			maxVolumeSize: 8 * gig,
+		},
+		"one large PV": {
+			pvs:           inRegions(2*gig, 2*gig, 20*gig),
+			stripes:       2,
+			available:     8 * gig,
+			maxVolumeSize: 4 * gig,
+		},
+		"unaligned": {
+			pvs:           inRegions(gig+1, gig+lvmAlign-1),
+			stripes:       2,
+			available:     2 * gig,
+			maxVolumeSize: 2 * gig,
+		},
+		"too few regions": {
+			pvs: []physicalVolume{
+				{name: "/dev/pmem0", region: "region0", free: 10 * gig},
+				{name: "/dev/pmem0.1", region: "region0", free: 10 * gig},
+			},
+			stripes: 2,
+		},
+		"two PVs in one region": {
+			pvs: []physicalVolume{
+				{name: "/dev/pmem0", region: "region0", free: 4 * gig},
+				{name: "/dev/pmem0.1", region: "region0", free: 6 * gig},
+				{name: "/dev/pmem1", region: "region1", free: 10 * gig},
+			},
+			stripes:       2,
+			available:     20 * gig,
+			maxVolumeSize: 12 * gig,
+		},
+	}
+
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			available, maxVolumeSize := stripedCapacity(tc.pvs, tc.stripes)
+			assert.Equal(t, tc.available, available, "available")
+			assert.Equal(t, tc.maxVolumeSize, maxVolumeSize, "maximum volume size")
+		})
+	}
+}
+
+func TestStripePVs(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	pvs := []physicalVolume{
+		{name: "/dev/pmem0", region: "region0", free: 4 * gig},
+		{name: "/dev/pmem0.1", region: "region0", free: 6 * gig},
+		{name: "/dev/pmem1", region: "region1", free: 2 * gig},
+		{name: "/dev/pmem2", region: "region2", free: 8 * gig},
+	}
+	assert.Equal(t, []string{"/dev/pmem2", "/dev/pmem0.1"}, stripePVs(pvs, 2, 12*gig), "one PV in each of the two largest regions")
+	assert.Nil(t, stripePVs(pvs, 2, 14*gig), "too large")
+	assert.Equal(t, []string{"/dev/pmem2", "/dev/pmem0.1", "/dev/pmem1"}, stripePVs(pvs, 3, 6*gig), "three regions")
+	assert.Nil(t, stripePVs(pvs, 4, 4*gig), "too few regions")
+}
+
+func TestParsePVSOutput(t *testing.T) {
+	output := `  pmem-csi            /dev/pmem0   1073741824
+  pmem-csi            /dev/pmem1   536870912
+  ndbus0region0fsdax  /dev/pmem2   4194304
+                      /dev/pmem3   0
+  other               /dev/sda1    8388608
+`
+	pvs, err := parsePVSOutput(output, []string{"pmem-csi", "ndbus0region0fsdax"})
+	require.NoError(t, err, "parse output")
+	assert.Equal(t, map[string][]physicalVolume{
+		"pmem-csi": {
+			{name: "/dev/pmem0", region: "/dev/pmem0", free: 1073741824},
+			{name: "/dev/pmem1", region: "/dev/pmem1", free: 536870912},
+		},
+		"ndbus0region0fsdax": {
+			{name: "/dev/pmem2", region: "/dev/pmem2", free: 4194304},
+		},
+	}, pvs)
+}
+
+func TestGetPVFree(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	bin := t.TempDir()
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	pvs := `#!/bin/sh
+echo "  pmem-csi /dev/pmem0 1073741824"
+echo "  pmem-csi /dev/pmem0.1 536870912"
+echo "  pmem-csi /dev/pmem1 4194304"
+echo "  pmem-csi /dev/sda1 8388608"
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "pvs"), []byte(pvs), 0700))
+	os.Setenv("PATH", bin+":"+path)
+
+	region := func(name string, blockDevices ...string) *ndctlfake.Region {
+		r := &ndctlfake.Region{
+			DeviceName_: name,
+			Enabled_:    true,
+			Type_:       ndctl.PmemRegion,
+		}
+		for _, blockDevice := range blockDevices {
+			r.Namespaces_ = append(r.Namespaces_, &ndctlfake.Namespace{
+				BlockDeviceName_: blockDevice,
+				Enabled_:         true,
+			})
+		}
+		return r
+	}
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: []ndctl.Region{
+			region("region0", "pmem0", "pmem0.1"),
+			region("region1", "pmem1"),
+		}}},
+	})
+	oldContext := newNdctlContext
+	defer func() {
+		newNdctlContext = oldContext
+	}()
+	newNdctlContext = func() (ndctl.Context, error) {
+		return ndctx, nil
+	}
+
+	pvFree, err := getPVFree(ctx, []string{"pmem-csi"})
+	require.NoError(t, err, "get PVs")
+	assert.Equal(t, map[string][]physicalVolume{
+		"pmem-csi": {
+			{name: "/dev/pmem0", region: "region0", free: 1073741824},
+			{name: "/dev/pmem0.1", region: "region0", free: 536870912},
+			{name: "/dev/pmem1", region: "region1", free: 4194304},
+			{name: "/dev/sda1", region: "/dev/sda1", free: 8388608},
+		},
+	}, pvFree)
+}
+
+func TestVolumeGroupLayout(t *testing.T) {
+	var layout VolumeGroupLayout
+	require.NoError(t, layout.Set("node"), "node")
+	assert.Equal(t, VolumeGroupPerNode, layout)
+	assert.Error(t, layout.Set("socket"), "socket")
+}
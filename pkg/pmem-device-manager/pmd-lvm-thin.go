@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// thinPoolName is the name of the thin pool logical volume in each
+// volume group.
+const thinPoolName = "pmem-csi-thinpool"
+
+var thinPoolArgs = []string{"--noheadings", "--nosuffix", "--units", "B", "--separator", ",", "-o", "vg_name,lv_name,lv_size,pool_lv,data_percent"}
+
+// ThinPool configures thin provisioning in LVM mode. Then all free
+// space in a volume group is used for a thin pool and volumes get
+// allocated from it on demand.
+type ThinPool struct {
+	// Overcommit is the percentage of the physical size of a
+	// thin pool that may be allocated to volumes. 100 disables
+	// overcommitment.
+	Overcommit uint
+	// Threshold is the data usage of a thin pool in percent at
+	// which no new volumes get created in it and warnings get
+	// logged.
+	Threshold uint
+}
+
+func (t ThinPool) validate() error {
+	if t.Overcommit < 100 {
+		return fmt.Errorf("invalid thin pool overcommit %d%%, must be at least 100%%", t.Overcommit)
+	}
+	if t.Threshold == 0 || t.Threshold > 100 {
+		return fmt.Errorf("invalid thin pool threshold %d%%, must be 1..100", t.Threshold)
+	}
+	return nil
+}
+
+type thinPoolInfo struct {
+	// size is the physical size of the pool.
+	size uint64
+	// used is the physical space used by volumes.
+	used uint64
+	// allocated is the sum of the sizes of all volumes.
+	allocated uint64
+}
+
+// aboveThreshold returns true if the pool is too full for new volumes.
+func (p thinPoolInfo) aboveThreshold(t ThinPool) bool {
+	return p.used*100 >= p.size*uint64(t.Threshold)
+}
+
+// free returns how much space may still be allocated for new volumes.
+func (p thinPoolInfo) free(t ThinPool) uint64 {
+	limit := p.size * uint64(t.Overcommit) / 100
+	if p.aboveThreshold(t) || p.allocated >= limit {
+		return 0
+	}
+	return limit - p.allocated
+}
+
+// setupThinPools ensures that each volume group has a thin pool
+// which covers all of its free space.
+func setupThinPools(ctx context.Context, volumeGroups []string) error {
+	ctx, logger := pmemlog.WithName(ctx, "setupThinPools")
+	if len(volumeGroups) == 0 {
+		return nil
+	}
+	pools, err := getThinPools(ctx, volumeGroups)
+	if err != nil {
+		return err
+	}
+	vgs, err := getVolumeGroups(ctx, volumeGroups)
+	if err != nil {
+		return err
+	}
+	for _, vg := range vgs {
+		if _, ok := pools[vg.name]; !ok {
+			logger.V(3).Info("Creating thin pool", "vg", vg.name)
+			// Zeroing ensures that volumes never see data of
+			// deleted volumes.
+			if _, err := pmemexec.RunCommand(ctx, "lvcreate", "--type", "thin-pool", "--zero", "y", "-l", "100%FREE", "-n", thinPoolName, vg.name); err != nil {
+				return fmt.Errorf("create thin pool in volume group '%s': %v", vg.name, err)
+			}
+			continue
+		}
+		if vg.free >= lvmAlign {
+			logger.V(3).Info("Extending thin pool", "vg", vg.name, "free", pmemlog.CapacityRef(int64(vg.free)))
+			if _, err := pmemexec.RunCommand(ctx, "lvextend", "-l", "+100%FREE", vg.name+"/"+thinPoolName); err != nil {
+				return fmt.Errorf("extend thin pool in volume group '%s': %v", vg.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// getThinPools returns information about the thin pools in the given
+// volume groups, indexed by volume group name.
+func getThinPools(ctx context.Context, volumeGroups []string) (map[string]*thinPoolInfo, error) {
+	if len(volumeGroups) == 0 {
+		// lvs would list all volume groups.
+		return map[string]*thinPoolInfo{}, nil
+	}
+	args := append(thinPoolArgs, volumeGroups...)
+	output, err := pmemexec.RunCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	return parseThinPoolOutput(output)
+}
+
+// lvs options "vg_name,lv_name,lv_size,pool_lv,data_percent" with "," as separator
+func parseThinPoolOutput(output string) (map[string]*thinPoolInfo, error) {
+	pools := map[string]*thinPoolInfo{}
+	allocated := map[string]uint64{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("failed to parse lvs output: %q", line)
+		}
+		vgName, lvName, poolLV := fields[0], fields[1], fields[3]
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse size in lvs output %q: %v", line, err)
+		}
+		switch {
+		case lvName == thinPoolName:
+			percent, err := strconv.ParseFloat(fields[4], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse data percent in lvs output %q: %v", line, err)
+			}
+			pools[vgName] = &thinPoolInfo{
+				size: size,
+				used: uint64(float64(size) * percent / 100),
+			}
+		case poolLV == thinPoolName:
+			allocated[vgName] += size
+		}
+	}
+	for vgName, p := range pools {
+		p.allocated = allocated[vgName]
+	}
+	return pools, nil
+}
+
+// isThinVolume returns true if the logical volume is allocated from
+// the thin pool.
+func isThinVolume(ctx context.Context, path string) (bool, error) {
+	output, err := pmemexec.RunCommand(ctx, "lvs", "--noheadings", "-o", "pool_lv", path)
+	if err != nil {
+		return false, fmt.Errorf("lvs failure: %v", err)
+	}
+	return strings.TrimSpace(output) == thinPoolName, nil
+}
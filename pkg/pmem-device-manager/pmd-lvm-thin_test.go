@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThinPoolOutput(t *testing.T) {
+	output := `  ndbus0region0fsdax,pmem-csi-thinpool,1073741824,,25.00
+  ndbus0region0fsdax,pvc-aa-bb,1073741824,pmem-csi-thinpool,12.50
+  ndbus0region0fsdax,pvc-cc-dd,536870912,pmem-csi-thinpool,25.00
+  ndbus0region0fsdax,pvc-ee-ff,536870912,,
+  ndbus0region1fsdax,pvc-gg-hh,536870912,,
+`
+	pools, err := parseThinPoolOutput(output)
+	require.NoError(t, err, "parse output")
+	assert.Equal(t, map[string]*thinPoolInfo{
+		"ndbus0region0fsdax": {
+			size:      1073741824,
+			used:      268435456,
+			allocated: 1610612736,
+		},
+	}, pools)
+
+	_, err = parseThinPoolOutput("ndbus0region0fsdax,pmem-csi-thinpool,1073741824")
+	assert.Error(t, err, "missing fields")
+}
+
+func TestThinPoolFree(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	pool := thinPoolInfo{size: 10 * gig, used: 5 * gig, allocated: 15 * gig}
+	assert.Equal(t, uint64(0), pool.free(ThinPool{Overcommit: 100, Threshold: 90}), "no overcommit")
+	assert.Equal(t, 5*gig, pool.free(ThinPool{Overcommit: 200, Threshold: 90}), "overcommit")
+	assert.Equal(t, uint64(0), pool.free(ThinPool{Overcommit: 200, Threshold: 50}), "above threshold")
+	assert.Error(t, ThinPool{Overcommit: 50, Threshold: 90}.validate(), "overcommit below 100")
+	assert.Error(t, ThinPool{Overcommit: 100, Threshold: 0}.validate(), "zero threshold")
+}
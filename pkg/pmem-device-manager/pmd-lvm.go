@@ -8,6 +8,7 @@ import (
 	"strings"
 	"sync"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -17,6 +18,7 @@ import (
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	"github.com/intel/pmem-csi/pkg/tracing"
 )
 
 const (
@@ -25,15 +27,42 @@ const (
 
 	// special alt name that a namespace must have to be managed by PMEM-CSI.
 	pmemCSINamespaceName = "pmem-csi"
+
+	// name of the volume group with the namespaces of all regions.
+	nodeVGName = "pmem-csi"
 )
 
 type pmemLvm struct {
+	pmemPercentage uint
+	pools          Pools
+	layout         VolumeGroupLayout
+	// thinPool is nil without thin provisioning.
+	thinPool *ThinPool
+	// volumeGroups gets read by Healthz without holding lvmMutex,
+	// so changing it also requires holding vgMutex.
 	volumeGroups []string
-	devices      map[string]*PmemDeviceInfo
+	vgMutex      sync.RWMutex
+	// regions maps volume group names to their region.
+	regions map[string]regionInfo
+	devices map[string]*PmemDeviceInfo
+	// recovery backs up the metadata after each change.
+	recovery metadataRecovery
+	// capacity caches GetCapacity results for different stripe counts.
+	capacity capacityCache
+}
+
+// regionInfo describes the region of a volume group.
+type regionInfo struct {
+	name           string
+	bus            string
+	numaNode       int
+	interleaveWays uint64
 }
 
 var _ PmemDeviceManager = &pmemLvm{}
-var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size", "--units", "B"}
+var _ Rescanner = &pmemLvm{}
+var _ MediaErrors = &pmemLvm{}
+var lvsArgs = []string{"--noheadings", "--nosuffix", "-o", "lv_name,lv_path,lv_size,lv_uuid,lv_tags", "--units", "B"}
 var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_free", "--units", "B"}
 
 // mutex to synchronize all LVM calls
@@ -44,60 +73,212 @@ var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_f
 var lvmMutex = &sync.Mutex{}
 
 // NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
-func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
-	ctx, logger := pmemlog.WithName(ctx, "LVM-New")
+func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-New")
+	ctx, span := tracing.Start(ctx, "LVM-New")
+	defer span.End()
 
 	if pmemPercentage > 100 {
 		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
 	}
+	thinPool := opts.ThinPool
+	if thinPool != nil {
+		if err := thinPool.validate(); err != nil {
+			return nil, err
+		}
+	}
+	layout := opts.Layout
+	if layout == "" {
+		layout = VolumeGroupPerRegion
+	}
+	if layout == VolumeGroupPerNode && len(opts.Pools) > 0 {
+		return nil, errors.New("pools are not supported when using one volume group per node")
+	}
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
 
-	ndctx, err := ndctl.NewContext()
+	// Must happen before setting up volume groups, which would
+	// otherwise create new ones on top of broken ones.
+	recovery := newMetadataRecovery(opts)
+	if err := recovery.repair(ctx); err != nil {
+		return nil, err
+	}
+
+	volumeGroups, regions, err := setupVolumeGroups(ctx, pmemPercentage, layout)
+	if err != nil {
+		return nil, err
+	}
+	if thinPool != nil {
+		if err := setupThinPools(ctx, volumeGroups); err != nil {
+			return nil, err
+		}
+	}
+	recovery.backup(ctx, volumeGroups...)
+
+	dm, err := newPmemDeviceManagerLVMForVGs(ctx, pmemPercentage, volumeGroups)
 	if err != nil {
 		return nil, err
 	}
+	lvm := dm.(*pmemLvm)
+	lvm.pools = opts.Pools
+	lvm.layout = layout
+	lvm.thinPool = thinPool
+	lvm.regions = regions
+	lvm.recovery = recovery
+	return lvm, nil
+}
+
+// setupVolumeGroups creates namespaces and volume groups in all
+// suitable regions as needed and returns the volume groups plus
+// the region of each volume group that belongs to only one region.
+// With one volume group per node, volume groups of individual
+// regions which were created earlier remain in use.
+func setupVolumeGroups(ctx context.Context, pmemPercentage uint, layout VolumeGroupLayout) ([]string, map[string]regionInfo, error) {
+	ctx, logger := pmemlog.WithName(ctx, "setupVolumeGroups")
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, nil, err
+	}
 	defer ndctx.Free()
 
 	volumeGroups := []string{}
-	for _, bus := range ndctx.GetBuses() {
-		for _, r := range bus.ActiveRegions() {
-			vgName := pmemcommon.VgName(bus, r)
-			if r.Type() != ndctl.PmemRegion {
-				logger.Info("Region is not suitable for fsdax, skipping it", "id", r.ID(), "device", r.DeviceName())
-				continue
-			}
-
-			if err := setupNS(ctx, r, pmemPercentage); err != nil {
-				return nil, err
+	regions := map[string]regionInfo{}
+	addVG := func(vgName string, r ndctl.Region) {
+		if _, err := pmemexec.RunCommand(ctx, "vgs", vgName); err != nil {
+			logger.V(5).Info("Volume group non-existent, skipping it", "vg", vgName)
+			return
+		}
+		for _, existing := range volumeGroups {
+			if existing == vgName {
+				return
 			}
-			if err := setupVG(ctx, r, vgName); err != nil {
-				return nil, err
+		}
+		volumeGroups = append(volumeGroups, vgName)
+		if r != nil {
+			regions[vgName] = regionInfo{
+				name:           r.DeviceName(),
+				bus:            r.Bus().DeviceName(),
+				numaNode:       r.NumaNode(),
+				interleaveWays: r.InterleaveWays(),
 			}
-			if _, err := pmemexec.RunCommand(ctx, "vgs", vgName); err != nil {
-				logger.V(5).Info("Volume group non-existent, skipping it", "vg", vgName)
-			} else {
-				volumeGroups = append(volumeGroups, vgName)
+		}
+	}
+	for _, r := range sortedRegions(ndctx) {
+		vgName := pmemcommon.VgName(r.Bus(), r)
+		if r.Type() != ndctl.PmemRegion {
+			logger.Info("Region is not suitable for fsdax, skipping it", "id", r.ID(), "device", r.DeviceName())
+			continue
+		}
+
+		if err := setupNS(ctx, r, pmemPercentage); err != nil {
+			return nil, nil, err
+		}
+		if layout == VolumeGroupPerNode {
+			addVG(vgName, r)
+			if err := setupVG(ctx, r, nodeVGName); err != nil {
+				return nil, nil, err
 			}
+			addVG(nodeVGName, nil)
+			continue
 		}
+		if err := setupVG(ctx, r, vgName); err != nil {
+			return nil, nil, err
+		}
+		addVG(vgName, r)
+	}
+	return volumeGroups, regions, nil
+}
+
+// Rescan sets up regions and namespaces which were added since the
+// last scan. New volume groups are used for volumes immediately,
+// existing ones get extended.
+func (lvm *pmemLvm) Rescan(ctx context.Context) (bool, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-Rescan")
+	ctx, span := tracing.Start(ctx, "LVM-Rescan")
+	defer span.End()
+	defer lvm.capacity.invalidate()
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	volumeGroups, regions, err := setupVolumeGroups(ctx, lvm.pmemPercentage, lvm.layout)
+	if err != nil {
+		return false, err
+	}
+	if lvm.thinPool != nil {
+		// Also grows the thin pools of extended volume groups.
+		if err := setupThinPools(ctx, volumeGroups); err != nil {
+			return false, err
+		}
+	}
+	lvm.recovery.backup(ctx, volumeGroups...)
+	if strings.Join(volumeGroups, ",") == strings.Join(lvm.volumeGroups, ",") {
+		return false, nil
+	}
+	if err := tagLogicalVolumes(ctx, volumeGroups...); err != nil {
+		return false, fmt.Errorf("tag logical volumes: %v", err)
 	}
+	devices, err := listDevices(ctx, volumeGroups...)
+	if err != nil {
+		return false, err
+	}
+	logger.V(2).Info("Volume groups changed", "old", lvm.volumeGroups, "new", volumeGroups)
+	lvm.vgMutex.Lock()
+	lvm.volumeGroups = volumeGroups
+	lvm.vgMutex.Unlock()
+	lvm.regions = regions
+	lvm.devices = devices
+	return true, nil
+}
 
-	return newPmemDeviceManagerLVMForVGs(ctx, volumeGroups)
+// filterVolumeGroups returns those of the volume groups of a single
+// region for which keep returns true.
+func (lvm *pmemLvm) filterVolumeGroups(volumeGroups []string, keep func(r regionInfo) bool) []string {
+	var result []string
+	for _, vgName := range volumeGroups {
+		if r, ok := lvm.regions[vgName]; ok && keep(r) {
+			result = append(result, vgName)
+		}
+	}
+	return result
+}
+
+// poolVolumeGroups returns the volume groups that may be used for a
+// volume in the pool, all of them if the pool is empty.
+func (lvm *pmemLvm) poolVolumeGroups(pool string) ([]string, error) {
+	if pool == "" {
+		return lvm.volumeGroups, nil
+	}
+	if _, ok := lvm.pools[pool]; !ok {
+		return nil, fmt.Errorf("%w: %q", pmemerr.UnknownPool, pool)
+	}
+	var volumeGroups []string
+	for _, vgName := range lvm.volumeGroups {
+		if lvm.pools.Contains(pool, lvm.regions[vgName].name) {
+			volumeGroups = append(volumeGroups, vgName)
+		}
+	}
+	return volumeGroups, nil
 }
 
 func (pmem *pmemLvm) GetMode() api.DeviceMode {
 	return api.DeviceModeLVM
 }
 
-func newPmemDeviceManagerLVMForVGs(ctx context.Context, volumeGroups []string) (PmemDeviceManager, error) {
+func newPmemDeviceManagerLVMForVGs(ctx context.Context, pmemPercentage uint, volumeGroups []string) (PmemDeviceManager, error) {
+	if err := tagLogicalVolumes(ctx, volumeGroups...); err != nil {
+		return nil, fmt.Errorf("tag logical volumes: %v", err)
+	}
 	devices, err := listDevices(ctx, volumeGroups...)
 	if err != nil {
 		return nil, err
 	}
 
 	return &pmemLvm{
-		volumeGroups: volumeGroups,
-		devices:      devices,
+		pmemPercentage: pmemPercentage,
+		volumeGroups:   volumeGroups,
+		devices:        devices,
 	}, nil
 }
 
@@ -108,8 +289,32 @@ type vgInfo struct {
 }
 
 func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err error) {
+	return lvm.cachedCapacity(ctx, 1)
+}
+
+var _ StripedCapacity = &pmemLvm{}
+
+func (lvm *pmemLvm) GetStripedCapacity(ctx context.Context, stripes uint) (capacity Capacity, err error) {
+	return lvm.cachedCapacity(ctx, stripes)
+}
+
+func (lvm *pmemLvm) cachedCapacity(ctx context.Context, stripes uint) (Capacity, error) {
+	return lvm.capacity.get(stripes, func() (Capacity, error) {
+		return lvm.getCapacity(ctx, stripes)
+	})
+}
+
+func (lvm *pmemLvm) getCapacity(ctx context.Context, stripes uint) (capacity Capacity, err error) {
 	logger := klog.FromContext(ctx).WithName("LVM-GetCapacity")
 	ctx = klog.NewContext(ctx, logger)
+	ctx, span := tracing.Start(ctx, "LVM-GetCapacity")
+	defer func() { tracing.End(span, err) }()
+	defer func() {
+		// Striped capacity is not what the gauges represent.
+		if err == nil && stripes <= 1 {
+			recordCapacity(api.DeviceModeLVM, capacity)
+		}
+	}()
 
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -119,14 +324,47 @@ func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err err
 	if err != nil {
 		return
 	}
+	var space *spaceInfo
+	space, err = lvm.getSpace(ctx, lvm.volumeGroups, stripes)
+	if err != nil {
+		return
+	}
+	if lvm.thinPool != nil {
+		for vgName, pool := range space.pools {
+			if pool.aboveThreshold(*lvm.thinPool) {
+				logger.Info("Warning: thin pool is running out of space, no new volumes will be created in it",
+					"vg", vgName,
+					"size", pmemlog.CapacityRef(int64(pool.size)),
+					"used", pmemlog.CapacityRef(int64(pool.used)),
+					"threshold-percent", lvm.thinPool.Threshold)
+			}
+		}
+	}
 
 	for _, vg := range vgs {
-		if vg.free > capacity.MaxVolumeSize {
-			capacity.MaxVolumeSize = vg.free / lvmAlign * lvmAlign
+		free, maxVolumeSize, physical := lvm.allocatable(vg, space, stripes)
+		maxVolumeSize = maxVolumeSize / lvmAlign * lvmAlign
+		if maxVolumeSize > capacity.MaxVolumeSize {
+			capacity.MaxVolumeSize = maxVolumeSize
 		}
-		capacity.Available += vg.free
+		capacity.Available += free
+		capacity.PhysicalAvailable += physical
 		capacity.Managed += vg.size
-		capacity.Total, err = totalSize()
+		detail := CapacityDetail{
+			VolumeGroup:   vg.name,
+			MaxVolumeSize: maxVolumeSize,
+			Available:     free,
+			Total:         vg.size,
+			NumaNode:      -1,
+		}
+		if r, ok := lvm.regions[vg.name]; ok {
+			detail.Region = r.name
+			detail.Bus = r.bus
+			detail.NumaNode = r.numaNode
+			detail.InterleaveWays = r.interleaveWays
+		}
+		capacity.Details = append(capacity.Details, detail)
+		capacity.Total, capacity.SystemRAM, err = totalSize()
 		if err != nil {
 			return
 		}
@@ -135,8 +373,68 @@ func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err err
 	return capacity, nil
 }
 
-func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+// spaceInfo contains information about volume groups that is needed
+// in addition to vgInfo to determine how much space is available.
+type spaceInfo struct {
+	// pools is only set with thin provisioning.
+	pools map[string]*thinPoolInfo
+	// pvs is only set for striped volumes.
+	pvs map[string][]physicalVolume
+}
+
+func (lvm *pmemLvm) getSpace(ctx context.Context, volumeGroups []string, stripes uint) (*spaceInfo, error) {
+	var space spaceInfo
+	var err error
+	switch {
+	case lvm.thinPool != nil:
+		space.pools, err = getThinPools(ctx, volumeGroups)
+	case stripes > 1 && lvm.layout == VolumeGroupPerNode:
+		space.pvs, err = getPVFree(ctx, volumeGroups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &space, nil
+}
+
+// allocatable returns how much space can be allocated for new volumes
+// with the given number of stripes in the volume group, the size of
+// the largest such volume, and how much space is physically free. All
+// are the same for volumes without striping and thin provisioning.
+func (lvm *pmemLvm) allocatable(vg vgInfo, space *spaceInfo, stripes uint) (free, maxVolumeSize, physical uint64) {
+	switch {
+	case lvm.thinPool != nil:
+		pool, ok := space.pools[vg.name]
+		if !ok || pool.used > pool.size {
+			return 0, 0, 0
+		}
+		physical = pool.size - pool.used
+		if stripes > 1 {
+			// Thin volumes cannot be striped.
+			return 0, 0, physical
+		}
+		free = pool.free(*lvm.thinPool)
+		return free, free, physical
+	case stripes > 1:
+		// Volume groups of a single region are not used
+		// for striping.
+		if lvm.layout != VolumeGroupPerNode || vg.name != nodeVGName {
+			return 0, 0, vg.free
+		}
+		free, maxVolumeSize = stripedCapacity(space.pvs[vg.name], stripes)
+		return free, maxVolumeSize, vg.free
+	default:
+		return vg.free, vg.free, vg.free
+	}
+}
+
+func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size, limit uint64, params parameters.Volume) (_ uint64, finalErr error) {
 	ctx, logger := pmemlog.WithName(ctx, "LVM-CreateDevice")
+	ctx, span := tracing.Start(ctx, "LVM-CreateDevice", attribute.String("volume-id", volumeId))
+	defer span.End()
+	// Free space changes, also when failing halfway.
+	defer lvm.capacity.invalidate()
+	defer func() { countDeviceError(opCreateDevice, finalErr) }()
 
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -148,30 +446,80 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 	if _, err := lvm.getDevice(volumeId); err == nil {
 		return 0, pmemerr.DeviceExists
 	}
-	vgs, err := getVolumeGroups(ctx, lvm.volumeGroups)
+	volumeGroups, err := lvm.poolVolumeGroups(params.GetPool())
+	if err != nil {
+		return 0, err
+	}
+	if node := params.GetNumaNode(); node >= 0 {
+		if lvm.layout == VolumeGroupPerNode {
+			return 0, fmt.Errorf("%w: NUMA node selection requires one volume group per region", pmemerr.NotSupported)
+		}
+		volumeGroups = lvm.numaNodeVolumeGroups(volumeGroups, node)
+	}
+	if bus := params.GetBus(); bus != "" {
+		if lvm.layout == VolumeGroupPerNode {
+			return 0, fmt.Errorf("%w: bus selection requires one volume group per region", pmemerr.NotSupported)
+		}
+		volumeGroups = lvm.busVolumeGroups(volumeGroups, bus)
+	}
+	if len(volumeGroups) == 0 {
+		// Calling vgs without volume groups would list all of them.
+		return 0, pmemerr.NotEnoughSpace
+	}
+	stripes := params.GetStripes()
+	if stripes > 1 && (lvm.thinPool != nil || lvm.layout != VolumeGroupPerNode) {
+		return 0, fmt.Errorf("%w: striping requires one volume group per node and no thin provisioning", pmemerr.NotSupported)
+	}
+	vgs, err := getVolumeGroups(ctx, volumeGroups)
+	if err != nil {
+		return 0, err
+	}
+	space, err := lvm.getSpace(ctx, volumeGroups, stripes)
 	if err != nil {
 		return 0, err
 	}
 	// Adjust up to next alignment boundary, if not aligned already.
-	actual := (size + lvmAlign - 1) / lvmAlign * lvmAlign
+	// Each stripe must be aligned.
+	align := lvmAlign * uint64(stripes)
+	actual := (size + align - 1) / align * align
 	if actual == 0 {
-		actual = lvmAlign
+		actual = align
 	}
 	if actual != size {
 		logger.V(3).Info("Increased size to satisfy LVM alignment",
 			"old-size", pmemlog.CapacityRef(int64(size)),
 			"new-size", pmemlog.CapacityRef(int64(actual)),
-			"alignment", pmemlog.CapacityRef(int64(lvmAlign)))
+			"alignment", pmemlog.CapacityRef(int64(align)))
+	}
+	if limit > 0 && actual > limit {
+		return 0, fmt.Errorf("%w: size %d aligned to %d bytes exceeds limit %d", pmemerr.OutOfRange, size, align, limit)
 	}
 	strSz := strconv.FormatUint(actual, 10) + "B"
 
 	for _, vg := range vgs {
 		// use first Vgroup with enough available space
-		if vg.free >= actual {
+		if _, maxVolumeSize, _ := lvm.allocatable(vg, space, stripes); maxVolumeSize >= actual {
 			// In some container environments clearing device fails with race condition.
 			// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
 			// lvcreate takes size in MBytes if no unit
-			if _, err := pmemexec.RunCommand(ctx, "lvcreate", "-Zn", "-L", strSz, "-n", volumeId, vg.name); err != nil {
+			args := []string{"-Zn", "-L", strSz, "-n", volumeId, "--addtag", lvTag}
+			var pvs []string
+			if stripes > 1 {
+				// Without a list of physical volumes, lvcreate
+				// might put two stripes into the same region.
+				pvs = stripePVs(space.pvs[vg.name], stripes, actual)
+				if pvs == nil {
+					continue
+				}
+				args = append(args, "-i", strconv.FormatUint(uint64(stripes), 10), "-I", stripeSize)
+			}
+			args = append(args, vg.name)
+			args = append(args, pvs...)
+			if lvm.thinPool != nil {
+				// The thin pool zeroes blocks when allocating them.
+				args = []string{"-V", strSz, "-T", vg.name + "/" + thinPoolName, "-n", volumeId, "--addtag", lvTag}
+			}
+			if _, err := pmemexec.RunCommand(ctx, "lvcreate", args...); err != nil {
 				logger.V(3).Info("lvcreate failed with error, trying next free region", "error", err)
 			} else {
 				// clear start of device to avoid old data being recognized as file system
@@ -182,11 +530,12 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 				if err := waitDeviceAppears(ctx, device); err != nil {
 					return 0, err
 				}
-				if err := clearDevice(ctx, device, false); err != nil {
-					return 0, fmt.Errorf("clear device %q: %v", volumeId, err)
+				if err := clearDevice(ctx, device, false, false); err != nil {
+					return 0, fmt.Errorf("clear device %q: %w", volumeId, err)
 				}
 
 				lvm.devices[device.VolumeId] = device
+				lvm.recovery.backup(ctx, vg.name)
 
 				return actual, nil
 			}
@@ -195,8 +544,13 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 	return 0, pmemerr.NotEnoughSpace
 }
 
-func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush bool) error {
+func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush, verify bool) (finalErr error) {
 	ctx, _ = pmemlog.WithName(ctx, "LVM-DeleteDevice")
+	ctx, span := tracing.Start(ctx, "LVM-DeleteDevice", attribute.String("volume-id", volumeId))
+	defer span.End()
+	defer lvm.capacity.invalidate()
+	operation := opDeleteDevice
+	defer func() { countDeviceError(operation, finalErr) }()
 
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -210,18 +564,35 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 		}
 		return err
 	}
-	if err := clearDevice(ctx, device, flush); err != nil {
+	clear := clearDevice
+	if flush && lvm.thinPool != nil {
+		// Overwriting a thin volume would allocate all of it.
+		thin, err := isThinVolume(ctx, device.Path)
+		if err != nil {
+			return err
+		}
+		if thin {
+			clear = func(ctx context.Context, device *PmemDeviceInfo, flush, verify bool) error {
+				return discardDevice(ctx, device, verify)
+			}
+		}
+	}
+	if err := clear(ctx, device, flush, verify); err != nil {
 		if errors.Is(err, pmemerr.DeviceNotFound) {
 			// Remove device from cache
 			delete(lvm.devices, volumeId)
 			return nil
 		}
+		if flush {
+			operation = opFlushDevice
+		}
 		return err
 	}
 
 	if _, err := pmemexec.RunCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
 		return err
 	}
+	lvm.recovery.backup(ctx, lvm.volumeGroups...)
 
 	// Remove device from cache
 	delete(lvm.devices, volumeId)
@@ -256,6 +627,24 @@ func (lvm *pmemLvm) getDevice(volumeId string) (*PmemDeviceInfo, error) {
 	return nil, pmemerr.DeviceNotFound
 }
 
+func (lvm *pmemLvm) RegionBadBlocks(ctx context.Context) (map[string]uint64, error) {
+	return regionBadBlocks(ctx)
+}
+
+func (lvm *pmemLvm) VolumeBadBlocks(ctx context.Context, volumeId string) (uint64, error) {
+	lvmMutex.Lock()
+	device, err := lvm.getDevice(volumeId)
+	lvmMutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	devices, err := lvDevices(ctx, device.Path)
+	if err != nil {
+		return 0, err
+	}
+	return namespaceBadBlocks(devices)
+}
+
 func getUncachedDevice(ctx context.Context, volumeId string, volumeGroup string) (*PmemDeviceInfo, error) {
 	devices, err := listDevices(ctx, volumeGroup)
 	if err != nil {
@@ -279,13 +668,15 @@ func listDevices(ctx context.Context, volumeGroups ...string) (map[string]*PmemD
 	return parseLVSOutput(output)
 }
 
-// lvs options "lv_name,lv_path,lv_size,lv_free"
+// lvs options "lv_name,lv_path,lv_size,lv_uuid,lv_tags". Logical volumes
+// without the lvTag were not created by PMEM-CSI and get skipped.
+// The field for the tags is empty for those without any tag.
 func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
 	devices := map[string]*PmemDeviceInfo{}
 	lines := strings.Split(output, "\n")
 	for _, line := range lines {
 		fields := strings.Fields(strings.TrimSpace(line))
-		if len(fields) != 3 {
+		if len(fields) != 5 || !hasLVTag(fields[4]) {
 			continue
 		}
 
@@ -293,6 +684,7 @@ func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
 		dev.VolumeId = fields[0]
 		dev.Path = fields[1]
 		dev.Size, _ = strconv.ParseUint(fields[2], 10, 64)
+		dev.UUID = fields[3]
 
 		devices[dev.VolumeId] = dev
 	}
@@ -336,6 +728,7 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 		"max-available-extent", pmemlog.CapacityRef(int64(r.MaxAvailableExtent())),
 		"may-use", pmemlog.CapacityRef(int64(canUse)))
 	// Subtract sizes of existing active namespaces with currently handled mode and owned by pmem-csi
+	var used uint64
 	for _, ns := range r.ActiveNamespaces() {
 		logger.V(3).Info("Existing namespace",
 			"usable-size", pmemlog.CapacityRef(int64(ns.Size())),
@@ -343,16 +736,34 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 			"mode", ns.Mode(),
 			"device", ns.DeviceName(),
 			"name", ns.Name())
-		if ns.Name() != pmemCSINamespaceName {
-			continue
+		if ns.Name() == pmemCSINamespaceName {
+			used += ns.RawSize()
 		}
-		used := ns.RawSize()
-		if used >= canUse {
-			logger.V(3).Info("All allowed space already in use by PMEM-CSI.")
-			canUse = 0
-			break
+	}
+	switch {
+	case used > canUse && percentage < 100:
+		// Namespaces may be a bit larger than requested
+		// because of alignment, so only warn when the
+		// difference is noticeable.
+		if used-canUse >= r.Size()/100 {
+			logger.Info("Warning: PMEM-CSI already uses more of the region than the percentage allows, reducing the percentage is not supported",
+				"region", r.DeviceName(),
+				"percentage", percentage,
+				"used", pmemlog.CapacityRef(int64(used)))
 		}
+		canUse = 0
+	case used >= canUse:
+		logger.V(3).Info("All allowed space already in use by PMEM-CSI.")
+		canUse = 0
+	case used > 0:
+		// The percentage was increased since the
+		// namespaces were created.
 		canUse -= used
+		logger.Info("Adding PMEM to the volume group because the percentage allows using more of the region",
+			"region", r.DeviceName(),
+			"percentage", percentage,
+			"used", pmemlog.CapacityRef(int64(used)),
+			"additional", pmemlog.CapacityRef(int64(canUse)))
 	}
 	// Because of overhead by alignment and extra space for page mapping, calculated available may show more than actual
 	if r.AvailableSize() < canUse {
@@ -383,6 +794,12 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 		if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", "/dev/"+ns.BlockDeviceName()); err != nil {
 			return fmt.Errorf("failed to wipe new namespace: %v", err)
 		}
+		// LVM mode uses the namespace anyway because it cannot
+		// choose where it gets placed. Volumes in it report the
+		// media errors as abnormal volume condition.
+		if count := ndctl.CountBadBlocks(ns.BadBlocks()); count > 0 {
+			logger.Info("Warning: new namespace has media errors", "namespace", ns.DeviceName(), "bad-blocks", count)
+		}
 	}
 
 	return nil
@@ -450,3 +867,58 @@ func setupVGForNamespaces(ctx context.Context, vgName string, devNames ...string
 	}
 	return nil
 }
+
+// RemoveVolumeGroups removes the volume groups of all regions and
+// the one of the node together with their logical volumes. Afterwards, the namespaces
+// that were created for LVM mode by the driver get destroyed.
+// Namespaces which were only added to a volume group by
+// ForceConvertRawNamespaces are left in fsdax mode.
+func RemoveVolumeGroups(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "RemoveVolumeGroups")
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	// Must be removed before destroying the namespaces of any region.
+	if _, err := pmemexec.RunCommand(ctx, "vgdisplay", nodeVGName); err == nil {
+		logger.V(2).Info("Removing volume group", "vg", nodeVGName)
+		if _, err := pmemexec.RunCommand(ctx, "vgremove", "--force", nodeVGName); err != nil {
+			return fmt.Errorf("failed to remove volume group '%s': %v", nodeVGName, err)
+		}
+	}
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Readonly() {
+				logger.V(3).Info("Skipped because read-only", "region", r.DeviceName())
+				continue
+			}
+			vgName := pmemcommon.VgName(bus, r)
+			if _, err := pmemexec.RunCommand(ctx, "vgdisplay", vgName); err != nil {
+				logger.V(5).Info("Volume group does not exist", "vg", vgName)
+			} else {
+				logger.V(2).Info("Removing volume group", "vg", vgName)
+				if _, err := pmemexec.RunCommand(ctx, "vgremove", "--force", vgName); err != nil {
+					return fmt.Errorf("failed to remove volume group '%s': %v", vgName, err)
+				}
+			}
+			for _, ns := range r.ActiveNamespaces() {
+				if ns.Name() != pmemCSINamespaceName {
+					continue
+				}
+				// Removes the physical volume signature.
+				devName := "/dev/" + ns.BlockDeviceName()
+				if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", devName); err != nil {
+					return fmt.Errorf("failed to wipe namespace '%s': %v", devName, err)
+				}
+				logger.V(2).Info("Destroying namespace", "namespace", ns.DeviceName(), "region", r.DeviceName())
+				if err := r.DestroyNamespace(ctx, ns, true); err != nil {
+					return fmt.Errorf("failed to destroy namespace '%s': %v", ns.DeviceName(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
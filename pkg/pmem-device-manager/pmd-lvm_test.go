@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestSetupNSPercentage(t *testing.T) {
+	gig := uint64(1024 * 1024 * 1024)
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "wipefs"), []byte("#!/bin/sh\n"), 0700))
+	os.Setenv("PATH", bin+":"+path)
+
+	testcases := map[string]struct {
+		used       uint64
+		percentage uint
+		expected   []uint64
+	}{
+		"new": {
+			percentage: 50,
+			expected:   []uint64{8 * gig},
+		},
+		"unchanged": {
+			used:       8 * gig,
+			percentage: 50,
+			expected:   []uint64{8 * gig},
+		},
+		"increased": {
+			used:       8 * gig,
+			percentage: 75,
+			expected:   []uint64{8 * gig, 4 * gig},
+		},
+		"reduced": {
+			used:       8 * gig,
+			percentage: 25,
+			expected:   []uint64{8 * gig},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			r := &ndctlfake.Region{
+				DeviceName_:         "region0",
+				Size_:               16 * gig,
+				AvailableSize_:      16*gig - tc.used,
+				MaxAvailableExtent_: 16*gig - tc.used,
+				Enabled_:            true,
+				Type_:               ndctl.PmemRegion,
+			}
+			if tc.used > 0 {
+				r.Namespaces_ = []ndctl.Namespace{
+					&ndctlfake.Namespace{
+						Name_:    pmemCSINamespaceName,
+						Size_:    tc.used,
+						Enabled_: true,
+						Mode_:    ndctl.FsdaxMode,
+					},
+				}
+			}
+			require.NoError(t, setupNS(ctx, r, tc.percentage), "setupNS")
+			var sizes []uint64
+			for _, ns := range r.ActiveNamespaces() {
+				assert.Equal(t, pmemCSINamespaceName, ns.Name(), "namespace name")
+				sizes = append(sizes, ns.RawSize())
+			}
+			assert.Equal(t, tc.expected, sizes, "namespace sizes")
+		})
+	}
+}
+
+func TestRemoveVolumeGroups(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	// Only the volume group of region0 exists.
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "vgdisplay"), []byte("#!/bin/sh\ntest \"$1\" = ndbus0region0fsdax\n"), 0700))
+	for _, cmd := range []string{"vgremove", "wipefs"} {
+		require.NoError(t, os.WriteFile(filepath.Join(bin, cmd), []byte("#!/bin/sh\necho "+cmd+" \"$@\" >>"+log+"\n"), 0700))
+	}
+	os.Setenv("PATH", bin+":"+path)
+
+	lvmNS := &ndctlfake.Namespace{
+		Name_:            pmemCSINamespaceName,
+		DeviceName_:      "namespace0.0",
+		BlockDeviceName_: "pmem0",
+		Size_:            gig,
+		Enabled_:         true,
+	}
+	otherNS := &ndctlfake.Namespace{
+		Name_:       "other",
+		DeviceName_: "namespace0.1",
+		Size_:       gig,
+		Enabled_:    true,
+	}
+	region0 := &ndctlfake.Region{
+		DeviceName_: "region0",
+		Size_:       4 * gig,
+		Enabled_:    true,
+		Type_:       ndctl.PmemRegion,
+		Namespaces_: []ndctl.Namespace{lvmNS, otherNS},
+	}
+	readonlyNS := &ndctlfake.Namespace{
+		Name_:       pmemCSINamespaceName,
+		DeviceName_: "namespace1.0",
+		Size_:       gig,
+		Enabled_:    true,
+	}
+	region1 := &ndctlfake.Region{
+		DeviceName_: "region1",
+		Size_:       4 * gig,
+		Enabled_:    true,
+		Readonly_:   true,
+		Type_:       ndctl.PmemRegion,
+		Namespaces_: []ndctl.Namespace{readonlyNS},
+	}
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: []ndctl.Region{region0, region1}}},
+	})
+	oldContext := newNdctlContext
+	defer func() {
+		newNdctlContext = oldContext
+	}()
+	newNdctlContext = func() (ndctl.Context, error) {
+		return ndctx, nil
+	}
+
+	require.NoError(t, RemoveVolumeGroups(ctx), "remove volume groups")
+	output, err := os.ReadFile(log)
+	require.NoError(t, err, "read command log")
+	assert.Equal(t, "vgremove --force ndbus0region0fsdax\nwipefs --all --force /dev/pmem0\n", string(output), "commands")
+	assert.Equal(t, []ndctl.Namespace{otherNS}, region0.ActiveNamespaces(), "remaining namespaces in region0")
+	assert.Equal(t, []ndctl.Namespace{readonlyNS}, region1.ActiveNamespaces(), "read-only region unchanged")
+}
@@ -6,6 +6,7 @@ import (
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 )
@@ -28,6 +29,15 @@ type PmemDeviceInfo struct {
 
 	// Size allocated for block device in bytes.
 	Size uint64
+
+	// Alignment is the mapping alignment of the namespace in
+	// bytes, 0 if unknown or not applicable (LVM mode).
+	Alignment uint64
+
+	// UUID is the UUID of the namespace or logical volume. A
+	// device that gets recreated with the same name has a
+	// different UUID. Empty if unknown.
+	UUID string
 }
 
 // Capacity contains information about PMEM. All sizes count bytes.
@@ -39,10 +49,76 @@ type Capacity struct {
 	// Available is the sum of all PMEM that could be used for
 	// volumes.
 	Available uint64
+	// PhysicalAvailable is the part of the PMEM that is not
+	// used yet. With thin provisioning in LVM mode, Available
+	// and MaxVolumeSize may be larger because of overcommitment,
+	// otherwise it is the same as Available.
+	PhysicalAvailable uint64
 	// Managed is all PMEM that is managed by the driver.
 	Managed uint64
 	// Total is all PMEM found by the driver.
 	Total uint64
+	// SystemRAM is the part of Total which the driver onlined as
+	// system RAM. It is not included in Managed.
+	SystemRAM uint64
+	// Details breaks down the capacity for each region (direct
+	// mode) or volume group (LVM mode). A volume must fit into
+	// one of them, which explains why MaxVolumeSize may be
+	// smaller than Available. Not provided by all device
+	// managers.
+	Details []CapacityDetail
+}
+
+// filter returns the capacity of those regions in the capacity
+// details for which keep returns true. Like the capacity of the whole
+// node, MaxVolumeSize is the maximum of the regions because a volume
+// must fit into one of them, while the other values are the sum. The
+// capacity is returned unmodified when there are no details.
+func (c Capacity) filter(keep func(detail CapacityDetail) bool) Capacity {
+	if len(c.Details) == 0 {
+		return c
+	}
+	result := Capacity{}
+	for _, detail := range c.Details {
+		if !keep(detail) {
+			continue
+		}
+		if detail.MaxVolumeSize > result.MaxVolumeSize {
+			result.MaxVolumeSize = detail.MaxVolumeSize
+		}
+		result.Available += detail.Available
+		result.Managed += detail.Total
+		result.Total += detail.Total
+		result.Details = append(result.Details, detail)
+	}
+	result.PhysicalAvailable = result.Available
+	return result
+}
+
+// CapacityDetail contains information about one region or volume
+// group. All sizes count bytes.
+type CapacityDetail struct {
+	// Region is the name of the region, empty for a volume group
+	// which spans several regions.
+	Region string `json:"region,omitempty"`
+	// Bus is the name of the NVDIMM bus of the region, empty for a
+	// volume group which spans several regions.
+	Bus string `json:"bus,omitempty"`
+	// VolumeGroup is the name of the volume group in LVM mode.
+	VolumeGroup string `json:"volumeGroup,omitempty"`
+	// MaxVolumeSize is the size of the largest volume that
+	// currently can be created in it.
+	MaxVolumeSize uint64 `json:"maxVolumeSize"`
+	// Available is the part that can be used for volumes.
+	Available uint64 `json:"available"`
+	// Total is the overall size.
+	Total uint64 `json:"total"`
+	// NumaNode is the NUMA node of the region, -1 if unknown or
+	// for a volume group which spans several regions.
+	NumaNode int `json:"numaNode"`
+	// InterleaveWays is the number of DIMMs that the region is
+	// interleaved across, 0 if unknown.
+	InterleaveWays uint64 `json:"interleaveWays,omitempty"`
 }
 
 func (c Capacity) GetCapacity(ctx context.Context) (Capacity, error) {
@@ -50,9 +126,10 @@ func (c Capacity) GetCapacity(ctx context.Context) (Capacity, error) {
 }
 
 func (c Capacity) String() string {
-	return fmt.Sprintf("%s maximum volume size, %s available, %s managed, %s total",
+	return fmt.Sprintf("%s maximum volume size, %s available, %s physically available, %s managed, %s total",
 		prettyPrintSize(c.MaxVolumeSize),
 		prettyPrintSize(c.Available),
+		prettyPrintSize(c.PhysicalAvailable),
 		prettyPrintSize(c.Managed),
 		prettyPrintSize(c.Total),
 	)
@@ -78,10 +155,12 @@ type PmemDeviceManager interface {
 	// GetName returns current device manager's operation mode
 	GetMode() api.DeviceMode
 
-	// CreateDevice creates a new block device with give name, size and namespace mode.
+	// CreateDevice creates a new block device with give name and size. The usage
+	// and pool are taken from the volume parameters.
 	// It returns the actual volume size which will always be at least as large as requested.
-	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists
-	CreateDevice(ctx context.Context, name string, size uint64, usage parameters.Usage) (uint64, error)
+	// A non-zero limit is the maximum for the actual size after alignment.
+	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists, ErrUnknownPool, ErrOutOfRange
+	CreateDevice(ctx context.Context, name string, size, limit uint64, params parameters.Volume) (uint64, error)
 
 	// GetDevice returns the block device information for given name
 	// Possible errors: ErrDeviceNotFound
@@ -89,22 +168,109 @@ type PmemDeviceManager interface {
 
 	// DeleteDevice deletes an existing block device with give name.
 	// If 'flush' is 'true', then the device data is zeroed before deleting the device
-	// Possible errors: ErrDeviceInUse
-	DeleteDevice(ctx context.Context, name string, flush bool) error
+	// If 'verify' is 'true', then the zeroed data is read back and the device is kept
+	// when that finds data.
+	// Possible errors: ErrDeviceInUse, ErrNotErased
+	DeleteDevice(ctx context.Context, name string, flush, verify bool) error
 
 	// ListDevices returns all the block devices information that was created by this device manager
 	ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error)
+
+	// Healthz checks that the storage stack underneath the device
+	// manager still works. It must not wait for other operations,
+	// which may take a long time while wiping a volume.
+	Healthz(ctx context.Context) error
+}
+
+// StripedCapacity is implemented by device managers which support
+// volumes that are striped across regions.
+type StripedCapacity interface {
+	// GetStripedCapacity returns information about local
+	// capacity for volumes with the given number of stripes.
+	GetStripedCapacity(ctx context.Context, stripes uint) (Capacity, error)
+}
+
+// DeviceShrinker is implemented by device managers which can reduce
+// the size of existing volumes.
+type DeviceShrinker interface {
+	// ShrinkDevice reduces the size of a device which is not in
+	// use and contains an ext4 filesystem. The filesystem gets
+	// shrunk first. Returns the actual new size, which may be
+	// larger than requested because of alignment.
+	// pmemerr.DeviceInUse is returned for devices which are
+	// mounted or otherwise in use, pmemerr.NotSupported for
+	// other filesystems.
+	ShrinkDevice(ctx context.Context, volumeId string, size uint64) (uint64, error)
+}
+
+// Options contains optional settings for New. The zero value is
+// valid.
+type Options struct {
+	// Pools are named subsets of the regions. Without them,
+	// volumes cannot ask for a pool.
+	Pools Pools
+	// ThinPool enables thin provisioning in LVM mode if not nil.
+	ThinPool *ThinPool
+	// Layout determines the volume groups in LVM mode.
+	Layout VolumeGroupLayout
+	// Endpoint is the gRPC endpoint of an external device manager.
+	Endpoint string
+	// WarmPool defines the namespaces which are kept ready for
+	// new volumes in direct mode.
+	WarmPool WarmPool
+	// MetadataBackupDir enables backups of the LVM metadata in
+	// that directory. During startup, corrupt metadata gets
+	// restored from those backups.
+	MetadataBackupDir string
+	// EventRecorder, if not nil, is used for events about the
+	// node with NodeName, for example after restoring LVM
+	// metadata.
+	EventRecorder record.EventRecorder
+	NodeName      string
+	// SystemRAMPercentage is the percentage of each PMEM region
+	// which gets onlined as system RAM instead of being used for
+	// volumes. Zero disables that.
+	SystemRAMPercentage uint
 }
 
 // New creates a new device manager for the given mode and percentage.
-func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint) (PmemDeviceManager, error) {
+func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+	if mode != api.DeviceModeLVM {
+		if opts.ThinPool != nil {
+			return nil, fmt.Errorf("thin provisioning is not supported for device mode %q", mode)
+		}
+		if opts.Layout != "" && opts.Layout != VolumeGroupPerRegion {
+			return nil, fmt.Errorf("volume group layout %q is not supported for device mode %q", opts.Layout, mode)
+		}
+	}
+	if mode != api.DeviceModeDirect && len(opts.WarmPool) > 0 {
+		return nil, fmt.Errorf("warm pool is not supported for device mode %q", mode)
+	}
+	if mode != api.DeviceModeLVM && opts.MetadataBackupDir != "" {
+		return nil, fmt.Errorf("LVM metadata backups are not supported for device mode %q", mode)
+	}
+	if opts.SystemRAMPercentage > 0 {
+		if mode != api.DeviceModeLVM && mode != api.DeviceModeDirect {
+			return nil, fmt.Errorf("system RAM is not supported for device mode %q", mode)
+		}
+		// Must happen first, the device managers use the
+		// remaining space.
+		if err := setupSystemRAM(ctx, opts.SystemRAMPercentage); err != nil {
+			return nil, err
+		}
+	}
+	if mode == api.DeviceModeExternal && len(opts.Pools) > 0 {
+		return nil, fmt.Errorf("pools are not supported for device mode %q", mode)
+	}
 	switch mode {
 	case api.DeviceModeFake:
 		return newFake(pmemPercentage)
 	case api.DeviceModeLVM:
-		return newPmemDeviceManagerLVM(ctx, pmemPercentage)
+		return newPmemDeviceManagerLVM(ctx, pmemPercentage, opts)
 	case api.DeviceModeDirect:
-		return newPmemDeviceManagerNdctl(ctx, pmemPercentage)
+		return newPmemDeviceManagerNdctl(ctx, pmemPercentage, opts.Pools, opts.WarmPool)
+	case api.DeviceModeExternal:
+		return newPmemDeviceManagerExternal(ctx, opts.Endpoint)
 	default:
 		return nil, fmt.Errorf("unsupported device mode %q", mode)
 	}
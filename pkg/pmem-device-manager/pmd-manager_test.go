@@ -7,6 +7,7 @@ package pmdmanager
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -47,6 +48,12 @@ var _ = Describe("DeviceManager", func() {
 	Context(ModeDirect, func() { runTests(ModeDirect) })
 })
 
+// volumeID returns a name in the same format as the volume IDs
+// created by PMEM-CSI. Devices with other names are ignored.
+func volumeID(name string) string {
+	return fmt.Sprintf("%.6s-%x", name, sha256.Sum224([]byte(name)))
+}
+
 func runTests(mode string) {
 	var dm PmemDeviceManager
 	var vg *testVGS
@@ -63,9 +70,9 @@ func runTests(mode string) {
 			vg, err = createTestVGS(vgname, vgsize)
 			Expect(err).Should(BeNil(), "Failed to create volume group")
 
-			dm, err = newPmemDeviceManagerLVMForVGs(ctx, []string{vg.name})
+			dm, err = newPmemDeviceManagerLVMForVGs(ctx, 100, []string{vg.name})
 		} else {
-			dm, err = newPmemDeviceManagerNdctl(ctx, 100)
+			dm, err = newPmemDeviceManagerNdctl(ctx, 100, nil, nil)
 			if err != nil && strings.Contains(err.Error(), "/sys mounted read-only") {
 				Skip("/sys mounted read-only, cannot test direct mode")
 			}
@@ -80,7 +87,7 @@ func runTests(mode string) {
 				continue
 			}
 			By("Cleaning up device: " + devName)
-			_ = dm.DeleteDevice(ctx, devName, false)
+			_ = dm.DeleteDevice(ctx, devName, false, false)
 		}
 		if mode == ModeLVM {
 			err := vg.Clean()
@@ -89,9 +96,9 @@ func runTests(mode string) {
 	})
 
 	It("Should create a new device", func() {
-		name := "test-dev-new"
+		name := volumeID("test-dev-new")
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, 0, parameters.Volume{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 
@@ -105,9 +112,9 @@ func runTests(mode string) {
 	})
 
 	It("Should support recreating a device", func() {
-		name := "test-dev"
+		name := volumeID("test-dev")
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, 0, parameters.Volume{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 
@@ -119,11 +126,11 @@ func runTests(mode string) {
 		Expect(dev.Size >= size).Should(BeTrue(), "Size mismatch")
 		Expect(dev.Path).ShouldNot(BeNil(), "Null device path")
 
-		err = dm.DeleteDevice(ctx, name, false)
+		err = dm.DeleteDevice(ctx, name, false, false)
 		Expect(err).Should(BeNil(), "Failed to delete device")
 		cleanupList[name] = false
 
-		actual, err = dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err = dm.CreateDevice(ctx, name, size, 0, parameters.Volume{})
 		Expect(err).Should(BeNil(), "Failed to recreate the same device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 		cleanupList[name] = true
@@ -150,9 +157,9 @@ func runTests(mode string) {
 		}
 
 		for i := 1; i <= max_devices; i++ {
-			name := fmt.Sprintf("list-dev-%d", i)
+			name := volumeID(fmt.Sprintf("list-dev-%d", i))
 			sizes[name] = uint64(rand.Intn(15)+1) * 1024 * 1024
-			actual, err := dm.CreateDevice(ctx, name, sizes[name], parameters.UsageAppDirect)
+			actual, err := dm.CreateDevice(ctx, name, sizes[name], 0, parameters.Volume{})
 			Expect(err).Should(BeNil(), "Failed to create new device")
 			Expect(actual).Should(BeNumerically(">=", sizes[name]), "device at least as large as requested")
 			cleanupList[name] = true
@@ -167,9 +174,9 @@ func runTests(mode string) {
 		}
 
 		for i := 1; i <= max_deletes; i++ {
-			name := fmt.Sprintf("list-dev-%d", i)
+			name := volumeID(fmt.Sprintf("list-dev-%d", i))
 			delete(sizes, name)
-			err = dm.DeleteDevice(ctx, name, false)
+			err = dm.DeleteDevice(ctx, name, false, false)
 			Expect(err).Should(BeNil(), "Error while deleting device '"+name+"'")
 			cleanupList[name] = false
 		}
@@ -181,12 +188,7 @@ func runTests(mode string) {
 		for _, dev := range list {
 			size, ok := sizes[dev.VolumeId]
 			Expect(ok).Should(BeTrue(), "Unexpected device name:"+dev.VolumeId)
-			// When testing in direct mode on a node which was set up for LVM
-			// then we don't have unique
-			// "volume IDs" for those existing namespaces (both have VolumeId = "pmem-csi")
-			// and we only have one entry in the size hash for two volumes. We simply skip
-			// the size check for existing volumes.
-			// TODO: should those volumes be listed at all?
+			// Existing volumes were recorded with size 0.
 			if size > 0 {
 				Expect(dev.Size).Should(BeNumerically(">=", size), "Device size mismatch")
 			}
@@ -194,9 +196,9 @@ func runTests(mode string) {
 	})
 
 	It("Should delete devices", func() {
-		name := "delete-dev"
+		name := volumeID("delete-dev")
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, 0, parameters.Volume{})
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 		cleanupList[name] = true
@@ -215,7 +217,7 @@ func runTests(mode string) {
 		}()
 
 		// Delete should fail as the device is in use
-		err = dm.DeleteDevice(ctx, name, true)
+		err = dm.DeleteDevice(ctx, name, true, false)
 		Expect(err).ShouldNot(BeNil(), "Error expected when deleting device in use: %s", dev.VolumeId)
 		Expect(errors.Is(err, pmemerr.DeviceInUse)).Should(BeTrue(), "Expected device busy error: %s", dev.VolumeId)
 		cleanupList[name] = false
@@ -224,7 +226,7 @@ func runTests(mode string) {
 		Expect(err).Should(BeNil(), "Failed to unmount the device: %s", dev.VolumeId)
 
 		// Delete should succeed
-		err = dm.DeleteDevice(ctx, name, true)
+		err = dm.DeleteDevice(ctx, name, true, false)
 		Expect(err).Should(BeNil(), "Failed to delete device")
 
 		dev, err = dm.GetDevice(ctx, name)
@@ -233,7 +235,7 @@ func runTests(mode string) {
 		Expect(dev).Should(BeNil(), "returned device should be nil")
 
 		// Delete call should not return any error on non-existing device
-		err = dm.DeleteDevice(ctx, name, true)
+		err = dm.DeleteDevice(ctx, name, true, false)
 		Expect(err).Should(BeNil(), "DeleteDevice() is not idempotent")
 	})
 }
@@ -5,8 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -14,26 +18,223 @@ import (
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	"github.com/intel/pmem-csi/pkg/tracing"
 
 	"k8s.io/utils/mount"
 )
 
 type pmemNdctl struct {
 	pmemPercentage uint
+	pools          Pools
+	warmPool       WarmPool
+	// refill triggers filling the warm pool, nil without a warm pool
+	refill chan struct{}
+	// capacity caches the GetCapacity result.
+	capacity capacityCache
 }
 
 var _ PmemDeviceManager = &pmemNdctl{}
+var _ MediaErrors = &pmemNdctl{}
 
 // mutex to synchronize all ndctl calls
 // https://github.com/pmem/ndctl/issues/96
-// Once ndctl supports concurrent calls we need to revisit
-// our locking strategy.
-var ndctlMutex = &sync.Mutex{}
+// Concurrent namespace creation only fails inside the same region,
+// so operations which modify namespaces in one region hold this
+// for reading plus the lock of that region (see withRegion).
+// Operations which modify arbitrary regions hold it exclusively.
+var ndctlMutex = &sync.RWMutex{}
+
+// regionMutexes maps region names to a *sync.Mutex.
+var regionMutexes sync.Map
+
+// newNdctlContext is used instead of ndctl.NewContext by code which
+// gets tested with a fake, for example withRegion or Defragment.
+var newNdctlContext = ndctl.NewContext
+
+// clearNewDevice clears the start of a newly created device. Tests
+// replace it because fake namespaces have no block device.
+var clearNewDevice = func(ctx context.Context, device *PmemDeviceInfo) error {
+	return clearDevice(ctx, device, false, false)
+}
+
+// withRegion calls f while holding the lock for the region. The
+// caller must hold ndctlMutex for reading. f gets a new context
+// because libndctl caches information like the seed namespace
+// which might have been changed by some other goroutine.
+func withRegion(regionName string, f func(ndctx ndctl.Context, r ndctl.Region) error) error {
+	mutex, _ := regionMutexes.LoadOrStore(regionName, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return wrapNdctlError(err)
+	}
+	defer ndctx.Free()
+	r := findRegion(ndctx, regionName)
+	if r == nil {
+		return fmt.Errorf("region %s: %w", regionName, pmemerr.DeviceNotFound)
+	}
+	return f(ndctx, r)
+}
+
+// activeRegions returns the names of the active regions, limited to
+// the given ones if not empty, in the order of sortedRegions.
+func activeRegions(ndctx ndctl.Context, regions []string) []string {
+	var names []string
+	for _, r := range sortedRegions(ndctx) {
+		if len(regions) > 0 && !containsString(regions, r.DeviceName()) {
+			continue
+		}
+		names = append(names, r.DeviceName())
+	}
+	return names
+}
+
+// sortedRegions returns the active regions ordered by bus and then
+// by region, so volumes get created in the same order on all nodes
+// and fill one bus before the next one.
+func sortedRegions(ndctx ndctl.Context) []ndctl.Region {
+	var regions []ndctl.Region
+	for _, bus := range ndctx.GetBuses() {
+		regions = append(regions, bus.ActiveRegions()...)
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		busI, busJ := regions[i].Bus().DeviceName(), regions[j].Bus().DeviceName()
+		if busI != busJ {
+			return lessDeviceName(busI, busJ)
+		}
+		return lessDeviceName(regions[i].DeviceName(), regions[j].DeviceName())
+	})
+	return regions
+}
+
+// filterRegions returns those of the active regions for which keep
+// returns true, in the same order.
+func filterRegions(ndctx ndctl.Context, regions []string, keep func(r ndctl.Region) bool) []string {
+	var names []string
+	for _, name := range regions {
+		if r := findRegion(ndctx, name); r != nil && keep(r) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// logEmulatedBuses explains why namespaces on emulated PMEM are
+// not checked for bad blocks.
+func logEmulatedBuses(ctx context.Context) {
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return
+	}
+	defer ndctx.Free()
+	for _, bus := range ndctx.GetBuses() {
+		if ndctl.IsEmulated(bus) {
+			klog.FromContext(ctx).Info("PMEM is emulated, not checking for bad blocks", "bus", bus.DeviceName(), "provider", bus.Provider())
+		}
+	}
+}
+
+// createNamespace is like ndctl.CreateNamespace, except that it
+// locks each region while trying it. The start of the new device
+// gets cleared before unlocking the region, to avoid old data being
+// recognized as file system. It returns the new device and the raw
+// size of its namespace.
+func createNamespace(ctx context.Context, regions []string, opts ndctl.CreateNamespaceOpts) (*PmemDeviceInfo, uint64, error) {
+	err := pmemerr.NotEnoughSpace
+	for _, region := range regions {
+		var device *PmemDeviceInfo
+		var size uint64
+		err = withRegion(region, func(ndctx ndctl.Context, r ndctl.Region) error {
+			start := time.Now()
+			ns, err := r.CreateNamespace(ctx, opts)
+			ObserveOperation(OperationCreateNamespace, start, err)
+			if err != nil {
+				return wrapNdctlError(err)
+			}
+			size = ns.RawSize()
+			// Not getDevice: several warm namespaces have
+			// the same name.
+			device = namespaceToPmemInfo(ns)
+			if err := clearNewDevice(ctx, device); err != nil {
+				return fmt.Errorf("clear device %q: %w", opts.Name, err)
+			}
+			return nil
+		})
+		if err == nil {
+			return device, size, nil
+		}
+	}
+	return nil, 0, err
+}
+
+// mappingAlignments are the mapping alignments tried for fsdax
+// namespaces, from largest to smallest. 1GiB enables huge pages for
+// applications which map the whole volume, but is not supported by
+// all kernels and regions, therefore 2MiB is the fallback.
+var mappingAlignments = []uint64{1 << 30, 2 << 20}
+
+// createAlignedNamespace is like createNamespace, except that it
+// tries the mapping alignments in order. Larger alignments are only
+// tried in regions where they do not cause padding, i.e. where the
+// requested size already is a multiple of the resulting namespace
+// alignment. That alignment also depends on the interleave ways and
+// the region alignment. Padding would waste space and make the
+// volume larger than what GetCapacity, which assumes the default
+// alignment, reports as available. The error of the last attempt is
+// returned if all of them fail.
+func createAlignedNamespace(ctx context.Context, ndctx ndctl.Context, regions []string, opts ndctl.CreateNamespaceOpts) (*PmemDeviceInfo, uint64, error) {
+	if opts.Mode != ndctl.FsdaxMode {
+		return createNamespace(ctx, regions, opts)
+	}
+	logger := klog.FromContext(ctx)
+	var err error
+	for i, align := range mappingAlignments {
+		candidates := regions
+		if i < len(mappingAlignments)-1 {
+			candidates = unpaddedRegions(ndctx, regions, opts.Size, align)
+			if len(candidates) == 0 {
+				continue
+			}
+		}
+		opts.Align = align
+		var device *PmemDeviceInfo
+		var actual uint64
+		device, actual, err = createNamespace(ctx, candidates, opts)
+		if err == nil {
+			return device, actual, nil
+		}
+		logger.V(3).Info("Creating namespace failed", "alignment", pmemlog.CapacityRef(int64(align)), "err", err)
+	}
+	return nil, 0, err
+}
+
+// unpaddedRegions returns those regions in which a namespace of the
+// given size and mapping alignment does not need to be rounded up.
+func unpaddedRegions(ndctx ndctl.Context, regions []string, size, align uint64) []string {
+	if size == 0 {
+		return nil
+	}
+	var names []string
+	for _, name := range regions {
+		r := findRegion(ndctx, name)
+		if r == nil {
+			continue
+		}
+		if regionAlign, _ := ndctl.CalculateAlignmentFor(r, align); size%regionAlign == 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
 
 // NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager
 // FIXME(avalluri): consider pmemPercentage while calculating available space
-func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
+func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint, pools Pools, warmPool WarmPool) (PmemDeviceManager, error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-New")
+	ctx, span := tracing.Start(ctx, "ndctl-New")
+	defer span.End()
 	if pmemPercentage > 100 {
 		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
 	}
@@ -71,7 +272,13 @@ func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDe
 		}
 	}
 
-	return &pmemNdctl{pmemPercentage: pmemPercentage}, nil
+	logEmulatedBuses(ctx)
+	pmem := &pmemNdctl{pmemPercentage: pmemPercentage, pools: pools, warmPool: warmPool}
+	if len(warmPool) > 0 {
+		pmem.refill = make(chan struct{}, 1)
+		go pmem.maintainWarmPool(ctx)
+	}
+	return pmem, nil
 }
 
 // sysIsWritable returns true if any of the /sys mounts is writable.
@@ -102,10 +309,23 @@ func (pmem *pmemNdctl) GetMode() api.DeviceMode {
 	return api.DeviceModeDirect
 }
 
-func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err error) {
+func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (Capacity, error) {
+	return pmem.capacity.get(0, func() (Capacity, error) {
+		return pmem.getCapacity(ctx)
+	})
+}
+
+func (pmem *pmemNdctl) getCapacity(ctx context.Context) (capacity Capacity, err error) {
 	ctx, logger := pmemlog.WithName(ctx, "ndctl-GetCapacity")
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+	ctx, span := tracing.Start(ctx, "ndctl-GetCapacity")
+	defer func() { tracing.End(span, err) }()
+	defer func() {
+		if err == nil {
+			recordCapacity(api.DeviceModeDirect, capacity)
+		}
+	}()
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
 
 	var ndctx ndctl.Context
 	ndctx, err = ndctl.NewContext()
@@ -132,28 +352,59 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 				"size", pmemlog.CapacityRef(int64(size)),
 			)
 
-			// align down by the region's alignment, avoid claiming having more than what we really can serve
+			// align down by the region's alignment, avoid claiming having more than what we really can serve.
+			// Larger mapping alignments are only used when they need no extra padding, see
+			// createAlignedNamespace, so the default alignment is the right one here.
 			maxVolumeSize = maxVolumeSize / align * align
 			if maxVolumeSize > capacity.MaxVolumeSize {
 				capacity.MaxVolumeSize = maxVolumeSize
 			}
-			capacity.Available += available / align * align
-			capacity.Managed += size
+			available = available / align * align
+			// Warm namespaces are available for new volumes.
+			for _, ns := range r.ActiveNamespaces() {
+				if isWarm(ns.Name()) {
+					available += ns.RawSize()
+				}
+			}
+			// PMEM used as system RAM is not available for volumes.
+			systemRAM := systemRAMSize(r)
+			capacity.Available += available
+			capacity.Managed += size - systemRAM
+			capacity.SystemRAM += systemRAM
+			capacity.Details = append(capacity.Details, CapacityDetail{
+				Region:         r.DeviceName(),
+				Bus:            bus.DeviceName(),
+				MaxVolumeSize:  maxVolumeSize,
+				Available:      available,
+				Total:          size - systemRAM,
+				NumaNode:       r.NumaNode(),
+				InterleaveWays: r.InterleaveWays(),
+			})
 		}
 	}
+	capacity.PhysicalAvailable = capacity.Available
 	// TODO: we should maintain capacity when adding or subtracting
 	// from upper layer, not done right now!!
 	return capacity, nil
 }
 
-func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size, limit uint64, params parameters.Volume) (_ uint64, finalErr error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-CreateDevice")
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+	ctx, span := tracing.Start(ctx, "ndctl-CreateDevice", attribute.String("volume-id", volumeId))
+	defer span.End()
+	// Free space changes, also when failing halfway.
+	defer pmem.capacity.invalidate()
+	defer func() { countDeviceError(opCreateDevice, finalErr) }()
+	if !IsVolumeID(volumeId) {
+		// It would not be listed nor deleted again.
+		return 0, fmt.Errorf("%q is not a volume ID, cannot create a namespace for it", volumeId)
+	}
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
-		return 0, err
+		return 0, wrapNdctlError(err)
 	}
 	defer ndctx.Free()
 
@@ -167,9 +418,22 @@ func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size u
 	}
 
 	opts := ndctl.CreateNamespaceOpts{
-		Name: volumeId,
-		Size: size,
+		Name:           volumeId,
+		Size:           size,
+		Limit:          limit,
+		AvoidBadBlocks: true,
+	}
+	if pool := params.GetPool(); pool != "" {
+		regions, ok := pmem.pools[pool]
+		if !ok {
+			return 0, fmt.Errorf("%w: %q", pmemerr.UnknownPool, pool)
+		}
+		opts.Regions = regions
+	}
+	if params.GetStripes() > 1 {
+		return 0, fmt.Errorf("%w: striping in direct mode", pmemerr.NotSupported)
 	}
+	usage := params.GetUsage()
 	switch usage {
 	case parameters.UsageAppDirect:
 		opts.Mode = ndctl.FsdaxMode
@@ -179,54 +443,113 @@ func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size u
 		return 0, fmt.Errorf("unsupported usage %s for direct mode", usage)
 	}
 
-	ns, err := ndctl.CreateNamespace(ctx, ndctx, opts)
-	if err != nil {
-		return 0, err
+	regions := activeRegions(ndctx, opts.Regions)
+	if node := params.GetNumaNode(); node >= 0 {
+		regions = numaNodeRegions(ndctx, regions, node)
+		if len(regions) == 0 {
+			return 0, fmt.Errorf("no region on NUMA node %d: %w", node, pmemerr.NotEnoughSpace)
+		}
+	}
+	if bus := params.GetBus(); bus != "" {
+		regions = busRegions(ndctx, regions, bus)
+		if len(regions) == 0 {
+			return 0, fmt.Errorf("no region on bus %s: %w", bus, pmemerr.NotEnoughSpace)
+		}
+	}
+	if opts.Mode == ndctl.FsdaxMode && len(pmem.warmPool) > 0 {
+		actual, err := takeWarmNamespace(ctx, regions, volumeId, size, limit)
+		if err != nil {
+			return 0, err
+		}
+		if actual > 0 {
+			// Already wiped when it was added to the pool.
+			pmem.triggerRefill()
+			return actual, nil
+		}
+	}
+	_, actual, err := createAlignedNamespace(ctx, ndctx, regions, opts)
+	if errors.Is(err, pmemerr.NotEnoughSpace) {
+		// Volumes have priority over the warm pool. GetCapacity
+		// counts warm namespaces as available, also those left
+		// behind after disabling the pool, so this must be tried
+		// even when there is no pool.
+		destroyed, err2 := destroyWarmNamespaces(ctx, regions)
+		if err2 != nil {
+			return 0, err2
+		}
+		if destroyed {
+			_, actual, err = createAlignedNamespace(ctx, ndctx, regions, opts)
+		}
 	}
-	actual := ns.RawSize()
-
-	// clear start of device to avoid old data being recognized as file system
-	device, err := getDevice(ndctx, volumeId)
 	if err != nil {
 		return 0, err
 	}
-	if err := clearDevice(ctx, device, false); err != nil {
-		return 0, fmt.Errorf("clear device %q: %v", volumeId, err)
-	}
 
 	return actual, nil
 }
 
-func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush bool) error {
+func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush, verify bool) (finalErr error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-DeleteDevice")
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+	ctx, span := tracing.Start(ctx, "ndctl-DeleteDevice", attribute.String("volume-id", volumeId))
+	defer span.End()
+	defer pmem.capacity.invalidate()
+	operation := opDeleteDevice
+	defer func() { countDeviceError(operation, finalErr) }()
+	if !IsVolumeID(volumeId) {
+		// Not created by PMEM-CSI, must not be touched.
+		return nil
+	}
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
-		return err
+		return wrapNdctlError(err)
 	}
 	defer ndctx.Free()
 
-	device, err := getDevice(ndctx, volumeId)
+	ns, err := ndctl.GetNamespaceByName(ndctx, volumeId)
 	if err != nil {
 		if errors.Is(err, pmemerr.DeviceNotFound) {
 			return nil
 		}
+		return wrapNdctlError(fmt.Errorf("error getting device %q: %w", volumeId, err))
+	}
+	device := namespaceToPmemInfo(ns)
+	regionName := ns.Region().DeviceName()
+	// Wiping the data does not modify the region.
+	if err := clearDevice(ctx, device, flush, verify); err != nil {
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			return nil
+		}
+		if flush {
+			operation = opFlushDevice
+		}
 		return err
 	}
-	if err := clearDevice(ctx, device, flush); err != nil {
+	if err := withRegion(regionName, func(ndctx ndctl.Context, r ndctl.Region) error {
+		ns, err := ndctl.GetNamespaceByName(ndctx, volumeId)
 		if errors.Is(err, pmemerr.DeviceNotFound) {
 			return nil
 		}
+		if err != nil {
+			return wrapNdctlError(err)
+		}
+		return wrapNdctlError(r.DestroyNamespace(ctx, ns, true))
+	}); err != nil {
 		return err
 	}
-	return ndctl.DestroyNamespaceByName(ndctx, volumeId)
+	// The freed space might be needed for the warm pool.
+	pmem.triggerRefill()
+	return nil
 }
 
 func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+	if !IsVolumeID(volumeId) {
+		return nil, fmt.Errorf("error getting device %q: %w", volumeId, pmemerr.DeviceNotFound)
+	}
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
@@ -237,9 +560,30 @@ func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDev
 	return getDevice(ndctx, volumeId)
 }
 
+func (pmem *pmemNdctl) RegionBadBlocks(ctx context.Context) (map[string]uint64, error) {
+	return regionBadBlocks(ctx)
+}
+
+func (pmem *pmemNdctl) VolumeBadBlocks(ctx context.Context, volumeId string) (uint64, error) {
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return 0, err
+	}
+	defer ndctx.Free()
+
+	ns, err := ndctl.GetNamespaceByName(ndctx, volumeId)
+	if err != nil {
+		return 0, fmt.Errorf("error getting device %q: %w", volumeId, err)
+	}
+	return ndctl.CountBadBlocks(ns.BadBlocks()), nil
+}
+
 func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
-	ndctlMutex.Lock()
-	defer ndctlMutex.Unlock()
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
 
 	ndctx, err := ndctl.NewContext()
 	if err != nil {
@@ -248,9 +592,14 @@ func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, erro
 	defer ndctx.Free()
 
 	devices := []*PmemDeviceInfo{}
-	for _, ns := range ndctl.GetAllNamespaces(ndctx) {
-		devices = append(devices, namespaceToPmemInfo(ns))
-	}
+	ndctl.VisitNamespaces(ndctx, func(ns ndctl.Namespace) bool {
+		// Warm namespaces and namespaces not created by
+		// PMEM-CSI are not volumes.
+		if IsVolumeID(ns.Name()) {
+			devices = append(devices, namespaceToPmemInfo(ns))
+		}
+		return true
+	})
 	return devices, nil
 }
 
@@ -265,15 +614,27 @@ func getDevice(ndctx ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
 
 func namespaceToPmemInfo(ns ndctl.Namespace) *PmemDeviceInfo {
 	return &PmemDeviceInfo{
-		VolumeId: ns.Name(),
-		Path:     "/dev/" + ns.BlockDeviceName(),
-		Size:     ns.Size(),
+		VolumeId:  ns.Name(),
+		Path:      "/dev/" + ns.BlockDeviceName(),
+		Size:      ns.Size(),
+		Alignment: ns.Alignment(),
+		UUID:      namespaceUUID(ns),
+	}
+}
+
+// namespaceUUID returns the UUID of the namespace as string, empty
+// if it has none.
+func namespaceUUID(ns ndctl.Namespace) string {
+	if uid := ns.UUID(); uid != uuid.Nil {
+		return uid.String()
 	}
+	return ""
 }
 
 // totalSize sums up all PMEM regions, regardless whether they are
-// enabled and regardless of their mode.
-func totalSize() (size uint64, err error) {
+// enabled and regardless of their mode. It also returns how much of
+// it is used as system RAM.
+func totalSize() (size, systemRAM uint64, err error) {
 	var ndctx ndctl.Context
 	ndctx, err = ndctl.NewContext()
 	if err != nil {
@@ -284,6 +645,7 @@ func totalSize() (size uint64, err error) {
 	for _, bus := range ndctx.GetBuses() {
 		for _, region := range bus.AllRegions() {
 			size += region.Size()
+			systemRAM += systemRAMSize(region)
 		}
 	}
 	return
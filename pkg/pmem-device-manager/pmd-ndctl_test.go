@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestCreateAlignedNamespace(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	mib := uint64(1024 * 1024)
+
+	testcases := map[string]struct {
+		interleave  []uint64
+		size        uint64
+		alignment   uint64
+		region      string
+		createdSize uint64
+	}{
+		"aligned": {
+			interleave:  []uint64{1},
+			size:        2 * gig,
+			alignment:   gig,
+			region:      "region0",
+			createdSize: 2 * gig,
+		},
+		"unaligned": {
+			interleave:  []uint64{1},
+			size:        gig + 2*mib,
+			alignment:   2 * mib,
+			region:      "region0",
+			createdSize: gig + 2*mib,
+		},
+		"interleaved": {
+			// 1GiB would have to be padded to 2GiB.
+			interleave:  []uint64{2},
+			size:        gig,
+			alignment:   2 * mib,
+			region:      "region0",
+			createdSize: gig,
+		},
+		"interleaved-aligned": {
+			interleave:  []uint64{2},
+			size:        2 * gig,
+			alignment:   gig,
+			region:      "region0",
+			createdSize: 2 * gig,
+		},
+		"some-interleaved": {
+			// Only region1 can use 1GiB without padding.
+			interleave:  []uint64{2, 1},
+			size:        gig,
+			alignment:   gig,
+			region:      "region1",
+			createdSize: gig,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var regions []ndctl.Region
+			var names []string
+			for i, ways := range tc.interleave {
+				name := fmt.Sprintf("region%d", i)
+				regions = append(regions, &ndctlfake.Region{
+					DeviceName_:         name,
+					Size_:               64 * gig,
+					MaxAvailableExtent_: 64 * gig,
+					Enabled_:            true,
+					Type_:               ndctl.PmemRegion,
+					InterleaveWays_:     ways,
+					RegionAlign_:        16 * mib,
+				})
+				names = append(names, name)
+			}
+			ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+				Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: regions}},
+			})
+			oldContext, oldClear := newNdctlContext, clearNewDevice
+			defer func() {
+				newNdctlContext, clearNewDevice = oldContext, oldClear
+			}()
+			newNdctlContext = func() (ndctl.Context, error) {
+				return ndctx, nil
+			}
+			clearNewDevice = func(ctx context.Context, device *PmemDeviceInfo) error {
+				return nil
+			}
+
+			device, actual, err := createAlignedNamespace(ctx, ndctx, names, ndctl.CreateNamespaceOpts{
+				Name: "pmem-csi-test",
+				Size: tc.size,
+				Mode: ndctl.FsdaxMode,
+			})
+			require.NoError(t, err, "create namespace")
+			assert.Equal(t, tc.alignment, device.Alignment, "alignment")
+			assert.Equal(t, tc.createdSize, actual, "size")
+			for _, r := range regions {
+				if r.DeviceName() == tc.region {
+					assert.Len(t, r.ActiveNamespaces(), 1, "namespaces in %s", r.DeviceName())
+				} else {
+					assert.Empty(t, r.ActiveNamespaces(), "namespaces in %s", r.DeviceName())
+				}
+			}
+		})
+	}
+}
@@ -16,12 +16,22 @@ import (
 
 const (
 	retryStatTimeout time.Duration = 100 * time.Millisecond
+
+	// verifySamples is the number of ranges that get read back
+	// after wiping a device when verification is enabled.
+	verifySamples = 16
+	// verifySampleSize is the size of each of those ranges.
+	verifySampleSize = 4096
 )
 
-func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
+// clearDevice overwrites the start of the device or, with flush, all
+// of it. With verify, sampled ranges of the overwritten part get read
+// back afterwards and an error wrapping pmemerr.NotErased is returned
+// if they still contain data.
+func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush, verify bool) error {
 	logger := klog.FromContext(ctx).WithName("clearDevice").WithValues("device", dev.Path)
 	ctx = klog.NewContext(ctx, logger)
-	logger.V(4).Info("Starting", "flush", flush)
+	logger.V(4).Info("Starting", "flush", flush, "verify", verify)
 
 	// by default, clear 4 kbytes to avoid recognizing file system by next volume seeing data area
 	var blocks uint64 = 4
@@ -51,14 +61,18 @@ func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
 		return fmt.Errorf("failed to clear device %q: %w", dev.Path, pmemerr.DeviceInUse)
 	}
 
+	erased := dev.Size
 	if blocks == 0 {
 		logger.V(5).Info("Wiping entire device")
 		// shred would write n times using random data, followed by optional write of zeroes.
 		// For faster operation, and because we consider zeroing enough for
 		// reasonable clearing in case of a memory device, we force zero iterations
 		// with random data, followed by one pass writing zeroes.
-		if _, err := pmemexec.RunCommand(ctx, "shred", "-n", "0", "-z", dev.Path); err != nil {
-			return fmt.Errorf("device shred failure: %v", err.Error())
+		start := time.Now()
+		_, err := pmemexec.RunThrottled(ctx, dev.Path, "shred", "-n", "0", "-z", dev.Path)
+		ObserveOperation(OperationWipe, start, err)
+		if err != nil {
+			return fmt.Errorf("device shred failure: %w", err)
 		}
 	} else {
 		logger.V(5).Info("Zeroing blocks at start of device", "blocks", blocks, "dev-size", dev.Size)
@@ -68,8 +82,82 @@ func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
 			blocks = dev.Size / 1024
 		}
 		count := "count=" + strconv.FormatUint(blocks, 10)
-		if _, err := pmemexec.RunCommand(ctx, "dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
-			return fmt.Errorf("device zeroing failure: %v", err.Error())
+		if _, err := pmemexec.RunThrottled(ctx, dev.Path, "dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
+			return fmt.Errorf("device zeroing failure: %w", err)
+		}
+		erased = blocks * 1024
+	}
+	if verify {
+		if err := verifyErased(fd, erased); err != nil {
+			return fmt.Errorf("verify erasure of %s: %w", dev.Path, err)
+		}
+		logger.V(3).Info("Verified erasure", "samples", verifySamples)
+	}
+	return nil
+}
+
+// discardDevice erases a thin volume by discarding all of its blocks
+// instead of overwriting them, which would allocate all of it.
+// Discarded blocks are unmapped from the volume and read back as
+// zeros, so with verify the entire device gets checked the same way
+// as after overwriting it.
+func discardDevice(ctx context.Context, dev *PmemDeviceInfo, verify bool) error {
+	logger := klog.FromContext(ctx).WithName("discardDevice").WithValues("device", dev.Path)
+	ctx = klog.NewContext(ctx, logger)
+	logger.V(4).Info("Starting", "verify", verify)
+
+	fd, err := unix.Open(dev.Path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("discard device: %v", err)
+		}
+		return fmt.Errorf("failed to discard device %q: %w", dev.Path, pmemerr.DeviceInUse)
+	}
+	defer unix.Close(fd)
+
+	start := time.Now()
+	_, err = pmemexec.RunCommand(ctx, "blkdiscard", dev.Path)
+	ObserveOperation(OperationWipe, start, err)
+	if err != nil {
+		return fmt.Errorf("device discard failure: %w", err)
+	}
+	if verify {
+		if err := verifyErased(fd, dev.Size); err != nil {
+			return fmt.Errorf("verify erasure of %s: %w", dev.Path, err)
+		}
+		logger.V(3).Info("Verified erasure", "samples", verifySamples)
+	}
+	return nil
+}
+
+// verifyErased reads verifySamples ranges which are spread evenly
+// over the first size bytes of the file and checks that they only
+// contain zeros. The page cache gets dropped first, otherwise reads
+// might return the data that was written instead of what the device
+// really stored.
+func verifyErased(fd int, size uint64) error {
+	if err := unix.Fsync(fd); err != nil {
+		return fmt.Errorf("sync: %v", err)
+	}
+	if err := unix.Fadvise(fd, 0, 0, unix.FADV_DONTNEED); err != nil {
+		return fmt.Errorf("drop page cache: %v", err)
+	}
+	buffer := make([]byte, verifySampleSize)
+	for i := uint64(0); i < verifySamples; i++ {
+		length := uint64(verifySampleSize)
+		if length > size {
+			length = size
+		}
+		// The first sample is at the start, the last one at the end.
+		offset := (size - length) * i / (verifySamples - 1)
+		n, err := unix.Pread(fd, buffer[:length], int64(offset))
+		if err != nil {
+			return fmt.Errorf("read %d bytes at offset %d: %v", length, offset, err)
+		}
+		for _, b := range buffer[:n] {
+			if b != 0 {
+				return fmt.Errorf("non-zero data at offset %d: %w", offset, pmemerr.NotErased)
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+func TestVerifyErased(t *testing.T) {
+	const size = 1024 * 1024
+	testcases := map[string]struct {
+		data      map[int64]byte
+		erased    uint64
+		notErased bool
+	}{
+		"zeros": {
+			erased: size,
+		},
+		"first-sample": {
+			data:      map[int64]byte{0: 1},
+			erased:    size,
+			notErased: true,
+		},
+		"last-sample": {
+			data:      map[int64]byte{size - 1: 1},
+			erased:    size,
+			notErased: true,
+		},
+		"between-samples": {
+			// Sampling cannot find everything.
+			data:   map[int64]byte{verifySampleSize: 1},
+			erased: size,
+		},
+		"after-erased-part": {
+			data:   map[int64]byte{4096: 1},
+			erased: 4096,
+		},
+		"small": {
+			data:      map[int64]byte{100: 1},
+			erased:    1024,
+			notErased: true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "device")
+			content := make([]byte, size)
+			for offset, b := range tc.data {
+				content[offset] = b
+			}
+			require.NoError(t, os.WriteFile(path, content, 0600), "write file")
+			fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+			require.NoError(t, err, "open file")
+			defer unix.Close(fd)
+
+			err = verifyErased(fd, tc.erased)
+			if tc.notErased {
+				assert.True(t, errors.Is(err, pmemerr.NotErased), "not erased: %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestDiscardDevice(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	const size = 1024 * 1024
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	bin := t.TempDir()
+	os.Setenv("PATH", bin+":"+path)
+
+	// The fake blkdiscard zeroes the file, except for the last byte
+	// if the file name says so.
+	blkdiscard := `#!/bin/sh
+truncate -s 0 "$1" && truncate -s ` + strconv.Itoa(size) + ` "$1"
+case "$1" in *broken) printf x | dd of="$1" bs=1 seek=` + strconv.Itoa(size-1) + ` conv=notrunc 2>/dev/null;; esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "blkdiscard"), []byte(blkdiscard), 0700))
+
+	for _, name := range []string{"device", "broken"} {
+		t.Run(name, func(t *testing.T) {
+			dev := &PmemDeviceInfo{
+				Path: filepath.Join(t.TempDir(), name),
+				Size: size,
+			}
+			content := make([]byte, size)
+			for i := range content {
+				content[i] = 1
+			}
+			require.NoError(t, os.WriteFile(dev.Path, content, 0600), "write file")
+
+			err := discardDevice(ctx, dev, true)
+			if name == "broken" {
+				assert.True(t, errors.Is(err, pmemerr.NotErased), "not erased: %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
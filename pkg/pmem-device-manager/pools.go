@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pools maps pool names to the names of the regions (for example,
+// "region0") which belong to the pool. Volumes which ask for a pool
+// are only created in those regions.
+//
+// It can be used as a flag value. Each occurrence of the flag adds
+// one pool with "<name>=<region>,<region>,...".
+type Pools map[string][]string
+
+func (p *Pools) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <name>=<region>,..., got %q", value)
+	}
+	name := strings.TrimSpace(parts[0])
+	if name == "" {
+		return fmt.Errorf("empty pool name in %q", value)
+	}
+	if _, ok := (*p)[name]; ok {
+		return fmt.Errorf("pool %q defined more than once", name)
+	}
+	var regions []string
+	for _, region := range strings.Split(parts[1], ",") {
+		region = strings.TrimSpace(region)
+		if region == "" {
+			continue
+		}
+		if !strings.HasPrefix(region, "region") {
+			return fmt.Errorf("pool %q: invalid region name %q", name, region)
+		}
+		regions = append(regions, region)
+	}
+	if len(regions) == 0 {
+		return fmt.Errorf("pool %q: no regions", name)
+	}
+	if *p == nil {
+		*p = Pools{}
+	}
+	(*p)[name] = regions
+	return nil
+}
+
+func (p *Pools) String() string {
+	var names []string
+	for name := range *p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pools []string
+	for _, name := range names {
+		pools = append(pools, name+"="+strings.Join((*p)[name], ","))
+	}
+	return strings.Join(pools, ";")
+}
+
+// Contains returns true if the region belongs to the pool.
+func (p Pools) Contains(pool, region string) bool {
+	for _, r := range p[pool] {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
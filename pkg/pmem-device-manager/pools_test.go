@@ -0,0 +1,34 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPools(t *testing.T) {
+	var pools Pools
+	require.NoError(t, pools.Set("fast=region0, region1"), "first pool")
+	require.NoError(t, pools.Set("slow=region2"), "second pool")
+	assert.Equal(t, "fast=region0,region1;slow=region2", pools.String(), "string")
+	assert.True(t, pools.Contains("fast", "region1"), "region1 in fast")
+	assert.False(t, pools.Contains("slow", "region1"), "region1 in slow")
+	assert.False(t, pools.Contains("other", "region1"), "region1 in other")
+
+	for _, value := range []string{
+		"fast=region3",
+		"region3",
+		"=region3",
+		"none=",
+		"bad=namespace0.0",
+	} {
+		assert.Error(t, pools.Set(value), value)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Reservation is the amount of PMEM on a node that does not get
+// reported as available, either as a percentage of the managed PMEM
+// or as an absolute size. Volumes can still use it, so it is left
+// for ephemeral volumes which get created without checking capacity
+// first.
+//
+// It can be used as a flag value, for example "10%" or "16Gi".
+type Reservation struct {
+	// Percent of Capacity.Managed, used instead of Bytes if
+	// non-zero.
+	Percent uint
+	// Bytes is an absolute amount.
+	Bytes uint64
+}
+
+func (r *Reservation) Set(value string) error {
+	value = strings.TrimSpace(value)
+	if percent := strings.TrimSuffix(value, "%"); percent != value {
+		p, err := strconv.ParseUint(percent, 10, 8)
+		if err != nil || p > 100 {
+			return fmt.Errorf("percentage must be 0..100, got %q", value)
+		}
+		*r = Reservation{Percent: uint(p)}
+		return nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return err
+	}
+	if quantity.Sign() < 0 {
+		return fmt.Errorf("size must not be negative, got %q", value)
+	}
+	*r = Reservation{Bytes: uint64(quantity.Value())}
+	return nil
+}
+
+func (r *Reservation) String() string {
+	if r.Percent > 0 {
+		return fmt.Sprintf("%d%%", r.Percent)
+	}
+	return prettyPrintSize(r.Bytes)
+}
+
+// Apply removes the reserved amount from the available PMEM.
+func (r Reservation) Apply(capacity Capacity) Capacity {
+	return r.subtract(capacity, r.reserved(capacity.Managed))
+}
+
+// ApplyShare is like Apply for a part of the node, for example the
+// regions on one NUMA node. The reservation is calculated for the
+// whole node with nodeManaged as managed PMEM and then split
+// proportionally to the managed PMEM of each part.
+func (r Reservation) ApplyShare(part Capacity, nodeManaged uint64) Capacity {
+	if nodeManaged == 0 || part.Managed >= nodeManaged {
+		return r.Apply(part)
+	}
+	// reserved * part.Managed / nodeManaged without overflowing.
+	hi, lo := bits.Mul64(r.reserved(nodeManaged), part.Managed)
+	share, _ := bits.Div64(hi, lo, nodeManaged)
+	return r.subtract(part, share)
+}
+
+// reserved returns the amount of PMEM that is reserved when the
+// given amount is managed by PMEM-CSI.
+func (r Reservation) reserved(managed uint64) uint64 {
+	if r.Percent > 0 {
+		return managed * uint64(r.Percent) / 100
+	}
+	return r.Bytes
+}
+
+func (r Reservation) subtract(capacity Capacity, reserved uint64) Capacity {
+	subtract := func(size uint64) uint64 {
+		if size < reserved {
+			return 0
+		}
+		return size - reserved
+	}
+	capacity.Available = subtract(capacity.Available)
+	capacity.PhysicalAvailable = subtract(capacity.PhysicalAvailable)
+	if capacity.MaxVolumeSize > capacity.Available {
+		capacity.MaxVolumeSize = capacity.Available
+	}
+	return capacity
+}
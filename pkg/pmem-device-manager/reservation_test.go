@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservation(t *testing.T) {
+	var r Reservation
+	require.NoError(t, r.Set("10%"), "percentage")
+	assert.Equal(t, Reservation{Percent: 10}, r, "percentage")
+	assert.Equal(t, "10%", r.String(), "percentage string")
+	require.NoError(t, r.Set("1Ki"), "size")
+	assert.Equal(t, Reservation{Bytes: 1024}, r, "size")
+	assert.Equal(t, "1Ki", r.String(), "size string")
+
+	for _, value := range []string{
+		"101%",
+		"-1%",
+		"x%",
+		"-1Gi",
+		"x",
+	} {
+		assert.Error(t, r.Set(value), value)
+	}
+
+	capacity := Capacity{
+		MaxVolumeSize:     600,
+		Available:         800,
+		PhysicalAvailable: 800,
+		Managed:           1000,
+		Total:             2000,
+	}
+	assert.Equal(t, capacity, Reservation{}.Apply(capacity), "no reservation")
+	assert.Equal(t, Capacity{
+		MaxVolumeSize:     600,
+		Available:         700,
+		PhysicalAvailable: 700,
+		Managed:           1000,
+		Total:             2000,
+	}, Reservation{Percent: 10}.Apply(capacity), "percentage")
+	assert.Equal(t, Capacity{
+		MaxVolumeSize:     300,
+		Available:         300,
+		PhysicalAvailable: 300,
+		Managed:           1000,
+		Total:             2000,
+	}, Reservation{Bytes: 500}.Apply(capacity), "size")
+	assert.Equal(t, Capacity{
+		Managed: 1000,
+		Total:   2000,
+	}, Reservation{Bytes: 900}.Apply(capacity), "more than available")
+
+	// A quarter of the node gets a quarter of the reservation.
+	part := Capacity{
+		MaxVolumeSize:     200,
+		Available:         200,
+		PhysicalAvailable: 200,
+		Managed:           250,
+		Total:             250,
+	}
+	assert.Equal(t, Capacity{
+		MaxVolumeSize:     175,
+		Available:         175,
+		PhysicalAvailable: 175,
+		Managed:           250,
+		Total:             250,
+	}, Reservation{Percent: 10}.ApplyShare(part, 1000), "percentage for part")
+	assert.Equal(t, Capacity{
+		MaxVolumeSize:     75,
+		Available:         75,
+		PhysicalAvailable: 75,
+		Managed:           250,
+		Total:             250,
+	}, Reservation{Bytes: 500}.ApplyShare(part, 1000), "size for part")
+	assert.Equal(t, Reservation{Bytes: 500}.Apply(capacity), Reservation{Bytes: 500}.ApplyShare(capacity, 1000), "whole node")
+	huge := uint64(1) << 50
+	assert.Equal(t, Capacity{
+		Available: huge - huge/8,
+		Managed:   huge / 4,
+	}, Reservation{Bytes: huge / 2}.ApplyShare(Capacity{Available: huge, Managed: huge / 4}, huge), "no overflow")
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// Static volumes are namespaces or logical volumes which were
+// created outside of PMEM-CSI and which an admin makes available
+// through a manually created PV. Their volume handle is
+//
+//	static:direct:<namespace name>
+//	static:lvm:<volume group>/<logical volume>
+//
+// PMEM-CSI never creates, deletes or wipes them.
+
+// StaticVolumePrefix is the beginning of all volume handles for
+// static volumes.
+const StaticVolumePrefix = "static:"
+
+// IsStaticVolumeID returns true if the volume ID refers to a static
+// volume. It does not check whether the rest of the ID is valid.
+func IsStaticVolumeID(id string) bool {
+	return strings.HasPrefix(id, StaticVolumePrefix)
+}
+
+// ParseStaticVolumeID splits the volume handle of a static volume
+// into device mode and name of the namespace or logical volume.
+func ParseStaticVolumeID(id string) (api.DeviceMode, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(id, StaticVolumePrefix), ":", 2)
+	if !IsStaticVolumeID(id) || len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("%q: expected static:direct:<namespace> or static:lvm:<volume group>/<logical volume>", id)
+	}
+	mode, name := api.DeviceMode(parts[0]), parts[1]
+	switch mode {
+	case api.DeviceModeDirect:
+		if IsVolumeID(name) || name == pmemCSINamespaceName || name == kmemNamespaceName || strings.HasPrefix(name, warmPrefix) {
+			return "", "", fmt.Errorf("%q: namespace %q is managed by PMEM-CSI", id, name)
+		}
+	case api.DeviceModeLVM:
+		vgLV := strings.Split(name, "/")
+		if len(vgLV) != 2 || vgLV[0] == "" || vgLV[1] == "" {
+			return "", "", fmt.Errorf("%q: expected <volume group>/<logical volume>, got %q", id, name)
+		}
+	default:
+		return "", "", fmt.Errorf("%q: unsupported device mode %q", id, mode)
+	}
+	return mode, name, nil
+}
+
+// GetStaticDevice returns the device for the volume handle of a
+// static volume. pmemerr.DeviceNotFound is returned when the
+// namespace or logical volume does not exist.
+func GetStaticDevice(ctx context.Context, id string) (*PmemDeviceInfo, error) {
+	ctx, _ = pmemlog.WithName(ctx, "GetStaticDevice")
+	mode, name, err := ParseStaticVolumeID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var device *PmemDeviceInfo
+	switch mode {
+	case api.DeviceModeDirect:
+		ndctlMutex.RLock()
+		defer ndctlMutex.RUnlock()
+
+		ndctx, err := ndctl.NewContext()
+		if err != nil {
+			return nil, err
+		}
+		defer ndctx.Free()
+		ns, err := ndctl.GetNamespaceByName(ndctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %q: %w", name, err)
+		}
+		device = namespaceToPmemInfo(ns)
+	case api.DeviceModeLVM:
+		lvmMutex.Lock()
+		defer lvmMutex.Unlock()
+
+		// lvs fails when the logical volume does not exist,
+		// list all volumes of the group instead.
+		vg := name[:strings.Index(name, "/")]
+		output, err := pmemexec.RunCommand(ctx, "lvs", append(lvsArgs, vg)...)
+		if err != nil {
+			return nil, fmt.Errorf("lvs failure: %v", err)
+		}
+		device, err = parseStaticLVSOutput(output, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The ID used by the node server.
+	device.VolumeId = id
+	return device, nil
+}
+
+// parseStaticLVSOutput finds the logical volume <vg>/<lv> in the
+// output of lvs with lvsArgs for the volume group. Logical volumes
+// of PMEM-CSI are not returned.
+func parseStaticLVSOutput(output, name string) (*PmemDeviceInfo, error) {
+	lv := name[strings.Index(name, "/")+1:]
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != lv {
+			continue
+		}
+		if len(fields) == 5 && hasLVTag(fields[4]) {
+			return nil, fmt.Errorf("logical volume %q is managed by PMEM-CSI", name)
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("logical volume %q: parse size %q: %v", name, fields[2], err)
+		}
+		return &PmemDeviceInfo{
+			Path: fields[1],
+			Size: size,
+			UUID: fields[3],
+		}, nil
+	}
+	return nil, fmt.Errorf("logical volume %q: %w", name, pmemerr.DeviceNotFound)
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+)
+
+func TestParseStaticVolumeID(t *testing.T) {
+	testcases := map[string]struct {
+		id   string
+		mode api.DeviceMode
+		name string
+		err  bool
+	}{
+		"direct": {
+			id:   "static:direct:db-data",
+			mode: api.DeviceModeDirect,
+			name: "db-data",
+		},
+		"lvm": {
+			id:   "static:lvm:vg0/db-data",
+			mode: api.DeviceModeLVM,
+			name: "vg0/db-data",
+		},
+		"no-prefix": {
+			id:  "direct:db-data",
+			err: true,
+		},
+		"no-name": {
+			id:  "static:direct:",
+			err: true,
+		},
+		"unknown-mode": {
+			id:  "static:dax:db-data",
+			err: true,
+		},
+		"lvm-without-vg": {
+			id:  "static:lvm:db-data",
+			err: true,
+		},
+		"pmem-csi-volume": {
+			id:  "static:direct:pvc-12-" + "0123456789abcdef0123456789abcdef0123456789abcdef01234567",
+			err: true,
+		},
+		"pmem-csi-lvm-namespace": {
+			id:  "static:direct:" + pmemCSINamespaceName,
+			err: true,
+		},
+		"warm-namespace": {
+			id:  "static:direct:" + warmPrefix + "0",
+			err: true,
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, IsStaticVolumeID(tc.id) || name == "no-prefix", "static volume ID")
+			mode, n, err := ParseStaticVolumeID(tc.id)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.mode, mode, "mode")
+			assert.Equal(t, tc.name, n, "name")
+		})
+	}
+}
+
+func TestParseStaticLVSOutput(t *testing.T) {
+	output := `  db-data /dev/vg0/db-data 4194304 rlBgvE-0bXq-2Dq8-rAiu-Wqk2-dSsh-CfFP0o
+  other /dev/vg0/other 8388608 8aXkpl-Ymz1-Ysw9-GfPj-ZTxZ-d0Ze-Q6fV2j backup
+  pvc-12-xyz /dev/vg0/pvc-12-xyz 4194304 oZ3Ffe-vgCy-6IDS-lj1e-bd7T-qx4K-vEeoGw pmem-csi
+`
+	device, err := parseStaticLVSOutput(output, "vg0/db-data")
+	require.NoError(t, err)
+	assert.Equal(t, "/dev/vg0/db-data", device.Path, "path")
+	assert.Equal(t, uint64(4194304), device.Size, "size")
+	assert.Equal(t, "rlBgvE-0bXq-2Dq8-rAiu-Wqk2-dSsh-CfFP0o", device.UUID, "UUID")
+
+	device, err = parseStaticLVSOutput(output, "vg0/other")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(8388608), device.Size, "size with foreign tag")
+
+	_, err = parseStaticLVSOutput(output, "vg0/pvc-12-xyz")
+	assert.Error(t, err, "PMEM-CSI volume")
+
+	_, err = parseStaticLVSOutput(output, "vg0/missing")
+	assert.True(t, errors.Is(err, pmemerr.DeviceNotFound), "missing volume: %v", err)
+}
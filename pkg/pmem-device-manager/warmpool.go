@@ -0,0 +1,324 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// WarmPool maps namespace sizes to the number of fsdax namespaces of
+// that size which are kept ready for new volumes in direct mode.
+// Such namespaces are created and wiped in advance, so provisioning
+// a volume only needs to rename one of them.
+//
+// It can be used as a flag value. Each occurrence of the flag adds
+// one size with "<size>=<count>", for example "4Gi=2".
+type WarmPool map[uint64]int
+
+func (w *WarmPool) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected <size>=<count>, got %q", value)
+	}
+	quantity, err := resource.ParseQuantity(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return fmt.Errorf("size in %q: %v", value, err)
+	}
+	if quantity.Sign() <= 0 {
+		return fmt.Errorf("size in %q must be positive", value)
+	}
+	size := uint64(quantity.Value())
+	count, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return fmt.Errorf("count in %q: %v", value, err)
+	}
+	if count <= 0 {
+		return fmt.Errorf("count in %q must be positive", value)
+	}
+	if _, ok := (*w)[size]; ok {
+		return fmt.Errorf("size %s defined more than once", parts[0])
+	}
+	if *w == nil {
+		*w = WarmPool{}
+	}
+	(*w)[size] = count
+	return nil
+}
+
+func (w *WarmPool) String() string {
+	var entries []string
+	for _, size := range w.sizes() {
+		entries = append(entries, fmt.Sprintf("%s=%d", resource.NewQuantity(int64(size), resource.BinarySI), (*w)[size]))
+	}
+	return strings.Join(entries, ";")
+}
+
+// sizes returns the configured sizes in increasing order.
+func (w *WarmPool) sizes() []uint64 {
+	var sizes []uint64
+	for size := range *w {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes
+}
+
+// warmPrefix is the beginning of the name of all namespaces in the
+// warm pool. The rest is the configured size.
+const warmPrefix = "pmem-csi-warm-"
+
+func warmName(size uint64) string {
+	return fmt.Sprintf("%s%d", warmPrefix, size)
+}
+
+func isWarm(name string) bool {
+	return strings.HasPrefix(name, warmPrefix)
+}
+
+// warmSize returns the configured size of a warm namespace, 0 if the
+// name is invalid.
+func warmSize(name string) uint64 {
+	size, _ := strconv.ParseUint(strings.TrimPrefix(name, warmPrefix), 10, 64)
+	return size
+}
+
+// alignUp returns the raw size of a namespace that gets created
+// for the given size.
+func alignUp(size, align uint64) uint64 {
+	if size == 0 || size%align != 0 {
+		size = (size/align + 1) * align
+	}
+	return size
+}
+
+// takeWarmNamespace looks for a warm namespace in one of the regions
+// which has exactly the size that a new namespace for the volume
+// would get and renames it. It returns the raw size of that
+// namespace, 0 if there is none. Must be called while holding
+// ndctlMutex for reading.
+func takeWarmNamespace(ctx context.Context, regions []string, volumeId string, size, limit uint64) (uint64, error) {
+	logger := klog.FromContext(ctx)
+	var actual uint64
+	for _, region := range regions {
+		if err := withRegion(region, func(ndctx ndctl.Context, r ndctl.Region) error {
+			align, _ := ndctl.CalculateAlignment(r)
+			for _, ns := range r.ActiveNamespaces() {
+				if !isWarm(ns.Name()) ||
+					ns.Mode() != ndctl.FsdaxMode ||
+					ns.RawSize() != alignUp(size, align) ||
+					limit > 0 && ns.RawSize() > limit {
+					continue
+				}
+				if err := renameNamespace(ns, volumeId); err != nil {
+					return fmt.Errorf("rename warm namespace %s: %v", ns.DeviceName(), err)
+				}
+				logger.V(3).Info("Using warm namespace", "namespace", ns.DeviceName(), "region", r.DeviceName())
+				actual = ns.RawSize()
+				return nil
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		if actual > 0 {
+			break
+		}
+	}
+	return actual, nil
+}
+
+// destroyWarmNamespaces frees the space used by warm namespaces in
+// the regions. It returns true if any namespace was destroyed. Must
+// be called while holding ndctlMutex for reading.
+func destroyWarmNamespaces(ctx context.Context, regions []string) (bool, error) {
+	logger := klog.FromContext(ctx)
+	destroyed := false
+	for _, region := range regions {
+		if err := withRegion(region, func(ndctx ndctl.Context, r ndctl.Region) error {
+			for _, ns := range r.ActiveNamespaces() {
+				if !isWarm(ns.Name()) {
+					continue
+				}
+				logger.V(3).Info("Destroying warm namespace", "namespace", ns.DeviceName(), "region", r.DeviceName())
+				if err := r.DestroyNamespace(ctx, ns, true); err != nil {
+					return fmt.Errorf("destroy warm namespace %s: %v", ns.DeviceName(), err)
+				}
+				destroyed = true
+			}
+			return nil
+		}); err != nil {
+			return destroyed, err
+		}
+	}
+	return destroyed, nil
+}
+
+// DestroyDriverNamespaces destroys the warm namespaces and the
+// namespaces for system RAM in all writable regions. System RAM gets
+// offlined first. Namespaces for volumes and LVM are left alone, see
+// RemoveVolumeGroups.
+func DestroyDriverNamespaces(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "DestroyDriverNamespaces")
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := newNdctlContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Readonly() {
+				logger.V(3).Info("Skipped because read-only", "region", r.DeviceName())
+				continue
+			}
+			for _, ns := range r.ActiveNamespaces() {
+				switch {
+				case isWarm(ns.Name()):
+				case ns.Name() == kmemNamespaceName:
+					if err := offlineSystemRAM(ctx, ns.DeviceName()); err != nil {
+						return fmt.Errorf("region %s: offline system RAM of %s: %v", r.DeviceName(), ns.DeviceName(), err)
+					}
+				default:
+					continue
+				}
+				logger.V(2).Info("Destroying namespace", "namespace", ns.DeviceName(), "name", ns.Name(), "region", r.DeviceName())
+				if err := r.DestroyNamespace(ctx, ns, true); err != nil {
+					return fmt.Errorf("region %s: destroy namespace %s: %v", r.DeviceName(), ns.DeviceName(), err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// maintainWarmPool keeps the warm pool filled until the context is
+// done. It gets triggered through pmem.refill.
+func (pmem *pmemNdctl) maintainWarmPool(ctx context.Context) {
+	ctx, logger := pmemlog.WithName(ctx, "WarmPool")
+	for {
+		if err := pmem.fillWarmPool(ctx); err != nil {
+			logger.Error(err, "Filling the warm pool failed")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-pmem.refill:
+		}
+	}
+}
+
+// triggerRefill asks maintainWarmPool to fill the pool without
+// blocking the caller.
+func (pmem *pmemNdctl) triggerRefill() {
+	if pmem.refill == nil {
+		return
+	}
+	select {
+	case pmem.refill <- struct{}{}:
+	default:
+	}
+}
+
+// fillWarmPool creates missing warm namespaces one at a time, so
+// that volume operations only have to wait for one namespace.
+// Namespaces of sizes which are no longer configured get removed.
+func (pmem *pmemNdctl) fillWarmPool(ctx context.Context) error {
+	full := map[uint64]bool{}
+	for ctx.Err() == nil {
+		changed, err := pmem.fillWarmPoolStep(ctx, full)
+		if err != nil || !changed {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillWarmPoolStep creates or destroys at most one warm namespace.
+// Sizes for which there is not enough space get added to full.
+func (pmem *pmemNdctl) fillWarmPoolStep(ctx context.Context, full map[uint64]bool) (bool, error) {
+	logger := klog.FromContext(ctx)
+	defer pmem.capacity.invalidate()
+	ndctlMutex.RLock()
+	defer ndctlMutex.RUnlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return false, err
+	}
+	defer ndctx.Free()
+
+	counts := map[uint64]int{}
+	for _, ns := range ndctl.GetActiveNamespaces(ndctx) {
+		if !isWarm(ns.Name()) {
+			continue
+		}
+		size := warmSize(ns.Name())
+		if _, ok := pmem.warmPool[size]; !ok {
+			name := ns.DeviceName()
+			logger.V(3).Info("Destroying unused warm namespace", "namespace", name)
+			return true, withRegion(ns.Region().DeviceName(), func(ndctx ndctl.Context, r ndctl.Region) error {
+				for _, ns := range r.ActiveNamespaces() {
+					if ns.DeviceName() == name && isWarm(ns.Name()) {
+						if err := r.DestroyNamespace(ctx, ns, true); err != nil {
+							return fmt.Errorf("destroy warm namespace %s: %v", name, err)
+						}
+					}
+				}
+				return nil
+			})
+		}
+		counts[size]++
+	}
+
+	for _, size := range pmem.warmPool.sizes() {
+		if full[size] || counts[size] >= pmem.warmPool[size] {
+			continue
+		}
+		device, _, err := createNamespace(ctx, activeRegions(ndctx, nil), ndctl.CreateNamespaceOpts{
+			Name:           warmName(size),
+			Size:           size,
+			Mode:           ndctl.FsdaxMode,
+			AvoidBadBlocks: true,
+		})
+		if errors.Is(err, pmemerr.NotEnoughSpace) {
+			logger.V(3).Info("Not enough space for warm namespace", "size", pmemlog.CapacityRef(int64(size)))
+			full[size] = true
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		logger.V(3).Info("Created warm namespace", "device", device.Path,
+			"size", pmemlog.CapacityRef(int64(size)), "count", counts[size]+1)
+		return true, nil
+	}
+	return false, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
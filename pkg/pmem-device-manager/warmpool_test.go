@@ -0,0 +1,188 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestWarmPool(t *testing.T) {
+	var warmPool WarmPool
+	require.NoError(t, warmPool.Set("4Gi=2"), "first size")
+	require.NoError(t, warmPool.Set(" 1Gi = 10 "), "second size")
+	assert.Equal(t, WarmPool{1024 * 1024 * 1024: 10, 4 * 1024 * 1024 * 1024: 2}, warmPool, "sizes")
+	assert.Equal(t, "1Gi=10;4Gi=2", warmPool.String(), "string")
+
+	for _, value := range []string{
+		"4096Mi=1",
+		"4Gi",
+		"=1",
+		"0=1",
+		"1Gi=0",
+		"1Gi=x",
+		"x=1",
+	} {
+		assert.Error(t, warmPool.Set(value), value)
+	}
+}
+
+func TestWarmName(t *testing.T) {
+	name := warmName(4 * 1024 * 1024 * 1024)
+	assert.True(t, isWarm(name), "is warm")
+	assert.Equal(t, uint64(4*1024*1024*1024), warmSize(name), "size")
+	assert.False(t, isWarm("pmem-csi-defrag"), "other name")
+	assert.Equal(t, uint64(0), warmSize(warmPrefix+"x"), "invalid size")
+}
+
+func TestAlignUp(t *testing.T) {
+	assert.Equal(t, uint64(96), alignUp(0, 96), "zero")
+	assert.Equal(t, uint64(96), alignUp(1, 96), "one")
+	assert.Equal(t, uint64(96), alignUp(96, 96), "aligned")
+	assert.Equal(t, uint64(192), alignUp(97, 96), "unaligned")
+}
+
+func TestCreateWarmNamespaces(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	var regions []ndctl.Region
+	var names []string
+	for _, name := range []string{"region0", "region1"} {
+		regions = append(regions, &ndctlfake.Region{
+			DeviceName_:         name,
+			Size_:               64 * gig,
+			MaxAvailableExtent_: 64 * gig,
+			Enabled_:            true,
+			Type_:               ndctl.PmemRegion,
+		})
+		names = append(names, name)
+	}
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: regions}},
+	})
+	oldContext, oldClear := newNdctlContext, clearNewDevice
+	defer func() {
+		newNdctlContext, clearNewDevice = oldContext, oldClear
+	}()
+	newNdctlContext = func() (ndctl.Context, error) {
+		return ndctx, nil
+	}
+	var mutex sync.Mutex
+	cleared := map[string]int{}
+	clearNewDevice = func(ctx context.Context, device *PmemDeviceInfo) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cleared[device.UUID]++
+		return nil
+	}
+
+	// All namespaces have the same name and each one must be
+	// cleared and returned exactly once.
+	const num = 10
+	devices := make([]*PmemDeviceInfo, num)
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			device, _, err := createNamespace(ctx, names, ndctl.CreateNamespaceOpts{
+				Name: warmName(gig),
+				Size: gig,
+				Mode: ndctl.FsdaxMode,
+			})
+			assert.NoError(t, err, "create namespace #%d", i)
+			devices[i] = device
+		}(i)
+	}
+	wg.Wait()
+
+	created := map[string]bool{}
+	for _, r := range regions {
+		for _, ns := range r.AllNamespaces() {
+			created[ns.UUID().String()] = true
+		}
+	}
+	require.Len(t, created, num, "created namespaces")
+	returned := map[string]bool{}
+	for i, device := range devices {
+		require.NotNil(t, device, "device #%d", i)
+		assert.True(t, created[device.UUID], "device #%d is a new namespace", i)
+		returned[device.UUID] = true
+	}
+	assert.Len(t, returned, num, "different devices")
+	for uid := range created {
+		assert.Equal(t, 1, cleared[uid], "namespace %s cleared once", uid)
+	}
+}
+
+func TestDestroyDriverNamespaces(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	ndctlList := `#!/bin/sh
+echo '{"dev":"namespace0.1","mode":"devdax","chardev":"dax0.1"}'
+`
+	daxctl := `#!/bin/sh
+case "$1" in
+list) echo '[{"chardev":"dax0.1","mode":"system-ram"}]';;
+*) echo daxctl "$@" >>` + log + `;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "ndctl"), []byte(ndctlList), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "daxctl"), []byte(daxctl), 0700))
+	os.Setenv("PATH", bin+":"+path)
+
+	warm := &ndctlfake.Namespace{Name_: warmName(gig), DeviceName_: "namespace0.0", Size_: gig, Mode_: ndctl.FsdaxMode, Enabled_: true}
+	kmem := &ndctlfake.Namespace{Name_: kmemNamespaceName, DeviceName_: "namespace0.1", Size_: gig, Mode_: ndctl.DaxMode, Enabled_: true}
+	volume := &ndctlfake.Namespace{Name_: "pvc-aa-bb", DeviceName_: "namespace0.2", Size_: gig, Mode_: ndctl.FsdaxMode, Enabled_: true}
+	region0 := &ndctlfake.Region{
+		DeviceName_: "region0",
+		Size_:       64 * gig,
+		Enabled_:    true,
+		Type_:       ndctl.PmemRegion,
+		Namespaces_: []ndctl.Namespace{warm, kmem, volume},
+	}
+	readonlyWarm := &ndctlfake.Namespace{Name_: warmName(gig), DeviceName_: "namespace1.0", Size_: gig, Mode_: ndctl.FsdaxMode, Enabled_: true}
+	region1 := &ndctlfake.Region{
+		DeviceName_: "region1",
+		Size_:       64 * gig,
+		Enabled_:    true,
+		Readonly_:   true,
+		Type_:       ndctl.PmemRegion,
+		Namespaces_: []ndctl.Namespace{readonlyWarm},
+	}
+	ndctx := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{&ndctlfake.Bus{DeviceName_: "ndbus0", Regions_: []ndctl.Region{region0, region1}}},
+	})
+	oldContext := newNdctlContext
+	defer func() {
+		newNdctlContext = oldContext
+	}()
+	newNdctlContext = func() (ndctl.Context, error) {
+		return ndctx, nil
+	}
+
+	require.NoError(t, DestroyDriverNamespaces(ctx), "destroy namespaces")
+	output, err := os.ReadFile(log)
+	require.NoError(t, err, "read command log")
+	assert.Equal(t, "daxctl reconfigure-device --mode=devdax --force dax0.1\n", string(output), "commands")
+	assert.Equal(t, []ndctl.Namespace{volume}, region0.ActiveNamespaces(), "remaining namespaces in region0")
+	assert.Equal(t, []ndctl.Namespace{readonlyWarm}, region1.ActiveNamespaces(), "read-only region unchanged")
+}
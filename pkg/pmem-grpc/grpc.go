@@ -10,25 +10,26 @@ import (
 	"net"
 	"os"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/kubernetes-csi/csi-lib-utils/connection"
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 )
 
-// grpcRequestCounter is used to assign a unique ID to all incoming gRPC requests.
-var grpcRequestCounter uint64
-
 func unixDialer(ctx context.Context, addr string) (net.Conn, error) {
 	dialer := net.Dialer{}
 	return dialer.DialContext(ctx, "unix", addr)
@@ -62,10 +63,34 @@ func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOpt
 	// in a timely manner.
 	// Code lifted from https://github.com/kubernetes-csi/csi-test/commit/6b8830bf5959a1c51c6e98fe514b22818b51eeeb
 	dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{PermitWithoutStream: true}))
+	// Propagates the trace context to the server.
+	dialOptions = append(dialOptions, grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	dialOptions = append(dialOptions, grpc.WithChainUnaryInterceptor(outgoingRequestID))
 
 	return grpc.Dial(address, dialOptions...)
 }
 
+// outgoingRequestID passes the request ID of the current call on to
+// the server, which then uses it in its own log output.
+func outgoingRequestID(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if id := pmemlog.RequestID(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, pmemlog.RequestIDKey, id)
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// incomingRequestID returns the request ID sent by the client, if any.
+func incomingRequestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if ids := md.Get(pmemlog.RequestIDKey); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
 // NewServer is a helper function to start a grpc server at the given endpoint.
 // The error prefix is added to all error messages if not empty.
 func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsManager metrics.CSIMetricsManager, opts ...grpc.ServerOption) (*grpc.Server, net.Listener, error) {
@@ -87,13 +112,19 @@ func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsMa
 
 	interceptors := []grpc.UnaryServerInterceptor{
 		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-			// Prepare a logger instance which always adds GRPC as prefix and a unique
-			// counter. This makes it possible to determine which log messages belong
-			// to which request and which are unrelated to gRPC.
+			// Prepare a logger instance which always adds the method name as prefix
+			// and a request ID. This makes it possible to determine which log messages
+			// belong to which request, including the output of commands, and which are
+			// unrelated to gRPC. The ID is taken from the caller if it sent one.
 			logger := klog.FromContext(ctx)
 			methodName := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
-			logger = logger.WithName(methodName).WithValues("request-counter", atomic.AddUint64(&grpcRequestCounter, 1))
-			ctx = klog.NewContext(ctx, logger)
+			ctx = klog.NewContext(ctx, logger.WithName(methodName))
+			id := incomingRequestID(ctx)
+			if id == "" {
+				id = pmemlog.NewRequestID()
+			}
+			ctx, _ = pmemlog.WithRequestID(ctx, id)
+			trace.SpanFromContext(ctx).SetAttributes(attribute.String(pmemlog.RequestIDKey, id))
 
 			resp, err := handler(ctx, req)
 			if errorPrefix != "" && err != nil {
@@ -114,6 +145,9 @@ func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsMa
 			connection.ExtendedCSIMetricsManager{CSIMetricsManager: csiMetricsManager}.RecordMetricsServerInterceptor)
 	}
 	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...))
+	// Creates a span for each call, as child of the span of the
+	// caller if it sent a trace context.
+	opts = append(opts, grpc.StatsHandler(otelgrpc.NewServerHandler()))
 	if tlsConfig != nil {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
@@ -283,6 +317,21 @@ func loadCertificate(caFile, certFile, keyFile string) (certPool *x509.CertPool,
 	return
 }
 
+// CheckEndpoint returns an error if nothing accepts connections on
+// the endpoint.
+func CheckEndpoint(ctx context.Context, endpoint string) error {
+	proto, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, proto, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func parseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
 		s := strings.SplitN(ep, "://", 2)
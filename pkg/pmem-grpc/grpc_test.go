@@ -0,0 +1,39 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemgrpc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	ctx := context.Background()
+	ctx, _ = pmemlog.WithRequestID(ctx, "1234")
+
+	var sent metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		sent, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	assert.NoError(t, outgoingRequestID(ctx, "/test/Method", nil, nil, nil, invoker), "invoke")
+	assert.Equal(t, []string{"1234"}, sent.Get(pmemlog.RequestIDKey), "outgoing metadata")
+
+	incoming := metadata.NewIncomingContext(context.Background(), sent)
+	assert.Equal(t, "1234", incomingRequestID(incoming), "incoming request ID")
+	assert.Empty(t, incomingRequestID(context.Background()), "no metadata")
+
+	sent = nil
+	assert.NoError(t, outgoingRequestID(context.Background(), "/test/Method", nil, nil, nil, invoker), "invoke without ID")
+	assert.Empty(t, sent.Get(pmemlog.RequestIDKey), "no request ID")
+}
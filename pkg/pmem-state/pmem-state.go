@@ -7,10 +7,12 @@ package pmemstate
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash/fnv"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -28,105 +30,292 @@ type StateManager interface {
 	GetAll() ([]string, error)
 }
 
+const (
+	// volumesDir is the sub-directory which contains the shards
+	// and the index.
+	volumesDir = "volumes"
+	// indexFile lists the IDs of all entries.
+	indexFile = "index.json"
+	// numShards is the number of sub-directories in volumesDir
+	// over which entries get distributed.
+	numShards   = 256
+	entrySuffix = ".json"
+	tmpSuffix   = ".tmp"
+)
+
 // fileState Persists the state information into a file.
 // This is is supposed to use by Nodes to persists the state.
 type fileState struct {
 	location string
-	// lock holds read-write lock
-	lock sync.RWMutex
-	// stateDirLock holds lock on state directory
-	stateDirLock sync.Mutex
+
+	// mutex protects all of the following fields.
+	mutex sync.Mutex
+	// cond is signaled when a commit finishes.
+	cond *sync.Cond
+	// ids is the content of the index, including changes that
+	// are not committed yet.
+	ids map[string]bool
+	// dirty contains directories which need to be synced by the
+	// next commit.
+	dirty map[string]bool
+	// committing is true while some goroutine writes a commit.
+	committing bool
+	// started and finished count commits.
+	started, finished uint64
+	// commitErr is the result of the last finished commit.
+	commitErr error
 }
 
 var _ StateManager = &fileState{}
 
 // NewFileState instantiates the file state manager with given directory
 // location. It ensures the provided directory exists.
-// State entries are mapped to files with the .json suffix in that directory and
-// vice versa. Other directory content is ignored, which makes it possible
-// to use the directory also for other state information.
+//
+// Entries are stored as <id>.json files in the "volumes" sub-directory,
+// distributed over up to 256 shards. The index file in that directory
+// lists all entries, so reading it is enough to find them. .json files
+// directly in the directory are entries stored by older releases and get
+// moved into the shards. Other directory content is ignored, which makes
+// it possible to use the directory also for other state information.
 func NewFileState(directory string) (StateManager, error) {
 	if err := ensureLocation(directory); err != nil {
 		return nil, err
 	}
 
-	return &fileState{
+	fs := &fileState{
 		location: directory,
-	}, nil
+		dirty:    map[string]bool{},
+	}
+	fs.cond = sync.NewCond(&fs.mutex)
+	ids, err := fs.readIndex()
+	if err != nil {
+		// First start with this layout or the index was lost.
+		ids, err = fs.migrate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.ids = ids
+	return fs, nil
 }
 
 // Create saves the volume metadata to file named <id>.json, overwriting
 // any existing one with the same ID.
 func (fs *fileState) Create(id string, data interface{}) error {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
-	suffix := ".tmp"
-	file := path.Join(fs.location, id+".json"+suffix)
-	// Create new file for synchronous writes
-	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0600)
+	shard := fs.shardDir(id)
+	created, err := ensureShard(shard)
 	if err != nil {
-		return fmt.Errorf("failed to create state file: %w", err)
-	}
-
-	if err := json.NewEncoder(fp).Encode(data); err != nil {
-		// cleanup file entry before returning error
-		fp.Close()      //nolint: errcheck, gosec
-		os.Remove(file) //nolint: errcheck, gosec
-		return fmt.Errorf("failed to encode metadata: %w", err)
+		return err
 	}
-
-	if err := fp.Close(); err != nil {
-		return fmt.Errorf("failed to close state file: %w", err)
+	if err := writeFile(filepath.Join(shard, id+entrySuffix), data); err != nil {
+		return err
 	}
 
-	if err := os.Rename(file, file[:len(file)-len(suffix)]); err != nil {
-		return fmt.Errorf("failed to rename state file: %w", err)
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.ids[id] = true
+	fs.dirty[shard] = true
+	if created {
+		fs.dirty[fs.volumesDir()] = true
 	}
-
-	return fs.syncStateDir()
+	return fs.commit()
 }
 
 // Delete deletes the metadata file saved for given volume id
 func (fs *fileState) Delete(id string) error {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	// The entry gets removed from the index first. If removing
+	// the file then fails or gets lost in a crash, the file is
+	// ignored and gets overwritten by the next Create.
+	fs.mutex.Lock()
+	delete(fs.ids, id)
+	err := fs.commit()
+	fs.mutex.Unlock()
+	if err != nil {
+		return err
+	}
 
-	file := path.Join(fs.location, id+".json")
-	if err := os.Remove(file); err != nil && err != os.ErrNotExist {
+	file := filepath.Join(fs.shardDir(id), id+entrySuffix)
+	if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
 		return fmt.Errorf("failed to delete state file: %w", err)
 	}
-
-	return fs.syncStateDir()
+	return nil
 }
 
 // Get retrieves metadata for given volume id to pointer location of dataPtr
 func (fs *fileState) Get(id string, dataPtr interface{}) error {
-	return fs.readFileData(path.Join(fs.location, id+".json"), dataPtr)
+	return readFile(filepath.Join(fs.shardDir(id), id+entrySuffix), dataPtr)
 }
 
-// GetAll retrieves the names of all .json files found in fileState.location directory
+// GetAll retrieves the IDs of all entries in the index.
 func (fs *fileState) GetAll() ([]string, error) {
-	fs.stateDirLock.Lock()
-	files, err := ioutil.ReadDir(fs.location)
-	fs.stateDirLock.Unlock()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return sortedIDs(fs.ids), nil
+}
+
+func (fs *fileState) volumesDir() string {
+	return filepath.Join(fs.location, volumesDir)
+}
+
+// shardDir returns the directory for the entry with the ID.
+func (fs *fileState) shardDir(id string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return filepath.Join(fs.volumesDir(), fmt.Sprintf("%02x", h.Sum32()%numShards))
+}
+
+// commit ensures that the current index and all files written before
+// are stored persistently. Concurrent callers share the same commit:
+// while one of them writes, the others wait and then get handled by
+// the next commit together. Must be called with the mutex locked.
+func (fs *fileState) commit() error {
+	// A commit which is in progress might not include the
+	// caller's changes, the next one will.
+	want := fs.started + 1
+	for fs.finished < want {
+		if fs.committing {
+			fs.cond.Wait()
+			continue
+		}
+		fs.committing = true
+		fs.started++
+		dirs := fs.dirty
+		fs.dirty = map[string]bool{}
+		ids := sortedIDs(fs.ids)
+
+		fs.mutex.Unlock()
+		err := fs.flush(dirs, ids)
+		fs.mutex.Lock()
+
+		if err != nil {
+			// Try again in the next commit.
+			for dir := range dirs {
+				fs.dirty[dir] = true
+			}
+		}
+		fs.committing = false
+		fs.finished = fs.started
+		fs.commitErr = err
+		fs.cond.Broadcast()
+	}
+	return fs.commitErr
+}
+
+// flush syncs the directories, then replaces the index. Shards come
+// before their parent because new shards need to be complete before
+// they become visible.
+func (fs *fileState) flush(dirs map[string]bool, ids []string) error {
+	volumes := fs.volumesDir()
+	for dir := range dirs {
+		if dir != volumes {
+			if err := syncDir(dir); err != nil {
+				return err
+			}
+		}
+	}
+	if dirs[volumes] {
+		if err := syncDir(volumes); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(filepath.Join(volumes, indexFile), ids); err != nil {
+		return fmt.Errorf("failed to write state index: %w", err)
+	}
+	return syncDir(volumes)
+}
+
+// readIndex returns the entries listed in the index.
+func (fs *fileState) readIndex() (map[string]bool, error) {
+	var list []string
+	if err := readFile(filepath.Join(fs.volumesDir(), indexFile), &list); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(list))
+	for _, id := range list {
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+// migrate moves entries stored by older releases into the shards and
+// creates the index for all entries found in the shards. Interrupting
+// it is safe because it starts again when there is no index.
+func (fs *fileState) migrate() (map[string]bool, error) {
+	volumes := fs.volumesDir()
+	if err := ensureLocation(volumes); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(fs.location)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read metadata from %q: %w", fs.location, err)
 	}
-
-	ids := []string{}
-	for _, fileInfo := range files {
-		fileName := fileInfo.Name()
-		if !strings.HasSuffix(fileName, ".json") {
+	dirs := map[string]bool{fs.location: true, volumes: true}
+	for _, file := range files {
+		id, ok := entryID(file)
+		if !ok {
 			continue
 		}
+		shard := fs.shardDir(id)
+		if _, err := ensureShard(shard); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(filepath.Join(fs.location, file.Name()), filepath.Join(shard, file.Name())); err != nil {
+			return nil, fmt.Errorf("failed to move state file: %w", err)
+		}
+		dirs[shard] = true
+	}
 
-		ids = append(ids, fileName[0:len(fileName)-len(".json")])
+	ids := map[string]bool{}
+	shards, err := os.ReadDir(volumes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata from %q: %w", volumes, err)
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		dir := filepath.Join(volumes, shard.Name())
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata from %q: %w", dir, err)
+		}
+		for _, file := range files {
+			if id, ok := entryID(file); ok {
+				ids[id] = true
+			}
+		}
 	}
 
+	// The old directory must be synced after the new shards,
+	// otherwise the moved files could get lost.
+	delete(dirs, fs.location)
+	if err := fs.flush(dirs, sortedIDs(ids)); err != nil {
+		return nil, err
+	}
+	if err := syncDir(fs.location); err != nil {
+		return nil, err
+	}
 	return ids, nil
 }
 
+// entryID returns the ID for a file which contains an entry.
+func entryID(file os.DirEntry) (string, bool) {
+	name := file.Name()
+	if file.IsDir() || !strings.HasSuffix(name, entrySuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(name, entrySuffix), true
+}
+
+func sortedIDs(ids map[string]bool) []string {
+	list := make([]string, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+	sort.Strings(list)
+	return list
+}
+
 func ensureLocation(directory string) error {
 	info, err := os.Stat(directory)
 	if err != nil {
@@ -140,11 +329,57 @@ func ensureLocation(directory string) error {
 	return err
 }
 
-func (fs *fileState) readFileData(file string, dataPtr interface{}) error {
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
+// ensureShard creates the shard directory if needed and reports
+// whether it did.
+func ensureShard(dir string) (bool, error) {
+	err := os.Mkdir(dir, 0750)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, os.ErrExist):
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to create state shard: %w", err)
+	}
+}
+
+// writeFile atomically replaces the file with the JSON encoding of
+// the data. The content is on disk when it returns, the directory
+// entry only after syncing the directory.
+func writeFile(file string, data interface{}) error {
+	// A unique name, in case that the same file is written
+	// concurrently.
+	fp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*"+tmpSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %w", err)
+	}
+	tmp := fp.Name()
+
+	if err := json.NewEncoder(fp).Encode(data); err != nil {
+		// cleanup file entry before returning error
+		fp.Close()     //nolint: errcheck, gosec
+		os.Remove(tmp) //nolint: errcheck, gosec
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	if err := fp.Sync(); err != nil {
+		fp.Close()     //nolint: errcheck, gosec
+		os.Remove(tmp) //nolint: errcheck, gosec
+		return fmt.Errorf("fsync failure on state file: %w", err)
+	}
+
+	if err := fp.Close(); err != nil {
+		return fmt.Errorf("failed to close state file: %w", err)
+	}
+
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("failed to rename state file: %w", err)
+	}
+	return nil
+}
 
-	fp, err := os.OpenFile(file, os.O_RDONLY|os.O_SYNC, 0) //nolint: gosec
+func readFile(file string, dataPtr interface{}) error {
+	fp, err := os.Open(file) //nolint: gosec
 	if err != nil {
 		return fmt.Errorf("failed to open state file: %w", err)
 	}
@@ -157,12 +392,10 @@ func (fs *fileState) readFileData(file string, dataPtr interface{}) error {
 	return nil
 }
 
-func (fs *fileState) syncStateDir() error {
+func syncDir(dir string) error {
 	var rErr error
-	fs.stateDirLock.Lock()
-	defer fs.stateDirLock.Unlock()
 
-	if fp, err := os.Open(fs.location); err != nil {
+	if fp, err := os.Open(dir); err != nil {
 		rErr = fmt.Errorf("failed to open state directory for syncing: %w", err)
 	} else if err := fp.Sync(); err != nil {
 		fp.Close() //nolint: errcheck
@@ -6,10 +6,11 @@ SPDX-License-Identifier: Apache-2.0
 package pmemstate_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
@@ -318,7 +319,10 @@ var _ = Describe("pmem state", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			// truncate file data
-			file := path.Join(stateDir, data.Id+".json")
+			files, err := filepath.Glob(filepath.Join(stateDir, "volumes", "*", data.Id+".json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1), "state file")
+			file := files[0]
 			fInfo, err := os.Stat(file)
 			Expect(err).NotTo(HaveOccurred())
 			err = os.Truncate(file, fInfo.Size()-10)
@@ -374,5 +378,89 @@ var _ = Describe("pmem state", func() {
 				Expect(data).Should(ContainElement(rData), "records data shold match")
 			}
 		})
+
+		It("migrates old state", func() {
+			data := testData{
+				Id:   "old",
+				Name: "test-data-old",
+				Params: map[string]string{
+					"key1": "val1",
+				},
+			}
+			// Stored like older releases did.
+			content, err := json.Marshal(data)
+			Expect(err).NotTo(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(stateDir, data.Id+".json"), content, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(stateDir, "other"), []byte("hello"), 0600)
+			Expect(err).NotTo(HaveOccurred())
+
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data.Id}), "migrated entries")
+			rData := testData{}
+			err = fs.Get(data.Id, &rData)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data.IsEqual(rData)).To(Equal(true))
+			Expect(filepath.Join(stateDir, data.Id+".json")).NotTo(BeAnExistingFile(), "old state file")
+			Expect(filepath.Join(stateDir, "other")).To(BeAnExistingFile(), "other file")
+
+			// The index is enough after a restart.
+			fs, err = pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err = fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data.Id}), "entries after restart")
+		})
+
+		It("recovers from lost index", func() {
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, id := range []string{"one", "two", "three"} {
+				err = fs.Create(id, testData{Id: id})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			err = fs.Delete("two")
+			Expect(err).NotTo(HaveOccurred())
+
+			err = os.Remove(filepath.Join(stateDir, "volumes", "index.json"))
+			Expect(err).NotTo(HaveOccurred())
+			fs, err = pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"one", "three"}), "entries found in shards")
+		})
+
+		It("concurrent creates and deletes", func() {
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+
+			const num = 100
+			wg := sync.WaitGroup{}
+			for i := 0; i < num; i++ {
+				wg.Add(1)
+				go func(id string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(fs.Create(id, testData{Id: id})).To(Succeed())
+					Expect(fs.Create(id+"-deleted", testData{Id: id})).To(Succeed())
+					Expect(fs.Delete(id + "-deleted")).To(Succeed())
+				}(fmt.Sprintf("id-%03d", i))
+			}
+			wg.Wait()
+
+			// Compare against what a restart finds.
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(HaveLen(num), "entries")
+			fs, err = pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			restarted, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restarted).To(Equal(ids), "entries after restart")
+		})
 	})
 })
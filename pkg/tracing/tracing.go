@@ -0,0 +1,81 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package tracing contains helper code for OpenTelemetry tracing.
+// Spans get created unconditionally. They are only exported after
+// Setup has installed a tracer provider, otherwise the no-op provider
+// of OpenTelemetry drops them.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.25.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the tracer of PMEM-CSI.
+const instrumentationName = "github.com/intel/pmem-csi"
+
+// Setup installs a global tracer provider which sends spans to an
+// OTLP collector via gRPC. The exporter and the sampler are
+// configured with the standard OTEL_* environment variables, for
+// example OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_TRACES_SAMPLER, like
+// in the Kubernetes CSI sidecars. The default is to sample a request
+// when the caller sampled it. The trace context of incoming gRPC
+// calls gets propagated in the W3C format.
+//
+// The returned function flushes pending spans and must be called
+// before the process exits.
+func Setup(ctx context.Context, serviceName, version string) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %v", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version),
+		),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+		// override the defaults.
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create OpenTelemetry resource: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start creates a new span as child of the span in the context, if
+// there is one.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End marks the span as failed if there was an error, then ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
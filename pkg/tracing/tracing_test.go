@@ -0,0 +1,43 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(old)
+
+	ctx, parent := Start(context.Background(), "parent")
+	_, child := Start(ctx, "child", attribute.String("volume-id", "pvc-aa-bb"))
+	End(child, errors.New("fake error"))
+	End(parent, nil)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2, "ended spans")
+	assert.Equal(t, "child", spans[0].Name(), "child name")
+	assert.Equal(t, spans[1].SpanContext().SpanID(), spans[0].Parent().SpanID(), "child of parent")
+	assert.Equal(t, []attribute.KeyValue{attribute.String("volume-id", "pvc-aa-bb")}, spans[0].Attributes(), "child attributes")
+	assert.Equal(t, codes.Error, spans[0].Status().Code, "child status")
+	assert.Equal(t, "fake error", spans[0].Status().Description, "child error")
+	assert.Equal(t, codes.Unset, spans[1].Status().Code, "parent status")
+}
@@ -11,42 +11,90 @@ package types
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
-// NodeSelector is a set of unique keys and their values.
-type NodeSelector map[string]string
+// NodeSelector is a set of unique keys and their values plus
+// additional label requirements. All of them must be satisfied by a
+// node.
+type NodeSelector struct {
+	MatchLabels      map[string]string
+	MatchExpressions []metav1.LabelSelectorRequirement
+}
 
-// Set converts a JSON representation into a NodeSelector.
+// Set converts a JSON representation into a NodeSelector. Both
+// a plain map (`{"storage":"pmem"}`) and a label selector
+// (`{"matchExpressions":[...]}`) are accepted.
 func (n *NodeSelector) Set(value string) error {
-	// Decoding into a plain map yields better error messages:
-	// "cannot unmarshal string into Go value of type types.NodeSelector"
-	// vs.
-	// "cannot unmarshal string into Go value of type map[string]string"
+	// Decoding into a plain map yields better error messages for
+	// the traditional format.
 	var m map[string]string
-	if err := json.NewDecoder(bytes.NewBufferString(value)).Decode(&m); err != nil {
-		return err
+	mapErr := decodeStrict(value, &m)
+	if mapErr == nil {
+		*n = NodeSelector{MatchLabels: m}
+		return nil
+	}
+
+	var selector metav1.LabelSelector
+	if err := decodeStrict(value, &selector); err != nil {
+		// Most users still use the plain map.
+		return mapErr
 	}
-	*n = m
+	if _, err := metav1.LabelSelectorAsSelector(&selector); err != nil {
+		return fmt.Errorf("invalid label selector: %v", err)
+	}
+	*n = NodeSelector{MatchLabels: selector.MatchLabels, MatchExpressions: selector.MatchExpressions}
 	return nil
 }
 
+func decodeStrict(value string, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewBufferString(value))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
 // String converts into the JSON representation expected by Set.
+// Without expressions, the plain map is used because older
+// releases of the driver only support that.
 func (n *NodeSelector) String() string {
 	var value bytes.Buffer
-	if err := json.NewEncoder(&value).Encode(n); err != nil {
+	var obj interface{} = n.MatchLabels
+	if len(n.MatchExpressions) > 0 {
+		obj = &metav1.LabelSelector{
+			MatchLabels:      n.MatchLabels,
+			MatchExpressions: n.MatchExpressions,
+		}
+	}
+	if err := json.NewEncoder(&value).Encode(obj); err != nil {
 		panic(err)
 	}
 	return strings.TrimSpace(value.String())
 }
 
+// IsSet returns true if the selector contains labels or expressions.
+func (n *NodeSelector) IsSet() bool {
+	return n.MatchLabels != nil || n.MatchExpressions != nil
+}
+
 // MatchesLabels returns true if all key/value pairs in the selector
-// are set in the labels.
-func (n *NodeSelector) MatchesLabels(labels map[string]string) bool {
-	for key, value := range *n {
-		if labels[key] != value {
+// are set in the labels and all expressions are satisfied.
+func (n *NodeSelector) MatchesLabels(nodeLabels map[string]string) bool {
+	for key, value := range n.MatchLabels {
+		if nodeLabels[key] != value {
 			return false
 		}
 	}
-	return true
+	if len(n.MatchExpressions) == 0 {
+		return true
+	}
+	selector, err := metav1.LabelSelectorAsSelector(&metav1.LabelSelector{MatchExpressions: n.MatchExpressions})
+	if err != nil {
+		// Set has validated the expressions, so this should not happen.
+		return false
+	}
+	return selector.Matches(labels.Set(nodeLabels))
 }
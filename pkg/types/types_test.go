@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeSelector(t *testing.T) {
+	testcases := map[string]struct {
+		value       string
+		expectError bool
+		expectValue string
+		matches     map[string]string
+		noMatch     map[string]string
+	}{
+		"map": {
+			value:       `{"storage":"pmem"}`,
+			expectValue: `{"storage":"pmem"}`,
+			matches:     map[string]string{"storage": "pmem", "foo": "bar"},
+			noMatch:     map[string]string{"storage": "optane"},
+		},
+		"match-labels": {
+			value:       `{"matchLabels":{"storage":"pmem"}}`,
+			expectValue: `{"storage":"pmem"}`,
+			matches:     map[string]string{"storage": "pmem"},
+			noMatch:     map[string]string{},
+		},
+		"match-expressions": {
+			value:       `{"matchLabels":{"zone":"a"},"matchExpressions":[{"key":"storage","operator":"In","values":["pmem","optane"]}]}`,
+			expectValue: `{"matchLabels":{"zone":"a"},"matchExpressions":[{"key":"storage","operator":"In","values":["pmem","optane"]}]}`,
+			matches:     map[string]string{"storage": "optane", "zone": "a"},
+			noMatch:     map[string]string{"storage": "optane"},
+		},
+		"invalid-operator": {
+			value:       `{"matchExpressions":[{"key":"storage","operator":"Like"}]}`,
+			expectError: true,
+		},
+		"invalid-json": {
+			value:       `"storage=pmem"`,
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var nodeSelector NodeSelector
+			err := nodeSelector.Set(tc.value)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectValue, nodeSelector.String())
+			assert.True(t, nodeSelector.MatchesLabels(tc.matches), "matches %v", tc.matches)
+			assert.False(t, nodeSelector.MatchesLabels(tc.noMatch), "matches %v", tc.noMatch)
+		})
+	}
+}
@@ -106,6 +106,7 @@ var _ = deploy.Describe("direct-testing", "direct-testing-metrics", "", func(d *
 									// Only the node driver implements CSI and manages volumes.
 									expect(ContainSubstring("csi_plugin_operations_seconds "), name)
 									expect(ContainSubstring("pmem_amount_available "), name)
+									expect(ContainSubstring("pmem_amount_physically_available "), name)
 									expect(ContainSubstring("pmem_amount_managed "), name)
 									expect(ContainSubstring("pmem_amount_max_volume_size "), name)
 									expect(ContainSubstring("pmem_amount_total "), name)
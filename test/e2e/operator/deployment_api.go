@@ -822,6 +822,7 @@ var _ = deploy.DescribeForSome("API", func(d *deploy.Deployment) bool {
 					obj := getter(&dep)
 					delete(obj)
 					ensureObjectRecovered(obj)
+					validateEvents(&deployment, []string{api.EventReasonDriftReverted}, "drift event")
 					err := validate.DriverDeployment(ctx, client, k8sver, d.Namespace, deployment)
 					Expect(err).ShouldNot(HaveOccurred(), "validate driver after object recover")
 				})
@@ -882,6 +883,7 @@ var _ = deploy.DescribeForSome("API", func(d *deploy.Deployment) bool {
 					Eventually(func() error {
 						return validate.DriverDeployment(ctx, client, k8sver, d.Namespace, deployment)
 					}, "2m", "1s").ShouldNot(HaveOccurred(), fmt.Sprintf("recovered %s", name))
+					validateEvents(&deployment, []string{api.EventReasonDriftReverted}, "drift event")
 				})
 			}
 		})
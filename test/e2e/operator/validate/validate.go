@@ -27,6 +27,7 @@ import (
 
 	cm "github.com/prometheus/client_model/go"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
@@ -257,6 +258,15 @@ func DriverDeployment(ctx context.Context, c client.Client, k8sver version.Versi
 				diffs = append(diffs, fmt.Sprintf("label %s of %s is wrong: expected %q, got %q", key, prettyPrintObjectID(*expected), value, actualValue))
 			}
 		}
+		actualAnnotations := actual.GetAnnotations()
+		for key, value := range expected.GetAnnotations() {
+			actualValue, found := actualAnnotations[key]
+			if !found {
+				diffs = append(diffs, fmt.Sprintf("annotation %s missing for %s", key, prettyPrintObjectID(*expected)))
+			} else if actualValue != value {
+				diffs = append(diffs, fmt.Sprintf("annotation %s of %s is wrong: expected %q, got %q", key, prettyPrintObjectID(*expected), value, actualValue))
+			}
+		}
 
 		// Certain top-level fields must be identical.
 		fields := map[string]bool{}
@@ -361,6 +371,8 @@ Deployment:` + defaultsApps + `
     strategy: ignore
 StatefulSet:` + defaultsApps + `
     updateStrategy: ignore
+StorageClass:
+  reclaimPolicy: Delete
 CSIDriver:
   spec:
     storageCapacity: false
@@ -545,12 +557,16 @@ func listAllDeployedObjects(ctx context.Context, c client.Client, deployment api
 		// Test client does not support differentiating cluster-scoped objects
 		// and the query fails when fetch those object by setting the namespace-
 		switch list.GetKind() {
-		case "CSIDriverList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList":
+		case "CSIDriverList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList", "StorageClassList":
 			opts = &client.ListOptions{}
 		}
 		// Filtering by owner doesn't work, so we have to use brute-force and look at all
 		// objects.
 		if err := c.List(ctx, list, opts); err != nil {
+			if meta.IsNoMatchError(err) {
+				// Optional CRD not installed.
+				continue
+			}
 			return objects, fmt.Errorf("list %s: %v", list.GetObjectKind(), err)
 		}
 	outer: